@@ -0,0 +1,273 @@
+// Package adaptive counts unique IPv4 addresses with per-worker hash sets
+// while the input has few of them, and switches to the concurrent engine's
+// sharded bitset once the sets grow past a threshold. Small inputs never
+// pay for bitset shards; large ones stop growing maps long before they
+// would outgrow the 512 MB bitset.
+package adaptive
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	// DefaultThreshold is the combined hash set size that triggers the
+	// switch: about 40 MB of maps, where a bitset with every shard touched
+	// starts to be cheaper per address.
+	DefaultThreshold = 1 << 20
+
+	bytesPerChunk = 2 * 1024 * 1024 // read chunk size
+	setEntryBytes = 40              // approximate hash set cost per entry
+)
+
+// Options configures an AdaptiveCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+	Workers int                // goroutines parsing the input, 0 for runtime.NumCPU()
+
+	// Threshold is the combined size of the workers' hash sets at which
+	// they are migrated into a bitset; 0 means DefaultThreshold. Sets may
+	// hold the same address more than once, so the switch can come before
+	// the input has Threshold distinct addresses.
+	Threshold int
+
+	// MaxMem caps the memory of a count, 0 for no cap: the sets switch
+	// once their entries, about 40 bytes each, would pass it if Threshold
+	// has not come first, and the bitset gets it as its shard budget. An
+	// input whose addresses outgrow the bitset's share fails with
+	// counter.ErrMemBudget.
+	MaxMem int64
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the switch point and oversized lines, nil to discard
+}
+
+func init() {
+	counter.Register("adaptive", func(o counter.Options) (counter.Counter, error) {
+		return NewWithOptions(Options{Parse: o.Parse, MaxLine: o.MaxLine, Workers: o.Workers, Threshold: o.AdaptiveThreshold,
+			MaxMem: o.MaxMem, Stats: o.Stats, Progress: o.Progress}), nil
+	})
+}
+
+// AdaptiveCounter counts unique IPs in hash sets that upgrade to a bitset.
+type AdaptiveCounter struct {
+	opts Options
+}
+
+// New creates an AdaptiveCounter with DefaultThreshold.
+func New() *AdaptiveCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates an AdaptiveCounter with the given options.
+func NewWithOptions(opts Options) *AdaptiveCounter {
+	opts.Threshold = cmp.Or(opts.Threshold, DefaultThreshold)
+	if opts.MaxMem > 0 {
+		opts.Threshold = int(min(int64(opts.Threshold), max(1, opts.MaxMem/setEntryBytes)))
+	}
+	return &AdaptiveCounter{opts: opts}
+}
+
+// CountUniqueIPs counts distinct IPv4s in a file.
+func (c *AdaptiveCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation.
+func (c *AdaptiveCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(ctx, file)
+}
+
+// run is the state shared by the workers of one CountReader call.
+type run struct {
+	size     atomic.Int64 // combined hash set size
+	upgraded atomic.Bool  // set once size crosses the threshold
+	once     sync.Once
+	opts     concurrent.Options        // of bitset, checked as the run starts
+	bitset   *concurrent.BitsetCounter // allocated on upgrade, under MaxMem
+	added    atomic.Int64              // bits newly set in bitset
+}
+
+// worker is one worker's view of the run: its private hash set until it
+// migrates, the shared bitset afterwards.
+type worker struct {
+	run  *run
+	set  map[uint32]struct{}
+	bits *concurrent.BitsetCounter // nil until this worker has migrated
+}
+
+// CountReader counts distinct IPv4s read from r. Every worker fills its
+// own hash set and adds its growth to a shared size after each chunk. The
+// worker that pushes the size past the threshold allocates the bitset and
+// flags the upgrade; from then on each worker, at its next chunk boundary,
+// adds its set's entries to the bitset and drops the set. A set is only
+// ever touched by its owner, so no entry is lost while others keep
+// working, and the bitset's Add reports each address as new exactly once,
+// so nothing is counted twice.
+func (c *AdaptiveCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	cr := utils.NewDelimChunkReader(c.opts.Progress.Reader(r), bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+
+	numWorkers := cmp.Or(c.opts.Workers, runtime.NumCPU())
+	st := &run{opts: concurrent.Options{MaxMem: c.opts.MaxMem, Workers: numWorkers, ChunkSize: bytesPerChunk}}
+	if err := st.opts.Validate(); err != nil {
+		return 0, fmt.Errorf("adaptive: %w", err)
+	}
+	chunkChan := make(chan utils.Chunk, numWorkers*2)
+	workers := make([]*worker, numWorkers)
+	var oversized atomic.Int64
+	var wg sync.WaitGroup
+	for i := range workers {
+		w := &worker{run: st, set: make(map[uint32]struct{})}
+		workers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ch := range chunkChan {
+				if ctx.Err() == nil {
+					oversized.Add(c.processChunk(ch.Data, maxLine, w))
+				}
+				cr.Release(ch)
+			}
+		}()
+	}
+
+	// Producer: errors only break out of the loop so the workers are
+	// always shut down
+	var readErr error
+	for ctx.Err() == nil {
+		ch, err := cr.Next()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		chunkChan <- ch
+	}
+	close(chunkChan)
+	wg.Wait()
+	c.opts.Stats.Set("oversized lines", "%d", oversized.Load()+cr.Oversized())
+	if readErr != nil {
+		return 0, counter.WrapRead("", readErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if st.upgraded.Load() {
+		// Workers that saw no chunk after the upgrade still hold a set
+		for _, w := range workers {
+			w.migrate()
+		}
+		if err := st.bitset.BudgetErr(); err != nil {
+			return 0, err
+		}
+		c.opts.Stats.Set("adaptive", "switched to the bitset past %d hash set entries", c.opts.Threshold)
+		return st.added.Load(), nil
+	}
+	c.opts.Stats.Set("adaptive", "stayed with hash sets (%d entries, threshold %d)", st.size.Load(), c.opts.Threshold)
+	return union(workers), nil
+}
+
+// processChunk adds every valid line in chunk to w and returns how many
+// lines were skipped for exceeding maxLine.
+func (c *AdaptiveCounter) processChunk(chunk []byte, maxLine int, w *worker) int64 {
+	if w.bits == nil && w.run.upgraded.Load() {
+		w.migrate()
+	}
+	before := len(w.set)
+	var oversized, added int64
+	delim := c.opts.Parse.Delim()
+	for data := chunk; len(data) > 0; {
+		var raw []byte
+		raw, data = utils.NextRecord(data, delim)
+		if len(raw) > maxLine {
+			oversized++
+			continue
+		}
+		line := c.opts.Parse.Trim(raw)
+		if len(line) == 0 {
+			continue
+		}
+		first, last, form, err := c.opts.Parse.ParseForm(raw, line)
+		if err != nil {
+			c.opts.Parse.Malformed.Add(line, err)
+			continue
+		}
+		c.opts.Parse.Canon.Add(first, last, form)
+		if w.bits != nil {
+			added += w.bits.AddRange(first, last)
+			continue
+		}
+		for ip := first; ; ip++ {
+			w.set[ip] = struct{}{}
+			if ip == last {
+				break
+			}
+		}
+	}
+	if w.bits != nil {
+		w.run.added.Add(added)
+		return oversized
+	}
+	if w.run.size.Add(int64(len(w.set)-before)) >= int64(c.opts.Threshold) {
+		w.run.once.Do(func() {
+			w.run.bitset, _ = concurrent.NewWithOptions(w.run.opts) // checked as the run started
+			w.run.upgraded.Store(true)
+		})
+	}
+	return oversized
+}
+
+// migrate moves w's hash set into the shared bitset, once.
+func (w *worker) migrate() {
+	if w.bits != nil {
+		return
+	}
+	w.bits = w.run.bitset
+	var added int64
+	for ip := range w.set {
+		if w.bits.Add(ip) {
+			added++
+		}
+	}
+	w.run.added.Add(added)
+	w.set = nil
+}
+
+// union returns the number of distinct addresses across the workers' sets.
+func union(workers []*worker) int64 {
+	largest := workers[0]
+	for _, w := range workers[1:] {
+		if len(w.set) > len(largest.set) {
+			largest = w
+		}
+	}
+	for _, w := range workers {
+		if w == largest {
+			continue
+		}
+		for ip := range w.set {
+			largest.set[ip] = struct{}{}
+		}
+		w.set = nil
+	}
+	return int64(len(largest.set))
+}
@@ -0,0 +1,84 @@
+package adaptive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// input returns lines addresses of a /12, many repeated, and how many
+// distinct ones there are.
+func input(lines int) (string, int64) {
+	rng := rand.New(rand.NewPCG(21, 22))
+	var b strings.Builder
+	seen := make(map[uint32]bool)
+	for range lines {
+		ip := 10<<24 | rng.Uint32N(1<<20)
+		if rng.IntN(2) == 0 {
+			ip = 192<<24 | 168<<16 | rng.Uint32N(1<<8)
+		}
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	return b.String(), int64(len(seen))
+}
+
+// The count is the same whether the sets stay below the threshold or are
+// migrated into the bitset, and the stats say which happened.
+func TestThreshold(t *testing.T) {
+	in, want := input(50000)
+	for _, tc := range []struct {
+		threshold int
+		switched  bool
+	}{{1 << 20, false}, {int(want) + 1, false}, {int(want) / 2, true}, {1, true}} {
+		stats := new(counter.Stats)
+		c := NewWithOptions(Options{Threshold: tc.threshold, Workers: 4, Stats: stats})
+		n, err := c.CountReader(context.Background(), strings.NewReader(in))
+		if err != nil || n != want {
+			t.Errorf("threshold %d: %d, %v, want %d", tc.threshold, n, err, want)
+		}
+		if got := strings.Contains(stats.String(), "switched to the bitset"); got != tc.switched {
+			t.Errorf("threshold %d: switched %v, want %v (%s)", tc.threshold, got, tc.switched, stats)
+		}
+	}
+}
+
+// Workers migrate their sets into the bitset while others still parse
+// into theirs; with -race this checks the handover, and every address is
+// counted once.
+func TestConcurrentMigration(t *testing.T) {
+	in, want := input(1_500_000) // several read chunks
+	for _, threshold := range []int{1000, 200000} {
+		c := NewWithOptions(Options{Threshold: threshold, Workers: 8})
+		for run := range 2 {
+			n, err := c.CountReader(context.Background(), strings.NewReader(in))
+			if err != nil || n != want {
+				t.Errorf("threshold %d, run %d: %d, %v, want %d", threshold, run, n, err, want)
+			}
+		}
+	}
+}
+
+// A budget moves the switch earlier and caps the bitset: one it fits
+// counts as usual, one too small for the addresses fails the count.
+func TestMaxMem(t *testing.T) {
+	in, want := input(50000)
+	stats := new(counter.Stats)
+	c := NewWithOptions(Options{MaxMem: 1 << 30, Workers: 2, Stats: stats})
+	if n, err := c.CountReader(context.Background(), strings.NewReader(in)); err != nil || n != want {
+		t.Errorf("ample budget: %d, %v, want %d", n, err, want)
+	}
+	c = NewWithOptions(Options{MaxMem: 256 << 10, Workers: 2, Stats: stats})
+	if c.opts.Threshold > 256<<10/setEntryBytes {
+		t.Errorf("threshold %d under a 256 KB budget", c.opts.Threshold)
+	}
+	if _, err := c.CountReader(context.Background(), strings.NewReader(in)); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("256 KB budget: %v, want ErrMemBudget", err)
+	}
+}
@@ -0,0 +1,281 @@
+// Package asn attributes IPv4 addresses to their origin AS with a
+// prefix-to-AS table in the CAIDA Routeviews style. Overlapping prefixes
+// are flattened into sorted, disjoint address ranges that each carry the
+// AS of their most specific prefix, so a lookup is one binary search and
+// allocates nothing.
+package asn
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Unknown is the key of addresses no prefix covers.
+const Unknown = "unknown"
+
+// ErrBadTable is returned for table lines that cannot be parsed.
+var ErrBadTable = errors.New("malformed prefix-to-AS table")
+
+// Table maps addresses to origin AS numbers.
+type Table struct {
+	starts []uint32 // first address of each range, ascending
+	ends   []uint32 // last address of each range
+	asns   []uint32 // index into names of each range's AS
+	names  []string // AS as written in the table, e.g. "13335" or "64500_64501"
+}
+
+// prefix is one parsed table line, packed so sorting is one integer
+// compare: start in the high 32 bits, then the length and the entry's
+// position in the table, so among identical prefixes the last one wins.
+type prefix struct {
+	key uint64
+	asn uint32 // index into names
+}
+
+const (
+	bitsShift = 26             // key bits below the prefix length
+	maxLines  = 1 << bitsShift // table entries the key can order
+)
+
+func (p prefix) start() uint32 { return uint32(p.key >> 32) }
+
+// end returns the last address of p; uint64 so /0 does not overflow.
+func (p prefix) end() uint64 {
+	bits := p.key >> bitsShift & 63
+	return uint64(p.start()) + 1<<(32-bits) - 1
+}
+
+// Load reads the table at path.
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open asn table: %w", err)
+	}
+	defer f.Close()
+	t, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("asn table %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Read parses a table with one "prefix/len asn" or "prefix len asn" entry
+// per line, fields separated by whitespace. Blank lines and lines starting
+// with '#' are skipped. The AS field is kept verbatim, so multi-origin
+// entries like "64500_64501" or AS sets stay distinct keys.
+func Read(r io.Reader) (*Table, error) {
+	var (
+		prefixes []prefix
+		names    []string
+		index    = make(map[string]uint32)
+	)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if len(prefixes) == maxLines {
+			return nil, fmt.Errorf("%w: more than %d entries", ErrBadTable, maxLines)
+		}
+		p, name, err := parseLine(line, len(prefixes))
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrBadTable, n, err)
+		}
+		id, ok := index[string(name)]
+		if !ok {
+			id = uint32(len(names))
+			names = append(names, string(name))
+			index[names[id]] = id
+		}
+		p.asn = id
+		prefixes = append(prefixes, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	t := &Table{names: names}
+	t.flatten(prefixes)
+	return t, nil
+}
+
+// parseLine splits the seq-th table entry into its prefix and AS field.
+func parseLine(line []byte, seq int) (prefix, []byte, error) {
+	var fields [3][]byte
+	n := 0
+	for rest := line; len(rest) > 0 && n < len(fields); n++ {
+		end := bytes.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		fields[n], rest = rest[:end], bytes.TrimLeft(rest[end:], " \t")
+		if n == len(fields)-1 && len(rest) > 0 {
+			n = -1 // too many fields
+			break
+		}
+	}
+	var addr, length, name []byte
+	switch {
+	case n == 2 && bytes.IndexByte(fields[0], '/') >= 0:
+		addr, length, _ = bytes.Cut(fields[0], []byte("/"))
+		name = fields[1]
+	case n == 3:
+		addr, length, name = fields[0], fields[1], fields[2]
+	default:
+		return prefix{}, nil, fmt.Errorf("want \"prefix/len asn\" or \"prefix len asn\", got %q", line)
+	}
+	ip, err := utils.ParseIPv4(addr)
+	if err != nil {
+		return prefix{}, nil, err
+	}
+	bits, err := strconv.Atoi(string(length))
+	if err != nil || bits < 0 || bits > 32 {
+		return prefix{}, nil, fmt.Errorf("bad prefix length %q", length)
+	}
+	mask := uint32(0)
+	if bits > 0 {
+		mask = ^uint32(0) << (32 - bits)
+	}
+	return prefix{key: uint64(ip&mask)<<32 | uint64(bits)<<bitsShift | uint64(seq)}, name, nil
+}
+
+// flatten turns possibly nested prefixes into disjoint ranges. Sorted by
+// start and then from least to most specific, prefixes nest like brackets:
+// a stack holds the prefixes covering the current position, and its top,
+// the most specific, owns each range until it ends or a more specific
+// prefix opens.
+func (t *Table) flatten(prefixes []prefix) {
+	slices.SortFunc(prefixes, func(a, b prefix) int { return cmp.Compare(a.key, b.key) })
+	var stack []prefix
+	var cursor uint64 // first address not yet assigned to a range
+	emit := func(end uint64, asn uint32) {
+		if cursor > end {
+			return
+		}
+		if n := len(t.starts); n > 0 && t.asns[n-1] == asn && uint64(t.ends[n-1])+1 == cursor {
+			t.ends[n-1] = uint32(end) // extend an adjacent range of the same AS
+		} else {
+			t.starts = append(t.starts, uint32(cursor))
+			t.ends = append(t.ends, uint32(end))
+			t.asns = append(t.asns, asn)
+		}
+		cursor = end + 1
+	}
+	closeBefore := func(limit uint64) {
+		for len(stack) > 0 && stack[len(stack)-1].end() < limit {
+			top := stack[len(stack)-1]
+			emit(top.end(), top.asn)
+			stack = stack[:len(stack)-1]
+		}
+	}
+	for _, p := range prefixes {
+		start := uint64(p.start())
+		closeBefore(start)
+		if len(stack) > 0 && start > cursor {
+			emit(start-1, stack[len(stack)-1].asn)
+		}
+		cursor = max(cursor, start)
+		stack = append(stack, p)
+	}
+	closeBefore(1 << 32)
+}
+
+// Len returns the number of disjoint ranges the table flattened into.
+func (t *Table) Len() int {
+	return len(t.starts)
+}
+
+// Lookup returns the AS of ip's most specific prefix, or Unknown. It does
+// not allocate.
+func (t *Table) Lookup(ip uint32) string {
+	if i := t.find(ip); i >= 0 {
+		return t.names[t.asns[i]]
+	}
+	return Unknown
+}
+
+// find returns the index of the range holding ip, or -1.
+func (t *Table) find(ip uint32) int {
+	// Largest start <= ip
+	lo, hi := 0, len(t.starts)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if t.starts[mid] <= ip {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if i := lo - 1; i >= 0 && ip <= t.ends[i] {
+		return i
+	}
+	return -1
+}
+
+// Breakdown counts the addresses each yields per AS. each should call fn
+// once for every distinct address, as concurrent.BitsetCounter.Range does;
+// addresses in ascending order, as Range yields them, mostly fall in the
+// range of the previous one and skip the search.
+func (t *Table) Breakdown(each func(fn func(ip uint32) bool)) Counts {
+	perAS := make([]int64, len(t.names)+1) // last slot is Unknown
+	last := -1
+	each(func(ip uint32) bool {
+		if last < 0 || ip < t.starts[last] || ip > t.ends[last] {
+			last = t.find(ip)
+		}
+		if i := last; i >= 0 {
+			perAS[t.asns[i]]++
+		} else {
+			perAS[len(t.names)]++
+		}
+		return true
+	})
+	counts := make(Counts)
+	for id, n := range perAS {
+		if n == 0 {
+			continue
+		}
+		if id == len(t.names) {
+			counts[Unknown] = n
+		} else {
+			counts[t.names[id]] = n
+		}
+	}
+	return counts
+}
+
+// Counts maps AS numbers, and Unknown, to unique address counts.
+type Counts map[string]int64
+
+// Sorted returns the AS keys by descending count, ties by key.
+func (c Counts) Sorted() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(c[b], c[a]), cmp.Compare(a, b))
+	})
+	return keys
+}
+
+// String formats the counts as "asn,unique_count" CSV with a header,
+// largest first.
+func (c Counts) String() string {
+	var sb strings.Builder
+	sb.WriteString("asn,unique_count")
+	for _, k := range c.Sorted() {
+		fmt.Fprintf(&sb, "\n%s,%d", k, c[k])
+	}
+	return sb.String()
+}
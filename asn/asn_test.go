@@ -0,0 +1,105 @@
+package asn
+
+import (
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// table nests prefixes three deep, repeats one with a later AS, and
+// touches both ends of the address space.
+const table = `# prefix/len asn
+10.0.0.0/8	64500
+10.1.0.0/16	64501
+10.1.2.0/24	64502
+10.1.2.128 25 64503
+192.168.0.0/24	64510
+192.168.0.0/24	64511
+0.0.0.0/32	64520
+255.255.255.0/24	64530
+
+1.0.0.0/24	13335_64540
+`
+
+// Every lookup at either edge of a prefix, and just outside it, lands on
+// the most specific prefix covering the address.
+func TestLookup(t *testing.T) {
+	tab, err := Read(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"0.0.0.0":         "64520",
+		"0.0.0.1":         Unknown,
+		"0.255.255.255":   Unknown,
+		"1.0.0.0":         "13335_64540",
+		"1.0.0.255":       "13335_64540",
+		"1.0.1.0":         Unknown,
+		"9.255.255.255":   Unknown,
+		"10.0.0.0":        "64500",
+		"10.0.255.255":    "64500",
+		"10.1.0.0":        "64501",
+		"10.1.1.255":      "64501",
+		"10.1.2.0":        "64502",
+		"10.1.2.127":      "64502",
+		"10.1.2.128":      "64503",
+		"10.1.2.255":      "64503",
+		"10.1.3.0":        "64501",
+		"10.1.255.255":    "64501",
+		"10.2.0.0":        "64500",
+		"10.255.255.255":  "64500",
+		"11.0.0.0":        Unknown,
+		"192.168.0.0":     "64511", // the later of two identical prefixes
+		"192.168.0.255":   "64511",
+		"192.168.1.0":     Unknown,
+		"255.255.254.255": Unknown,
+		"255.255.255.0":   "64530",
+		"255.255.255.255": "64530",
+	} {
+		addr, _ := utils.ParseIPv4([]byte(ip))
+		if got := tab.Lookup(addr); got != want {
+			t.Errorf("%s: %s, want %s", ip, got, want)
+		}
+	}
+	addr, _ := utils.ParseIPv4([]byte("10.1.2.200"))
+	if n := testing.AllocsPerRun(100, func() { tab.Lookup(addr) }); n != 0 {
+		t.Errorf("Lookup allocates %.0f times", n)
+	}
+}
+
+// Breakdown counts each address once under its AS, whether or not the
+// addresses come in ascending order.
+func TestBreakdown(t *testing.T) {
+	tab, err := Read(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []uint32
+	for _, s := range []string{"0.0.0.0", "10.0.0.1", "10.1.0.1", "10.1.2.1", "10.1.2.129", "10.200.0.0", "11.0.0.0", "255.255.255.255", "10.1.2.2"} {
+		ip, _ := utils.ParseIPv4([]byte(s))
+		ips = append(ips, ip)
+	}
+	got := tab.Breakdown(func(fn func(ip uint32) bool) {
+		for _, ip := range ips {
+			fn(ip)
+		}
+	})
+	want := Counts{"64520": 1, "64500": 2, "64501": 1, "64502": 2, "64503": 1, Unknown: 1, "64530": 1}
+	if !maps.Equal(got, want) {
+		t.Errorf("breakdown %v, want %v", got, want)
+	}
+	if s := got.String(); !strings.HasPrefix(s, "asn,unique_count\n64500,2\n64502,2\n") {
+		t.Errorf("CSV starts %q", s)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, line := range []string{"10.0.0.0/33 1", "10.0.0.0 1", "10.0.0/8 1", "10.0.0.0/8 1 2"} {
+		if _, err := Read(strings.NewReader(line)); !errors.Is(err, ErrBadTable) {
+			t.Errorf("%q: %v, want ErrBadTable", line, err)
+		}
+	}
+}
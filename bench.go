@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// benchRun is one timed run of one engine.
+type benchRun struct {
+	engine     string
+	run        int
+	elapsed    time.Duration
+	mbps       float64
+	linesPerS  float64
+	peakHeap   uint64
+	peakRSS    int64  // 0 where the high-water mark cannot be reset
+	allocs     uint64 // heap objects allocated
+	allocBytes uint64
+	gcs        uint32
+	count      int64
+	estimate   bool
+}
+
+// runBench implements `ipcounter bench`: run each selected engine -runs
+// times on the same file and report wall time, throughput in MB and lines
+// per second, peak heap and RSS, allocations and the count. Run 1 of the
+// first engine is the only one that may start with a cold page cache, so
+// runs are labeled by index rather than averaged. With -chunk-sizes the
+// concurrent engine runs once per size, each listed as its own engine, to
+// find the best -chunk-size for a disk. The exact engines must agree on
+// the count; sketches are listed with theirs.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	impls := fs.String("impl", "concurrent,bucket", "comma-separated engines to run")
+	runs := fs.Int("runs", 3, "runs per engine")
+	format := fs.String("format", "table", "output format: table|csv")
+	sweep := fs.String("chunk-sizes", "", "concurrent: comma-separated chunk sizes to compare, e.g. 256KB,2MB,8MB (overrides -chunk-size)")
+	ef := addEngineFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter bench [flags] <filename>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *runs < 1 {
+		return errors.New("-runs must be at least 1")
+	}
+	filename := fs.Arg(0)
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	if opts.MaxReadRate > 0 {
+		return errors.New("bench times the engines flat out; -max-read-mbps does not apply")
+	}
+	// Every run rereads the input, so a pipe is spooled once up front
+	filename, cleanup, err := counter.Spool(context.Background(), filename, opts.TempDir, opts.Logger)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	st, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	lines, err := benchLines(filename, st.Size(), opts)
+	if err != nil {
+		return err
+	}
+
+	var results []benchRun
+	if opts.InputFormat == "pcap" || opts.InputFormat == "parquet" {
+		return fmt.Errorf("bench cannot read -input-format %s; count the file with the main command", opts.InputFormat)
+	}
+	sizes, err := parseChunkSizes(*sweep)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(*impls, ",") {
+		if counter.BinaryOrder(opts.InputFormat) != nil && name != "concurrent" {
+			return fmt.Errorf("-input-format %s needs -impl concurrent, got %s", opts.InputFormat, name)
+		}
+		variants := []chunkSize{{n: opts.ChunkSize}}
+		if name == "concurrent" && sizes != nil {
+			variants = sizes
+		}
+		for _, size := range variants {
+			label := name
+			if size.text != "" {
+				label = name + "@" + size.text
+			}
+			o := opts
+			o.ChunkSize = size.n
+			for i := 1; i <= *runs; i++ {
+				c, err := counter.NewWithOptions(name, o)
+				if err != nil {
+					return err
+				}
+				r, err := benchOnce(c, filename, st.Size(), lines)
+				if err != nil {
+					return fmt.Errorf("%s run %d: %w", label, i, err)
+				}
+				r.engine, r.run = label, i
+				results = append(results, r)
+			}
+		}
+	}
+
+	if *format == "csv" {
+		err = writeBenchCSV(os.Stdout, results)
+	} else {
+		writeBenchTable(results)
+	}
+	if err != nil {
+		return err
+	}
+
+	var exact *benchRun
+	for i, r := range results {
+		switch {
+		case r.estimate:
+		case exact == nil:
+			exact = &results[i]
+		case r.count != exact.count:
+			fmt.Fprintf(os.Stderr, "!!! COUNT MISMATCH: %s run %d counted %d, %s run %d counted %d\n",
+				r.engine, r.run, r.count, exact.engine, exact.run, exact.count)
+			os.Exit(2)
+		}
+	}
+	return nil
+}
+
+// benchLines returns the records in the file, lines of text or 4-byte
+// addresses, read once up front so every engine's lines per second are of
+// the same number whether or not it counts lines itself.
+func benchLines(filename string, size int64, opts counter.Options) (int64, error) {
+	if counter.BinaryOrder(opts.InputFormat) != nil {
+		return size / 4, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	delim := opts.Parse.Delim()
+	buf := make([]byte, 1<<20)
+	var n int64
+	var last byte
+	for {
+		m, err := f.Read(buf)
+		n += int64(bytes.Count(buf[:m], []byte{delim}))
+		if m > 0 {
+			last = buf[m-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if size > 0 && last != delim {
+		n++ // an unterminated last line
+	}
+	return n, nil
+}
+
+// chunkSize is one -chunk-sizes entry, labeled as the user wrote it.
+type chunkSize struct {
+	n    int
+	text string
+}
+
+// parseChunkSizes parses a -chunk-sizes list, or returns nil for an empty
+// one.
+func parseChunkSizes(s string) ([]chunkSize, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var sizes []chunkSize
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		n, err := counter.ParseBytes(f)
+		if err != nil {
+			return nil, fmt.Errorf("-chunk-sizes: %w", err)
+		}
+		if err := (concurrent.Options{ChunkSize: int(n)}).Validate(); err != nil || n == 0 {
+			return nil, fmt.Errorf("-chunk-sizes: %s must be between %s and %s", f,
+				counter.FormatBytes(concurrent.MinChunkSize), counter.FormatBytes(concurrent.MaxChunkSize))
+		}
+		sizes = append(sizes, chunkSize{n: int(n), text: f})
+	}
+	return sizes, nil
+}
+
+// benchOnce runs c once on filename, of size bytes and lines records,
+// while sampling the heap for its peak. The heap is collected and
+// returned to the OS first, and the RSS high-water mark reset, so each
+// run is measured from the same start.
+func benchOnce(c counter.Counter, filename string, size, lines int64) (benchRun, error) {
+	debug.FreeOSMemory()
+	rssReset := counter.ResetPeakRSS()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	sampler := counter.StartMemSampler(10 * time.Millisecond)
+	start := time.Now()
+	n, err := c.CountUniqueIPs(filename)
+	elapsed := time.Since(start)
+	peak := sampler.Stop()
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		return benchRun{}, err
+	}
+	r := benchRun{
+		elapsed:    elapsed,
+		mbps:       float64(size) / (1 << 20) / elapsed.Seconds(),
+		linesPerS:  float64(lines) / elapsed.Seconds(),
+		peakHeap:   peak.HeapAlloc,
+		allocs:     after.Mallocs - before.Mallocs,
+		allocBytes: after.TotalAlloc - before.TotalAlloc,
+		gcs:        after.NumGC - before.NumGC,
+		count:      n,
+	}
+	if rssReset {
+		r.peakRSS = peak.RSS
+	}
+	_, r.estimate = c.(counter.Estimator)
+	return r, nil
+}
+
+func writeBenchTable(results []benchRun) {
+	fmt.Printf("%-18s %4s %12s %10s %12s %12s %12s %12s %12s %5s %14s\n",
+		"engine", "run", "wall", "MB/s", "lines/s", "peak heap", "peak rss", "allocs", "alloc bytes", "GCs", "count")
+	for _, r := range results {
+		fmt.Printf("%-18s %4d %12s %10.1f %12.0f %12s %12s %12d %12s %5d %14s\n", r.engine, r.run, r.elapsed.Round(time.Millisecond),
+			r.mbps, r.linesPerS, counter.FormatBytes(int64(r.peakHeap)), benchRSS(r.peakRSS), r.allocs,
+			counter.FormatBytes(int64(r.allocBytes)), r.gcs, benchCount(r))
+	}
+	fmt.Println()
+	fmt.Printf("%-18s %12s %10s %12s %12s\n", "engine", "median wall", "MB/s", "lines/s", "peak rss")
+	for _, name := range benchEngines(results) {
+		var walls []time.Duration
+		var mbps, lps []float64
+		var rss int64
+		for _, r := range results {
+			if r.engine == name {
+				walls = append(walls, r.elapsed)
+				mbps = append(mbps, r.mbps)
+				lps = append(lps, r.linesPerS)
+				rss = max(rss, r.peakRSS)
+			}
+		}
+		sort.Slice(walls, func(i, j int) bool { return walls[i] < walls[j] })
+		sort.Float64s(mbps)
+		sort.Float64s(lps)
+		fmt.Printf("%-18s %12s %10.1f %12.0f %12s\n", name, walls[len(walls)/2].Round(time.Millisecond),
+			mbps[len(mbps)/2], lps[len(lps)/2], benchRSS(rss))
+	}
+}
+
+// benchRSS formats a peak RSS, "-" where it is unknown.
+func benchRSS(rss int64) string {
+	if rss == 0 {
+		return "-"
+	}
+	return counter.FormatBytes(rss)
+}
+
+// benchCount formats the count of r, marking an estimate.
+func benchCount(r benchRun) string {
+	if r.estimate {
+		return fmt.Sprintf("~%d", r.count)
+	}
+	return strconv.FormatInt(r.count, 10)
+}
+
+func writeBenchCSV(f *os.File, results []benchRun) error {
+	w := csv.NewWriter(f)
+	w.Write([]string{"engine", "run", "wall_ms", "mb_per_s", "peak_heap_bytes", "count",
+		"lines_per_s", "peak_rss_bytes", "allocs", "alloc_bytes", "gcs", "estimate"})
+	for _, r := range results {
+		w.Write([]string{
+			r.engine,
+			strconv.Itoa(r.run),
+			strconv.FormatInt(r.elapsed.Milliseconds(), 10),
+			strconv.FormatFloat(r.mbps, 'f', 1, 64),
+			strconv.FormatUint(r.peakHeap, 10),
+			strconv.FormatInt(r.count, 10),
+			strconv.FormatFloat(r.linesPerS, 'f', 0, 64),
+			strconv.FormatInt(r.peakRSS, 10),
+			strconv.FormatUint(r.allocs, 10),
+			strconv.FormatUint(r.allocBytes, 10),
+			strconv.FormatUint(uint64(r.gcs), 10),
+			strconv.FormatBool(r.estimate),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// benchEngines returns the engine names in first-run order.
+func benchEngines(results []benchRun) []string {
+	var names []string
+	for _, r := range results {
+		if len(names) == 0 || names[len(names)-1] != r.engine {
+			names = append(names, r.engine)
+		}
+	}
+	return names
+}
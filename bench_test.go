@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Lines per second are of every record, an unterminated last line and
+// NUL-delimited ones included, and of 4-byte addresses in binary input.
+func TestBenchLines(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		opts counter.Options
+		want int64
+	}{
+		{"", counter.Options{}, 0},
+		{"1.2.3.4\n5.6.7.8\n", counter.Options{}, 2},
+		{"1.2.3.4\n5.6.7.8", counter.Options{}, 2},
+		{"1.2.3.4\x005.6.7.8\x00", counter.Options{Parse: utils.ParseOptions{RecordSep: "\x00"}}, 2},
+		{"\x01\x02\x03\x04\x05\x06\x07\x08", counter.Options{InputFormat: "binary-be"}, 2},
+	} {
+		path := filepath.Join(t.TempDir(), "in")
+		if err := os.WriteFile(path, []byte(tc.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := benchLines(path, int64(len(tc.data)), tc.opts); err != nil || n != tc.want {
+			t.Errorf("%q: %d, %v; want %d", tc.data, n, err, tc.want)
+		}
+	}
+}
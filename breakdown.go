@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/asn"
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/geoip"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// breakdowns are the per-country and per-AS tables printed after a count.
+// They walk the concurrent engine's set, so each distinct address is
+// looked up once.
+type breakdowns struct {
+	geo  *geoip.DB
+	asns *asn.Table
+}
+
+// loadBreakdowns opens the databases named by -geoip and -asn-table, so a
+// missing or corrupt one fails before the input is read, and switches impl
+// to the concurrent engine whose set they range over.
+func loadBreakdowns(geoPath, asnPath string, impl *string) (*breakdowns, error) {
+	var b breakdowns
+	if geoPath == "" && asnPath == "" {
+		return &b, nil
+	}
+	switch *impl {
+	case "auto", "concurrent":
+		*impl = "concurrent"
+	default:
+		var flags []string
+		if geoPath != "" {
+			flags = append(flags, "-geoip")
+		}
+		if asnPath != "" {
+			flags = append(flags, "-asn-table")
+		}
+		return nil, fmt.Errorf("%s needs -impl concurrent, got %s", strings.Join(flags, " and "), *impl)
+	}
+	var err error
+	if geoPath != "" {
+		if b.geo, err = geoip.Open(geoPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if b.asns, err = asn.Load(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	return &b, nil
+}
+
+// print writes the requested breakdowns of c's set to stdout.
+func (b *breakdowns) print(c counter.Counter) error {
+	if b.geo == nil && b.asns == nil {
+		return nil
+	}
+	set := c.(*concurrent.BitsetCounter)
+	if b.geo != nil {
+		countries, err := b.geo.Breakdown(set.Range)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Unique IPv4 addresses by country:")
+		fmt.Println(countries)
+	}
+	if b.asns != nil {
+		fmt.Println(b.asns.Breakdown(set.Range))
+	}
+	return nil
+}
+
+// printPrefixSweep writes the -prefix-sweep table of c's set to stdout, as
+// aligned text or as one JSON object.
+func printPrefixSweep(c counter.Counter, format string) error {
+	ps, ok := c.(counter.PrefixSweeper)
+	if !ok {
+		return nil
+	}
+	counts := ps.PrefixCounts()
+	if len(counts) == 0 {
+		return nil
+	}
+	if format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			Prefixes []counter.PrefixCount `json:"prefixes"`
+		}{counts})
+	}
+	fmt.Println("Distinct prefixes:")
+	for _, p := range counts {
+		fmt.Printf("  /%-3d %d\n", p.Length, p.Unique)
+	}
+	return nil
+}
+
+// printTopSubnets writes the -by-prefix table of c's set to stdout: the
+// top busiest prefixes of length bits, all of them for top 0.
+func printTopSubnets(c counter.Counter, bits, top int) {
+	dm, ok := c.(counter.DensityMapper)
+	if bits == 0 || !ok {
+		return
+	}
+	subnets, seen := counter.TopSubnets(dm.Density(), bits, top)
+	if len(subnets) < seen {
+		fmt.Printf("Unique IPv4 addresses by /%d, top %d of %d:\n", bits, len(subnets), seen)
+	} else {
+		fmt.Printf("Unique IPv4 addresses by /%d:\n", bits)
+	}
+	for _, s := range subnets {
+		fmt.Printf("  %-18s %d\n", s.Prefix, s.Unique)
+	}
+}
+
+// printTopAddresses writes the -top-ips list of the bucket engine's last
+// run to stdout, an address and its occurrences a line.
+func printTopAddresses(c counter.Counter) {
+	b, ok := c.(*bucket.BucketCounter)
+	if !ok || b.TopAddresses() == nil {
+		return
+	}
+	fmt.Println("Most frequent IPv4 addresses:")
+	for _, a := range b.TopAddresses() {
+		fmt.Printf("  %-15s %d\n", a.Addr, a.Count)
+	}
+}
+
+// printSubsamples writes the -subsample-rates table of c's set to stdout,
+// ending with the full count as rate 1.
+func printSubsamples(c counter.Counter) {
+	s, ok := c.(counter.Subsampler)
+	if !ok {
+		return
+	}
+	counts := s.SubsampleCounts()
+	if len(counts) == 0 {
+		return
+	}
+	fmt.Println("Unique IPv4 addresses by subsample rate:")
+	for _, sc := range counts {
+		label := strconv.FormatFloat(sc.Rate, 'g', -1, 64)
+		if sc.Rate == 1 {
+			label = "full"
+		}
+		fmt.Printf("  %-8s %d\n", label, sc.Unique)
+	}
+}
+
+// printCanonReport prints, for -canon-report, the counted lines and
+// distinct addresses of each non-canonical form, and the addresses that
+// only appeared in one; nothing without a report.
+func printCanonReport(c *utils.Canonical) {
+	if c == nil {
+		return
+	}
+	fmt.Println("Counted addresses by non-canonical form:")
+	for _, r := range c.Rows() {
+		fmt.Printf("  %-14s %d lines, %d distinct addresses\n", r.Form, r.Lines, r.Addresses)
+	}
+	fmt.Printf("  %-14s %d distinct addresses\n", "only these", c.NonCanonicalOnly())
+}
+
+// writeBucketStats writes the bucket engine's per-bucket numbers to path
+// as JSON, for finding the buckets that dominate a run, renamed into
+// place once complete and fsynced with sync.
+func writeBucketStats(c counter.Counter, path string, sync bool) error {
+	b, ok := c.(*bucket.BucketCounter)
+	if !ok {
+		return fmt.Errorf("-bucket-stats needs -impl bucket")
+	}
+	data, err := json.MarshalIndent(struct {
+		Buckets []bucket.BucketStat `json:"buckets"`
+	}{b.BucketStats()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = counter.WriteFileAtomic(path, sync, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("-bucket-stats: %w", err)
+	}
+	return nil
+}
+
+// concurrentOnly returns the first flag set in opts that only the
+// concurrent engine honors, so that a count falling back to bucket would
+// drop it, or "" for none. extras is whether an output that walks the
+// concurrent set, such as -dump or a breakdown, was asked for.
+func concurrentOnly(opts counter.Options, extras bool) string {
+	switch {
+	case opts.StateFile != "":
+		return "-state-file"
+	case opts.Preload != "":
+		return "-preload"
+	case opts.AddressSpace.IsValid():
+		return "-address-space"
+	case opts.BitsetFile != "" || opts.BitsetSwap:
+		return "-bitset-file"
+	case opts.Record != "":
+		return "-record"
+	case counter.BinaryOrder(opts.InputFormat) != nil:
+		return "-input-format " + opts.InputFormat
+	case extras:
+		return "-dump, -geoip or -asn-table"
+	}
+	return ""
+}
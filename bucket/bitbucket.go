@@ -1,139 +1,760 @@
 package bucket
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/binary"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
+	"log/slog"
+	"math"
 	"os"
-	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"ipcounter/utils" 
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
 )
 
 const (
-	numBuckets    = 256            // split by top 8 bits
-	suffixBits    = 24             // per-bucket space = 2^24
-	wordsPerSet   = (1<<suffixBits + 31) / 32 // 2^24 bits / 32
-	writeBufSize  = 256 * 1024     // 256KB buffered writes
-	readBufSize   = 1 * 1024 * 1024 // 1MB buffered reads
+	writeBufSize = 256 * 1024      // 256KB buffered writes
+	readBufSize  = 1 * 1024 * 1024 // 1MB buffered reads
+
+	// DefaultMemBuffer is the per-bucket in-memory buffer; with the
+	// default 256 buckets they bound the total at 16 MB.
+	DefaultMemBuffer = 64 * 1024
+
+	// fdReserve is the open files left for stdio, the runtime and other
+	// state when fitting the bucket files under the open file limit.
+	fdReserve = 32
+	// maxGroup is the most buckets sharing a file, so a tag fits a byte.
+	maxGroup = 256
 )
 
-// CountUniqueIPs: 2-pass exact counting with disk buckets.
-// Pass 1: partition into 256 files by top byte.
-// Pass 2: per bucket, use a 2MB bitset on the 24-bit suffix.
-func CountUniqueIPs(filename string) (int64, error) {
-	// --- Pass 1: split into temp files ---
-	dir, err := os.MkdirTemp("", "ipbuckets-*")
+// Options configures a BucketCounter.
+type Options struct {
+	Parse utils.ParseOptions // accepted address forms
+
+	// MaxLine is the longest line accepted; longer ones are skipped
+	// without being buffered. 0 means utils.DefaultMaxLine.
+	MaxLine int
+
+	// Readers is the number of pass-1 workers parsing the input; 0 means
+	// runtime.NumCPU(). MaxMem may scale them down.
+	Readers int
+
+	// Workers is the number of buckets counted concurrently in pass 2,
+	// each holding one bitset; 0 means min(NumCPU, 8).
+	Workers int
+
+	// MaxBucketMem caps the size of one pass-2 bitset and so picks the
+	// Layout: the largest bitset that fits wins, trading more memory for
+	// fewer buckets. 0 means the default 256 buckets with 2 MB bitsets.
+	MaxBucketMem int64
+
+	// Partition is how pass 1 assigns addresses to buckets. With
+	// PartitionHash every bucket gets about the same share of the
+	// addresses however skewed the input, so buckets are never split,
+	// and pass 2 sorts each bucket instead of setting bits, in 4 bytes
+	// per record of the bucket for each worker; MaxMem bounds the workers
+	// to the largest bucket. It cannot be combined with CIDR lines,
+	// PrefixSweep, Density or SubsampleRates, which need buckets of
+	// contiguous addresses.
+	Partition Partition
+
+	// MemBuffer is how many bytes of records a bucket keeps in memory
+	// before it is spilled to a temp file; buckets that never overflow
+	// are counted from memory in pass 2. 0 means DefaultMemBuffer and a
+	// negative value spills every bucket.
+	MemBuffer int
+
+	// DedupCache is how many written addresses each bucket remembers in
+	// pass 1, shared by the workers, so that a repeat of one is not
+	// written again, keeping 8 bytes each; pass 2 is exact either way.
+	// An address repeated throughout the input then costs a record each
+	// time it is evicted rather than one per line. 0 means
+	// DefaultDedupCache and a negative value writes every repeat. It is
+	// off with MinOccurrences, which counts every record. KeepDir's
+	// manifest records whether it was on, and FromDir refuses such
+	// buckets to MinOccurrences and TopAddresses.
+	DedupCache int
+
+	// TempDir is where the bucket files are spilled; empty means
+	// os.TempDir. Pass 1 can write about 3 bytes per input line there.
+	TempDir string
+
+	// MaxOpenFiles caps the spill files pass 1 keeps open, as the open
+	// file limit does, for systems where that is not known, such as
+	// Windows, or is lower than it seems, as in some containers: below
+	// the bucket count, consecutive buckets share a file. 0 means as many
+	// as the limit allows.
+	MaxOpenFiles int
+
+	// SpaceCheck compares the estimated spill (about 3 bytes per line)
+	// with the free space in TempDir before pass 1 and warns by default.
+	SpaceCheck SpaceCheck
+
+	// Compress encodes spilled bucket files, trading pass-1 and pass-2
+	// CPU for less temp I/O on slow disks.
+	Compress Compression
+
+	// KeepDir, if set, is where pass 1 writes its bucket files instead of
+	// a throwaway temp dir. They are left there with a manifest so a later
+	// run can skip pass 1 with FromDir. Every bucket is spilled to disk.
+	KeepDir string
+
+	// MaxMem is a memory budget in bytes the run is sized to, 0 for none.
+	MaxMem int64
+
+	// Retries is how many times in a row pass 1 reopens the input file
+	// at the offset it reached after a transient read error, and retries
+	// a transient write to a bucket file; 0 for none.
+	Retries int
+
+	// NoCache drops the pages of the input and of the bucket files from
+	// the page cache once they are read, and of the bucket files once
+	// they are written back, so a one-shot count of a huge file does not
+	// evict everything else. Shared bucket files, read once per bucket
+	// in them, are only dropped as they are written.
+	NoCache bool
+
+	// Checkpoint, if set, makes pass 1 write a running estimate of the
+	// count every Checkpoint.Every lines or bytes, or at its Shares of the
+	// lines, from a 16 MB linear counting sketch; only the final count is
+	// exact.
+	Checkpoint counter.Checkpoint
+
+	// PrefixSweep lists the prefix lengths, 1 to 32, whose distinct
+	// prefixes PrefixCounts reports; pass 2 tallies them from each
+	// bucket's bitset before moving on.
+	PrefixSweep []int
+
+	// Density makes pass 2 keep, for Density, how many addresses of
+	// every /24 each bucket's bitset holds: 32 MB for the whole space.
+	Density bool
+
+	// SubsampleRates lists ascending rates, above 0 and at most 1, whose
+	// by-address subsamples SubsampleCounts reports; pass 2 hashes every
+	// address of each bucket's bitset once.
+	SubsampleRates []float64
+
+	// Sorted, if set, is called with every distinct address of a run in
+	// ascending order as pass 2 counts the buckets, from one goroutine at
+	// a time; an error it returns fails the run. Buckets finish out of
+	// order, so each bucket counted ahead of a lower one keeps a copy of
+	// its bitset until that one is in, and a split bucket holds up those
+	// above it until its sub-buckets are counted. It needs prefix
+	// partitioning and cannot take MinOccurrences.
+	Sorted func(ip uint32) error
+
+	// MinOccurrences, above 1, counts only addresses seen at least that
+	// many times, up to MaxMinOccurrences: pass 2 keeps a saturating
+	// counter of 2, 4, 8 or 16 bits per suffix instead of one bit, for
+	// minimums up to 3, 15, 255 and beyond, and each bucket takes that
+	// many times the memory. A CIDR line is one occurrence of every
+	// address in it. It cannot be combined with PrefixSweep, Density or
+	// SubsampleRates.
+	MinOccurrences int
+
+	// TopAddresses, above 0, lists that many of the addresses seen most
+	// often, with how many times each was, for TopAddresses: pass 2 keeps
+	// an exact 32-bit counter per suffix, 32 times a bucket's bitset, and
+	// walks each bucket's counters once it is counted. With
+	// MinOccurrences only addresses seen that many times are listed. It
+	// needs prefix partitioning, cannot be resumed and cannot be combined
+	// with PrefixSweep, Density, SubsampleRates or Sorted.
+	TopAddresses int
+
+	// VerifyCount makes pass 2 recount each bucket's bitset, or its
+	// counters, before moving on and fail with a
+	// *counter.CountMismatchError if that differs from the suffixes it
+	// counted as they were added.
+	VerifyCount bool
+
+	// MaxWriteRate caps the bytes per second pass 1 writes to the
+	// bucket files, after compression, 0 for none. Buckets kept in
+	// memory are not slowed down.
+	MaxWriteRate int64
+
+	// FromDir, if set, skips pass 1 and counts the buckets a KeepDir run
+	// left there; the input file is then optional and only checked
+	// against the manifest's recorded size.
+	FromDir string
+
+	// ResumeDir, if set, is a work directory that lets a run killed
+	// partway, by the OOM killer or a reboot, go on where it stopped
+	// instead of starting over. Pass 1 spills every bucket there as with
+	// KeepDir and every ResumeEvery bytes of input fsyncs the files and
+	// saves the input offset reached and their lengths; pass 2 records
+	// each bucket's count as it is done. Counting the same file into the
+	// same ResumeDir again cuts the files back to the last checkpoint and
+	// reads on from its offset, or counts only the buckets pass 2 had not
+	// finished. The directory is left with a manifest, as with KeepDir,
+	// and a rerun once the count is in returns it at once. Only a regular
+	// file counted by name can be resumed, and not with PrefixSweep,
+	// Density, SubsampleRates or Sorted, which need every bucket's bitset.
+	ResumeDir string
+
+	// ResumeEvery is the input bytes pass 1 of a ResumeDir run reads
+	// between checkpoints; 0 means DefaultResumeEvery.
+	ResumeEvery int64
+
+	// SplitAt is the record bytes a bucket's file reaches in pass 1
+	// before the bucket is split: its later records go to 256 sub-buckets
+	// by the address's next byte, which pass 2 counts concurrently into
+	// the bucket's bitset instead of reading one long file, keeping the
+	// count exact. 0 means DefaultSplitAt and a negative value never
+	// splits. A split needs 256 more open files, and about 16 KB of write
+	// buffer each; buckets are left whole when the open file limit has no
+	// room for them.
+	SplitAt int64
+
+	// Sync fsyncs each bucket file before it is closed and the spill
+	// directory once all are, and with KeepDir the manifest too, so a
+	// kept directory whose manifest survived a crash has every record it
+	// describes. A throwaway temp dir does not need it; it only slows the
+	// end of pass 1 down.
+	Sync bool
+
+	// Overlap starts pass 2 while pass 1 is still closing its files,
+	// counting each bucket as soon as its records are final instead of
+	// once every file is closed. It does not apply with KeepDir, whose
+	// manifest describes closed files.
+	Overlap bool
+
+	// SkewWarn is the share of the records, 0 to 1, one bucket may hold
+	// before pass 2 warns that the bucket bounds it; 0 means
+	// DefaultSkewWarn and 1 never warns. Runs of under 64 MB of records
+	// are never warned about.
+	SkewWarn float64
+
+	Progress *counter.Progress // receives the input read in pass 1 and the buckets counted in pass 2, nil for none
+	Stats    *counter.Stats    // receives the layout, spill size and oversized lines, nil to discard
+
+	// Logger receives the temp space warning, the first few lines that
+	// fail to parse, a summary of each run and, at debug level, each
+	// pass and bucket; nil for slog.Default().
+	Logger *slog.Logger
+}
+
+func init() {
+	counter.Register("bucket", func(o counter.Options) (counter.Counter, error) {
+		opts := fromCounter(o)
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("bucket: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+	counter.RegisterMinMem("bucket", func(o counter.Options) int64 {
+		return MinMem(fromCounter(o))
+	})
+}
+
+// fromCounter returns the Options of the engine-neutral o.
+func fromCounter(o counter.Options) Options {
+	check, _ := ParseSpaceCheck(o.SpaceCheck) // validated by the caller
+	compress, _ := ParseCompression(o.SpillCompress)
+	partition, _ := ParsePartition(o.BucketPartition)
+	return Options{
+		Parse:        o.Parse,
+		MaxLine:      o.MaxLine,
+		Readers:      o.Workers,
+		Workers:      o.BucketWorkers,
+		MaxBucketMem: o.BucketMaxMem,
+		MemBuffer:    o.BucketMemBuffer,
+		DedupCache:   o.BucketDedupCache,
+		TempDir:      o.TempDir,
+		SpaceCheck:   check,
+		Compress:     compress,
+		KeepDir:      o.KeepBuckets,
+		FromDir:      o.FromBuckets,
+		ResumeDir:    o.ResumeBuckets,
+		ResumeEvery:  o.ResumeEvery,
+		MaxMem:       o.MaxMem,
+		Retries:      o.ReadRetries,
+		NoCache:      o.NoCache,
+		Checkpoint:   o.Checkpoint,
+		PrefixSweep:  o.PrefixSweep,
+		Density:      o.Density,
+		Stats:        o.Stats,
+		Progress:     o.Progress,
+		Logger:       o.Logger,
+
+		MinOccurrences: o.MinOccurrences,
+		TopAddresses:   o.TopAddresses,
+		Partition:      partition,
+		VerifyCount:    o.VerifyCount,
+		MaxWriteRate:   o.MaxWriteRate,
+		SplitAt:        o.BucketSplit,
+		MaxOpenFiles:   o.BucketOpenFiles,
+		SkewWarn:       o.BucketSkewWarn,
+		Overlap:        o.BucketOverlap,
+		Sync:           o.Fsync,
+		SubsampleRates: o.SubsampleRates,
+	}
+}
+
+// BucketCounter counts unique IPs with the two-pass disk bucket method.
+type BucketCounter struct {
+	opts       Options
+	layout     Layout
+	readers    int   // pass-1 workers
+	writeBuf   int   // per-bucket write buffer
+	tally      tally // pass-2 structure for MinOccurrences
+	planErr    error // options or budget that cannot be met, returned by every run
+	log        *slog.Logger
+	skips      *counter.SkipLog         // lines of the current run that failed to parse
+	started    time.Time                // when the current run began
+	prefixes   []counter.PrefixCount    // of the last run, for PrefixCounts
+	subsamples []counter.SubsampleCount // of the last run, for SubsampleCounts
+	density    []uint16                 // of the last run, for Density
+	buckets    []BucketStat             // of the last run, for BucketStats
+	top        []AddressCount           // of the last run, for TopAddresses
+	counted    *countLog                // where a ResumeDir run's pass 2 records its buckets, nil otherwise
+
+	pass2Pool sync.Pool // *pass2Buffers of finished pass-2 workers
+}
+
+// New creates a BucketCounter with default options.
+func New() *BucketCounter {
+	return NewWithOptions(Options{})
+}
+
+// Validate reports whether o can build a BucketCounter: MaxBucketMem must
+// hold at least the smallest supported bitset.
+func (o Options) Validate() error {
+	_, err := LayoutForMem(o.MaxBucketMem)
+	return err
+}
+
+// NewWithOptions creates a BucketCounter with the given options. It panics
+// if opts fail Validate. With opts.MaxMem set, workers and buffers are
+// scaled down to fit it; a budget too small even for that makes every
+// count fail with counter.ErrMemBudget.
+func NewWithOptions(opts Options) *BucketCounter {
+	layout, err := LayoutForMem(opts.MaxBucketMem)
 	if err != nil {
-		return 0, fmt.Errorf("mkdtemp: %w", err)
+		panic("bucket: " + err.Error())
+	}
+	layout.Partition = opts.Partition
+	c := &BucketCounter{opts: opts, layout: layout, readers: cmp.Or(opts.Readers, runtime.NumCPU()), writeBuf: writeBufSize,
+		log: counter.Logger(opts.Logger)}
+	c.tally, c.planErr = tallyFor(opts.MinOccurrences)
+	if c.planErr == nil && opts.TopAddresses > 0 {
+		c.tally = tally{width: 32, min: uint32(max(opts.MinOccurrences, 1))}
+		if opts.Partition == PartitionHash || opts.ResumeDir != "" {
+			c.planErr = errors.New("bucket: a list of the most frequent addresses walks every bucket's counters in one pass 2 and needs prefix partitioning and no resume")
+		}
+	}
+	if c.planErr == nil && c.tally.width > 0 && (len(opts.PrefixSweep) > 0 || opts.Density || len(opts.SubsampleRates) > 0 || opts.Sorted != nil) {
+		c.planErr = errors.New("bucket: a prefix sweep, density map, subsample or sorted walk counts every address once and cannot take a minimum number of occurrences or a list of the most frequent addresses")
+	}
+	if c.planErr == nil && opts.Partition == PartitionHash && (opts.Parse.CIDR || len(opts.PrefixSweep) > 0 || opts.Density || len(opts.SubsampleRates) > 0 || opts.Sorted != nil) {
+		c.planErr = errors.New("bucket: CIDR lines, a prefix sweep, density map, subsample or sorted walk need buckets of contiguous addresses, not hash partitioning")
+	}
+	if c.planErr == nil && opts.ResumeDir != "" && (opts.KeepDir != "" || opts.FromDir != "") {
+		c.planErr = errors.New("bucket: a resumable run keeps its own buckets and cannot take KeepDir or FromDir")
 	}
-	defer os.RemoveAll(dir)
+	if c.planErr == nil && opts.ResumeDir != "" && (len(opts.PrefixSweep) > 0 || opts.Density || len(opts.SubsampleRates) > 0 || opts.Sorted != nil) {
+		c.planErr = errors.New("bucket: a resumed pass 2 skips the buckets counted before, so a prefix sweep, density map, subsample or sorted walk cannot be resumed")
+	}
+	if c.planErr == nil && opts.MaxMem > 0 {
+		c.planErr = c.fitBudget(opts.MaxMem)
+	}
+	return c
+}
+
+// CountUniqueIPs counts with a default BucketCounter.
+func CountUniqueIPs(filename string) (int64, error) {
+	return New().CountUniqueIPs(filename)
+}
 
-	files := make([]*os.File, numBuckets)
-	writers := make([]*bufio.Writer, numBuckets)
-	for i := 0; i < numBuckets; i++ {
-		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("b%03d.bin", i)))
+// CountUniqueIPs: 2-pass exact counting with disk buckets.
+// Pass 1: partition into files by top bits (256 by default), one suffix
+// record per line.
+// Pass 2: per bucket, use a bitset on the suffix (2MB for 24 bits).
+func (c *BucketCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation: both passes
+// stop once ctx is done and the temp dir is removed before ctx.Err() is
+// returned. A KeepDir is left without a manifest.
+func (c *BucketCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	if err := c.start(); err != nil {
+		return 0, err
+	}
+	if c.opts.FromDir != "" {
+		return c.countFromDir(ctx, filename)
+	}
+	if c.opts.ResumeDir != "" {
+		return c.countResumable(ctx, filename)
+	}
+	src, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer src.Close()
+	size := int64(-1)
+	if st, err := src.Stat(); err == nil && st.Mode().IsRegular() {
+		size = st.Size()
+	}
+	if c.opts.KeepDir == "" {
+		// Kept buckets record the input's size, so only a run that keeps
+		// nothing may skip reading it
+		lines, blank, err := counter.BlankFile(src, c.opts.Parse.Delim())
 		if err != nil {
-			return 0, fmt.Errorf("create bucket: %w", err)
+			return 0, counter.WrapRead(filename, err)
 		}
-		files[i] = f
-		w := bufio.NewWriterSize(f, writeBufSize)
-		writers[i] = w
-	}
-	// Close all writers/files at the end of pass1
-	flushClose := func() {
-		for i := 0; i < numBuckets; i++ {
-			if writers[i] != nil {
-				writers[i].Flush()
-				writers[i] = nil
-			}
-			if files[i] != nil {
-				files[i].Close()
-				files[i] = nil
-			}
+		if blank {
+			counter.NoteBlank(c.opts.Stats, c.opts.Parse, lines)
+			return c.count(ctx, bytes.NewReader(nil), filename, 0)
 		}
 	}
+	r := counter.NewRetryFile(ctx, src, c.opts.Retries, c.opts.Stats, c.log)
+	defer r.Close()
+	if c.opts.NoCache {
+		return c.count(ctx, counter.DropBehind(src, 0, r), filename, size)
+	}
+	return c.count(ctx, r, filename, size)
+}
 
-	src, err := os.Open(filename)
+// CountReader counts distinct IPv4s read from r. Pass 1 reads the input
+// once, so a stream works as well as a file; its size, for the temp space
+// check, comes from r's Size method when it has one.
+func (c *BucketCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	if err := c.start(); err != nil {
+		return 0, err
+	}
+	if c.opts.FromDir != "" || c.opts.ResumeDir != "" {
+		return 0, errors.New("bucket: kept buckets and resumable runs are counted with CountUniqueIPs")
+	}
+	size := int64(-1)
+	if s, ok := r.(interface{ Size() int64 }); ok {
+		size = s.Size()
+	}
+	return c.count(ctx, r, "", size)
+}
+
+// CountUniqueIPsFS counts distinct IPv4s in the file name of fsys, such
+// as an embed.FS or fstest.MapFS. Only the input comes from fsys; the
+// spill files still go to TempDir or KeepDir on disk.
+func (c *BucketCounter) CountUniqueIPsFS(fsys fs.FS, name string) (int64, error) {
+	if err := c.start(); err != nil {
+		return 0, err
+	}
+	if c.opts.FromDir != "" || c.opts.ResumeDir != "" {
+		return 0, errors.New("bucket: kept buckets and resumable runs are counted with CountUniqueIPs")
+	}
+	src, err := fsys.Open(name)
 	if err != nil {
-		flushClose()
-		return 0, fmt.Errorf("open input: %w", err)
+		return 0, &counter.OpenError{Path: name, Err: err}
 	}
 	defer src.Close()
+	size := int64(-1)
+	if st, err := src.Stat(); err == nil && st.Mode().IsRegular() {
+		size = st.Size()
+	}
+	return c.count(context.Background(), src, name, size)
+}
 
-	r := bufio.NewReaderSize(src, readBufSize)
-	var line []byte
-	for {
-		b, err := r.ReadBytes('\n')
-		if errorsIsEOFOrNil := err == nil || err == io.EOF; !errorsIsEOFOrNil {
-			flushClose()
-			return 0, fmt.Errorf("read: %w", err)
+// start records the layout and plan, readies the run's logging and
+// returns the budget error, if any.
+func (c *BucketCounter) start() error {
+	c.opts.Stats.Set("bucket layout", "%s", c.layout)
+	c.opts.Stats.Set("bucket plan", "%s", c.planString())
+	c.reportTally()
+	c.skips = counter.NewSkipLog(c.log)
+	c.started = time.Now()
+	c.prefixes, c.subsamples, c.density, c.buckets, c.top = nil, nil, nil, nil, nil
+	return c.planErr
+}
+
+// CountParallel counts the union of inputs with one pass 1 per input, up
+// to parallel at once with a share of the pass-1 workers each, all
+// appending to the same bucket files under their per-bucket locks; pass 2
+// then runs once. Kept buckets record a single source, so KeepDir,
+// FromDir and ResumeDir are rejected.
+func (c *BucketCounter) CountParallel(ctx context.Context, inputs []counter.Input, parallel int) (int64, error) {
+	if err := c.start(); err != nil {
+		return 0, err
+	}
+	if c.opts.FromDir != "" || c.opts.KeepDir != "" || c.opts.ResumeDir != "" {
+		return 0, errors.New("bucket: kept buckets record a single input; count several inputs without -keep-buckets, -from-buckets or -resume")
+	}
+	base, dir, cleanup, err := c.spillDir()
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	size := int64(0)
+	for _, in := range inputs {
+		if in.Size < 0 {
+			size = -1
+			break
 		}
-		// handle last line without '\n'
-		if idx := bytes.LastIndexByte(b, '\n'); idx >= 0 {
-			line = bytes.TrimSpace(b[:idx])
-		} else {
-			line = bytes.TrimSpace(b)
+		size += in.Size
+	}
+	if err := c.preflight(size, base); err != nil {
+		return 0, err
+	}
+
+	sp, err := c.newSpill(dir, parallel)
+	if err != nil {
+		return 0, err
+	}
+	workers := max(1, c.readers/max(parallel, 1))
+	pg := c.newProgress()
+	c.log.Debug("bucket pass 1 started", "dir", dir, "buckets", c.layout.Buckets(), "inputs", len(inputs),
+		"parallel", parallel, "workers", workers)
+	var oversized atomic.Int64
+	err = counter.ForEachInput(ctx, inputs, parallel, func(ctx context.Context, _ counter.Source, r io.Reader) error {
+		n, err := c.partition(ctx, r, sp, workers, pg, nil)
+		oversized.Add(n)
+		return err
+	})
+	if err == nil {
+		pg.finish()
+	}
+	c.opts.Stats.Set("oversized lines", "%d", oversized.Load())
+	if err == nil && c.opts.Overlap {
+		return c.overlapPasses(ctx, sp, base)
+	}
+	if err := c.closeSpill(sp, base, err, nil); err != nil {
+		return 0, err
+	}
+	return c.countBuckets(ctx, sp)
+}
+
+// spillDir returns the directory pass 1 writes to, KeepDir or a new temp
+// dir that cleanup removes, and base, the directory whose volume it is on.
+func (c *BucketCounter) spillDir() (base, dir string, cleanup func(), err error) {
+	if dir = c.opts.KeepDir; dir != "" {
+		if err := prepareKeepDir(dir); err != nil {
+			return "", "", nil, err
 		}
-		if len(line) != 0 {
-			ip, perr := utils.ParseIPv4(line)
-			if perr == nil {
-				top := byte(ip >> 24)
-				suffix := ip & 0x00FFFFFF
-				var buf [4]byte
-				binary.BigEndian.PutUint32(buf[:], suffix)
-				writers[top].Write(buf[:]) // write suffix only (4 bytes)
-			}
+		return dir, dir, func() {}, nil
+	}
+	base = cmp.Or(c.opts.TempDir, os.TempDir())
+	dir, err = os.MkdirTemp(base, "ipbuckets-*")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("bucket %w: cannot create bucket dir in %s: %w", counter.ErrSpill, base, err)
+	}
+	cleanup = func() {
+		// Every bucket file is closed by now; Windows refuses to delete
+		// one that is still open
+		if err := counter.RemoveAll(dir); err != nil {
+			c.log.Warn("bucket temp dir left behind", "dir", dir, "err", err)
 		}
-		if err == io.EOF {
-			break
+	}
+	return base, dir, cleanup, nil
+}
+
+// newSpill returns the spill pass 1 writes to dir while inputs are open.
+// Every bucket file stays open until pass 1 ends, so when the open file
+// limit, or Options.MaxOpenFiles, leaves fewer files than buckets,
+// consecutive buckets share a file instead of failing with "too many open
+// files" partway through.
+func (c *BucketCounter) newSpill(dir string, inputs int) (*spill, error) {
+	buckets := c.layout.Buckets()
+	group, files, err := shareFiles(buckets, inputs, c.opts.MaxOpenFiles)
+	if err != nil {
+		return nil, err
+	}
+	if group > 1 {
+		c.log.Info("open files are capped below the bucket count; buckets share files",
+			"files", files, "buckets", buckets, "per_file", group)
+		c.opts.Stats.Set("bucket files", "%d buckets per file, %d spill files open at most", group, files)
+	}
+	sp := newSpill(dir, c.layout, c.memBuffer(), c.writeBuf, c.opts.Compress, group)
+	sp.limit = counter.NewLimiter(c.opts.MaxWriteRate)
+	sp.retry = counter.NewWriteRetrier(c.opts.Retries, c.opts.Stats, c.log)
+	sp.progress = c.opts.Progress
+	sp.noCache = c.opts.NoCache
+	sp.sync = c.opts.Sync
+	sp.splitAt = c.splitAt()
+	sp.spare.Store(int64(files - buckets))
+	return sp, nil
+}
+
+// splitAt returns the record bytes at which a bucket is split, 0 for never,
+// as for hash partitioned buckets, which a skewed input does not grow.
+func (c *BucketCounter) splitAt() int64 {
+	switch {
+	case c.opts.SplitAt < 0 || c.layout.Partition == PartitionHash:
+		return 0
+	case c.opts.SplitAt == 0:
+		return DefaultSplitAt
+	}
+	return c.opts.SplitAt
+}
+
+// shareFiles returns how many consecutive buckets share a file so that
+// the files of n buckets fit under the open file limit, with inputs files
+// open besides, and under maxOpen if it is positive, and how many spill
+// files may be open, math.MaxInt if there is no cap.
+func shareFiles(n, inputs, maxOpen int) (group, files int, err error) {
+	files = math.MaxInt
+	limit := openFileLimit()
+	if limit >= 0 {
+		files = limit - fdReserve - inputs
+	}
+	if maxOpen > 0 && maxOpen < files {
+		files = maxOpen
+	}
+	if files >= n {
+		return 1, files, nil
+	}
+	if files < 1 || (n+files-1)/files > maxGroup {
+		if maxOpen > 0 && files == maxOpen {
+			return 0, files, fmt.Errorf("bucket %w: %d open files are too few for %d buckets, which share a file at most %d at a time; allow more or use fewer buckets",
+				counter.ErrSpill, maxOpen, n, maxGroup)
 		}
+		return 0, files, fmt.Errorf("bucket %w: open file limit %d is too low for %d buckets; raise it with ulimit -n or use fewer buckets",
+			counter.ErrSpill, limit, n)
+	}
+	return (n + files - 1) / files, files, nil
+}
+
+// closeSpill flushes the bucket files after pass 1, calling seal, if
+// set, with each bucket whose records are final as closeSealing does,
+// records how much was written to base, and returns the first of err and
+// any close error.
+func (c *BucketCounter) closeSpill(sp *spill, base string, err error, seal func(i int)) error {
+	if cerr := sp.closeSealing(seal); err == nil {
+		err = cerr
+	}
+	raw, disk := sp.written()
+	c.log.Debug("bucket pass 1 done", "raw_bytes", raw, "disk_bytes", disk)
+	if c.opts.Compress == CompressNone {
+		c.opts.Stats.Set("bucket temp written", "%s to %s", counter.FormatBytes(raw), base)
+	} else {
+		c.opts.Stats.Set("bucket temp written", "%s raw, %s %s-compressed to %s",
+			counter.FormatBytes(raw), counter.FormatBytes(disk), c.opts.Compress, base)
+	}
+	if sp.limit != nil {
+		c.opts.Stats.Set("bucket spill throttle", "%s", sp.limit)
+	}
+	if n := sp.lookups.Load(); n > 0 {
+		hits := sp.dedupHits.Load()
+		c.opts.Stats.Set("bucket dedup cache", "%.1f%% hits, %d of %d addresses not written again, %d entries per bucket",
+			100*float64(hits)/float64(n), hits, n, c.dedupEntries())
+		c.log.Debug("bucket dedup cache", "hits", hits, "lookups", n)
+	}
+	if n := sp.splits.Load(); n > 0 {
+		c.log.Info("buckets split by their next byte", "buckets", n, "split_at", counter.FormatBytes(sp.splitAt))
+		c.opts.Stats.Set("bucket splits", "%d, each going on in %d sub-buckets once its file reached %s",
+			n, subBuckets, counter.FormatBytes(sp.splitAt))
+	}
+	return err
+}
+
+// count runs both passes over src, named name in a kept manifest and
+// size bytes long, or -1 if unknown.
+func (c *BucketCounter) count(ctx context.Context, src io.Reader, name string, size int64) (int64, error) {
+	// --- Pass 1: split into temp files ---
+	base, dir, cleanup, err := c.spillDir()
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	if err := c.preflight(size, base); err != nil {
+		return 0, err
 	}
-	flushClose()
 
-	// --- Pass 2: for each bucket, count uniques with a 2MB bitset ---
-	var total int64
-	for i := 0; i < numBuckets; i++ {
-		path := filepath.Join(dir, fmt.Sprintf("b%03d.bin", i))
-		f, err := os.Open(path)
+	sp, err := c.newSpill(dir, 1)
+	if err != nil {
+		return 0, err
+	}
+	in := &countingReader{r: src}
+	sum := crc32.New(crc32c)
+	if c.opts.KeepDir != "" {
+		in.r = io.TeeReader(src, sum)
+	}
+	c.log.Debug("bucket pass 1 started", "dir", dir, "buckets", c.layout.Buckets(), "workers", c.readers)
+	pg := c.newProgress()
+	oversized, err := c.partition(ctx, in, sp, c.readers, pg, nil)
+	if err == nil {
+		pg.finish()
+	}
+	c.opts.Stats.Set("oversized lines", "%d", oversized)
+	if err == nil && c.opts.Overlap && c.opts.KeepDir == "" {
+		return c.overlapPasses(ctx, sp, base)
+	}
+	if err := c.closeSpill(sp, base, err, nil); err != nil {
+		return 0, err
+	}
+	if c.opts.KeepDir != "" {
+		files := make(map[string]int64)
+		sp.fileSizes(dir, files)
+		err = writeManifest(dir, manifest{
+			Buckets:      c.layout.Buckets(),
+			SuffixBits:   c.layout.SuffixBits,
+			Partition:    c.layout.Partition.String(),
+			Group:        sp.group,
+			Compression:  c.opts.Compress.String(),
+			Dedup:        c.dedupEntries() > 0,
+			Source:       name,
+			SourceSize:   in.n,
+			SourceCRC32C: fmt.Sprintf("%08x", sum.Sum32()),
+			Ranges:       sp.ranges(),
+			Split:        sp.splitBuckets(),
+			Files:        files,
+		}, c.opts.Sync)
 		if err != nil {
-			return 0, fmt.Errorf("open bucket %d: %w", i, err)
+			return 0, err
 		}
+	}
 
-		// 2^24 bits → 2MB; store as []uint32 to set bits quickly
-		bitset := make([]uint32, wordsPerSet)
-
-		rr := bufio.NewReaderSize(f, readBufSize)
-		var buf [4]byte
-		var added int64
-		for {
-			_, err := io.ReadFull(rr, buf[:])
-			if err == io.EOF {
-				break
-			}
-			if err == io.ErrUnexpectedEOF {
-				// trailing corruption: ignore
-				break
-			}
-			if err != nil {
-				f.Close()
-				return 0, fmt.Errorf("read bucket %d: %w", i, err)
-			}
-			suffix := binary.BigEndian.Uint32(buf[:]) // 0..2^24-1
-			word := suffix >> 5       // /32
-			bit := suffix & 31        // %32
-			mask := uint32(1) << bit
-			if (bitset[word] & mask) == 0 {
-				bitset[word] |= mask
-				added++
-			}
+	// --- Pass 2: for each touched bucket, count uniques with a 2MB bitset ---
+	return c.countBuckets(ctx, sp)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// countFromDir runs pass 2 alone over the buckets kept in c.opts.FromDir.
+// A non-empty filename must match the size of the input that produced them,
+// unless it is a pipe whose size is unknown.
+func (c *BucketCounter) countFromDir(ctx context.Context, filename string) (int64, error) {
+	sp, m, err := c.openSpill(c.opts.FromDir)
+	if err != nil {
+		return 0, err
+	}
+	if filename != "" {
+		st, err := os.Stat(filename)
+		if err != nil {
+			return 0, &counter.OpenError{Path: filename, Err: err}
+		}
+		if st.Mode().IsRegular() && st.Size() != m.SourceSize {
+			return 0, fmt.Errorf("%s is %d bytes but the buckets in %s came from %s (%d bytes)",
+				filename, st.Size(), c.opts.FromDir, m.Source, m.SourceSize)
 		}
-		f.Close()
-		total += added
-		// bitset gets GC'd before next bucket; peak RAM stays small
 	}
+	return c.countBuckets(ctx, sp)
+}
 
-	return total, nil
+// memBuffer returns the per-bucket in-memory limit in bytes.
+func (c *BucketCounter) memBuffer() int {
+	switch {
+	case c.opts.MemBuffer < 0 || c.opts.KeepDir != "" || c.opts.ResumeDir != "":
+		return 0
+	case c.opts.MemBuffer == 0:
+		return DefaultMemBuffer
+	}
+	return c.opts.MemBuffer
 }
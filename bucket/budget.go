@@ -0,0 +1,81 @@
+package bucket
+
+import (
+	"fmt"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+const minWriteBufSize = 16 * 1024 // smallest per-bucket write buffer under a budget
+
+// estimateMem returns the expected peak memory of a run: the larger of
+// pass 1 (queued and in-flight read chunks, per-worker staging, the dedup
+// cache, memory buffers and write buffers of every bucket) and
+// pass 2 (one bitset, or set of counters, and read buffer per worker,
+// plus the memory buffers not yet counted).
+func (c *BucketCounter) estimateMem() int64 {
+	buckets := int64(c.layout.Buckets())
+	memBuffers := buckets * int64(c.memBuffer())
+	pass1 := int64(3*c.readers+1)*bytesPerChunk +
+		int64(c.readers)*buckets*stageSize +
+		buckets*int64(c.dedupEntries())*8 +
+		memBuffers +
+		buckets*int64(c.writeBuf)
+	pass2 := int64(c.workers())*(c.tally.bytes(c.layout)+readBufSize) + memBuffers
+	return max(pass1, pass2)
+}
+
+// fitBudget shrinks the run until estimateMem fits in budget, a step of
+// shrink at a time.
+func (c *BucketCounter) fitBudget(budget int64) error {
+	for c.estimateMem() > budget {
+		if !c.shrink() {
+			return fmt.Errorf("%w: the bucket engine needs at least %s with %s, budget is %s",
+				counter.ErrMemBudget, counter.FormatBytes(c.estimateMem()), c.layout, counter.FormatBytes(budget))
+		}
+	}
+	return nil
+}
+
+// shrink takes the next step down in memory and reports false once there
+// is none left: first the in-memory buckets go, then write buffers
+// shrink, then the dedup cache goes, then both passes lose workers. The
+// layout is left alone, since smaller bitsets mean more buckets and more
+// pass-1 buffers.
+func (c *BucketCounter) shrink() bool {
+	switch {
+	case c.memBuffer() > 0:
+		c.opts.MemBuffer = -1
+	case c.writeBuf > minWriteBufSize:
+		c.writeBuf /= 2
+	case c.dedupEntries() > 0:
+		c.opts.DedupCache = -1
+	case c.readers > 1 || c.workers() > 1:
+		c.readers = max(1, c.readers/2)
+		c.opts.Workers = max(1, c.workers()/2)
+	default:
+		return false
+	}
+	return true
+}
+
+// MinMem returns the least memory a count can be fitted into with opts,
+// the plan fitBudget shrinks to at its smallest.
+func MinMem(opts Options) int64 {
+	opts.MaxMem = 0
+	c := NewWithOptions(opts)
+	for c.shrink() {
+	}
+	return c.estimateMem()
+}
+
+// planString describes the sizing a run will use, for -stats.
+func (c *BucketCounter) planString() string {
+	s := fmt.Sprintf("%d pass-1 workers, %d pass-2 workers, %s memory and %s write buffer per bucket, estimated peak %s",
+		c.readers, c.workers(), counter.FormatBytes(int64(c.memBuffer())), counter.FormatBytes(int64(c.writeBuf)),
+		counter.FormatBytes(c.estimateMem()))
+	if c.opts.MaxMem > 0 {
+		s += " of " + counter.FormatBytes(c.opts.MaxMem) + " budget"
+	}
+	return s
+}
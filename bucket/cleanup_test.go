@@ -0,0 +1,104 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// failingReader returns err once r is drained.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+// openUnder returns the files this process holds open under dir, from
+// /proc, or nil where that is not available.
+func openUnder(dir string) []string {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil
+	}
+	var open []string
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && strings.HasPrefix(target, dir) {
+			open = append(open, target)
+		}
+	}
+	return open
+}
+
+// Every bucket file is closed before the temp dir is removed, so a run
+// that completes, or fails partway through pass 1, leaves the temp dir
+// empty; Windows would refuse to delete a file still open.
+func TestTempCleanup(t *testing.T) {
+	rng := rand.New(rand.NewPCG(21, 22))
+	var b strings.Builder
+	for range 100000 {
+		fmt.Fprintf(&b, "%s\r\n", utils.FormatIPv4(rng.Uint32()))
+	}
+	input := b.String()
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	want, err := NewWithOptions(Options{TempDir: t.TempDir(), Logger: discard}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errInjected := errors.New("injected read failure")
+
+	for _, o := range []Options{
+		{},
+		{MemBuffer: -1},
+		{MemBuffer: -1, Compress: CompressFlate, NoCache: true},
+		{MemBuffer: 4 << 10, SplitAt: 32 << 10},
+		{MemBuffer: -1, Overlap: true},
+		{MemBuffer: -1, MinOccurrences: 2},
+	} {
+		tmp, err := filepath.EvalSymlinks(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.TempDir, o.Logger = tmp, discard
+		c := NewWithOptions(o)
+		check := func(run string) {
+			t.Helper()
+			if open := openUnder(tmp); len(open) > 0 {
+				t.Errorf("%+v, %s: %d files still open, such as %s", o, run, len(open), open[0])
+			}
+			if left, _ := os.ReadDir(tmp); len(left) > 0 {
+				t.Errorf("%+v, %s: %d entries left in the temp dir", o, run, len(left))
+			}
+		}
+		n, err := c.CountUniqueIPs(path)
+		if err != nil || (o.MinOccurrences == 0 && n != want) {
+			t.Errorf("%+v: %d, %v, want %d", o, n, err, want)
+		}
+		check("complete")
+
+		r := &failingReader{r: strings.NewReader(input[:len(input)/2]), err: errInjected}
+		if _, err := c.CountReader(context.Background(), r); !errors.Is(err, errInjected) {
+			t.Errorf("%+v: %v, want the read failure", o, err)
+		}
+		check("failed")
+	}
+}
@@ -0,0 +1,159 @@
+package bucket
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/input"
+)
+
+// Compression selects how bucket files are encoded on disk.
+type Compression int
+
+const (
+	CompressNone   Compression = iota // raw records
+	CompressFlate                     // self-contained flate blocks at BestSpeed
+	CompressSnappy                    // raw snappy blocks
+	CompressLZ4                       // LZ4 blocks
+)
+
+var compressionNames = []string{"none", "flate", "snappy", "lz4"}
+
+// ParseCompression parses none, snappy, lz4 or flate.
+func ParseCompression(s string) (Compression, error) {
+	if s == "" {
+		return CompressNone, nil
+	}
+	for i, name := range compressionNames {
+		if strings.EqualFold(s, name) {
+			return Compression(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown spill compression %q (want none|snappy|lz4|flate)", s)
+}
+
+func (c Compression) String() string {
+	return compressionNames[c]
+}
+
+// flateWriters are shared by every bucket: a flate.Writer is large, so
+// buckets borrow one per block instead of owning one each.
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// blockWriter compresses each Write into one self-contained block,
+// stored as a 4-byte big-endian length followed by the block in its
+// codec's format. The bucket's bufio.Writer in front of it makes blocks
+// its buffer size long.
+type blockWriter struct {
+	w     io.Writer
+	codec Compression
+	buf   bytes.Buffer // a flate block
+	block []byte       // a snappy or LZ4 block
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	var block []byte
+	switch bw.codec {
+	case CompressSnappy:
+		bw.block = input.EncodeSnappy(append(bw.block[:0], 0, 0, 0, 0), p)
+		block = bw.block
+	case CompressLZ4:
+		bw.block = encodeLZ4(append(bw.block[:0], 0, 0, 0, 0), p)
+		block = bw.block
+	default:
+		var err error
+		if block, err = bw.flate(p); err != nil {
+			return 0, err
+		}
+	}
+	binary.BigEndian.PutUint32(block, uint32(len(block)-4))
+	if _, err := bw.w.Write(block); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flate returns p compressed behind room for the length.
+func (bw *blockWriter) flate(p []byte) ([]byte, error) {
+	bw.buf.Reset()
+	bw.buf.Write([]byte{0, 0, 0, 0}) // length, patched by Write
+	fw := flateWriters.Get().(*flate.Writer)
+	fw.Reset(&bw.buf)
+	_, err := fw.Write(p)
+	if err == nil {
+		err = fw.Close()
+	}
+	flateWriters.Put(fw)
+	return bw.buf.Bytes(), err
+}
+
+// blockReader decodes the blocks written by blockWriter. A truncated last
+// block ends the stream with io.ErrUnexpectedEOF, like a partial record.
+type blockReader struct {
+	r     io.Reader
+	codec Compression
+	block []byte // compressed block
+	out   bytes.Buffer
+	raw   []byte // a decoded snappy or LZ4 block
+	fr    io.ReadCloser
+}
+
+func newBlockReader(r io.Reader, codec Compression) *blockReader {
+	return &blockReader{r: r, codec: codec}
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for br.out.Len() == 0 {
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+	return br.out.Read(p)
+}
+
+// next decompresses the following block into out.
+func (br *blockReader) next() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(br.r, hdr[:]); err != nil {
+		return err // io.EOF at a block boundary
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if cap(br.block) < int(n) {
+		br.block = make([]byte, n)
+	}
+	br.block = br.block[:n]
+	if _, err := io.ReadFull(br.r, br.block); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	br.out.Reset()
+	var err error
+	switch br.codec {
+	case CompressSnappy:
+		br.raw, err = input.DecodeSnappy(br.raw, br.block)
+	case CompressLZ4:
+		br.raw, err = decodeLZ4(br.raw, br.block)
+	default:
+		if br.fr == nil {
+			br.fr = flate.NewReader(bytes.NewReader(br.block))
+		} else {
+			br.fr.(flate.Resetter).Reset(bytes.NewReader(br.block), nil)
+		}
+		_, err = br.out.ReadFrom(br.fr)
+	}
+	if err != nil {
+		return fmt.Errorf("decompress: %w", err)
+	}
+	br.out.Write(br.raw)
+	br.raw = br.raw[:0]
+	return nil
+}
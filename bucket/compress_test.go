@@ -0,0 +1,214 @@
+package bucket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/input"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Compressed blocks of every codec read back as exactly the bytes
+// written, through any buffer size; a stream cut inside its last block
+// gives every earlier block and then io.ErrUnexpectedEOF, as a bucket
+// file cut inside a record does.
+func TestBlockRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(151, 152))
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(rng.IntN(16)) // compressible, like suffixes sharing their top bits
+	}
+	for _, codec := range []Compression{CompressSnappy, CompressLZ4, CompressFlate} {
+		for _, bufSize := range []int{16, 4096, 1 << 20} {
+			var enc bytes.Buffer
+			w := bufio.NewWriterSize(&blockWriter{w: &enc, codec: codec}, bufSize)
+			for rest := data; len(rest) > 0; {
+				n := min(len(rest), 1+rng.IntN(10000))
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if bufSize >= 4096 && enc.Len() >= len(data) {
+				t.Errorf("%v, buffer %d: %d bytes compressed to %d", codec, bufSize, len(data), enc.Len())
+			}
+			got, err := io.ReadAll(newBlockReader(bytes.NewReader(enc.Bytes()), codec))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%v, buffer %d: read back %d bytes, %v; want the %d written", codec, bufSize, len(got), err, len(data))
+			}
+
+			got, err = io.ReadAll(newBlockReader(bytes.NewReader(enc.Bytes()[:enc.Len()-1]), codec))
+			if err != io.ErrUnexpectedEOF || !bytes.Equal(got, data[:len(got)]) || len(got) == len(data) {
+				t.Errorf("%v, buffer %d, cut: read back %d bytes, %v; want a prefix and io.ErrUnexpectedEOF", codec, bufSize, len(got), err)
+			}
+		}
+	}
+}
+
+// The snappy and LZ4 codecs give back any block, empty, too short to
+// match, incompressible, or of runs and repeats reaching past the longest
+// length and offset a single element holds; a corrupt block fails
+// instead of reading out of bounds.
+func TestBlockCodecs(t *testing.T) {
+	rng := rand.New(rand.NewPCG(155, 156))
+	random := make([]byte, 100000)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+	var repeats []byte
+	for len(repeats) < 200000 {
+		n := 1 + rng.IntN(300)
+		if len(repeats) > 70000 && rng.IntN(2) == 0 {
+			from := rng.IntN(len(repeats) - n)
+			repeats = append(repeats, repeats[from:from+n]...)
+		} else {
+			repeats = append(repeats, random[:n]...)
+		}
+	}
+	blocks := [][]byte{nil, []byte("a"), []byte("abcdabcdabcd"), bytes.Repeat([]byte{7}, 100000), random, repeats}
+	codecs := []struct {
+		name   string
+		encode func(dst, src []byte) []byte
+		decode func(dst, src []byte) ([]byte, error)
+	}{
+		{"snappy", input.EncodeSnappy, input.DecodeSnappy},
+		{"lz4", encodeLZ4, decodeLZ4},
+	}
+	for _, c := range codecs {
+		for _, block := range blocks {
+			enc := c.encode(nil, block)
+			got, err := c.decode(nil, enc)
+			if err != nil || !bytes.Equal(got, block) {
+				t.Errorf("%s, %d bytes: read back %d bytes, %v", c.name, len(block), len(got), err)
+			}
+			if len(block) > 1000 && !bytes.Equal(block, random) && len(enc) > len(block)/4 {
+				t.Errorf("%s, %d bytes: compressed to %d", c.name, len(block), len(enc))
+			}
+			for range 100 {
+				bad := bytes.Clone(enc)
+				if len(bad) > 0 {
+					bad[rng.IntN(len(bad))] ^= byte(1 + rng.IntN(255))
+					bad = bad[:rng.IntN(len(bad)+1)]
+				}
+				c.decode(nil, bad) // must not panic
+			}
+		}
+	}
+}
+
+// A run spilling compressed bucket files counts what one spilling raw
+// records does, addresses seen twice included, and says how much the
+// compression saved; a partial record at the end of the decompressed
+// records is dropped as it is from a raw file.
+func TestCompressIdentity(t *testing.T) {
+	rng := rand.New(rand.NewPCG(153, 154))
+	var b strings.Builder
+	for range 200000 {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(rng.Uint32N(64)<<24|rng.Uint32N(1<<18)))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, occurrences := range []int{0, 2} {
+		var counts []int64
+		for _, compress := range []Compression{CompressNone, CompressSnappy, CompressLZ4, CompressFlate} {
+			stats := new(counter.Stats)
+			c := NewWithOptions(Options{Compress: compress, MemBuffer: -1, MinOccurrences: occurrences, Stats: stats, Logger: discard})
+			n, err := c.CountUniqueIPs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts = append(counts, n)
+			if written := stats.Map()["bucket temp written"]; compress != CompressNone && !strings.Contains(written, compress.String()+"-compressed") {
+				t.Errorf("stats %q, want the raw and %v-compressed bytes", written, compress)
+			}
+		}
+		if counts[0] == 0 || counts[1] != counts[0] || counts[2] != counts[0] || counts[3] != counts[0] {
+			t.Errorf("min occurrences %d: %d raw, %d snappy, %d lz4, %d flate", occurrences, counts[0], counts[1], counts[2], counts[3])
+		}
+	}
+
+	l, err := NewLayout(DefaultSuffixBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffixes := []uint32{0, 0x123456, 0xFFFFFF}
+	var recs []byte
+	for _, s := range suffixes {
+		recs = l.appendRecord(recs, 7<<24|s)
+	}
+	for _, codec := range []Compression{CompressSnappy, CompressLZ4, CompressFlate} {
+		sp := newSpill(t.TempDir(), l, 0, 4096, codec, 1)
+		if err := sp.write(7, append(recs, 0xAB, 0xCD)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sp.close(); err != nil {
+			t.Fatal(err)
+		}
+		var got []uint32
+		err = sp.records(context.Background(), 7, l.recordSize(), make([]byte, 3*1024), func(recs []byte) {
+			for ; len(recs) > 0; recs = recs[3:] {
+				got = append(got, l.decodeRecord(recs))
+			}
+		})
+		if err != nil || !slices.Equal(got, suffixes) {
+			t.Errorf("%v with 2 trailing bytes: read %x, %v; want %x", codec, got, err, suffixes)
+		}
+	}
+}
+
+// A count spilling to a temp volume that takes 256 KiB/s past its first
+// second, a busy spinning disk's bandwidth scaled down with the input,
+// with each codec.
+// Addresses come in bursts of requests, as clients' do in access logs,
+// and the dedup cache is off so the repeats reach the files; the codecs
+// then write a fraction of the raw bytes and finish sooner for it.
+func BenchmarkSpillCompress(b *testing.B) {
+	rng := rand.New(rand.NewPCG(157, 158))
+	var buf strings.Builder
+	for lines := 0; lines < 1<<20; {
+		ip := utils.FormatIPv4(rng.Uint32N(16)<<24 | rng.Uint32N(1<<24))
+		for range 1 + rng.IntN(16) {
+			fmt.Fprintf(&buf, "%s\n", ip)
+			lines++
+		}
+	}
+	path := filepath.Join(b.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(buf.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, codec := range []Compression{CompressNone, CompressSnappy, CompressLZ4, CompressFlate} {
+		b.Run(codec.String(), func(b *testing.B) {
+			b.SetBytes(int64(buf.Len()))
+			for range b.N {
+				stats := new(counter.Stats)
+				c := NewWithOptions(Options{Compress: codec, MemBuffer: -1, DedupCache: -1, MaxWriteRate: 256 << 10,
+					TempDir: b.TempDir(), Stats: stats, Logger: discard})
+				if _, err := c.CountUniqueIPs(path); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				b.Log(stats.Map()["bucket temp written"])
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package bucket
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// DefaultDedupCache is the number of written addresses each bucket
+// remembers in pass 1, 8 KB of cache per bucket.
+const DefaultDedupCache = 1 << 10
+
+// dedupCache is pass 1's direct-mapped cache of the addresses written to
+// each bucket, shared by the workers. An address found in its bucket's
+// slots already has a record on its way to the bucket, staged by one
+// worker or another, and pass 2 sets a bit once however many records it
+// has, so the repeat is dropped rather than written: an address repeated
+// throughout the input costs a record each time it is evicted rather than
+// one per line, whichever workers parse its lines. A miss writes the
+// record and takes the address's slot, evicting whatever held it. Slots
+// are read and taken atomically without a lock; two workers missing on
+// one address at once both write it, which only costs a record. A nil
+// *dedupCache keeps nothing, so every address is written.
+type dedupCache struct {
+	slots    []atomic.Uint64 // entries per bucket, bucket after bucket: address | 1<<32 for a slot in use
+	logSlots uint            // log2 of the slots per bucket
+}
+
+// newDedupCache returns a cache of entries slots per bucket, rounded up
+// to a power of two, nil for none.
+func newDedupCache(buckets, entries int) *dedupCache {
+	if entries <= 0 {
+		return nil
+	}
+	logSlots := uint(bits.Len(uint(entries - 1)))
+	return &dedupCache{slots: make([]atomic.Uint64, buckets<<logSlots), logSlots: logSlots}
+}
+
+// seen reports whether ip was written to bucket top since its slot last
+// changed hands, and otherwise takes the slot.
+func (d *dedupCache) seen(top int, ip uint32) bool {
+	i := top<<d.logSlots | int((ip*0x9e3779b1)>>(32-d.logSlots)) // Fibonacci hashing
+	want := uint64(ip) | 1<<32
+	s := &d.slots[i]
+	if s.Load() == want {
+		return true
+	}
+	s.Store(want)
+	return false
+}
+
+// dedupTally is a pass-1 worker's lookups in the dedup cache, added to
+// the run's totals when it is done.
+type dedupTally struct {
+	cache         *dedupCache
+	hits, lookups int64
+}
+
+// seen is dedupCache.seen, tallied; it reports false without a cache.
+func (t *dedupTally) seen(top int, ip uint32) bool {
+	if t.cache == nil {
+		return false
+	}
+	t.lookups++
+	if t.cache.seen(top, ip) {
+		t.hits++
+		return true
+	}
+	return false
+}
+
+// dedupEntries returns the slots of each bucket's cache, 0 for none.
+// Counting occurrences needs every record, so MinOccurrences turns it
+// off.
+func (c *BucketCounter) dedupEntries() int {
+	switch {
+	case c.opts.DedupCache < 0 || c.tally.width > 0:
+		return 0
+	case c.opts.DedupCache == 0:
+		return DefaultDedupCache
+	}
+	return c.opts.DedupCache
+}
@@ -0,0 +1,138 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/gen"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The dedup cache drops repeats of recently written addresses without
+// changing the count, whatever its size, and stays out of the way of
+// MinOccurrences, which needs every record.
+func TestDedupCache(t *testing.T) {
+	rng := rand.New(rand.NewPCG(11, 12))
+	var b strings.Builder
+	seen, twice := make(map[uint32]int), 0
+	for range 20000 {
+		ip := rng.Uint32()
+		if rng.IntN(2) == 0 {
+			ip = 10<<24 | rng.Uint32N(1<<10)
+		}
+		for range 1 + rng.IntN(8) { // a burst
+			if seen[ip]++; seen[ip] == 2 {
+				twice++
+			}
+			fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+		}
+	}
+	input := b.String()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	written := make(map[int]int64)
+	for _, entries := range []int{-1, 0, 3} {
+		stats := new(counter.Stats)
+		c := NewWithOptions(Options{DedupCache: entries, Workers: 2, Stats: stats, Logger: discard})
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(seen)) {
+			t.Errorf("cache of %d: %d unique, want %d", entries, n, len(seen))
+		}
+		for _, s := range c.BucketStats() {
+			written[entries] += s.Bytes
+		}
+		if got := strings.Contains(stats.String(), "bucket dedup cache"); got != (entries >= 0) {
+			t.Errorf("cache of %d: hit rate reported %v", entries, got)
+		}
+	}
+	if written[0] >= written[-1]/2 || written[3] > written[-1] {
+		t.Errorf("record bytes: %d with the default cache, %d with 4 entries, %d with none", written[0], written[3], written[-1])
+	}
+
+	c := NewWithOptions(Options{MinOccurrences: 2, Logger: discard})
+	if n, err := c.CountReader(context.Background(), strings.NewReader(input)); err != nil || n != int64(twice) {
+		t.Errorf("MinOccurrences 2: %d, %v, want %d", n, err, twice)
+	}
+
+	// Kept buckets say whether the cache dropped repeats, and those that
+	// it did are refused to a count of occurrences
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range []int{0, -1} {
+		dir := filepath.Join(t.TempDir(), "kb")
+		if _, err := NewWithOptions(Options{DedupCache: entries, KeepDir: dir, Logger: discard}).CountUniqueIPs(path); err != nil {
+			t.Fatal(err)
+		}
+		n, err := NewWithOptions(Options{FromDir: dir, MinOccurrences: 2, Logger: discard}).CountUniqueIPs(path)
+		switch {
+		case entries == 0 && err == nil:
+			t.Errorf("buckets kept with the cache counted %d addresses seen twice", n)
+		case entries < 0 && (err != nil || n != int64(twice)):
+			t.Errorf("buckets kept without the cache: %d, %v, want %d seen twice", n, err, twice)
+		}
+	}
+
+	// A hundred addresses over several chunks, parsed by different
+	// workers, are each written about once however many workers there are
+	b.Reset()
+	for i := range 400000 {
+		fmt.Fprintf(&b, "10.0.0.%d\n", i%100)
+	}
+	hot := make(map[int]int64)
+	for _, readers := range []int{1, 4} {
+		c := NewWithOptions(Options{Readers: readers, Logger: discard})
+		if n, err := c.CountReader(context.Background(), strings.NewReader(b.String())); err != nil || n != 100 {
+			t.Fatalf("%d readers: %d, %v, want 100", readers, n, err)
+		}
+		for _, s := range c.BucketStats() {
+			hot[readers] += s.Bytes
+		}
+	}
+	if hot[4] > 2*hot[1] || hot[1] > 4*3*100 {
+		t.Errorf("record bytes of 100 hot addresses: %d with 1 reader, %d with 4", hot[1], hot[4])
+	}
+}
+
+// BenchmarkDedupCache counts a hot-set input, nine repeats in ten drawn
+// from a thousand addresses, with and without the cache, by one and four
+// pass-1 workers sharing it, and reports the record bytes pass 1 wrote
+// per input line.
+func BenchmarkDedupCache(b *testing.B) {
+	var buf bytes.Buffer
+	cfg := gen.Config{Lines: 2_000_000, Unique: 200_000, Seed: 1, Shuffle: true, Dist: gen.HotSet, Hot: 1000, HotFrac: 0.9}
+	if _, err := gen.Write(&buf, cfg); err != nil {
+		b.Fatal(err)
+	}
+	input := buf.String()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, bc := range []struct{ entries, readers int }{{-1, 1}, {DefaultDedupCache, 1}, {DefaultDedupCache, 4}} {
+		b.Run(fmt.Sprintf("entries=%d/readers=%d", max(bc.entries, 0), bc.readers), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			c := NewWithOptions(Options{DedupCache: bc.entries, Readers: bc.readers, MemBuffer: -1, TempDir: b.TempDir(), Logger: discard})
+			for range b.N {
+				if _, err := c.CountReader(context.Background(), strings.NewReader(input)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var written int64
+			for _, s := range c.BucketStats() {
+				written += s.Bytes
+			}
+			b.ReportMetric(float64(written)/float64(cfg.Lines), "B/line")
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package bucket
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// With Sync every kept bucket file, directory and the manifest are
+// fsynced, a failing fsync fails the run before the manifest describes
+// files that may not be on disk, and a kept file that is missing or cut
+// short is refused instead of counted.
+func TestDurableKeptBuckets(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	var b strings.Builder
+	for range 100000 {
+		ip := rng.Uint32()
+		if rng.IntN(10) < 9 {
+			ip = 10<<24 | rng.Uint32N(1<<16)
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := NewWithOptions(Options{}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var synced atomic.Int64
+	failOn := ""
+	errInjected := errors.New("injected fsync failure")
+	defer func(orig func(*os.File) error) { counter.Fsync = orig }(counter.Fsync)
+	counter.Fsync = func(f *os.File) error {
+		synced.Add(1)
+		if failOn != "" && strings.Contains(f.Name(), failOn) {
+			return errInjected
+		}
+		return nil
+	}
+	keep := func(sync bool) (string, error) {
+		dir := filepath.Join(t.TempDir(), "kept")
+		_, err := NewWithOptions(Options{KeepDir: dir, SplitAt: 32 << 10, Sync: sync}).CountUniqueIPs(path)
+		return dir, err
+	}
+
+	dir, err := keep(false)
+	if err != nil || synced.Load() != 0 {
+		t.Fatalf("without Sync: %v, %d fsyncs", err, synced.Load())
+	}
+	dir, err = keep(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every file, the kept directory, the split bucket's directory, and
+	// the manifest with the kept directory again
+	if got, min := synced.Load(), int64(len(m.Files)+4); got < min {
+		t.Errorf("%d fsyncs, want at least %d", got, min)
+	}
+	if n, err := NewWithOptions(Options{FromDir: dir}).CountUniqueIPs(path); err != nil || n != want {
+		t.Errorf("from kept buckets: %d, %v, want %d", n, err, want)
+	}
+
+	for _, fail := range []string{"b010.bin", subDir("", 10), manifestName} {
+		failOn = fail
+		dir, err := keep(true)
+		if !errors.Is(err, errInjected) {
+			t.Errorf("fsync of %s failing: %v", fail, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+			t.Errorf("fsync of %s failing: the manifest was written", fail)
+		}
+	}
+	failOn = ""
+
+	sub := filepath.Join(subDir(dir, 10), "b000.bin")
+	st, err := os.Stat(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct {
+		name   string
+		damage func() error
+	}{
+		{"truncated", func() error { return os.Truncate(sub, st.Size()/2) }},
+		{"missing", func() error { return os.Remove(sub) }},
+	} {
+		if err := d.damage(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewWithOptions(Options{FromDir: dir}).CountUniqueIPs(path); !errors.Is(err, ErrPartialBucket) {
+			t.Errorf("%s sub-bucket file: %v, want ErrPartialBucket", d.name, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// MaxOpenFiles below the bucket count makes consecutive buckets share
+// files, with and without compression, and the count stays exact; too
+// few files for a byte's worth of buckets each fail before pass 1.
+func TestMaxOpenFiles(t *testing.T) {
+	rng := rand.New(rand.NewPCG(13, 14))
+	var b strings.Builder
+	seen := make(map[uint32]bool)
+	for range 50000 {
+		ip := rng.Uint32()
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	input := b.String()
+
+	for _, compress := range []Compression{CompressNone, CompressFlate} {
+		stats := &counter.Stats{}
+		c := NewWithOptions(Options{MaxOpenFiles: 16, MemBuffer: -1, Workers: 2, Compress: compress, Stats: stats})
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(seen)) {
+			t.Errorf("%s: %d unique, want %d", compress, n, len(seen))
+		}
+		if got, want := stats.Map()["bucket files"], "16 buckets per file, 16 spill files open at most"; got != want {
+			t.Errorf("%s: bucket files %q, want %q", compress, got, want)
+		}
+	}
+
+	c := NewWithOptions(Options{MaxOpenFiles: 2, MaxBucketMem: 512 << 10})
+	if _, err := c.CountReader(context.Background(), strings.NewReader(input)); !errors.Is(err, counter.ErrSpill) {
+		t.Errorf("1024 buckets in 2 files: got %v, want a spill error", err)
+	}
+}
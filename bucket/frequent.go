@@ -0,0 +1,119 @@
+package bucket
+
+import (
+	"cmp"
+	"container/heap"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// AddressCount is how many times an address appeared in a run's input.
+type AddressCount struct {
+	Addr  netip.Addr
+	Count int64
+}
+
+// TopAddresses returns the addresses the last run saw most often, up to
+// Options.TopAddresses of them, the most frequent first and ties in
+// address order, or nil without TopAddresses.
+func (c *BucketCounter) TopAddresses() []AddressCount {
+	return c.top
+}
+
+// frequent keeps the most frequent addresses of pass 2's buckets as each
+// is counted, walking its 32-bit counters. A nil *frequent does nothing,
+// so pass 2 can call add unconditionally.
+type frequent struct {
+	mu     sync.Mutex
+	layout Layout
+	n      int
+	min    uint32 // occurrences an address needs to be listed
+	top    addrHeap
+}
+
+// newFrequent returns the top list of a pass 2 over layout l, nil without
+// Options.TopAddresses.
+func (c *BucketCounter) newFrequent(l Layout) *frequent {
+	if c.opts.TopAddresses <= 0 {
+		return nil
+	}
+	return &frequent{layout: l, n: c.opts.TopAddresses, min: c.tally.min}
+}
+
+// add merges the most frequent addresses of bucket i, whose counters are
+// set once it holds all its suffixes. The bucket's own top list is found
+// before the lock is taken, so workers walking buckets seldom wait.
+func (f *frequent) add(i int, set []uint32) {
+	if f == nil {
+		return
+	}
+	var top addrHeap
+	base := uint32(i) << f.layout.SuffixBits
+	for s, v := range set {
+		if v < f.min {
+			continue
+		}
+		top.offer(addrEntry{ip: base | uint32(s), count: v}, f.n)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range top {
+		f.top.offer(e, f.n)
+	}
+}
+
+// list returns the kept addresses, the most frequent first.
+func (f *frequent) list() []AddressCount {
+	if f == nil {
+		return nil
+	}
+	slices.SortFunc(f.top, func(a, b addrEntry) int {
+		return cmp.Or(cmp.Compare(b.count, a.count), cmp.Compare(a.ip, b.ip))
+	})
+	out := make([]AddressCount, len(f.top))
+	for i, e := range f.top {
+		out[i] = AddressCount{
+			Addr:  netip.AddrFrom4([4]byte{byte(e.ip >> 24), byte(e.ip >> 16), byte(e.ip >> 8), byte(e.ip)}),
+			Count: int64(e.count),
+		}
+	}
+	return out
+}
+
+// addrEntry is an address and its occurrences.
+type addrEntry struct {
+	ip    uint32
+	count uint32
+}
+
+// addrHeap is a min-heap of the most frequent addresses seen so far, the
+// least frequent of them, and of equals the highest, on top to be
+// replaced.
+type addrHeap []addrEntry
+
+// offer keeps e if the heap holds fewer than n or e beats its top.
+func (h *addrHeap) offer(e addrEntry, n int) {
+	switch {
+	case len(*h) < n:
+		heap.Push(h, e)
+	case h.less((*h)[0], e):
+		(*h)[0] = e
+		heap.Fix(h, 0)
+	}
+}
+
+func (h addrHeap) less(a, b addrEntry) bool {
+	return a.count < b.count || (a.count == b.count && a.ip > b.ip)
+}
+
+func (h addrHeap) Len() int           { return len(h) }
+func (h addrHeap) Less(i, j int) bool { return h.less(h[i], h[j]) }
+func (h addrHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *addrHeap) Push(x any)        { *h = append(*h, x.(addrEntry)) }
+func (h *addrHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,58 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// TopAddresses lists the most frequent addresses with their exact counts,
+// ties in address order, across a split bucket and past any small
+// counter's limit, and with a minimum only those seen that often.
+func TestTopAddresses(t *testing.T) {
+	rng := rand.New(rand.NewPCG(11, 12))
+	var lines []string
+	add := func(ip uint32, times int) {
+		for range times {
+			lines = append(lines, utils.FormatIPv4(ip))
+		}
+	}
+	add(10<<24|5, 70000) // past a 16-bit counter, in the bucket that splits
+	add(192<<24|168<<16|1, 300)
+	add(1<<24|1, 300)
+	add(8<<24|8<<16|8<<8|8, 20)
+	for range 20000 {
+		add(10<<24|rng.Uint32N(1<<16), 1)
+	}
+	rng.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+	input := strings.Join(lines, "\n") + "\n"
+
+	want := "10.0.0.5 70000, 1.0.0.1 300, 192.168.0.1 300, 8.8.8.8 20"
+	for _, minOcc := range []int{0, 100} {
+		c := NewWithOptions(Options{TopAddresses: 4, MinOccurrences: minOcc, MaxBucketMem: 512 << 10,
+			SplitAt: 64 << 10, MemBuffer: -1, Workers: 2})
+		if _, err := c.CountReader(context.Background(), strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, a := range c.TopAddresses() {
+			got = append(got, fmt.Sprintf("%s %d", a.Addr, a.Count))
+		}
+		w := want
+		if minOcc == 100 {
+			w = strings.TrimSuffix(want, ", 8.8.8.8 20")
+		}
+		if g := strings.Join(got, ", "); g != w {
+			t.Errorf("min %d: top addresses %s, want %s", minOcc, g, w)
+		}
+	}
+
+	c := NewWithOptions(Options{Partition: PartitionHash, TopAddresses: 1})
+	if _, err := c.CountReader(context.Background(), strings.NewReader("1.2.3.4\n")); err == nil {
+		t.Error("a top list of hash-partitioned buckets was accepted")
+	}
+}
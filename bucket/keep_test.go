@@ -0,0 +1,93 @@
+package bucket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Buckets kept by one run count to the same number from FromDir as the
+// run itself, without the input; a kept directory is refused as a
+// target for another run, and as a source to a counter of another
+// layout, a manifest edited to another layout, an input of another size
+// or a directory pass 1 never finished.
+func TestKeepBuckets(t *testing.T) {
+	rng := rand.New(rand.NewPCG(91, 92))
+	var b strings.Builder
+	for range 200000 {
+		ip := rng.Uint32()
+		if rng.IntN(2) == 0 {
+			ip = 10<<24 | rng.Uint32N(1<<16)
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	want, err := NewWithOptions(Options{Logger: discard}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(tmp, "kept")
+	if n, err := NewWithOptions(Options{KeepDir: dir, Logger: discard}).CountUniqueIPs(path); err != nil || n != want {
+		t.Fatalf("keeping buckets: %d, %v; want %d", n, err, want)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Source != path || m.SourceSize != int64(b.Len()) || m.SuffixBits != DefaultSuffixBits || len(m.Files) == 0 {
+		t.Errorf("manifest: %+v", m)
+	}
+	for _, in := range []string{path, ""} { // named input checked by size, or none
+		if n, err := NewWithOptions(Options{FromDir: dir, Logger: discard}).CountUniqueIPs(in); err != nil || n != want {
+			t.Errorf("from buckets, input %q: %d, %v; want %d", in, n, err, want)
+		}
+	}
+	if _, err := NewWithOptions(Options{KeepDir: dir, Logger: discard}).CountUniqueIPs(path); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("keeping into a kept dir: %v, want it refused as not empty", err)
+	}
+
+	if _, err := NewWithOptions(Options{FromDir: dir, MaxBucketMem: 1 << 20, Logger: discard}).CountUniqueIPs(path); !errors.Is(err, ErrLayoutMismatch) {
+		t.Errorf("from buckets with 23-bit suffixes: %v, want ErrLayoutMismatch", err)
+	}
+	other := filepath.Join(tmp, "other.txt")
+	if err := os.WriteFile(other, []byte("10.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithOptions(Options{FromDir: dir, Logger: discard}).CountUniqueIPs(other); err == nil || !strings.Contains(err.Error(), "came from") {
+		t.Errorf("from buckets of another input: %v, want it refused", err)
+	}
+
+	m.SuffixBits--
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithOptions(Options{FromDir: dir, Logger: discard}).CountUniqueIPs(path); !errors.Is(err, ErrLayoutMismatch) {
+		t.Errorf("from buckets with a manifest of %d-bit suffixes: %v, want ErrLayoutMismatch", m.SuffixBits, err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, manifestName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithOptions(Options{FromDir: dir, Logger: discard}).CountUniqueIPs(path); err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Errorf("from buckets without a manifest: %v, want it refused", err)
+	}
+}
@@ -0,0 +1,123 @@
+package bucket
+
+import (
+	"fmt"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+const (
+	DefaultSuffixBits = 24 // 256 buckets with 2 MB bitsets
+	MinSuffixBits     = 22 // 1024 buckets with 512 KB bitsets
+	MaxSuffixBits     = 28 // 16 buckets with 32 MB bitsets
+)
+
+// Layout is how an address splits into a bucket index (its top TopBits)
+// and the suffix stored in that bucket (its low SuffixBits). With
+// PartitionHash the index is the top TopBits of a hash of the address
+// instead, and the bucket stores the whole address.
+type Layout struct {
+	TopBits    uint
+	SuffixBits uint
+	Partition  Partition
+}
+
+// NewLayout returns the layout with the given suffix width.
+func NewLayout(suffixBits uint) (Layout, error) {
+	l := Layout{TopBits: 32 - suffixBits, SuffixBits: suffixBits}
+	return l, l.Validate()
+}
+
+// LayoutForMem returns the layout with the largest pass-2 bitset that
+// fits in maxBucketMem bytes; 0 means the default 2 MB layout.
+func LayoutForMem(maxBucketMem int64) (Layout, error) {
+	if maxBucketMem == 0 {
+		return NewLayout(DefaultSuffixBits)
+	}
+	minMem := int64(1) << MinSuffixBits / 8
+	if maxBucketMem < minMem {
+		return Layout{}, fmt.Errorf("max bucket memory must be at least %s, got %s",
+			counter.FormatBytes(minMem), counter.FormatBytes(maxBucketMem))
+	}
+	s := uint(MinSuffixBits)
+	for s < MaxSuffixBits && int64(1)<<(s+1)/8 <= maxBucketMem {
+		s++
+	}
+	return NewLayout(s)
+}
+
+// Validate reports whether l splits all 32 bits within the supported range.
+func (l Layout) Validate() error {
+	if l.TopBits+l.SuffixBits != 32 {
+		return fmt.Errorf("bucket layout %d+%d bits does not cover 32 bits", l.TopBits, l.SuffixBits)
+	}
+	if l.SuffixBits < MinSuffixBits || l.SuffixBits > MaxSuffixBits {
+		return fmt.Errorf("bucket suffix must be %d to %d bits, got %d", MinSuffixBits, MaxSuffixBits, l.SuffixBits)
+	}
+	return nil
+}
+
+// Buckets returns the number of buckets.
+func (l Layout) Buckets() int {
+	return 1 << l.TopBits
+}
+
+// BitsetBytes returns the size of one pass-2 bitset, 0 for PartitionHash,
+// which sorts each bucket instead.
+func (l Layout) BitsetBytes() int64 {
+	if l.Partition == PartitionHash {
+		return 0
+	}
+	return int64(1) << l.SuffixBits / 8
+}
+
+// SpillBytes returns the bytes pass 1 writes for records addresses,
+// uncompressed and with every bucket spilled.
+func (l Layout) SpillBytes(records int64) int64 {
+	return records * int64(l.recordSize())
+}
+
+// recordSize returns the bytes one suffix, or address, takes on disk.
+func (l Layout) recordSize() int {
+	if l.Partition == PartitionHash {
+		return 4
+	}
+	return int(l.SuffixBits+7) / 8
+}
+
+// words returns the length of a pass-2 bitset in uint32 words.
+func (l Layout) words() int {
+	if l.Partition == PartitionHash {
+		return 0
+	}
+	return 1 << l.SuffixBits / 32
+}
+
+func (l Layout) String() string {
+	if l.Partition == PartitionHash {
+		return fmt.Sprintf("%d buckets by hash, 4-byte records sorted in pass 2", l.Buckets())
+	}
+	return fmt.Sprintf("%d buckets × %d-bit suffixes, %s bitsets, %d-byte records",
+		l.Buckets(), l.SuffixBits, counter.FormatBytes(l.BitsetBytes()), l.recordSize())
+}
+
+// appendRecord appends the suffix of ip, or with PartitionHash all of
+// it, as a big-endian record.
+func (l Layout) appendRecord(dst []byte, ip uint32) []byte {
+	s := ip & (1<<l.SuffixBits - 1)
+	if l.Partition == PartitionHash {
+		s = ip
+	}
+	if l.recordSize() == 4 {
+		return append(dst, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+	}
+	return append(dst, byte(s>>16), byte(s>>8), byte(s))
+}
+
+// decodeRecord returns the suffix, or address, stored in a bucket record.
+func (l Layout) decodeRecord(rec []byte) uint32 {
+	if l.recordSize() == 4 {
+		return uint32(rec[0])<<24 | uint32(rec[1])<<16 | uint32(rec[2])<<8 | uint32(rec[3])
+	}
+	return uint32(rec[0])<<16 | uint32(rec[1])<<8 | uint32(rec[2])
+}
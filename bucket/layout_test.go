@@ -0,0 +1,75 @@
+package bucket
+
+import (
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Every -max-bucket-mem picks the largest bitset that fits, and every
+// layout, from 1024 small buckets to 16 large ones, counts the same,
+// whether the buckets stay in memory or go to files. The input puts
+// addresses on either side of each layout's bucket boundaries, where a
+// suffix cut one bit short or long would merge or drop them.
+func TestLayoutCounts(t *testing.T) {
+	rng := rand.New(rand.NewPCG(327, 328))
+	seen := map[uint32]bool{}
+	var b strings.Builder
+	add := func(ip uint32) {
+		seen[ip] = true
+		b.WriteString(utils.FormatIPv4(ip) + "\n")
+	}
+	for range 100000 {
+		ip := rng.Uint32()
+		add(ip)
+		if rng.IntN(3) == 0 {
+			add(ip)
+		}
+	}
+	for s := uint(MinSuffixBits); s <= MaxSuffixBits; s++ {
+		for top := uint32(0); top < 1<<(32-s); top += 7 {
+			add(top<<s - 1)
+			add(top << s)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, tc := range []struct {
+		mem        int64
+		suffixBits uint
+	}{
+		{512 << 10, 22},
+		{1 << 20, 23},
+		{0, DefaultSuffixBits},
+		{3 << 20, 24},
+		{4 << 20, 25},
+		{8 << 20, 26},
+		{16 << 20, 27},
+		{32 << 20, 28},
+		{1 << 30, MaxSuffixBits},
+	} {
+		for _, memBuffer := range []int{-1, 0} {
+			c := NewWithOptions(Options{MaxBucketMem: tc.mem, MemBuffer: memBuffer, TempDir: t.TempDir(), Logger: discard})
+			if c.layout.SuffixBits != tc.suffixBits {
+				t.Errorf("max bucket mem %d: %d suffix bits, want %d", tc.mem, c.layout.SuffixBits, tc.suffixBits)
+			}
+			if n, err := c.CountUniqueIPs(path); err != nil || n != int64(len(seen)) {
+				t.Errorf("max bucket mem %d, mem buffer %d: %d, %v; want %d", tc.mem, memBuffer, n, err, len(seen))
+			}
+		}
+	}
+
+	if err := (Options{MaxBucketMem: 256 << 10}).Validate(); err == nil {
+		t.Error("a 256 KB bucket limit, below the smallest bitset, validated")
+	}
+}
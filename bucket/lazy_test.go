@@ -0,0 +1,72 @@
+package bucket
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// An input touching exactly three top bytes gives pass 2 those three
+// buckets and no others, and the temp dir holds a file only for each of
+// them that left memory: all three when nothing is kept in memory, the
+// one overflowing its buffer by default.
+func TestLazyBucketFiles(t *testing.T) {
+	rng := rand.New(rand.NewPCG(121, 122))
+	seen := map[uint32]bool{}
+	var b strings.Builder
+	for _, in := range []struct {
+		top   uint32
+		lines int
+	}{{10, 50000}, {172, 1000}, {192, 1000}} {
+		for range in.lines {
+			ip := in.top<<24 | rng.Uint32N(1<<24)
+			seen[ip] = true
+			fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+		}
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	defer func() { testHookPass2 = nil }()
+
+	for _, tc := range []struct {
+		mem   int
+		files []string
+	}{
+		{-1, []string{"b010.bin", "b172.bin", "b192.bin"}},
+		{0, []string{"b010.bin"}},
+	} {
+		var touched []int
+		var files []string
+		testHookPass2 = func(dir string, buckets []int) {
+			touched = buckets
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Error(err)
+			}
+			for _, e := range entries {
+				files = append(files, e.Name())
+			}
+		}
+		n, err := NewWithOptions(Options{MemBuffer: tc.mem, TempDir: t.TempDir(), Logger: discard}).CountUniqueIPs(path)
+		if err != nil || n != int64(len(seen)) {
+			t.Errorf("mem buffer %d: %d, %v; want %d", tc.mem, n, err, len(seen))
+		}
+		if !slices.Equal(touched, []int{10, 172, 192}) {
+			t.Errorf("mem buffer %d: pass 2 over buckets %v, want 10, 172 and 192", tc.mem, touched)
+		}
+		if !slices.Equal(files, tc.files) {
+			t.Errorf("mem buffer %d: temp dir holds %v, want %v", tc.mem, files, tc.files)
+		}
+	}
+}
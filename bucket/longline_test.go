@@ -0,0 +1,67 @@
+package bucket
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"runtime"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// longLine is an address, size bytes with no newline, and another
+// address, made up as it is read.
+type longLine struct {
+	head, tail string
+	size       int
+	off        int
+}
+
+func (l *longLine) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		switch {
+		case l.off < len(l.head):
+			c := copy(p[n:], l.head[l.off:])
+			n, l.off = n+c, l.off+c
+		case l.off < len(l.head)+l.size:
+			c := min(len(p)-n, len(l.head)+l.size-l.off)
+			for i := range c {
+				p[n+i] = 'x'
+			}
+			n, l.off = n+c, l.off+c
+		case l.off < len(l.head)+l.size+len(l.tail):
+			c := copy(p[n:], l.tail[l.off-len(l.head)-l.size:])
+			n, l.off = n+c, l.off+c
+		default:
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// A 100 MB line with no newline is skipped as one oversized line without
+// being buffered: the addresses around it count and the run allocates a
+// fraction of the line.
+func TestLongLine(t *testing.T) {
+	stats := &counter.Stats{}
+	c := NewWithOptions(Options{Workers: 2, TempDir: t.TempDir(), Stats: stats, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	n, err := c.CountReader(context.Background(), &longLine{head: "10.0.0.1\n", size: 100 << 20, tail: "\n10.0.0.2\n"})
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || stats.Map()["oversized lines"] != "1" {
+		t.Errorf("%d unique, oversized lines %q; want 2 and 1", n, stats.Map()["oversized lines"])
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+		t.Errorf("allocated %s for a 100 MB line", counter.FormatBytes(int64(alloc)))
+	}
+}
@@ -0,0 +1,138 @@
+package bucket
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errBadLZ4 = errors.New("corrupt lz4 block")
+
+const (
+	lz4MinMatch   = 4
+	lz4MaxOffset  = 1<<16 - 1
+	lz4LastLits   = 5  // the block ends in at least this many literals
+	lz4MatchLimit = 12 // and no match starts this close to its end
+)
+
+// encodeLZ4 appends src to dst compressed, as the uncompressed length in a
+// uvarint followed by one LZ4 block, matching greedily on 4-byte hashes.
+func encodeLZ4(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	var table [1 << 14]int32 // 1 + the last position of each hash
+	lit := 0
+	for i := 0; i+lz4MatchLimit < len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := v * 2654435761 >> 18
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > lz4MaxOffset || binary.LittleEndian.Uint32(src[cand:]) != v {
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLits && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = appendLZ4Sequence(dst, src[lit:i], i-cand, n)
+		i += n
+		lit = i
+	}
+	return appendLZ4Sequence(dst, src[lit:], 0, 0)
+}
+
+// appendLZ4Sequence appends lits and then a match of length bytes from
+// offset back; a zero length makes it the block's last sequence, of
+// literals alone.
+func appendLZ4Sequence(dst, lits []byte, offset, length int) []byte {
+	token := len(lits)
+	if token > 15 {
+		token = 15
+	}
+	ml := 0
+	if length > 0 {
+		ml = min(length-lz4MinMatch, 15)
+	}
+	dst = append(dst, byte(token)<<4|byte(ml))
+	if len(lits) >= 15 {
+		dst = appendLZ4Length(dst, len(lits)-15)
+	}
+	dst = append(dst, lits...)
+	if length == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if length-lz4MinMatch >= 15 {
+		dst = appendLZ4Length(dst, length-lz4MinMatch-15)
+	}
+	return dst
+}
+
+// appendLZ4Length appends the rest of a length past its token's 15, in
+// bytes of 255 and a final one below it.
+func appendLZ4Length(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// decodeLZ4 decompresses a block written by encodeLZ4 into dst's storage.
+func decodeLZ4(dst, src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > 1<<31 {
+		return nil, errBadLZ4
+	}
+	src = src[k:]
+	if uint64(cap(dst)) < n {
+		dst = make([]byte, 0, n)
+	}
+	dst = dst[:0]
+	length := func(l int) (int, bool) {
+		if l < 15 {
+			return l, true
+		}
+		for {
+			if len(src) == 0 {
+				return 0, false
+			}
+			b := src[0]
+			src = src[1:]
+			l += int(b)
+			if b != 255 {
+				return l, true
+			}
+		}
+	}
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
+		lits, ok := length(int(token >> 4))
+		if !ok || len(src) < lits || uint64(len(dst)+lits) > n {
+			return nil, errBadLZ4
+		}
+		dst = append(dst, src[:lits]...)
+		src = src[lits:]
+		if len(src) == 0 {
+			break // the last sequence has no match
+		}
+		if len(src) < 2 {
+			return nil, errBadLZ4
+		}
+		offset := int(binary.LittleEndian.Uint16(src))
+		src = src[2:]
+		ml, ok := length(int(token & 15))
+		ml += lz4MinMatch
+		if !ok || offset == 0 || offset > len(dst) || uint64(len(dst)+ml) > n {
+			return nil, errBadLZ4
+		}
+		// The match may overlap what it appends, repeating a short run
+		start := len(dst) - offset
+		for i := range ml {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errBadLZ4
+	}
+	return dst, nil
+}
@@ -0,0 +1,201 @@
+package bucket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// manifestName is the file describing a kept bucket directory. It is
+// written last, so a directory without one is an incomplete pass 1.
+const manifestName = "manifest.json"
+
+// ErrLayoutMismatch is returned when a kept bucket directory was written
+// with a different layout than the counter uses.
+var ErrLayoutMismatch = errors.New("bucket layout mismatch")
+
+// ErrPartialBucket is returned when a file of a kept bucket directory is
+// missing or does not have the length its manifest recorded, as after a
+// crash that lost writes the manifest had already described.
+var ErrPartialBucket = errors.New("partial bucket file")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// manifest records how a kept bucket directory was produced.
+type manifest struct {
+	Buckets      int    `json:"buckets"`
+	SuffixBits   uint   `json:"suffix_bits"`
+	Partition    string `json:"partition,omitempty"` // topbyte, or "" from before there was a choice, or hash
+	Group        int    `json:"group,omitempty"`     // buckets per file, 0 or 1 for one each
+	Compression  string `json:"compression"`
+	Source       string `json:"source"`
+	SourceSize   int64  `json:"source_size"`
+	SourceCRC32C string `json:"source_crc32c"` // hex, of the raw input bytes
+
+	// Dedup records that pass 1 skipped repeats its dedup cache
+	// remembered, so the files hold every address but not every
+	// occurrence of one, and cannot be counted with MinOccurrences or
+	// TopAddresses.
+	Dedup bool `json:"dedup,omitempty"`
+
+	// Ranges holds the CIDR suffix ranges of each bucket, which live in
+	// memory rather than in the bucket files.
+	Ranges map[int][]suffixRange `json:"ranges,omitempty"`
+
+	// Split lists the buckets split in pass 1, whose later records are
+	// in sub-bucket files of a directory of their own.
+	Split []int `json:"split,omitempty"`
+
+	// Files holds the length of every bucket file, by slash-separated
+	// path within the directory, so a file cut short is caught before it
+	// is counted. Directories kept before it was recorded have none.
+	Files map[string]int64 `json:"files,omitempty"`
+}
+
+// writeManifest stores m in dir, renamed into place once complete, and
+// with sync fsynced along with dir.
+func writeManifest(dir string, m manifest, sync bool) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = counter.WriteFileAtomic(filepath.Join(dir, manifestName), sync, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+// readManifest loads the manifest of a kept bucket directory.
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, fmt.Errorf("%s has no %s; pass 1 did not finish there", dir, manifestName)
+	}
+	if err != nil {
+		return m, fmt.Errorf("read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("parse manifest: %w", err)
+	}
+	return m, nil
+}
+
+// prepareKeepDir creates dir for kept buckets, refusing one that already
+// has files so runs never mix.
+func prepareKeepDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot create bucket dir %s: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read bucket dir: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("bucket dir %s is not empty", dir)
+	}
+	return nil
+}
+
+// openSpill returns the kept buckets in dir for pass 2, checking that
+// their layout matches c's.
+func (c *BucketCounter) openSpill(dir string) (*spill, manifest, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, m, err
+	}
+	l, err := NewLayout(m.SuffixBits)
+	if err != nil || l.Buckets() != m.Buckets {
+		return nil, m, fmt.Errorf("%w: %s has %d buckets with %d-bit suffixes", ErrLayoutMismatch, dir, m.Buckets, m.SuffixBits)
+	}
+	if l.Partition, err = ParsePartition(m.Partition); err != nil {
+		return nil, m, fmt.Errorf("%w: %s: %w", ErrLayoutMismatch, dir, err)
+	}
+	if l != c.layout {
+		return nil, m, fmt.Errorf("%w: %s was written with %s, counter uses %s",
+			ErrLayoutMismatch, dir, l, c.layout)
+	}
+	if m.Dedup && c.tally.width > 0 {
+		return nil, m, fmt.Errorf("%s was written with the pass-1 dedup cache, which skips repeats, so its files cannot count occurrences; keep them with the cache off", dir)
+	}
+	compress, err := ParseCompression(m.Compression)
+	if err != nil {
+		return nil, m, err
+	}
+	group := max(m.Group, 1)
+	if group > maxGroup {
+		return nil, m, fmt.Errorf("%s has %d buckets per file, at most %d are supported", manifestName, m.Group, maxGroup)
+	}
+	sp := newSpill(dir, l, 0, 0, compress, group)
+	for i := range sp.buckets {
+		if _, err := os.Stat(sp.path(i)); err == nil {
+			sp.buckets[i].spilled = true
+		}
+	}
+	for _, i := range m.Split {
+		if i < 0 || i >= len(sp.buckets) {
+			return nil, m, fmt.Errorf("%s lists split bucket %d of %d", manifestName, i, len(sp.buckets))
+		}
+		sub := newSpillN(subDir(dir, i), subBuckets, 0, 0, compress, 1)
+		for k := range sub.buckets {
+			if _, err := os.Stat(sub.path(k)); err == nil {
+				sub.buckets[k].spilled = true
+			}
+		}
+		sp.buckets[i].sub = sub
+	}
+	for i, ranges := range m.Ranges {
+		if i < 0 || i >= len(sp.buckets) {
+			return nil, m, fmt.Errorf("%s lists ranges for bucket %d of %d", manifestName, i, len(sp.buckets))
+		}
+		for _, r := range ranges {
+			if r.First > r.Last || uint64(r.Last) >= uint64(1)<<l.SuffixBits {
+				return nil, m, fmt.Errorf("%s has invalid range %d-%d in bucket %d", manifestName, r.First, r.Last, i)
+			}
+		}
+		sp.buckets[i].ranges = ranges
+	}
+	if err := checkFiles(dir, sp, m.Files); err != nil {
+		return nil, m, err
+	}
+	return sp, m, nil
+}
+
+// checkFiles compares the bucket files of sp, kept in dir, with the
+// lengths recorded in its manifest, if any.
+func checkFiles(dir string, sp *spill, files map[string]int64) error {
+	if files == nil {
+		return nil
+	}
+	for rel, want := range files {
+		st, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel)))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s lists %s, which is missing from %s", ErrPartialBucket, manifestName, rel, dir)
+		}
+		if err != nil {
+			return err
+		}
+		if st.Size() != want {
+			return fmt.Errorf("%w: %s is %d bytes, %s recorded %d", ErrPartialBucket,
+				filepath.Join(dir, filepath.FromSlash(rel)), st.Size(), manifestName, want)
+		}
+	}
+	got := make(map[string]int64)
+	sp.diskSizes(dir, got)
+	for rel := range got {
+		if _, ok := files[rel]; !ok {
+			return fmt.Errorf("%w: %s is not in %s", ErrPartialBucket, filepath.Join(dir, filepath.FromSlash(rel)), manifestName)
+		}
+	}
+	return nil
+}
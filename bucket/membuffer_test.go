@@ -0,0 +1,76 @@
+package bucket
+
+import (
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Buckets one record either side of the in-memory buffer, and exactly
+// filling it, count the same whether all of them stay in memory, all go
+// to files, or each goes where the buffer puts it; a bucket gets a file
+// exactly when its records overflow the buffer, and an address repeated
+// across the flush is counted once.
+func TestMemBufferThreshold(t *testing.T) {
+	const memBuffer = 3000 // 1000 records
+	rng := rand.New(rand.NewPCG(131, 132))
+	records := map[uint32]int{1: 999, 2: 1000, 3: 1001, 4: 1, 5: 4000}
+	seen := map[uint32]bool{}
+	var lines []string
+	for top, n := range records {
+		var ips []uint32
+		for range n {
+			ip := top<<24 | rng.Uint32N(1<<24)
+			if len(ips) > 0 && rng.IntN(5) == 0 {
+				ip = ips[rng.IntN(len(ips))]
+			}
+			ips = append(ips, ip)
+			seen[ip] = true
+			lines = append(lines, utils.FormatIPv4(ip)+"\n")
+		}
+	}
+	rng.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	defer func() { testHookPass2 = nil }()
+
+	for _, tc := range []struct {
+		mem   int
+		files []string
+	}{
+		{-1, []string{"b001.bin", "b002.bin", "b003.bin", "b004.bin", "b005.bin"}},
+		{memBuffer, []string{"b003.bin", "b005.bin"}},
+		{1 << 20, nil},
+	} {
+		for _, readers := range []int{1, 4} {
+			var files []string
+			testHookPass2 = func(dir string, _ []int) {
+				entries, err := os.ReadDir(dir)
+				if err != nil {
+					t.Error(err)
+				}
+				for _, e := range entries {
+					files = append(files, e.Name())
+				}
+			}
+			c := NewWithOptions(Options{MemBuffer: tc.mem, DedupCache: -1, Readers: readers, TempDir: t.TempDir(), Logger: discard})
+			n, err := c.CountUniqueIPs(path)
+			if err != nil || n != int64(len(seen)) {
+				t.Errorf("mem buffer %d, %d readers: %d, %v; want %d", tc.mem, readers, n, err, len(seen))
+			}
+			if !slices.Equal(files, tc.files) {
+				t.Errorf("mem buffer %d, %d readers: files %v, want %v", tc.mem, readers, files, tc.files)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package bucket
+
+import (
+	"context"
+	"time"
+)
+
+// overlapPasses ends pass 1 over sp, whose input is fully read, and runs
+// pass 2 alongside it: a goroutine flushes and closes the bucket files
+// while pass-2 workers already count the buckets whose records are final,
+// those that never left memory first, then each file's as soon as it is
+// closed. Any line may land in any bucket, so nothing is final before the
+// input ends; what overlaps is the close of pass 1, flushing up to a
+// write buffer per bucket, with the start of pass 2. Split buckets' sub-
+// buckets are counted once every file is closed, as before. A close error
+// wins over pass 2's result.
+func (c *BucketCounter) overlapPasses(ctx context.Context, sp *spill, base string) (int64, error) {
+	buckets := sp.touched()
+	pos := make([]int, len(sp.buckets))
+	for j, i := range buckets {
+		pos[i] = j + 1
+	}
+	// Buffered for every bucket, so sealing never waits on a worker, not
+	// even on one that has stopped
+	sealed := make(chan int, len(buckets))
+	closed := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		closed <- c.closeSpill(sp, base, nil, func(i int) {
+			if pos[i] > 0 {
+				sealed <- pos[i] - 1
+			}
+		})
+		close(sealed)
+		c.log.Debug("bucket files closed during pass 2", "elapsed", time.Since(start).Round(time.Millisecond))
+	}()
+	n, err := c.countSealed(ctx, sp, buckets, 0, sealed)
+	if cerr := <-closed; cerr != nil {
+		return 0, cerr
+	}
+	return n, err
+}
@@ -0,0 +1,114 @@
+package bucket
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/gen"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Counting buckets while the files of others are still being closed must
+// give the sequential count, with buckets in memory, spilled and split,
+// with ranges, and for several inputs, and must leave no files behind.
+func TestOverlapPasses(t *testing.T) {
+	rng := rand.New(rand.NewPCG(11, 12))
+	var b strings.Builder
+	seen := make(map[uint32]bool)
+	for range 150000 {
+		ip := rng.Uint32()
+		if rng.IntN(4) > 0 {
+			ip = 10<<24 | rng.Uint32N(1<<16)
+		}
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	b.WriteString("172.16.0.0/24\n")
+	want := int64(len(seen)) + 256
+	input := b.String()
+
+	for _, o := range []Options{
+		{},
+		{MemBuffer: -1},
+		{MemBuffer: 4 << 10, SplitAt: 32 << 10},
+	} {
+		tmp := t.TempDir()
+		o.Overlap, o.TempDir = true, tmp
+		o.Parse = utils.ParseOptions{CIDR: true, MinPrefix: 16}
+		c := NewWithOptions(o)
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%+v: %d, want %d", o, n, want)
+		}
+		half := len(input) / 2
+		half += strings.IndexByte(input[half:], '\n') + 1
+		inputs := []counter.Input{
+			{Name: "a", Size: int64(half), Open: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(input[:half])), nil }},
+			{Name: "b", Size: int64(len(input) - half), Open: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(input[half:])), nil }},
+		}
+		if n, err = c.CountParallel(context.Background(), inputs, 2); err != nil || n != want {
+			t.Errorf("%+v, two inputs: %d, %v, want %d", o, n, err, want)
+		}
+		if left, _ := os.ReadDir(tmp); len(left) > 0 {
+			t.Errorf("%+v: %d entries left in the temp dir", o, len(left))
+		}
+	}
+}
+
+var overlapLines = flag.Uint64("overlap-lines", 4_000_000, "lines of the input BenchmarkOverlap generates; 300000000 writes about 4.5 GB")
+
+// BenchmarkOverlap counts a generated input with every bucket spilled,
+// with and without Overlap; the difference is the close of pass 1 that
+// pass 2 now hides. The input is written once per run of the benchmark,
+// so a multi-GB one, set with -overlap-lines, needs that much in TMPDIR.
+func BenchmarkOverlap(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "input.txt")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	res, err := gen.Write(w, gen.Config{Lines: *overlapLines, Unique: *overlapLines / 4, Seed: 1, Shuffle: true})
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, overlap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("overlap=%v", overlap), func(b *testing.B) {
+			b.SetBytes(st.Size())
+			c := NewWithOptions(Options{MemBuffer: -1, Overlap: overlap, TempDir: b.TempDir(), Logger: discard})
+			for range b.N {
+				n, err := c.CountUniqueIPs(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != int64(res.Unique) {
+					b.Fatalf("%d unique, want %d", n, res.Unique)
+				}
+			}
+		})
+	}
+}
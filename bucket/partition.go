@@ -0,0 +1,131 @@
+package bucket
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// Partition selects how pass 1 assigns an address to a bucket.
+type Partition int
+
+const (
+	// PartitionTopByte takes the bucket from the address's top bits and
+	// stores its suffix, counted in pass 2 with a bitset of every
+	// suffix. Bucket sizes follow the input: one busy /8 is one large
+	// bucket.
+	PartitionTopByte Partition = iota
+	// PartitionHash takes the bucket from a hash of the address and
+	// stores all 4 bytes of it, so buckets come out the same size
+	// whatever the input; pass 2 sorts each bucket's addresses to count
+	// them, in 4 bytes per record of the bucket instead of a bitset.
+	PartitionHash
+)
+
+// ParsePartition parses topbyte or hash.
+func ParsePartition(s string) (Partition, error) {
+	switch strings.ToLower(s) {
+	case "", "topbyte":
+		return PartitionTopByte, nil
+	case "hash":
+		return PartitionHash, nil
+	}
+	return 0, fmt.Errorf("unknown bucket partition %q (want topbyte|hash)", s)
+}
+
+func (p Partition) String() string {
+	if p == PartitionHash {
+		return "hash"
+	}
+	return "topbyte"
+}
+
+// bucketOf returns the bucket ip goes to.
+func (l Layout) bucketOf(ip uint32) int {
+	if l.Partition == PartitionHash {
+		return int(mix(ip) >> l.SuffixBits)
+	}
+	return int(ip >> l.SuffixBits)
+}
+
+// mix is the murmur3 32-bit finalizer: a bijection whose high bits depend
+// on every bit of the address, so the addresses of one subnet spread over
+// every bucket.
+func mix(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// countHashBucket counts the distinct addresses in bucket i of a hash
+// partitioned spill, or those seen t.min times, by sorting them in bufs'
+// key buffer, grown to the bucket's records, and returns them with the
+// record bytes read.
+func countHashBucket(ctx context.Context, sp *spill, i int, bufs *pass2Buffers, t tally) (added, size int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	b := &sp.buckets[i]
+	keys := bufs.keys[:0]
+	if want := int(b.written+int64(len(b.mem))) / 4; cap(keys) < want {
+		keys = make([]uint32, 0, want)
+	}
+	err = sp.records(ctx, i, 4, bufs.read, func(recs []byte) {
+		for off := 0; off+4 <= len(recs); off += 4 {
+			keys = append(keys, binary.BigEndian.Uint32(recs[off:]))
+		}
+		size += int64(len(recs))
+	})
+	bufs.keys = keys
+	if err != nil {
+		return 0, 0, err
+	}
+	slices.Sort(keys)
+	return t.runs(keys), size, nil
+}
+
+// runs returns how many distinct values sorted keys holds, or with a
+// minimum how many of them repeat at least that many times.
+func (t tally) runs(keys []uint32) int64 {
+	least := max(int(t.min), 1)
+	var n int64
+	for i := 0; i < len(keys); {
+		j := i + 1
+		for j < len(keys) && keys[j] == keys[i] {
+			j++
+		}
+		if j-i >= least {
+			n++
+		}
+		i = j
+	}
+	return n
+}
+
+// hashWorkers returns how many pass-2 workers of a hash partitioned run
+// fit in Options.MaxMem, each holding the addresses of a bucket as large
+// as the largest of buckets next to its read buffer, and an error when
+// not even one does. Without a budget it is c.workers().
+func (c *BucketCounter) hashWorkers(sp *spill, buckets []int) (int, error) {
+	if c.opts.MaxMem <= 0 {
+		return c.workers(), nil
+	}
+	var largest int64
+	for _, i := range buckets {
+		b := &sp.buckets[i]
+		largest = max(largest, b.written+int64(len(b.mem)))
+	}
+	each := largest + readBufSize
+	if each > c.opts.MaxMem {
+		return 0, fmt.Errorf("%w: a hash partitioned bucket of %s needs %s to sort in pass 2, budget is %s; use more buckets or topbyte partitioning",
+			counter.ErrMemBudget, counter.FormatBytes(largest), counter.FormatBytes(each), counter.FormatBytes(c.opts.MaxMem))
+	}
+	return max(1, min(c.workers(), int(c.opts.MaxMem/each))), nil
+}
@@ -0,0 +1,116 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Hash partitioning counts what top-byte partitioning does, with buckets
+// in memory, spilled and compressed, with a minimum number of
+// occurrences and from kept buckets, and gives a skewed input buckets of
+// about the same size.
+func TestHashPartition(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	var b strings.Builder
+	for range 100000 {
+		ip := rng.Uint32()
+		if rng.IntN(10) < 9 {
+			ip = 10<<24 | rng.Uint32N(1<<16)
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	input := b.String()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, o := range []Options{
+		{},
+		{MemBuffer: -1},
+		{MemBuffer: -1, Compress: CompressFlate, Workers: 3},
+		{MinOccurrences: 2},
+		{MemBuffer: -1, MinOccurrences: 3, MaxMem: 64 << 20},
+	} {
+		o.Logger = discard
+		want, err := NewWithOptions(o).CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.Partition = PartitionHash
+		c := NewWithOptions(o)
+		got, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("%+v: %v", o, err)
+		}
+		if got != want {
+			t.Errorf("%+v: %d by hash, %d by top byte", o, got, want)
+		}
+		var largest, total int64
+		for _, s := range c.BucketStats() {
+			largest = max(largest, s.Bytes)
+			total += s.Bytes
+		}
+		if buckets := int64(len(c.BucketStats())); largest*buckets > 2*total {
+			t.Errorf("%+v: largest of %d buckets holds %d of %d bytes", o, buckets, largest, total)
+		}
+	}
+
+	// Kept buckets remember their partitioning
+	dir := filepath.Join(t.TempDir(), "kept")
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := NewWithOptions(Options{Logger: discard}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithOptions(Options{Partition: PartitionHash, KeepDir: dir, Logger: discard}).CountUniqueIPs(path); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewWithOptions(Options{Partition: PartitionHash, FromDir: dir, Logger: discard}).CountUniqueIPs(path)
+	if err != nil || n != want {
+		t.Errorf("from kept buckets: %d, %v, want %d", n, err, want)
+	}
+
+	if _, err := NewWithOptions(Options{Partition: PartitionHash, Parse: utils.ParseOptions{CIDR: true}}).CountReader(context.Background(), strings.NewReader(input)); err == nil {
+		t.Error("hash partitioning took CIDR lines")
+	}
+}
+
+// BenchmarkPartition counts an input with every address in one /8 under
+// each partitioning and reports the largest bucket's share of the records
+// in percent; by top byte it is all of them.
+func BenchmarkPartition(b *testing.B) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var sb strings.Builder
+	for range 1_000_000 {
+		fmt.Fprintf(&sb, "%s\n", utils.FormatIPv4(10<<24|rng.Uint32N(1<<24)))
+	}
+	input := sb.String()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, p := range []Partition{PartitionTopByte, PartitionHash} {
+		b.Run(p.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			c := NewWithOptions(Options{Partition: p, MemBuffer: -1, TempDir: b.TempDir(), Logger: discard})
+			for range b.N {
+				if _, err := c.CountReader(context.Background(), strings.NewReader(input)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var largest, total int64
+			for _, s := range c.BucketStats() {
+				largest = max(largest, s.Bytes)
+				total += s.Bytes
+			}
+			b.ReportMetric(100*float64(largest)/float64(total), "%largest")
+		})
+	}
+}
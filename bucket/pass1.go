@@ -0,0 +1,271 @@
+package bucket
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/linear"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	bytesPerChunk = 2 * 1024 * 1024 // pass-1 read chunk
+	stageSize     = 4 * 1024        // per-worker per-bucket batch before a locked write
+)
+
+// partition runs pass 1: a producer reads src in chunks split at the last
+// newline, and numWorkers workers parse lines and stage suffix records per
+// bucket, writing a batch to the shared bucket file whenever it fills.
+// Record order within a bucket does not matter to pass 2, so several
+// partitions may fill one spill at once. It returns the number of lines
+// skipped for exceeding MaxLine. Processed chunks are added to pg, if set.
+//
+// With save set, every resumeEvery bytes of src the producer lets the
+// workers finish the chunks handed out and write their batches, then
+// calls save with the offset in src every line before which is in sp.
+func (c *BucketCounter) partition(ctx context.Context, src io.Reader, sp *spill, numWorkers int, pg *progress, save func(end int64) error) (int64, error) {
+	cr := utils.NewDelimChunkReader(src, bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+
+	var (
+		failed    atomic.Bool
+		errOnce   sync.Once
+		firstErr  error
+		oversized atomic.Int64
+		wg        sync.WaitGroup
+		cache     = newDedupCache(sp.layout.Buckets(), c.dedupEntries())
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		failed.Store(true)
+	}
+
+	// startWorkers starts the workers on a new channel of chunks; they
+	// write their batches and return once it is closed
+	startWorkers := func() chan<- utils.Chunk {
+		chunkChan := make(chan utils.Chunk, numWorkers*2)
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stage := make([][]byte, sp.layout.Buckets())
+				dedup := &dedupTally{cache: cache}
+				defer func() {
+					sp.lookups.Add(dedup.lookups)
+					sp.dedupHits.Add(dedup.hits)
+				}()
+				for ch := range chunkChan {
+					if !failed.Load() {
+						n, err := c.partitionChunk(ch.Data, maxLine, stage, dedup, sp, pg)
+						oversized.Add(n)
+						pg.chunk(ch.Data, c.opts.Parse.Delim())
+						c.opts.Progress.AddWorker(i, int64(len(ch.Data)))
+						if err != nil {
+							fail(err)
+						}
+					}
+					cr.Release(ch)
+				}
+				for top, recs := range stage {
+					if len(recs) > 0 && !failed.Load() {
+						if err := sp.write(top, recs); err != nil {
+							fail(err)
+						}
+					}
+				}
+			}()
+		}
+		return chunkChan
+	}
+
+	// Producer
+	chunkChan := startWorkers()
+	next := c.resumeEvery()
+	for !failed.Load() {
+		if err := ctx.Err(); err != nil {
+			fail(err)
+			break
+		}
+		ch, err := cr.Next()
+		if err != nil {
+			if err != io.EOF {
+				fail(counter.WrapRead("", err))
+			}
+			break
+		}
+		end := ch.Offset + int64(len(ch.Data))
+		chunkChan <- ch
+		if save != nil && end >= next {
+			close(chunkChan)
+			wg.Wait()
+			if !failed.Load() {
+				if err := save(end); err != nil {
+					fail(err)
+				}
+			}
+			next = end + c.resumeEvery()
+			chunkChan = startWorkers()
+		}
+	}
+	close(chunkChan)
+	wg.Wait()
+	return oversized.Load() + cr.Oversized(), firstErr
+}
+
+// partitionChunk stages the suffix of every valid line in chunk, but for
+// the repeats the dedup cache remembers, and returns how many lines were
+// skipped for exceeding maxLine.
+func (c *BucketCounter) partitionChunk(chunk []byte, maxLine int, stage [][]byte, dedup *dedupTally, sp *spill, pg *progress) (int64, error) {
+	l := sp.layout
+	delim := c.opts.Parse.Delim()
+	plain := c.opts.Parse.Plain()
+	var oversized int64
+	for data := chunk; len(data) > 0; {
+		var raw []byte
+		var ip, last uint32
+		var ok bool
+		if plain {
+			// One pass over the line; the lines it turns down are
+			// parsed again below
+			var next int
+			ip, next, ok = utils.ParseIPv4Line(data, 0)
+			raw, data = data[:next], data[next:]
+			if len(raw) > 0 && raw[len(raw)-1] == '\n' {
+				raw = raw[:len(raw)-1]
+			}
+			last, ok = ip, ok && len(raw) <= maxLine
+			if ok && !c.opts.Parse.Filter.Allow(ip) {
+				continue
+			}
+		} else {
+			raw, data = utils.NextRecord(data, delim)
+		}
+		if !ok {
+			if len(raw) > maxLine {
+				oversized++
+				continue
+			}
+			if ip, last, ok = c.parseRecord(raw); !ok {
+				continue
+			}
+		}
+		pg.add(ip, last)
+		if ip != last {
+			l.splitBlock(ip, last, sp)
+			continue
+		}
+		top := l.bucketOf(ip)
+		if dedup.seen(top, ip) {
+			continue
+		}
+		stage[top] = l.appendRecord(stage[top], ip)
+		if len(stage[top]) >= stageSize {
+			if err := sp.write(top, stage[top]); err != nil {
+				return oversized, err
+			}
+			stage[top] = stage[top][:0]
+		}
+	}
+	return oversized, nil
+}
+
+// parseRecord parses one record no longer than the maximum line, logging
+// it if it is invalid, and reports whether it held an address or block.
+func (c *BucketCounter) parseRecord(raw []byte) (first, last uint32, ok bool) {
+	line := c.opts.Parse.Trim(raw)
+	if len(line) == 0 {
+		return 0, 0, false
+	}
+	first, last, form, err := c.opts.Parse.ParseForm(raw, line)
+	if err != nil {
+		c.opts.Parse.Malformed.Add(line, err)
+		c.skips.Add(line, err)
+		return 0, 0, false
+	}
+	c.opts.Parse.Canon.Add(first, last, form)
+	return first, last, true
+}
+
+// progress meters pass 1 for Options.Checkpoint and Options.Progress.
+// The exact count only exists once pass 2 is done, so checkpoints report
+// an estimate from a linear counting sketch fed every address pass 1
+// partitions, and Progress none.
+type progress struct {
+	meter  *counter.Meter
+	sketch *linear.Sketch // nil without checkpoints
+	report *counter.Progress
+}
+
+// newProgress returns pass 1's progress, nil without checkpoints or
+// Options.Progress. Its readers finish chunks out of order, so shares of
+// the input may be a chunk per reader off.
+func (c *BucketCounter) newProgress() *progress {
+	c.opts.Progress.Rename("pass 1")
+	if !c.opts.Checkpoint.Metered() {
+		if c.opts.Progress == nil {
+			return nil
+		}
+		return &progress{report: c.opts.Progress}
+	}
+	sk := linear.NewSketch(0)
+	m := counter.NewMeter(c.opts.Checkpoint, sk.Estimate, true)
+	m.SetInFlight(int64(c.readers) * bytesPerChunk)
+	return &progress{meter: m, sketch: sk, report: c.opts.Progress}
+}
+
+// add feeds the addresses [first, last] to the sketch.
+func (p *progress) add(first, last uint32) {
+	if p == nil || p.sketch == nil {
+		return
+	}
+	for ip := first; ; ip++ {
+		p.sketch.Add(ip)
+		if ip == last {
+			return
+		}
+	}
+}
+
+// finish writes the curve's last row once pass 1 has read everything.
+func (p *progress) finish() {
+	if p != nil {
+		p.meter.Finish()
+	}
+}
+
+// chunk adds a partitioned chunk to the meter and the report.
+func (p *progress) chunk(data []byte, delim byte) {
+	if p == nil {
+		return
+	}
+	var lines int64
+	if !p.meter.Bytes() || p.report != nil {
+		lines = utils.CountRecords(data, delim)
+	}
+	p.meter.Add(lines, int64(len(data)))
+	p.report.Add(lines, int64(len(data)))
+}
+
+// splitBlock records the addresses [first, last] of a CIDR line as one
+// suffix range in each bucket the block touches, rather than a record per
+// address.
+func (l Layout) splitBlock(first, last uint32, sp *spill) {
+	mask := uint32(1)<<l.SuffixBits - 1
+	for top := first >> l.SuffixBits; top <= last>>l.SuffixBits; top++ {
+		r := suffixRange{First: 0, Last: mask}
+		if top == first>>l.SuffixBits {
+			r.First = first & mask
+		}
+		if top == last>>l.SuffixBits {
+			r.Last = last & mask
+		}
+		sp.addRange(int(top), r)
+		if top == last>>l.SuffixBits {
+			break // top would wrap past the last bucket
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package bucket
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Several pass-1 workers spill the same records to the same buckets as
+// one does, only in another order, and pass 2 then counts the same.
+// Every record goes to a file and every repeat is written, so each
+// bucket file, its records sorted, must match byte for byte.
+func TestParallelPass1(t *testing.T) {
+	rng := rand.New(rand.NewPCG(323, 324))
+	seen := map[uint32]bool{}
+	var b strings.Builder
+	for range 200000 {
+		ip := rng.Uint32()
+		if rng.IntN(4) == 0 {
+			ip &= 0x0a00ffff // a few hot /16s repeat often
+		}
+		seen[ip] = true
+		b.WriteString(utils.FormatIPv4(ip) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	defer func() { testHookPass2 = nil }()
+
+	// spilled counts with readers pass-1 workers and returns the touched
+	// buckets and each bucket file's records, sorted
+	spilled := func(readers int) ([]int, map[string][]byte) {
+		var touched []int
+		files := map[string][]byte{}
+		testHookPass2 = func(dir string, buckets []int) {
+			touched = buckets
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Error(err)
+			}
+			for _, e := range entries {
+				data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+				if err != nil {
+					t.Error(err)
+				}
+				files[e.Name()] = sortRecords(data, 3)
+			}
+		}
+		c := NewWithOptions(Options{Readers: readers, MemBuffer: -1, DedupCache: -1, TempDir: t.TempDir(), Logger: discard})
+		n, err := c.CountUniqueIPs(path)
+		if err != nil || n != int64(len(seen)) {
+			t.Errorf("%d readers: %d, %v; want %d", readers, n, err, len(seen))
+		}
+		return touched, files
+	}
+
+	wantTouched, wantFiles := spilled(1)
+	if len(wantTouched) != 256 || len(wantFiles) != 256 {
+		t.Fatalf("one reader: %d buckets touched, %d files; want 256", len(wantTouched), len(wantFiles))
+	}
+	for _, readers := range []int{2, 4, 8} {
+		touched, files := spilled(readers)
+		if !slices.Equal(touched, wantTouched) {
+			t.Errorf("%d readers: touched %v, want %v", readers, touched, wantTouched)
+		}
+		if !maps.EqualFunc(files, wantFiles, bytes.Equal) {
+			t.Errorf("%d readers: bucket files differ from one reader's", readers)
+		}
+	}
+}
+
+// sortRecords returns data's size-byte records in ascending order.
+func sortRecords(data []byte, size int) []byte {
+	recs := make([][]byte, 0, len(data)/size)
+	for i := 0; i+size <= len(data); i += size {
+		recs = append(recs, data[i:i+size])
+	}
+	slices.SortFunc(recs, bytes.Compare)
+	return bytes.Join(recs, nil)
+}
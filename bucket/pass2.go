@@ -0,0 +1,385 @@
+package bucket
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+const defaultMaxWorkers = 8 // beyond this pass 2 is usually disk-bound
+
+// workers returns the pass-2 concurrency.
+func (c *BucketCounter) workers() int {
+	if c.opts.Workers > 0 {
+		return c.opts.Workers
+	}
+	return min(runtime.NumCPU(), defaultMaxWorkers)
+}
+
+// countBuckets runs pass 2 over the buckets sp touched: buckets are
+// independent, so a bounded pool of workers counts them concurrently,
+// keeping peak memory at workers × one bitset. Untouched buckets are never opened
+// or given a bitset. The first error stops the remaining buckets and is
+// returned.
+//
+// A split bucket's own file and ranges are counted first, like any
+// bucket, and its bitset kept; its sub-buckets are then counted into
+// that bitset as units of their own, spread over the workers, and their
+// new suffixes added to the bucket's count, so an address seen on both
+// sides of the split counts once.
+func (c *BucketCounter) countBuckets(ctx context.Context, sp *spill) (int64, error) {
+	buckets := sp.touched()
+	if testHookPass2 != nil {
+		testHookPass2(sp.dir, buckets)
+	}
+	return c.countSealed(ctx, sp, buckets, 0, unitsOf(len(buckets)))
+}
+
+// testHookPass2, if set, is called with the bucket directory and the
+// buckets pass 1 touched as pass 2 starts over them.
+var testHookPass2 func(dir string, touched []int)
+
+// countSealed is countBuckets over buckets, the ones sp touched but for
+// those an earlier run counted prior addresses in, taking them in the
+// order their positions in buckets arrive on sealed, which must deliver
+// each at most once and be closed once the spill's files, sub-buckets
+// included, are. Each bucket's count goes to c.counted once it is final.
+func (c *BucketCounter) countSealed(ctx context.Context, sp *spill, buckets []int, prior int64, sealed <-chan int) (int64, error) {
+	sw, so, fq := c.newSweep(sp.layout), c.newSorter(sp.layout, buckets), c.newFrequent(sp.layout)
+	if len(buckets) == 0 {
+		// Nothing was spilled: no bucket to open, and every count is 0
+		c.log.Debug("bucket pass 2 skipped; no records")
+		c.opts.Stats.Set("bucket pass 2", "skipped, no records")
+		c.prefixes, c.subsamples, c.buckets, c.top = sw.counts(0), sw.subsamples(), nil, fq.list()
+		if sw != nil {
+			c.density = sw.density
+		}
+		return prior, nil
+	}
+	c.log.Debug("bucket pass 2 started", "buckets", len(buckets), "workers", c.workers())
+	c.opts.Progress.Phase("pass 2", "buckets", int64(len(buckets)))
+	c.opts.Progress.SetUnique(prior)
+	var (
+		total   atomic.Int64
+		stats   = make([]BucketStat, len(buckets)) // by position, each set by the worker counting it
+		parents = make([][]uint32, len(buckets))   // by position, the bitsets of split buckets
+	)
+	total.Store(prior)
+	workers, count := c.workers(), countBucket
+	if sp.layout.Partition == PartitionHash {
+		var err error
+		if workers, err = c.hashWorkers(sp, buckets); err != nil {
+			return 0, err
+		}
+		count = countHashBucket
+	}
+	err := c.eachUnit(sp.layout, len(buckets), workers, sealed, func(j int, bufs *pass2Buffers) error {
+		i := buckets[j]
+		began := time.Now()
+		ranges := len(sp.buckets[i].ranges)
+		n, size, err := count(ctx, sp, i, bufs, c.tally)
+		if err != nil {
+			return err
+		}
+		stats[j] = sp.layout.bucketStat(i, size, ranges, n, time.Since(began))
+		c.opts.Progress.SetUnique(total.Add(n))
+		c.opts.Progress.Add(0, 1)
+		if sp.buckets[i].sub != nil {
+			parents[j] = slices.Clone(bufs.bitset) // swept once its sub-buckets are in
+			return nil
+		}
+		if err := c.verifyBucket(sp.layout, i, bufs.bitset, n); err != nil {
+			return err
+		}
+		if err := c.counted.add(i, n); err != nil {
+			return err
+		}
+		c.log.Debug("bucket counted", "bucket", i, "unique", n, "bytes", size)
+		sw.add(i, n, bufs.bitset)
+		fq.add(i, bufs.bitset)
+		return so.add(j, bufs.bitset)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	type subUnit struct{ j, k int } // sub-bucket k of buckets[j]
+	var subs []subUnit
+	for j, set := range parents {
+		if set != nil {
+			for _, k := range sp.buckets[buckets[j]].sub.touched() {
+				subs = append(subs, subUnit{j, k})
+			}
+		}
+	}
+	subStats := make([]BucketStat, len(subs))
+	err = c.eachUnit(sp.layout, len(subs), c.workers(), unitsOf(len(subs)), func(u int, bufs *pass2Buffers) error {
+		sub := subs[u]
+		began := time.Now()
+		n, size, err := countSubBucket(ctx, sp.buckets[buckets[sub.j]].sub, sub.k, parents[sub.j], sp.layout, c.tally, bufs.read)
+		if err != nil {
+			return err
+		}
+		subStats[u] = BucketStat{Bytes: size, Unique: n, Seconds: time.Since(began).Seconds()}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for u, sub := range subs {
+		st := &stats[sub.j]
+		st.Bytes += subStats[u].Bytes
+		st.Unique += subStats[u].Unique
+		st.Seconds += subStats[u].Seconds
+		st.SubBuckets++
+		total.Add(subStats[u].Unique)
+	}
+	for j, set := range parents {
+		if set != nil {
+			if err := c.verifyBucket(sp.layout, buckets[j], set, stats[j].Unique); err != nil {
+				return 0, err
+			}
+			if err := c.counted.add(buckets[j], stats[j].Unique); err != nil {
+				return 0, err
+			}
+			c.log.Debug("bucket counted", "bucket", buckets[j], "unique", stats[j].Unique, "bytes", stats[j].Bytes,
+				"sub_buckets", stats[j].SubBuckets)
+			sw.add(buckets[j], stats[j].Unique, set)
+			fq.add(buckets[j], set)
+			if err := so.add(j, set); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	c.prefixes = sw.counts(total.Load())
+	c.top = fq.list()
+	c.subsamples = sw.subsamples()
+	c.buckets = stats
+	c.reportSkew(stats)
+	if sw != nil {
+		c.density = sw.density
+	}
+	c.log.Info("bucket count done", "unique", total.Load(), "buckets", len(buckets),
+		"elapsed", time.Since(c.started).Round(time.Millisecond))
+	return total.Load(), nil
+}
+
+// eachUnit calls fn for the units of a pass 2 over layout l, n at most,
+// as they arrive on units, on a pool of up to workers workers, each with
+// its own pass-2 buffers. The first error stops the remaining units and
+// is returned.
+func (c *BucketCounter) eachUnit(l Layout, n, workers int, units <-chan int, fn func(j int, bufs *pass2Buffers) error) error {
+	var (
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < min(workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bufs := c.getPass2Buffers(l)
+			defer c.pass2Pool.Put(bufs)
+			for !failed.Load() {
+				j, ok := <-units
+				if !ok {
+					return
+				}
+				if err := fn(j, bufs); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// unitsOf returns the units 0 to n-1, ready at once.
+func unitsOf(n int) <-chan int {
+	units := make(chan int, n)
+	for j := range n {
+		units <- j
+	}
+	close(units)
+	return units
+}
+
+// pass2Buffers is a pass-2 worker's bitset and read buffer, reused for
+// every bucket it counts and, through BucketCounter.pass2Pool, by later
+// runs, so a counter that counts file after file stops allocating them.
+type pass2Buffers struct {
+	bitset []uint32 // 2^SuffixBits bits, 2MB for 24, or counters of that many suffixes; uint32s to set bits quickly
+	keys   []uint32 // the addresses of a hash partitioned bucket, sorted to count them; no bitset then
+	read   []byte   // whole records only
+}
+
+// getPass2Buffers returns pooled buffers sized for l, or new ones when
+// the pool is empty or holds another layout's, as after FromDir.
+func (c *BucketCounter) getPass2Buffers(l Layout) *pass2Buffers {
+	size := l.recordSize()
+	if bufs, ok := c.pass2Pool.Get().(*pass2Buffers); ok && len(bufs.bitset) == c.tally.words(l) && len(bufs.read)%size == 0 {
+		return bufs
+	}
+	return &pass2Buffers{
+		bitset: make([]uint32, c.tally.words(l)),
+		read:   make([]byte, readBufSize/size*size),
+	}
+}
+
+// countBucket counts the distinct suffixes in bucket i with bufs' bitset,
+// reading them from memory or from the bucket file if it was spilled, and
+// returns them with the record bytes read.
+func countBucket(ctx context.Context, sp *spill, i int, bufs *pass2Buffers, t tally) (added, size int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	l := sp.layout
+	m := marker{l: l, t: t, set: bufs.bitset}
+	clear(m.set) // the previous bucket's bits, whether it finished or not
+
+	for _, r := range sp.buckets[i].ranges {
+		added += m.markRange(r)
+	}
+	err = sp.records(ctx, i, l.recordSize(), bufs.read, func(recs []byte) {
+		added += m.markRecords(recs)
+		size += int64(len(recs))
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return added, size, nil
+}
+
+// records calls fn with the records of bucket i, size bytes each, from
+// memory or, a buffer of buf at a time, from its file. The memory is
+// released once read. A trailing partial record is corruption and is
+// ignored.
+func (s *spill) records(ctx context.Context, i, size int, buf []byte, fn func(recs []byte)) error {
+	b := &s.buckets[i]
+	if !b.spilled {
+		fn(b.mem)
+		b.mem = nil // release the buffer as soon as it is counted
+		return nil
+	}
+
+	f, err := os.Open(s.path(i))
+	if err != nil {
+		return fmt.Errorf("bucket %w: open bucket %d: %w", counter.ErrSpill, i, err)
+	}
+	defer f.Close()
+
+	var fr io.Reader = f
+	if s.noCache && s.group == 1 {
+		fr = counter.DropBehind(f, 0, f)
+	}
+	r := s.source(fr)
+	if s.group > 1 {
+		if err := readFrames(ctx, r, byte(i%s.group), size, buf, fn); err != nil {
+			return fmt.Errorf("bucket %w: read bucket %d: %w", counter.ErrSpill, i, err)
+		}
+		return nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(r, buf)
+		fn(buf[:n-n%size])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("bucket %w: read bucket %d: %w", counter.ErrSpill, i, err)
+		}
+	}
+}
+
+// readFrames calls fn with the records in the frames of a shared file
+// tagged tag, skipping the other buckets' frames. Like a bucket file, a
+// truncated tail is ignored.
+func readFrames(ctx context.Context, r io.Reader, tag byte, size int, buf []byte, fn func(recs []byte)) error {
+	br := bufio.NewReader(r)
+	var hdr [frameHeader]byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		left := int64(binary.BigEndian.Uint32(hdr[1:]))
+		if hdr[0] != tag {
+			if _, err := br.Discard(int(left)); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+		for left > 0 {
+			n, err := io.ReadFull(br, buf[:min(int64(len(buf)), left)])
+			fn(buf[:n-n%size])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			left -= int64(n)
+		}
+	}
+}
+
+// markRange sets the bits of every suffix in r a word at a time, returning
+// how many were new.
+func (l Layout) markRange(bitset []uint32, r suffixRange) int64 {
+	var added int64
+	for lo, end := uint64(r.First), uint64(r.Last)+1; lo < end; {
+		word, bit := lo>>5, lo&31
+		n := min(32-bit, end-lo)
+		mask := ^uint32(0)
+		if n < 32 {
+			mask = (uint32(1)<<n - 1) << bit
+		}
+		added += int64(bits.OnesCount32(mask &^ bitset[word]))
+		bitset[word] |= mask
+		lo += n
+	}
+	return added
+}
+
+// markRecords sets the bit of every record in recs, returning how many
+// were new.
+func (l Layout) markRecords(bitset []uint32, recs []byte) int64 {
+	var added int64
+	size := l.recordSize()
+	for off := 0; off+size <= len(recs); off += size {
+		suffix := l.decodeRecord(recs[off:]) // 0..2^SuffixBits-1
+		word := suffix >> 5                  // /32
+		bit := suffix & 31                   // %32
+		mask := uint32(1) << bit
+		if (bitset[word] & mask) == 0 {
+			bitset[word] |= mask
+			added++
+		}
+	}
+	return added
+}
@@ -0,0 +1,91 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A pass-2 worker reuses its bitset for bucket after bucket, and a
+// counter for run after run, so each bucket must start from a clear one.
+// Every bucket here holds the same suffixes: a bit or an occurrence left
+// over from the one before would hide them, or with MinOccurrences 2
+// make addresses seen once count.
+func TestPass2StaleBits(t *testing.T) {
+	rng := rand.New(rand.NewPCG(81, 82))
+	suffixes := make(map[uint32]bool)
+	for len(suffixes) < 3000 {
+		suffixes[rng.Uint32N(1<<24)] = true
+	}
+	input := func(tops ...uint32) string {
+		var b strings.Builder
+		for _, top := range tops {
+			for s := range suffixes {
+				fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(top<<24|s))
+			}
+		}
+		return b.String()
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, mem := range []int{0, -1} { // buckets counted from memory, then from files
+		c := NewWithOptions(Options{Workers: 1, MemBuffer: mem, TempDir: t.TempDir(), Logger: discard})
+		for run, tops := range [][]uint32{{1, 2, 3, 4}, {5, 6}} {
+			n, err := c.CountReader(context.Background(), strings.NewReader(input(tops...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(len(tops) * len(suffixes)); n != want {
+				t.Errorf("mem buffer %d, run %d: %d unique, want %d", mem, run, n, want)
+			}
+		}
+
+		c = NewWithOptions(Options{Workers: 1, MemBuffer: mem, MinOccurrences: 2, TempDir: t.TempDir(), Logger: discard})
+		for run := range 2 {
+			n, err := c.CountReader(context.Background(), strings.NewReader(input(1, 2, 3, 4)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 0 {
+				t.Errorf("mem buffer %d, min occurrences 2, run %d: %d addresses seen twice, want 0", mem, run, n)
+			}
+		}
+	}
+}
+
+// BenchmarkPass2Workers counts an input spread over all 256 buckets, every
+// one spilled, with 1 to 8 pass-2 workers, and reports the time from the
+// start of pass 2 to the count alone as pass2-ns/op.
+func BenchmarkPass2Workers(b *testing.B) {
+	rng := rand.New(rand.NewPCG(322, 323))
+	var sb strings.Builder
+	for range 4_000_000 {
+		fmt.Fprintf(&sb, "%s\n", utils.FormatIPv4(rng.Uint32()))
+	}
+	input := sb.String()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	defer func() { testHookPass2 = nil }()
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			var start time.Time
+			var pass2 time.Duration
+			testHookPass2 = func(string, []int) { start = time.Now() }
+			c := NewWithOptions(Options{Workers: workers, MemBuffer: -1, TempDir: b.TempDir(), Logger: discard})
+			b.SetBytes(int64(len(input)))
+			for range b.N {
+				if _, err := c.CountReader(context.Background(), strings.NewReader(input)); err != nil {
+					b.Fatal(err)
+				}
+				pass2 += time.Since(start)
+			}
+			b.ReportMetric(float64(pass2.Nanoseconds())/float64(b.N), "pass2-ns/op")
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package bucket
+
+import (
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// PrefixCounts returns how many distinct prefixes of each length in
+// Options.PrefixSweep the last run's set held, or nil without a sweep.
+func (c *BucketCounter) PrefixCounts() []counter.PrefixCount {
+	return c.prefixes
+}
+
+// Density returns how many addresses of every /24 the last run's set
+// held, indexed by the block's top 24 bits, or nil without
+// Options.Density.
+func (c *BucketCounter) Density() []uint16 {
+	return c.density
+}
+
+// SubsampleCounts returns how many distinct addresses of the last run's
+// set a by-address sample at each rate of Options.SubsampleRates would
+// have held, or nil without rates.
+func (c *BucketCounter) SubsampleCounts() []counter.SubsampleCount {
+	return c.subsamples
+}
+
+// sweep tallies Options.PrefixSweep, Options.Density and
+// Options.SubsampleRates during pass 2.
+// Buckets hold disjoint address ranges, so a prefix longer than the
+// bucket index is summed bucket by bucket from their bitsets, while a
+// shorter one is a distinct run of high bits among the buckets that held
+// any address; a /24 is 8 words of one bucket's bitset. A nil *sweep does
+// nothing, so pass 2 can call add unconditionally.
+type sweep struct {
+	layout   Layout
+	lengths  []int
+	inBucket []atomic.Int64 // by length, distinct prefixes summed over buckets
+	nonEmpty []bool         // by bucket, each set by the worker counting it
+	density  []uint16       // by /24, nil without Options.Density
+	sub      *counter.Subsample
+}
+
+// newSweep returns the sweep of a pass 2 over layout l, nil if there is
+// none to do.
+func (c *BucketCounter) newSweep(l Layout) *sweep {
+	if len(c.opts.PrefixSweep) == 0 && !c.opts.Density && len(c.opts.SubsampleRates) == 0 {
+		return nil
+	}
+	s := &sweep{
+		layout:   l,
+		lengths:  c.opts.PrefixSweep,
+		inBucket: make([]atomic.Int64, len(c.opts.PrefixSweep)),
+		nonEmpty: make([]bool, l.Buckets()),
+		sub:      counter.NewSubsample(c.opts.SubsampleRates),
+	}
+	if c.opts.Density {
+		s.density = make([]uint16, counter.Slash24s)
+	}
+	return s
+}
+
+// add tallies bucket i once its bitset holds all n of its suffixes.
+func (s *sweep) add(i int, n int64, bitset []uint32) {
+	if s == nil || n == 0 {
+		return
+	}
+	s.nonEmpty[i] = true
+	for k, length := range s.lengths {
+		if length > int(s.layout.TopBits) && length < 32 {
+			s.inBucket[k].Add(countBlocks(bitset, uint(32-length)))
+		}
+	}
+	if s.density != nil {
+		// The bucket's /24s are its own run of entries
+		d := s.density[i<<(s.layout.SuffixBits-8):]
+		for j := 0; j < len(bitset); j += 8 {
+			var n int
+			for _, x := range bitset[j : j+8] {
+				n += bits.OnesCount32(x)
+			}
+			d[j/8] = uint16(n)
+		}
+	}
+	if s.sub != nil {
+		t := s.sub.NewTally()
+		base := uint32(i) << s.layout.SuffixBits
+		for j, x := range bitset {
+			for ; x != 0; x &= x - 1 {
+				s.sub.Add(t, base|uint32(j*32+bits.TrailingZeros32(x)))
+			}
+		}
+		s.sub.Merge(t)
+	}
+}
+
+// subsamples returns the subsample tallies once every bucket was added.
+func (s *sweep) subsamples() []counter.SubsampleCount {
+	if s == nil {
+		return nil
+	}
+	return s.sub.Counts()
+}
+
+// counts returns the prefix tallies once every bucket was added, total
+// being the run's unique count.
+func (s *sweep) counts(total int64) []counter.PrefixCount {
+	if s == nil || len(s.lengths) == 0 {
+		return nil
+	}
+	out := make([]counter.PrefixCount, len(s.lengths))
+	for k, length := range s.lengths {
+		out[k].Length = length
+		switch {
+		case length == 32:
+			out[k].Unique = total
+		case length > int(s.layout.TopBits):
+			out[k].Unique = s.inBucket[k].Load()
+		default:
+			shift := s.layout.TopBits - uint(length)
+			last := -1
+			for i, ok := range s.nonEmpty {
+				if ok && i>>shift != last {
+					last = i >> shift
+					out[k].Unique++
+				}
+			}
+		}
+	}
+	return out
+}
+
+// countBlocks returns how many blocks of 2^host consecutive bits of
+// bitset have any bit set.
+func countBlocks(bitset []uint32, host uint) int64 {
+	var n int64
+	if host >= 5 {
+		words := 1 << (host - 5)
+		for i := 0; i < len(bitset); i += words {
+			for _, x := range bitset[i : i+words] {
+				if x != 0 {
+					n++
+					break
+				}
+			}
+		}
+		return n
+	}
+	// Fold each block into its lowest bit
+	low := ^uint32(0) / (1<<(1<<host) - 1)
+	for _, x := range bitset {
+		for sh := uint(1); sh < 1<<host; sh <<= 1 {
+			x |= x >> sh
+		}
+		n += int64(bits.OnesCount32(x & low))
+	}
+	return n
+}
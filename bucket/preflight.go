@@ -0,0 +1,69 @@
+package bucket
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// avgLineBytes is the mean length of a dotted-quad line with its newline
+// for uniformly spread addresses, used to estimate the line count.
+const avgLineBytes = 14
+
+// ErrInsufficientSpace is returned when SpaceCheck is SpaceAbort and the
+// temp volume looks too small for the spill.
+var ErrInsufficientSpace = errors.New("insufficient temp space")
+
+// SpaceCheck selects what happens when the temp volume looks too small.
+type SpaceCheck int
+
+const (
+	SpaceWarn  SpaceCheck = iota // log a warning and carry on
+	SpaceAbort                   // fail before reading the input
+	SpaceOff                     // skip the check
+)
+
+// ParseSpaceCheck parses warn, abort or off.
+func ParseSpaceCheck(s string) (SpaceCheck, error) {
+	switch strings.ToLower(s) {
+	case "", "warn":
+		return SpaceWarn, nil
+	case "abort":
+		return SpaceAbort, nil
+	case "off":
+		return SpaceOff, nil
+	}
+	return 0, fmt.Errorf("unknown space check %q (want warn|abort|off)", s)
+}
+
+// estimateSpill returns the bytes pass 1 is expected to write for an
+// input of inputSize bytes, ignoring buckets that stay in memory.
+func (c *BucketCounter) estimateSpill(inputSize int64) int64 {
+	return c.layout.SpillBytes(inputSize / avgLineBytes)
+}
+
+// preflight compares the estimated spill for an input of size bytes
+// against the free space in dir and warns or fails according to
+// c.opts.SpaceCheck. A negative size is unknown and skips the check.
+func (c *BucketCounter) preflight(size int64, dir string) error {
+	if c.opts.SpaceCheck == SpaceOff || size < 0 {
+		return nil
+	}
+	free := freeSpace(dir)
+	if free < 0 {
+		return nil
+	}
+	need := c.estimateSpill(size)
+	if need <= free {
+		return nil
+	}
+	if c.opts.SpaceCheck == SpaceAbort {
+		return fmt.Errorf("%w: bucket spill needs about %s but %s has %s free",
+			ErrInsufficientSpace, counter.FormatBytes(need), dir, counter.FormatBytes(free))
+	}
+	c.log.Warn("temp volume may be too small for the bucket spill", "need", counter.FormatBytes(need),
+		"dir", dir, "free", counter.FormatBytes(free))
+	return nil
+}
@@ -0,0 +1,64 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"slices"
+	"testing"
+)
+
+// A bucket file written by pass 1 holds each suffix as a 3-byte
+// big-endian record, the smallest and largest 24-bit suffixes included,
+// and pass 2 reads back those suffixes, dropping a partial record left
+// at the end of the file.
+func TestRecordEncoding(t *testing.T) {
+	l, err := NewLayout(DefaultSuffixBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const top = 10
+	suffixes := []uint32{0, 1, 0x00FF00, 0x7FFFFF, 0xFFFFFE, 0xFFFFFF}
+	want := []byte{
+		0x00, 0x00, 0x00,
+		0x00, 0x00, 0x01,
+		0x00, 0xFF, 0x00,
+		0x7F, 0xFF, 0xFF,
+		0xFF, 0xFF, 0xFE,
+		0xFF, 0xFF, 0xFF,
+	}
+	var recs []byte
+	for _, s := range suffixes {
+		recs = l.appendRecord(recs, top<<24|s)
+	}
+	if !bytes.Equal(recs, want) {
+		t.Fatalf("records % x, want % x", recs, want)
+	}
+
+	sp := newSpill(t.TempDir(), l, 0, 4096, CompressNone, 1)
+	if err := sp.write(top, recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(sp.path(top))
+	if err != nil || !bytes.Equal(data, want) {
+		t.Fatalf("bucket file % x, %v; want % x", data, err, want)
+	}
+
+	for _, tail := range [][]byte{nil, {0xFF}, {0xFF, 0xFF}} {
+		if err := os.WriteFile(sp.path(top), append(bytes.Clone(want), tail...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var got []uint32
+		err := sp.records(context.Background(), top, l.recordSize(), make([]byte, 3*4), func(recs []byte) {
+			for ; len(recs) > 0; recs = recs[3:] {
+				got = append(got, l.decodeRecord(recs))
+			}
+		})
+		if err != nil || !slices.Equal(got, suffixes) {
+			t.Errorf("%d trailing bytes: read %x, %v; want %x", len(tail), got, err, suffixes)
+		}
+	}
+}
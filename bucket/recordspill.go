@@ -0,0 +1,125 @@
+package bucket
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// RecordSpillOptions configures NewRecordSpill.
+type RecordSpillOptions struct {
+	Partitions int // number of partitions, 1 to 65536
+	RecordSize int // bytes per record
+
+	// MemBuffer is how many bytes of records a partition keeps in memory
+	// before it gets a file; 0 means DefaultMemBuffer and a negative
+	// value spills every partition.
+	MemBuffer int
+
+	TempDir      string      // where the spill directory is created, "" for os.TempDir
+	Compress     Compression // encoding of the partition files
+	MaxWriteRate int64       // bytes per second reaching the files, 0 for no cap
+	NoCache      bool        // drop the files' pages from the page cache once written and read
+}
+
+// RecordSpill is pass 1's spill for engines whose keys are not addresses,
+// such as the pair engine's 64-bit (source, destination) keys: records of
+// a fixed size are appended to partitions the caller picks, kept in
+// memory until a partition outgrows its buffer, and shared files, the
+// write throttle and compression work as for the bucket files. Records
+// come back per partition in no particular order.
+type RecordSpill struct {
+	sp   *spill
+	size int
+	base string // the volume the spill is on, for messages
+}
+
+// NewRecordSpill creates an empty spill in a new temp directory, which
+// Remove deletes.
+func NewRecordSpill(o RecordSpillOptions) (*RecordSpill, error) {
+	if o.Partitions < 1 || o.Partitions > 1<<16 {
+		return nil, fmt.Errorf("bucket: partitions must be 1 to %d, got %d", 1<<16, o.Partitions)
+	}
+	if o.RecordSize < 1 {
+		return nil, fmt.Errorf("bucket: record size must be positive, got %d", o.RecordSize)
+	}
+	group, _, err := shareFiles(o.Partitions, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	base := cmp.Or(o.TempDir, os.TempDir())
+	dir, err := os.MkdirTemp(base, "ipbuckets-*")
+	if err != nil {
+		return nil, fmt.Errorf("bucket %w: cannot create spill dir in %s: %w", counter.ErrSpill, base, err)
+	}
+	memLimit := o.MemBuffer
+	switch {
+	case memLimit < 0:
+		memLimit = 0
+	case memLimit == 0:
+		memLimit = DefaultMemBuffer
+	}
+	sp := newSpillN(dir, o.Partitions, memLimit, writeBufSize, o.Compress, group)
+	sp.limit = counter.NewLimiter(o.MaxWriteRate)
+	sp.noCache = o.NoCache
+	return &RecordSpill{sp: sp, size: o.RecordSize, base: base}, nil
+}
+
+// Partitions returns the number of partitions.
+func (r *RecordSpill) Partitions() int {
+	return len(r.sp.buckets)
+}
+
+// Write appends whole records to partition i. Writers of different
+// partitions do not contend; writers of one are serialized.
+func (r *RecordSpill) Write(i int, recs []byte) error {
+	if len(recs)%r.size != 0 {
+		return fmt.Errorf("bucket: %d bytes are not whole %d-byte records", len(recs), r.size)
+	}
+	return r.sp.write(i, recs)
+}
+
+// Close flushes and closes the partition files once every record is
+// written, before any is read.
+func (r *RecordSpill) Close() error {
+	return r.sp.close()
+}
+
+// Touched returns the partitions that received records, in order.
+func (r *RecordSpill) Touched() []int {
+	return r.sp.touched()
+}
+
+// Read calls fn with the records of partition i, whole records a buffer
+// at a time; recs is only valid during the call. Once read, a partition
+// kept in memory is released, so each partition is read once. Several
+// partitions may be read at once.
+func (r *RecordSpill) Read(ctx context.Context, i int, fn func(recs []byte)) error {
+	buf := make([]byte, readBufSize/r.size*r.size)
+	return r.sp.records(ctx, i, r.size, buf, fn)
+}
+
+// Written returns the record bytes written to files and the bytes that
+// reached disk, which differ when compressing.
+func (r *RecordSpill) Written() (raw, disk int64) {
+	return r.sp.written()
+}
+
+// String describes where the spill went and how much, for -stats.
+func (r *RecordSpill) String() string {
+	raw, disk := r.sp.written()
+	if r.sp.compress == CompressNone {
+		return fmt.Sprintf("%s to %s", counter.FormatBytes(raw), r.base)
+	}
+	return fmt.Sprintf("%s raw, %s %s-compressed to %s", counter.FormatBytes(raw), counter.FormatBytes(disk), r.sp.compress, r.base)
+}
+
+// Remove closes the files, if still open, and deletes the spill
+// directory.
+func (r *RecordSpill) Remove() error {
+	r.sp.close()
+	return counter.RemoveAll(r.sp.dir)
+}
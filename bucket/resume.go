@@ -0,0 +1,435 @@
+package bucket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+const (
+	// DefaultResumeEvery is the input bytes pass 1 of a ResumeDir run
+	// reads between checkpoints.
+	DefaultResumeEvery = 1 << 30
+
+	// resumeName is the pass-1 checkpoint of a ResumeDir run, replaced
+	// at each checkpoint and removed once the manifest describes the
+	// finished files.
+	resumeName = "resume.json"
+
+	// countedName lists the buckets pass 2 of a ResumeDir run has
+	// counted, as "bucket unique" lines appended and fsynced one by one.
+	countedName = "counted.txt"
+)
+
+// resumeState is a pass-1 checkpoint: the manifest the files would have
+// if the input ended at Offset, and what a resumed run needs besides.
+type resumeState struct {
+	manifest
+	SourceModTime time.Time     `json:"source_mtime"`
+	Offset        int64         `json:"offset"`  // input bytes every line of which is in the files
+	Written       map[int]int64 `json:"written"` // record bytes in each spilled bucket's own file
+}
+
+// resumeEvery returns the input bytes between pass-1 checkpoints.
+func (c *BucketCounter) resumeEvery() int64 {
+	if c.opts.ResumeEvery > 0 {
+		return c.opts.ResumeEvery
+	}
+	return DefaultResumeEvery
+}
+
+// countResumable counts filename with both passes checkpointed in
+// c.opts.ResumeDir, going on from where a run that stopped there left off:
+// pass 2 once the manifest is written, else pass 1 from its last
+// checkpoint, if any.
+func (c *BucketCounter) countResumable(ctx context.Context, filename string) (int64, error) {
+	dir := c.opts.ResumeDir
+	src, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer src.Close()
+	st, err := src.Stat()
+	if err != nil {
+		return 0, counter.WrapRead(filename, err)
+	}
+	if !st.Mode().IsRegular() {
+		return 0, fmt.Errorf("bucket: a resumable run reads a regular file again from where it stopped, and %s is not one", filename)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+		sp, m, err := c.openSpill(dir)
+		if err != nil {
+			return 0, err
+		}
+		if m.SourceSize != st.Size() {
+			return 0, fmt.Errorf("%s is %d bytes but the run in %s counted %s (%d bytes)",
+				filename, st.Size(), dir, m.Source, m.SourceSize)
+		}
+		c.log.Info("bucket run resumed in pass 2", "dir", dir)
+		return c.countLogged(ctx, sp)
+	}
+
+	state, resumed, err := readResume(dir)
+	if err != nil {
+		return 0, err
+	}
+	var sp *spill
+	if resumed {
+		if state.SourceSize != st.Size() || !state.SourceModTime.Equal(st.ModTime()) {
+			return 0, fmt.Errorf("%s has changed since the run in %s began (%d bytes, modified %s, then %d bytes, modified %s); remove the directory to start over",
+				filename, dir, st.Size(), st.ModTime().Format(time.RFC3339), state.SourceSize, state.SourceModTime.Format(time.RFC3339))
+		}
+		if state.Dedup && c.tally.width > 0 {
+			return 0, fmt.Errorf("the run in %s was begun with the pass-1 dedup cache, which skips repeats, so it cannot count occurrences; remove the directory to start over", dir)
+		}
+		if sp, err = c.reopenSpill(dir, state); err != nil {
+			return 0, err
+		}
+		state.Dedup = state.Dedup || c.dedupEntries() > 0
+		c.log.Info("bucket run resumed in pass 1", "dir", dir, "offset", state.Offset, "size", state.SourceSize)
+	} else {
+		if err := prepareKeepDir(dir); err != nil {
+			return 0, err
+		}
+		if sp, err = c.newSpill(dir, 1); err != nil {
+			return 0, err
+		}
+		state = resumeState{
+			manifest: manifest{
+				Buckets:     c.layout.Buckets(),
+				SuffixBits:  c.layout.SuffixBits,
+				Partition:   c.layout.Partition.String(),
+				Group:       sp.group,
+				Compression: c.opts.Compress.String(),
+				Dedup:       c.dedupEntries() > 0,
+				Source:      filename,
+				SourceSize:  st.Size(),
+			},
+			SourceModTime: st.ModTime(),
+		}
+	}
+	sp.sync = true // a checkpoint or manifest must not outlive the records it describes
+	if !resumed {
+		// A run killed before its first checkpoint starts over from this one
+		if err := c.saveResume(sp, &state, 0); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.preflight(st.Size()-state.Offset, dir); err != nil {
+		return 0, err
+	}
+	if _, err := src.Seek(state.Offset, io.SeekStart); err != nil {
+		return 0, counter.WrapRead(filename, err)
+	}
+
+	r := counter.NewRetryFile(ctx, src, c.opts.Retries, c.opts.Stats, c.log)
+	defer r.Close()
+	var in io.Reader = r
+	if c.opts.NoCache {
+		in = counter.DropBehind(src, state.Offset, r)
+	}
+	// The checksum is of the whole input, so only a run that read it all
+	// has one
+	sum := crc32.New(crc32c)
+	if !resumed {
+		in = io.TeeReader(in, sum)
+	}
+	c.log.Debug("bucket pass 1 started", "dir", dir, "buckets", c.layout.Buckets(), "workers", c.readers, "offset", state.Offset)
+	pg := c.newProgress()
+	base := state.Offset
+	oversized, err := c.partition(ctx, in, sp, c.readers, pg, func(end int64) error {
+		return c.saveResume(sp, &state, base+end)
+	})
+	if err == nil {
+		pg.finish()
+	}
+	c.opts.Stats.Set("oversized lines", "%d", oversized)
+	if err := c.closeSpill(sp, dir, err, nil); err != nil {
+		c.log.Info("bucket pass 1 stopped; count the same file into the same directory to resume", "dir", dir, "offset", state.Offset)
+		return 0, err
+	}
+
+	m := state.manifest
+	m.Files = make(map[string]int64)
+	sp.fileSizes(dir, m.Files)
+	m.Ranges, m.Split = sp.ranges(), sp.splitBuckets()
+	if !resumed {
+		m.SourceCRC32C = fmt.Sprintf("%08x", sum.Sum32())
+	}
+	if err := writeManifest(dir, m, true); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(filepath.Join(dir, resumeName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("remove %s: %w", resumeName, err)
+	}
+	return c.countLogged(ctx, sp)
+}
+
+// saveResume flushes the files of sp, which no worker is writing to, and
+// replaces the checkpoint in its directory with one at offset.
+func (c *BucketCounter) saveResume(sp *spill, state *resumeState, offset int64) error {
+	if err := sp.flush(); err != nil {
+		return err
+	}
+	state.Offset = offset
+	state.Written = make(map[int]int64)
+	for i := range sp.buckets {
+		if n := sp.buckets[i].written; n > 0 {
+			state.Written[i] = n
+		}
+	}
+	state.Files = make(map[string]int64)
+	sp.fileSizes(sp.dir, state.Files)
+	state.Ranges, state.Split = sp.ranges(), sp.splitBuckets()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = counter.WriteFileAtomic(filepath.Join(sp.dir, resumeName), true, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("write %s: %w", resumeName, err)
+	}
+	c.log.Debug("bucket pass 1 checkpoint", "offset", offset)
+	return nil
+}
+
+// readResume loads the pass-1 checkpoint in dir, reporting false if there
+// is none.
+func readResume(dir string) (resumeState, bool, error) {
+	var state resumeState
+	data, err := os.ReadFile(filepath.Join(dir, resumeName))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, fmt.Errorf("read %s: %w", resumeName, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, false, fmt.Errorf("parse %s: %w", resumeName, err)
+	}
+	return state, true, nil
+}
+
+// reopenSpill returns the spill a checkpointed pass 1 wrote to dir, its
+// files cut back to their lengths at the checkpoint and those created
+// since removed, ready to be appended to.
+func (c *BucketCounter) reopenSpill(dir string, state resumeState) (*spill, error) {
+	l, err := NewLayout(state.SuffixBits)
+	if err == nil {
+		l.Partition, err = ParsePartition(state.Partition)
+	}
+	if err != nil || l != c.layout || state.Compression != c.opts.Compress.String() {
+		return nil, fmt.Errorf("%w: the run in %s was begun with %s and %s compression, this one uses %s and %s; remove the directory to start over",
+			ErrLayoutMismatch, dir, l, state.Compression, c.layout, c.opts.Compress)
+	}
+	sp, err := c.newSpill(dir, 1)
+	if err != nil {
+		return nil, err
+	}
+	group := max(state.Group, 1)
+	if group > maxGroup {
+		return nil, fmt.Errorf("%s has %d buckets per file, at most %d are supported", resumeName, state.Group, maxGroup)
+	}
+	sp.group, sp.files = group, make([]spillFile, (len(sp.buckets)+group-1)/group)
+
+	for i, n := range state.Written {
+		if i < 0 || i >= len(sp.buckets) {
+			return nil, fmt.Errorf("%s lists bucket %d of %d", resumeName, i, len(sp.buckets))
+		}
+		sp.buckets[i].spilled, sp.buckets[i].written = true, n
+	}
+	for _, i := range state.Split {
+		if i < 0 || i >= len(sp.buckets) {
+			return nil, fmt.Errorf("%s lists split bucket %d of %d", resumeName, i, len(sp.buckets))
+		}
+		sp.spare.Add(-subBuckets)
+		sp.addSub(i)
+	}
+	for i, ranges := range state.Ranges {
+		if i < 0 || i >= len(sp.buckets) {
+			return nil, fmt.Errorf("%s lists ranges for bucket %d of %d", resumeName, i, len(sp.buckets))
+		}
+		sp.buckets[i].ranges = ranges
+	}
+
+	// Cut every file back to the checkpoint and note it as written so
+	// far, and remove those begun since
+	keep := make(map[string]bool)
+	for rel, size := range state.Files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.Truncate(path, size); errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s lists %s, which is missing from %s", ErrPartialBucket, resumeName, rel, dir)
+		} else if err != nil {
+			return nil, fmt.Errorf("bucket %w: %w", counter.ErrSpill, err)
+		}
+		keep[path] = true
+	}
+	sp.restoreFiles(keep, state.Files)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case path == dir:
+			return nil
+		case d.IsDir():
+			if keep[path] {
+				return nil
+			}
+			if err := os.RemoveAll(path); err != nil { // a split since the checkpoint
+				return err
+			}
+			return filepath.SkipDir
+		case !keep[path] && filepath.Ext(path) == ".bin":
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bucket %w: %w", counter.ErrSpill, err)
+	}
+	return sp, nil
+}
+
+// restoreFiles records the lengths files, by slash-separated path relative
+// to the top spill's directory, gives the files of s, sub-buckets
+// included, and marks every split bucket's directory in keep by path.
+func (s *spill) restoreFiles(keep map[string]bool, files map[string]int64) {
+	root := s.dir
+	var walk func(s *spill)
+	walk = func(s *spill) {
+		for j := range s.files {
+			rel, _ := filepath.Rel(root, s.path(j*s.group))
+			if n, ok := files[filepath.ToSlash(rel)]; ok {
+				s.files[j].disk = n
+				if s.group == 1 {
+					s.buckets[j].spilled = true
+				}
+			}
+		}
+		for i := range s.buckets {
+			if sub := s.buckets[i].sub; sub != nil {
+				keep[sub.dir] = true
+				walk(sub)
+			}
+		}
+	}
+	walk(s)
+}
+
+// countLogged runs pass 2 over sp, a ResumeDir run's, skipping the
+// buckets an earlier run recorded as counted and recording the others as
+// they are.
+func (c *BucketCounter) countLogged(ctx context.Context, sp *spill) (int64, error) {
+	log, done, err := openCountLog(filepath.Join(sp.dir, countedName))
+	if err != nil {
+		return 0, err
+	}
+	defer log.close()
+	var (
+		buckets []int
+		prior   int64
+	)
+	for _, i := range sp.touched() {
+		if n, ok := done[i]; ok {
+			prior += n
+		} else {
+			buckets = append(buckets, i)
+		}
+	}
+	if len(done) > 0 {
+		c.log.Info("bucket pass 2 resumed", "counted", len(done), "left", len(buckets), "unique_so_far", prior)
+		c.opts.Stats.Set("bucket resume", "%d buckets counted before, %d left", len(done), len(buckets))
+		if len(buckets) == 0 {
+			return prior, nil
+		}
+	}
+	c.counted = log
+	defer func() { c.counted = nil }()
+	return c.countSealed(ctx, sp, buckets, prior, unitsOf(len(buckets)))
+}
+
+// countLog is the file pass 2 of a ResumeDir run records each bucket's
+// count in once it is final. Safe for concurrent use; a nil *countLog
+// records nothing.
+type countLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openCountLog opens the count log at path for appending, creating it if
+// missing, and returns the counts it holds by bucket. A last line cut
+// short by a crash is dropped.
+func openCountLog(path string) (*countLog, map[int]int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bucket %w: %w", counter.ErrSpill, err)
+	}
+	done := make(map[int]int64)
+	var good int64
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("read %s: %w", countedName, err)
+		}
+		i, n, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+		bi, err1 := strconv.Atoi(string(i))
+		bn, err2 := strconv.ParseInt(string(n), 10, 64)
+		if !ok || err1 != nil || err2 != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s has an invalid line %q", countedName, line)
+		}
+		done[bi] = bn
+		good += int64(len(line))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("bucket %w: %w", counter.ErrSpill, err)
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("bucket %w: %w", counter.ErrSpill, err)
+	}
+	return &countLog{f: f}, done, nil
+}
+
+// add records that bucket i holds n addresses.
+func (l *countLog) add(i int, n int64) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := fmt.Fprintf(l.f, "%d %d\n", i, n); err != nil {
+		return fmt.Errorf("bucket %w: record bucket %d: %w", counter.ErrSpill, i, err)
+	}
+	if err := counter.Fsync(l.f); err != nil {
+		return fmt.Errorf("bucket %w: record bucket %d: %w", counter.ErrSpill, i, err)
+	}
+	return nil
+}
+
+func (l *countLog) close() {
+	l.f.Close()
+}
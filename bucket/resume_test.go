@@ -0,0 +1,137 @@
+package bucket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// afterCheckpoints calls fn once a run has logged n pass-1 checkpoints.
+type afterCheckpoints struct {
+	n  int
+	fn func()
+}
+
+func (w *afterCheckpoints) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("bucket pass 1 checkpoint")) {
+		if w.n--; w.n == 0 {
+			w.fn()
+		}
+	}
+	return len(p), nil
+}
+
+// A resumable run stopped partway through pass 1 goes on from its last
+// checkpoint, dropping what it wrote after it, one stopped in pass 2
+// counts only the buckets it had not recorded, and both end with the
+// count of an uninterrupted run.
+func TestResume(t *testing.T) {
+	rng := rand.New(rand.NewPCG(9, 10))
+	var b strings.Builder
+	b.WriteString("192.168.0.0/24\n")
+	for range 1200000 {
+		ip := rng.Uint32()
+		if rng.IntN(10) < 8 {
+			ip = 10<<24 | rng.Uint32N(1<<18)
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cidr := utils.ParseOptions{CIDR: true, MinPrefix: 8}
+	want, err := NewWithOptions(Options{Parse: cidr}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A run that crashes saving its third checkpoint, having flushed more
+	// records and split a bucket since the second
+	dir := filepath.Join(t.TempDir(), "work")
+	resumable := func(log *slog.Logger) *BucketCounter {
+		return NewWithOptions(Options{Parse: cidr, ResumeDir: dir, ResumeEvery: 2 << 20, SplitAt: 600 << 10, Logger: log})
+	}
+	errCrash := errors.New("crashed")
+	crashing := false
+	defer func(orig func(*os.File) error) { counter.Fsync = orig }(counter.Fsync)
+	counter.Fsync = func(f *os.File) error {
+		if crashing {
+			return errCrash
+		}
+		return nil
+	}
+	crashAfter := func(n int) *slog.Logger {
+		crashing = false
+		w := &afterCheckpoints{n: n, fn: func() { crashing = true }}
+		return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	if _, err := resumable(crashAfter(2)).CountUniqueIPs(path); !errors.Is(err, errCrash) {
+		t.Fatalf("crashed run: %v", err)
+	}
+	crashing = false
+	state, ok, err := readResume(dir)
+	if err != nil || !ok || state.Offset == 0 || state.Offset >= int64(b.Len()) {
+		t.Fatalf("checkpoint at %d of %d, %v, %v", state.Offset, b.Len(), ok, err)
+	}
+	if len(state.Split) > 0 || len(state.Ranges) == 0 {
+		t.Fatalf("checkpoint with splits %v and ranges %v, want none and some", state.Split, state.Ranges)
+	}
+	if _, err := os.Stat(subDir(dir, 10)); err != nil {
+		t.Fatalf("no split since the checkpoint: %v", err)
+	}
+
+	discard := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	if n, err := resumable(discard).CountUniqueIPs(path); err != nil || n != want {
+		t.Fatalf("resumed in pass 1: %d, %v, want %d", n, err, want)
+	}
+	if _, ok, _ := readResume(dir); ok {
+		t.Errorf("%s left behind after pass 1", resumeName)
+	}
+
+	// Keep two recorded buckets and half a line, as a crash while
+	// recording a third would
+	counted := filepath.Join(dir, countedName)
+	data, err := os.ReadFile(counted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) < 4 {
+		t.Fatalf("%d buckets recorded", len(lines)-1)
+	}
+	kept := lines[0] + lines[1] + lines[2][:len(lines[2])/2]
+	if err := os.WriteFile(counted, []byte(kept), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := resumable(discard).CountUniqueIPs(path); err != nil || n != want {
+		t.Fatalf("resumed in pass 2: %d, %v, want %d", n, err, want)
+	}
+	if n, err := resumable(discard).CountUniqueIPs(path); err != nil || n != want {
+		t.Errorf("finished run: %d, %v, want %d", n, err, want)
+	}
+
+	// A checkpoint of another file is refused
+	dir = filepath.Join(t.TempDir(), "work")
+	if _, err := resumable(crashAfter(1)).CountUniqueIPs(path); !errors.Is(err, errCrash) {
+		t.Fatalf("crashed run: %v", err)
+	}
+	crashing = false
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumable(discard).CountUniqueIPs(path); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("changed input: %v", err)
+	}
+}
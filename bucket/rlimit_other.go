@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package bucket
+
+func openFileLimit() int {
+	return -1
+}
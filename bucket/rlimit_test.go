@@ -0,0 +1,90 @@
+//go:build linux || darwin
+
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// rlimitEnv carries the open file limit into the test's child process.
+const rlimitEnv = "BUCKET_TEST_RLIMIT_NOFILE"
+
+// Under a lowered RLIMIT_NOFILE, 1024 buckets share files so that pass 1
+// stays under the limit and the count stays exact, and a limit too low
+// for that fails before pass 1 with a spill error rather than with "too
+// many open files" halfway through. The limit is lowered in a child
+// process so the other tests keep theirs.
+func TestOpenFileLimit(t *testing.T) {
+	if s := os.Getenv(rlimitEnv); s != "" {
+		limit, _ := strconv.ParseUint(s, 10, 64)
+		rlimitChild(t, limit)
+		return
+	}
+	for _, limit := range []int{96, 36} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestOpenFileLimit$", "-test.v")
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", rlimitEnv, limit))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("RLIMIT_NOFILE %d: %v\n%s", limit, err, out)
+		}
+	}
+}
+
+// rlimitChild lowers the soft limit on open files to limit and counts
+// under it.
+func rlimitChild(t *testing.T, limit uint64) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		t.Fatal(err)
+	}
+	rl.Cur = limit
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		t.Fatal(err)
+	}
+	if got := openFileLimit(); got != int(limit) {
+		t.Fatalf("open file limit %d after lowering it to %d", got, limit)
+	}
+
+	rng := rand.New(rand.NewPCG(15, 16))
+	var b strings.Builder
+	seen := make(map[uint32]bool)
+	for range 50000 {
+		ip := rng.Uint32()
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	stats := &counter.Stats{}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c := NewWithOptions(Options{MaxBucketMem: 512 << 10, Workers: 2, TempDir: t.TempDir(), Stats: stats, Logger: discard})
+	n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+	files := int(limit) - fdReserve - 1
+	if (1024+files-1)/files > maxGroup {
+		if !errors.Is(err, counter.ErrSpill) || !strings.Contains(err.Error(), "open file limit") {
+			t.Errorf("1024 buckets under a limit of %d: got %v, want a spill error naming the limit", limit, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(seen)) {
+		t.Errorf("%d unique, want %d", n, len(seen))
+	}
+	want := fmt.Sprintf("%d buckets per file, %d spill files open at most", (1024+files-1)/files, files)
+	if got := stats.Map()["bucket files"]; got != want {
+		t.Errorf("bucket files %q, want %q", got, want)
+	}
+}
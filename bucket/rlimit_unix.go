@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package bucket
+
+import "syscall"
+
+// openFileLimit returns the process's soft limit on open files, or -1 if
+// unknown.
+func openFileLimit() int {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil || rl.Cur > 1<<30 {
+		return -1
+	}
+	return int(rl.Cur)
+}
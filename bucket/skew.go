@@ -0,0 +1,103 @@
+package bucket
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	// DefaultSkewWarn is the share of the records one bucket may hold
+	// before a run warns that it dominates pass 2.
+	DefaultSkewWarn = 0.5
+
+	// skewMinBytes is the records below which a run is too short for
+	// the skew to matter, so it is reported but never warned about.
+	skewMinBytes = 64 << 20
+
+	skewTop = 3 // largest buckets named in the stats
+)
+
+// BucketStat is what one bucket of a run held and cost in pass 2.
+type BucketStat struct {
+	Bucket  int     `json:"bucket"`
+	Prefix  string  `json:"prefix"`  // the addresses the bucket holds, e.g. 10.0.0.0/8, or "hash 17" by hash
+	Bytes   int64   `json:"bytes"`   // record bytes pass 1 wrote to it, in memory or spilled
+	Ranges  int     `json:"ranges"`  // CIDR ranges set without records
+	Unique  int64   `json:"unique"`  // distinct addresses, or those seen MinOccurrences times
+	Seconds float64 `json:"seconds"` // pass-2 time counting it, summed over its sub-buckets
+
+	// SubBuckets is how many sub-buckets a split bucket's later records
+	// went to, 0 for a bucket that was not split.
+	SubBuckets int `json:"sub_buckets,omitempty"`
+}
+
+// BucketStats returns the buckets the last run touched, in bucket order,
+// or nil before a run finishes.
+func (c *BucketCounter) BucketStats() []BucketStat {
+	return c.buckets
+}
+
+// bucketStat returns the stat of bucket i of l.
+func (l Layout) bucketStat(i int, bytes int64, ranges int, unique int64, took time.Duration) BucketStat {
+	prefix := fmt.Sprintf("%s/%d", utils.FormatIPv4(uint32(i)<<l.SuffixBits), l.TopBits)
+	if l.Partition == PartitionHash {
+		prefix = fmt.Sprintf("hash %d", i)
+	}
+	return BucketStat{
+		Bucket:  i,
+		Prefix:  prefix,
+		Bytes:   bytes,
+		Ranges:  ranges,
+		Unique:  unique,
+		Seconds: took.Seconds(),
+	}
+}
+
+// reportSkew records how evenly the records of a pass 2 spread over its
+// buckets: the coefficient of variation of their sizes and the largest
+// few. A bucket holding more than Options.SkewWarn of them is warned
+// about, since pass 2 cannot finish before that one bucket does however
+// many workers count the rest.
+func (c *BucketCounter) reportSkew(buckets []BucketStat) {
+	var total int64
+	for _, b := range buckets {
+		total += b.Bytes
+	}
+	if total == 0 {
+		return
+	}
+	mean := float64(total) / float64(len(buckets))
+	var sq float64
+	for _, b := range buckets {
+		sq += (float64(b.Bytes) - mean) * (float64(b.Bytes) - mean)
+	}
+	c.opts.Stats.Set("bucket size cv", "%.2f over %d buckets", math.Sqrt(sq/float64(len(buckets)))/mean, len(buckets))
+
+	largest := slices.SortedFunc(slices.Values(buckets), func(a, b BucketStat) int {
+		return cmp.Compare(b.Bytes, a.Bytes)
+	})
+	var sb strings.Builder
+	for i, b := range largest[:min(skewTop, len(largest))] {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s %.0f%% (%s, %d unique, %s)", b.Prefix, 100*float64(b.Bytes)/float64(total),
+			counter.FormatBytes(b.Bytes), b.Unique, time.Duration(b.Seconds*float64(time.Second)).Round(time.Millisecond))
+	}
+	c.opts.Stats.Set("largest buckets", "%s", sb.String())
+
+	top := largest[0]
+	share := float64(top.Bytes) / float64(total)
+	if limit := cmp.Or(c.opts.SkewWarn, DefaultSkewWarn); share > limit && total >= skewMinBytes {
+		c.opts.Stats.Set("bucket skew", "%s holds %.0f%% of the records, above %.0f%%", top.Prefix, 100*share, 100*limit)
+		c.log.Warn("one bucket holds most of the records and bounds pass 2", "bucket", top.Prefix,
+			"share", fmt.Sprintf("%.0f%%", 100*share), "bytes", counter.FormatBytes(top.Bytes))
+	}
+}
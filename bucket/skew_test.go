@@ -0,0 +1,51 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Each touched bucket reports the records pass 1 gave it, spilled or not,
+// and its share of the count, and the largest leads the skew summary.
+func TestBucketStats(t *testing.T) {
+	var b strings.Builder
+	for i := range 50000 {
+		fmt.Fprintf(&b, "10.%d.%d.%d\n", i>>16&0xff, i>>8&0xff, i&0xff)
+		if i%10 == 0 {
+			fmt.Fprintf(&b, "192.168.%d.%d\n", i>>8&0xff, i&0xff)
+		}
+	}
+	b.WriteString("172.16.0.0/30\n")
+	stats := new(counter.Stats)
+	c := NewWithOptions(Options{MemBuffer: 16 << 10, Stats: stats,
+		Parse: utils.ParseOptions{CIDR: true, MinPrefix: 8}})
+	n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]BucketStat{
+		"10.0.0.0/8":  {Bucket: 10, Bytes: 50000 * 3, Unique: 50000},
+		"172.0.0.0/8": {Bucket: 172, Ranges: 1, Unique: 4},
+		"192.0.0.0/8": {Bucket: 192, Bytes: 5000 * 3, Unique: 5000},
+	}
+	got := c.BucketStats()
+	var sum int64
+	for _, s := range got {
+		w, ok := want[s.Prefix]
+		if !ok || s.Bucket != w.Bucket || s.Bytes != w.Bytes || s.Ranges != w.Ranges || s.Unique != w.Unique {
+			t.Errorf("bucket %s: %+v, want %+v", s.Prefix, s, w)
+		}
+		sum += s.Unique
+	}
+	if len(got) != len(want) || sum != n {
+		t.Errorf("%d buckets summing to %d, want %d summing to %d", len(got), sum, len(want), n)
+	}
+	if s := stats.String(); !strings.Contains(s, "largest buckets: 10.0.0.0/8 91%") || strings.Contains(s, "bucket skew") {
+		t.Errorf("stats:\n%s", s)
+	}
+}
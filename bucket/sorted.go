@@ -0,0 +1,74 @@
+package bucket
+
+import (
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+// sorter hands the addresses of pass 2's buckets to Options.Sorted in
+// ascending order. With prefix partitioning bucket i holds the addresses
+// whose top bits are i, so walking the buckets in order walks the space in
+// order; but workers finish buckets out of order, so a bucket counted
+// before the ones below it keeps a copy of its bitset until they are in.
+// A nil *sorter does nothing, so pass 2 can call add unconditionally.
+type sorter struct {
+	mu      sync.Mutex
+	fn      func(ip uint32) error
+	layout  Layout
+	buckets []int            // the touched buckets, ascending
+	next    int              // position in buckets of the next one to walk
+	pending map[int][]uint32 // by position, bitsets counted ahead of next
+	err     error            // the first error fn returned
+}
+
+// newSorter returns the sorter of a pass 2 over buckets of layout l, nil
+// without Options.Sorted.
+func (c *BucketCounter) newSorter(l Layout, buckets []int) *sorter {
+	if c.opts.Sorted == nil {
+		return nil
+	}
+	return &sorter{fn: c.opts.Sorted, layout: l, buckets: buckets, pending: make(map[int][]uint32)}
+}
+
+// add takes the bitset of buckets[j] once it holds all its suffixes, and
+// walks it and any later ones it was holding up. It returns the first
+// error Options.Sorted returned, now or for an earlier bucket.
+func (s *sorter) add(j int, bitset []uint32) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if j != s.next {
+		s.pending[j] = slices.Clone(bitset)
+		return nil
+	}
+	for {
+		if s.err = s.walk(s.buckets[s.next], bitset); s.err != nil {
+			return s.err
+		}
+		delete(s.pending, s.next)
+		s.next++
+		var ok bool
+		if bitset, ok = s.pending[s.next]; !ok {
+			return nil
+		}
+	}
+}
+
+// walk calls fn for every address of bucket i's bitset in order.
+func (s *sorter) walk(i int, bitset []uint32) error {
+	base := uint32(i) << s.layout.SuffixBits
+	for w, x := range bitset {
+		for ; x != 0; x &= x - 1 {
+			if err := s.fn(base | uint32(w*32+bits.TrailingZeros32(x))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Sorted gets every distinct address once and in ascending order, however
+// the workers finish the buckets, with a split bucket holding up the ones
+// above it and with pass 2 overlapping pass 1.
+func TestSorted(t *testing.T) {
+	rng := rand.New(rand.NewPCG(9, 10))
+	var b strings.Builder
+	seen := make(map[uint32]bool)
+	for range 100000 {
+		ip := rng.Uint32()
+		if rng.IntN(2) == 0 {
+			ip = 10<<24 | rng.Uint32N(1<<16) // splits bucket 10
+		}
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	want := slices.Sorted(func(yield func(uint32) bool) {
+		for ip := range seen {
+			if !yield(ip) {
+				return
+			}
+		}
+	})
+
+	for _, overlap := range []bool{false, true} {
+		var got []uint32
+		c := NewWithOptions(Options{SplitAt: 64 << 10, MemBuffer: -1, Workers: 4, Overlap: overlap,
+			Sorted: func(ip uint32) error {
+				got = append(got, ip)
+				return nil
+			}})
+		n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(want)) || !slices.Equal(got, want) {
+			t.Errorf("overlap %v: %d unique, %d addresses walked, want %d in order", overlap, n, len(got), len(want))
+		}
+	}
+
+	c := NewWithOptions(Options{Partition: PartitionHash, Sorted: func(uint32) error { return nil }})
+	if _, err := c.CountReader(context.Background(), strings.NewReader("1.2.3.4\n")); err == nil {
+		t.Error("a sorted walk of hash-partitioned buckets was accepted")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !windows
+
+package bucket
+
+import (
+	"errors"
+	"syscall"
+)
+
+func freeSpace(dir string) int64 {
+	return -1
+}
+
+func noSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
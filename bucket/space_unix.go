@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package bucket
+
+import (
+	"errors"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the
+// volume holding dir, or -1 if unknown.
+func freeSpace(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
+
+// noSpace reports whether err is a write failing on a full volume.
+func noSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,35 @@
+//go:build windows
+
+package bucket
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the bytes available to this user, quotas included, on
+// the volume holding dir, or -1 if unknown.
+func freeSpace(dir string) int64 {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return -1
+	}
+	var avail uint64
+	if ok, _, _ := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0); ok == 0 {
+		return -1
+	}
+	return int64(avail)
+}
+
+const (
+	errorHandleDiskFull syscall.Errno = 39  // ERROR_HANDLE_DISK_FULL
+	errorDiskFull       syscall.Errno = 112 // ERROR_DISK_FULL
+)
+
+// noSpace reports whether err is a write failing on a full volume.
+func noSpace(err error) bool {
+	return errors.Is(err, errorDiskFull) || errors.Is(err, errorHandleDiskFull)
+}
@@ -0,0 +1,442 @@
+package bucket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// spill owns the bucket files written in pass 1. Workers append batches
+// of records to a bucket under that bucket's lock, so concurrent writers
+// only contend when they flush to the same bucket at the same time. A
+// bucket keeps its records in memory up to memLimit bytes and only gets a
+// file once it overflows, so inputs touching a few /8s, or buckets with few
+// lines, create (and later scan) few files.
+//
+// When the open file limit is below the bucket count, group consecutive
+// buckets share one file and each batch in it is framed with the bucket's
+// tag byte and length, so pass 2 reads a shared file once per bucket.
+//
+// A bucket whose file passes splitAt bytes is split: its later records go
+// to sub-buckets by their next byte, see split.
+type spill struct {
+	dir      string
+	layout   Layout
+	memLimit int
+	writeBuf int
+	compress Compression
+	group    int                   // buckets per file, 1 for a file of bare records per bucket
+	limit    *counter.Limiter      // caps the bytes reaching disk, nil for no cap
+	retry    *counter.WriteRetrier // retries transient write errors, nil for none
+	progress *counter.Progress     // receives the bytes reaching disk, nil for none
+	noCache  bool                  // drop bucket file pages from the page cache once written and read
+	sync     bool                  // fsync each file before closing it, and the directory once all are closed
+	splitAt  int64                 // record bytes in a bucket's file before it is split, 0 to never split
+	spare    atomic.Int64          // open files left for sub-buckets
+	splits   atomic.Int32          // buckets split
+
+	// lookups and dedupHits add up the pass-1 workers' use of the dedup cache
+	lookups, dedupHits atomic.Int64
+
+	buckets []spillBucket
+	files   []spillFile
+}
+
+type spillBucket struct {
+	mu      sync.Mutex
+	mem     []byte // records not yet spilled, nil once the bucket has a file
+	spilled bool   // records live in the bucket's file
+	written int64  // record bytes handed to the bucket's file
+
+	// sub holds the records written after the bucket was split, nil
+	// before; stage batches them by sub-bucket.
+	sub   *spill
+	stage [][]byte
+
+	// ranges are inclusive suffix ranges from CIDR lines, set word-wise
+	// in pass 2 instead of being spilled record by record.
+	ranges []suffixRange
+}
+
+// spillFile is a file on disk holding the records of group buckets.
+type spillFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	disk int64 // bytes that reached the file, after compression
+}
+
+// suffixRange is an inclusive range of suffixes within one bucket.
+type suffixRange struct {
+	First uint32 `json:"first"`
+	Last  uint32 `json:"last"`
+}
+
+// countingWriter counts the bytes written through it, also to p.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+	p *counter.Progress
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.n += int64(n)
+	cw.p.AddTemp(int64(n))
+	return n, err
+}
+
+// bucketPath returns the file holding bucket i.
+func bucketPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("b%03d.bin", i))
+}
+
+// groupPath returns the file holding the buckets of group j.
+func groupPath(dir string, j int) string {
+	return filepath.Join(dir, fmt.Sprintf("g%03d.bin", j))
+}
+
+// newSpill returns an empty spill writing bucket files to dir, group
+// buckets per file.
+func newSpill(dir string, layout Layout, memLimit, writeBuf int, compress Compression, group int) *spill {
+	sp := newSpillN(dir, layout.Buckets(), memLimit, writeBuf, compress, group)
+	sp.layout = layout
+	return sp
+}
+
+// newSpillN returns an empty spill of n buckets of records that are not
+// address suffixes, with no layout.
+func newSpillN(dir string, n, memLimit, writeBuf int, compress Compression, group int) *spill {
+	return &spill{
+		dir:      dir,
+		memLimit: memLimit,
+		writeBuf: writeBuf,
+		compress: compress,
+		group:    group,
+		buckets:  make([]spillBucket, n),
+		files:    make([]spillFile, (n+group-1)/group),
+	}
+}
+
+// path returns the file holding bucket i's records.
+func (s *spill) path(i int) string {
+	if s.group == 1 {
+		return bucketPath(s.dir, i)
+	}
+	return groupPath(s.dir, i/s.group)
+}
+
+// sink returns the writer f's buffered records are flushed into.
+func (s *spill) sink(f *spillFile) io.Writer {
+	w := s.retry.Writer(f.f)
+	if testHookSink != nil {
+		w = testHookSink(w)
+	}
+	if s.noCache {
+		w = counter.DropBehindWriter(f.f, w)
+	}
+	cw := countingWriter{w: counter.ThrottleWriter(w, s.limit), n: &f.disk, p: s.progress}
+	if s.compress != CompressNone {
+		return &blockWriter{w: cw, codec: s.compress}
+	}
+	return cw
+}
+
+// testHookSink, if set, wraps the writer of every bucket file pass 1
+// opens, past any write retries.
+var testHookSink func(w io.Writer) io.Writer
+
+// source returns a reader of bucket file f's records.
+func (s *spill) source(f io.Reader) io.Reader {
+	if s.compress != CompressNone {
+		return newBlockReader(f, s.compress)
+	}
+	return f
+}
+
+// write appends encoded records to bucket i.
+func (s *spill) write(i int, p []byte) error {
+	b := &s.buckets[i]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sub != nil {
+		return s.writeSub(b, p)
+	}
+	if !b.spilled {
+		if len(b.mem)+len(p) <= s.memLimit {
+			if b.mem == nil {
+				b.mem = make([]byte, 0, s.memLimit)
+			}
+			b.mem = append(b.mem, p...)
+			return nil
+		}
+		b.spilled = true
+		if err := s.append(i, b.mem); err != nil {
+			return err
+		}
+		b.written += int64(len(b.mem))
+		b.mem = nil
+	}
+	if err := s.append(i, p); err != nil {
+		return err
+	}
+	b.written += int64(len(p))
+	if s.splitAt > 0 && b.written >= s.splitAt && b.written-int64(len(p)) < s.splitAt {
+		return s.split(i)
+	}
+	return nil
+}
+
+// frameHeader is the size of a batch's tag byte and big-endian length in
+// a shared file.
+const frameHeader = 5
+
+// append writes p to bucket i's file, creating the file on first use and
+// framing p when the file is shared. A file a resumed run kept is
+// appended to.
+func (s *spill) append(i int, p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	f := &s.files[i/s.group]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		file, err := os.OpenFile(s.path(i), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return s.failed("create", i, err)
+		}
+		f.f = file
+		f.w = bufio.NewWriterSize(s.sink(f), s.writeBuf)
+	}
+	if s.group > 1 {
+		var hdr [frameHeader]byte
+		hdr[0] = byte(i % s.group)
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(p)))
+		if _, err := f.w.Write(hdr[:]); err != nil {
+			return s.failed("write", i, err)
+		}
+	}
+	if _, err := f.w.Write(p); err != nil {
+		return s.failed("write", i, err)
+	}
+	return nil
+}
+
+// addRange records that every suffix in r of bucket i was seen.
+func (s *spill) addRange(i int, r suffixRange) {
+	b := &s.buckets[i]
+	b.mu.Lock()
+	b.ranges = append(b.ranges, r)
+	b.mu.Unlock()
+}
+
+// failed wraps an error from bucket file i, naming a full temp volume
+// explicitly since that is by far the most common cause.
+func (s *spill) failed(op string, i int, err error) error {
+	if noSpace(err) {
+		return fmt.Errorf("bucket %w: no space left in %s (%s bucket %d): %w", counter.ErrSpill, s.dir, op, i, err)
+	}
+	return fmt.Errorf("bucket %w: %s bucket %d: %w", counter.ErrSpill, op, i, err)
+}
+
+// flush writes every bucket file's buffered records and fsyncs the files
+// and their directories, sub-buckets included, leaving them open, so
+// their lengths on disk hold every record written so far. Nothing may
+// write to s meanwhile.
+func (s *spill) flush() error {
+	created := false
+	for j := range s.files {
+		f := &s.files[j]
+		if f.f == nil {
+			continue
+		}
+		created = true
+		if err := f.w.Flush(); err != nil {
+			return s.failed("flush", j*s.group, err)
+		}
+		if err := counter.Fsync(f.f); err != nil {
+			return s.failed("fsync", j*s.group, err)
+		}
+	}
+	for i := range s.buckets {
+		if sub := s.buckets[i].sub; sub != nil {
+			if err := sub.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if created {
+		if err := counter.SyncDir(s.dir); err != nil {
+			return fmt.Errorf("bucket %w: fsync %s: %w", counter.ErrSpill, s.dir, err)
+		}
+	}
+	return nil
+}
+
+// close flushes and closes every bucket file.
+func (s *spill) close() error {
+	return s.closeSealing(nil)
+}
+
+// closeSealing is close, calling seal, if set, with each bucket as soon
+// as its own records are final: the buckets that never left memory
+// first, then those of each file once it is flushed and closed. A split
+// bucket's sub-buckets are only final once closeSealing returns. A bucket
+// whose file failed to close is not sealed. With sync every file is
+// fsynced before it is closed, and the directory once all are.
+func (s *spill) closeSealing(seal func(i int)) error {
+	created := false
+	if seal != nil {
+		for i := range s.buckets {
+			if b := &s.buckets[i]; !b.spilled {
+				seal(i)
+			}
+		}
+	}
+	var first error
+	for j := range s.files {
+		f := &s.files[j]
+		ok := true
+		created = created || f.f != nil
+		if f.w != nil {
+			if err := f.w.Flush(); err != nil {
+				ok = false
+				if first == nil {
+					first = s.failed("flush", j*s.group, err)
+				}
+			}
+			f.w = nil
+		}
+		if f.f != nil && s.sync && ok {
+			if err := counter.Fsync(f.f); err != nil {
+				ok = false
+				if first == nil {
+					first = s.failed("fsync", j*s.group, err)
+				}
+			}
+		}
+		if f.f != nil {
+			if err := f.f.Close(); err != nil {
+				ok = false
+				if first == nil {
+					first = s.failed("close", j*s.group, err)
+				}
+			}
+			f.f = nil
+		}
+		if seal != nil && ok {
+			for i := j * s.group; i < min((j+1)*s.group, len(s.buckets)); i++ {
+				if s.buckets[i].spilled {
+					seal(i)
+				}
+			}
+		}
+	}
+	for i := range s.buckets {
+		if sub := s.buckets[i].sub; sub != nil {
+			if err := sub.close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	if s.sync && created && first == nil {
+		if err := counter.SyncDir(s.dir); err != nil {
+			first = fmt.Errorf("bucket %w: fsync %s: %w", counter.ErrSpill, s.dir, err)
+		}
+	}
+	return first
+}
+
+// touched returns the indices of buckets that received records or ranges.
+func (s *spill) touched() []int {
+	var idx []int
+	for i := range s.buckets {
+		if b := &s.buckets[i]; b.spilled || len(b.mem) > 0 || len(b.ranges) > 0 {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// written returns the total record bytes spilled to bucket files and the
+// bytes that reached disk, which differ when compressing, sub-buckets
+// included.
+func (s *spill) written() (raw, disk int64) {
+	for i := range s.buckets {
+		raw += s.buckets[i].written
+		if sub := s.buckets[i].sub; sub != nil {
+			r, d := sub.written()
+			raw, disk = raw+r, disk+d
+		}
+	}
+	for j := range s.files {
+		disk += s.files[j].disk
+	}
+	return raw, disk
+}
+
+// splitBuckets returns the buckets that were split, in order.
+func (s *spill) splitBuckets() []int {
+	var idx []int
+	for i := range s.buckets {
+		if s.buckets[i].sub != nil {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// ranges returns the suffix ranges of every bucket that has some.
+func (s *spill) ranges() map[int][]suffixRange {
+	var m map[int][]suffixRange
+	for i := range s.buckets {
+		if r := s.buckets[i].ranges; len(r) > 0 {
+			if m == nil {
+				m = make(map[int][]suffixRange)
+			}
+			m[i] = r
+		}
+	}
+	return m
+}
+
+// fileSizes adds the bytes each file of s, sub-buckets included, received
+// to m, by slash-separated path relative to root.
+func (s *spill) fileSizes(root string, m map[string]int64) {
+	for j := range s.files {
+		if n := s.files[j].disk; n > 0 {
+			rel, _ := filepath.Rel(root, s.path(j*s.group))
+			m[filepath.ToSlash(rel)] = n
+		}
+	}
+	for i := range s.buckets {
+		if sub := s.buckets[i].sub; sub != nil {
+			sub.fileSizes(root, m)
+		}
+	}
+}
+
+// diskSizes adds the length of every file of s found on disk,
+// sub-buckets included, to m, by slash-separated path relative to root.
+func (s *spill) diskSizes(root string, m map[string]int64) {
+	for j := range s.files {
+		path := s.path(j * s.group)
+		if st, err := os.Stat(path); err == nil {
+			rel, _ := filepath.Rel(root, path)
+			m[filepath.ToSlash(rel)] = st.Size()
+		}
+	}
+	for i := range s.buckets {
+		if sub := s.buckets[i].sub; sub != nil {
+			sub.diskSizes(root, m)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package bucket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// failingWriter passes writes to w until the bytes shared by every
+// failingWriter of a run reach budget, then fails them with err.
+type failingWriter struct {
+	w      io.Writer
+	budget int64
+	used   *atomic.Int64
+	err    error
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.used.Add(int64(len(p))) > f.budget {
+		return 0, &os.PathError{Op: "write", Path: "bucket", Err: f.err}
+	}
+	return f.w.Write(p)
+}
+
+// A bucket file write failing partway through pass 1, whether a bucket
+// of its own, a shared or a compressed file, fails the run with ErrSpill
+// and the cause instead of a count, naming a full volume as such, and
+// leaves nothing in the temp dir.
+func TestSpillWriteError(t *testing.T) {
+	rng := rand.New(rand.NewPCG(141, 142))
+	var b strings.Builder
+	for range 300000 {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(rng.Uint32()))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	defer func() { testHookSink = nil }()
+
+	for _, cause := range []error{syscall.ENOSPC, syscall.EIO} {
+		for _, tc := range []struct {
+			name string
+			o    Options
+		}{
+			{"own files", Options{MemBuffer: -1}},
+			{"shared files", Options{MemBuffer: -1, MaxOpenFiles: 16}},
+			{"compressed", Options{MemBuffer: -1, Compress: CompressFlate}},
+			{"overflowing memory", Options{MemBuffer: 2 << 10}},
+		} {
+			var used atomic.Int64
+			testHookSink = func(w io.Writer) io.Writer {
+				return &failingWriter{w: w, budget: 64 << 10, used: &used, err: cause}
+			}
+			tmp := t.TempDir()
+			o := tc.o
+			o.TempDir, o.Logger = tmp, discard
+			n, err := NewWithOptions(o).CountUniqueIPs(path)
+			if !errors.Is(err, counter.ErrSpill) || !errors.Is(err, cause) || n != 0 {
+				t.Errorf("%v, %s: %d, %v; want ErrSpill from the write", cause, tc.name, n, err)
+			} else if full := strings.Contains(err.Error(), "no space left"); full != noSpace(cause) {
+				t.Errorf("%v, %s: %v names a full volume: %v", cause, tc.name, err, full)
+			}
+			if left, _ := os.ReadDir(tmp); len(left) > 0 {
+				t.Errorf("%v, %s: %d entries left in the temp dir", cause, tc.name, len(left))
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DefaultSplitAt is the record bytes a bucket's file reaches before
+	// the bucket is split by the address's next byte.
+	DefaultSplitAt = 2 << 30
+
+	subBits    = 8 // of the suffix picking a sub-bucket
+	subBuckets = 1 << subBits
+)
+
+// subDir returns the directory holding the sub-buckets of bucket i.
+func subDir(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("b%03d", i))
+}
+
+// subBucket returns the sub-bucket a suffix of l belongs to, its top
+// subBits bits, which for the default layout is the address's second byte.
+func (l Layout) subBucket(suffix uint32) int {
+	return int(suffix >> (l.SuffixBits - subBits))
+}
+
+// split starts routing the records of bucket i, whose file has just
+// passed splitAt, to subBuckets sub-buckets of their own, so that pass 2
+// can count its tail concurrently instead of as one long file. Records
+// already in the bucket's file stay there. Sub-buckets go straight to
+// files with small write buffers; when the open file limit, or
+// Options.MaxOpenFiles, has no room for them, or files are shared, the
+// bucket is left whole. The caller
+// holds the bucket's lock.
+func (s *spill) split(i int) error {
+	if s.group > 1 || s.spare.Add(-subBuckets) < 0 {
+		s.spare.Add(subBuckets)
+		return nil
+	}
+	if err := os.Mkdir(subDir(s.dir, i), 0o755); err != nil {
+		return s.failed("split", i, err)
+	}
+	s.addSub(i)
+	return nil
+}
+
+// addSub gives bucket i the sub-buckets of a split in subDir, which
+// exists, and returns them.
+func (s *spill) addSub(i int) *spill {
+	sub := newSpillN(subDir(s.dir, i), subBuckets, 0, max(s.writeBuf/16, 4096), s.compress, 1)
+	sub.limit, sub.retry, sub.progress = s.limit, s.retry, s.progress
+	sub.noCache = s.noCache
+	sub.sync = s.sync
+	b := &s.buckets[i]
+	b.sub, b.stage = sub, make([][]byte, subBuckets)
+	s.splits.Add(1)
+	return sub
+}
+
+// writeSub appends the records p of a split bucket b to its sub-buckets.
+// The caller holds the bucket's lock, which also guards b.stage.
+func (s *spill) writeSub(b *spillBucket, p []byte) error {
+	l := s.layout
+	size := l.recordSize()
+	for off := 0; off+size <= len(p); off += size {
+		j := l.subBucket(l.decodeRecord(p[off:]))
+		b.stage[j] = append(b.stage[j], p[off:off+size]...)
+	}
+	for j, recs := range b.stage {
+		if len(recs) > 0 {
+			if err := b.sub.write(j, recs); err != nil {
+				return err
+			}
+			b.stage[j] = recs[:0]
+		}
+	}
+	return nil
+}
+
+// countSubBucket marks the records of sub-bucket k of sub, a split
+// bucket's, into set, the bucket's bitset or counters once its own file
+// and ranges are in, returning how many newly count and the record
+// bytes read. Sub-buckets hold disjoint suffixes, so each touches only
+// its 1/256 of set, 8 KB of a 2 MB bitset, and several can be counted
+// into one set at once.
+func countSubBucket(ctx context.Context, sub *spill, k int, set []uint32, l Layout, t tally, buf []byte) (added, size int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	m := marker{l: l, t: t, set: set}
+	err = sub.records(ctx, k, l.recordSize(), buf, func(recs []byte) {
+		added += m.markRecords(recs)
+		size += int64(len(recs))
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return added, size, nil
+}
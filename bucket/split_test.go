@@ -0,0 +1,96 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// With 90% of the addresses in one /8, that bucket splits partway through
+// pass 1, and addresses seen on both sides of the split, in ranges and
+// in other buckets still count once, with a minimum number of
+// occurrences and from kept buckets too.
+func TestSplitBucket(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	var b strings.Builder
+	seen := make(map[uint32]int)
+	for range 200000 {
+		ip := rng.Uint32()
+		if rng.IntN(10) < 9 {
+			ip = 10<<24 | rng.Uint32N(1<<17) // repeats throughout the file
+		}
+		seen[ip]++
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	b.WriteString("10.1.0.0/24\n")
+	for ip := uint32(10<<24 | 1<<16); ip < 10<<24|1<<16|256; ip++ {
+		seen[ip]++
+	}
+	input := b.String()
+	want := func(minOcc int) int64 {
+		var n int64
+		for _, k := range seen {
+			if k >= minOcc {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, minOcc := range []int{1, 2} {
+		o := Options{SplitAt: 64 << 10, MemBuffer: -1, Workers: 4, MinOccurrences: minOcc,
+			Parse: utils.ParseOptions{CIDR: true, MinPrefix: 8}}
+		if minOcc == 1 {
+			o.PrefixSweep = []int{16}
+		}
+		c := NewWithOptions(o)
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want(minOcc) {
+			t.Errorf("min %d: %d unique, want %d", minOcc, n, want(minOcc))
+		}
+		for _, s := range c.BucketStats() {
+			if (s.Bucket == 10) != (s.SubBuckets > 0) {
+				t.Errorf("min %d: bucket %s has %d sub-buckets", minOcc, s.Prefix, s.SubBuckets)
+			}
+		}
+		if minOcc == 1 {
+			slash16 := make(map[uint32]bool)
+			for ip := range seen {
+				slash16[ip>>16] = true
+			}
+			if got := c.PrefixCounts(); got[0].Unique != int64(len(slash16)) {
+				t.Errorf("%d distinct /16s, want %d", got[0].Unique, len(slash16))
+			}
+		}
+	}
+
+	// Kept buckets carry the split over to a later run
+	dir := filepath.Join(t.TempDir(), "kept")
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keep := NewWithOptions(Options{SplitAt: 64 << 10, KeepDir: dir, Parse: utils.ParseOptions{CIDR: true, MinPrefix: 8}})
+	if _, err := keep.CountUniqueIPs(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(subDir(dir, 10)); err != nil {
+		t.Fatalf("bucket 10 was not split: %v", err)
+	}
+	n, err := NewWithOptions(Options{FromDir: dir}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want(1) {
+		t.Errorf("from kept buckets: %d unique, want %d", n, want(1))
+	}
+}
@@ -0,0 +1,58 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Subsample counts taken bucket by bucket in pass 2 must be those of
+// hashing every distinct address, whether a bucket stayed in memory, was
+// spilled or was split.
+func TestSubsampleCounts(t *testing.T) {
+	rng := rand.New(rand.NewPCG(9, 10))
+	var b strings.Builder
+	rates := []float64{0.05, 0.25, 1}
+	want := make([]int64, len(rates))
+	seen := make(map[uint32]bool)
+	for range 200000 {
+		ip := rng.Uint32N(8)<<24 | rng.Uint32N(1<<16)
+		if rng.IntN(4) == 0 {
+			ip = 192<<24 | rng.Uint32N(1<<12)
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		h := counter.SubsampleHash(ip)
+		for i, r := range rates {
+			if r == 1 || float64(h) < r*(1<<64) {
+				want[i]++
+			}
+		}
+	}
+
+	for _, o := range []Options{{}, {MemBuffer: -1, SplitAt: 64 << 10}} {
+		o.SubsampleRates = rates
+		c := NewWithOptions(o)
+		n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := c.SubsampleCounts()
+		if len(got) != len(rates) || got[len(got)-1].Unique != n {
+			t.Fatalf("%+v: %v, want %d rows ending with %d", o, got, len(rates), n)
+		}
+		for i, sc := range got {
+			if sc.Rate != rates[i] || sc.Unique != want[i] {
+				t.Errorf("mem buffer %d: rate %g has %d, want %g with %d", o.MemBuffer, sc.Rate, sc.Unique, rates[i], want[i])
+			}
+		}
+	}
+}
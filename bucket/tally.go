@@ -0,0 +1,153 @@
+package bucket
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// MaxMinOccurrences is the largest Options.MinOccurrences, the most a
+// 16-bit counter can tell apart.
+const MaxMinOccurrences = 1<<16 - 1
+
+// tally selects pass 2's structure: with width 0 a bitset, counting each
+// suffix the first time it is seen; otherwise a saturating counter of
+// width bits per suffix, counting each suffix the time its count reaches
+// min.
+type tally struct {
+	width uint   // bits per counter: 0 for the bitset, 2, 4, 8 or 16, or 32 for Options.TopAddresses
+	min   uint32 // occurrences a suffix needs to be counted
+}
+
+// tallyFor returns the narrowest counters that reach minOcc, 0 or 1 giving
+// the bitset.
+func tallyFor(minOcc int) (tally, error) {
+	switch {
+	case minOcc < 0 || minOcc > MaxMinOccurrences:
+		return tally{}, fmt.Errorf("minimum occurrences must be 1 to %d, got %d", MaxMinOccurrences, minOcc)
+	case minOcc <= 1:
+		return tally{}, nil
+	case minOcc <= 3:
+		return tally{width: 2, min: uint32(minOcc)}, nil
+	case minOcc <= 15:
+		return tally{width: 4, min: uint32(minOcc)}, nil
+	case minOcc <= 255:
+		return tally{width: 8, min: uint32(minOcc)}, nil
+	}
+	return tally{width: 16, min: uint32(minOcc)}, nil
+}
+
+// words returns the length in uint32 words of one bucket's structure.
+func (t tally) words(l Layout) int {
+	return l.words() * int(max(t.width, 1))
+}
+
+// bytes returns the size of one bucket's structure.
+func (t tally) bytes(l Layout) int64 {
+	return l.BitsetBytes() * int64(max(t.width, 1))
+}
+
+func (t tally) String() string {
+	if t.width == 0 {
+		return "1-bit set"
+	}
+	if t.width == 32 {
+		return fmt.Sprintf("32-bit counters, counted at %d occurrences", t.min)
+	}
+	return fmt.Sprintf("%d-bit saturating counters, counted at %d occurrences", t.width, t.min)
+}
+
+// marker sets the suffixes of one bucket in a pass-2 buffer, its bitset
+// or counters, returning how many newly count.
+type marker struct {
+	l   Layout
+	t   tally
+	set []uint32
+}
+
+// markRecords marks every record in recs.
+func (m marker) markRecords(recs []byte) int64 {
+	if m.t.width == 0 {
+		return m.l.markRecords(m.set, recs)
+	}
+	var added int64
+	size := m.l.recordSize()
+	for off := 0; off+size <= len(recs); off += size {
+		if m.add(m.l.decodeRecord(recs[off:])) {
+			added++
+		}
+	}
+	return added
+}
+
+// markRange marks every suffix in r once.
+func (m marker) markRange(r suffixRange) int64 {
+	if m.t.width == 0 {
+		return m.l.markRange(m.set, r)
+	}
+	var added int64
+	for s := uint64(r.First); s <= uint64(r.Last); s++ {
+		if m.add(uint32(s)) {
+			added++
+		}
+	}
+	return added
+}
+
+// add counts one more occurrence of suffix, reporting whether that
+// brought it to the minimum. A counter stops at its largest value, which
+// is at least the minimum.
+func (m marker) add(suffix uint32) bool {
+	per := 32 / uint32(m.t.width)
+	w, shift := suffix/per, suffix%per*uint32(m.t.width)
+	mask := uint32(1)<<m.t.width - 1
+	v := m.set[w] >> shift & mask
+	if v == mask {
+		return false
+	}
+	m.set[w] += 1 << shift
+	return v+1 == m.t.min
+}
+
+// count returns how many suffixes the buffer counts: the bits set, or
+// the counters at the minimum, where a saturated one stays.
+func (m marker) count() int64 {
+	var n int64
+	if m.t.width == 0 {
+		for _, w := range m.set {
+			n += int64(bits.OnesCount32(w))
+		}
+		return n
+	}
+	mask := uint32(1)<<m.t.width - 1
+	for _, w := range m.set {
+		for shift := uint(0); shift < 32; shift += m.t.width {
+			if w>>shift&mask >= m.t.min {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// verifyBucket recounts set, the buffer bucket i was counted into, with
+// Options.VerifyCount, and fails unless it holds the counted suffixes.
+func (c *BucketCounter) verifyBucket(l Layout, i int, set []uint32, counted int64) error {
+	if !c.opts.VerifyCount || l.Partition == PartitionHash {
+		// A sorted bucket is counted once, with no running count
+		return nil
+	}
+	if n := (marker{l: l, t: c.tally, set: set}).count(); n != counted {
+		return &counter.CountMismatchError{Set: fmt.Sprintf("bucket %d", i), Counted: counted, Recount: n}
+	}
+	return nil
+}
+
+// reportTally records the pass-2 structure and its size for -stats.
+func (c *BucketCounter) reportTally() {
+	if c.tally.width == 0 {
+		return
+	}
+	c.opts.Stats.Set("bucket pass 2", "%s, %s per bucket", c.tally, counter.FormatBytes(c.tally.bytes(c.layout)))
+}
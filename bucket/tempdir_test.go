@@ -0,0 +1,61 @@
+package bucket
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Pass 1 spills into a directory of its own under TempDir, or under
+// os.TempDir when that is unset, and nowhere else; the stats name where
+// and how many bytes went there.
+func TestTempDir(t *testing.T) {
+	var b strings.Builder
+	for i := range 30000 {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(uint32(i)*2654435761))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	chosen, env := t.TempDir(), t.TempDir()
+	t.Setenv("TMPDIR", env)
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	defer func() { testHookPass2 = nil }()
+
+	for _, tc := range []struct {
+		tempDir, want, other string
+	}{
+		{chosen, chosen, env},
+		{"", env, chosen},
+	} {
+		var dir string
+		var files int
+		testHookPass2 = func(d string, _ []int) {
+			dir = d
+			entries, _ := os.ReadDir(d)
+			files = len(entries)
+			if other, _ := os.ReadDir(tc.other); len(other) > 0 {
+				t.Errorf("temp dir %q: %d entries in %s as well", tc.tempDir, len(other), tc.other)
+			}
+		}
+		stats := new(counter.Stats)
+		if _, err := NewWithOptions(Options{TempDir: tc.tempDir, MemBuffer: -1, Stats: stats, Logger: discard}).CountUniqueIPs(path); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(dir) != tc.want || !strings.HasPrefix(filepath.Base(dir), "ipbuckets-") || files != 256 {
+			t.Errorf("temp dir %q: spilled %d files to %s, want 256 in an ipbuckets-* dir of %s", tc.tempDir, files, dir, tc.want)
+		}
+		written := fmt.Sprintf("%s to %s", counter.FormatBytes(3*30000), tc.want)
+		if got := stats.Map()["bucket temp written"]; got != written {
+			t.Errorf("temp dir %q: stats %q, want %q", tc.tempDir, got, written)
+		}
+	}
+}
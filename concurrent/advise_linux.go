@@ -0,0 +1,10 @@
+package concurrent
+
+import "syscall"
+
+// adviseSequential tells the kernel each worker walks its range of a
+// mapping front to back, for deeper readahead and for the pages behind it
+// to be reclaimed first, as a read would get. It is only a hint.
+func adviseSequential(data []byte) {
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+}
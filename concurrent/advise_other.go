@@ -0,0 +1,5 @@
+//go:build !linux
+
+package concurrent
+
+func adviseSequential(data []byte) {}
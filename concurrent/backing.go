@@ -0,0 +1,63 @@
+package concurrent
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// ErrBackingUnsupported is returned for Options.BitsetFile and BitsetSwap
+// on platforms without mmap.
+var ErrBackingUnsupported = errors.New("file-backed and swappable bitsets need Linux or macOS")
+
+// attachBacking maps the region Options.BitsetFile or BitsetSwap asks
+// for the first time the counter is used. Shards allocated from then on
+// take their words from it instead of the Go heap, at the shard's place
+// in it, so the kernel can page cold shards out, to the file or to swap,
+// rather than the process being killed for its resident size. Pages are
+// only backed once a bit in them is set.
+func (b *BitsetCounter) attachBacking() error {
+	if (b.opts.BitsetFile == "" && !b.opts.BitsetSwap) || b.backing != nil {
+		return nil
+	}
+	size := int64(b.wordsPerShard) * 8 * int64(len(b.shards))
+	r, err := mapBacking(b.opts.BitsetFile, size)
+	if err != nil {
+		return err
+	}
+	b.backing = r
+	where := "swap"
+	if b.opts.BitsetFile != "" {
+		where = b.opts.BitsetFile
+	}
+	b.opts.Stats.Set("concurrent bitset", "%s mapped, paged out to %s", counter.FormatBytes(size), where)
+	b.log.Info("concurrent bitset mapped", "bytes", size, "backing", where)
+	return nil
+}
+
+// newWords returns zeroed words for shard s: a fresh slice, or its part
+// of the mapped region, which is zero until the shard is first published
+// and is cleared again whenever the shard is released.
+func (b *BitsetCounter) newWords(s *shard) []uint64 {
+	if b.backing == nil {
+		return make([]uint64, b.wordsPerShard)
+	}
+	i := int((uintptr(unsafe.Pointer(s)) - uintptr(unsafe.Pointer(&b.shards[0]))) / unsafe.Sizeof(shard{}))
+	lo, hi := i*b.wordsPerShard, (i+1)*b.wordsPerShard
+	return b.backing.words[lo:hi:hi]
+}
+
+// closeBacking drops the shards and unmaps the region.
+func (b *BitsetCounter) closeBacking() error {
+	if b.backing == nil {
+		return nil
+	}
+	for i := range b.shards {
+		b.shards[i].words.Store(nil)
+		b.shards[i].count.Store(0)
+	}
+	err := b.backing.close()
+	b.backing = nil
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package concurrent
+
+type region struct {
+	words []uint64
+}
+
+func mapBacking(path string, size int64) (*region, error) {
+	return nil, ErrBackingUnsupported
+}
+
+func (r *region) close() error { return nil }
@@ -0,0 +1,80 @@
+//go:build linux || darwin
+
+package concurrent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A bitset backed by a file or by swap counts run after run exactly as
+// one on the heap does, before and after ResetAndFree zeroes its region,
+// and a snapshot written from it is byte for byte the heap counter's,
+// loading back to the same count. The file is gone from the directory as
+// soon as it is mapped.
+func TestBitsetBacking(t *testing.T) {
+	rng := rand.New(rand.NewPCG(61, 62))
+	var inputs []string
+	for range 3 {
+		var b strings.Builder
+		for range 50000 {
+			// In 16 of the default shards, so snapshots, which walk the
+			// allocated ones, stay quick
+			b.WriteString(utils.FormatIPv4(rng.Uint32()>>rng.UintN(20)&^0x3ff0) + "\n")
+		}
+		inputs = append(inputs, b.String())
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	heap := newCounter(t, Options{Workers: 4, Logger: discard})
+	file := newCounter(t, Options{Workers: 4, Logger: discard, BitsetFile: filepath.Join(dir, "bits")})
+	swap := newCounter(t, Options{Workers: 4, Logger: discard, BitsetSwap: true})
+	defer file.Close()
+	defer swap.Close()
+
+	for i, input := range inputs {
+		if i == 2 {
+			for _, c := range []*BitsetCounter{heap, file, swap} {
+				c.ResetAndFree()
+			}
+		}
+		want, err := heap.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := heap.CountExact()
+		var snap bytes.Buffer
+		if err := heap.WriteSnapshot(&snap); err != nil {
+			t.Fatal(err)
+		}
+		for name, c := range map[string]*BitsetCounter{"file": file, "swap": swap} {
+			n, err := c.CountReader(context.Background(), strings.NewReader(input))
+			if err != nil || n != want || c.CountExact() != total {
+				t.Errorf("run %d, %s: %d new, %v, %d in all; want %d, %d", i, name, n, err, c.CountExact(), want, total)
+			}
+			var got bytes.Buffer
+			if err := c.WriteSnapshot(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), snap.Bytes()) {
+				t.Errorf("run %d, %s: snapshot differs from the heap counter's", i, name)
+			}
+			loaded := newCounter(t, Options{Logger: discard})
+			if n, err := loaded.LoadSnapshot(&got); err != nil || n != total {
+				t.Errorf("run %d, %s: snapshot loads to %d, %v; want %d", i, name, n, err, total)
+			}
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("bitset file left behind: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin
+
+package concurrent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// region is the mapping shard words are taken from under
+// Options.BitsetFile or BitsetSwap.
+type region struct {
+	data  []byte
+	words []uint64
+}
+
+// mapBacking maps size bytes of zeroed memory: shared over a new sparse
+// file at path, which is removed as soon as it is mapped so nothing is
+// left behind, or with path "" anonymous and private, paged out to swap.
+// Either way the memory is outside the Go heap, so the garbage collector
+// neither scans it nor counts it against a memory limit.
+func mapBacking(path string, size int64) (*region, error) {
+	fd, flags := -1, syscall.MAP_PRIVATE|syscall.MAP_ANON
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("bitset file: %w", err)
+		}
+		defer f.Close() // the mapping keeps the file alive
+		defer os.Remove(path)
+		if err := f.Truncate(size); err != nil {
+			return nil, fmt.Errorf("bitset file %s: %w", path, err)
+		}
+		fd, flags = int(f.Fd()), syscall.MAP_SHARED
+	}
+	data, err := syscall.Mmap(fd, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, flags)
+	if err != nil {
+		return nil, fmt.Errorf("bitset mmap: %w", err)
+	}
+	words := unsafe.Slice((*uint64)(unsafe.Pointer(&data[0])), len(data)/8)
+	return &region{data: data, words: words}, nil
+}
+
+// close unmaps the region; a file behind it was already removed.
+func (r *region) close() error {
+	return syscall.Munmap(r.data)
+}
@@ -0,0 +1,24 @@
+package concurrent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPartialRecord is returned with Options.Strict when binary input does
+// not end on a 4-byte boundary.
+var ErrPartialRecord = errors.New("input ends with a partial 4-byte record")
+
+// checkPartial reports the partial record that binary input ended with,
+// n bytes long: an error with Options.Strict, a warning otherwise.
+func (b *BitsetCounter) checkPartial(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if b.opts.Strict {
+		return fmt.Errorf("%w (%d trailing bytes)", ErrPartialRecord, n)
+	}
+	b.log.Warn("input ends with a partial record; ignored", "bytes", n)
+	b.opts.Stats.Set("partial record", "%d trailing bytes ignored", n)
+	return nil
+}
@@ -0,0 +1,75 @@
+package concurrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The distinct addresses of a text count, exported as packed records in
+// either byte order, count back to the same set; a trailing partial
+// record is dropped with a warning, or with Strict fails the run.
+func TestBinaryRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewPCG(71, 72))
+	var b strings.Builder
+	for range 100000 {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(10<<24|rng.Uint32N(1<<24)))
+	}
+	b.WriteString("0.0.0.0\n255.255.255.255\n") // the ends of the address space
+	text := filepath.Join(dir, "in.txt")
+	if err := os.WriteFile(text, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	src := newCounter(t, Options{Logger: discard})
+	want, err := src.CountUniqueIPs(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []uint32
+	src.Range(func(ip uint32) bool {
+		ips = append(ips, ip)
+		return true
+	})
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		packed := make([]byte, 4*len(ips))
+		for i, ip := range ips {
+			order.PutUint32(packed[4*i:], ip)
+		}
+		path := filepath.Join(dir, order.String()+".bin")
+		if err := os.WriteFile(path, packed, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		c := newCounter(t, Options{Binary: order, Logger: discard})
+		n, err := c.CountUniqueIPs(path)
+		if err != nil || n != want {
+			t.Errorf("%s: %d, %v; want %d", order, n, err, want)
+		}
+		for _, ip := range ips {
+			if !c.Contains(ip) {
+				t.Fatalf("%s: %s missing from the recounted set", order, utils.FormatIPv4(ip))
+			}
+		}
+
+		if err := os.WriteFile(path, append(packed, 10, 0, 0), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := newCounter(t, Options{Binary: order, Logger: discard}).CountUniqueIPs(path); err != nil || n != want {
+			t.Errorf("%s with 3 trailing bytes: %d, %v; want %d", order, n, err, want)
+		}
+		if _, err := newCounter(t, Options{Binary: order, Strict: true, Logger: discard}).CountUniqueIPs(path); !errors.Is(err, ErrPartialRecord) {
+			t.Errorf("%s with 3 trailing bytes, strict: %v, want ErrPartialRecord", order, err)
+		}
+	}
+}
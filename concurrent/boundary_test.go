@@ -0,0 +1,99 @@
+package concurrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// splitAtNewlines covers the data with contiguous ranges, each ending
+// just after a delimiter or at the end, wherever the even cut falls: on a
+// delimiter, just after one, mid-line, or past the last one.
+func TestSplitAtNewlines(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"10.0.0.1",
+		"10.0.0.1\n",
+		"\n\n\n\n",
+		"10.0.0.1\n10.0.0.2\n10.0.0.3",
+		"1\n22\n333\n4444\n55555\n666666\n7777777\n",
+		strings.Repeat("x", 100) + "\n1\n",
+	} {
+		for n := 1; n <= 8; n++ {
+			ranges := splitAtNewlines([]byte(data), n, '\n')
+			if len(ranges) > n {
+				t.Errorf("%q in %d: %d ranges", data, n, len(ranges))
+			}
+			end := 0
+			for _, r := range ranges {
+				if r[0] != end || r[1] <= r[0] {
+					t.Fatalf("%q in %d: ranges %v not contiguous and non-empty", data, n, ranges)
+				}
+				if end = r[1]; end < len(data) && data[end-1] != '\n' {
+					t.Errorf("%q in %d: range %v ends mid-line", data, n, r)
+				}
+			}
+			if end != len(data) {
+				t.Errorf("%q in %d: ranges %v stop at %d of %d bytes", data, n, ranges, end, len(data))
+			}
+		}
+	}
+}
+
+// Moving the end of the input a byte at a time moves every mapped and
+// segmented split point across the lines around it, so some split each
+// way: just before a newline, just after one, and inside an address.
+// Each line is still counted whole by exactly one worker: none lost and
+// none cut into two malformed halves, or into an address that is not in
+// the input, as 0.1.2.1 from 0.1.2.123.
+func TestSplitLines(t *testing.T) {
+	rng := rand.New(rand.NewPCG(101, 102))
+	seen := map[uint32]bool{}
+	var b strings.Builder
+	for b.Len() < 3<<20+1000 { // three segments of more than segmentBufSize
+		ip := rng.Uint32N(1<<16)<<8 | 100 + rng.Uint32N(156) // in 0.0.0.0/8, so Bits 24 holds it
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	lines := []byte(b.String())
+	dir := t.TempDir()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for pad := -1; pad < 32; pad++ {
+		data := lines[:len(lines)-1] // -1: the last line has no newline
+		if pad >= 0 {
+			data = append(bytes.Clone(lines), bytes.Repeat([]byte{'\n'}, pad)...)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("in%d.txt", pad))
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{2, 3} {
+			for _, o := range []Options{{Mmap: true}, {Segmented: true}} {
+				malformed := &utils.Malformed{Keep: 3}
+				o.Workers, o.Bits, o.Parse, o.Logger = workers, 24, utils.ParseOptions{Malformed: malformed}, discard
+				c := newCounter(t, o)
+				n, err := c.CountUniqueIPs(path)
+				if err != nil || n != int64(len(seen)) || malformed.Lines() != 0 {
+					t.Fatalf("mmap %v, segmented %v, %d workers, %d trailing newlines: %d, %v, want %d; %d malformed lines %v",
+						o.Mmap, o.Segmented, workers, pad, n, err, len(seen), malformed.Lines(), malformed.Examples())
+				}
+				for ip := range seen { // with the count, so nothing else was counted
+					if !c.Contains(ip) {
+						t.Fatalf("mmap %v, segmented %v, %d workers, %d trailing newlines: %s not counted",
+							o.Mmap, o.Segmented, workers, pad, utils.FormatIPv4(ip))
+					}
+				}
+			}
+		}
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,102 @@
+package concurrent
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// splitRange walks the addresses [first, last] in shard layout: lone
+// addresses before and after the whole rounds of len(shards) consecutive
+// addresses go to point, and each round-aligned middle part goes to span
+// once per shard as the offsets [lo, hi) it covers there. A /16 with the
+// default 16384 shards is one span of 4 bits per shard instead of 65536
+// single bits.
+func splitRange(first, last uint32, shardShift uint, point func(ip uint32), span func(s int, lo, hi uint32)) {
+	numShards := uint64(1) << shardShift
+	ip, end := uint64(first), uint64(last)+1
+	for ; ip < end && ip%numShards != 0; ip++ {
+		point(uint32(ip))
+	}
+	if bodyEnd := end - end%numShards; bodyEnd > ip {
+		lo, hi := uint32(ip>>shardShift), uint32(bodyEnd>>shardShift)
+		for s := range int(numShards) {
+			span(s, lo, hi)
+		}
+		ip = bodyEnd
+	}
+	for ; ip < end; ip++ {
+		point(uint32(ip))
+	}
+}
+
+// AddRange marks every address in [first, last] as seen and returns how
+// many were new, filling whole words where the range allows. Safe for
+// concurrent use; under Options.MaxMem, addresses whose shard would exceed
+// the budget are dropped, as are those outside Options.AddressSpace.
+func (b *BitsetCounter) AddRange(first, last uint32) int64 {
+	if !b.spaced {
+		return b.addRange(first, last, b.onNew)
+	}
+	end := b.base + b.spaceMax
+	if last < b.base || first > end {
+		return 0
+	}
+	return b.addRange(max(first, b.base)-b.base, min(last, end)-b.base, b.onNew)
+}
+
+// addRange sets the bits [first, last] of the set, passing the addresses
+// that were new to note.
+func (b *BitsetCounter) addRange(first, last uint32, note func(ip uint32)) int64 {
+	var added int64
+	splitRange(first, last, b.shardShift,
+		func(ip uint32) {
+			if b.addBit(ip, note) {
+				added++
+			}
+		},
+		func(s int, lo, hi uint32) {
+			sh := &b.shards[s]
+			words := sh.loaded()
+			if words == nil {
+				if words = b.alloc(sh); words == nil {
+					return
+				}
+			}
+			fillWords(lo, hi, func(w int, mask uint64) {
+				old := atomic.OrUint64(&words[w], mask)
+				n := int64(bits.OnesCount64(mask &^ old))
+				sh.count.Add(n)
+				added += n
+				b.notifyWord(s, w, mask&^old, note)
+			})
+		})
+	return added
+}
+
+// addRange is AddRange on a worker's private set; new addresses are
+// counted when it is merged.
+func (l *localSet) addRange(first, last uint32) {
+	splitRange(first, last, l.shardShift, l.add, func(s int, lo, hi uint32) {
+		words := l.shards[s]
+		if words == nil {
+			words = make([]uint64, l.wordsPer)
+			l.shards[s] = words
+		}
+		fillWords(lo, hi, func(w int, mask uint64) { words[w] |= mask })
+	})
+}
+
+// fillWords calls set with each word index and bit mask covering the bit
+// offsets [lo, hi).
+func fillWords(lo, hi uint32, set func(w int, mask uint64)) {
+	for lo < hi {
+		w, bit := lo/64, lo%64
+		n := min(64-bit, hi-lo)
+		mask := ^uint64(0)
+		if n < 64 {
+			mask = (uint64(1)<<n - 1) << bit
+		}
+		set(int(w), mask)
+		lo += n
+	}
+}
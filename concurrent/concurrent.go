@@ -1,212 +1,1066 @@
 package concurrent
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/bits"
+	"net/netip"
+	"os"
 	"runtime"
+	"slices"
 	"sync"
 	"sync/atomic"
-	"bufio"
-	"os"
-	"fmt"
-	"io"
-	"bytes"
+	"time"
 
-	"ipcounter/utils"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/pipeline"
+	"github.com/Sveta-1999/IPCounter/utils"
 )
 
 const (
-	maxIPv4   = uint64(1) << 32   // total IPv4 space (2^32)
-	numShards = 16384             // number of bitset partitions
-)
+	maxIPv4       = uint64(1) << 32 // total IPv4 space (2^32), the default tracked space
+	DefaultShards = 16384           // default number of bitset partitions
+	MaxShards     = 1 << 20         // keeps the padded header array at 64 MB
 
-var (
-	bitsPerShard  = (maxIPv4 + uint64(numShards) - 1) / uint64(numShards)
-	wordsPerShard = (bitsPerShard + 31) / 32 // 32 bits per uint32 word
+	DefaultChunkSize = 2 * 1024 * 1024  // bytes the producer hands a worker at a time
+	MinChunkSize     = 4 * 1024         // below this channel traffic dominates
+	MaxChunkSize     = 64 * 1024 * 1024 // above this workers wait long for their first chunk
 )
 
-// shard represents a lazily allocated slice of bits
+// cacheLine is the coherence granule shard headers are padded to
+const cacheLine = 64
+
+// shard represents a lazily allocated slice of bits. Shard headers sit in
+// one contiguous array, each padded to its own cache line, so workers
+// touching neighbouring shards never contend on the same line. The words
+// pointer is published with a CAS instead of a sync.Once, whose mutex and
+// done flag made every header larger and shared the line on first use.
+// The running count of set bits lives on the same line, so keeping it
+// costs no more sharing than the words pointer already has.
 type shard struct {
-	once  sync.Once  // ensure words init only once
-	words []uint32   // bit array (32 IPs per uint32)
+	words atomic.Pointer[[]uint64] // bit array (64 IPs per uint64), nil until first write
+	count atomic.Int64             // bits set so far
+	_     [cacheLine - 16]byte
+}
+
+// ensure returns the shard's words, taking them from newWords on first
+// use. Racing allocators agree on whichever slice is published first.
+func (s *shard) ensure(newWords func(*shard) []uint64) []uint64 {
+	if p := s.words.Load(); p != nil {
+		return *p
+	}
+	words := newWords(s)
+	if s.words.CompareAndSwap(nil, &words) {
+		return words
+	}
+	return *s.words.Load()
+}
+
+// loaded returns the shard's words, or nil if it was never written
+func (s *shard) loaded() []uint64 {
+	if p := s.words.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Options configures a BitsetCounter
+type Options struct {
+	Parse utils.ParseOptions // accepted address forms
+	Mmap  bool               // map the file and split it across workers instead of streaming
+
+	// Segmented makes each worker read its own byte range of the file
+	// with ReadAt. Non-regular files (pipes, devices) fall back to the
+	// streaming reader.
+	Segmented bool
+
+	Bitset BitsetMode // shared atomic bitset or per-worker local bitsets
+
+	// NUMAGroups splits the workers of a run into this many groups, or
+	// with NUMAAuto one per NUMA node, each adding atomically to a bitset
+	// of its own that is ORed into the shared one at the end, like local
+	// bitsets. On a host of several sockets that keeps the atomics on a
+	// word among the cores of one; with a group per node detected, each
+	// group's workers are also pinned to its node's CPUs. It costs up to
+	// a full bitset per group, so it takes the place of the shared and
+	// local bitsets and cannot be combined with what needs them. 0 or 1
+	// leaves the workers as one group.
+	NUMAGroups int
+
+	// Shards is the number of bitset partitions, a power of two up to
+	// MaxShards; 0 means DefaultShards. Fewer shards suit small inputs
+	// (less header overhead, better locality), more reduce contention.
+	Shards int
+
+	// MaxLine is the longest line accepted; longer ones are skipped
+	// without being buffered. 0 means utils.DefaultMaxLine.
+	MaxLine int
+
+	// ChunkSize is how many bytes the producer reads and hands to a
+	// worker at a time, between MinChunkSize and MaxChunkSize; 0 means
+	// DefaultChunkSize. Small chunks get workers going sooner on small
+	// inputs, large ones cut per-chunk overhead on fast disks. Mapped
+	// reads check for cancellation at this granularity.
+	ChunkSize int
+
+	// Workers is how many goroutines parse the input, whichever way it
+	// is read, and merge local bitsets; 0 means runtime.NumCPU(). The
+	// counter never changes GOMAXPROCS, so more workers than it allows
+	// take turns on its threads.
+	Workers int
+
+	// QueueDepth is how many read chunks may wait for a worker; 0 means
+	// two per worker. A deeper queue lets the producer run further ahead
+	// of bursts of slow chunks, at ChunkSize bytes of memory each.
+	QueueDepth int
+
+	// Job, set by counter.Pool.Count, has the streaming reads parse on
+	// the workers of its pool, with the pool's queue depth, and reserves
+	// every shard allocated against the pool's memory cap; a shard over
+	// it fails the run with counter.ErrMemBudget. Mapped and segmented
+	// reads still run workers of their own.
+	Job *counter.PoolJob
+
+	// MaxMem caps the bitset shards allocated so the counter stays within
+	// about this many bytes; an input spread over more shards fails with
+	// counter.ErrMemBudget. 0 means no cap. Local bitsets multiply memory
+	// by the worker count, so auto mode uses the shared bitset under a cap
+	// and explicit local mode is rejected.
+	MaxMem int64
+
+	// Retries is how many times in a row the streaming reader reopens the
+	// file at the offset it reached after a transient read error, such as
+	// EIO or ESTALE on NFS; 0 for none. Mapped and segmented reads are not
+	// retried.
+	Retries int
+
+	// Watchdog samples the allocated shards plus the rest of the Go heap
+	// every 50ms during a run and stops it with counter.ErrMemBudget once
+	// they pass MaxMem or, without one, the memory the process held plus
+	// what the host had free when the run began, before the host swaps.
+	// Unlike the MaxMem shard cap it also sees the read buffers, the local
+	// bitsets and whatever else the process allocates.
+	Watchdog bool
+
+	// NoCache drops the file's pages from the page cache behind the read
+	// position of the streaming and segmented reads, so a one-shot scan
+	// of a huge file leaves the cache to other work. Mapped reads are
+	// not covered.
+	NoCache bool
+
+	// Bits is the size of the tracked space as a power of two, 0 for the
+	// full 32-bit IPv4 space; Add and Contains then take values below
+	// 2^Bits. A smaller space suits hashed sketches. Each shard must still
+	// hold at least one word, so Shards may be at most 2^(Bits-6).
+	Bits int
+
+	// Hash, if set, maps every parsed address into the tracked space
+	// before its bit is set, e.g. for linear counting. It must return
+	// values below 2^Bits.
+	Hash func(ip uint32) uint32
+
+	// AddressSpace, if valid, is the IPv4 block every address is known to
+	// be in, such as 100.64.0.0/10: the bitset spans just that block, bit
+	// i standing for its i-th address, so memory is bounded by the
+	// block's size whatever the input holds. Parsed addresses outside it
+	// are invalid, counted in Stats and sampled like lines that fail to
+	// parse. It cannot be combined with Bits, Hash, StateFile, PrefixSweep
+	// or Density, which need the full space.
+	AddressSpace netip.Prefix
+
+	// StateFile, if set, backs the bitset with this file of StateBytes,
+	// mapped shared and locked for the counter's lifetime, so it keeps
+	// every address ever counted into it across runs; counts are then of
+	// addresses new to the file. It implies a single shard and the shared
+	// bitset, and cannot be combined with Bits or Hash.
+	StateFile string
+
+	// Preload, if set, is a list of addresses, one per line, added to the
+	// set before the first run with LoadListFile, so counts are of
+	// addresses the list lacks. A line that fails to parse fails the run.
+	Preload string
+
+	// StreamDump, if set, is a file every address the counter sets for
+	// the first time is appended to as it is found, one dotted quad per
+	// line in the order found, so a run that is interrupted or killed
+	// leaves what it had found. A flush point, a line "# flushed N",
+	// writes the buffer out after every DumpFlushEntries addresses or
+	// DumpFlushInterval, and at the end of every run, recording that the
+	// N addresses above it are in the file. Without ResumeDump the file
+	// is started afresh; with it, the addresses it holds, up to what a
+	// crash cut short, are set before the first run like Preload's, and
+	// runs append only the ones it lacks. It needs real addresses as the
+	// shared bitset sets them, so it cannot be combined with Bits, Hash
+	// or BitsetLocal.
+	StreamDump string
+	ResumeDump bool
+
+	// Sync fsyncs the StreamDump at every flush point, so what it
+	// records survives a crash of the host and not just of the process.
+	Sync bool
+
+	// BitsetFile, if set, takes the shard words from a 2^Bits/8-byte
+	// sparse file created at this path, mapped shared and removed at
+	// once, instead of the Go heap; BitsetSwap does the same with
+	// anonymous memory. The kernel can then page cold shards out to the
+	// file or to swap under memory pressure, and a dense input on a
+	// small host slows down instead of being killed. Both imply the
+	// shared bitset and need Linux or macOS.
+	BitsetFile string
+	BitsetSwap bool
+
+	// OnNewIP, if set, is called exactly once for every address the
+	// counter sets for the first time, the moment its bit is set, from
+	// whichever worker goroutine set it: it must be safe for concurrent
+	// use and should return quickly, since that worker waits for it. With
+	// Hash it gets the hashed value. Local bitsets only find new addresses
+	// when they are merged at the end of a run, so BitsetAuto stays with
+	// the shared bitset when a callback is set.
+	OnNewIP func(ip uint32)
+
+	// OnNewIPFrom, if set, is OnNewIP with the source the address was
+	// read from: one of the inputs of CountParallel or of a
+	// counter.Sourced stream such as input.Concat, the file of
+	// CountUniqueIPs, or the zero Source for any other reader. Both may
+	// be set. Streams of several sources then use the shared bitset.
+	OnNewIPFrom func(ip uint32, src counter.Source)
+
+	// Binary, if set, reads the input as packed 4-byte addresses in this
+	// byte order instead of text lines: no parsing, no line splitting.
+	// Mmap and Segmented do not apply. A trailing partial record is
+	// ignored with a warning, or with Strict fails the run with
+	// ErrPartialRecord.
+	Binary binary.ByteOrder
+	Strict bool
+
+	// Checkpoint, if set, makes runs write the running count, Count, at
+	// every Checkpoint.Every lines or bytes processed, or at its Shares of
+	// the input, which a file is then streamed for rather than mapped or
+	// split. Only the shared bitset knows that count mid-run, so
+	// BitsetAuto then stays with it and BitsetLocal is rejected.
+	Checkpoint counter.Checkpoint
+
+	// PrefixSweep lists the prefix lengths, 1 to 32, whose distinct
+	// prefixes PrefixCounts reports. It needs the full IPv4 space, so it
+	// cannot be combined with Bits or Hash.
+	PrefixSweep []int
+
+	// Density makes Density available; it needs the full IPv4 space too.
+	// The set is walked after the count, so this only checks the options.
+	Density bool
+
+	// SubsampleRates lists ascending rates, above 0 and at most 1, whose
+	// by-address subsamples SubsampleCounts reports. The set is walked
+	// after the count; the addresses must be real, so it cannot be
+	// combined with Bits or Hash.
+	SubsampleRates []float64
+
+	// Record, if set, makes each streaming run write a trace of its
+	// chunks to this file: each chunk's byte range, the addresses parsed
+	// from it and how many were new, for pipeline.Replay to re-check one
+	// at a time. The file is replaced once the run succeeds. Only the
+	// shared bitset finds new addresses chunk by chunk, so BitsetAuto
+	// then stays with it; Mmap, Segmented, several inputs at once and
+	// anything that is not the full space of real addresses are rejected.
+	Record string
+
+	// ShardStats makes each run send SummarizeShards of ShardStats to
+	// Stats, and fail if the shards' popcounts do not add up to Count. It
+	// does nothing without Stats.
+	ShardStats bool
+
+	// VerifyCount makes each run popcount the allocated shards in
+	// parallel once the input is read and fail with a
+	// *counter.CountMismatchError if they do not add up to Count, which
+	// every newly set bit increments on its own. It costs a pass over
+	// the allocated shards, about as long as reading as many bytes.
+	VerifyCount bool
+
+	Progress *counter.Progress // receives the input read and the count so far, nil for none
+	Stats    *counter.Stats    // receives the oversized line count and budget, nil to discard
+
+	// Logger receives the partial-record warning, the first few lines
+	// that fail to parse, a summary of each run and, at debug level, how
+	// the workers were set up; nil for slog.Default().
+	Logger *slog.Logger
+}
+
+// Validate reports whether opts describe a usable counter
+func (o Options) Validate() error {
+	if n := o.Shards; n != 0 && (n < 1 || n > MaxShards || n&(n-1) != 0) {
+		return fmt.Errorf("shards must be a power of two between 1 and %d, got %d", MaxShards, n)
+	}
+	if o.Bits != 0 {
+		shards := cmp.Or(o.Shards, DefaultShards)
+		if o.Bits > 32 || 1<<o.Bits < shards*64 {
+			return fmt.Errorf("bits must be between log2(shards)+6 and 32, got %d for %d shards", o.Bits, shards)
+		}
+	}
+	if n := o.ChunkSize; n != 0 && (n < MinChunkSize || n > MaxChunkSize) {
+		return fmt.Errorf("chunk size must be between %s and %s, got %d bytes",
+			counter.FormatBytes(MinChunkSize), counter.FormatBytes(MaxChunkSize), n)
+	}
+	if o.QueueDepth < 0 {
+		return fmt.Errorf("queue depth must not be negative, got %d", o.QueueDepth)
+	}
+	if o.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", o.Workers)
+	}
+	if o.MaxMem > 0 && o.Bitset == BitsetLocal {
+		return fmt.Errorf("local bitsets cannot honor a memory budget")
+	}
+	if o.Checkpoint.Metered() && o.Bitset == BitsetLocal {
+		return fmt.Errorf("local bitsets have no running count to checkpoint")
+	}
+	if o.NUMAGroups < NUMAAuto {
+		return fmt.Errorf("NUMA groups must be at least 1, got %d", o.NUMAGroups)
+	}
+	if o.NUMAGroups > 1 || o.NUMAGroups == NUMAAuto {
+		switch {
+		case o.Bitset == BitsetLocal:
+			return fmt.Errorf("NUMA groups cannot be combined with local bitsets, which are private already")
+		case o.MaxMem > 0, o.Checkpoint.Metered(), o.StateFile != "", o.BitsetFile != "", o.BitsetSwap, o.Record != "":
+			return fmt.Errorf("NUMA groups cannot be combined with a memory budget, checkpoints, a state file, a mapped bitset or a chunk trace, which need the shared bitset")
+		}
+	}
+	if p := o.AddressSpace; p.IsValid() {
+		if !p.Addr().Is4() {
+			return fmt.Errorf("address space must be an IPv4 block, got %s", p)
+		}
+		if o.Bits != 0 || o.Hash != nil || o.StateFile != "" || len(o.PrefixSweep) > 0 || o.Density {
+			return fmt.Errorf("an address space cannot be combined with bits, a hash, a state file, a prefix sweep or a density map")
+		}
+	}
+	if o.StateFile != "" && (o.Bits != 0 || o.Hash != nil || o.Bitset == BitsetLocal) {
+		return fmt.Errorf("a state file holds the full IPv4 space in the shared bitset")
+	}
+	if o.BitsetFile != "" && o.BitsetSwap {
+		return fmt.Errorf("a bitset file and a swappable bitset are mutually exclusive")
+	}
+	if (o.BitsetFile != "" || o.BitsetSwap) && (o.StateFile != "" || o.Bitset == BitsetLocal) {
+		return fmt.Errorf("a mapped bitset is the shared bitset, so it cannot be combined with a state file or local bitsets")
+	}
+	if (len(o.PrefixSweep) > 0 || o.Density) && (o.Bits != 0 || o.Hash != nil) {
+		return fmt.Errorf("a prefix sweep or density map needs the full IPv4 space")
+	}
+	for _, n := range o.PrefixSweep {
+		if n < 1 || n > 32 {
+			return fmt.Errorf("prefix length must be 1 to 32, got %d", n)
+		}
+	}
+	if o.Record != "" && (o.Mmap || o.Segmented || o.Bitset == BitsetLocal) {
+		return fmt.Errorf("a chunk trace records the streaming reader into the shared bitset")
+	}
+	if o.Record != "" && (o.Bits != 0 || o.Hash != nil || o.AddressSpace.IsValid()) {
+		return fmt.Errorf("a chunk trace needs the full IPv4 space of real addresses")
+	}
+	if o.StreamDump != "" && (o.Bits != 0 || o.Hash != nil || o.Bitset == BitsetLocal) {
+		return fmt.Errorf("a stream dump needs real addresses as the shared bitset sets them, not bits, hashed values or local bitsets")
+	}
+	if o.ResumeDump && o.StreamDump == "" {
+		return fmt.Errorf("resuming a dump needs a stream dump to resume")
+	}
+	if len(o.SubsampleRates) > 0 && (o.Bits != 0 || o.Hash != nil) {
+		return fmt.Errorf("subsample rates need addresses, not bits or hashed values")
+	}
+	for _, r := range o.SubsampleRates {
+		if !(r > 0 && r <= 1) {
+			return fmt.Errorf("subsample rate must be above 0 and at most 1, got %g", r)
+		}
+	}
+	return nil
 }
 
-func (s *shard) ensure() {
-	s.once.Do(func() {
-		s.words = make([]uint32, wordsPerShard)
+func init() {
+	counter.Register("concurrent", func(o counter.Options) (counter.Counter, error) {
+		mode, _ := ParseBitsetMode(o.Bitset) // validated by the caller
+		b, err := NewWithOptions(Options{
+			Parse:      o.Parse,
+			Mmap:       o.Mmap,
+			Segmented:  o.Segmented,
+			Bitset:     mode,
+			NUMAGroups: o.NUMAGroups,
+			Shards:     o.Shards,
+			MaxLine:    o.MaxLine,
+			MaxMem:     o.MaxMem,
+			Retries:    o.ReadRetries,
+			NoCache:    o.NoCache,
+			Watchdog:   o.MemWatchdog,
+
+			ChunkSize:  o.ChunkSize,
+			QueueDepth: o.QueueDepth,
+			Workers:    o.Workers,
+			Job:        o.PoolJob,
+
+			StateFile:    o.StateFile,
+			Preload:      o.Preload,
+			StreamDump:   o.StreamDump,
+			ResumeDump:   o.ResumeDump,
+			Sync:         o.Fsync,
+			AddressSpace: o.AddressSpace,
+			Binary:       counter.BinaryOrder(o.InputFormat),
+			Strict:       o.Strict,
+
+			BitsetFile: o.BitsetFile,
+			BitsetSwap: o.BitsetSwap,
+
+			Checkpoint:  o.Checkpoint,
+			PrefixSweep: o.PrefixSweep,
+			Density:     o.Density,
+			ShardStats:  o.ShardStats,
+			VerifyCount: o.VerifyCount,
+			Record:      o.Record,
+
+			SubsampleRates: o.SubsampleRates,
+			Stats:          o.Stats,
+			Progress:       o.Progress,
+			Logger:         o.Logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
 	})
 }
 
-// BitsetCounter tracks seen IPs in multiple shards
+// BitsetCounter tracks seen IPs in multiple shards. An IP lives in shard
+// ip % len(shards) at bit offset ip / len(shards); with a power-of-two
+// shard count these are a mask and a shift, and every uint32 maps to a
+// distinct (shard, offset) pair.
 type BitsetCounter struct {
-	shards []*shard
+	shards        []shard
+	shardMask     uint32 // len(shards) - 1
+	shardShift    uint   // log2(len(shards))
+	wordsPerShard int    // 2^Bits / len(shards) bits, 64 per word
+	maxLine       int    // opts.MaxLine or utils.DefaultMaxLine
+	delim         byte   // opts.Parse.Delim(), the byte records end in
+	oversized     atomic.Int64
+	base          uint32 // first address of Options.AddressSpace, which bit 0 stands for
+	spaceMax      uint32 // offset of its last address from base
+	spaced        bool   // Options.AddressSpace is set
+	outside       atomic.Int64
+	maxShards     int64 // shards the budget allows, when capped
+	capped        bool  // Options.MaxMem is set, even if it allows no shard at all
+	allocated     atomic.Int64
+	overBudget    atomic.Bool
+	watch         *watchdog          // of the current run, nil without Options.Watchdog
+	state         *stateFile         // mapped Options.StateFile, nil until the first run
+	trace         *pipeline.Recorder // the Options.Record trace of the run, nil between runs
+	preloaded     bool               // Options.Preload is in the set
+	dump          *streamDump        // open Options.StreamDump, nil until the first run
+	backing       *region            // mapped Options.BitsetFile or BitsetSwap, nil until the first run
+	onNew         func(ip uint32)
+	newIPs        chan uint32    // from NewIPs, closed when the run ends
+	seq           atomic.Int64   // numbers pieces of input in reading order
+	order         inputOrder     // first and last addresses, for Stats
+	meter         *counter.Meter // Options.Checkpoint for the current run
+	log           *slog.Logger
+	skips         *counter.SkipLog // lines of the current run that failed to parse
+	parser        *pipeline.Parser // of the current run, for the readers that split the input themselves
+	start         time.Time        // when the current run began
+	runSrc        counter.Source   // what the current run reads, unless its inputs say
+	fileSize      int64            // bytes of the file the next run streams, for Checkpoint.Shares
+	sourcesMu     sync.Mutex
+	sources       []counter.SourceTally // of the last run, when it read several sources
+	opts          Options
 }
 
 // New creates a BitsetCounter with uninitialized shards
 func New() *BitsetCounter {
-	shards := make([]*shard, numShards)
-	for i := range shards {
-		shards[i] = &shard{} // lazy init on first write
+	b, err := NewWithOptions(Options{})
+	if err != nil {
+		panic("concurrent: " + err.Error()) // the defaults are valid
 	}
-	return &BitsetCounter{shards: shards}
+	return b
 }
 
-// setBit marks the given bit if not already set, returns true if it was new
-func setBit(s *shard, offset uint32) bool {
-	s.ensure()
-	wordIdx := offset / 32
-	bitIdx := offset % 32
-	mask := uint32(1) << bitIdx
-	ptr := &s.words[wordIdx]
-
-	for {
-		old := atomic.LoadUint32(ptr)
-		if old&mask != 0 {
-			return false // already set
-		}
-		if atomic.CompareAndSwapUint32(ptr, old, old|mask) {
-			return true // successfully set
+// NewWithOptions creates a BitsetCounter with the given options, or
+// returns why opts fail Validate.
+func NewWithOptions(opts Options) (*BitsetCounter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("concurrent: %w", err)
+	}
+	if opts.Shards == 0 {
+		opts.Shards = DefaultShards
+	}
+	opts.ChunkSize = cmp.Or(opts.ChunkSize, DefaultChunkSize)
+	if opts.StateFile != "" {
+		// One shard spanning the file keeps its bits in address order
+		opts.Shards, opts.Bitset = 1, BitsetShared
+	}
+	if opts.BitsetFile != "" || opts.BitsetSwap {
+		// Local bitsets would be on the heap again
+		opts.Bitset = BitsetShared
+	}
+	if p := opts.AddressSpace.Masked(); p.IsValid() {
+		// Every shard still needs a word
+		opts.Bits = min(32, max(32-p.Bits(), bits.TrailingZeros(uint(opts.Shards))+6))
+	}
+	b := &BitsetCounter{
+		shards:        make([]shard, opts.Shards), // lazy init on first write
+		shardMask:     uint32(opts.Shards - 1),
+		shardShift:    uint(bits.TrailingZeros(uint(opts.Shards))),
+		wordsPerShard: int(space(opts.Bits) / uint64(opts.Shards) / 64),
+		maxLine:       cmp.Or(opts.MaxLine, utils.DefaultMaxLine),
+		delim:         opts.Parse.Delim(),
+		onNew:         opts.OnNewIP,
+		log:           counter.Logger(opts.Logger),
+		opts:          opts,
+	}
+	if opts.StreamDump != "" {
+		// Whatever else hears of new addresses, and NewIPs after it
+		prev := opts.OnNewIP
+		b.opts.OnNewIP = func(ip uint32) {
+			if prev != nil {
+				prev(ip)
+			}
+			b.dump.add(ip)
 		}
+		b.onNew = b.opts.OnNewIP
+	}
+	if p := opts.AddressSpace.Masked(); p.IsValid() {
+		b.spaced = true
+		b.base = binary.BigEndian.Uint32(p.Addr().AsSlice())
+		b.spaceMax = uint32(uint64(1)<<(32-p.Bits()) - 1)
+	}
+	if opts.MaxMem > 0 {
+		// Headers and read buffers, queued or being processed, come
+		// out of the budget first. One too small for them allows no shard,
+		// and the first address fails the run.
+		b.capped = true
+		b.maxShards = max(0, (opts.MaxMem-Overhead(opts))/int64(b.wordsPerShard*8))
+	}
+	return b, nil
+}
+
+// Overhead returns the memory a BitsetCounter with opts takes besides
+// its shard words: the padded shard headers and the read chunks queued or
+// being parsed.
+func Overhead(opts Options) int64 {
+	workers := workerCount(opts)
+	queued := cmp.Or(opts.QueueDepth, 2*workers)
+	chunk := cmp.Or(opts.ChunkSize, DefaultChunkSize)
+	return int64(cmp.Or(opts.Shards, DefaultShards))*cacheLine + int64((queued+workers)*chunk)
+}
+
+// workerCount returns the workers a BitsetCounter with opts runs.
+func workerCount(opts Options) int {
+	return cmp.Or(opts.Workers, runtime.NumCPU())
+}
+
+// space returns the number of values a counter with the given Bits tracks.
+func space(bits int) uint64 {
+	if bits == 0 {
+		return maxIPv4
+	}
+	return uint64(1) << bits
+}
+
+// alloc allocates s's words on first use, counting them against the
+// budget and the pool's cap. Once either is spent it returns nil and
+// flags the run.
+func (b *BitsetCounter) alloc(s *shard) []uint64 {
+	if !b.capped && b.opts.Job == nil {
+		return s.ensure(b.newWords)
+	}
+	if !b.reserveShard() {
+		b.overBudget.Store(true)
+		return nil
+	}
+	words := b.newWords(s)
+	if s.words.CompareAndSwap(nil, &words) {
+		return words
 	}
+	b.releaseShard() // lost the race; use the winner's slice
+	return *s.words.Load()
 }
 
-const bytesPerChunk = 2 * 1024 * 1024 // 2 MB read buffer size
+// reserveShard counts one more shard against the budget and the pool's
+// cap, reporting false, and counting nothing, if it fits neither.
+func (b *BitsetCounter) reserveShard() bool {
+	if n := b.allocated.Add(1); b.capped && n > b.maxShards {
+		b.allocated.Add(-1)
+		return false
+	}
+	if !b.opts.Job.Reserve(int64(b.wordsPerShard * 8)) {
+		b.allocated.Add(-1)
+		return false
+	}
+	return true
+}
+
+// releaseShard undoes reserveShard.
+func (b *BitsetCounter) releaseShard() {
+	b.allocated.Add(-1)
+	b.opts.Job.Release(int64(b.wordsPerShard * 8))
+}
+
+// BudgetErr returns an error wrapping counter.ErrMemBudget once Add,
+// AddRange or the current run has dropped an address for want of memory
+// under Options.MaxMem or the pool's cap, and nil before that. A run
+// clears it as it starts.
+func (b *BitsetCounter) BudgetErr() error {
+	if !b.overBudget.Load() {
+		return nil
+	}
+	return b.budgetErr()
+}
+
+// budgetErr describes a run that needed more shards than the budget or
+// the pool's cap, or that the watchdog stopped.
+func (b *BitsetCounter) budgetErr() error {
+	if err := b.opts.Job.Err(); err != nil {
+		return err
+	}
+	if w := b.watch; w != nil && w.over.Load() > 0 {
+		return fmt.Errorf("%w: %s in use, over the %s budget; use the bucket engine",
+			counter.ErrMemBudget, counter.FormatBytes(w.over.Load()), counter.FormatBytes(w.budget))
+	}
+	return fmt.Errorf("%w: input spans more than %d of %d bitset shards (%s of %s budget); use the bucket engine",
+		counter.ErrMemBudget, b.maxShards, len(b.shards),
+		counter.FormatBytes(b.maxShards*int64(b.wordsPerShard*8)), counter.FormatBytes(b.opts.MaxMem))
+}
+
+// setBit marks the given bit if not already set, returns true if it was new.
+// The atomic OR is wait-free; its returned old value tells whether this
+// call was the one that set the bit, so exactly one caller sees true.
+// Over the memory budget nothing is set and it returns false.
+func (b *BitsetCounter) setBit(s *shard, offset uint32) bool {
+	words := s.loaded()
+	if words == nil {
+		if words = b.alloc(s); words == nil {
+			return false
+		}
+	}
+	mask := uint64(1) << (offset % 64)
+	if atomic.OrUint64(&words[offset/64], mask)&mask != 0 {
+		return false
+	}
+	s.count.Add(1)
+	return true
+}
 
 // CountUniqueIPs counts distinct IPv4s in a file using concurrent chunk processing
 func (b *BitsetCounter) CountUniqueIPs(filename string) (int64, error) {
+	return b.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation: once ctx is
+// done the producer stops reading, workers drop queued chunks, and every
+// goroutine has exited by the time ctx.Err() is returned.
+func (b *BitsetCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	if err := b.attachState(); err != nil {
+		return 0, b.endRun(err)
+	}
+	return b.finishRun(b.countFile(ctx, filename))
+}
+
+// finishRun ends a run started by one of the Count methods: it syncs the
+// state file, flushes the stream dump, writes the checkpoint curve's last
+// row and closes the NewIPs channel.
+func (b *BitsetCounter) finishRun(n int64, err error) (int64, error) {
+	if serr := b.syncState(); err == nil {
+		err = serr
+	}
+	if derr := b.flushDump(); err == nil {
+		err = derr
+	}
+	if err == nil {
+		b.meter.Finish()
+		b.reportExtremes()
+		err = b.reportShards()
+	}
+	if err == nil {
+		b.log.Info("concurrent count done", "new", n, "oversized", b.oversized.Load(),
+			"elapsed", time.Since(b.start).Round(time.Millisecond))
+	}
+	if err = b.endRun(err); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// resetRun clears what the previous run left behind for a new one.
+func (b *BitsetCounter) resetRun() {
+	b.oversized.Store(0)
+	b.overBudget.Store(false)
+	b.startWatchdog()
+	b.resetOrder()
+	b.runSrc, b.sources = counter.Source{}, nil
+	b.meter = counter.NewMeter(b.opts.Checkpoint, b.Count, false)
+	b.meter.SetSize(b.fileSize)
+	b.meter.SetInFlight(int64(workerCount(b.opts)) * int64(b.opts.ChunkSize))
+	b.fileSize = 0
+	b.skips = counter.NewSkipLog(b.log)
+	b.parser = &pipeline.Parser{Parse: b.opts.Parse, MaxLine: b.maxLine, Skips: b.skips, Oversized: &b.oversized}
+	if b.spaced {
+		b.parser.Check = b.checkSpace
+	}
+	b.start = time.Now()
+}
+
+// countFile counts filename by mapping, segments or streaming.
+func (b *BitsetCounter) countFile(ctx context.Context, filename string) (int64, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return 0, fmt.Errorf("failed to open file: %w", err)
+		return 0, &counter.OpenError{Path: filename, Err: err}
 	}
 	defer file.Close()
 
-	numWorkers := runtime.NumCPU()
-	chunkChan := make(chan []byte, numWorkers*2)
-	resultChan := make(chan int64, numWorkers*2)
+	b.resetRun()
+	b.runSrc.Name = filename
+	if b.opts.Binary == nil {
+		// A blank file has no chunk worth mapping, splitting or reading
+		lines, blank, err := counter.BlankFile(file, b.opts.Parse.Delim())
+		if err != nil {
+			return 0, counter.WrapRead(filename, err)
+		}
+		if blank {
+			counter.NoteBlank(b.opts.Stats, b.opts.Parse, lines)
+			return b.countReader(ctx, bytes.NewReader(nil))
+		}
+	}
+	// Mapped and segmented workers each take a range of the file, so the
+	// bytes processed say nothing of how far into it the count is
+	ranged := b.opts.Binary == nil && len(b.opts.Checkpoint.Shares) == 0
+	if b.opts.Mmap && ranged {
+		if n, err := b.countMapped(ctx, file); err != errMmapUnsupported {
+			return n, err
+		}
+	}
+	if b.opts.Segmented && ranged {
+		if st, err := file.Stat(); err == nil && st.Mode().IsRegular() {
+			return b.countSegmented(ctx, file, st.Size())
+		}
+	}
 
-	// Pool for reusing read buffers
-	bufPool := sync.Pool{
-		New: func() any { return make([]byte, bytesPerChunk) },
+	if st, err := file.Stat(); err == nil && st.Mode().IsRegular() {
+		b.fileSize = st.Size()
 	}
+	r := counter.NewRetryFile(ctx, file, b.opts.Retries, b.opts.Stats, b.log)
+	defer r.Close()
+	if b.opts.NoCache {
+		return b.countReader(ctx, counter.DropBehind(file, 0, r))
+	}
+	return b.countReader(ctx, r)
+}
 
-	runtime.GOMAXPROCS(numWorkers)
+// CountUniqueIPsFS counts distinct IPv4s in the file name of fsys, such
+// as an embed.FS or fstest.MapFS, with the streaming pipeline.
+func (b *BitsetCounter) CountUniqueIPsFS(fsys fs.FS, name string) (int64, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return 0, &counter.OpenError{Path: name, Err: err}
+	}
+	defer file.Close()
+	return b.CountReader(context.Background(), file)
+}
 
-	// Worker goroutines process chunks in parallel
-	var wg sync.WaitGroup
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for chunk := range chunkChan {
-				resultChan <- processChunk(chunk, b)
-			}
-		}()
-	}
-
-	// Aggregator goroutine sums worker results
-	var resultWg sync.WaitGroup
-	resultWg.Add(1)
-	var total int64
-	go func() {
-		defer resultWg.Done()
-		for c := range resultChan {
-			total += c
-		}
-	}()
-
-	// Producer: reads file in chunks, splits at last newline
-	var carry []byte
-	reader := bufio.NewReader(file)
-
-	for {
-		buf := bufPool.Get().([]byte)
-		n, readErr := reader.Read(buf)
-		if n == 0 && readErr != nil {
-			bufPool.Put(buf)
-			if readErr == io.EOF {
-				break
-			}
-			return 0, fmt.Errorf("read error: %w", readErr)
-		}
+// CountReader counts distinct IPv4s read from r with the streaming
+// producer/worker pipeline. Whatever ends the read - EOF, a read error or
+// ctx - the chunk channel is closed and every worker has exited before
+// CountReader returns.
+func (b *BitsetCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	if err := b.attachState(); err != nil {
+		return 0, b.endRun(err)
+	}
+	return b.finishRun(b.countReader(ctx, r))
+}
 
-		data := buf[:n]
-		cut := bytes.LastIndexByte(data, '\n')
+func (b *BitsetCounter) countReader(ctx context.Context, r io.Reader) (int64, error) {
+	b.resetRun()
+	count := b.countStream
+	if b.opts.Record != "" {
+		count = b.recordStream
+	}
+	total, err := count(ctx, r, workerCount(b.opts))
+	b.reportOversized()
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
 
-		if cut == -1 { // no newline found, accumulate and continue
-			carry = append(carry, data...)
-			bufPool.Put(buf)
-			if readErr == io.EOF {
-				break
-			}
-			continue
-		}
+// CountParallel counts the union of inputs into the set, streaming up to
+// parallel of them at once with Workers/parallel workers each. Bits are
+// set atomically, so each new address is counted by exactly one pipeline
+// and the total is the same as counting the inputs one after another.
+func (b *BitsetCounter) CountParallel(ctx context.Context, inputs []counter.Input, parallel int) (int64, error) {
+	if err := b.attachState(); err != nil {
+		return 0, b.endRun(err)
+	}
+	return b.finishRun(b.countParallel(ctx, inputs, parallel))
+}
 
-		// Complete chunk = carry + data until last newline
-		chunk := make([]byte, len(carry)+(cut+1))
-		copy(chunk, carry)
-		copy(chunk[len(carry):], data[:cut+1])
-		carry = carry[:0]
+func (b *BitsetCounter) countParallel(ctx context.Context, inputs []counter.Input, parallel int) (int64, error) {
+	b.resetRun()
+	if b.opts.Record != "" {
+		return 0, errors.New("a chunk trace records one input; count them one after another")
+	}
+	workers := max(1, workerCount(b.opts)/max(parallel, 1))
+	var total atomic.Int64
+	err := counter.ForEachInput(ctx, inputs, parallel, func(ctx context.Context, src counter.Source, r io.Reader) error {
+		n, err := b.countStreamFrom(ctx, r, workers, &src)
+		total.Add(n)
+		return err
+	})
+	b.reportOversized()
+	if err != nil {
+		return 0, err
+	}
+	if err := b.runErr(ctx); err != nil {
+		return 0, err
+	}
+	return total.Load(), nil
+}
 
-		chunkChan <- chunk
+// countStream runs the producer/worker pipeline over r with numWorkers
+// workers and returns how many addresses were new to the set. Several
+// may run at once on one counter.
+func (b *BitsetCounter) countStream(ctx context.Context, r io.Reader, numWorkers int) (int64, error) {
+	return b.countStreamFrom(ctx, r, numWorkers, nil)
+}
 
-		// Save remainder after last newline
-		if cut+1 < len(data) {
-			carry = append(carry, data[cut+1:]...)
+// countStreamFrom is countStream reading src, one of several inputs, or
+// with a nil src a stream that may be a counter.Sourced. Either way what
+// each source contributed goes to Sources and Stats.
+func (b *BitsetCounter) countStreamFrom(ctx context.Context, r io.Reader, numWorkers int, src *counter.Source) (int64, error) {
+	if b.opts.Job != nil {
+		numWorkers = b.opts.Job.Workers()
+	}
+	var locals *workerSets
+	if _, sourced := r.(counter.Sourced); !sourced || src != nil {
+		// A worker's local set cannot tell which source its addresses
+		// came from
+		locals = b.newLocalSets(numWorkers)
+	}
+	depth := cmp.Or(b.opts.QueueDepth, numWorkers*2)
+	b.log.Debug("concurrent worker pool sized", "workers", numWorkers, "chunk_size", b.opts.ChunkSize,
+		"queue_depth", depth, "local_bitsets", locals != nil, "numa_groups", locals.numGroups())
+	res, err := pipeline.Run(ctx, r, &stream{b: b, locals: locals, src: src}, pipeline.Options{
+		Parse:      b.opts.Parse,
+		Binary:     b.opts.Binary,
+		MaxLine:    b.opts.MaxLine,
+		Check:      b.parser.Check,
+		Skips:      b.skips,
+		Workers:    numWorkers,
+		ChunkSize:  b.opts.ChunkSize,
+		QueueDepth: depth,
+		Seq:        &b.seq,
+		Stop:       b.overBudget.Load,
+		Trace:      b.trace,
+		Source:     src,
+		Job:        b.opts.Job,
+		Progress:   b.opts.Progress,
+	})
+	b.oversized.Add(res.Oversized)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.runErr(ctx); err != nil {
+		return 0, err
+	}
+	if err := b.checkPartial(res.Partial); err != nil {
+		return 0, err
+	}
+	n := res.New
+	if locals != nil {
+		runSrc := b.runSrc
+		if src != nil {
+			runSrc = *src
 		}
-
-		bufPool.Put(buf)
-
-		if readErr == io.EOF {
-			break
+		n = b.mergeLocal(locals, b.noteFor(&runSrc))
+		if len(res.Sources) == 1 {
+			res.Sources[0].New = n
 		}
 	}
+	b.addSources(res.Sources)
+	return n, nil
+}
 
-	// Send leftover tail without newline
-	if len(carry) > 0 {
-		chunk := make([]byte, len(carry))
-		copy(chunk, carry)
-		chunkChan <- chunk
+// addSources records the tallies of a run's sources.
+func (b *BitsetCounter) addSources(tallies []counter.SourceTally) {
+	b.sourcesMu.Lock()
+	defer b.sourcesMu.Unlock()
+	for _, t := range tallies {
+		b.sources = append(b.sources, t)
+		b.opts.Stats.AddSource(t)
 	}
+}
 
-	// Cleanup
-	close(chunkChan)
-	wg.Wait()
-	close(resultChan)
-	resultWg.Wait()
+// Sources returns what each source of the last run contributed, in source
+// order: the inputs of CountParallel or the sources of a counter.Sourced
+// stream. It is nil after a run of a single source.
+func (b *BitsetCounter) Sources() []counter.SourceTally {
+	b.sourcesMu.Lock()
+	defer b.sourcesMu.Unlock()
+	return slices.SortedFunc(slices.Values(b.sources), func(x, y counter.SourceTally) int { return cmp.Compare(x.Index, y.Index) })
+}
 
-	return total, nil
+// A BitsetCounter is itself a sink for programs running their own
+// pipeline.
+var _ pipeline.RangeSink = (*BitsetCounter)(nil)
+
+// stream is the pipeline sink of one countStream: the set, whose workers
+// each add through their own state.
+type stream struct {
+	b      *BitsetCounter
+	locals *workerSets
+	src    *counter.Source // the input read, nil unless it is one of several
 }
 
-// processChunk parses IPs in chunk and updates bitset
-func processChunk(chunk []byte, b *BitsetCounter) int64 {
-	var count int64
-	start := 0
+func (s *stream) Add(ip uint32) bool {
+	return s.b.Add(ip)
+}
 
-	for i, c := range chunk {
-		if c == '\n' {
-			line := bytes.TrimSpace(chunk[start:i])
-			start = i + 1
-			if len(line) == 0 { continue }
+func (s *stream) Worker(i int) pipeline.Worker {
+	w := s.b.newWorker(s.locals, i)
+	if s.src != nil {
+		w.src = *s.src
+	}
+	return w
+}
 
-			ipInt, err := utils.ParseIPv4(line)
-			if err != nil { continue }
+// reportOversized records the lines dropped for exceeding MaxLine, the
+// addresses outside AddressSpace and the shards allocated under a budget.
+func (b *BitsetCounter) reportOversized() {
+	b.opts.Stats.Set("oversized lines", "%d", b.oversized.Load())
+	if b.spaced {
+		b.opts.Stats.Set("outside address space", "%d addresses", b.outside.Load())
+	}
+	if b.capped {
+		b.opts.Stats.Set("concurrent budget", "%d of at most %d shards allocated (%s budget)",
+			b.allocated.Load(), b.maxShards, counter.FormatBytes(b.opts.MaxMem))
+	}
+}
 
-			shardIdx := ipInt % numShards
-			if setBit(b.shards[shardIdx], ipInt/numShards) {
-				count++
-			}
+// runErr returns why a run stopped early: cancellation or the budget.
+func (b *BitsetCounter) runErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if b.overBudget.Load() {
+		return b.budgetErr()
+	}
+	return nil
+}
+
+// checkpoint adds data, just processed, to the run's checkpoint meter and
+// Options.Progress.
+func (b *BitsetCounter) checkpoint(data []byte) {
+	if b.meter == nil && b.opts.Progress == nil {
+		return
+	}
+	var lines int64
+	switch {
+	case b.meter.Bytes() && b.opts.Progress == nil:
+	case b.opts.Binary != nil:
+		lines = int64(len(data) / 4)
+	default:
+		lines = utils.CountRecords(data, b.delim)
+	}
+	b.meter.Add(lines, int64(len(data)))
+	b.progress(lines, int64(len(data)))
+}
+
+// progress adds lines and n bytes to Options.Progress with the count so
+// far, which with Options.Hash is of bits rather than addresses and so
+// left out.
+func (b *BitsetCounter) progress(lines, n int64) {
+	if p := b.opts.Progress; p != nil {
+		p.Add(lines, n)
+		if b.opts.Hash == nil {
+			p.SetUnique(b.Count())
 		}
 	}
+}
 
-	// Handle last line (no trailing newline)
-	if start < len(chunk) {
-		line := bytes.TrimSpace(chunk[start:])
-		if len(line) > 0 {
-			if ipInt, err := utils.ParseIPv4(line); err == nil {
-				shardIdx := ipInt % numShards
-				if setBit(b.shards[shardIdx], ipInt/numShards) {
-					count++
-				}
-			}
+// processRange parses part in newline-aligned pieces of about
+// Options.ChunkSize, so a canceled ctx or spent budget stops the worker
+// between pieces.
+func processRange(ctx context.Context, part []byte, b *BitsetCounter, w *worker) int64 {
+	var count int64
+	for len(part) > 0 && ctx.Err() == nil && !b.overBudget.Load() {
+		end := min(len(part), b.opts.ChunkSize)
+		if i := bytes.IndexByte(part[end:], b.delim); i >= 0 {
+			end += i + 1
+		} else {
+			end = len(part)
 		}
+		count += b.parser.Chunk(part[:end], w)
+		b.checkpoint(part[:end])
+		part = part[end:]
 	}
 	return count
 }
+
+// addIP adds one address, returning 1 if it was new. With a local set it
+// is counted when the set is merged.
+func (b *BitsetCounter) addIP(ip uint32, w *worker) int64 {
+	ipInt := ip
+	if b.opts.Hash != nil {
+		ipInt = b.opts.Hash(ipInt)
+	}
+	ipInt, ok := b.offset(ipInt)
+	if !ok {
+		b.outside.Add(1)
+		return 0
+	}
+	if w.local != nil {
+		w.local.add(ipInt)
+		return 0
+	}
+	if w.group != nil {
+		w.group.add(ipInt)
+		return 0
+	}
+	if b.addBit(ipInt, w.note) {
+		w.newIP(ip)
+		return 1
+	}
+	return 0
+}
+
+// addBlock adds the addresses [first, last] of a CIDR line. Hashed
+// addresses are scattered, so with Options.Hash each one is set on its own.
+func (b *BitsetCounter) addBlock(first, last uint32, w *worker) int64 {
+	if b.opts.Hash != nil {
+		var added int64
+		for ip := first; ; ip++ {
+			if h := b.opts.Hash(ip); w.local != nil {
+				w.local.add(h)
+			} else if w.group != nil {
+				w.group.add(h)
+			} else if b.addBit(h, w.note) {
+				added++
+			}
+			if ip == last {
+				return added
+			}
+		}
+	}
+	lo, hi, ok := b.clip(first, last)
+	if !ok {
+		return 0
+	}
+	if w.local != nil {
+		w.local.addRange(lo, hi)
+		return 0
+	}
+	if w.group != nil {
+		w.group.addRange(lo, hi)
+		return 0
+	}
+	added := b.addRange(lo, hi, w.note)
+	if added > 0 {
+		w.newIP(b.base + hi)
+	}
+	return added
+}
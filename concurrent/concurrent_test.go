@@ -0,0 +1,518 @@
+package concurrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// newCounter is NewWithOptions for options the test expects to be valid.
+func newCounter(tb testing.TB, opts Options) *BitsetCounter {
+	tb.Helper()
+	b, err := NewWithOptions(opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// A curve's rows must rise with the input and its last row must be the
+// whole input and the exact count, whether or not it falls on a row.
+func TestCurveEndsAtCount(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	var b strings.Builder
+	const lines = 200000
+	for range lines {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(rng.Uint32N(50000)))
+	}
+	input := b.String()
+
+	for _, every := range []int64{30000, 40000} {
+		var out strings.Builder
+		c := newCounter(t, Options{ChunkSize: MinChunkSize,
+			Checkpoint: counter.Checkpoint{Every: every, Curve: true, Out: &out}})
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if rows[0] != "lines_processed,cumulative_unique" {
+			t.Fatalf("every %d: header %q", every, rows[0])
+		}
+		var prevLines, prevUnique int64
+		for _, row := range rows[1:] {
+			var l, u int64
+			if _, err := fmt.Sscanf(row, "%d,%d", &l, &u); err != nil {
+				t.Fatalf("every %d: row %q: %v", every, row, err)
+			}
+			if l <= prevLines || u < prevUnique {
+				t.Errorf("every %d: row %q after %d,%d", every, row, prevLines, prevUnique)
+			}
+			prevLines, prevUnique = l, u
+		}
+		if prevLines != lines || prevUnique != n {
+			t.Errorf("every %d: last row %d,%d, want %d,%d", every, prevLines, prevUnique, lines, n)
+		}
+		if len(rows) < int(lines/every)+1 {
+			t.Errorf("every %d: %d rows", every, len(rows)-1)
+		}
+	}
+}
+
+// Every address of the fixture appears in its first half, so the table
+// of a file reaches all of them at 50%, give or take the chunks in flight
+// its comment admits to, while mapped or split runs stream instead.
+func TestUniquesAt(t *testing.T) {
+	var b strings.Builder
+	for range 2 {
+		for i := range 100000 { // 15-byte lines
+			fmt.Fprintf(&b, "10.1%02d.1%02d.10%d\n", i/1000, i/10%100, i%10)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inFlight := int64(runtime.NumCPU() * MinChunkSize)
+
+	for _, o := range []Options{{}, {Mmap: true}, {Segmented: true}} {
+		var out strings.Builder
+		o.ChunkSize = MinChunkSize
+		o.Checkpoint = counter.Checkpoint{Shares: []float64{0.5, 1}, Table: &out}
+		n, err := newCounter(t, o).CountUniqueIPs(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if len(rows) != 4 || !strings.HasPrefix(rows[0], "# taken as chunks finish out of order") ||
+			rows[1] != "percent_of_file,unique_so_far,percent_of_final_uniques" || rows[3] != fmt.Sprintf("100,%d,100.00", n) {
+			t.Fatalf("mmap %v, segmented %v: table\n%s", o.Mmap, o.Segmented, out.String())
+		}
+		var unique int64
+		if _, err := fmt.Sscanf(rows[2], "50,%d,", &unique); err != nil || unique < n-inFlight/15 || unique > n {
+			t.Errorf("mmap %v, segmented %v: row %q, want %d less up to %d lines in flight", o.Mmap, o.Segmented, rows[2], n, inFlight/15)
+		}
+	}
+}
+
+// A preload equal to the input leaves nothing new, a disjoint one leaves
+// the count as it was, and a preload line that fails to parse fails the
+// run even though the input's own bad lines are skipped.
+func TestPreload(t *testing.T) {
+	input := "1.1.1.1\n2.2.2.2\nbad\n3.3.3.3\n1.1.1.1\n"
+	write := func(list string) string {
+		path := filepath.Join(t.TempDir(), "seen.txt")
+		if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, tc := range []struct {
+		list        string
+		new, merged int64
+	}{
+		{"1.1.1.1\n2.2.2.2\n3.3.3.3\n", 0, 3},
+		{"# seen\n9.9.9.9\n  8.8.8.8:53\n\n", 3, 5},
+	} {
+		c := newCounter(t, Options{Preload: write(tc.list),
+			Parse: utils.ParseOptions{CommentPrefix: "#", StripPort: true}})
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("%q: %v", tc.list, err)
+		}
+		if n != tc.new || c.Count() != tc.merged {
+			t.Errorf("%q: %d new of %d, want %d of %d", tc.list, n, c.Count(), tc.new, tc.merged)
+		}
+	}
+
+	c := newCounter(t, Options{Preload: write("1.1.1.1\nbad\n")})
+	if _, err := c.CountReader(context.Background(), strings.NewReader(input)); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("bad preload line: error %v", err)
+	}
+}
+
+// Both edges of the address space count and the addresses just past them
+// do not, whether lines are single addresses, blocks spilling over the
+// space or packed records, and whatever the bitset mode; Range and
+// Contains give back the addresses themselves.
+func TestAddressSpace(t *testing.T) {
+	space := netip.MustParsePrefix("100.64.0.0/10")
+	first, last := uint32(100<<24|64<<16), uint32(100<<24|127<<16|0xffff)
+	lines := []uint32{first, first - 1, last, last + 1, first, 0, ^uint32(0), first + 1000}
+	var text strings.Builder
+	var packed []byte
+	for _, ip := range lines {
+		fmt.Fprintf(&text, "%s\n", utils.FormatIPv4(ip))
+		packed = binary.BigEndian.AppendUint32(packed, ip)
+	}
+
+	for _, mode := range []BitsetMode{BitsetShared, BitsetLocal} {
+		for _, bin := range []bool{false, true} {
+			stats := new(counter.Stats)
+			o := Options{AddressSpace: space, Bitset: mode, Stats: stats}
+			in := strings.NewReader(text.String())
+			if bin {
+				o.Binary, in = binary.BigEndian, strings.NewReader(string(packed))
+			}
+			c := newCounter(t, o)
+			n, err := c.CountReader(context.Background(), in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 3 {
+				t.Errorf("mode %v, binary %v: %d unique, want 3", mode, bin, n)
+			}
+			if got := stats.String(); !strings.Contains(got, "outside address space: 4 addresses") {
+				t.Errorf("mode %v, binary %v: stats\n%s", mode, bin, got)
+			}
+			var got []uint32
+			c.Range(func(ip uint32) bool { got = append(got, ip); return true })
+			if want := []uint32{first, first + 1000, last}; !slices.Equal(got, want) {
+				t.Errorf("mode %v, binary %v: Range gave %v, want %v", mode, bin, got, want)
+			}
+			if !c.Contains(last) || c.Contains(last+1) || c.Contains(first-1) {
+				t.Errorf("mode %v, binary %v: Contains is wrong at the edges", mode, bin)
+			}
+		}
+	}
+
+	// A block covering the space counts all of it and only it
+	c := newCounter(t, Options{AddressSpace: space, Parse: utils.ParseOptions{CIDR: true, MinPrefix: 8}})
+	n, err := c.CountReader(context.Background(), strings.NewReader("100.0.0.0/9\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1<<22 {
+		t.Errorf("block over the space: %d unique, want %d", n, 1<<22)
+	}
+
+	// A space smaller than the shards still holds both edges
+	c = newCounter(t, Options{AddressSpace: netip.MustParsePrefix("10.0.0.4/30")})
+	n, err = c.CountReader(context.Background(), strings.NewReader("10.0.0.3\n10.0.0.4\n10.0.0.7\n10.0.0.8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lo, hi, _ := c.Bounds(); n != 2 || lo != 10<<24|4 || hi != 10<<24|7 {
+		t.Errorf("/30 space: %d unique from %s to %s", n, utils.FormatIPv4(lo), utils.FormatIPv4(hi))
+	}
+}
+
+// Subsample counts must be those of hashing every distinct address,
+// nested and ending with the full count, in every bitset mode and with the
+// set bounded to an address space.
+func TestSubsampleCounts(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	var b strings.Builder
+	rates := []float64{0.01, 0.1, 0.5, 1}
+	want := make([]int64, len(rates))
+	seen := make(map[uint32]bool)
+	for range 300000 {
+		ip := 10<<24 | rng.Uint32N(1<<20)
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		h := counter.SubsampleHash(ip)
+		for i, r := range rates {
+			if r == 1 || float64(h) < r*(1<<64) {
+				want[i]++
+			}
+		}
+	}
+	input := b.String()
+
+	for _, o := range []Options{
+		{Bitset: BitsetShared},
+		{Bitset: BitsetLocal},
+		{AddressSpace: netip.MustParsePrefix("10.0.0.0/12")},
+	} {
+		o.SubsampleRates = rates
+		c := newCounter(t, o)
+		if _, err := c.CountReader(context.Background(), strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		got := c.SubsampleCounts()
+		for i, sc := range got {
+			if sc.Rate != rates[i] || sc.Unique != want[i] {
+				t.Errorf("%v %v: rate %g has %d, want %g with %d", o.Bitset, o.AddressSpace, sc.Rate, sc.Unique, rates[i], want[i])
+			}
+		}
+		if len(got) != len(rates) || got[len(got)-1].Unique != c.Count() {
+			t.Errorf("%v %v: %v, want %d rows ending with %d", o.Bitset, o.AddressSpace, got, len(rates), c.Count())
+		}
+	}
+}
+
+// endless yields the same address line forever, so only the budget can
+// end a run over it.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	const line = "10.0.0.1\n"
+	n := 0
+	for n+len(line) <= len(p) {
+		n += copy(p[n:], line)
+	}
+	return n, nil
+}
+
+// The watchdog stops a run whose heap goes over MaxMem even though the
+// shards it allocates fit, and says so in the error and the stats.
+func TestWatchdog(t *testing.T) {
+	ballast := make([]byte, 64<<20)
+	for i := range ballast {
+		ballast[i] = 1
+	}
+	stats := &counter.Stats{}
+	c := newCounter(t, Options{Watchdog: true, MaxMem: 32 << 20, ChunkSize: MinChunkSize, QueueDepth: 1,
+		AddressSpace: netip.MustParsePrefix("10.0.0.0/24"), Stats: stats,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	_, err := c.CountReader(context.Background(), endless{})
+	if !errors.Is(err, counter.ErrMemBudget) || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("over budget: %v, want the watchdog's ErrMemBudget", err)
+	}
+	if got := stats.String(); !strings.Contains(got, "concurrent watchdog: stopped the run") {
+		t.Errorf("stats %q", got)
+	}
+	runtime.KeepAlive(ballast)
+}
+
+// A budget too small for the headers and read buffers allows no shard at
+// all rather than none of a cap, so the first address fails the run; an
+// input with no addresses still counts.
+func TestBudgetBelowOverhead(t *testing.T) {
+	opts := Options{MaxMem: 1 << 20, Shards: 64, ChunkSize: MinChunkSize, Workers: 2,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	opts.MaxMem = Overhead(opts) - 1
+	n, err := newCounter(t, opts).CountReader(context.Background(), strings.NewReader("# nothing\n"))
+	if err != nil || n != 0 {
+		t.Fatalf("no addresses: %d, %v", n, err)
+	}
+	_, err = newCounter(t, opts).CountReader(context.Background(), strings.NewReader("10.0.0.1\n"))
+	if !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("budget below the overhead: %v, want ErrMemBudget", err)
+	}
+}
+
+// benchInput returns n random addresses of 10.0.0.0/12 as text lines and
+// packed records.
+func benchInput(n int) (text, packed []byte) {
+	rng := rand.New(rand.NewPCG(9, 10))
+	for range n {
+		ip := 10<<24 | rng.Uint32N(1<<20)
+		text = fmt.Appendf(text, "%s\n", utils.FormatIPv4(ip))
+		packed = binary.BigEndian.AppendUint32(packed, ip)
+	}
+	return text, packed
+}
+
+// The set is bounded to the input's block so that clearing it between
+// runs does not dominate.
+func BenchmarkCountReader(b *testing.B) {
+	text, packed := benchInput(1 << 20)
+	for _, bc := range []struct {
+		name  string
+		input []byte
+		order binary.ByteOrder
+	}{{"text", text, nil}, {"binary", packed, binary.BigEndian}} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := newCounter(b, Options{Binary: bc.order, Bitset: BitsetShared,
+				AddressSpace: netip.MustParsePrefix("10.0.0.0/12"), Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+			b.SetBytes(int64(len(bc.input)))
+			for range b.N {
+				c.Reset()
+				if _, err := c.CountReader(context.Background(), bytes.NewReader(bc.input)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkChunkSize reads a generated file in chunks from the smallest
+// allowed to the largest sensible, with 4 workers, so the cost of small
+// chunks' handoffs and of large chunks' late start shows on the host.
+func BenchmarkChunkSize(b *testing.B) {
+	text, _ := benchInput(1 << 21)
+	path := filepath.Join(b.TempDir(), "in.txt")
+	if err := os.WriteFile(path, text, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{MinChunkSize, 64 << 10, 512 << 10, 2 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("chunk=%dKiB", size>>10), func(b *testing.B) {
+			c := newCounter(b, Options{Workers: 4, ChunkSize: size, Bitset: BitsetShared,
+				AddressSpace: netip.MustParsePrefix("10.0.0.0/12"), Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+			b.SetBytes(int64(len(text)))
+			for range b.N {
+				c.Reset()
+				if _, err := c.CountUniqueIPs(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSmallChunks streams an input in the smallest chunks allowed,
+// so whatever the workers do per chunk to hand back their counts
+// weighs on the run. Every address falls in shard 0 of 64, keeping the
+// Reset between runs to one 8 MB shard.
+func BenchmarkSmallChunks(b *testing.B) {
+	rng := rand.New(rand.NewPCG(368, 369))
+	var text []byte
+	for range 1 << 20 {
+		text = fmt.Appendf(text, "%s\n", utils.FormatIPv4(rng.Uint32N(1<<26)<<6))
+	}
+	c := newCounter(b, Options{Shards: 64, ChunkSize: MinChunkSize, Bitset: BitsetShared,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	b.SetBytes(int64(len(text)))
+	for range b.N {
+		c.Reset()
+		if _, err := c.CountReader(context.Background(), bytes.NewReader(text)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Strings are parsed as input lines, and a Reset racing with adders
+// leaves the running count agreeing with the bits once they stop.
+func TestAddStringAndReset(t *testing.T) {
+	c := newCounter(t, Options{Parse: utils.ParseOptions{CIDR: true, CommentPrefix: "#"},
+		AddressSpace: netip.MustParsePrefix("10.0.0.0/8")})
+	for _, tc := range []struct {
+		s     string
+		added int64
+		fail  bool
+	}{
+		{" 10.0.0.1\r\n", 1, false}, {"10.0.0.1", 0, false}, {"10.1.0.0/24", 256, false},
+		{"", 0, false}, {"# note", 0, false}, {"10.0.0", 0, true}, {"192.168.0.1", 0, true},
+	} {
+		added, err := c.AddString(tc.s)
+		if added != tc.added || (err != nil) != tc.fail {
+			t.Errorf("AddString(%q) = %d, %v; want %d, failing %v", tc.s, added, err, tc.added, tc.fail)
+		}
+	}
+	if n := c.Count(); n != 257 {
+		t.Errorf("count %d, want 257", n)
+	}
+
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(g), 1))
+			for range 50000 {
+				c.Add(10<<24 | rng.Uint32()>>16)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	for resetting := true; resetting; {
+		select {
+		case <-done:
+			resetting = false
+		default:
+			c.Reset()
+			runtime.Gosched()
+		}
+	}
+	if n, exact := c.Count(), c.CountExact(); n != exact {
+		t.Errorf("count %d after resets, %d bits set", n, exact)
+	}
+	c.Reset()
+	if n := c.Count(); n != 0 || c.Contains(10<<24|1) {
+		t.Errorf("count %d after a quiet reset", n)
+	}
+}
+
+// VerifyCount must pass an honest run in every bitset mode and catch one
+// whose running count was thrown off by an address counted twice.
+func TestVerifyCount(t *testing.T) {
+	rng := rand.New(rand.NewPCG(9, 10))
+	var b strings.Builder
+	for range 50000 {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(rng.Uint32()>>12))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, o := range []Options{{Bitset: BitsetShared}, {Bitset: BitsetLocal}, {Mmap: true}, {Segmented: true}} {
+		o.VerifyCount, o.Logger = true, discard
+		want, err := newCounter(t, o).CountUniqueIPs(path)
+		if err != nil {
+			t.Fatalf("%+v: %v", o, err)
+		}
+
+		testHookCounted = func(b *BitsetCounter) { b.shards[len(b.shards)-1].count.Add(1) }
+		_, err = newCounter(t, o).CountUniqueIPs(path)
+		testHookCounted = nil
+		var mismatch *counter.CountMismatchError
+		if !errors.As(err, &mismatch) || !errors.Is(err, counter.ErrCountMismatch) {
+			t.Fatalf("%+v: %v, want a count mismatch", o, err)
+		}
+		if mismatch.Recount != want || mismatch.Counted != want+1 {
+			t.Errorf("%+v: %+v, want %d recounted and %d counted", o, mismatch, want, want+1)
+		}
+	}
+}
+
+// Any worker count gives the same count in every read mode, and the
+// counter leaves GOMAXPROCS as the caller set it; a negative one is
+// refused with an error, not a panic, however the counter is built.
+func TestWorkers(t *testing.T) {
+	rng := rand.New(rand.NewPCG(11, 12))
+	var b strings.Builder
+	seen := map[uint32]bool{}
+	for range 50000 {
+		ip := rng.Uint32() >> 14
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(3))
+	for _, workers := range []int{1, 3, 7} {
+		for _, o := range []Options{{Bitset: BitsetShared}, {Bitset: BitsetLocal}, {Mmap: true}, {Segmented: true}} {
+			o.Workers, o.ChunkSize = workers, 64<<10
+			n, err := newCounter(t, o).CountUniqueIPs(path)
+			if err != nil || n != int64(len(seen)) {
+				t.Errorf("%+v: %d, %v, want %d", o, n, err, len(seen))
+			}
+			if p := runtime.GOMAXPROCS(0); p != 3 {
+				t.Fatalf("%+v: GOMAXPROCS %d, want 3", o, p)
+			}
+		}
+	}
+	if err := (Options{Workers: -1}).Validate(); err == nil {
+		t.Error("negative Workers accepted")
+	}
+	if c, err := NewWithOptions(Options{Workers: -1}); c != nil || err == nil {
+		t.Errorf("negative Workers: %v, %v; want an error", c, err)
+	}
+	if c, err := counter.NewWithOptions("concurrent", counter.Options{Workers: -1}); c != nil || err == nil {
+		t.Errorf("negative Workers through the registry: %v, %v; want an error", c, err)
+	}
+}
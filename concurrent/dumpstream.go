@@ -0,0 +1,216 @@
+package concurrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	// DumpFlushEntries and DumpFlushInterval bound how much of a
+	// StreamDump an interrupted run can lose: a flush point is written
+	// once this many addresses were appended since the last, or once
+	// this long has passed with any appended.
+	DumpFlushEntries  = 1 << 16
+	DumpFlushInterval = time.Second
+
+	// dumpMark starts a flush point line, followed by the number of
+	// addresses above it.
+	dumpMark = "# flushed "
+)
+
+// streamDump is the open Options.StreamDump: addresses are appended as
+// workers find them, one dotted quad per line, and each flush point
+// writes the buffer out, fsyncs it with Options.Sync and records the
+// number of addresses above it on a line of its own.
+type streamDump struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	buf     []byte
+	n       int64     // addresses in the file, written out or not
+	flushed int64     // addresses above the last flush point
+	last    time.Time // of the last flush point
+	sync    bool
+	err     error // the first write error, returned by the next flush
+}
+
+// add appends ip, and writes a flush point when one is due.
+func (d *streamDump) add(ip uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return
+	}
+	d.buf = append(utils.AppendIPv4(d.buf[:0], ip), '\n')
+	if _, d.err = d.w.Write(d.buf); d.err != nil {
+		return
+	}
+	d.n++
+	// The clock is only read every 1024 addresses
+	if pending := d.n - d.flushed; pending >= DumpFlushEntries || (pending%1024 == 0 && time.Since(d.last) >= DumpFlushInterval) {
+		d.err = d.flushLocked()
+	}
+}
+
+// flush writes a flush point if anything was appended since the last,
+// and returns the first error the dump met.
+func (d *streamDump) flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil && d.n > d.flushed {
+		d.err = d.flushLocked()
+	}
+	return d.err
+}
+
+func (d *streamDump) flushLocked() error {
+	d.buf = strconv.AppendInt(append(d.buf[:0], dumpMark...), d.n, 10)
+	d.buf = append(d.buf, '\n')
+	if _, err := d.w.Write(d.buf); err != nil {
+		return err
+	}
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	if d.sync {
+		if err := d.f.Sync(); err != nil {
+			return err
+		}
+	}
+	d.flushed, d.last = d.n, time.Now()
+	return nil
+}
+
+// attachDump opens Options.StreamDump the first time the counter runs:
+// with ResumeDump, the addresses already in it are set first, like
+// Preload's, so runs append only the ones it lacks; otherwise it is
+// started afresh.
+func (b *BitsetCounter) attachDump() error {
+	if b.opts.StreamDump == "" || b.dump != nil {
+		return nil
+	}
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if b.opts.ResumeDump {
+		flags &^= os.O_TRUNC
+	}
+	f, err := os.OpenFile(b.opts.StreamDump, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("stream dump: %w", err)
+	}
+	d := &streamDump{f: f, sync: b.opts.Sync, last: time.Now()}
+	if b.opts.ResumeDump {
+		if d.n, err = b.resumeDump(f); err != nil {
+			f.Close()
+			return fmt.Errorf("stream dump %s: %w", b.opts.StreamDump, err)
+		}
+		d.flushed = d.n
+		b.opts.Stats.Set("resumed dump addresses", "%d", d.n)
+		b.log.Info("stream dump resumed", "dump", b.opts.StreamDump, "addresses", d.n)
+	}
+	d.w = bufio.NewWriterSize(f, 256*1024)
+	b.dump = d
+	return nil
+}
+
+// resumeDump sets the addresses of the dump f and leaves f at the end of
+// the last whole one, to append after. What a crash cut short is cut
+// off: a last line without its newline, and anything after the first
+// line that is neither an address nor a flush point, unless a flush
+// point follows it, in which case the file is not a dump or is damaged
+// where it was already written out. It returns the number of addresses.
+func (b *BitsetCounter) resumeDump(f *os.File) (int64, error) {
+	r := bufio.NewReaderSize(f, 256*1024)
+	var (
+		n, line   int64
+		end, keep int64 // end of the line read, and of the last one kept
+		badLine   int64 // the first line cut off, 0 for none
+	)
+	for {
+		raw, err := r.ReadSlice('\n')
+		long := err == bufio.ErrBufferFull // no line of a dump is this long
+		for err == bufio.ErrBufferFull {
+			end += int64(len(raw))
+			raw, err = r.ReadSlice('\n')
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		end += int64(len(raw))
+		line++
+		raw = bytes.TrimSuffix(raw, []byte{'\n'})
+		if long {
+			raw = nil
+		}
+		if mark, ok := bytes.CutPrefix(raw, []byte(dumpMark)); ok {
+			if v, err := strconv.ParseInt(string(mark), 10, 64); err == nil && v == n && badLine == 0 {
+				keep = end
+				continue
+			}
+			if badLine != 0 {
+				return 0, fmt.Errorf("line %d: not an address, above flush point %q at line %d", badLine, raw, line)
+			}
+			badLine = line
+			continue
+		}
+		if badLine != 0 {
+			continue
+		}
+		ip, err := utils.ParseIPv4(raw)
+		if err == nil && b.spaced && (ip < b.base || ip > b.base+b.spaceMax) {
+			err = ErrOutsideSpace
+		}
+		if err != nil {
+			badLine = line
+			continue
+		}
+		b.addListed(ip, ip)
+		n++
+		keep = end
+	}
+	if badLine != 0 {
+		b.log.Warn("stream dump cut short", "dump", b.opts.StreamDump, "line", badLine)
+	}
+	if err := f.Truncate(keep); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(keep, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// flushDump writes a flush point at the end of a run, interrupted or not,
+// so whatever it found is on disk.
+func (b *BitsetCounter) flushDump() error {
+	if b.dump == nil {
+		return nil
+	}
+	if err := b.dump.flush(); err != nil {
+		return fmt.Errorf("stream dump %s: %w", b.opts.StreamDump, err)
+	}
+	return nil
+}
+
+// closeDump flushes and closes the stream dump.
+func (b *BitsetCounter) closeDump() error {
+	if b.dump == nil {
+		return nil
+	}
+	err := b.flushDump()
+	if cerr := b.dump.f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("stream dump %s: %w", b.opts.StreamDump, cerr)
+	}
+	b.dump = nil
+	return err
+}
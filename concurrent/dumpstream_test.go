@@ -0,0 +1,108 @@
+package concurrent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A run canceled partway leaves a stream dump of what it found, ending in
+// a flush point; a resumed run over the same input, after a crash cut
+// the dump's last line short, appends only what the dump lacks, so the
+// dump holds every address of a clean run exactly once.
+func TestStreamDumpResume(t *testing.T) {
+	input, want := numaInput(200000)
+	path := filepath.Join(t.TempDir(), "dump.txt")
+	opts := Options{StreamDump: path, AddressSpace: numaSpace, ChunkSize: MinChunkSize,
+		Parse: utils.ParseOptions{CIDR: true}, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var found atomic.Int64
+	first := opts
+	first.OnNewIP = func(uint32) {
+		if found.Add(1) == 5000 {
+			cancel()
+		}
+	}
+	b := newCounter(t, first)
+	if _, err := b.CountReader(ctx, strings.NewReader(input)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled run: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ips, marks := readDump(t, path)
+	if len(ips) < 5000 || int64(len(ips)) >= want || marks[len(marks)-1] != len(ips) {
+		t.Fatalf("canceled run dumped %d of %d addresses, last flush point %d", len(ips), want, marks[len(marks)-1])
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("10.0.1.")
+	f.Close()
+
+	opts.ResumeDump = true
+	b = newCounter(t, opts)
+	n, err := b.CountReader(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resumed := len(ips)
+	ips, _ = readDump(t, path)
+	seen := make(map[uint32]bool)
+	for _, ip := range ips {
+		if seen[ip] {
+			t.Fatalf("%s dumped twice", utils.FormatIPv4(ip))
+		}
+		seen[ip] = true
+	}
+	if b.Count() != want || int64(len(seen)) != want || n != want-int64(resumed) {
+		t.Errorf("resumed: %d new, %d in the set, %d in the dump; want %d new, %d", n, b.Count(), len(seen), want-int64(resumed), want)
+	}
+}
+
+// readDump returns the addresses of a stream dump and the counts its
+// flush points record, checking each against the addresses above it.
+func readDump(t *testing.T, path string) (ips []uint32, marks []int) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if mark, ok := strings.CutPrefix(sc.Text(), dumpMark); ok {
+			if n, err := strconv.Atoi(mark); err != nil || n != len(ips) {
+				t.Fatalf("flush point %q below %d addresses", sc.Text(), len(ips))
+			}
+			marks = append(marks, len(ips))
+			continue
+		}
+		ip, err := utils.ParseIPv4(sc.Bytes())
+		if err != nil {
+			t.Fatalf("dump line %q: %v", sc.Text(), err)
+		}
+		ips = append(ips, ip)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ips, marks
+}
@@ -0,0 +1,99 @@
+package concurrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// errInjected is what failAfter fails with.
+var errInjected = errors.New("injected read error")
+
+// failAfter reads as endless does until n bytes are read, then fails.
+type failAfter struct {
+	n int
+}
+
+func (f *failAfter) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errInjected
+	}
+	n, _ := endless{}.Read(p[:min(len(p), f.n)])
+	f.n -= n
+	if n == 0 {
+		return 0, errInjected
+	}
+	return n, nil
+}
+
+// settled waits for the goroutine count to fall back to base and reports
+// whether it did.
+func settled(base int) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if runtime.NumGoroutine() <= base {
+			return true
+		}
+	}
+	return false
+}
+
+// A read error mid-input and a cancellation mid-run each return their
+// error and leave no goroutine of the run behind: producer, workers,
+// aggregator and reader alike, streaming, mapped or segmented.
+func TestNoLeaks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in.txt")
+	var b strings.Builder
+	for i := range 1 << 20 {
+		fmt.Fprintf(&b, "10.%d.%d.%d\n", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	base := runtime.NumGoroutine()
+
+	for _, tc := range []struct {
+		name string
+		run  func(ctx context.Context, c *BitsetCounter) (int64, error)
+		want error
+		stop time.Duration // canceled after this long
+	}{
+		{"read error", func(ctx context.Context, c *BitsetCounter) (int64, error) {
+			return c.CountReader(ctx, &failAfter{n: 5 << 20})
+		}, errInjected, time.Minute},
+		{"canceled stream", func(ctx context.Context, c *BitsetCounter) (int64, error) {
+			return c.CountReader(ctx, endless{})
+		}, context.DeadlineExceeded, 50 * time.Millisecond},
+		{"canceled file", func(ctx context.Context, c *BitsetCounter) (int64, error) {
+			for ctx.Err() == nil {
+				if _, err := c.CountUniqueIPsContext(ctx, path); err != nil {
+					return 0, err
+				}
+			}
+			return 0, ctx.Err()
+		}, context.DeadlineExceeded, 50 * time.Millisecond},
+	} {
+		for _, opts := range []Options{{}, {Mmap: true}, {Segmented: true}} {
+			opts.Workers, opts.Logger = 4, discard
+			ctx, cancel := context.WithTimeout(context.Background(), tc.stop)
+			_, err := tc.run(ctx, newCounter(t, opts))
+			cancel()
+			if !errors.Is(err, tc.want) {
+				t.Errorf("%s, mmap %v, segmented %v: %v, want %v", tc.name, opts.Mmap, opts.Segmented, err, tc.want)
+			}
+			if !settled(base) {
+				buf := make([]byte, 1<<20)
+				t.Fatalf("%s, mmap %v, segmented %v: %d goroutines left of %d before\n%s", tc.name, opts.Mmap, opts.Segmented,
+					runtime.NumGoroutine(), base, buf[:runtime.Stack(buf, true)])
+			}
+		}
+	}
+}
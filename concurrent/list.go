@@ -0,0 +1,120 @@
+package concurrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// LoadList adds the addresses of r, a list such as an allowlist or the
+// addresses already seen, to the set before a run, so the run counts
+// only the ones new to it. Lines are parsed as the run parses them, with
+// Options.Parse, blank and comment lines skipped, but the list is
+// presumed curated: a line that fails to parse, is longer than
+// Options.MaxLine or falls outside Options.AddressSpace is an error, and
+// the set may then hold part of the list. It returns how many distinct addresses the list added.
+func (b *BitsetCounter) LoadList(r io.Reader) (int64, error) {
+	if err := b.attachBacking(); err != nil {
+		return 0, err
+	}
+	// Parse the list as the input but keep it out of the run's line,
+	// comment and cleanup counts
+	parse := b.opts.Parse
+	parse.Lines, parse.Comments = nil, nil
+	if parse.Relaxed != nil {
+		parse.Relaxed = new(utils.Normalized)
+	}
+	cr := utils.NewDelimChunkReader(r, DefaultChunkSize, b.maxLine, b.delim)
+	var added, lines int64
+	for {
+		ch, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		for data := ch.Data; len(data) > 0; {
+			var raw []byte
+			raw, data = utils.NextRecord(data, b.delim)
+			lines++
+			if len(raw) > b.maxLine {
+				return 0, fmt.Errorf("line %d: longer than %d bytes", lines, b.maxLine)
+			}
+			line := parse.Trim(raw)
+			if len(line) == 0 {
+				continue
+			}
+			first, last, err := parse.ParseBlock(line)
+			if utils.Ignored(err) {
+				continue
+			}
+			if err == nil && b.spaced && (first < b.base || last > b.base+b.spaceMax) {
+				err = ErrOutsideSpace
+			}
+			if err != nil {
+				return 0, fmt.Errorf("line %d: %q: %w", lines, line, err)
+			}
+			added += b.addListed(first, last)
+		}
+		cr.Release(ch)
+		if cr.Oversized() > 0 {
+			return 0, fmt.Errorf("after line %d: a line longer than %d bytes", lines, b.maxLine)
+		}
+	}
+	if b.overBudget.Load() {
+		return 0, b.budgetErr()
+	}
+	return added, nil
+}
+
+// addListed adds the addresses [first, last] of a list line, offset into
+// Options.AddressSpace or hashed with Options.Hash. It sets the bits directly, so OnNewIP and NewIPs
+// only hear of the addresses runs add.
+func (b *BitsetCounter) addListed(first, last uint32) int64 {
+	var added int64
+	for ip := first; ; ip++ {
+		h := ip - b.base
+		if b.opts.Hash != nil {
+			h = b.opts.Hash(ip)
+		}
+		if b.setBit(&b.shards[h&b.shardMask], h>>b.shardShift) {
+			added++
+		}
+		if ip == last {
+			return added
+		}
+	}
+}
+
+// LoadListFile is LoadList reading the file at path.
+func (b *BitsetCounter) LoadListFile(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, &counter.OpenError{Path: path, Err: err}
+	}
+	defer f.Close()
+	n, err := b.LoadList(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
+
+// attachPreload loads Options.Preload the first time the counter runs.
+func (b *BitsetCounter) attachPreload() error {
+	if b.opts.Preload == "" || b.preloaded {
+		return nil
+	}
+	n, err := b.LoadListFile(b.opts.Preload)
+	if err != nil {
+		return fmt.Errorf("preload %w", err)
+	}
+	b.preloaded = true
+	b.opts.Stats.Set("preloaded addresses", "%d", n)
+	b.log.Info("preloaded", "list", b.opts.Preload, "addresses", n)
+	return nil
+}
@@ -0,0 +1,175 @@
+package concurrent
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// BitsetMode selects how workers record IPs
+type BitsetMode int
+
+const (
+	BitsetAuto   BitsetMode = iota // local with localMinWorkers or more workers, shared otherwise
+	BitsetShared                   // all workers set bits in the shared bitset atomically
+	BitsetLocal                    // each worker fills a private bitset, OR-merged at the end
+)
+
+// localMinWorkers is where cross-core contention on shared words starts
+// to cost more than the extra memory of private bitsets
+const localMinWorkers = 8
+
+// ParseBitsetMode maps a -bitset flag value to a BitsetMode
+func ParseBitsetMode(s string) (BitsetMode, error) {
+	switch s {
+	case "", "auto":
+		return BitsetAuto, nil
+	case "shared":
+		return BitsetShared, nil
+	case "local":
+		return BitsetLocal, nil
+	}
+	return 0, fmt.Errorf("unknown bitset mode: %s", s)
+}
+
+// useLocal reports whether a run with numWorkers workers uses local bitsets
+func (b *BitsetCounter) useLocal(numWorkers int) bool {
+	switch b.opts.Bitset {
+	case BitsetLocal:
+		return true
+	case BitsetShared:
+		return false
+	}
+	return numWorkers >= localMinWorkers && !b.capped && b.onNew == nil && b.opts.OnNewIPFrom == nil && !b.opts.Checkpoint.Metered() && b.opts.Record == ""
+}
+
+// localSet is one worker's private sharded bitset. It uses the same shard
+// layout as BitsetCounter but plain stores, since only its owner writes it.
+// Memory is up to one full bitset per worker for inputs touching every
+// shard, in exchange for zero synchronization on the hot path.
+type localSet struct {
+	shards     [][]uint64
+	shardMask  uint32
+	shardShift uint
+	wordsPer   int
+}
+
+func (b *BitsetCounter) newLocalSet() *localSet {
+	return &localSet{
+		shards:     make([][]uint64, len(b.shards)),
+		shardMask:  b.shardMask,
+		shardShift: b.shardShift,
+		wordsPer:   b.wordsPerShard,
+	}
+}
+
+func (l *localSet) add(ip uint32) {
+	words := l.shards[ip&l.shardMask]
+	if words == nil {
+		words = make([]uint64, l.wordsPer)
+		l.shards[ip&l.shardMask] = words
+	}
+	offset := ip >> l.shardShift
+	words[offset/64] |= uint64(1) << (offset % 64)
+}
+
+// take returns the words of shard i, nil if it was never written, and
+// lets go of them.
+func (l *localSet) take(i int) []uint64 {
+	words := l.shards[i]
+	l.shards[i] = nil
+	return words
+}
+
+// privateSet is a set workers add to instead of the shared bitset, ORed
+// into it by mergeLocal once the run is done.
+type privateSet interface {
+	take(i int) []uint64
+}
+
+// workerSets are the private sets of a run's workers: one per worker in
+// local mode, one per group of workers with Options.NUMAGroups. A nil
+// *workerSets is shared mode.
+type workerSets struct {
+	locals  []*localSet // by worker, nil in group mode
+	groups  []*groupSet // nil in local mode
+	workers int
+	cpus    [][]int // CPUs to pin each group's workers to, nil to not pin
+}
+
+// newLocalSets returns the private sets of a run of numWorkers workers,
+// or nil in shared mode.
+func (b *BitsetCounter) newLocalSets(numWorkers int) *workerSets {
+	if groups := b.numaGroups(numWorkers); groups > 1 {
+		ws := &workerSets{groups: make([]*groupSet, groups), workers: numWorkers}
+		for g := range ws.groups {
+			ws.groups[g] = b.newGroupSet()
+		}
+		if nodes := numaNodes(); len(nodes) == groups && b.opts.Job == nil {
+			ws.cpus = nodes
+		}
+		return ws
+	}
+	if !b.useLocal(numWorkers) {
+		return nil
+	}
+	ws := &workerSets{locals: make([]*localSet, numWorkers), workers: numWorkers}
+	for i := range ws.locals {
+		ws.locals[i] = b.newLocalSet()
+	}
+	return ws
+}
+
+// sets returns every private set once.
+func (ws *workerSets) sets() []privateSet {
+	var sets []privateSet
+	for _, l := range ws.locals {
+		sets = append(sets, l)
+	}
+	for _, g := range ws.groups {
+		sets = append(sets, g)
+	}
+	return sets
+}
+
+// mergeLocal ORs every private set into the shared bitset and returns
+// the number of bits that were new, passing their addresses to note.
+// Shards are split across goroutines, so each shared word has exactly
+// one merging writer.
+func (b *BitsetCounter) mergeLocal(ws *workerSets, note func(ip uint32)) int64 {
+	sets := ws.sets()
+	mergers := workerCount(b.opts)
+	var total atomic.Int64
+	var wg sync.WaitGroup
+	for m := 0; m < mergers; m++ {
+		wg.Add(1)
+		go func(m int) {
+			defer wg.Done()
+			var added int64
+			for i := m; i < len(b.shards); i += mergers {
+				for _, l := range sets {
+					words := l.take(i) // release as we go
+					if words == nil {
+						continue
+					}
+					shared := b.shards[i].ensure(b.newWords)
+					var shardAdded int64
+					for w, nw := range words {
+						if nw == 0 {
+							continue
+						}
+						old := atomic.OrUint64(&shared[w], nw)
+						shardAdded += int64(bits.OnesCount64(nw &^ old))
+						b.notifyWord(i, w, nw&^old, note)
+					}
+					b.shards[i].count.Add(shardAdded)
+					added += shardAdded
+				}
+			}
+			total.Add(added)
+		}(m)
+	}
+	wg.Wait()
+	return total.Load()
+}
@@ -0,0 +1,48 @@
+package concurrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// BenchmarkBitsets counts an input where nine lines in ten repeat an
+// address already seen, so the shared bitset's workers keep setting the
+// same words, against local bitsets merged at the end, each with 8
+// workers.
+func BenchmarkBitsets(b *testing.B) {
+	const lines = 1 << 20
+	rng := rand.New(rand.NewPCG(319, 320))
+	hot := make([]uint32, lines/10)
+	for i := range hot {
+		hot[i] = 10<<24 | rng.Uint32N(1<<20)
+	}
+	var sb strings.Builder
+	for range lines {
+		fmt.Fprintf(&sb, "%s\n", utils.FormatIPv4(hot[rng.IntN(len(hot))]))
+	}
+	input := sb.String()
+	for _, bc := range []struct {
+		name string
+		mode BitsetMode
+	}{{"shared", BitsetShared}, {"local", BitsetLocal}} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := newCounter(b, Options{Workers: 8, Bitset: bc.mode, AddressSpace: netip.MustParsePrefix("10.0.0.0/12"),
+				Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+			b.SetBytes(int64(len(input)))
+			for range b.N {
+				c.Reset()
+				if _, err := c.CountReader(context.Background(), strings.NewReader(input)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
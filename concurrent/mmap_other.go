@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package concurrent
+
+import "os"
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) {}
@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package concurrent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errMmapUnsupported // larger than the address space
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	adviseSequential(data)
+	return data, nil
+}
+
+func munmapFile(data []byte) {
+	syscall.Munmap(data)
+}
@@ -0,0 +1,71 @@
+package concurrent
+
+import (
+	"math/bits"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// NewIPsBuffer is the capacity of the channel NewIPs returns.
+const NewIPsBuffer = 4096
+
+// NewIPs returns a channel that receives every address the counter's next
+// run sets for the first time, as Options.OnNewIP would, and is closed
+// when that run returns. Call it before the run. Once NewIPsBuffer
+// addresses are waiting, the worker that found the next one blocks until
+// the reader catches up, so a slow reader slows the count rather than
+// losing addresses; read until the channel is closed, even after
+// canceling the run.
+func (b *BitsetCounter) NewIPs() <-chan uint32 {
+	ch := make(chan uint32, NewIPsBuffer)
+	prev := b.opts.OnNewIP
+	b.newIPs = ch
+	b.onNew = func(ip uint32) {
+		if prev != nil {
+			prev(ip)
+		}
+		ch <- ip
+	}
+	return ch
+}
+
+// endRun closes the NewIPs channel, if any, and passes err through.
+func (b *BitsetCounter) endRun(err error) error {
+	b.stopWatchdog()
+	if b.newIPs != nil {
+		close(b.newIPs)
+		b.newIPs, b.onNew = nil, b.opts.OnNewIP
+	}
+	return err
+}
+
+// notifyWord reports the bits in newBits, just set in word w of shard s,
+// to note, the OnNewIP callback or a run's noteFor.
+func (b *BitsetCounter) notifyWord(s, w int, newBits uint64, note func(ip uint32)) {
+	if note == nil {
+		return
+	}
+	for newBits != 0 {
+		bit := bits.TrailingZeros64(newBits)
+		newBits &= newBits - 1
+		offset := uint32(w*64 + bit)
+		note(b.base + (offset<<b.shardShift | uint32(s)))
+	}
+}
+
+// noteFor returns what gets the addresses a run finds new in *src: the
+// OnNewIP callback and NewIPs channel, and OnNewIPFrom with the source
+// *src holds when it is called. Without OnNewIPFrom it is just the former.
+func (b *BitsetCounter) noteFor(src *counter.Source) func(ip uint32) {
+	from := b.opts.OnNewIPFrom
+	if from == nil {
+		return b.onNew
+	}
+	onNew := b.onNew
+	return func(ip uint32) {
+		if onNew != nil {
+			onNew(ip)
+		}
+		from(ip, *src)
+	}
+}
@@ -0,0 +1,125 @@
+package concurrent
+
+import (
+	"sync/atomic"
+)
+
+// NUMAAuto as Options.NUMAGroups makes one group per NUMA node of the
+// host, and none on a host of one node or where the nodes are unknown.
+const NUMAAuto = -1
+
+// numaGroups returns how many groups the workers of a run of numWorkers
+// split into, 1 for none. Group sets, like local ones, only find new
+// addresses when they are merged, so runs that need them as they are set
+// stay with the shared bitset.
+func (b *BitsetCounter) numaGroups(numWorkers int) int {
+	groups := b.opts.NUMAGroups
+	if groups == NUMAAuto {
+		groups = len(numaNodes())
+	}
+	groups = min(groups, numWorkers)
+	if groups <= 1 || b.onNew != nil || b.opts.OnNewIPFrom != nil {
+		return 1
+	}
+	return groups
+}
+
+// groupSet is the private sharded bitset of one group of workers. Its
+// workers write it at once, with atomics like the shared bitset, but its
+// words are only ever in the caches of the group's node, whereas the
+// shared bitset's bounce between sockets.
+type groupSet struct {
+	shards     []atomic.Pointer[[]uint64]
+	shardMask  uint32
+	shardShift uint
+	wordsPer   int
+}
+
+func (b *BitsetCounter) newGroupSet() *groupSet {
+	return &groupSet{
+		shards:     make([]atomic.Pointer[[]uint64], len(b.shards)),
+		shardMask:  b.shardMask,
+		shardShift: b.shardShift,
+		wordsPer:   b.wordsPerShard,
+	}
+}
+
+// words returns shard s's words, allocating them on first use. Racing
+// workers agree on whichever slice is published first.
+func (g *groupSet) words(s uint32) []uint64 {
+	if p := g.shards[s].Load(); p != nil {
+		return *p
+	}
+	words := make([]uint64, g.wordsPer)
+	if g.shards[s].CompareAndSwap(nil, &words) {
+		return words
+	}
+	return *g.shards[s].Load()
+}
+
+func (g *groupSet) add(ip uint32) {
+	words := g.words(ip & g.shardMask)
+	offset := ip >> g.shardShift
+	word, bit := &words[offset/64], uint64(1)<<(offset%64)
+	// A repeat only reads the line, which stays shared among the group
+	if atomic.LoadUint64(word)&bit == 0 {
+		atomic.OrUint64(word, bit)
+	}
+}
+
+// addRange sets the bits of the addresses [first, last], whole words at a
+// time where a shard's span covers them.
+func (g *groupSet) addRange(first, last uint32) {
+	splitRange(first, last, g.shardShift, g.add, func(s int, lo, hi uint32) {
+		words := g.words(uint32(s))
+		fillWords(lo, hi, func(w int, mask uint64) { atomic.OrUint64(&words[w], mask) })
+	})
+}
+
+// take returns the words of shard i, nil if it was never written, and
+// lets go of them.
+func (g *groupSet) take(i int) []uint64 {
+	if p := g.shards[i].Swap(nil); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// assign gives worker i its private set: its own in local mode, its
+// group's in group mode, where consecutive workers share a group.
+func (ws *workerSets) assign(w *worker, i int) {
+	if ws == nil {
+		return
+	}
+	if ws.locals != nil {
+		w.local = ws.locals[i]
+		return
+	}
+	g := i * len(ws.groups) / ws.workers
+	w.group = ws.groups[g]
+	if ws.cpus != nil {
+		w.cpus = ws.cpus[g]
+	}
+}
+
+// numGroups returns the number of worker groups, 0 outside group mode.
+func (ws *workerSets) numGroups() int {
+	if ws == nil {
+		return 0
+	}
+	return len(ws.groups)
+}
+
+// pin binds the calling goroutine, on its first call, to the CPUs of the
+// worker's node. The goroutine then keeps its thread, which ends with it,
+// so the binding never reaches other goroutines. A failure only leaves
+// the worker unpinned.
+func (w *worker) pin() {
+	if w.cpus == nil {
+		return
+	}
+	if err := pinThread(w.cpus); err != nil {
+		w.b.log.Debug("concurrent worker not pinned", "err", err)
+	}
+	w.cpus = nil
+}
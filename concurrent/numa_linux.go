@@ -0,0 +1,85 @@
+package concurrent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// numaNodes returns the CPUs of each NUMA node of the host, from sysfs,
+// or nil on a host of one node or where sysfs does not say.
+func numaNodes() [][]int {
+	dirs, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if len(dirs) < 2 {
+		return nil
+	}
+	slices.SortFunc(dirs, func(a, b string) int { return nodeNumber(a) - nodeNumber(b) })
+	var nodes [][]int
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil
+		}
+		if cpus := parseCPUList(strings.TrimSpace(string(data))); len(cpus) > 0 {
+			nodes = append(nodes, cpus) // a node of memory alone has none
+		}
+	}
+	if len(nodes) < 2 {
+		return nil
+	}
+	return nodes
+}
+
+// nodeNumber returns N of a sysfs nodeN directory.
+func nodeNumber(dir string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+	return n
+}
+
+// parseCPUList reads a kernel CPU list such as "0-23,48-71", nil if it
+// is not one.
+func parseCPUList(s string) []int {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
+
+// pinThread locks the calling goroutine to its thread, for good, and
+// binds the thread to cpus.
+func pinThread(cpus []int) error {
+	var mask [1024 / 64]uint64
+	for _, cpu := range cpus {
+		if cpu < len(mask)*64 {
+			mask[cpu/64] |= 1 << (cpu % 64)
+		}
+	}
+	runtime.LockOSThread()
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package concurrent
+
+import "errors"
+
+// numaNodes returns nil: only Linux tells the NUMA nodes apart here.
+func numaNodes() [][]int {
+	return nil
+}
+
+func pinThread(cpus []int) error {
+	return errors.New("CPU pinning needs Linux")
+}
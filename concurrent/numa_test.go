@@ -0,0 +1,95 @@
+package concurrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// numaSpace is the block numaInput draws from, so a set of each group
+// stays small.
+var numaSpace = netip.MustParsePrefix("10.0.0.0/14")
+
+// numaInput returns lines of addresses from the four /16s of numaSpace, with repeats and
+// CIDR blocks, and the number of distinct addresses they hold.
+func numaInput(lines int) (string, int64) {
+	rng := rand.New(rand.NewPCG(21, 22))
+	var b strings.Builder
+	seen := make(map[uint32]bool)
+	for range lines {
+		ip := uint32(rng.IntN(4))<<16 | 10<<24 | rng.Uint32N(1<<16)
+		if rng.IntN(200) == 0 {
+			ip &^= 0xff
+			fmt.Fprintf(&b, "%s/24\n", utils.FormatIPv4(ip))
+			for i := range uint32(256) {
+				seen[ip+i] = true
+			}
+			continue
+		}
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	return b.String(), int64(len(seen))
+}
+
+// Workers split into NUMA groups count exactly what one group does,
+// whatever the number of groups and workers, single addresses and blocks
+// alike, and the merged set holds every address.
+func TestNUMAGroups(t *testing.T) {
+	input, want := numaInput(100000)
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, groups := range []int{1, 2, 3, 4} {
+		for _, workers := range []int{2, 5, 8} {
+			b := newCounter(t, Options{NUMAGroups: groups, Shards: 1024, AddressSpace: numaSpace, Parse: utils.ParseOptions{CIDR: true}, Logger: discard})
+			b.resetRun()
+			n, err := b.countStream(context.Background(), strings.NewReader(input), workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != want || b.Count() != want {
+				t.Errorf("%d groups of %d workers: %d new, %d in the set; want %d", groups, workers, n, b.Count(), want)
+			}
+			wantGroups := min(groups, workers)
+			if wantGroups == 1 {
+				wantGroups = 0
+			}
+			if got := b.newLocalSets(workers).numGroups(); got != wantGroups {
+				t.Errorf("%d groups of %d workers: %d group sets, want %d", groups, workers, got, wantGroups)
+			}
+		}
+	}
+
+	for _, o := range []Options{{NUMAGroups: 2, Bitset: BitsetLocal}, {NUMAGroups: 2, MaxMem: 1 << 30}, {NUMAGroups: -2}} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v passed Validate", o)
+		}
+	}
+}
+
+// Workers as many as GOMAXPROCS, in one group or several; on a host of
+// many cores over several sockets the groups contend less.
+func BenchmarkNUMAGroups(b *testing.B) {
+	input, _ := numaInput(1 << 20)
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	workers := runtime.GOMAXPROCS(0)
+	for _, groups := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("groups=%d", groups), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for range b.N {
+				c := newCounter(b, Options{NUMAGroups: groups, Bitset: BitsetShared, Shards: 1024, AddressSpace: numaSpace, Parse: utils.ParseOptions{CIDR: true}, Logger: discard})
+				c.resetRun()
+				if _, err := c.countStream(context.Background(), strings.NewReader(input), workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package concurrent
+
+import (
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// worker is one worker goroutine's state for a run: its private set in
+// local mode or its group's with Options.NUMAGroups, both nil in shared
+// mode, and while Stats are collected the first address it parsed and the
+// last one it found new in the piece of input at hand.
+type worker struct {
+	b      *BitsetCounter
+	local  *localSet
+	group  *groupSet
+	cpus   []int // to pin the worker's goroutine to, nil once pinned or not pinning
+	track  bool
+	parsed bool   // first holds an address
+	first  uint32 // first address parsed
+	found  bool   // last holds an address
+	last   uint32 // last address found new
+
+	src  counter.Source  // where the addresses being added came from
+	note func(ip uint32) // gets the addresses found new, nil for none
+}
+
+// newWorker returns the state of worker i, with its private set from
+// sets, nil in shared mode. Addresses are only tracked for Stats and
+// without Hash, whose values are not addresses.
+func (b *BitsetCounter) newWorker(sets *workerSets, i int) *worker {
+	w := &worker{b: b, track: b.opts.Stats != nil && b.opts.Hash == nil, src: b.runSrc}
+	sets.assign(w, i)
+	w.note = b.noteFor(&w.src)
+	return w
+}
+
+// SetSource makes the addresses added next count as coming from src.
+func (w *worker) SetSource(src counter.Source) {
+	w.src = src
+}
+
+// Add adds ip for the pipeline, noting it as the first address of the
+// piece when the set can hold it. In local and group mode new addresses
+// are only found when merging, so it then reports false.
+func (w *worker) Add(ip uint32) bool {
+	if b := w.b; !b.spaced || ip-b.base <= b.spaceMax {
+		w.parsedIP(ip)
+	}
+	return w.b.addIP(ip, w) == 1
+}
+
+// AddRange adds the addresses [first, last] of a CIDR line.
+func (w *worker) AddRange(first, last uint32) int64 {
+	w.parsedIP(first)
+	return w.b.addBlock(first, last, w)
+}
+
+// ChunkDone folds the chunk numbered seq into the run's order and
+// checkpoint, and pins the worker once it is running.
+func (w *worker) ChunkDone(data []byte, seq int64) error {
+	w.pin()
+	w.b.record(seq, w)
+	w.b.checkpoint(data)
+	return nil
+}
+
+// parsedIP notes ip, just parsed, as the first of the piece if none was.
+func (w *worker) parsedIP(ip uint32) {
+	if w.track && !w.parsed {
+		w.parsed, w.first = true, ip
+	}
+}
+
+// newIP notes ip, just found new, as the last of the piece so far.
+func (w *worker) newIP(ip uint32) {
+	if w.track {
+		w.found, w.last = true, ip
+	}
+}
+
+// inputOrder collects the first and last addresses of the pieces workers
+// finish. Producers number pieces in the order they read them, so the
+// first of the lowest-numbered piece and the last of the highest-numbered
+// one win whatever order workers finish in.
+type inputOrder struct {
+	mu                sync.Mutex
+	hasFirst, hasLast bool
+	firstSeq, lastSeq int64
+	first, last       uint32
+}
+
+// record folds w's piece number seq into b.order and clears w for the
+// next piece.
+func (b *BitsetCounter) record(seq int64, w *worker) {
+	if !w.track || (!w.parsed && !w.found) {
+		return
+	}
+	o := &b.order
+	o.mu.Lock()
+	if w.parsed && (!o.hasFirst || seq < o.firstSeq) {
+		o.hasFirst, o.firstSeq, o.first = true, seq, w.first
+	}
+	if w.found && (!o.hasLast || seq > o.lastSeq) {
+		o.hasLast, o.lastSeq, o.last = true, seq, w.last
+	}
+	o.mu.Unlock()
+	w.parsed, w.found = false, false
+}
+
+// resetOrder forgets the addresses of the previous run.
+func (b *BitsetCounter) resetOrder() {
+	o := &b.order
+	o.mu.Lock()
+	o.hasFirst, o.hasLast = false, false
+	o.mu.Unlock()
+}
+
+// reportExtremes sets the smallest and largest addresses in the set and
+// the first and last ones of the input in Stats.
+//
+// Min and max come from a walk of the shards and are exact. The first
+// address is the first one parsed from the earliest piece of input, which
+// is always new, so it is exact too. With a StateFile the set and "new"
+// cover every earlier run, so these three are left out. The last new address is
+// the last one a worker found new in the latest piece that had one: when
+// an address and its repeat land in pieces processed at the same time,
+// the later piece may set its bit first and claim it, so unlike the
+// sequential engines it can differ from run to run, and for a CIDR block
+// it is the block's last address. Local bitsets only find new addresses
+// when merging, so then it is not reported.
+func (b *BitsetCounter) reportExtremes() {
+	if b.opts.Stats == nil || b.opts.Hash != nil {
+		return
+	}
+	state := b.opts.StateFile != ""
+	if lo, hi, ok := b.Bounds(); ok && !state {
+		b.opts.Stats.Set("min ip", "%s", utils.FormatIPv4(lo))
+		b.opts.Stats.Set("max ip", "%s", utils.FormatIPv4(hi))
+	}
+	o := &b.order
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.hasFirst && !state {
+		b.opts.Stats.Set("first new ip", "%s", utils.FormatIPv4(o.first))
+	}
+	if o.hasLast {
+		b.opts.Stats.Set("last new ip", "%s", utils.FormatIPv4(o.last))
+	}
+}
@@ -0,0 +1,139 @@
+package concurrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// stringInput is an input reading s.
+func stringInput(name, s string) counter.Input {
+	return counter.Input{Name: name, Size: int64(len(s)), Open: func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(s)), nil
+	}}
+}
+
+// Two hundred small counts at once on one pool each get their own count,
+// though the pool's cap only lets a few hold memory at a time; a count
+// that could never fit fails, and one canceled while it waits stops.
+func TestPoolCounts(t *testing.T) {
+	pool := counter.NewPool(counter.PoolOptions{Workers: 4, MaxMem: 48 << 20})
+	defer pool.Close()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	const counts = 200
+	inputs := make([]string, counts)
+	want := make([]int64, counts)
+	for i := range counts {
+		rng := rand.New(rand.NewPCG(uint64(i), 1))
+		var b strings.Builder
+		seen := make(map[uint32]bool)
+		for range 1 + rng.IntN(400) {
+			ip := 10<<24 | rng.Uint32N(1<<12)
+			seen[ip] = true
+			fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+			if rng.IntN(50) == 0 {
+				b.WriteString("not an address\n")
+			}
+		}
+		inputs[i], want[i] = b.String(), int64(len(seen))
+	}
+	var wg sync.WaitGroup
+	for i := range counts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := pool.Count(context.Background(), stringInput(fmt.Sprint(i), inputs[i]), counter.Options{Logger: discard})
+			if err != nil || n != want[i] {
+				t.Errorf("count %d: %d, %v; want %d", i, n, err, want[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	huge := counter.Input{Name: "huge", Size: 1 << 40, Open: func() (io.ReadCloser, error) { panic("opened") }}
+	if _, err := pool.Count(context.Background(), huge, counter.Options{}); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("a count over the cap: %v, want ErrMemBudget", err)
+	}
+	// Nothing is left reserved, so a count that could touch 1126 shards
+	// of 32 KB, most of the cap, gets it at once
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n, err := pool.Count(ctx, stringInput("last", "1.2.3.4\n"+strings.Repeat("\n", 9000)), counter.Options{Logger: discard})
+	if err != nil || n != 1 {
+		t.Errorf("last count: %d, %v; want 1", n, err)
+	}
+
+	// A count waiting for memory gives up with its ctx
+	small := counter.NewPool(counter.PoolOptions{Workers: 1, MaxMem: 2 << 20})
+	defer small.Close()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	block := counter.Input{Name: "block", Size: 0, Open: func() (io.ReadCloser, error) {
+		close(started)
+		<-release
+		return io.NopCloser(strings.NewReader("")), nil
+	}}
+	go func() {
+		defer close(release)
+		<-started
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := small.Count(ctx, stringInput("waits", ""), counter.Options{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("a canceled count waiting for memory: %v", err)
+		}
+	}()
+	if _, err := small.Count(context.Background(), block, counter.Options{Logger: discard}); err != nil {
+		t.Error(err)
+	}
+}
+
+// On a pool of one worker, a small count started after a huge one is
+// still being read finishes first.
+func TestPoolFairness(t *testing.T) {
+	pool := counter.NewPool(counter.PoolOptions{Workers: 1})
+	defer pool.Close()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var b strings.Builder
+	rng := rand.New(rand.NewPCG(1, 2))
+	for b.Len() < 8<<20 {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(10<<24|rng.Uint32N(1<<16)))
+	}
+	opened := make(chan struct{})
+	big := stringInput("huge", b.String())
+	open := big.Open
+	big.Open = func() (io.ReadCloser, error) {
+		close(opened)
+		return open()
+	}
+	var hugeDone atomic.Bool
+	errc := make(chan error, 1)
+	go func() {
+		_, err := pool.Count(context.Background(), big, counter.Options{Logger: discard})
+		hugeDone.Store(true)
+		errc <- err
+	}()
+	<-opened
+	n, err := pool.Count(context.Background(), stringInput("small", "1.2.3.4\n5.6.7.8\n1.2.3.4\n"), counter.Options{Logger: discard})
+	if err != nil || n != 2 {
+		t.Errorf("small count: %d, %v; want 2", n, err)
+	}
+	if hugeDone.Load() {
+		t.Error("the huge count finished before the small one")
+	}
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,117 @@
+package concurrent
+
+import (
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// PrefixCounts returns how many distinct prefixes of each length in
+// Options.PrefixSweep the set holds. /32 is Count; the shorter lengths
+// come from one walk over the allocated shards that masks every set bit
+// down to its prefix in a bitset of 2^length bits (2 MB for /24, 8 KB for
+// /16). Like Range it only sees a point-in-time view while writers are
+// active.
+func (b *BitsetCounter) PrefixCounts() []counter.PrefixCount {
+	out := make([]counter.PrefixCount, len(b.opts.PrefixSweep))
+	sets := make([][]uint64, len(out))
+	for k, n := range b.opts.PrefixSweep {
+		out[k].Length = n
+		if n < 32 {
+			sets[k] = make([]uint64, max(1, (1<<n)/64))
+		}
+	}
+	live, liveWords := b.liveShards()
+	for k, words := range liveWords {
+		s := uint32(live[k])
+		for w := range words {
+			x := atomic.LoadUint64(&words[w])
+			if x == 0 {
+				continue
+			}
+			for j, set := range sets {
+				if set != nil {
+					b.markPrefixes(set, uint(out[j].Length), s, w, x)
+				}
+			}
+		}
+	}
+	for k := range out {
+		if sets[k] == nil {
+			out[k].Unique = b.Count()
+		} else {
+			out[k].Unique = popcount(sets[k])
+		}
+	}
+	return out
+}
+
+// markPrefixes sets in set the /n prefix of every address in word w of
+// shard s, whose set bits are x. A shard holds every address with its low
+// shardShift bits equal to s, bit j of word w being offset w*64+j above
+// them. When the bits below the prefix include the shard bits, the prefix
+// is the offset shifted right, so a word is folded into blocks that each
+// give one prefix; otherwise every address has its own.
+func (b *BitsetCounter) markPrefixes(set []uint64, n uint, s uint32, w int, x uint64) {
+	host := 32 - n
+	base := uint64(w) * 64
+	if host < b.shardShift {
+		for ; x != 0; x &= x - 1 {
+			offset := base + uint64(bits.TrailingZeros64(x))
+			setBit(set, offset<<(b.shardShift-host)|uint64(s>>host))
+		}
+		return
+	}
+	block := host - b.shardShift // offset bits below the prefix
+	if block >= 6 {
+		setBit(set, base>>block)
+		return
+	}
+	// Fold each block of 2^block bits into its lowest bit
+	for sh := uint(1); sh < 1<<block; sh <<= 1 {
+		x |= x >> sh
+	}
+	x &= ^uint64(0) / (1<<(1<<block) - 1)
+	for ; x != 0; x &= x - 1 {
+		setBit(set, (base+uint64(bits.TrailingZeros64(x)))>>block)
+	}
+}
+
+// setBit sets bit i of an unshared bitset.
+func setBit(set []uint64, i uint64) {
+	set[i/64] |= 1 << (i % 64)
+}
+
+// Density returns how many addresses of every /24 the set holds, indexed
+// by the block's top 24 bits, from one walk over the allocated shards:
+// whole words are popcounted when a word falls within one /24, as it does
+// with 4 shards or fewer, and otherwise each address is tallied. Like
+// Range it only sees a point-in-time view while writers are active.
+func (b *BitsetCounter) Density() []uint16 {
+	d := make([]uint16, counter.Slash24s)
+	live, liveWords := b.liveShards()
+	for k, words := range liveWords {
+		s := uint64(live[k])
+		for w := range words {
+			x := atomic.LoadUint64(&words[w])
+			if x == 0 {
+				continue
+			}
+			base := uint64(w) * 64
+			switch {
+			case b.shardShift > 8:
+				for ; x != 0; x &= x - 1 {
+					d[(base+uint64(bits.TrailingZeros64(x)))<<(b.shardShift-8)|s>>8]++
+				}
+			case 8-b.shardShift >= 6:
+				d[base>>(8-b.shardShift)] += uint16(bits.OnesCount64(x))
+			default:
+				for ; x != 0; x &= x - 1 {
+					d[(base+uint64(bits.TrailingZeros64(x)))>>(8-b.shardShift)]++
+				}
+			}
+		}
+	}
+	return d
+}
@@ -0,0 +1,98 @@
+package concurrent
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// Range calls fn for every IP in the set in ascending order, stopping early
+// if fn returns false. IPs are sharded by ip % shards, so ascending order
+// walks word index w across all shards before moving to w+1: within a word,
+// bit j of shard s is ip (w*64+j)*shards + s.
+// Range may run alongside writers but then only sees a point-in-time view
+// of each word.
+func (b *BitsetCounter) Range(fn func(ip uint32) bool) {
+	live, liveWords := b.liveShards()
+	if len(live) == 0 {
+		return
+	}
+
+	cur := make([]uint64, len(live))
+	for w := uint64(0); w < uint64(b.wordsPerShard); w++ {
+		nonzero := false
+		for k, words := range liveWords {
+			cur[k] = atomic.LoadUint64(&words[w])
+			if cur[k] != 0 {
+				nonzero = true
+			}
+		}
+		if !nonzero {
+			continue
+		}
+		for bit := uint64(0); bit < 64; bit++ {
+			mask := uint64(1) << bit
+			base := (w*64 + bit) << b.shardShift
+			for k, i := range live {
+				if cur[k]&mask == 0 {
+					continue
+				}
+				ip := base + uint64(i)
+				if ip >= space(b.opts.Bits) {
+					return
+				}
+				if !fn(b.base + uint32(ip)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Bounds returns the smallest and largest IPs in the set, and false when
+// it is empty. It walks word indexes in from both ends across the
+// allocated shards and stops at the first nonzero one each way: every
+// bit of word w sorts before every bit of word w+1 in any shard. Like
+// Range it only sees a point-in-time view while writers are active.
+func (b *BitsetCounter) Bounds() (lo, hi uint32, ok bool) {
+	live, liveWords := b.liveShards()
+	for w := 0; w < b.wordsPerShard && !ok; w++ {
+		for k, words := range liveWords {
+			if x := atomic.LoadUint64(&words[w]); x != 0 {
+				ip := b.ipAt(live[k], w, bits.TrailingZeros64(x))
+				if !ok || ip < lo {
+					lo, ok = ip, true
+				}
+			}
+		}
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	for w, got := b.wordsPerShard-1, false; w >= 0 && !got; w-- {
+		for k, words := range liveWords {
+			if x := atomic.LoadUint64(&words[w]); x != 0 {
+				ip := b.ipAt(live[k], w, 63-bits.LeadingZeros64(x))
+				if !got || ip > hi {
+					hi, got = ip, true
+				}
+			}
+		}
+	}
+	return lo, hi, true
+}
+
+// liveShards returns the indexes of the allocated shards and their words.
+func (b *BitsetCounter) liveShards() (live []int, liveWords [][]uint64) {
+	for i := range b.shards {
+		if words := b.shards[i].loaded(); words != nil {
+			live = append(live, i)
+			liveWords = append(liveWords, words)
+		}
+	}
+	return live, liveWords
+}
+
+// ipAt returns the IP of bit j of word w in shard s.
+func (b *BitsetCounter) ipAt(s, w, j int) uint32 {
+	return b.base + uint32((uint64(w)*64+uint64(j))<<b.shardShift+uint64(s))
+}
@@ -0,0 +1,56 @@
+package concurrent
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// Range visits every address once in ascending order whatever the shard
+// interleaving, including both ends of the space.
+func TestRangeOrder(t *testing.T) {
+	rng := rand.New(rand.NewPCG(13, 14))
+	want := []uint32{0, 1, 63, 64, 16383, 16384, 1<<32 - 1}
+	for range 5000 {
+		want = append(want, rng.Uint32())
+	}
+	slices.Sort(want)
+	want = slices.Compact(want)
+
+	for _, shards := range []int{1, 64, DefaultShards} {
+		c := newCounter(t, Options{Shards: shards})
+		for _, i := range rng.Perm(len(want)) {
+			c.Add(want[i])
+		}
+		var got []uint32
+		c.Range(func(ip uint32) bool {
+			got = append(got, ip)
+			return true
+		})
+		if !slices.Equal(got, want) {
+			t.Errorf("%d shards: %d addresses visited, want %d in order", shards, len(got), len(want))
+		}
+	}
+}
+
+// Range stops as soon as fn returns false, having visited only the
+// smallest addresses.
+func TestRangeStopsEarly(t *testing.T) {
+	c := New()
+	for ip := uint32(0); ip < 1000; ip++ {
+		c.Add(ip * 7919)
+	}
+	var got []uint32
+	c.Range(func(ip uint32) bool {
+		got = append(got, ip)
+		return len(got) < 10
+	})
+	if len(got) != 10 {
+		t.Fatalf("%d calls after fn returned false on the 10th", len(got))
+	}
+	for i, ip := range got {
+		if ip != uint32(i)*7919 {
+			t.Errorf("call %d: %d, want %d", i, ip, uint32(i)*7919)
+		}
+	}
+}
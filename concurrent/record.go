@@ -0,0 +1,24 @@
+package concurrent
+
+import (
+	"context"
+	"io"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/pipeline"
+)
+
+// recordStream is countStream writing the Options.Record trace of the
+// run. The trace goes through a temp file renamed into place once the run
+// has succeeded, so a failed run leaves the previous trace, if any.
+func (b *BitsetCounter) recordStream(ctx context.Context, r io.Reader, numWorkers int) (n int64, err error) {
+	err = counter.WriteFileAtomic(b.opts.Record, false, func(w io.Writer) error {
+		b.trace = pipeline.NewRecorder(w)
+		defer func() { b.trace = nil }()
+		if n, err = b.countStream(ctx, r, numWorkers); err != nil {
+			return err
+		}
+		return b.trace.Close()
+	})
+	return n, err
+}
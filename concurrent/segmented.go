@@ -0,0 +1,154 @@
+package concurrent
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	segmentBufSize = 1 * 1024 * 1024 // per-worker read buffer
+	ctxCheckLines  = 1 << 16         // lines between cancellation checks
+)
+
+// countSegmented splits a regular file into one contiguous byte range per
+// worker. Each worker reads its own range with ReadAt, so there is no
+// single producer, no chunk copies and no channel traffic.
+//
+// A line belongs to the range containing its first byte: a worker skips
+// the partial line at its start (the previous worker finishes it) and
+// reads past its end to complete the line straddling the boundary.
+func (b *BitsetCounter) countSegmented(ctx context.Context, file *os.File, size int64) (int64, error) {
+	numWorkers := int64(workerCount(b.opts))
+	if size < numWorkers*segmentBufSize {
+		numWorkers = size/segmentBufSize + 1
+	}
+
+	locals := b.newLocalSets(int(numWorkers))
+	b.log.Debug("concurrent segmented read split", "workers", numWorkers, "bytes", size, "local_bitsets", locals != nil, "numa_groups", locals.numGroups())
+	seq := b.seq.Add(numWorkers) - numWorkers // ranges are in file order
+	var wg sync.WaitGroup
+	counts := make([]int64, numWorkers)
+	errs := make([]error, numWorkers)
+	for k := int64(0); k < numWorkers; k++ {
+		wg.Add(1)
+		go func(k int64) {
+			defer wg.Done()
+			start, end := size*k/numWorkers, size*(k+1)/numWorkers
+			w := b.newWorker(locals, int(k))
+			w.pin()
+			counts[k], errs[k] = b.countSegment(ctx, file, size, start, end, w)
+			b.record(seq+k, w)
+		}(k)
+	}
+	wg.Wait()
+	b.reportOversized()
+	if err := b.runErr(ctx); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for k := range counts {
+		if errs[k] != nil {
+			return 0, errs[k]
+		}
+		total += counts[k]
+	}
+	if locals != nil {
+		total = b.mergeLocal(locals, b.noteFor(&b.runSrc))
+	}
+	return total, nil
+}
+
+// countSegment processes the lines that start in [start, end).
+func (b *BitsetCounter) countSegment(ctx context.Context, file *os.File, size, start, end int64, w *worker) (int64, error) {
+	pos := start
+	if start > 0 {
+		// Begin one byte early: if it is a newline (or b.delim), the line
+		// at start is ours; otherwise we are mid-line and skip to the next
+		// one.
+		pos = start - 1
+	}
+	var sr io.Reader = io.NewSectionReader(file, pos, size-pos)
+	if b.opts.NoCache {
+		sr = counter.DropBehind(file, pos, sr)
+	}
+	r := bufio.NewReaderSize(sr, segmentBufSize)
+
+	if start == 0 {
+		n, err := utils.SkipBOM(r)
+		if err != nil {
+			return 0, &counter.ReadError{Path: file.Name(), Offset: pos, Err: err}
+		}
+		pos += int64(n)
+	} else {
+		n, err := skipLine(r, b.delim)
+		pos += n
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, &counter.ReadError{Path: file.Name(), Offset: pos, Err: err}
+		}
+	}
+
+	var count int64
+	var metered int64 // lines read since the last checkpoint update
+	meteredPos := pos
+	defer func() {
+		b.meter.Add(metered, pos-meteredPos)
+		b.progress(metered, pos-meteredPos)
+	}()
+	for lines := 1; pos < end; lines++ {
+		if lines%ctxCheckLines == 0 {
+			if err := b.runErr(ctx); err != nil {
+				return 0, err
+			}
+			b.meter.Add(metered, pos-meteredPos)
+			b.progress(metered, pos-meteredPos)
+			metered, meteredPos = 0, pos
+		}
+		line, err := r.ReadSlice(b.delim)
+		pos += int64(len(line))
+		metered++
+		if err == bufio.ErrBufferFull {
+			// Far longer than any address: drop it.
+			b.oversized.Add(1)
+			n, err := skipLine(r, b.delim)
+			pos += n
+			if err != nil && err != io.EOF {
+				return 0, &counter.ReadError{Path: file.Name(), Offset: pos, Err: err}
+			}
+			continue
+		}
+		if n := len(line); b.delim != '\n' && n > 0 && line[n-1] == b.delim {
+			line = line[:n-1] // TrimSpace only drops a newline
+		}
+		count += b.parser.Line(line, w)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, &counter.ReadError{Path: file.Name(), Offset: pos, Err: err}
+		}
+	}
+	return count, nil
+}
+
+// skipLine consumes r up to and including the next delim and returns the
+// number of bytes consumed.
+func skipLine(r *bufio.Reader, delim byte) (int64, error) {
+	var n int64
+	for {
+		chunk, err := r.ReadSlice(delim)
+		n += int64(len(chunk))
+		if err != bufio.ErrBufferFull {
+			return n, err
+		}
+	}
+}
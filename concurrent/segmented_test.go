@@ -0,0 +1,84 @@
+package concurrent
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Segmented workers, each reading its own range, add into one shared
+// bitset or their own, while two counters run at once; with -race this
+// checks the workers share nothing unguarded, and each run counts what
+// streaming does.
+func TestSegmentedRace(t *testing.T) {
+	rng := rand.New(rand.NewPCG(111, 112))
+	var b strings.Builder
+	for b.Len() < 8<<20 { // a segment of more than segmentBufSize for each worker
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(10<<24|rng.Uint32N(1<<20)))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	want, err := newCounter(t, Options{Workers: 1, Logger: discard}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []BitsetMode{BitsetShared, BitsetLocal} {
+		var wg sync.WaitGroup
+		for range 2 {
+			c := newCounter(t, Options{Segmented: true, Workers: 6, Bitset: mode, VerifyCount: true,
+				AddressSpace: netip.MustParsePrefix("10.0.0.0/12"), Logger: discard})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if n, err := c.CountUniqueIPs(path); err != nil || n != want {
+					t.Errorf("bitset %v: %d, %v; want %d", mode, n, err, want)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// Reading a file through the chunk pipeline, segment by segment, or
+// mapped; with -benchmem the segmented and mapped reads should allocate
+// little beyond their per-worker buffers, and nothing per chunk.
+func BenchmarkReadModes(b *testing.B) {
+	text, _ := benchInput(1 << 20)
+	path := filepath.Join(b.TempDir(), "in.txt")
+	if err := os.WriteFile(path, text, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, bc := range []struct {
+		name string
+		o    Options
+	}{{"stream", Options{}}, {"segmented", Options{Segmented: true}}, {"mmap", Options{Mmap: true}}} {
+		b.Run(bc.name, func(b *testing.B) {
+			o := bc.o
+			o.Workers, o.Bitset = 4, BitsetShared
+			o.AddressSpace = netip.MustParsePrefix("10.0.0.0/12")
+			o.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+			c := newCounter(b, o)
+			b.SetBytes(int64(len(text)))
+			b.ReportAllocs()
+			for range b.N {
+				c.Reset()
+				if _, err := c.CountUniqueIPs(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package concurrent
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Add marks ip as seen and reports whether it was new.
+// Safe for concurrent use. Under Options.MaxMem, an ip whose shard would
+// exceed the budget is dropped and Add returns false, as is one outside
+// Options.AddressSpace.
+func (b *BitsetCounter) Add(ip uint32) bool {
+	off, ok := b.offset(ip)
+	return ok && b.addBit(off, b.onNew)
+}
+
+// AddString parses s as a line of the input, with Options.Parse, marks
+// the address or, with Parse.CIDR, the block it holds as seen, and returns
+// how many addresses were new. A blank or comment line adds nothing; one
+// that fails to parse or falls outside Options.AddressSpace is an error.
+// Safe for concurrent use, so a service can feed the set addresses as they
+// arrive and read Count for a live total.
+func (b *BitsetCounter) AddString(s string) (int64, error) {
+	parse := b.opts.Parse
+	parse.Lines, parse.Comments, parse.Relaxed, parse.Canon = nil, nil, nil, nil
+	line := parse.Trim([]byte(s))
+	if len(line) == 0 {
+		return 0, nil
+	}
+	first, last, err := parse.ParseBlock(line)
+	if utils.Ignored(err) {
+		return 0, nil
+	}
+	if err == nil && b.spaced && (first < b.base || last > b.base+b.spaceMax) {
+		err = ErrOutsideSpace
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%q: %w", line, err)
+	}
+	if first == last {
+		if b.Add(first) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return b.AddRange(first, last), nil
+}
+
+// addBit sets bit x of the set, the address itself unless AddressSpace
+// offsets it, and reports whether it was new, passing the address to note
+// if so and note is set.
+func (b *BitsetCounter) addBit(x uint32, note func(ip uint32)) bool {
+	if !b.setBit(&b.shards[x&b.shardMask], x>>b.shardShift) {
+		return false
+	}
+	if note != nil {
+		note(b.base + x)
+	}
+	return true
+}
+
+// Contains reports whether ip has been added. Safe for concurrent use.
+func (b *BitsetCounter) Contains(ip uint32) bool {
+	ip, ok := b.offset(ip)
+	if !ok {
+		return false
+	}
+	words := b.shards[ip&b.shardMask].loaded()
+	if words == nil {
+		return false
+	}
+	offset := ip >> b.shardShift
+	return atomic.LoadUint64(&words[offset/64])&(uint64(1)<<(offset%64)) != 0
+}
+
+// Count returns the number of distinct IPs in the set from the running
+// per-shard tallies that every newly set bit increments. It is safe to
+// call at any time, including while a run is adding: it then returns a
+// recent total that only grows, and once the run returns it is exact.
+func (b *BitsetCounter) Count() int64 {
+	var n int64
+	for i := range b.shards {
+		n += b.shards[i].count.Load()
+	}
+	return n
+}
+
+// CountExact returns the number of distinct IPs in the set by popcounting
+// the allocated shards, to check Count against. Safe for concurrent use;
+// while writers are active the result is a lower bound.
+func (b *BitsetCounter) CountExact() int64 {
+	var n int64
+	for i := range b.shards {
+		n += popcount(b.shards[i].loaded())
+	}
+	return n
+}
+
+// popcount returns the number of bits set in words.
+func popcount(words []uint64) int64 {
+	var n int64
+	for i := range words {
+		n += int64(bits.OnesCount64(atomic.LoadUint64(&words[i])))
+	}
+	return n
+}
+
+// Merge adds the addresses of o's set to b's, shard by shard, and returns
+// how many were new to b. Only the shards o allocated are read, so
+// merging the set of a day that touched a few blocks is cheap. The two
+// must have been built with the same Shards, Bits and AddressSpace and
+// without Hash, and neither may be running. Under Options.MaxMem a merge
+// that does not fit fails with counter.ErrMemBudget, b then holding part
+// of o.
+func (b *BitsetCounter) Merge(o *BitsetCounter) (int64, error) {
+	if !b.sameLayout(o) {
+		return 0, errors.New("merged sets must share shards, bits and address space, without a hash")
+	}
+	if err := b.attachBacking(); err != nil {
+		return 0, err
+	}
+	var added int64
+	for i := range o.shards {
+		words := o.shards[i].loaded()
+		if words == nil {
+			continue
+		}
+		var shared []uint64
+		var shardAdded int64
+		for w := range words {
+			nw := atomic.LoadUint64(&words[w])
+			if nw == 0 {
+				continue
+			}
+			if shared == nil {
+				// A shard o allocated but left empty costs b nothing
+				if shared = b.alloc(&b.shards[i]); shared == nil {
+					return added, b.budgetErr()
+				}
+			}
+			old := atomic.OrUint64(&shared[w], nw)
+			shardAdded += int64(bits.OnesCount64(nw &^ old))
+		}
+		b.shards[i].count.Add(shardAdded)
+		added += shardAdded
+	}
+	return added, nil
+}
+
+// IntersectCount returns how many addresses b's set and o's both hold,
+// ANDing them shard by shard; a shard either left unallocated holds none
+// of the other's. The two must be built as for Merge, and neither may be
+// running. With each set's Count it gives the addresses only one holds.
+func (b *BitsetCounter) IntersectCount(o *BitsetCounter) (int64, error) {
+	if !b.sameLayout(o) {
+		return 0, errors.New("intersected sets must share shards, bits and address space, without a hash")
+	}
+	var n int64
+	for i := range b.shards {
+		bw, ow := b.shards[i].loaded(), o.shards[i].loaded()
+		if bw == nil || ow == nil {
+			continue
+		}
+		for w := range bw {
+			n += int64(bits.OnesCount64(atomic.LoadUint64(&bw[w]) & atomic.LoadUint64(&ow[w])))
+		}
+	}
+	return n, nil
+}
+
+// sameLayout reports whether bit x of b's set and of o's stand for the same
+// address, so the two can be combined word by word.
+func (b *BitsetCounter) sameLayout(o *BitsetCounter) bool {
+	return len(b.shards) == len(o.shards) && b.wordsPerShard == o.wordsPerShard && b.base == o.base &&
+		b.opts.Hash == nil && o.opts.Hash == nil
+}
+
+// Reset clears the set while keeping allocated shards for reuse, so a
+// counter can process file after file without re-allocating its bitset.
+// It is safe to call while Add, AddString and Count are, as a service
+// clearing a live total each period does: every word is swapped for zero
+// and its bits taken off the shard's tally, so an address added during
+// the reset is either cleared or kept and counted. It must not be called
+// concurrently with CountUniqueIPs.
+func (b *BitsetCounter) Reset() {
+	for i := range b.shards {
+		sh := &b.shards[i]
+		words := sh.loaded()
+		var cleared int64
+		for w := range words {
+			if atomic.LoadUint64(&words[w]) != 0 {
+				cleared += int64(bits.OnesCount64(atomic.SwapUint64(&words[w], 0)))
+			}
+		}
+		sh.count.Add(-cleared)
+	}
+}
+
+// ResetAndFree clears the set and releases all shard memory; shards in a
+// mapped region are zeroed for their next use instead.
+// It must not be called concurrently with Add or CountUniqueIPs.
+func (b *BitsetCounter) ResetAndFree() {
+	for i := range b.shards {
+		if b.backing != nil {
+			clear(b.shards[i].loaded())
+		}
+		b.shards[i].words.Store(nil)
+		b.shards[i].count.Store(0)
+	}
+	b.allocated.Store(0)
+}
@@ -0,0 +1,172 @@
+package concurrent
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// BenchmarkAddContended has 16 goroutines adding interleaved runs of
+// consecutive offsets in one shard, so their CAS loops keep meeting on the
+// same words.
+func BenchmarkAddContended(b *testing.B) {
+	const goroutines = 16
+	c := New()
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := g; i < b.N; i += goroutines {
+				c.Add(uint32(i)<<14 | uint32(i>>18)) // shard i>>18 of DefaultShards
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkNeighbourShards has 8 goroutines each adding to, or looking
+// up in, its own one of 8 adjacent shards. They share no words, so any
+// slowdown against one goroutine is their shard headers sharing cache
+// lines.
+func BenchmarkNeighbourShards(b *testing.B) {
+	const goroutines = 8
+	for _, bc := range []struct {
+		name string
+		op   func(c *BitsetCounter, ip uint32)
+	}{
+		{"add", func(c *BitsetCounter, ip uint32) { c.Add(ip) }},
+		{"contains", func(c *BitsetCounter, ip uint32) { c.Contains(ip) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := New()
+			for g := range goroutines {
+				c.Add(uint32(g)) // allocate the shards outside the timer
+			}
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for g := range goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := g; i < b.N; i += goroutines {
+						bc.op(c, uint32(i)<<14|uint32(g)) // shard g of DefaultShards
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// A counter Reset between two files counts the second as a fresh one
+// would: nothing of the first is left in its bits or its tally.
+func TestResetBetweenRuns(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(a, []byte("1.1.1.1\n2.2.2.2\n10.0.0.1\n255.255.255.255\n1.1.1.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("10.0.0.1\n10.0.0.2\n10.0.0.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := New().CountUniqueIPs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New()
+	if n, err := c.CountUniqueIPs(a); err != nil || n != 4 {
+		t.Fatalf("fixture A: %d, %v; want 4", n, err)
+	}
+	c.Reset()
+	n, err := c.CountUniqueIPs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want || c.Count() != want || c.CountExact() != want {
+		t.Errorf("fixture B after Reset: %d, Count %d, %d bits set; want %d", n, c.Count(), c.CountExact(), want)
+	}
+	for _, ip := range []uint32{1<<24 | 1<<16 | 1<<8 | 1, 2<<24 | 2<<16 | 2<<8 | 2, 1<<32 - 1} {
+		if c.Contains(ip) {
+			t.Errorf("%s of fixture A survived Reset", utils.FormatIPv4(ip))
+		}
+	}
+}
+
+// Count and CountExact may be polled from another goroutine while a run
+// adds to the set: neither goes down, neither passes the final count, and
+// both reach it once the run returns. Run with -race.
+func TestCountDuringRun(t *testing.T) {
+	const n = 200000
+	c := newCounter(t, Options{Workers: 4, ChunkSize: MinChunkSize})
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var got int64
+	var runErr error
+	go func() {
+		defer close(done)
+		got, runErr = c.CountReader(context.Background(), pr)
+	}()
+
+	write := func(from, to int) {
+		var b strings.Builder
+		for i := from; i < to; i++ {
+			b.WriteString(utils.FormatIPv4(uint32(i)*2654435761) + "\n")
+		}
+		if _, err := io.WriteString(pw, b.String()); err != nil {
+			t.Error(err)
+		}
+	}
+	var polls []int64
+	poll := func() {
+		last := int64(-1)
+		if len(polls) > 0 {
+			last = polls[len(polls)-1]
+		}
+		live, exact := c.Count(), c.CountExact()
+		if live < last || exact > n || live > n {
+			t.Errorf("polled %d live, %d exact after %d", live, exact, last)
+		}
+		polls = append(polls, live)
+	}
+
+	write(0, n/2)
+	for deadline := time.Now().Add(10 * time.Second); c.Count() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing counted from the first half of the input")
+		}
+		poll()
+		runtime.Gosched()
+	}
+	poll()
+	go func() {
+		write(n/2, n)
+		pw.Close()
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			poll()
+		}
+	}
+	if runErr != nil || got != n {
+		t.Fatalf("run: %d, %v", got, runErr)
+	}
+	if live, exact := c.Count(), c.CountExact(); live != n || exact != n {
+		t.Errorf("after the run: %d live, %d exact, want %d", live, exact, n)
+	}
+}
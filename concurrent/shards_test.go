@@ -0,0 +1,148 @@
+package concurrent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Every uint32 maps to its own (shard, offset) pair, ip % shards and
+// ip / shards, inside the shard's words, and ipAt takes the pair back to
+// it. With 2^32 pairs in all the mapping is then one to one. Short runs
+// check every 251st address, plus every low one.
+func TestShardMapping(t *testing.T) {
+	for _, shards := range []int{1, 2, 64, DefaultShards, MaxShards} {
+		t.Run(fmt.Sprint(shards), func(t *testing.T) {
+			t.Parallel()
+			c := newCounter(t, Options{Shards: shards})
+			if total := uint64(len(c.shards)) * uint64(c.wordsPerShard) * 64; total != 1<<32 {
+				t.Fatalf("%d shards of %d words hold %d bits", len(c.shards), c.wordsPerShard, total)
+			}
+			step := uint64(1)
+			if testing.Short() {
+				step = 251
+			}
+			check := func(ip uint32) bool {
+				s, off := ip&c.shardMask, ip>>c.shardShift
+				if int(s) >= len(c.shards) || int(off) >= c.wordsPerShard*64 ||
+					c.ipAt(int(s), int(off/64), int(off%64)) != ip {
+					t.Errorf("%s maps to shard %d offset %d", utils.FormatIPv4(ip), s, off)
+					return false
+				}
+				return true
+			}
+			for ip := uint64(0); ip < 1<<32; ip += step {
+				if !check(uint32(ip)) {
+					return
+				}
+			}
+			for ip := uint32(0); ip < 1<<16; ip++ {
+				if !check(ip) || !check(^ip) {
+					return
+				}
+			}
+		})
+	}
+}
+
+// The shard count changes where bits go but never the count.
+func TestShardCountsAgree(t *testing.T) {
+	rng := rand.New(rand.NewPCG(15, 16))
+	var b strings.Builder
+	seen := map[uint32]bool{}
+	for range 100000 {
+		ip := rng.Uint32() >> rng.UintN(24)
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, shards := range []int{1, 2, 64, 1024, DefaultShards, MaxShards} {
+		n, err := newCounter(t, Options{Shards: shards}).CountUniqueIPs(path)
+		if err != nil {
+			t.Fatalf("%d shards: %v", shards, err)
+		}
+		if n != int64(len(seen)) {
+			t.Errorf("%d shards: %d, want %d", shards, n, len(seen))
+		}
+	}
+}
+
+// The popcounts of the shards add up to the unique count, with every
+// shard holding a bit allocated and no other, and the summary totals
+// them the same.
+func TestShardStatsTotal(t *testing.T) {
+	rng := rand.New(rand.NewPCG(17, 18))
+	var b strings.Builder
+	seen := map[uint32]bool{}
+	for range 50000 {
+		ip := rng.Uint32() >> rng.UintN(28)
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	for _, shards := range []int{1, 64, DefaultShards} {
+		c := newCounter(t, Options{Shards: shards, Workers: 4})
+		n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := c.ShardStats()
+		var sum int64
+		for i, st := range stats {
+			if st.Shard != i || st.Allocated != (st.Bits > 0) {
+				t.Errorf("%d shards: stat %d is %+v", shards, i, st)
+			}
+			sum += st.Bits
+		}
+		if sum != n || n != int64(len(seen)) {
+			t.Errorf("%d shards: popcounts add up to %d, count %d, want %d", shards, sum, n, len(seen))
+		}
+		if s := SummarizeShards(stats); s.Total != n || s.Shards != len(stats) {
+			t.Errorf("%d shards: summary %+v, count %d", shards, s, n)
+		}
+	}
+}
+
+// Percentiles are nearest-rank over every shard, allocated or not, and
+// the Gini runs from 0 for bits spread evenly to (n-1)/n for all of them
+// in one of n shards.
+func TestSummarizeShards(t *testing.T) {
+	stats := func(bits ...int64) []ShardStat {
+		s := make([]ShardStat, len(bits))
+		for i, b := range bits {
+			s[i] = ShardStat{Shard: i, Allocated: b > 0, Bits: b}
+		}
+		return s
+	}
+	var ramp []int64
+	for i := range 100 {
+		ramp = append(ramp, int64(100-i)) // unsorted: 100 down to 1
+	}
+	for _, tc := range []struct {
+		name               string
+		stats              []ShardStat
+		p50, p90, p99, max int64
+		gini               float64
+	}{
+		{"empty", nil, 0, 0, 0, 0, 0},
+		{"no bits", stats(0, 0, 0, 0), 0, 0, 0, 0, 0},
+		{"even", stats(7, 7, 7, 7), 7, 7, 7, 7, 0},
+		{"one of four", stats(0, 0, 12, 0), 0, 12, 12, 12, 0.75},
+		{"ramp", stats(ramp...), 50, 90, 99, 100, 0.33},
+	} {
+		s := SummarizeShards(tc.stats)
+		if s.P50 != tc.p50 || s.P90 != tc.p90 || s.P99 != tc.p99 || s.Max != tc.max || math.Abs(s.Gini-tc.gini) > 1e-9 {
+			t.Errorf("%s: %+v, want p50 %d, p90 %d, p99 %d, max %d, Gini %.3f",
+				tc.name, s, tc.p50, tc.p90, tc.p99, tc.max, tc.gini)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package concurrent
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// ShardStat is the occupancy of one bitset shard.
+type ShardStat struct {
+	Shard     int   // index: the low bits shared by every address in the shard
+	Allocated bool  // its words were allocated, by a write or a loaded state
+	Bits      int64 // bits set, by popcount
+}
+
+// ShardStats returns the occupancy of every shard in index order. The
+// allocated shards are popcounted on up to GOMAXPROCS goroutines, each
+// taking a contiguous run of them. Their Bits add up to Count once a run
+// has returned; like Range it only sees a point-in-time view while
+// writers are active.
+func (b *BitsetCounter) ShardStats() []ShardStat {
+	stats := make([]ShardStat, len(b.shards))
+	workers := min(runtime.GOMAXPROCS(0), len(b.shards))
+	per := (len(b.shards) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for lo := 0; lo < len(b.shards); lo += per {
+		hi := min(lo+per, len(b.shards))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := lo; i < hi; i++ {
+				words := b.shards[i].loaded()
+				stats[i] = ShardStat{Shard: i, Allocated: words != nil, Bits: popcount(words)}
+			}
+		}()
+	}
+	wg.Wait()
+	return stats
+}
+
+// ShardSummary condenses ShardStats into how evenly the set spreads over
+// the shards. The percentiles and Gini are over every shard, unallocated
+// ones holding 0 bits: a Gini near 0 means the bits are spread evenly,
+// near 1 that a few shards hold them all, as with an input from a few
+// small subnets.
+type ShardSummary struct {
+	Shards    int
+	Allocated int
+	Total     int64 // bits set in all shards
+	P50       int64
+	P90       int64
+	P99       int64
+	Max       int64
+	Gini      float64
+}
+
+// SummarizeShards returns the summary of stats.
+func SummarizeShards(stats []ShardStat) ShardSummary {
+	s := ShardSummary{Shards: len(stats)}
+	if len(stats) == 0 {
+		return s
+	}
+	bits := make([]int64, len(stats))
+	for i, st := range stats {
+		bits[i] = st.Bits
+		s.Total += st.Bits
+		if st.Allocated {
+			s.Allocated++
+		}
+	}
+	slices.Sort(bits)
+	rank := func(p float64) int64 { // nearest-rank percentile
+		return bits[max(0, int(p*float64(len(bits))+0.999999)-1)]
+	}
+	s.P50, s.P90, s.P99, s.Max = rank(0.50), rank(0.90), rank(0.99), bits[len(bits)-1]
+	if s.Total > 0 {
+		// G = 2·Σ i·x_i / (n·Σ x) − (n+1)/n over ascending x, i from 1
+		var weighted float64
+		for i, x := range bits {
+			weighted += float64(i+1) * float64(x)
+		}
+		n := float64(len(bits))
+		s.Gini = 2*weighted/(n*float64(s.Total)) - (n+1)/n
+	}
+	return s
+}
+
+// String formats the summary for -stats.
+func (s ShardSummary) String() string {
+	return fmt.Sprintf("%d of %d shards allocated; bits per shard p50 %d, p90 %d, p99 %d, max %d; Gini %.3f",
+		s.Allocated, s.Shards, s.P50, s.P90, s.P99, s.Max, s.Gini)
+}
+
+// reportShards sends the shard summary to Stats, with ShardStats, and
+// checks that the popcounts add up to the running count, which every set
+// bit increments separately: a difference means a bit was set without
+// being counted, or counted twice. VerifyCount checks without the summary.
+func (b *BitsetCounter) reportShards() error {
+	report := b.opts.ShardStats && b.opts.Stats != nil
+	if !report && !b.opts.VerifyCount {
+		return nil
+	}
+	if testHookCounted != nil {
+		testHookCounted(b)
+	}
+	s := SummarizeShards(b.ShardStats())
+	if report {
+		b.opts.Stats.Set("shard occupancy", "%s", s)
+	}
+	if n := b.Count(); s.Total != n {
+		return &counter.CountMismatchError{Set: "bitset", Counted: n, Recount: s.Total}
+	}
+	return nil
+}
+
+// testHookCounted, if set, is called with the counter once a run has
+// read its input and before its count is checked, for tests to break the
+// count.
+var testHookCounted func(b *BitsetCounter)
@@ -0,0 +1,224 @@
+package concurrent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A snapshot is a set saved to a file: the magic, whose last two bytes
+// are the format version, the number of addresses as a little-endian
+// uint64, then one record per /16 holding any, in ascending order, and a
+// CRC-32C of everything before it. A record is the /16's top 16 bits and
+// its address count minus one as little-endian uint16s, then up to
+// snapshotArrayMax low halves as ascending uint16s or, for denser blocks,
+// its 8 KB bitmap, bit a%8 of byte a/8 for low half a.
+const (
+	snapshotArrayMax = 4096 // where a bitmap becomes smaller than a list
+	blockBitmapBytes = 1 << 16 / 8
+)
+
+// SnapshotMagic starts every snapshot; its last two bytes are the version.
+const SnapshotMagic = "ipcset01"
+
+// ErrBadSnapshot is returned for a snapshot that is truncated, corrupt or
+// written by another format version.
+var ErrBadSnapshot = errors.New("bad snapshot")
+
+var snapshotCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteSnapshot writes the set to w as a snapshot, walking it with Range,
+// so it must not be called while a run is adding.
+func (b *BitsetCounter) WriteSnapshot(w io.Writer) error {
+	if b.opts.Bits != 0 || b.opts.Hash != nil {
+		return errors.New("snapshots hold the full IPv4 space")
+	}
+	sum := crc32.New(snapshotCRC)
+	bw := bufio.NewWriter(io.MultiWriter(w, sum))
+	bw.WriteString(SnapshotMagic)
+	binary.Write(bw, binary.LittleEndian, uint64(b.Count()))
+
+	var (
+		lows   []uint16
+		high   = -1
+		bitmap [blockBitmapBytes]byte
+		rec    [4]byte
+	)
+	flush := func() {
+		if len(lows) == 0 {
+			return
+		}
+		binary.LittleEndian.PutUint16(rec[0:], uint16(high))
+		binary.LittleEndian.PutUint16(rec[2:], uint16(len(lows)-1))
+		bw.Write(rec[:])
+		if len(lows) <= snapshotArrayMax {
+			for _, lo := range lows {
+				binary.LittleEndian.PutUint16(rec[:2], lo)
+				bw.Write(rec[:2])
+			}
+		} else {
+			clear(bitmap[:])
+			for _, lo := range lows {
+				bitmap[lo/8] |= 1 << (lo % 8)
+			}
+			bw.Write(bitmap[:])
+		}
+		lows = lows[:0]
+	}
+	b.Range(func(ip uint32) bool {
+		if h := int(ip >> 16); h != high {
+			flush()
+			high = h
+		}
+		lows = append(lows, uint16(ip))
+		return true
+	})
+	flush()
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint32(nil, sum.Sum32()))
+	return err
+}
+
+// LoadSnapshot adds every address of the snapshot in r to the set and
+// returns how many the snapshot held. The whole snapshot is checked, down
+// to its checksum and the end of r; on error, including a snapshot that
+// does not fit Options.MaxMem, the set may hold part of it.
+func (b *BitsetCounter) LoadSnapshot(r io.Reader) (int64, error) {
+	if b.opts.Bits != 0 || b.opts.Hash != nil {
+		return 0, errors.New("snapshots hold the full IPv4 space")
+	}
+	if err := b.attachBacking(); err != nil {
+		return 0, err
+	}
+	sum := crc32.New(snapshotCRC)
+	br := bufio.NewReader(r)
+	in := io.TeeReader(br, sum)
+
+	hdr := make([]byte, len(SnapshotMagic)+8)
+	if _, err := io.ReadFull(in, hdr); err != nil {
+		return 0, fmt.Errorf("%w: short header: %v", ErrBadSnapshot, err)
+	}
+	if magic := string(hdr[:len(SnapshotMagic)]); magic != SnapshotMagic {
+		if strings.HasPrefix(magic, SnapshotMagic[:6]) {
+			return 0, fmt.Errorf("%w: format version %s, this build reads %s", ErrBadSnapshot, magic[6:], SnapshotMagic[6:])
+		}
+		return 0, fmt.Errorf("%w: not a snapshot (magic %q)", ErrBadSnapshot, magic)
+	}
+	total := binary.LittleEndian.Uint64(hdr[len(SnapshotMagic):])
+	if total > maxIPv4 {
+		return 0, fmt.Errorf("%w: %d addresses", ErrBadSnapshot, total)
+	}
+
+	var (
+		seen   uint64
+		high   = -1
+		rec    [4]byte
+		bitmap [blockBitmapBytes]byte
+	)
+	for seen < total {
+		if _, err := io.ReadFull(in, rec[:]); err != nil {
+			return 0, fmt.Errorf("%w: block after %d of %d addresses: %v", ErrBadSnapshot, seen, total, err)
+		}
+		h := int(binary.LittleEndian.Uint16(rec[0:]))
+		n := uint64(binary.LittleEndian.Uint16(rec[2:])) + 1
+		if h <= high || seen+n > total {
+			return 0, fmt.Errorf("%w: block %d out of order or past the count", ErrBadSnapshot, h)
+		}
+		high = h
+		base := uint32(h) << 16
+		if n <= snapshotArrayMax {
+			prev := -1
+			for range n {
+				if _, err := io.ReadFull(in, rec[:2]); err != nil {
+					return 0, fmt.Errorf("%w: block %d: %v", ErrBadSnapshot, h, err)
+				}
+				lo := int(binary.LittleEndian.Uint16(rec[:2]))
+				if lo <= prev {
+					return 0, fmt.Errorf("%w: block %d not in ascending order", ErrBadSnapshot, h)
+				}
+				prev = lo
+				b.Add(base | uint32(lo))
+			}
+		} else {
+			if _, err := io.ReadFull(in, bitmap[:]); err != nil {
+				return 0, fmt.Errorf("%w: block %d: %v", ErrBadSnapshot, h, err)
+			}
+			var got uint64
+			for i, x := range bitmap {
+				got += uint64(bits.OnesCount8(x))
+				for ; x != 0; x &= x - 1 {
+					b.Add(base | uint32(i*8+bits.TrailingZeros8(x)))
+				}
+			}
+			if got != n {
+				return 0, fmt.Errorf("%w: block %d has %d addresses, header says %d", ErrBadSnapshot, h, got, n)
+			}
+		}
+		seen += n
+	}
+
+	want := sum.Sum32()
+	if _, err := io.ReadFull(br, rec[:]); err != nil {
+		return 0, fmt.Errorf("%w: missing checksum: %v", ErrBadSnapshot, err)
+	}
+	if got := binary.LittleEndian.Uint32(rec[:]); got != want {
+		return 0, fmt.Errorf("%w: checksum %08x, want %08x", ErrBadSnapshot, got, want)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return 0, fmt.Errorf("%w: trailing data", ErrBadSnapshot)
+	}
+	if b.overBudget.Load() {
+		return 0, b.budgetErr()
+	}
+	return int64(total), nil
+}
+
+// WriteSnapshotFile writes the set to path as a snapshot through a temp
+// file in the same directory, renamed over path once complete, so a crash
+// leaves the previous snapshot in place.
+func (b *BitsetCounter) WriteSnapshotFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	defer os.Remove(f.Name()) // after a successful rename there is nothing left to remove
+	if err := b.WriteSnapshot(f); err != nil {
+		f.Close()
+		return fmt.Errorf("write snapshot %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("write snapshot %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write snapshot %s: %w", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshotFile adds the addresses of the snapshot at path to the set,
+// as LoadSnapshot does.
+func (b *BitsetCounter) LoadSnapshotFile(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := b.LoadSnapshot(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
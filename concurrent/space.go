@@ -0,0 +1,47 @@
+package concurrent
+
+import "errors"
+
+// ErrOutsideSpace is what lines whose addresses all fall outside
+// Options.AddressSpace are skipped with.
+var ErrOutsideSpace = errors.New("address outside the address space")
+
+// offset returns ip's bit in the set, false when ip is outside
+// Options.AddressSpace.
+func (b *BitsetCounter) offset(ip uint32) (uint32, bool) {
+	if !b.spaced {
+		return ip, true
+	}
+	off := ip - b.base
+	return off, off <= b.spaceMax
+}
+
+// clip returns the bits of the addresses [first, last] inside
+// Options.AddressSpace, counting the rest as outside, and false when none
+// are inside.
+func (b *BitsetCounter) clip(first, last uint32) (lo, hi uint32, ok bool) {
+	if !b.spaced {
+		return first, last, true
+	}
+	end := b.base + b.spaceMax
+	if last < b.base || first > end {
+		b.outside.Add(int64(last-first) + 1)
+		return 0, 0, false
+	}
+	lo, hi = max(first, b.base), min(last, end)
+	if n := int64(last-first) - int64(hi-lo); n > 0 {
+		b.outside.Add(n)
+	}
+	return lo - b.base, hi - b.base, true
+}
+
+// checkSpace rejects a line whose addresses all lie outside the space,
+// counting them; of a line partly inside, the part outside is clipped
+// and counted when it is added.
+func (b *BitsetCounter) checkSpace(first, last uint32) error {
+	if last < b.base || first > b.base+b.spaceMax {
+		b.outside.Add(int64(last-first) + 1)
+		return ErrOutsideSpace
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package concurrent
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// StateBytes is the size of a state file: one bit per IPv4 address, the
+// bit for address a at byte a/8, bit a%8, so every address has the same
+// place whatever the shard count.
+const StateBytes = int64(maxIPv4 / 8)
+
+var (
+	// ErrStateUnsupported is returned for Options.StateFile on platforms
+	// without mmap and flock.
+	ErrStateUnsupported = errors.New("state files need Linux or macOS")
+	// ErrStateLocked is returned when another run holds the state file.
+	ErrStateLocked = errors.New("state file is in use by another run")
+)
+
+// attachState maps Options.StateFile, creating it if needed, as the
+// counter's single shard the first time the counter runs. Every address
+// the file has recorded is then already set, so a run counts only the
+// addresses it is the first to see. A BitsetFile or BitsetSwap region is
+// mapped here too, and Options.Preload loaded and Options.StreamDump
+// opened after both.
+func (b *BitsetCounter) attachState() error {
+	if err := b.attachBacking(); err != nil {
+		return err
+	}
+	if b.opts.StateFile != "" && b.state == nil {
+		st, err := openState(b.opts.StateFile)
+		if err != nil {
+			return err
+		}
+		words := unsafe.Slice((*uint64)(unsafe.Pointer(&st.data[0])), len(st.data)/8)
+		b.shards[0].words.Store(&words)
+		b.shards[0].count.Store(popcount(words)) // one pass over the file
+		b.state = st
+	}
+	if err := b.attachPreload(); err != nil {
+		return err
+	}
+	return b.attachDump()
+}
+
+// syncState flushes the state file after a run, so what it counted is
+// durable before the count is reported.
+func (b *BitsetCounter) syncState() error {
+	if b.state == nil {
+		return nil
+	}
+	if err := b.state.sync(); err != nil {
+		return fmt.Errorf("state file %s: %w", b.opts.StateFile, err)
+	}
+	return nil
+}
+
+// Close flushes and unmaps the state file and releases its lock, or
+// unmaps a BitsetFile or BitsetSwap region, and closes the stream dump.
+// It is a no-op for a counter without any; the counter must not be used
+// after.
+func (b *BitsetCounter) Close() error {
+	err := b.closeDump()
+	if b.state == nil {
+		if cerr := b.closeBacking(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	b.shards[0].words.Store(nil)
+	if cerr := b.state.close(); err == nil {
+		err = cerr
+	}
+	b.state = nil
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package concurrent
+
+type stateFile struct {
+	data []byte
+}
+
+func openState(path string) (*stateFile, error) {
+	return nil, ErrStateUnsupported
+}
+
+func (s *stateFile) sync() error { return nil }
+
+func (s *stateFile) close() error { return nil }
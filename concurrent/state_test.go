@@ -0,0 +1,83 @@
+//go:build linux || darwin
+
+package concurrent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A state file keeps what one run counted for the next: a counter
+// reopening it counts only addresses new to it, a second counter cannot
+// open it while the first holds it, and each address is the bit at byte
+// a/8, bit a%8 of the file.
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.state")
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	run := func(input string) int64 {
+		t.Helper()
+		c := newCounter(t, Options{StateFile: path, Workers: 2, Logger: discard})
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := run("10.0.0.1\n10.0.0.2\n10.0.0.1\n255.255.255.255\n"); n != 3 {
+		t.Errorf("first run: %d, want 3", n)
+	}
+	if n := run("10.0.0.2\n10.0.0.3\n255.255.255.255\n0.0.0.0\n"); n != 2 {
+		t.Errorf("second run: %d new, want 2", n)
+	}
+	if n := run("10.0.0.1\n0.0.0.0\n"); n != 0 {
+		t.Errorf("third run: %d new, want 0", n)
+	}
+
+	holder := newCounter(t, Options{StateFile: path, Logger: discard})
+	if _, err := holder.CountReader(context.Background(), strings.NewReader("10.0.0.9\n")); err != nil {
+		t.Fatal(err)
+	}
+	other := newCounter(t, Options{StateFile: path, Logger: discard})
+	if _, err := other.CountReader(context.Background(), strings.NewReader("10.0.0.9\n")); !errors.Is(err, ErrStateLocked) {
+		t.Errorf("second holder: %v, want ErrStateLocked", err)
+	}
+	if err := holder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != StateBytes {
+		t.Fatalf("state file is %d bytes, want %d", len(data), StateBytes)
+	}
+	var set []uint32
+	for _, a := range []uint32{0, 10<<24 | 1, 10<<24 | 2, 10<<24 | 3, 10<<24 | 9, 1<<32 - 1} {
+		if data[a/8]&(1<<(a%8)) != 0 {
+			set = append(set, a)
+		}
+	}
+	if len(set) != 6 {
+		t.Errorf("addresses set in the file: %v, want all 6", set)
+	}
+	ones := 0
+	for _, b := range data {
+		for ; b != 0; b &= b - 1 {
+			ones++
+		}
+	}
+	if ones != 6 {
+		t.Errorf("%d bits set in the file, want 6", ones)
+	}
+}
@@ -0,0 +1,78 @@
+//go:build linux || darwin
+
+package concurrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// stateFile is a mapped, exclusively locked state file.
+type stateFile struct {
+	f    *os.File
+	data []byte
+}
+
+// openState opens or creates path, checks its size, takes an exclusive
+// lock and maps it shared, so bits set in memory land in the file. A new
+// file is sized with Truncate, which leaves it sparse: disk use grows with
+// the pages that are written.
+func openState(path string) (*stateFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("state file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrStateLocked, path)
+		}
+		return nil, fmt.Errorf("state file %s: lock: %w", path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("state file: %w", err)
+	}
+	switch st.Size() {
+	case StateBytes:
+	case 0:
+		if err := f.Truncate(StateBytes); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("state file %s: %w", path, err)
+		}
+	default:
+		f.Close()
+		return nil, fmt.Errorf("state file %s is %d bytes, want %d", path, st.Size(), StateBytes)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(StateBytes), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("state file %s: mmap: %w", path, err)
+	}
+	return &stateFile{f: f, data: data}, nil
+}
+
+// sync writes the dirty pages back and waits for them.
+func (s *stateFile) sync() error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&s.data[0])), uintptr(len(s.data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return fmt.Errorf("msync: %w", errno)
+	}
+	return nil
+}
+
+// close syncs, unmaps and closes the file, which drops the lock.
+func (s *stateFile) close() error {
+	err := s.sync()
+	if uerr := syscall.Munmap(s.data); err == nil {
+		err = uerr
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package concurrent
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// SubsampleCounts returns how many distinct addresses of the set a
+// by-address sample at each rate of Options.SubsampleRates would have
+// held, or nil without rates. The allocated shards are split among a
+// CPU's worth of goroutines that hash every set address once. Like Range
+// it only sees a point-in-time view while writers are active.
+func (b *BitsetCounter) SubsampleCounts() []counter.SubsampleCount {
+	sub := counter.NewSubsample(b.opts.SubsampleRates)
+	if sub == nil {
+		return nil
+	}
+	live, liveWords := b.liveShards()
+	var (
+		next atomic.Int64
+		wg   sync.WaitGroup
+	)
+	for range min(workerCount(b.opts), len(live)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := sub.NewTally()
+			for k := int(next.Add(1) - 1); k < len(live); k = int(next.Add(1) - 1) {
+				words := liveWords[k]
+				for w := range words {
+					for x := atomic.LoadUint64(&words[w]); x != 0; x &= x - 1 {
+						sub.Add(t, b.ipAt(live[k], w, bits.TrailingZeros64(x)))
+					}
+				}
+			}
+			sub.Merge(t)
+		}()
+	}
+	wg.Wait()
+	return sub.Counts()
+}
@@ -0,0 +1,107 @@
+package concurrent
+
+import (
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// watchInterval is how often the watchdog samples memory during a run.
+const watchInterval = 50 * time.Millisecond
+
+// heapMetric is the live heap, including heap-allocated shards; reading it
+// does not stop the world as runtime.ReadMemStats does.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// watchdog samples a run's memory for Options.Watchdog and flags the run
+// over budget once it passes budget bytes.
+type watchdog struct {
+	budget int64
+	stop   chan struct{}
+	done   chan struct{}
+	peak   int64        // highest sample, read once done is closed
+	over   atomic.Int64 // the sample that tripped it, 0 if none
+}
+
+// startWatchdog starts watching the run that is beginning, if
+// Options.Watchdog asks for it. The budget is MaxMem or, without one,
+// what the process holds now plus what the host has free. A run that
+// resets twice, as a file falling through to the stream does, keeps the
+// watchdog it has.
+func (b *BitsetCounter) startWatchdog() {
+	if !b.opts.Watchdog || b.watch != nil {
+		return
+	}
+	budget := b.opts.MaxMem
+	if budget <= 0 {
+		avail := counter.AvailableMemory()
+		if avail <= 0 {
+			b.log.Warn("memory watchdog off: neither a budget nor the available memory is known")
+			return
+		}
+		budget = b.memInUse() + avail
+	}
+	w := &watchdog{budget: budget, stop: make(chan struct{}), done: make(chan struct{})}
+	b.watch = w
+	go func() {
+		defer close(w.done)
+		tick := time.NewTicker(watchInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-tick.C:
+			}
+			used := b.memInUse()
+			w.peak = max(w.peak, used)
+			if used > w.budget {
+				w.over.Store(used)
+				b.overBudget.Store(true)
+				b.log.Warn("concurrent memory over budget; stopping the run",
+					"in_use", counter.FormatBytes(used), "budget", counter.FormatBytes(w.budget))
+				return
+			}
+		}
+	}()
+}
+
+// stopWatchdog stops the watchdog of the run that is ending and records
+// what it saw.
+func (b *BitsetCounter) stopWatchdog() {
+	w := b.watch
+	if w == nil {
+		return
+	}
+	b.watch = nil
+	close(w.stop)
+	<-w.done
+	w.peak = max(w.peak, b.memInUse()) // a run shorter than a tick gets one sample
+	if over := w.over.Load(); over > 0 {
+		b.opts.Stats.Set("concurrent watchdog", "stopped the run at %s of a %s budget",
+			counter.FormatBytes(over), counter.FormatBytes(w.budget))
+	} else {
+		b.opts.Stats.Set("concurrent watchdog", "peak %s of a %s budget",
+			counter.FormatBytes(w.peak), counter.FormatBytes(w.budget))
+	}
+}
+
+// memInUse returns the bytes of the allocated shards plus the rest of the
+// Go heap. Heap-allocated shards are part of the heap already; mapped ones
+// are added to it.
+func (b *BitsetCounter) memInUse() int64 {
+	live, _ := b.liveShards()
+	shards := int64(len(live)) * int64(b.wordsPerShard) * 8
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	var heap int64
+	if sample[0].Value.Kind() == metrics.KindUint64 {
+		heap = int64(sample[0].Value.Uint64())
+	}
+	if b.backing != nil {
+		return heap + shards
+	}
+	return max(heap, shards)
+}
@@ -0,0 +1,266 @@
+package counter
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const (
+	naiveMaxFileSize = 16 << 20  // map-based set stays small below this
+	bitsetBytes      = 512 << 20 // fully allocated 2^32-bit bitset
+	shardBytes       = 32 << 10  // one lazily allocated bitset shard
+	minLineBytes     = 8         // "1.1.1.1\n"
+	mapEntryBytes    = 40        // naive map cost per distinct address
+	defaultAvailMem  = 1 << 30   // assumed when available memory is unknown
+	unknownSize      = 1 << 40   // assumed for streams that do not give their size
+)
+
+func init() {
+	Register("auto", func(o Options) (Counter, error) { return &Auto{opts: o}, nil })
+}
+
+// Selection records which engine Select picked and why.
+type Selection struct {
+	Engine   string
+	Reason   string
+	FileSize int64
+	AvailMem int64 // 0 when unknown
+	MaxMem   int64 // budget from Options.MaxMem, 0 for none
+}
+
+func (s Selection) String() string {
+	return fmt.Sprintf("%s (%s)", s.Engine, s.Reason)
+}
+
+// Select picks an engine for an input of fileSize bytes given availMem
+// bytes of free memory (0 if unknown):
+//   - naive for tiny files, where a map beats allocating bitset shards;
+//   - concurrent when the worst-case bitset for the input fits in half of
+//     the available memory;
+//   - bucket otherwise, which needs only a few MB plus temp disk;
+//   - extsort where even bucket's smallest plan, as registered with
+//     RegisterMinMem, does not fit, its runs scaled down to the memory;
+//     below extsort's own smallest plan the count then fails with
+//     ErrMemBudget.
+func Select(fileSize, availMem int64) Selection {
+	return SelectBudget(fileSize, availMem, 0)
+}
+
+// SelectBudget is Select with a memory budget: maxMem, when set and below
+// the available memory, is what the engine has to fit in.
+func SelectBudget(fileSize, availMem, maxMem int64) Selection {
+	return selectBudget(fileSize, availMem, maxMem, Options{})
+}
+
+// selectBudget is SelectBudget weighing the engines' smallest plans with
+// opts.
+func selectBudget(fileSize, availMem, maxMem int64, opts Options) Selection {
+	sel := Selection{FileSize: fileSize, AvailMem: availMem, MaxMem: maxMem}
+	mem := availMem
+	if mem <= 0 {
+		mem = defaultAvailMem
+	}
+	label := memLabel(availMem)
+	if maxMem > 0 && maxMem < mem {
+		mem = maxMem
+		label = "the " + FormatBytes(maxMem) + " budget"
+	}
+
+	// Every line can be a new address in a different shard, up to the
+	// full bitset
+	worst := WorstCase(fileSize)
+	naive, bitset := worst.NaiveMem(), worst.BitsetMem()
+	bucketMin, known := MinMem("bucket", opts)
+
+	switch {
+	case fileSize < naiveMaxFileSize && naive <= mem/2:
+		sel.Engine = "naive"
+		sel.Reason = fmt.Sprintf("file %s is below %s", FormatBytes(fileSize), FormatBytes(naiveMaxFileSize))
+	case bitset <= mem/2:
+		sel.Engine = "concurrent"
+		sel.Reason = fmt.Sprintf("worst-case bitset %s fits in half of %s", FormatBytes(bitset), label)
+	case known && mem < bucketMin:
+		sel.Engine = "extsort"
+		sel.Reason = fmt.Sprintf("worst-case bitset %s exceeds half of %s, below the bucket engine's smallest plan %s", FormatBytes(bitset), label, FormatBytes(bucketMin))
+	default:
+		sel.Engine = "bucket"
+		sel.Reason = fmt.Sprintf("worst-case bitset %s exceeds half of %s", FormatBytes(bitset), label)
+	}
+	return sel
+}
+
+func memLabel(availMem int64) string {
+	if availMem <= 0 {
+		return "assumed " + FormatBytes(defaultAvailMem) + " memory"
+	}
+	return "available " + FormatBytes(availMem) + " memory"
+}
+
+// FormatBytes renders n with a binary unit suffix, e.g. "512.0 MiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// selectUnknown picks an engine for an input whose size is unknown until
+// it has been read: the configured stream engine, or else whatever a huge
+// file would get, since naive's map could grow without bound.
+func (a *Auto) selectUnknown() Selection {
+	if e := a.opts.StreamEngine; e != "" {
+		return Selection{Engine: e, Reason: "input size unknown, -stream-engine " + e, FileSize: -1, MaxMem: a.opts.MaxMem}
+	}
+	sel := selectBudget(unknownSize, AvailableMemory(), a.opts.MaxMem, a.opts)
+	sel.FileSize = -1
+	sel.Reason = "input size unknown; " + sel.Reason
+	return sel
+}
+
+// Auto is a Counter that picks naive, concurrent, bucket or extsort per
+// input. Extsort must be registered, as importing ipcount does.
+type Auto struct {
+	opts   Options
+	last   Selection
+	engine Counter // the engine of the last count
+}
+
+// CountUniqueIPs selects an engine for filename and runs it.
+func (a *Auto) CountUniqueIPs(filename string) (int64, error) {
+	return a.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation.
+func (a *Auto) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	size, err := InputSize(filename)
+	if err != nil {
+		return 0, err
+	}
+	a.last = a.Plan(size)
+	a.checkpointable()
+	c, err := a.newEngine()
+	if err != nil {
+		return 0, err
+	}
+	n, err := Count(ctx, c, filename)
+	a.noteFallback(c)
+	return n, err
+}
+
+// CountReader selects an engine for a stream and runs it. The size comes
+// from r's Size method when it has one; a stream of unknown size gets
+// concurrent or bucket, as a pipe does.
+func (a *Auto) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	if s, ok := r.(interface{ Size() int64 }); ok && s.Size() >= 0 {
+		a.last = selectBudget(s.Size(), AvailableMemory(), a.opts.MaxMem, a.opts)
+	} else {
+		a.last = a.selectUnknown()
+	}
+	a.checkpointable()
+	c, err := a.newEngine()
+	if err != nil {
+		return 0, err
+	}
+	rc, ok := c.(ReaderCounter)
+	if !ok {
+		return 0, fmt.Errorf("%s cannot count a stream", a.last.Engine)
+	}
+	n, err := rc.CountReader(ctx, r)
+	a.noteFallback(c)
+	return n, err
+}
+
+// CountParallel selects an engine for the combined size of inputs and
+// counts their union with it. Naive cannot share its set between readers,
+// so where it would be picked concurrent runs instead.
+func (a *Auto) CountParallel(ctx context.Context, inputs []Input, parallel int) (int64, error) {
+	size := int64(0)
+	for _, in := range inputs {
+		if in.Size < 0 {
+			size = -1
+			break
+		}
+		size += in.Size
+	}
+	a.last = a.Plan(size)
+	a.replaceNaive("naive cannot read inputs in parallel")
+	a.checkpointable()
+	c, err := a.newEngine()
+	if err != nil {
+		return 0, err
+	}
+	pc, ok := c.(ParallelCounter)
+	if !ok {
+		return 0, fmt.Errorf("%s cannot count inputs in parallel", a.last.Engine)
+	}
+	return pc.CountParallel(ctx, inputs, parallel)
+}
+
+// replaceNaive runs concurrent instead where naive was selected, for the
+// reason why.
+func (a *Auto) replaceNaive(why string) {
+	if a.last.Engine == "naive" {
+		a.last.Engine = "concurrent"
+		a.last.Reason += "; " + why
+	}
+}
+
+// checkpointable makes sure the selected engine writes the checkpoints
+// Options.Checkpoint asks for, which naive does not.
+func (a *Auto) checkpointable() {
+	if a.opts.Checkpoint.Every > 0 {
+		a.replaceNaive("naive has no -checkpoint-every")
+	}
+}
+
+// newEngine builds the selected engine and logs the choice. Concurrent
+// comes wrapped in a Fallback with Options.AutoFallback.
+func (a *Auto) newEngine() (Counter, error) {
+	Logger(a.opts.Logger).Info("auto selected engine", "engine", a.last.Engine, "reason", a.last.Reason)
+	var err error
+	if a.last.Engine == "concurrent" && a.opts.AutoFallback {
+		a.engine = NewFallback(a.opts)
+	} else if a.engine, err = NewWithOptions(a.last.Engine, a.opts); err != nil {
+		return nil, err
+	}
+	return a.engine, nil
+}
+
+// Sources returns what each source contributed to the last count, when
+// the engine that ran tallies its sources; nil otherwise.
+func (a *Auto) Sources() []SourceTally {
+	if sc, ok := a.engine.(SourceCounter); ok {
+		return sc.Sources()
+	}
+	return nil
+}
+
+// noteFallback records in the selection that c, the engine just run, went
+// over the memory budget and fell back to bucket.
+func (a *Auto) noteFallback(c Counter) {
+	if f, ok := c.(*Fallback); ok && f.FellBack() {
+		a.last.Engine = "bucket"
+		a.last.Reason += "; concurrent went over the memory budget and fell back"
+	}
+}
+
+// Plan returns the selection for an input of size bytes, -1 when unknown,
+// without counting anything.
+func (a *Auto) Plan(size int64) Selection {
+	if size < 0 {
+		return a.selectUnknown()
+	}
+	return selectBudget(size, AvailableMemory(), a.opts.MaxMem, a.opts)
+}
+
+// Selection returns the decision made by the last CountUniqueIPs call.
+func (a *Auto) Selection() Selection {
+	return a.last
+}
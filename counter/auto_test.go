@@ -0,0 +1,89 @@
+package counter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/counter"
+	_ "github.com/Sveta-1999/IPCounter/extsort"
+)
+
+// The budget picks the engine: naive and concurrent while their worst
+// case fits in half of it, bucket down to its smallest plan and extsort
+// below that, whether the budget is -max-mem or what is available.
+func TestSelectBudget(t *testing.T) {
+	bucketMin, ok := counter.MinMem("bucket", counter.Options{})
+	extsortMin, ok2 := counter.MinMem("extsort", counter.Options{})
+	if !ok || !ok2 || extsortMin >= bucketMin {
+		t.Fatalf("smallest plans: bucket %d (%t), extsort %d (%t)", bucketMin, ok, extsortMin, ok2)
+	}
+	const big = 10 << 30
+	for _, tc := range []struct {
+		name             string
+		size, avail, max int64
+		want             string
+	}{
+		{"small file", 1 << 20, 0, 0, "naive"},
+		{"bitset fits the budget", big, 64 << 30, 2 << 30, "concurrent"},
+		{"bitset fits the memory", big, 2 << 30, 0, "concurrent"},
+		{"bitset over the budget", big, 64 << 30, 256 << 20, "bucket"},
+		{"bucket's smallest plan", big, 64 << 30, bucketMin, "bucket"},
+		{"below bucket's smallest plan", big, 64 << 30, bucketMin - 1, "extsort"},
+		{"memory below bucket's plan", big, bucketMin - 1, 0, "extsort"},
+		{"extsort's smallest plan", big, 0, extsortMin, "extsort"},
+		{"below every plan", big, 0, extsortMin - 1, "extsort"},
+		{"budget above the memory", big, 256 << 20, 2 << 30, "bucket"},
+	} {
+		if got := counter.SelectBudget(tc.size, tc.avail, tc.max); got.Engine != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// sized is a stream that claims to be size bytes long.
+type sized struct {
+	io.Reader
+	size int64
+}
+
+func (s sized) Size() int64 { return s.size }
+
+// Under a budget too small for bucket auto counts with extsort, and under
+// one too small for extsort too it fails with ErrMemBudget.
+func TestAutoSmallBudget(t *testing.T) {
+	extsortMin, _ := counter.MinMem("extsort", counter.Options{})
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	input := sized{strings.NewReader("1.2.3.4\n5.6.7.8\n1.2.3.4\n"), 10 << 30}
+
+	c, _ := counter.NewWithOptions("auto", counter.Options{MaxMem: extsortMin, TempDir: t.TempDir(), Logger: log})
+	n, err := c.(counter.ReaderCounter).CountReader(context.Background(), input)
+	if err != nil || n != 2 {
+		t.Errorf("at extsort's smallest plan: %d, %v; want 2", n, err)
+	}
+	if sel := c.(*counter.Auto).Selection(); sel.Engine != "extsort" {
+		t.Errorf("at extsort's smallest plan: picked %s", sel)
+	}
+
+	c, _ = counter.NewWithOptions("auto", counter.Options{MaxMem: extsortMin - 1, TempDir: t.TempDir(), Logger: log})
+	if _, err := c.(counter.ReaderCounter).CountReader(context.Background(), input); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("below every plan: %v, want ErrMemBudget", err)
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte("1.2.3.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 10<<30); err != nil { // sparse, too big for naive
+		t.Fatal(err)
+	}
+	c, _ = counter.NewWithOptions("auto", counter.Options{MaxMem: extsortMin - 1, TempDir: t.TempDir(), Logger: log})
+	if _, err := c.CountUniqueIPs(path); !errors.Is(err, counter.ErrMemBudget) || errors.Is(err, counter.ErrRead) {
+		t.Errorf("a file below every plan: %v, want ErrMemBudget and no read error", err)
+	}
+}
@@ -0,0 +1,68 @@
+package counter
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const blankReadSize = 64 << 10 // bytes BlankFile reads at a time
+
+// BlankFile reports whether the regular file f holds no address at all,
+// being empty or nothing but whitespace and delim bytes, and if so how
+// many lines it has. It reads with ReadAt, leaving f's offset alone, and
+// stops at the first byte that could start an address, so for any other
+// file it costs one small read. A file that is not regular, such as a
+// pipe, is never blank.
+func BlankFile(f *os.File, delim byte) (lines int64, blank bool, err error) {
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		return 0, false, err
+	}
+	buf := make([]byte, min(st.Size(), blankReadSize))
+	var off int64
+	last := delim
+	for {
+		n, err := f.ReadAt(buf, off)
+		for _, c := range buf[:n] {
+			switch c {
+			case delim:
+				lines++
+			case ' ', '\t', '\r', '\n', '\v', '\f':
+			default:
+				return 0, false, nil
+			}
+			last = c
+		}
+		off += int64(n)
+		if errors.Is(err, io.EOF) || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if off > 0 && last != delim {
+		lines++ // the last line has no delimiter
+	}
+	return lines, true, nil
+}
+
+// NoteBlank records that an engine skipped a blank input of lines lines,
+// 0 for an empty one, in stats and in p's line counters, as if each line
+// had been read and found empty.
+func NoteBlank(stats *Stats, p utils.ParseOptions, lines int64) {
+	if lines == 0 {
+		stats.Set("input", "empty, nothing to count")
+	} else {
+		stats.Set("input", "%d blank lines, nothing to count", lines)
+	}
+	if p.Lines != nil {
+		p.Lines.Add(lines)
+	}
+	if p.Relaxed != nil {
+		p.Relaxed.Blank.Add(lines)
+	}
+}
@@ -0,0 +1,329 @@
+package counter
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Checkpoint configures -checkpoint-every: an engine writes its running
+// unique count each time the input it has processed passes another
+// multiple of Every lines, or bytes with Bytes, so a long run can be
+// plotted as it goes. The final count is unaffected.
+type Checkpoint struct {
+	Every int64     // lines or bytes between snapshots, 0 for none
+	Bytes bool      // Every counts bytes instead of lines
+	Out   io.Writer // receives one "lines=N unique=M" line per snapshot, nil for os.Stderr
+
+	// Curve writes the snapshots as CSV for plotting a saturation curve:
+	// a "lines_processed,cumulative_unique" header (bytes_processed with
+	// Bytes, cumulative_unique_estimate for estimates), a row per
+	// snapshot and, once the engine calls Finish, a row for the whole
+	// input.
+	Curve bool
+
+	// Shares asks for the running count at these shares of the input,
+	// ascending in (0, 1], such as 0.01, 0.1 and 0.5, to see how
+	// front-loaded it is. Once the engine calls Finish, Table receives
+	// them as "percent_of_file,unique_so_far,percent_of_final_uniques"
+	// CSV rows, nil for os.Stderr. The shares are of the input's bytes
+	// when the engine knows its size, as of a plain file, and of its
+	// lines otherwise.
+	Shares []float64
+	Table  io.Writer
+}
+
+// Metered reports whether cp asks for running counts of any kind.
+func (cp Checkpoint) Metered() bool {
+	return cp.Every > 0 || len(cp.Shares) > 0
+}
+
+// ParseCheckpoint parses a -checkpoint-every value: a plain number of
+// lines, such as 100000000, or a size with a unit, such as 1GB, for bytes.
+// An empty value or 0 means no checkpoints.
+func ParseCheckpoint(s string) (Checkpoint, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Checkpoint{}, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 {
+			return Checkpoint{}, fmt.Errorf("checkpoint interval must not be negative, got %d", n)
+		}
+		return Checkpoint{Every: n}, nil
+	}
+	n, err := ParseBytes(s)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	return Checkpoint{Every: n, Bytes: n > 0}, nil
+}
+
+// ParseShares parses a -uniques-at value: a comma-separated list of
+// percentages of the input, such as "1,10,50", into ascending shares.
+func ParseShares(s string) ([]float64, error) {
+	var shares []float64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(strings.TrimSuffix(f, "%"), 64)
+		if err != nil || !(p > 0 && p <= 100) {
+			return nil, fmt.Errorf("percentage must be above 0 and at most 100, got %q", f)
+		}
+		shares = append(shares, p/100)
+	}
+	slices.Sort(shares)
+	return slices.Compact(shares), nil
+}
+
+// Meter counts processed input toward checkpoints and writes a snapshot
+// at each one. Workers add what they have processed once per chunk; the
+// worker that crosses a checkpoint writes it, with the input processed so
+// far, which is the first chunk boundary past the checkpoint rather than
+// the checkpoint itself. Safe for concurrent use; a nil *Meter does
+// nothing, so engines can call Add unconditionally.
+type Meter struct {
+	every  int64
+	bytes  bool
+	out    io.Writer
+	label  string       // "unique", or "unique_estimate" for estimates
+	unique func() int64 // the running count
+	done   atomic.Int64 // lines or bytes processed
+	next   atomic.Int64 // next checkpoint
+	mu     sync.Mutex   // serializes snapshots so they come out in order
+
+	curve bool  // CSV rows, see Checkpoint.Curve
+	rows  bool  // the header and at least one row are written
+	last  int64 // done at the last row
+
+	shares *shareMarks // Checkpoint.Shares, nil for none
+}
+
+// maxMarks bounds the running counts kept for shares of lines; past it
+// every other one is dropped and the rest are kept twice as far apart.
+const maxMarks = 1024
+
+// shareMarks records the running count at Checkpoint.Shares of the input.
+// With the input's size the marks are taken as the bytes processed past
+// each share of it; without, they are taken every step lines, thinned out
+// as the input grows, and Finish picks the first one at or past each
+// share of the lines there turned out to be.
+type shareMarks struct {
+	at       []float64
+	out      io.Writer
+	size     int64        // input bytes, 0 for shares of lines
+	inFlight int64        // input bytes a mark may be early or late by, 0 for exact
+	done     atomic.Int64 // bytes processed with size, lines without
+	next     atomic.Int64 // done at the next mark
+	step     int64        // lines between marks without size
+	marks    []mark
+}
+
+// mark is the running count with done processed.
+type mark struct{ done, unique int64 }
+
+// NewMeter returns a Meter for cp reporting unique, or nil when cp asks
+// for no running counts. With estimate the snapshots are labelled as
+// estimates.
+func NewMeter(cp Checkpoint, unique func() int64, estimate bool) *Meter {
+	if !cp.Metered() {
+		return nil
+	}
+	m := &Meter{every: cp.Every, bytes: cp.Bytes, out: cp.Out, label: "unique", unique: unique, curve: cp.Curve}
+	if m.out == nil {
+		m.out = os.Stderr
+	}
+	if len(cp.Shares) > 0 {
+		m.shares = &shareMarks{at: cp.Shares, out: cmp.Or[io.Writer](cp.Table, os.Stderr), step: 1}
+		m.shares.next.Store(1)
+	}
+	if estimate {
+		m.label = "unique_estimate"
+	}
+	m.next.Store(cp.Every)
+	return m
+}
+
+// Bytes reports whether m counts bytes, so callers can skip counting lines.
+func (m *Meter) Bytes() bool {
+	return m != nil && (m.bytes || m.every == 0) && (m.shares == nil || m.shares.size > 0)
+}
+
+// SetSize tells m the input is size bytes, so the shares are of its
+// bytes rather than its lines. Engines call it before adding anything,
+// when they know the size.
+func (m *Meter) SetSize(size int64) {
+	if m == nil || m.shares == nil || size <= 0 {
+		return
+	}
+	m.shares.size = size
+	m.shares.next.Store(m.shares.point(0))
+}
+
+// SetInFlight tells m that a share's count may be early or late by up to
+// n bytes of input processed out of order, for engines whose workers
+// finish chunks out of order.
+func (m *Meter) SetInFlight(n int64) {
+	if m != nil && m.shares != nil {
+		m.shares.inFlight = n
+	}
+}
+
+// Add records lines and bytes of processed input and writes a snapshot if
+// that passes the next checkpoint.
+func (m *Meter) Add(lines, bytes int64) {
+	if m == nil {
+		return
+	}
+	if m.shares != nil {
+		m.addShares(lines, bytes)
+	}
+	if m.every == 0 {
+		return
+	}
+	n := lines
+	if m.bytes {
+		n = bytes
+	}
+	if m.done.Add(n) < m.next.Load() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	done := m.done.Load()
+	if done < m.next.Load() {
+		return // another worker wrote this one
+	}
+	m.snapshot(done)
+	m.next.Store((done/m.every + 1) * m.every)
+}
+
+// addShares records the running count at the shares lines and bytes of
+// processed input pass.
+func (m *Meter) addShares(lines, bytes int64) {
+	sh := m.shares
+	n := lines
+	if sh.size > 0 {
+		n = bytes
+	}
+	if sh.done.Add(n) < sh.next.Load() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	done := sh.done.Load()
+	if done < sh.next.Load() {
+		return // another worker took this one
+	}
+	unique := m.unique()
+	if sh.size > 0 {
+		for len(sh.marks) < len(sh.at) && done >= sh.point(len(sh.marks)) {
+			sh.marks = append(sh.marks, mark{done, unique})
+		}
+		sh.next.Store(sh.point(len(sh.marks)))
+		return
+	}
+	if sh.marks = append(sh.marks, mark{done, unique}); len(sh.marks) == maxMarks {
+		for i := range maxMarks / 2 {
+			sh.marks[i] = sh.marks[2*i+1]
+		}
+		sh.marks = sh.marks[:maxMarks/2]
+		sh.step *= 2
+	}
+	sh.next.Store(done + sh.step)
+}
+
+// point returns the bytes processed at share i of the input, past the
+// last share for none.
+func (sh *shareMarks) point(i int) int64 {
+	if i >= len(sh.at) {
+		return math.MaxInt64
+	}
+	return max(1, int64(math.Ceil(sh.at[i]*float64(sh.size))))
+}
+
+// Finish writes a curve's last row, for all the input processed, unless
+// the last snapshot already covers it, and the shares' table. Engines
+// call it once the run's input is all processed, when the running count
+// is final. It does nothing for plain checkpoints.
+func (m *Meter) Finish() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shares != nil {
+		m.shares.table(m.unique(), m.label)
+	}
+	if !m.curve {
+		return
+	}
+	if done := m.done.Load(); !m.rows || done != m.last {
+		m.snapshot(done)
+	}
+}
+
+// table writes the running count at each share against final, the count
+// of the whole input, after comments on what the shares are of and how
+// far off a mark may be.
+func (sh *shareMarks) table(final int64, label string) {
+	done := sh.done.Load()
+	if sh.size == 0 {
+		fmt.Fprintf(sh.out, "# shares of the %d lines, the input's size being unknown", done)
+		if sh.step > 1 {
+			fmt.Fprintf(sh.out, "; counts are kept every %d lines, so a row may be that late", sh.step)
+		}
+		fmt.Fprintln(sh.out)
+	}
+	if sh.inFlight > 0 {
+		fmt.Fprintf(sh.out, "# taken as chunks finish out of order: a row may be early or late by up to %s of input\n", FormatBytes(sh.inFlight))
+	}
+	if label == "unique" {
+		fmt.Fprintln(sh.out, "percent_of_file,unique_so_far,percent_of_final_uniques")
+	} else {
+		fmt.Fprintf(sh.out, "percent_of_file,%s_so_far,percent_of_final_%s\n", label, label)
+	}
+	for i, at := range sh.at {
+		unique := final
+		if sh.size > 0 && i < len(sh.marks) {
+			unique = sh.marks[i].unique
+		} else if sh.size == 0 {
+			point := int64(math.Ceil(at * float64(done)))
+			if j := sort.Search(len(sh.marks), func(j int) bool { return sh.marks[j].done >= point }); j < len(sh.marks) {
+				unique = sh.marks[j].unique
+			}
+		}
+		percent := 100.0
+		if final > 0 {
+			percent = 100 * float64(unique) / float64(final)
+		}
+		fmt.Fprintf(sh.out, "%s,%d,%.2f\n", strconv.FormatFloat(100*at, 'f', -1, 64), unique, percent)
+	}
+}
+
+// snapshot writes the count at done processed; m.mu is held.
+func (m *Meter) snapshot(done int64) {
+	unit := "lines"
+	if m.bytes {
+		unit = "bytes"
+	}
+	if !m.curve {
+		fmt.Fprintf(m.out, "%s=%d %s=%d\n", unit, done, m.label, m.unique())
+		return
+	}
+	if !m.rows {
+		fmt.Fprintf(m.out, "%s_processed,cumulative_%s\n", unit, m.label)
+		m.rows = true
+	}
+	fmt.Fprintf(m.out, "%d,%d\n", done, m.unique())
+	m.last = done
+}
@@ -0,0 +1,83 @@
+package counter_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/Sveta-1999/IPCounter/bucket"
+	_ "github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Counting a file where every address comes twice in a row, one worker
+// writes a snapshot at the first chunk boundary past each multiple of
+// Every lines, showing exactly half the lines so far as unique; the curve
+// ends in a row for the whole input, and the count itself is what it is
+// without checkpoints. Bucket's pass 1 labels its snapshots estimates.
+func TestCheckpointEvery(t *testing.T) {
+	const lines = 40000
+	var b strings.Builder
+	for i := range lines {
+		b.WriteString(utils.FormatIPv4(uint32(i/2)*2654435761) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	count := func(engine string, cp counter.Checkpoint) int64 {
+		t.Helper()
+		c, err := counter.NewWithOptions(engine, counter.Options{
+			Workers: 1, ChunkSize: 4096, Checkpoint: cp, TempDir: t.TempDir(), Logger: discard,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.CountUniqueIPs(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	var out bytes.Buffer
+	if n := count("concurrent", counter.Checkpoint{Every: 5000, Out: &out}); n != lines/2 {
+		t.Errorf("count with checkpoints: %d, want %d", n, lines/2)
+	}
+	snaps := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(snaps) != lines/5000 {
+		t.Errorf("%d snapshots, want %d:\n%s", len(snaps), lines/5000, out.String())
+	}
+	prev := int64(0)
+	for i, s := range snaps {
+		var done, unique int64
+		if _, err := fmt.Sscanf(s, "lines=%d unique=%d", &done, &unique); err != nil {
+			t.Fatalf("snapshot %q: %v", s, err)
+		}
+		if done < int64(i+1)*5000 || done >= int64(i+1)*5000+4096/8 || done <= prev || unique != (done+1)/2 {
+			t.Errorf("snapshot %d: %q", i, s)
+		}
+		prev = done
+	}
+
+	out.Reset()
+	count("concurrent", counter.Checkpoint{Every: 15000, Out: &out, Curve: true})
+	rows := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if rows[0] != "lines_processed,cumulative_unique" || len(rows) != 4 || rows[3] != fmt.Sprintf("%d,%d", lines, lines/2) {
+		t.Errorf("curve:\n%s", out.String())
+	}
+
+	out.Reset()
+	count("bucket", counter.Checkpoint{Every: 10000, Out: &out})
+	// Pass 1 reads in larger pieces, here the whole input at once
+	if snaps := strings.Split(strings.TrimSpace(out.String()), "\n"); !strings.HasPrefix(snaps[len(snaps)-1], fmt.Sprintf("lines=%d unique_estimate=", lines)) {
+		t.Errorf("bucket snapshots:\n%s", out.String())
+	}
+}
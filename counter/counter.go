@@ -0,0 +1,293 @@
+// Package counter defines the common interface of the unique-IP counting
+// engines and a registry so the CLI (and external users) can select an
+// engine by name. Engines register themselves from their init functions.
+package counter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Counter counts distinct IPv4 addresses in a file.
+type Counter interface {
+	CountUniqueIPs(filename string) (int64, error)
+}
+
+// ContextCounter is a Counter that stops early, releasing its goroutines
+// and temp files, once ctx is canceled. It then returns ctx.Err().
+type ContextCounter interface {
+	Counter
+	CountUniqueIPsContext(ctx context.Context, filename string) (int64, error)
+}
+
+// ReaderCounter is a Counter that can also count a stream, such as an
+// HTTP response body, that cannot be reopened or mapped.
+type ReaderCounter interface {
+	Counter
+	CountReader(ctx context.Context, r io.Reader) (int64, error)
+}
+
+// Estimator is a Counter whose result is an estimate rather than an exact
+// count, such as the linear engine.
+type Estimator interface {
+	Counter
+	// StdError returns the standard error of the last count.
+	StdError() float64
+}
+
+// Count runs c on filename, honoring ctx when c is a ContextCounter.
+func Count(ctx context.Context, c Counter, filename string) (int64, error) {
+	if cc, ok := c.(ContextCounter); ok {
+		return cc.CountUniqueIPsContext(ctx, filename)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.CountUniqueIPs(filename)
+}
+
+// Options carries engine-independent settings to a Factory. Engines ignore
+// fields that do not apply to them.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+	Mmap    bool               // concurrent: read the input through a memory map
+	NoCache bool               // naive, concurrent, bucket, pair: drop input and spill file pages from the page cache once read
+	Fsync   bool               // naive, kmv, bucket: fsync spill, manifest and output files before closing them; concurrent: the stream dump at each flush point
+
+	// VerifyCount makes concurrent and bucket recount their sets by
+	// popcount once the input is read and fail with ErrCountMismatch if
+	// that differs from the count kept as addresses were added.
+	VerifyCount bool
+
+	// StreamEngine is what auto runs on an input of unknown size, such as
+	// a pipe: concurrent or bucket, "" to pick by memory as if it were
+	// huge.
+	StreamEngine string
+
+	ChunkSize  int // concurrent, roaring, extsort, hll: bytes handed to a worker at a time, 0 for the default
+	QueueDepth int // concurrent, roaring, extsort, hll: read chunks waiting for a worker, 0 for two per worker
+	Workers    int // concurrent, adaptive, kmv, hll, roaring, extsort, bucket pass 1: goroutines parsing the input, 0 for one per CPU
+
+	// PoolJob, set by Pool.Count, makes concurrent parse on the pool's
+	// workers instead of its own and reserve its shards from the pool.
+	PoolJob *PoolJob
+
+	Segmented  bool   // concurrent: each worker reads its own byte range
+	Bitset     string // concurrent: auto|shared|local bitset mode
+	NUMAGroups int    // concurrent: worker groups with bitsets of their own, -1 for one per NUMA node, 0 or 1 for none
+	Shards     int    // concurrent: bitset partitions, 0 for the default
+	ShardStats bool   // concurrent: report how the set spreads over the shards with Stats
+	Record     string // concurrent: write a trace of the run's chunks to this file for replaying
+	StateFile  string // concurrent: persistent bitset file of addresses ever seen
+	Preload    string // concurrent: list of known addresses set before counting, so counts are of new ones
+	StreamDump string // concurrent: append each address to this file as it is first set, with flush points
+	ResumeDump bool   // concurrent: set the addresses of StreamDump before counting and append to it
+
+	// AddressSpace, if valid, is the IPv4 block every address is in, such
+	// as 100.64.0.0/10: concurrent sizes its bitset to it and treats
+	// addresses outside it as invalid.
+	AddressSpace netip.Prefix
+
+	BitsetFile string // concurrent: map the bitset over a scratch file created here, "" for the heap
+	BitsetSwap bool   // concurrent: map the bitset as anonymous memory the kernel may swap out
+
+	// InputFormat is text, or binary-be or binary-le for packed 4-byte
+	// addresses, which only concurrent reads; "" means text. Strict
+	// makes a trailing partial binary record an error, not a warning;
+	// for text, the CLI fails a count whose Parse.Malformed is not empty.
+	InputFormat string
+	Strict      bool
+
+	Checkpoint  Checkpoint // concurrent, bucket: running counts every so many lines or bytes
+	PrefixSweep []int      // concurrent, bucket: prefix lengths to count distinct prefixes of, see PrefixSweeper
+	Density     bool       // concurrent, bucket: keep per-/24 counts for DensityMapper
+
+	SubsampleRates []float64 // concurrent, bucket: rates of by-address subsamples to count, see Subsampler
+
+	SketchBits      int    // linear: log2 of the bitmap size, 0 for the default
+	SketchK         int    // kmv: hash values kept, 0 for the default
+	SketchPrecision int    // hll: log2 of the register count, 0 for the default
+	SketchOut       string // kmv: write the final sketch to this file
+	FirstSeen       string // naive: write each distinct address and the byte offset of its first line to this file
+
+	AdaptiveThreshold int // adaptive: hash set entries before switching to the bitset, 0 for the default
+
+	Window      time.Duration   // window: length of a window, 0 for one hour
+	WindowLag   time.Duration   // window: out-of-order tolerance, 0 for one window
+	WindowSlide time.Duration   // window: step of a sliding window, 0 for tiled windows
+	TimeFormat  string          // window: timestamp format name or Go layout, "" for RFC3339
+	TimeField   int             // window: 1-based field holding the timestamp, 0 for the first
+	TimeExtract utils.Extractor // window: finds the timestamp in a line instead of TimeField, nil for none
+	Output      io.Writer       // window, group: receives the per-window or per-key rows, nil to discard
+
+	GroupColumn   int    // group: 1-based field holding the key, 0 for the first
+	Column        int    // group: 1-based field holding the address, 0 for the first other field
+	FieldSep      string // group, pair: field separator byte, "" for ','
+	MaxGroups     int    // group: distinct keys tracked, 0 for no cap
+	GroupOverflow string // group: error|other for keys past MaxGroups, "" for error
+
+	PairColumns   [2]int // pair: 1-based fields holding the source and destination, zero for 1 and 2
+	PairEndpoints bool   // pair: also count the distinct sources and destinations
+
+	Family string // ipv6: ipv6|any addresses counted, any for IPv4 as ::ffff:a.b.c.d too; "" for ipv6
+
+	SampleFraction float64 // sample: share of the file read, 0 for the default
+	SampleBlock    int     // sample: bytes per randomly placed read, 0 for the default
+	Seed           int64   // sample: seed for the block choice
+
+	BucketWorkers    int     // bucket, pair: buckets or partitions counted concurrently in pass 2, 0 for the default
+	BucketMaxMem     int64   // bucket: largest pass-2 bitset, picks the bucket count; 0 for 2 MB
+	BucketMemBuffer  int     // bucket, pair: bytes a bucket keeps in memory before spilling, 0 for the default, <0 to always spill
+	BucketDedupCache int     // bucket: written addresses each bucket remembers in pass 1 and skips writing again, 0 for the default, <0 for none
+	BucketPartition  string  // bucket: topbyte|hash assignment of addresses to buckets, "" for topbyte
+	BucketSplit      int64   // bucket: record bytes a bucket's file reaches before it is split by the next byte, 0 for the default, <0 to never split
+	BucketOpenFiles  int     // bucket: spill files pass 1 keeps open, buckets sharing files below the bucket count, 0 for as many as the open file limit allows
+	BucketSkewWarn   float64 // bucket: share of the records one bucket may hold before a warning, 0 for the default
+	BucketOverlap    bool    // bucket: count buckets in pass 2 while pass 1 is still closing the files of others
+	MinOccurrences   int     // bucket: count only addresses seen at least this many times, 0 or 1 for all
+	TopAddresses     int     // bucket: also list this many of the addresses seen most often, with their counts
+	MaxWriteRate     int64   // bucket, pair: bytes per second written to spill files, 0 for no cap
+
+	TempDir       string // bucket, pair, extsort: directory for spill files, "" for os.TempDir
+	SpaceCheck    string // bucket: warn|abort|off when the temp volume looks too small
+	SpillCompress string // bucket, pair: none|snappy|lz4|flate encoding of spill files
+	KeepBuckets   string // bucket: keep pass-1 files in this directory
+	FromBuckets   string // bucket: skip pass 1 and count the files kept here
+	ResumeBuckets string // bucket: checkpoint both passes in this directory and go on from a run that stopped there
+	ResumeEvery   int64  // bucket: input bytes between pass-1 checkpoints of ResumeBuckets, 0 for the default
+
+	// MaxMem is a memory budget in bytes, 0 for none. Auto picks an
+	// engine that fits, bucket and extsort size their buffers to it, and concurrent,
+	// adaptive, roaring, naive and reference fail with ErrMemBudget rather
+	// than grow past it.
+	MaxMem int64
+
+	// MemWatchdog makes concurrent sample its bitset shards plus the rest
+	// of the Go heap during a run and stop with ErrMemBudget once they
+	// pass MaxMem, or without one the memory the host had free when the
+	// run began. AutoFallback then, for auto and a forced concurrent
+	// through NewFallback, recounts an input that can be read again with
+	// bucket instead of failing.
+	MemWatchdog  bool
+	AutoFallback bool
+
+	// ReadRetries is how many times in a row naive, concurrent and bucket
+	// reopen a local input after a transient read error, and bucket
+	// retries a transient write to a spill file, 0 for none.
+	ReadRetries int
+
+	// MaxReadRate caps the bytes per second read from the inputs, 0 for
+	// none. The CLI applies it where it opens inputs, around whichever
+	// engine runs, so engines ignore it.
+	MaxReadRate int64
+
+	// Progress receives the input read and the unique count so far from
+	// every engine but sample, and the bucket engine's passes, for a
+	// report during the run; nil for none.
+	Progress *Progress
+
+	Stats *Stats // receives engine-specific statistics, nil to discard
+
+	// Logger receives warnings, samples of skipped lines, info-level
+	// summaries and debug-level phase events; nil for slog.Default().
+	Logger *slog.Logger
+}
+
+// ErrMemBudget is returned by engines that would exceed Options.MaxMem.
+var ErrMemBudget = errors.New("memory budget exceeded")
+
+// Factory builds a Counter from Options, failing on options the engine
+// cannot take.
+type Factory func(opts Options) (Counter, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+	minMems   = make(map[string]func(Options) int64)
+)
+
+// Register makes an engine available under name. It panics if name is
+// already registered or factory is nil.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if factory == nil {
+		panic("counter: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("counter: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// RegisterMinMem records how little memory the engine registered under
+// name can fit a count into with the given options, the smallest plan it
+// scales down to under Options.MaxMem, for auto to weigh budgets against.
+func RegisterMinMem(name string, minMem func(Options) int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	minMems[name] = minMem
+}
+
+// MinMem returns the least memory the engine registered under name needs
+// with opts, and false if it registered none.
+func MinMem(name string, opts Options) (int64, bool) {
+	mu.RLock()
+	minMem, ok := minMems[name]
+	mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	return minMem(opts), true
+}
+
+// New creates the engine registered under name with default options.
+func New(name string) (Counter, error) {
+	return NewWithOptions(name, Options{})
+}
+
+// NewWithOptions creates the engine registered under name.
+func NewWithOptions(name string, opts Options) (Counter, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown impl: %s", name)
+	}
+	return factory(opts)
+}
+
+// Names returns the registered engine names in sorted order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BinaryOrder returns the byte order of a binary InputFormat, or nil for
+// text.
+func BinaryOrder(format string) binary.ByteOrder {
+	switch format {
+	case "binary-be":
+		return binary.BigEndian
+	case "binary-le":
+		return binary.LittleEndian
+	}
+	return nil
+}
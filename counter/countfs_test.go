@@ -0,0 +1,51 @@
+package counter_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/Sveta-1999/IPCounter/bucket"
+	_ "github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	_ "github.com/Sveta-1999/IPCounter/naive"
+)
+
+// The engines that read an fs.FS count a file of one as they would the
+// same file on disk, and a name missing from it fails with an OpenError
+// for that name wrapping fs.ErrNotExist.
+func TestCountUniqueIPsFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"logs/a.txt": {Data: []byte(strings.Repeat("10.0.0.1\n192.168.1.1\r\n10.0.0.1\n", 500) + "8.8.8.8")},
+		"logs/b.txt": {Data: []byte("not an address\n1.2.3.4\n")},
+		"empty.txt":  {Data: nil},
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	type fsCounter interface {
+		CountUniqueIPsFS(fsys fs.FS, name string) (int64, error)
+	}
+	for _, name := range []string{"naive", "concurrent", "bucket"} {
+		c, err := counter.NewWithOptions(name, counter.Options{TempDir: t.TempDir(), Logger: discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fc, ok := c.(fsCounter)
+		if !ok {
+			t.Fatalf("%s does not count an fs.FS", name)
+		}
+		for file, want := range map[string]int64{"logs/a.txt": 3, "logs/b.txt": 1, "empty.txt": 0} {
+			if n, err := fc.CountUniqueIPsFS(fsys, file); err != nil || n != want {
+				t.Errorf("%s, %s: %d, %v; want %d", name, file, n, err, want)
+			}
+		}
+		_, err = fc.CountUniqueIPsFS(fsys, "logs/missing.txt")
+		var oe *counter.OpenError
+		if !errors.As(err, &oe) || oe.Path != "logs/missing.txt" || !errors.Is(err, fs.ErrNotExist) || !errors.Is(err, counter.ErrOpenInput) {
+			t.Errorf("%s, missing: %v", name, err)
+		}
+	}
+}
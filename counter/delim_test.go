@@ -0,0 +1,73 @@
+package counter_test
+
+import (
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/Sveta-1999/IPCounter/bucket"
+	_ "github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	_ "github.com/Sveta-1999/IPCounter/naive"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A million ';'-separated addresses on one physical line count in full
+// with RecordSep ";", in every way the engines read a file, without the
+// line tripping MaxLine; read as newline-separated, the same file is one
+// oversized line and counts nothing.
+func TestSemicolonLine(t *testing.T) {
+	rng := rand.New(rand.NewPCG(91, 92))
+	seen := map[uint32]bool{}
+	var b strings.Builder
+	for i := range 1000000 {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		ip := rng.Uint32() >> 10 // 4M addresses, so a good share repeat
+		seen[ip] = true
+		b.WriteString(utils.FormatIPv4(ip))
+	}
+	b.WriteString("\n")
+	path := filepath.Join(t.TempDir(), "one-line.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := int64(len(seen))
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, tc := range []struct {
+		name string
+		opts counter.Options
+	}{
+		{"naive", counter.Options{}},
+		{"concurrent", counter.Options{Workers: 4}},
+		{"concurrent", counter.Options{Workers: 4, Mmap: true}},
+		{"concurrent", counter.Options{Workers: 4, Segmented: true}},
+		{"bucket", counter.Options{}},
+	} {
+		opts := tc.opts
+		opts.Parse.RecordSep = ";"
+		opts.TempDir, opts.Logger = t.TempDir(), discard
+		c, err := counter.NewWithOptions(tc.name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := c.CountUniqueIPs(path); err != nil || n != want {
+			t.Errorf("%s %+v: %d, %v; want %d", tc.name, tc.opts, n, err, want)
+		}
+
+		opts.Parse.RecordSep = ""
+		c, err = counter.NewWithOptions(tc.name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := c.CountUniqueIPs(path); err != nil || n != 0 {
+			t.Errorf("%s %+v, newline-separated: %d, %v; want 0", tc.name, tc.opts, n, err)
+		}
+	}
+}
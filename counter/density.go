@@ -0,0 +1,90 @@
+package counter
+
+import (
+	"cmp"
+	"container/heap"
+	"net/netip"
+	"slices"
+)
+
+// Slash24s is the number of /24 blocks in the IPv4 space.
+const Slash24s = 1 << 24
+
+// DensityMapper is a Counter that can report, after a count with
+// Options.Density set, how many of the 256 addresses of every /24 its set
+// holds: a slice of Slash24s entries indexed by the block's top 24 bits.
+type DensityMapper interface {
+	Counter
+	Density() []uint16
+}
+
+// SubnetCount is the number of distinct addresses a set holds in one
+// prefix.
+type SubnetCount struct {
+	Prefix netip.Prefix
+	Unique int64
+}
+
+// TopSubnets sums density, per-/24 counts as a DensityMapper returns them,
+// into the prefixes of length bits, 1 to 24, and returns the n holding the
+// most distinct addresses, the busiest first and ties in address order, or
+// every prefix holding any for n 0. It also returns how many prefixes hold
+// any. Only the n kept are held in memory.
+func TopSubnets(density []uint16, bits, n int) ([]SubnetCount, int) {
+	shift := 24 - bits
+	var top subnetHeap
+	seen := 0
+	for p := range 1 << bits {
+		var unique int64
+		for _, d := range density[p<<shift : (p+1)<<shift] {
+			unique += int64(d)
+		}
+		if unique == 0 {
+			continue
+		}
+		seen++
+		e := subnetEntry{prefix: uint32(p), unique: unique}
+		switch {
+		case n == 0 || len(top) < n:
+			heap.Push(&top, e)
+		case top.less(top[0], e):
+			top[0] = e
+			heap.Fix(&top, 0)
+		}
+	}
+	slices.SortFunc(top, func(a, b subnetEntry) int {
+		return cmp.Or(cmp.Compare(b.unique, a.unique), cmp.Compare(a.prefix, b.prefix))
+	})
+	out := make([]SubnetCount, len(top))
+	for i, e := range top {
+		ip := e.prefix << (32 - bits)
+		addr := netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)})
+		out[i] = SubnetCount{Prefix: netip.PrefixFrom(addr, bits), Unique: e.unique}
+	}
+	return out, seen
+}
+
+// subnetEntry is a prefix by its index among those of its length.
+type subnetEntry struct {
+	prefix uint32
+	unique int64
+}
+
+// subnetHeap is a min-heap of the busiest prefixes seen so far, the least
+// busy of them, and of equals the highest, on top to be replaced.
+type subnetHeap []subnetEntry
+
+func (h subnetHeap) less(a, b subnetEntry) bool {
+	return a.unique < b.unique || (a.unique == b.unique && a.prefix > b.prefix)
+}
+
+func (h subnetHeap) Len() int           { return len(h) }
+func (h subnetHeap) Less(i, j int) bool { return h.less(h[i], h[j]) }
+func (h subnetHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *subnetHeap) Push(x any)        { *h = append(*h, x.(subnetEntry)) }
+func (h *subnetHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
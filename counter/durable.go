@@ -0,0 +1,72 @@
+package counter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Fsync flushes f to stable storage. Every durable write of the engines
+// and outputs goes through it, so tests can make it fail.
+var Fsync = (*os.File).Sync
+
+// SyncDir flushes the entries of dir, such as a file just created or
+// renamed into it, to stable storage. On Windows, which does not flush
+// directory handles, the open is all it checks.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = Fsync(d); dirSyncUnsupported(err) {
+		err = nil
+	}
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// WriteFileAtomic writes path through a temp file in the same directory,
+// renamed over path once write has returned and the file is closed, so
+// path never holds a partial result, even while it is being written or
+// after a crash; a failed write leaves whatever was there before. With
+// sync the temp file is fsynced before the rename and the directory
+// after it, so a completed write also survives losing power.
+func WriteFileAtomic(path string, sync bool, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // after a successful rename there is nothing left to remove
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && sync {
+		if err = Fsync(f); err != nil {
+			err = fmt.Errorf("fsync %s: %w", path, err)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	if sync {
+		if err := SyncDir(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("fsync %s: %w", filepath.Dir(path), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Categories of run failure, for errors.Is on whatever an engine's
+// CountUniqueIPs returns. An interrupted run returns ctx.Err(), so it is
+// matched with context.Canceled or context.DeadlineExceeded instead.
+var (
+	// ErrOpenInput matches an input that could not be opened or
+	// stat'ed; errors.As with *OpenError gives its path.
+	ErrOpenInput = errors.New("cannot open input")
+	// ErrRead matches an input that failed partway through; errors.As
+	// with *ReadError gives the path and byte offset when known.
+	ErrRead = errors.New("read failed")
+	// ErrSpill matches a failure to create, write or read back temp
+	// files, such as an unwritable or full temp directory.
+	ErrSpill = errors.New("spill failed")
+	// ErrCountMismatch matches a run whose running count disagreed with
+	// a recount of its set, as Options.VerifyCount checks; errors.As
+	// with *CountMismatchError gives both numbers.
+	ErrCountMismatch = errors.New("count mismatch")
+	// ErrNotText matches an input whose start does not look like text
+	// records, such as a binary file or a CSV without line breaks;
+	// errors.As with *NotTextError gives its path and why.
+	ErrNotText = errors.New("input is not delimited text")
+	// ErrMalformed matches a strict count of text input that skipped
+	// lines because they failed to parse; errors.As with
+	// *MalformedError gives how many.
+	ErrMalformed = errors.New("malformed lines in input")
+)
+
+// OpenError records an input that could not be opened.
+type OpenError struct {
+	Path string
+	Err  error
+}
+
+func (e *OpenError) Error() string { return "failed to open file: " + e.Err.Error() }
+
+func (e *OpenError) Unwrap() error { return e.Err }
+
+// Is makes an OpenError match ErrOpenInput.
+func (e *OpenError) Is(target error) bool { return target == ErrOpenInput }
+
+// ReadError records a read that failed after the input was opened.
+type ReadError struct {
+	Path   string // "" for a reader without a name
+	Offset int64  // bytes of the input read before the failure, -1 if unknown
+	Err    error
+}
+
+func (e *ReadError) Error() string {
+	if e.Offset < 0 {
+		return "read error: " + e.Err.Error()
+	}
+	return fmt.Sprintf("read error at byte %d: %v", e.Offset, e.Err)
+}
+
+func (e *ReadError) Unwrap() error { return e.Err }
+
+// Is makes a ReadError match ErrRead.
+func (e *ReadError) Is(target error) bool { return target == ErrRead }
+
+// CountMismatchError records a running count, kept as addresses were
+// added, that a recount of the set does not agree with: an address was
+// counted twice, or added without being counted. The result of such a
+// run cannot be trusted.
+type CountMismatchError struct {
+	Set     string // what was recounted, such as "bitset" or "bucket 17"
+	Counted int64  // the running count
+	Recount int64  // the addresses the set holds
+}
+
+func (e *CountMismatchError) Error() string {
+	return fmt.Sprintf("%s holds %d addresses, but %d were counted", e.Set, e.Recount, e.Counted)
+}
+
+// Is makes a CountMismatchError match ErrCountMismatch.
+func (e *CountMismatchError) Is(target error) bool { return target == ErrCountMismatch }
+
+// NotTextError records an input that was not counted because its start
+// does not look like text records ending in the delimiter.
+type NotTextError struct {
+	Path   string
+	Reason string // such as "only 31% of its first 64.0 KiB is text"
+}
+
+func (e *NotTextError) Error() string {
+	return fmt.Sprintf("%s does not look like newline-separated text: %s (did you mean -input-format binary-be or -delim?); -force-text counts it anyway",
+		e.Path, e.Reason)
+}
+
+// Is makes a NotTextError match ErrNotText.
+func (e *NotTextError) Is(target error) bool { return target == ErrNotText }
+
+// WrapRead returns err, from reading path, as a *ReadError with an
+// unknown offset. An err that already holds one, from a reader that knew
+// the offset, cancellation, ErrMemBudget and ErrSpill, which no read of
+// the input caused, are returned unchanged; a path missing from the held
+// one is filled in.
+func WrapRead(path string, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrMemBudget) || errors.Is(err, ErrSpill) {
+		return err
+	}
+	var re *ReadError
+	if errors.As(err, &re) {
+		if re.Path == "" {
+			re.Path = path
+		}
+		return err
+	}
+	return &ReadError{Path: path, Offset: -1, Err: err}
+}
+
+// MalformedError records a strict count that skipped lines which failed
+// to parse, so its count is not of the whole input.
+type MalformedError struct {
+	Lines int64 // lines skipped
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("%d lines failed to parse and were skipped", e.Lines)
+}
+
+// Is makes a MalformedError match ErrMalformed.
+func (e *MalformedError) Is(target error) bool { return target == ErrMalformed }
@@ -0,0 +1,135 @@
+package counter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/Sveta-1999/IPCounter/adaptive"
+	_ "github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	_ "github.com/Sveta-1999/IPCounter/group"
+	_ "github.com/Sveta-1999/IPCounter/hll"
+	_ "github.com/Sveta-1999/IPCounter/ipv6"
+	_ "github.com/Sveta-1999/IPCounter/kmv"
+	_ "github.com/Sveta-1999/IPCounter/linear"
+	_ "github.com/Sveta-1999/IPCounter/naive"
+	_ "github.com/Sveta-1999/IPCounter/pair"
+	_ "github.com/Sveta-1999/IPCounter/reference"
+	_ "github.com/Sveta-1999/IPCounter/roaring"
+	_ "github.com/Sveta-1999/IPCounter/sample"
+	"github.com/Sveta-1999/IPCounter/utils"
+	_ "github.com/Sveta-1999/IPCounter/window"
+)
+
+// errInjected is what brokenReader fails with.
+var errInjected = errors.New("injected read error")
+
+// brokenReader gives a few lines, then fails.
+type brokenReader struct {
+	lines *strings.Reader
+}
+
+func (r brokenReader) Read(p []byte) (int, error) {
+	if r.lines.Len() == 0 {
+		return 0, errInjected
+	}
+	return r.lines.Read(p)
+}
+
+// Each failure mode matches its sentinel and no other, in every engine
+// it applies to: a missing input ErrOpenInput with the path, a reader
+// failing partway ErrRead with the cause, a temp directory that cannot
+// be written ErrSpill, and a canceled count context.Canceled alone.
+func TestErrorCategories(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.txt")
+	if err := os.WriteFile(input, []byte(strings.Repeat("10.0.0.1\n10.0.0.2\n", 1000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	notDir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sentinels := []error{counter.ErrOpenInput, counter.ErrRead, counter.ErrSpill, context.Canceled}
+	only := func(err, want error) bool {
+		for _, s := range sentinels {
+			if errors.Is(err, s) != (s == want) {
+				return false
+			}
+		}
+		return true
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, name := range []string{"adaptive", "bucket", "concurrent", "extsort", "hll", "kmv", "linear", "naive", "reference", "roaring"} {
+		c, err := counter.NewWithOptions(name, counter.Options{TempDir: dir, Logger: discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing := filepath.Join(dir, "missing.txt")
+		_, err = c.CountUniqueIPs(missing)
+		var oe *counter.OpenError
+		if !only(err, counter.ErrOpenInput) || !errors.As(err, &oe) || oe.Path != missing || !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s, missing input: %v", name, err)
+		}
+
+		if rc, ok := c.(counter.ReaderCounter); ok {
+			_, err = rc.CountReader(context.Background(), brokenReader{strings.NewReader("10.0.0.1\n10.0.0.2\n")})
+			var re *counter.ReadError
+			if !only(err, counter.ErrRead) || !errors.As(err, &re) || !errors.Is(err, errInjected) {
+				t.Errorf("%s, failing reader: %v", name, err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err = counter.Count(ctx, c, input); !only(err, context.Canceled) {
+			t.Errorf("%s, canceled: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"bucket", "extsort"} {
+		c, err := counter.NewWithOptions(name, counter.Options{TempDir: notDir, Logger: discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.CountUniqueIPs(input); !only(err, counter.ErrSpill) {
+			t.Errorf("%s, temp dir a file: %v", name, err)
+		}
+	}
+}
+
+// Options an engine cannot take fail NewWithOptions with an error naming
+// the engine, and never panic, whether or not the CLI checked them first.
+func TestFactoryErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    counter.Options
+	}{
+		{"bucket", counter.Options{BucketMaxMem: 1}},
+		{"concurrent", counter.Options{Workers: -1}},
+		{"extsort", counter.Options{Workers: -1}},
+		{"group", counter.Options{GroupColumn: 2, Column: 2}},
+		{"hll", counter.Options{SketchPrecision: 1}},
+		{"ipv6", counter.Options{Parse: utils.ParseOptions{CIDR: true}}},
+		{"kmv", counter.Options{SketchK: 2}},
+		{"linear", counter.Options{SketchBits: 1}},
+		{"pair", counter.Options{PairColumns: [2]int{3, 3}}},
+		{"roaring", counter.Options{Workers: -1}},
+		{"sample", counter.Options{SampleFraction: 2}},
+		{"window", counter.Options{Window: -time.Hour}},
+	} {
+		c, err := counter.NewWithOptions(tc.name, tc.o)
+		if c != nil || err == nil || !strings.HasPrefix(err.Error(), tc.name+": ") {
+			t.Errorf("%s: %v, %v; want no counter and an error naming the engine", tc.name, c, err)
+		}
+	}
+}
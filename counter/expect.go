@@ -0,0 +1,94 @@
+package counter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrExpectation matches a count that differs from the one expected by
+// more than the tolerance; errors.As with *ExpectationError gives both.
+var ErrExpectation = errors.New("unique count differs from the expected count")
+
+// Expectation is the count a run should give, for regression checks
+// across a fleet: the same input counted by another build, engine or
+// host must count the same, or within a tolerance for an estimate.
+type Expectation struct {
+	Count int64
+
+	// Tolerance is how far the count may be from Count: with Relative a
+	// fraction of Count, such as 0.001 for 0.1%, otherwise a number of
+	// addresses. 0 means the counts must be equal.
+	Tolerance float64
+	Relative  bool
+}
+
+// ParseTolerance reads a tolerance such as "0.1%", a share of the
+// expected count, or "25", a number of addresses.
+func ParseTolerance(s string) (tolerance float64, relative bool, err error) {
+	num, relative := strings.CutSuffix(strings.TrimSpace(s), "%")
+	tolerance, err = strconv.ParseFloat(num, 64)
+	if err != nil || tolerance < 0 || math.IsInf(tolerance, 0) || math.IsNaN(tolerance) {
+		return 0, false, fmt.Errorf("tolerance must be a number of addresses or a percentage such as 0.1%%, got %q", s)
+	}
+	if relative {
+		tolerance /= 100
+	}
+	return tolerance, relative, nil
+}
+
+// Diff compares a count to the expected one.
+func (e Expectation) Diff(actual int64) ExpectationDiff {
+	d := ExpectationDiff{Expected: e.Count, Actual: actual, Delta: actual - e.Count}
+	if e.Count != 0 {
+		rel := float64(d.Delta) / float64(e.Count)
+		d.RelativeDelta = &rel
+	}
+	allowed := e.Tolerance
+	if e.Relative {
+		allowed *= float64(e.Count)
+	}
+	d.Tolerance = allowed
+	d.OK = math.Abs(float64(d.Delta)) <= allowed
+	return d
+}
+
+// Check returns an *ExpectationError when actual is further from the
+// expected count than the tolerance, and nil otherwise.
+func (e Expectation) Check(actual int64) error {
+	if d := e.Diff(actual); !d.OK {
+		return &ExpectationError{d}
+	}
+	return nil
+}
+
+// ExpectationDiff is how a count compares to the expected one, in the
+// form -result-file and scripts read.
+type ExpectationDiff struct {
+	Expected      int64    `json:"expected"`
+	Actual        int64    `json:"actual"`
+	Delta         int64    `json:"delta"`          // Actual - Expected
+	RelativeDelta *float64 `json:"relative_delta"` // Delta / Expected, nil when Expected is 0
+	Tolerance     float64  `json:"tolerance"`      // largest |Delta| allowed, in addresses
+	OK            bool     `json:"ok"`
+}
+
+// ExpectationError records a count further from the expected one than
+// the tolerance.
+type ExpectationError struct {
+	ExpectationDiff
+}
+
+func (e *ExpectationError) Error() string {
+	off := fmt.Sprintf("%+d", e.Delta)
+	if e.RelativeDelta != nil {
+		off += fmt.Sprintf(" (%+.4g%%)", 100**e.RelativeDelta)
+	}
+	return fmt.Sprintf("counted %d unique addresses, expected %d: off by %s, more than the %g allowed",
+		e.Actual, e.Expected, off, e.Tolerance)
+}
+
+// Is makes an ExpectationError match ErrExpectation.
+func (e *ExpectationError) Is(target error) bool { return target == ErrExpectation }
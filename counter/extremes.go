@@ -0,0 +1,39 @@
+package counter
+
+import "github.com/Sveta-1999/IPCounter/utils"
+
+// Extremes tracks, for -stats, the numerically smallest and largest
+// distinct addresses of a run and the first and last ones found new in
+// input order. Sequential engines feed it every new address as they find
+// it, so the results are exact. A nil *Extremes discards everything, so
+// engines can call Add unconditionally.
+type Extremes struct {
+	min, max    uint32
+	first, last uint32
+	seen        bool
+}
+
+// Add records ip, which the caller has just found new.
+func (e *Extremes) Add(ip uint32) {
+	if e == nil {
+		return
+	}
+	if !e.seen {
+		e.min, e.max, e.first, e.seen = ip, ip, ip, true
+	}
+	e.min = min(e.min, ip)
+	e.max = max(e.max, ip)
+	e.last = ip
+}
+
+// Report sets the four addresses in s as dotted quads, or nothing when no
+// address was added.
+func (e *Extremes) Report(s *Stats) {
+	if e == nil || !e.seen {
+		return
+	}
+	s.Set("min ip", "%s", utils.FormatIPv4(e.min))
+	s.Set("max ip", "%s", utils.FormatIPv4(e.max))
+	s.Set("first new ip", "%s", utils.FormatIPv4(e.first))
+	s.Set("last new ip", "%s", utils.FormatIPv4(e.last))
+}
@@ -0,0 +1,85 @@
+package counter_test
+
+import (
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	_ "github.com/Sveta-1999/IPCounter/naive"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The concurrent engine reports the same min, max and first new address
+// as the sequential naive engine whatever the workers and read mode, run
+// after run, and the same last new address when the input ends in one
+// seen nowhere else. Local bitsets find new addresses only when merging,
+// so they report no last one.
+func TestExtremesAcrossWorkers(t *testing.T) {
+	rng := rand.New(rand.NewPCG(101, 102))
+	pool := make([]uint32, 20000)
+	for i := range pool {
+		// In 10.0.0.0/8 and 16 of the default shards, which keeps the
+		// walks for min and max quick
+		pool[i] = 10<<24 | rng.Uint32()>>8&^0x3ff0
+	}
+	var b strings.Builder
+	for range 300000 {
+		b.WriteString(utils.FormatIPv4(pool[rng.IntN(len(pool))]) + "\n")
+	}
+	b.WriteString("203.0.113.77\n") // the only address outside 10/8
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	keys := []string{"min ip", "max ip", "first new ip", "last new ip"}
+	extremes := func(engine string, opts counter.Options) string {
+		t.Helper()
+		opts.Stats, opts.Logger = &counter.Stats{}, discard
+		c, err := counter.NewWithOptions(engine, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.CountUniqueIPs(path); err != nil {
+			t.Fatal(err)
+		}
+		m := opts.Stats.Map()
+		var got []string
+		for _, k := range keys {
+			got = append(got, k+"="+m[k])
+		}
+		return strings.Join(got, " ")
+	}
+
+	want := extremes("naive", counter.Options{})
+	first, _, _ := strings.Cut(b.String(), "\n")
+	if !strings.HasSuffix(want, " max ip=203.0.113.77 first new ip="+first+" last new ip=203.0.113.77") {
+		t.Fatalf("naive: %s", want)
+	}
+	for _, opts := range []counter.Options{
+		{Workers: 1},
+		{Workers: 2, ChunkSize: 4096},
+		{Workers: 8, ChunkSize: 4096, Bitset: "shared"},
+		{Workers: 4, Mmap: true, ChunkSize: 4096},
+		{Workers: 4, Segmented: true},
+	} {
+		for run := range 3 {
+			if got := extremes("concurrent", opts); got != want {
+				t.Errorf("workers %d, chunk %d, mmap %v, segmented %v, bitset %q, run %d:\n got %s\nwant %s", opts.Workers, opts.ChunkSize, opts.Mmap, opts.Segmented, opts.Bitset, run, got, want)
+			}
+		}
+	}
+	// Eight workers pick local bitsets unless told otherwise
+	wantLocal := strings.Replace(want, "last new ip=203.0.113.77", "last new ip=", 1)
+	for _, bitset := range []string{"local", ""} {
+		if got := extremes("concurrent", counter.Options{Workers: 8, ChunkSize: 4096, Bitset: bitset}); got != wantLocal {
+			t.Errorf("bitset %q:\n got %s\nwant %s", bitset, got, wantLocal)
+		}
+	}
+}
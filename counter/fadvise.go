@@ -0,0 +1,82 @@
+package counter
+
+import (
+	"io"
+	"os"
+)
+
+// dropEvery is how many bytes pass between page cache hints.
+const dropEvery = 8 << 20
+
+// fadvise is the posix_fadvise call the cache droppers make.
+var fadvise = sysFadvise
+
+// cacheDropper tells the kernel the bytes of f it has seen pass through
+// are not needed again, a dropEvery at a time, so a one-shot scan of a
+// file much larger than memory does not evict everything else from the
+// page cache. The hints are advisory: errors are ignored and nothing read
+// or written changes.
+type cacheDropper struct {
+	f    *os.File
+	pos  int64 // offset just past the last byte seen
+	done int64 // offset up to which pages were last dropped
+	prev int64 // start of the range dropped last, advised again for writes
+}
+
+// advance records n more bytes seen and drops the pages behind them once
+// dropEvery have gone by, or with final at the end. A written range is
+// advised twice, a hint apart: the first starts writing its dirty pages
+// back and the second drops them once they are clean.
+func (d *cacheDropper) advance(n int, final, written bool) {
+	d.pos += int64(n)
+	if d.pos-d.done < dropEvery && !(final && d.pos > d.done) {
+		return
+	}
+	// Start on a page boundary: the page holding done was only partly
+	// covered by the last hint, so it is still cached
+	from := d.done &^ int64(os.Getpagesize()-1)
+	if written {
+		from = d.prev
+	}
+	fadvise(d.f, from, d.pos-from, fadvDontNeed)
+	d.prev, d.done = d.done&^int64(os.Getpagesize()-1), d.pos
+}
+
+// DropBehind returns a reader of r, which reads f front to back from
+// offset off, that hints the kernel to read ahead aggressively and to
+// drop f's pages from the page cache behind the read position. f is used
+// only for the hints.
+func DropBehind(f *os.File, off int64, r io.Reader) io.Reader {
+	fadvise(f, off, 0, fadvSequential)
+	return &dropReader{r: r, d: cacheDropper{f: f, pos: off, done: off, prev: off}}
+}
+
+type dropReader struct {
+	r io.Reader
+	d cacheDropper
+}
+
+func (r *dropReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.d.advance(n, err == io.EOF, false)
+	return n, err
+}
+
+// DropBehindWriter returns a writer of w, which appends to f from its
+// start, that drops f's pages from the page cache behind the write
+// position once the kernel has written them back. f is used only for the
+// hints.
+func DropBehindWriter(f *os.File, w io.Writer) io.Writer {
+	return &dropWriter{w: w, d: cacheDropper{f: f}}
+}
+
+type dropWriter struct {
+	w io.Writer
+	d cacheDropper
+}
+
+func (w *dropWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.d.advance(n, false, true)
+	return n, err
+}
@@ -0,0 +1,23 @@
+//go:build amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x
+
+package counter
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fadvSequential = 2 // POSIX_FADV_SEQUENTIAL
+	fadvDontNeed   = 4 // POSIX_FADV_DONTNEED
+)
+
+// sysFadvise is posix_fadvise(2) on f's bytes [off, off+n), n 0 meaning to
+// the end of the file.
+func sysFadvise(f *os.File, off, n int64, advice int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(off), uintptr(n), uintptr(advice), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
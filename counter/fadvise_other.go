@@ -0,0 +1,16 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x)
+
+package counter
+
+import "os"
+
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// sysFadvise does nothing: the page cache hints are only made on 64-bit
+// Linux.
+func sysFadvise(f *os.File, off, n int64, advice int) error {
+	return nil
+}
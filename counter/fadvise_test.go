@@ -0,0 +1,81 @@
+package counter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// advice is one posix_fadvise call recorded by recordFadvise.
+type advice struct {
+	off, n int64
+	advice int
+}
+
+// recordFadvise replaces the fadvise hook for the rest of the test and
+// returns the calls made through it.
+func recordFadvise(t *testing.T) *[]advice {
+	calls := new([]advice)
+	prev := fadvise
+	fadvise = func(f *os.File, off, n int64, a int) error {
+		*calls = append(*calls, advice{off, n, a})
+		return nil
+	}
+	t.Cleanup(func() { fadvise = prev })
+	return calls
+}
+
+// A read through DropBehind hints sequential access up front and drops
+// every page behind it by the end, and a write through DropBehindWriter
+// drops what it wrote, without changing a byte either way.
+func TestDropBehind(t *testing.T) {
+	calls := recordFadvise(t)
+	data := bytes.Repeat([]byte("192.168.0.1\n"), (3*dropEvery+5000)/12)
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(DropBehind(f, 0, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("reading through DropBehind changed the input")
+	}
+	if len(*calls) == 0 || (*calls)[0] != (advice{0, 0, fadvSequential}) {
+		t.Fatalf("calls %v, want POSIX_FADV_SEQUENTIAL first", *calls)
+	}
+	covered := int64(0)
+	for _, c := range (*calls)[1:] {
+		if c.advice != fadvDontNeed || c.off > covered {
+			t.Fatalf("call %+v after %d bytes dropped, want POSIX_FADV_DONTNEED from no later", c, covered)
+		}
+		covered = c.off + c.n
+	}
+	if covered != int64(len(data)) || len(*calls) < 4 {
+		t.Errorf("%d calls dropped %d of %d bytes", len(*calls)-1, covered, len(data))
+	}
+
+	*calls = nil
+	out, err := os.Create(filepath.Join(t.TempDir(), "spill"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := DropBehindWriter(out, out).Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) == 0 || (*calls)[0].advice != fadvDontNeed {
+		t.Errorf("writing %d bytes made calls %v, want POSIX_FADV_DONTNEED", len(data), *calls)
+	}
+	if written, _ := os.ReadFile(out.Name()); !bytes.Equal(written, data) {
+		t.Error("writing through DropBehindWriter changed the output")
+	}
+}
@@ -0,0 +1,192 @@
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Fallback is a Counter that counts with concurrent and, when that stops
+// with ErrMemBudget partway through an input that can be read again,
+// releases the bitset and counts the same input from the start with
+// bucket, which needs a few MB and temp disk. Only the first count can
+// fall back, while the set holds nothing but that input; inputs read once,
+// such as pipes and several sources joined into one stream, fail as
+// concurrent does. Auto counts through one where it picks concurrent and
+// Options.AutoFallback is set.
+type Fallback struct {
+	opts    Options
+	c       Counter // the engine of the last count, nil before the first
+	counted bool
+	fell    bool // the first count fell back to bucket
+}
+
+// NewFallback returns a Fallback building its engines with opts.
+func NewFallback(opts Options) *Fallback {
+	return &Fallback{opts: opts}
+}
+
+// Counter returns the engine that gave the last count, concurrent or, if
+// it fell back, bucket, for follow-up queries; nil before any count.
+func (f *Fallback) Counter() Counter {
+	return f.c
+}
+
+// Sources returns what each source contributed to the last count, when
+// the engine that gave it tallies its sources; nil otherwise.
+func (f *Fallback) Sources() []SourceTally {
+	if sc, ok := f.c.(SourceCounter); ok {
+		return sc.Sources()
+	}
+	return nil
+}
+
+// FellBack reports whether the first count went over the budget and
+// was redone with bucket.
+func (f *Fallback) FellBack() bool {
+	return f.fell
+}
+
+// CountUniqueIPs counts filename, falling back to bucket if need be.
+func (f *Fallback) CountUniqueIPs(filename string) (int64, error) {
+	return f.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation. A regular
+// file can be read again; anything else cannot fall back.
+func (f *Fallback) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	size, err := InputSize(filename)
+	if err != nil {
+		return 0, err
+	}
+	first, err := f.engine()
+	if err != nil {
+		return 0, err
+	}
+	mark := markParse(f.opts)
+	n, err := Count(ctx, f.c, filename)
+	if !first || size < 0 || !errors.Is(err, ErrMemBudget) {
+		return n, err
+	}
+	if err := f.fallBack(err, mark); err != nil {
+		return 0, err
+	}
+	return Count(ctx, f.c, filename)
+}
+
+// CountReader counts r, falling back to bucket if need be when r is an
+// io.Seeker that can be rewound to where the count began.
+func (f *Fallback) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	first, err := f.engine()
+	if err != nil {
+		return 0, err
+	}
+	rc, ok := f.c.(ReaderCounter)
+	if !ok {
+		return 0, errors.New("concurrent cannot count a stream")
+	}
+	seeker, seekable := r.(io.Seeker)
+	var start int64
+	if seekable {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+	mark := markParse(f.opts)
+	n, err := rc.CountReader(ctx, r)
+	if !first || !seekable || !errors.Is(err, ErrMemBudget) {
+		return n, err
+	}
+	if _, serr := seeker.Seek(start, io.SeekStart); serr != nil {
+		return 0, fmt.Errorf("%w; rewinding the input for bucket: %v", err, serr)
+	}
+	if err := f.fallBack(err, mark); err != nil {
+		return 0, err
+	}
+	return f.c.(ReaderCounter).CountReader(ctx, r)
+}
+
+// CountParallel counts the union of inputs with concurrent. Readers
+// running at once cannot all be rewound, so it never falls back.
+func (f *Fallback) CountParallel(ctx context.Context, inputs []Input, parallel int) (int64, error) {
+	if _, err := f.engine(); err != nil {
+		return 0, err
+	}
+	pc, ok := f.c.(ParallelCounter)
+	if !ok {
+		return 0, errors.New("concurrent cannot count inputs in parallel")
+	}
+	return pc.CountParallel(ctx, inputs, parallel)
+}
+
+// engine builds the concurrent engine on the first count and reports
+// whether this is it.
+func (f *Fallback) engine() (first bool, err error) {
+	if f.counted {
+		return false, nil
+	}
+	f.counted = true
+	f.c, err = NewWithOptions("concurrent", f.opts)
+	return true, err
+}
+
+// fallBack replaces the concurrent engine, which failed with err, by a
+// bucket one, releasing the bitset and undoing the line counts of the
+// aborted run first.
+func (f *Fallback) fallBack(err error, mark parseMark) error {
+	if c, ok := f.c.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil {
+			return fmt.Errorf("%w; releasing the concurrent engine: %v", err, cerr)
+		}
+	}
+	f.c = nil
+	debug.FreeOSMemory() // hand the bitset back to the host before bucket starts
+	mark.rewind()
+	Logger(f.opts.Logger).Warn("concurrent engine over its memory budget; recounting with bucket", "reason", err)
+	f.opts.Stats.Set("auto fallback", "concurrent stopped (%v); recounted with bucket", err)
+	c, err := NewWithOptions("bucket", f.opts)
+	if err != nil {
+		return err
+	}
+	f.c, f.fell = c, true
+	return nil
+}
+
+// parseMark holds the shared line counters of ParseOptions as they were
+// before a count, so a count that is redone does not add its lines twice.
+type parseMark struct {
+	counters []*atomic.Int64
+	values   []int64
+}
+
+func markParse(o Options) parseMark {
+	var m parseMark
+	p := o.Parse
+	for _, c := range []*atomic.Int64{p.Lines, p.Comments} {
+		if c != nil {
+			m.counters = append(m.counters, c)
+		}
+	}
+	if r := p.Relaxed; r != nil {
+		m.counters = append(m.counters, &r.Indented, &r.Blank, &r.Quoted, &r.Bracketed)
+	}
+	if c := p.Canon; c != nil {
+		// Its sets only gain what the recount adds again
+		for i := range c.Lines {
+			m.counters = append(m.counters, &c.Lines[i])
+		}
+	}
+	for _, c := range m.counters {
+		m.values = append(m.values, c.Load())
+	}
+	return m
+}
+
+func (m parseMark) rewind() {
+	for i, c := range m.counters {
+		c.Store(m.values[i])
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package counter
+
+import "os"
+
+// dirSyncUnsupported reports whether err means the platform cannot flush
+// a directory; every platform but Windows can.
+func dirSyncUnsupported(err error) bool {
+	return false
+}
+
+// RemoveAll removes path and everything under it, as os.RemoveAll does.
+func RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,39 @@
+//go:build windows
+
+package counter
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	errorInvalidFunction  syscall.Errno = 1  // ERROR_INVALID_FUNCTION, from file systems without directory flushes
+	errorSharingViolation syscall.Errno = 32 // ERROR_SHARING_VIOLATION
+)
+
+// dirSyncUnsupported reports whether err is Windows refusing to flush a
+// directory handle. NTFS journals directory entries, so there is nothing
+// left to flush and SyncDir succeeds.
+func dirSyncUnsupported(err error) bool {
+	return errors.Is(err, syscall.ERROR_ACCESS_DENIED) || errors.Is(err, errorInvalidFunction)
+}
+
+// RemoveAll removes path and everything under it. A file whose last
+// handle was only just closed can still be held for a moment by the
+// virus scanner or the search indexer, so a removal denied access or
+// failing with a sharing violation is retried, backing off, for about a
+// second.
+func RemoveAll(path string) error {
+	err := os.RemoveAll(path)
+	for wait := 20 * time.Millisecond; err != nil && wait < time.Second; wait *= 2 {
+		if !errors.Is(err, syscall.ERROR_ACCESS_DENIED) && !errors.Is(err, errorSharingViolation) {
+			break
+		}
+		time.Sleep(wait)
+		err = os.RemoveAll(path)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package counter
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// SkipSamples is how many skipped lines a run logs before going quiet.
+const SkipSamples = 5
+
+// skipSampleLen is the longest prefix of a skipped line that is logged.
+const skipSampleLen = 80
+
+// Logger returns l, or slog.Default() when l is nil.
+func Logger(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// SkipLog logs the first SkipSamples lines an engine skips for failing to
+// parse, at warn level, and then one line saying the rest are not logged.
+// Workers share one; a nil *SkipLog discards everything, so engines can
+// call Add unconditionally on their hot paths.
+type SkipLog struct {
+	log  *slog.Logger
+	left atomic.Int64
+}
+
+// NewSkipLog returns a SkipLog for l, or nil when l drops warnings.
+func NewSkipLog(l *slog.Logger) *SkipLog {
+	l = Logger(l)
+	if !l.Enabled(context.Background(), slog.LevelWarn) {
+		return nil
+	}
+	s := &SkipLog{log: l}
+	s.left.Store(SkipSamples)
+	return s
+}
+
+// Add logs line, which failed to parse with err, while samples are left.
+// Comment lines and filtered addresses are not invalid and are never
+// logged.
+func (s *SkipLog) Add(line []byte, err error) {
+	if s == nil || s.left.Load() < 0 || utils.Ignored(err) {
+		return
+	}
+	switch n := s.left.Add(-1); {
+	case n >= 0:
+		s.log.Warn("skipped line", "line", string(line[:min(len(line), skipSampleLen)]), "err", err)
+	case n == -1:
+		s.log.Warn("further skipped lines are not logged")
+	}
+}
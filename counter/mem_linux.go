@@ -0,0 +1,49 @@
+package counter
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// AvailableMemory returns MemAvailable from /proc/meminfo in bytes, or 0
+// if it cannot be read.
+func AvailableMemory() int64 {
+	return procKB("/proc/meminfo", "MemAvailable:")
+}
+
+// PeakRSS returns the process's resident set high-water mark (VmHWM from
+// /proc/self/status) in bytes, or 0 if it cannot be read.
+func PeakRSS() int64 {
+	return procKB("/proc/self/status", "VmHWM:")
+}
+
+// ResetPeakRSS sets the resident set high-water mark to the current
+// resident set, so PeakRSS measures from now on, reporting whether the
+// kernel allowed it (Linux 4.0 and later).
+func ResetPeakRSS() bool {
+	return os.WriteFile("/proc/self/clear_refs", []byte("5"), 0) == nil
+}
+
+// procKB returns the "key value kB" entry of a proc file in bytes, or 0.
+func procKB(path, key string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := bytes.Fields(sc.Bytes())
+		if len(fields) >= 2 && string(fields[0]) == key {
+			kb, err := strconv.ParseInt(string(fields[1]), 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package counter
+
+// AvailableMemory is unknown off Linux; Select then assumes a conservative
+// default.
+func AvailableMemory() int64 {
+	return 0
+}
+
+// PeakRSS is unknown off Linux.
+func PeakRSS() int64 {
+	return 0
+}
+
+// ResetPeakRSS cannot reset the high-water mark off Linux.
+func ResetPeakRSS() bool {
+	return false
+}
@@ -0,0 +1,68 @@
+package counter
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// MemPeak is the peak memory observed by a MemSampler.
+type MemPeak struct {
+	HeapAlloc uint64 // live heap
+	Sys       uint64 // memory obtained from the OS by the Go runtime
+	RSS       int64  // process high-water mark (VmHWM), 0 where unavailable
+}
+
+func (p MemPeak) String() string {
+	s := fmt.Sprintf("heap %s, sys %s", FormatBytes(int64(p.HeapAlloc)), FormatBytes(int64(p.Sys)))
+	if p.RSS > 0 {
+		s += ", rss " + FormatBytes(p.RSS)
+	}
+	return s
+}
+
+// MemSampler records peak memory by polling runtime.ReadMemStats from a
+// background goroutine, so it works around any engine without hooks.
+type MemSampler struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+	peak MemPeak
+}
+
+// StartMemSampler starts sampling every interval until Stop.
+func StartMemSampler(interval time.Duration) *MemSampler {
+	s := &MemSampler{stop: make(chan struct{})}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			s.sample()
+			select {
+			case <-s.stop:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return s
+}
+
+func (s *MemSampler) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s.peak.HeapAlloc = max(s.peak.HeapAlloc, ms.HeapAlloc)
+	s.peak.Sys = max(s.peak.Sys, ms.Sys)
+}
+
+// Stop ends sampling and returns the peaks seen, including one last
+// sample taken at the end.
+func (s *MemSampler) Stop() MemPeak {
+	close(s.stop)
+	s.wg.Wait()
+	s.sample()
+	s.peak.RSS = PeakRSS()
+	return s.peak
+}
@@ -0,0 +1,50 @@
+package counter_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	_ "github.com/Sveta-1999/IPCounter/naive"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A sampler around a count reports the heap the count held at its peak,
+// the runtime's memory from the OS at least as large, and on Linux the
+// process's resident high-water mark.
+func TestMemSampler(t *testing.T) {
+	rng := rand.New(rand.NewPCG(81, 82))
+	var b strings.Builder
+	for range 200000 {
+		b.WriteString(utils.FormatIPv4(rng.Uint32()) + "\n")
+	}
+	c, err := counter.NewWithOptions("naive", counter.Options{
+		Workers: 1,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.GC()
+	sampler := counter.StartMemSampler(time.Millisecond)
+	n, err := c.(counter.ReaderCounter).CountReader(context.Background(), strings.NewReader(b.String()))
+	peak := sampler.Stop()
+	if err != nil || n < 199000 {
+		t.Fatalf("count: %d, %v", n, err)
+	}
+	// 200,000 map entries of naive's set take a few MB at least
+	if peak.HeapAlloc < 4<<20 || peak.Sys < peak.HeapAlloc {
+		t.Errorf("peak heap %d, sys %d", peak.HeapAlloc, peak.Sys)
+	}
+	if runtime.GOOS == "linux" {
+		if peak.RSS <= 0 || !strings.Contains(peak.String(), "rss ") {
+			t.Errorf("peak rss %d, reported as %q", peak.RSS, peak)
+		}
+	}
+}
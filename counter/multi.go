@@ -0,0 +1,115 @@
+package counter
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Input is one of several sources counted into one set.
+type Input struct {
+	Name  string
+	Index int   // position among the sources given, which may include some skipped
+	Size  int64 // bytes, -1 if unknown
+	Open  func() (io.ReadCloser, error)
+}
+
+// Source returns the label of what in contributes.
+func (in Input) Source() Source {
+	return Source{Name: in.Name, Index: in.Index}
+}
+
+// Source labels one of several inputs counted into one set, so that
+// figures and new addresses can be told apart by where they came from.
+type Source struct {
+	Name  string `json:"name"`
+	Index int    `json:"index"`
+}
+
+// SourceTally is what one source contributed to a run.
+type SourceTally struct {
+	Source
+	Lines   int64 `json:"lines"`   // records parsed, blank ones included
+	Invalid int64 `json:"invalid"` // of them skipped because they did not parse
+	New     int64 `json:"new"`     // addresses the set first got from it
+}
+
+// Add adds the figures of u, from the same source, to t.
+func (t *SourceTally) Add(u SourceTally) {
+	t.Lines += u.Lines
+	t.Invalid += u.Invalid
+	t.New += u.New
+}
+
+// Sourced is a stream of several sources back to back, such as
+// input.Concat, that tells which one each byte it has returned came from.
+type Sourced interface {
+	// SourceAt returns the source holding the byte at offset, counted
+	// from the start of the stream, and the offset it ends at, or -1 if
+	// it has not ended yet. Only offsets already read can be asked for.
+	SourceAt(offset int64) (src Source, end int64)
+}
+
+// SourceCounter is a Counter that tallies what each source of its last
+// run contributed, when that run read several of them.
+type SourceCounter interface {
+	Counter
+	// Sources returns the tallies in source order, nil when the last run
+	// read a single source.
+	Sources() []SourceTally
+}
+
+// ParallelCounter is a Counter that can read several inputs at once into
+// one shared set and return the size of their union.
+type ParallelCounter interface {
+	Counter
+	// CountParallel counts the union of inputs, reading up to parallel
+	// of them at a time with a share of the engine's workers each.
+	CountParallel(ctx context.Context, inputs []Input, parallel int) (int64, error)
+}
+
+// ForEachInput opens each input and passes it to fn with its label,
+// running up to parallel calls at a time. The first error cancels the ctx
+// given to the other calls, stops new ones from starting and is returned.
+func ForEachInput(ctx context.Context, inputs []Input, parallel int, fn func(ctx context.Context, src Source, r io.Reader) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, max(parallel, 1))
+	for _, in := range inputs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := func() error {
+				r, err := in.Open()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				return fn(ctx, in.Source(), r)
+			}()
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
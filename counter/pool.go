@@ -0,0 +1,287 @@
+package counter
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultPoolChunkSize is what a count on a Pool reads at a time
+	// unless its options say: small, since its inputs are.
+	DefaultPoolChunkSize = 64 * 1024
+	poolShards           = 16384 // concurrent's default shard count, for sizing counts that leave it 0
+	shardHeaderBytes     = 64    // a concurrent shard header, padded to a cache line
+)
+
+// ErrPoolClosed is returned by Pool.Count after Pool.Close.
+var ErrPoolClosed = errors.New("counter: pool closed")
+
+// PoolOptions configures a Pool.
+type PoolOptions struct {
+	Workers int // goroutines parsing chunks for every count, 0 for NumCPU
+
+	// MaxMem caps the memory all counts in flight hold together. A count
+	// waits to start until its read buffers and shard headers fit, with
+	// the words of every shard its input could touch at one address a
+	// line when its size is known; a shard past that, of CIDR lines or
+	// an input of unknown size, that does not fit fails the count with
+	// ErrMemBudget. 0 means no cap.
+	MaxMem int64
+
+	QueueDepth int // chunks one count may have waiting for a worker, 0 for 2
+	ChunkSize  int // bytes a count reads at a time unless its options say, 0 for DefaultPoolChunkSize
+}
+
+// Pool runs the parsing of many concurrent counts on one fixed set of
+// goroutines, for a process counting hundreds of small inputs at once
+// that would otherwise start a worker pool per input. Each count keeps
+// its own set and reader; workers take the chunks of the counts waiting
+// in turn, one chunk of each, so a count of a huge input cannot starve
+// small ones. It is safe for concurrent use.
+type Pool struct {
+	opts PoolOptions
+
+	mu     sync.Mutex
+	work   *sync.Cond    // a chunk was queued or the pool closed
+	jobs   []*PoolJob    // counts with chunks queued, served in turn
+	turn   int           // index into jobs of the next to serve
+	used   int64         // memory reserved by the counts in flight
+	freed  chan struct{} // closed and replaced whenever memory is released
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewPool starts a Pool's workers.
+func NewPool(opts PoolOptions) *Pool {
+	opts.Workers = cmp.Or(opts.Workers, runtime.NumCPU())
+	opts.QueueDepth = cmp.Or(opts.QueueDepth, 2)
+	opts.ChunkSize = cmp.Or(opts.ChunkSize, DefaultPoolChunkSize)
+	p := &Pool{opts: opts, freed: make(chan struct{})}
+	p.work = sync.NewCond(&p.mu)
+	for i := range opts.Workers {
+		p.wg.Add(1)
+		go p.run(i)
+	}
+	return p
+}
+
+// Close stops the workers once the chunks queued are parsed. Call it when
+// no Count is running; later ones return ErrPoolClosed.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.work.Broadcast()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// Count counts the distinct addresses of in with the concurrent engine,
+// parsing on the pool's workers, as concurrent.CountReader would on its
+// own. A ChunkSize left 0 in opts gets the pool's; opts.MaxMem still caps
+// this count alone.
+func (p *Pool) Count(ctx context.Context, in Input, opts Options) (int64, error) {
+	opts.ChunkSize = cmp.Or(opts.ChunkSize, p.opts.ChunkSize)
+	j := &PoolJob{pool: p, slots: make(chan struct{}, p.opts.QueueDepth)}
+	if err := p.admit(ctx, j, in, opts); err != nil {
+		return 0, err
+	}
+	defer j.release()
+
+	opts.PoolJob = j
+	c, err := NewWithOptions("concurrent", opts)
+	if err != nil {
+		return 0, err
+	}
+	rc, ok := c.(ReaderCounter)
+	if !ok {
+		return 0, fmt.Errorf("counter: %T cannot count a stream", c)
+	}
+	r, err := in.Open()
+	if err != nil {
+		return 0, &OpenError{Path: in.Name, Err: err}
+	}
+	defer r.Close()
+	return rc.CountReader(ctx, r)
+}
+
+// admit reserves for j what a count of in with opts needs to start, and
+// the words of the shards it could touch as credit for its later
+// reservations, waiting for counts in flight to release enough.
+func (p *Pool) admit(ctx context.Context, j *PoolJob, in Input, opts Options) error {
+	shards := int64(cmp.Or(opts.Shards, poolShards))
+	n := int64(p.opts.QueueDepth+1)*int64(opts.ChunkSize) + shards*shardHeaderBytes
+	if in.Size >= 0 {
+		record := int64(minLineBytes)
+		if BinaryOrder(opts.InputFormat) != nil {
+			record = 4
+		}
+		j.credit = min(shards, in.Size/record+1) * (bitsetBytes / shards)
+		n += j.credit
+	}
+	if p.opts.MaxMem > 0 && n > p.opts.MaxMem {
+		return fmt.Errorf("%w: counting %s on the pool needs up to %s, the pool's cap is %s",
+			ErrMemBudget, in.Name, FormatBytes(n), FormatBytes(p.opts.MaxMem))
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return ErrPoolClosed
+		}
+		if p.opts.MaxMem <= 0 || p.used+n <= p.opts.MaxMem {
+			p.used += n
+			p.mu.Unlock()
+			j.reserved.Add(n)
+			return nil
+		}
+		freed := p.freed
+		p.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run is worker i: it parses the next chunk of each count in turn.
+func (p *Pool) run(i int) {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.jobs) == 0 && !p.closed {
+			p.work.Wait()
+		}
+		if len(p.jobs) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		p.turn %= len(p.jobs)
+		j := p.jobs[p.turn]
+		task := j.queue[0]
+		j.queue = j.queue[1:]
+		if len(j.queue) == 0 {
+			p.jobs = slices.Delete(p.jobs, p.turn, p.turn+1)
+			j.listed = false
+		} else {
+			p.turn++
+		}
+		p.mu.Unlock()
+
+		task(i)
+		<-j.slots
+		j.wg.Done()
+	}
+}
+
+// PoolJob is one count's share of a Pool: the chunks it queued and the
+// memory it reserved. Engines get one through Options.PoolJob; a nil
+// PoolJob reserves without a cap.
+type PoolJob struct {
+	pool     *Pool
+	slots    chan struct{} // one per chunk queued or being parsed
+	queue    []func(worker int)
+	listed   bool // in pool.jobs
+	wg       sync.WaitGroup
+	reserved atomic.Int64
+	credit   int64 // of reserved, what Reserve hands out before asking the pool; under pool.mu
+	refused  atomic.Bool
+}
+
+// Workers returns the number of the pool's workers, which Submit's tasks
+// are told the index of.
+func (j *PoolJob) Workers() int {
+	return j.pool.opts.Workers
+}
+
+// Submit queues task for the next free worker of the pool, waiting while
+// the job has the pool's QueueDepth of them queued or running. A worker
+// runs one task at a time, so the tasks given one index never overlap.
+func (j *PoolJob) Submit(ctx context.Context, task func(worker int)) error {
+	select {
+	case j.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	j.wg.Add(1)
+	p := j.pool
+	p.mu.Lock()
+	j.queue = append(j.queue, task)
+	if !j.listed {
+		j.listed = true
+		p.jobs = append(p.jobs, j)
+	}
+	p.work.Signal()
+	p.mu.Unlock()
+	return nil
+}
+
+// Wait waits for every task submitted to finish.
+func (j *PoolJob) Wait() {
+	j.wg.Wait()
+}
+
+// Reserve counts n more bytes held by the job against what it reserved
+// when it started, and past that against the pool's cap, and reports
+// whether they fit; once they do not, Err says so.
+func (j *PoolJob) Reserve(n int64) bool {
+	if j == nil {
+		return true
+	}
+	p := j.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if j.credit >= n {
+		j.credit -= n
+		return true
+	}
+	if p.opts.MaxMem > 0 && p.used+n > p.opts.MaxMem {
+		j.refused.Store(true)
+		return false
+	}
+	p.used += n
+	j.reserved.Add(n)
+	return true
+}
+
+// Release hands n bytes reserved with Reserve back to the job, for its
+// later reservations; the pool gets them back when the count is over.
+func (j *PoolJob) Release(n int64) {
+	if j == nil {
+		return
+	}
+	j.pool.mu.Lock()
+	defer j.pool.mu.Unlock()
+	j.credit += n
+}
+
+// Err returns an error wrapping ErrMemBudget once Reserve has refused the
+// job memory, and nil before.
+func (j *PoolJob) Err() error {
+	if j == nil || !j.refused.Load() {
+		return nil
+	}
+	return fmt.Errorf("%w: the counts on the pool hold its cap of %s, %s of it this one's; use fewer at once or the bucket engine",
+		ErrMemBudget, FormatBytes(j.pool.opts.MaxMem), FormatBytes(j.reserved.Load()))
+}
+
+// release returns everything the job reserved, once its count is over.
+func (j *PoolJob) release() {
+	j.pool.free(j.reserved.Swap(0))
+}
+
+// free returns n bytes to the pool and wakes the counts waiting for
+// memory.
+func (p *Pool) free(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used -= n
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
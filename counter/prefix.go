@@ -0,0 +1,42 @@
+package counter
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PrefixCount is the number of distinct /Length prefixes a set covers: a
+// /8 holds one for every first octet seen, a /32 one per address.
+type PrefixCount struct {
+	Length int   `json:"length"`
+	Unique int64 `json:"unique"`
+}
+
+// PrefixSweeper is a Counter that can report, after a count, how many
+// distinct prefixes of each length in Options.PrefixSweep its set holds.
+// The counts are exact, taken from the same set as the unique count.
+type PrefixSweeper interface {
+	Counter
+	PrefixCounts() []PrefixCount
+}
+
+// ParsePrefixLengths parses a -prefix-sweep value, a comma-separated list
+// of prefix lengths from 1 to 32 such as "8,16,24,32", into ascending
+// order without duplicates. An empty value means no sweep.
+func ParsePrefixLengths(s string) ([]int, error) {
+	var lengths []int
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(f, "/"))
+		if err != nil || n < 1 || n > 32 {
+			return nil, fmt.Errorf("prefix length must be 1 to 32, got %q", f)
+		}
+		lengths = append(lengths, n)
+	}
+	slices.Sort(lengths)
+	return slices.Compact(lengths), nil
+}
@@ -0,0 +1,242 @@
+package counter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress tracks how far a count has got, for -progress: engines add the
+// input they have read and the unique count so far as they go, and a
+// reporter takes snapshots of it from another goroutine. A count runs in
+// phases, "reading" for most engines and "pass 1" and "pass 2" for the
+// bucket engine, each with its own work done and total. Safe for
+// concurrent use; a nil *Progress does nothing, so engines can call it
+// unconditionally.
+type Progress struct {
+	start time.Time
+
+	mu         sync.Mutex
+	phase      string
+	unit       string // "bytes", or what else Done counts
+	total      int64  // work in the phase, -1 unknown
+	phaseStart time.Time
+	ended      []PhaseTime
+	workers    []int64 // input bytes by parsing worker, over the whole count
+
+	done   atomic.Int64
+	lines  atomic.Int64
+	unique atomic.Int64 // -1 until an engine sets it
+	temp   atomic.Int64 // bytes written to temp files
+}
+
+// NewProgress returns a Progress in its "reading" phase, total input
+// bytes to read, -1 if unknown.
+func NewProgress(total int64) *Progress {
+	p := &Progress{start: time.Now()}
+	p.Phase("reading", "bytes", total)
+	return p
+}
+
+// Phase ends the current phase and starts the phase name, of total units
+// of work, -1 if unknown, with nothing done. The unique count carries
+// over.
+func (p *Progress) Phase(name, unit string, total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.phase == "" {
+		p.unique.Store(-1)
+	} else {
+		p.ended = append(p.ended, p.current(now))
+	}
+	p.phase, p.unit, p.total, p.phaseStart = name, unit, total, now
+	p.done.Store(0)
+	p.lines.Store(0)
+}
+
+// Rename renames the current phase, keeping what it has done.
+func (p *Progress) Rename(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.phase = name
+	p.mu.Unlock()
+}
+
+// Add adds lines, 0 if the engine does not count them, and done units of
+// the phase's work, bytes when reading.
+func (p *Progress) Add(lines, done int64) {
+	if p == nil {
+		return
+	}
+	p.lines.Add(lines)
+	p.done.Add(done)
+}
+
+// AddWorker adds n bytes of input to those parsing worker i has handled.
+func (p *Progress) AddWorker(i int, n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if i >= len(p.workers) {
+		p.workers = append(p.workers, make([]int64, i+1-len(p.workers))...)
+	}
+	p.workers[i] += n
+	p.mu.Unlock()
+}
+
+// AddTemp adds n bytes to those the count has written to temp files.
+func (p *Progress) AddTemp(n int64) {
+	if p != nil {
+		p.temp.Add(n)
+	}
+}
+
+// SetUnique records the unique count so far.
+func (p *Progress) SetUnique(n int64) {
+	if p != nil {
+		p.unique.Store(n)
+	}
+}
+
+// Reader returns r counting the bytes read from it as done, for engines
+// that read their input through a single reader.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.done.Add(int64(n))
+	return n, err
+}
+
+// Snapshot returns what the count has done so far.
+func (p *Progress) Snapshot() ProgressReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	return ProgressReport{
+		Phase:        p.phase,
+		Unit:         p.unit,
+		Done:         p.done.Load(),
+		Total:        p.total,
+		Lines:        p.lines.Load(),
+		Unique:       p.unique.Load(),
+		Elapsed:      now.Sub(p.start),
+		PhaseElapsed: now.Sub(p.phaseStart),
+		TempBytes:    p.temp.Load(),
+		WorkerBytes:  slices.Clone(p.workers),
+	}
+}
+
+// Phases returns the phases the count has been through, the current one
+// last and timed until now.
+func (p *Progress) Phases() []PhaseTime {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append(append([]PhaseTime(nil), p.ended...), p.current(time.Now()))
+}
+
+// current returns the current phase as of now. The caller holds mu.
+func (p *Progress) current(now time.Time) PhaseTime {
+	return PhaseTime{Name: p.phase, Unit: p.unit, Done: p.done.Load(), Lines: p.lines.Load(), Elapsed: now.Sub(p.phaseStart)}
+}
+
+// PhaseTime is what a phase of a count did and how long it took.
+type PhaseTime struct {
+	Name    string        // "reading", "pass 1" or "pass 2"
+	Unit    string        // what Done counts: "bytes", or "buckets" in pass 2
+	Done    int64         // work done in the phase
+	Lines   int64         // lines read in the phase, 0 if the engine does not count them
+	Elapsed time.Duration // from the start of the phase to its end
+}
+
+// Report calls fn with a snapshot of p every interval until ctx is done,
+// then once more with the last one, and returns once fn has returned.
+func (p *Progress) Report(ctx context.Context, interval time.Duration, fn func(ProgressReport)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fn(p.Snapshot())
+		case <-ctx.Done():
+			fn(p.Snapshot())
+			return
+		}
+	}
+}
+
+// ProgressReport is a snapshot of a Progress.
+type ProgressReport struct {
+	Phase        string        // "reading", "pass 1" or "pass 2"
+	Unit         string        // what Done and Total count: "bytes", or "buckets" in pass 2
+	Done         int64         // work done in the phase
+	Total        int64         // work in the phase, -1 if unknown, as of a pipe
+	Lines        int64         // lines read in the phase, 0 if the engine does not count them
+	Unique       int64         // distinct addresses so far, -1 if the engine only knows at the end
+	Elapsed      time.Duration // since the count started
+	PhaseElapsed time.Duration // since the phase started
+	TempBytes    int64         // written to temp files by the bucket and extsort engines, after compression
+	WorkerBytes  []int64       // input bytes each parsing worker has handled, nil if the engine does not say
+}
+
+// Remaining estimates the time left in the phase from its rate so far,
+// false while there is nothing to go on or the total is unknown.
+func (r ProgressReport) Remaining() (time.Duration, bool) {
+	if r.Total < 0 || r.Done <= 0 || r.PhaseElapsed <= 0 {
+		return 0, false
+	}
+	left := max(r.Total-r.Done, 0)
+	return time.Duration(float64(r.PhaseElapsed) * float64(left) / float64(r.Done)), true
+}
+
+// String formats r as one line, such as "pass 1: 12.0 GiB of 93.1 GiB
+// (12.9%), 1002443010 lines, 2m10s elapsed, about 14m38s left".
+func (r ProgressReport) String() string {
+	var b strings.Builder
+	b.WriteString(r.Phase + ": ")
+	done, total := fmt.Sprintf("%d", r.Done), fmt.Sprintf("%d", r.Total)
+	if r.Unit == "bytes" {
+		done, total = FormatBytes(r.Done), FormatBytes(r.Total)
+	} else {
+		done += " " + r.Unit
+		total += " " + r.Unit
+	}
+	if r.Total >= 0 {
+		fmt.Fprintf(&b, "%s of %s (%.1f%%)", done, total, 100*float64(r.Done)/float64(max(r.Total, 1)))
+	} else {
+		b.WriteString(done)
+	}
+	if r.Lines > 0 {
+		fmt.Fprintf(&b, ", %d lines", r.Lines)
+	}
+	if r.Unique >= 0 {
+		fmt.Fprintf(&b, ", %d unique", r.Unique)
+	}
+	fmt.Fprintf(&b, ", %s elapsed", r.Elapsed.Round(time.Second))
+	if left, ok := r.Remaining(); ok {
+		fmt.Fprintf(&b, ", about %s left", left.Round(time.Second))
+	}
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package counter
+
+import "math"
+
+// bitsetShards is the concurrent engine's default shard count, each
+// shardBytes of the full bitset.
+const bitsetShards = bitsetBytes / shardBytes
+
+// Projection is what counting an input is expected to involve, in the
+// figures the engines' memory follows from. WorstCase projects from the
+// size alone, which is what auto decides on; `ipcounter estimate` fills
+// the figures in from a sample. Both price the engines with the same
+// methods, so the estimate's worst case is auto's.
+type Projection struct {
+	Size      int64 // input bytes
+	Addresses int64 // addresses read, repeats included
+	Distinct  int64 // distinct addresses
+	Shards    int64 // default-size bitset shards the addresses fall in
+}
+
+// WorstCase returns the projection for a size-byte input of the shortest
+// possible lines, each a different address in a different shard.
+func WorstCase(size int64) Projection {
+	lines := size / minLineBytes
+	return Projection{Size: size, Addresses: lines, Distinct: lines, Shards: min(lines, bitsetShards)}
+}
+
+// NaiveMem returns the memory of naive's map.
+func (p Projection) NaiveMem() int64 {
+	return p.Distinct * mapEntryBytes
+}
+
+// BitsetMem returns the memory of concurrent's allocated shards, without
+// its headers and read buffers.
+func (p Projection) BitsetMem() int64 {
+	return p.Shards * shardBytes
+}
+
+// BitsetShard returns the default-size bitset shard holding ip: concurrent
+// takes the shard from an address's low bits.
+func BitsetShard(ip uint32) int {
+	return int(ip % bitsetShards)
+}
+
+// ProjectShards returns how many shards distinct addresses are expected to
+// fall in, given that a sample's sampleDistinct of them fell in
+// sampleShards. The addresses are taken to spread evenly over some number
+// of shards E, which the sample pins down from E·(1-e^(-d/E)) = k; an
+// input confined to a few shards is projected to stay in them.
+func ProjectShards(distinct, sampleDistinct, sampleShards int64) int64 {
+	if sampleShards == 0 || distinct <= 0 {
+		return 0
+	}
+	touched := func(n, e float64) float64 { return e * -math.Expm1(-n/e) }
+	d, k := float64(sampleDistinct), float64(sampleShards)
+	lo, hi := k, float64(bitsetShards)
+	if touched(d, hi) > k {
+		// Bisect for E: touched grows with it
+		for range 100 {
+			mid := (lo + hi) / 2
+			if touched(d, mid) < k {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+	}
+	n := math.Round(touched(float64(distinct), hi))
+	return int64(max(n, min(k, float64(distinct))))
+}
@@ -0,0 +1,218 @@
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultReadRetries is the reopen attempts in a row the CLI allows after a
+// transient read error.
+const DefaultReadRetries = 3
+
+const maxRetryBackoff = 10 * time.Second
+
+// RetryFile reads a local file and survives transient read errors, such
+// as EIO or ESTALE from an NFS mount: it reopens the file by name, seeks
+// to the byte after the last one it returned and carries on, so the
+// caller sees every byte exactly once. Up to max attempts in a row are
+// made, with doubling backoff, before the error is returned as a
+// *ReadError holding the offset reached.
+type RetryFile struct {
+	ctx      context.Context
+	cur      io.Reader // the caller's file, then the last reopened one
+	reopened *os.File  // owned by RetryFile, nil until the first retry
+	name     string
+	offset   int64 // bytes returned so far
+	max      int
+	inRow    int
+	retries  int
+	stats    *Stats
+	log      *slog.Logger
+}
+
+// NewRetryFile returns a reader of f that retries up to maxRetries times,
+// warning on log (nil for slog.Default()) before each one.
+// f stays owned by the caller; Close releases only the handles opened by
+// retries. A non-regular file, which cannot be reopened where it left
+// off, gets no retries.
+func NewRetryFile(ctx context.Context, f *os.File, maxRetries int, stats *Stats, log *slog.Logger) *RetryFile {
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		maxRetries = 0
+	}
+	r := &RetryFile{ctx: ctx, cur: f, name: f.Name(), max: maxRetries, stats: stats, log: Logger(log)}
+	if off, err := f.Seek(0, io.SeekCurrent); err == nil {
+		r.offset = off
+	}
+	return r
+}
+
+// Read reads from the file, reopening it after a transient error.
+func (r *RetryFile) Read(p []byte) (int, error) {
+	for {
+		n, err := r.cur.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.inRow = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if !isTransient(err) || r.max <= 0 {
+			return n, r.failed(err)
+		}
+		if rerr := r.reopen(err); rerr != nil {
+			return n, r.failed(rerr)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// failed returns err as a *ReadError at the offset reached, or unchanged
+// when ctx ended the retries.
+func (r *RetryFile) failed(err error) error {
+	if r.ctx.Err() != nil && errors.Is(err, r.ctx.Err()) {
+		return err
+	}
+	return &ReadError{Path: r.name, Offset: r.offset, Err: err}
+}
+
+// Retries returns how many times the file was reopened.
+func (r *RetryFile) Retries() int {
+	return r.retries
+}
+
+// Close closes the handle opened by the last retry, if any.
+func (r *RetryFile) Close() error {
+	if r.reopened == nil {
+		return nil
+	}
+	err := r.reopened.Close()
+	r.reopened = nil
+	return err
+}
+
+// reopen waits, then opens the file again at r.offset, until it succeeds,
+// a non-transient error occurs or the attempts run out.
+func (r *RetryFile) reopen(cause error) error {
+	for {
+		if r.inRow >= r.max {
+			return fmt.Errorf("%s: %w (after %d retries)", r.name, cause, r.inRow)
+		}
+		delay := min(100*time.Millisecond<<r.inRow, maxRetryBackoff)
+		r.inRow++
+		r.retries++
+		r.stats.Set("read retries", "%d", r.retries)
+		r.log.Warn("read failed; reopening", "file", r.name, "err", cause, "offset", r.offset,
+			"delay", delay, "attempt", r.inRow, "max", r.max)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			t.Stop()
+			return r.ctx.Err()
+		}
+
+		f, err := os.Open(r.name)
+		if err == nil {
+			if _, err = f.Seek(r.offset, io.SeekStart); err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			if !isTransient(err) {
+				return fmt.Errorf("%s: reopen after %v: %w", r.name, cause, err)
+			}
+			cause = err
+			continue
+		}
+		if r.reopened != nil {
+			r.reopened.Close()
+		}
+		r.cur, r.reopened = f, f
+		return nil
+	}
+}
+
+// WriteRetrier retries transient write errors, such as EIO from an NFS
+// mount, on the files it wraps: a failed write is repeated for the bytes
+// it did not write, after a doubling backoff, up to max times in a row,
+// so what reaches the file is the same as without the error. A full
+// volume is not transient. A nil *WriteRetrier leaves writers as they
+// are.
+type WriteRetrier struct {
+	max     int
+	retries atomic.Int64
+	stats   *Stats
+	log     *slog.Logger
+}
+
+// NewWriteRetrier returns a retrier making up to maxRetries attempts in a
+// row, warning on log (nil for slog.Default()) before each one, or nil for
+// maxRetries 0.
+func NewWriteRetrier(maxRetries int, stats *Stats, log *slog.Logger) *WriteRetrier {
+	if maxRetries <= 0 {
+		return nil
+	}
+	return &WriteRetrier{max: maxRetries, stats: stats, log: Logger(log)}
+}
+
+// Writer returns f written with retries.
+func (r *WriteRetrier) Writer(f *os.File) io.Writer {
+	if r == nil {
+		return f
+	}
+	return &retryWriter{w: f, name: f.Name(), r: r}
+}
+
+// Retries returns how many writes were retried.
+func (r *WriteRetrier) Retries() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.retries.Load()
+}
+
+type retryWriter struct {
+	w    io.Writer
+	name string
+	r    *WriteRetrier
+}
+
+func (w *retryWriter) Write(p []byte) (int, error) {
+	written, inRow := 0, 0
+	for {
+		n, err := w.w.Write(p[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if n > 0 {
+			inRow = 0
+		}
+		if !isTransient(err) || inRow >= w.r.max {
+			return written, err
+		}
+		delay := min(100*time.Millisecond<<inRow, maxRetryBackoff)
+		inRow++
+		w.r.stats.Set("write retries", "%d", w.r.retries.Add(1))
+		w.r.log.Warn("write failed; retrying", "file", w.name, "err", err, "written", written,
+			"delay", delay, "attempt", inRow, "max", w.r.max)
+		time.Sleep(delay)
+	}
+}
+
+// isTransient reports whether a read or write error may go away on a
+// fresh attempt.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ESTALE) ||
+		errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, syscall.EAGAIN)
+}
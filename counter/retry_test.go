@@ -0,0 +1,84 @@
+package counter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// failAt reads r until off bytes are read, then fails once with err.
+type failAt struct {
+	r   io.Reader
+	off int64
+	err error
+}
+
+func (f *failAt) Read(p []byte) (int, error) {
+	if f.off <= 0 {
+		return 0, f.err
+	}
+	n, err := f.r.Read(p[:min(int64(len(p)), f.off)])
+	f.off -= int64(n)
+	return n, err
+}
+
+// An EIO partway through a line is retried by reopening the file where
+// the read left off, so every byte, and so every address, arrives once;
+// an error that is not transient, or one with no retries allowed, fails
+// at the offset reached.
+func TestRetryFile(t *testing.T) {
+	var b bytes.Buffer
+	for i := range 200000 {
+		fmt.Fprintf(&b, "10.%d.%d.%d\n", i>>16, i>>8&0xff, i&0xff)
+	}
+	data := b.Bytes()
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const off = 1<<20 + 3 // inside a line
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, tc := range []struct {
+		err     error
+		retries int
+		fails   bool
+	}{
+		{syscall.EIO, 3, false},
+		{syscall.ESTALE, 1, false},
+		{syscall.EIO, 0, true},
+		{syscall.EACCES, 3, true},
+	} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := &Stats{}
+		r := NewRetryFile(context.Background(), f, tc.retries, stats, discard)
+		r.cur = &failAt{r: f, off: off, err: &os.PathError{Op: "read", Path: path, Err: tc.err}}
+		got, err := io.ReadAll(r)
+		r.Close()
+		f.Close()
+
+		var re *ReadError
+		switch {
+		case tc.fails:
+			if !errors.As(err, &re) || re.Offset != off || !errors.Is(err, tc.err) || r.Retries() != 0 {
+				t.Errorf("%v with %d retries: %v after %d retries, want a ReadError at %d", tc.err, tc.retries, err, r.Retries(), off)
+			}
+		case err != nil:
+			t.Errorf("%v with %d retries: %v", tc.err, tc.retries, err)
+		case !bytes.Equal(got, data):
+			t.Errorf("%v with %d retries: read %d bytes, not the %d of the file", tc.err, tc.retries, len(got), len(data))
+		case r.Retries() != 1 || stats.Map()["read retries"] != "1":
+			t.Errorf("%v with %d retries: %d retries, stats %q", tc.err, tc.retries, r.Retries(), stats.Map()["read retries"])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// InputSize returns the size of filename in bytes, or -1 when it is a
+// pipe, socket or terminal whose length is unknown until it has been read.
+func InputSize(filename string) (int64, error) {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return 0, &OpenError{Path: filename, Err: err}
+	}
+	if !st.Mode().IsRegular() {
+		return -1, nil
+	}
+	return st.Size(), nil
+}
+
+// Spool makes filename readable more than once. A regular file is
+// returned as is; anything else, such as a named pipe or <(cmd), is
+// copied to a temp file in dir ("" for os.TempDir) with a warning on log
+// (nil for slog.Default()), and cleanup removes the copy.
+func Spool(ctx context.Context, filename, dir string, log *slog.Logger) (path string, cleanup func(), err error) {
+	size, err := InputSize(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	if size >= 0 {
+		return filename, func() {}, nil
+	}
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", nil, &OpenError{Path: filename, Err: err}
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(dir, "ipcounter-spool-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("spool: %w: %w", ErrSpill, err)
+	}
+	cleanup = func() { RemoveAll(dst.Name()) }
+	log = Logger(log)
+	log.Warn("input cannot be read twice; copying it to a temp file first", "input", filename, "copy", dst.Name())
+
+	n, err := io.Copy(dst, &ctxReader{ctx: ctx, r: src, name: filename})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+		if errors.Is(err, ErrRead) {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("spool: %w: %w", ErrSpill, err)
+	}
+	log.Info("spooled input", "input", filename, "bytes", n)
+	return dst.Name(), cleanup, nil
+}
+
+// ctxReader stops a copy once ctx is done, and tells read errors from
+// write errors by returning the former as a *ReadError.
+type ctxReader struct {
+	ctx    context.Context
+	r      io.Reader
+	name   string
+	offset int64
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	c.offset += int64(n)
+	if err != nil && err != io.EOF {
+		err = &ReadError{Path: c.name, Offset: c.offset, Err: err}
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package counter
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Stats collects engine-specific run statistics for -stats output. Engines
+// report through Options.Stats; a nil *Stats discards everything, so
+// engines can call Set unconditionally.
+type Stats struct {
+	mu      sync.Mutex
+	keys    []string
+	vals    map[string]string
+	sources map[int]SourceTally
+}
+
+// Set records value under key, keeping the order keys were first set in.
+func (s *Stats) Set(key, format string, args ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vals == nil {
+		s.vals = make(map[string]string)
+	}
+	if _, ok := s.vals[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.vals[key] = fmt.Sprintf(format, args...)
+}
+
+// String formats the statistics as "key: value" lines.
+func (s *Stats) String() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sb strings.Builder
+	for _, k := range s.keys {
+		fmt.Fprintf(&sb, "%s: %s\n", k, s.vals[k])
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// Map returns the statistics as a map from key to value, for callers that
+// report them as data rather than text.
+func (s *Stats) Map() map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.vals)
+}
+
+// AddSource adds t to the tally of its source, which is shown as the
+// entry "source N", N counting from 1.
+func (s *Stats) AddSource(t SourceTally) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.sources == nil {
+		s.sources = make(map[int]SourceTally)
+	}
+	cur := s.sources[t.Index]
+	cur.Source = t.Source
+	cur.Add(t)
+	s.sources[t.Index] = cur
+	s.mu.Unlock()
+	s.Set(fmt.Sprintf("source %d", t.Index+1), "%s: %d lines, %d invalid, %d new", cur.Name, cur.Lines, cur.Invalid, cur.New)
+}
+
+// Sources returns the tallies AddSource collected, in source order.
+func (s *Stats) Sources() []SourceTally {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.SortedFunc(maps.Values(s.sources), func(a, b SourceTally) int { return cmp.Compare(a.Index, b.Index) })
+}
@@ -0,0 +1,139 @@
+package counter
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// SubsampleCount is the number of distinct addresses a sample of the
+// input at Rate would have held. The sample is by address, not by line:
+// an address is in it when SubsampleHash(ip) falls in the lowest Rate of
+// the hash range, so it is in or out on every line it is on.
+type SubsampleCount struct {
+	Rate   float64 `json:"rate"`
+	Unique int64   `json:"unique"`
+}
+
+// Subsampler is a Counter that can report, after a count, the distinct
+// addresses of its set that a by-address sample at each rate of
+// Options.SubsampleRates would have kept. They come from the same set as
+// the unique count, so they are exact and the same on every run.
+type Subsampler interface {
+	Counter
+	SubsampleCounts() []SubsampleCount
+}
+
+// SubsampleHash is the hash that decides whether ip is in a subsample:
+// the splitmix64 finalizer of the address as a uint64.
+func SubsampleHash(ip uint32) uint64 {
+	h := uint64(ip)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// ParseSubsampleRates parses a -subsample-rates value, a comma-separated
+// list of rates above 0 and at most 1 such as "0.01,0.1,0.5", into
+// ascending order without duplicates. An empty value means none.
+func ParseSubsampleRates(s string) ([]float64, error) {
+	var rates []float64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		r, err := strconv.ParseFloat(f, 64)
+		if err != nil || !(r > 0 && r <= 1) {
+			return nil, fmt.Errorf("subsample rate must be above 0 and at most 1, got %q", f)
+		}
+		rates = append(rates, r)
+	}
+	slices.Sort(rates)
+	return slices.Compact(rates), nil
+}
+
+// Subsample tallies the distinct addresses of a set by the subsamples of
+// ascending rates that hold them. Every address is added once, by
+// whichever worker owns its part of the set; workers keep a Tally each
+// and Merge it, so adding needs no atomics. A nil *Subsample does
+// nothing, so engines can call it unconditionally.
+type Subsample struct {
+	rates  []float64
+	limits []uint64       // by rate, the hashes below which an address is in
+	in     []atomic.Int64 // by rate, addresses whose smallest subsample is that one
+}
+
+// NewSubsample returns the tally of rates, ascending as
+// ParseSubsampleRates returns them, or nil when there are none.
+func NewSubsample(rates []float64) *Subsample {
+	if len(rates) == 0 {
+		return nil
+	}
+	s := &Subsample{rates: rates, limits: make([]uint64, len(rates)), in: make([]atomic.Int64, len(rates))}
+	for i, r := range rates {
+		if r >= 1 {
+			s.limits[i] = math.MaxUint64
+		} else {
+			s.limits[i] = uint64(r * (1 << 64))
+		}
+	}
+	return s
+}
+
+// Tally is one worker's share of a Subsample, by rate.
+type Tally []int64
+
+// NewTally returns an empty tally for s, nil for a nil s.
+func (s *Subsample) NewTally() Tally {
+	if s == nil {
+		return nil
+	}
+	return make(Tally, len(s.rates))
+}
+
+// Add counts ip, an address of the set, in t. The rates nest, so it is
+// only counted in the smallest subsample holding it; Counts sums upward.
+func (s *Subsample) Add(t Tally, ip uint32) {
+	if s == nil {
+		return
+	}
+	h := SubsampleHash(ip)
+	for i, limit := range s.limits {
+		if h < limit || limit == math.MaxUint64 {
+			t[i]++
+			return
+		}
+	}
+}
+
+// Merge folds t into s and clears it.
+func (s *Subsample) Merge(t Tally) {
+	if s == nil {
+		return
+	}
+	for i, n := range t {
+		s.in[i].Add(n)
+		t[i] = 0
+	}
+}
+
+// Counts returns the distinct addresses in each subsample once every
+// address was added, nil for a nil s.
+func (s *Subsample) Counts() []SubsampleCount {
+	if s == nil {
+		return nil
+	}
+	out := make([]SubsampleCount, len(s.rates))
+	var n int64
+	for i, r := range s.rates {
+		n += s.in[i].Load()
+		out[i] = SubsampleCount{Rate: r, Unique: n}
+	}
+	return out
+}
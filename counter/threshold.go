@@ -0,0 +1,85 @@
+package counter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrThreshold matches a count that fell below a Thresholds bound;
+// errors.As with *ThresholdError gives the bound and the values checked.
+var ErrThreshold = errors.New("unique count below threshold")
+
+// Thresholds are lower bounds on a count for data-quality gates: a feed
+// whose exporter broke and repeats one record has far fewer unique
+// addresses, and a far lower share of unique lines, than usual.
+type Thresholds struct {
+	MinUnique int64   // fewest unique addresses, 0 for no bound
+	MinRatio  float64 // lowest unique addresses per line read, 0 for no bound
+}
+
+// Validate reports bounds that cannot be met or make no sense.
+func (t Thresholds) Validate() error {
+	if t.MinUnique < 0 {
+		return fmt.Errorf("minimum unique count must not be negative, got %d", t.MinUnique)
+	}
+	if t.MinRatio < 0 || t.MinRatio > 1 {
+		return fmt.Errorf("minimum unique ratio must be 0 to 1, got %g", t.MinRatio)
+	}
+	return nil
+}
+
+// NeedsLines reports whether Check needs the lines read, which engines
+// only count when ParseOptions.Lines is set.
+func (t Thresholds) NeedsLines() bool {
+	return t.MinRatio > 0
+}
+
+// Uniqueness is what Thresholds are checked against, so callers with a
+// policy of their own can evaluate it the same way.
+type Uniqueness struct {
+	Unique int64
+	Lines  int64 // lines read, from ParseOptions.Lines; 0 if not counted
+}
+
+// Ratio returns the unique addresses per line read, 0 when no lines were
+// read, so an empty feed fails a ratio bound as well.
+func (u Uniqueness) Ratio() float64 {
+	if u.Lines == 0 {
+		return 0
+	}
+	return float64(u.Unique) / float64(u.Lines)
+}
+
+func (u Uniqueness) String() string {
+	return fmt.Sprintf("%.4g (%d unique of %d lines)", u.Ratio(), u.Unique, u.Lines)
+}
+
+// ThresholdError records the bound a count fell below: MinRatio with
+// RatioBound, MinUnique without.
+type ThresholdError struct {
+	Uniqueness
+	Thresholds
+	RatioBound bool
+}
+
+func (e *ThresholdError) Error() string {
+	if e.RatioBound {
+		return fmt.Sprintf("unique ratio %s is below the minimum of %g", e.Uniqueness, e.MinRatio)
+	}
+	return fmt.Sprintf("%d unique addresses is below the minimum of %d", e.Unique, e.MinUnique)
+}
+
+// Is makes a ThresholdError match ErrThreshold.
+func (e *ThresholdError) Is(target error) bool { return target == ErrThreshold }
+
+// Check returns a *ThresholdError for the first bound u falls below,
+// MinUnique before MinRatio, or nil when it meets both.
+func (t Thresholds) Check(u Uniqueness) error {
+	switch {
+	case t.MinUnique > 0 && u.Unique < t.MinUnique:
+		return &ThresholdError{Uniqueness: u, Thresholds: t}
+	case t.MinRatio > 0 && u.Ratio() < t.MinRatio:
+		return &ThresholdError{Uniqueness: u, Thresholds: t, RatioBound: true}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package counter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket capping the bytes per second that pass
+// through the readers and writers sharing it. It starts full, holding one
+// second of bytes, so only what goes past the first second is delayed.
+// A nil *Limiter lets everything through.
+type Limiter struct {
+	rate float64 // bytes per second
+
+	// now and sleep are time.Now and a timer wait cut short by ctx,
+	// replaced by tests with a clock of their own
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu     sync.Mutex
+	tokens float64 // may go negative: the debt later callers wait out
+	last   time.Time
+	bytes  int64
+	waited time.Duration
+}
+
+// NewLimiter returns a Limiter for rate bytes per second, or nil for a
+// rate of 0 or less.
+func NewLimiter(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now(), now: time.Now, sleep: sleep}
+}
+
+// sleep waits d, or returns ctx's error once it is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Rate returns the cap in bytes per second.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// Totals returns the bytes let through so far and the time callers spent
+// waiting for them.
+func (l *Limiter) Totals() (bytes int64, waited time.Duration) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bytes, l.waited
+}
+
+// String describes the cap and what went through it, for -stats.
+func (l *Limiter) String() string {
+	n, waited := l.Totals()
+	return fmt.Sprintf("%s/s cap, %s through, %s waiting", FormatBytes(l.Rate()), FormatBytes(n), waited.Round(time.Millisecond))
+}
+
+// chunk is the most one Read or Write passes on at once, a tenth of a
+// second's worth, so a large buffer does not arrive in one burst.
+func (l *Limiter) chunk() int {
+	return max(int(l.rate/10), 4<<10)
+}
+
+// wait takes n bytes from the bucket and sleeps until the bucket is back
+// out of debt, or ctx is done.
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := l.now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	l.bytes += int64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.waited += d
+	}
+	l.mu.Unlock()
+	if d == 0 {
+		return nil
+	}
+	return l.sleep(ctx, d)
+}
+
+// ThrottleReader returns r read at no more than l's rate; a wait cut
+// short by ctx returns its error. A nil l returns r itself.
+func ThrottleReader(ctx context.Context, r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, l: l, ctx: ctx}
+}
+
+type throttledReader struct {
+	r   io.Reader
+	l   *Limiter
+	ctx context.Context
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p[:min(len(p), t.l.chunk())])
+	if n > 0 {
+		if werr := t.l.wait(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// ThrottleWriter returns w written at no more than l's rate. A nil l
+// returns w itself.
+func ThrottleWriter(w io.Writer, l *Limiter) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &throttledWriter{w: w, l: l}
+}
+
+type throttledWriter struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), t.l.chunk())
+		t.l.wait(context.Background(), n)
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,83 @@
+package counter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for the Limiter's clock: sleeping moves it on at
+// once by the time slept.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.t = c.t.Add(d)
+	return nil
+}
+
+// fakeLimiter returns a Limiter of rate bytes per second on a clock of
+// its own.
+func fakeLimiter(rate int64) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1e9, 0)}
+	l := NewLimiter(rate)
+	l.now, l.sleep, l.last = clock.now, clock.sleep, clock.t
+	return l, clock
+}
+
+// 5 MB at 1 MB/s takes at least 4 seconds, the first second's worth
+// passing at once, and every byte arrives, read or written.
+func TestLimiter(t *testing.T) {
+	const size, rate = 5 << 20, 1 << 20
+	data := bytes.Repeat([]byte("10.0.0.1\n"), size/9+1)[:size]
+
+	l, clock := fakeLimiter(rate)
+	start := clock.t
+	var got bytes.Buffer
+	if _, err := io.Copy(&got, ThrottleReader(context.Background(), bytes.NewReader(data), l)); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := clock.t.Sub(start)
+	if elapsed < 3999*time.Millisecond || elapsed > 4100*time.Millisecond {
+		t.Errorf("reading 5 MB at 1 MB/s took %s, want about 4s", elapsed)
+	}
+	if n, waited := l.Totals(); n != size || waited != elapsed {
+		t.Errorf("totals %d bytes, %s waiting; want %d bytes, %s", n, waited, size, elapsed)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Error("the throttled read changed the input")
+	}
+
+	l, clock = fakeLimiter(rate)
+	start = clock.t
+	got.Reset()
+	if n, err := ThrottleWriter(&got, l).Write(data); err != nil || n != size {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	if elapsed := clock.t.Sub(start); elapsed < 3999*time.Millisecond || elapsed > 4100*time.Millisecond {
+		t.Errorf("writing 5 MB at 1 MB/s took %s, want about 4s", elapsed)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Error("the throttled write changed the output")
+	}
+
+	// A read waiting out its debt stops with the context
+	l, _ = fakeLimiter(rate)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := io.Copy(io.Discard, ThrottleReader(ctx, bytes.NewReader(data), l)); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled read: %v", err)
+	}
+	if NewLimiter(0) != nil {
+		t.Error("a rate of 0 made a limiter")
+	}
+}
@@ -0,0 +1,103 @@
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// naiveVerifyMaxFileSize bounds the inputs the map-based engine is asked to
+// cross-check; beyond it the map would need gigabytes.
+const naiveVerifyMaxFileSize = 256 << 20
+
+// ErrMismatch is returned by Verify when engines disagree.
+var ErrMismatch = errors.New("engines disagree")
+
+func init() {
+	Register("all", func(o Options) (Counter, error) { return &Verify{opts: o}, nil })
+}
+
+// RunResult is the outcome of one engine in a Verify run.
+type RunResult struct {
+	Engine  string
+	Count   int64
+	Elapsed time.Duration
+	Err     error
+}
+
+// Verify is a Counter that runs naive (for small enough inputs),
+// concurrent and bucket on the same file and fails unless all agree.
+type Verify struct {
+	opts    Options
+	results []RunResult
+}
+
+// CountUniqueIPs runs every applicable engine and returns the agreed count.
+func (v *Verify) CountUniqueIPs(filename string) (int64, error) {
+	return v.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation. An input
+// that cannot be read twice, such as a pipe, is spooled to a temp file in
+// Options.TempDir first.
+func (v *Verify) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	filename, cleanup, err := Spool(ctx, filename, v.opts.TempDir, v.opts.Logger)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	size, err := InputSize(filename)
+	if err != nil {
+		return 0, err
+	}
+	engines := []string{"concurrent", "bucket"}
+	if size <= naiveVerifyMaxFileSize {
+		engines = append([]string{"naive"}, engines...)
+	}
+
+	v.results = v.results[:0]
+	for _, name := range engines {
+		c, err := NewWithOptions(name, v.opts)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		n, err := Count(ctx, c, filename)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		v.results = append(v.results, RunResult{Engine: name, Count: n, Elapsed: time.Since(start), Err: err})
+	}
+
+	for _, r := range v.results {
+		if r.Err != nil {
+			return 0, fmt.Errorf("%s: %w", r.Engine, r.Err)
+		}
+	}
+	for _, r := range v.results[1:] {
+		if r.Count != v.results[0].Count {
+			return 0, fmt.Errorf("%w:\n%s", ErrMismatch, v.Report())
+		}
+	}
+	return v.results[0].Count, nil
+}
+
+// Results returns the per-engine outcomes of the last run.
+func (v *Verify) Results() []RunResult {
+	return v.results
+}
+
+// Report formats the per-engine outcomes as an aligned table.
+func (v *Verify) Report() string {
+	var sb strings.Builder
+	for _, r := range v.results {
+		if r.Err != nil {
+			fmt.Fprintf(&sb, "  %-10s error: %v\n", r.Engine, r.Err)
+			continue
+		}
+		fmt.Fprintf(&sb, "  %-10s %12d  %s\n", r.Engine, r.Count, r.Elapsed.Round(time.Millisecond))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
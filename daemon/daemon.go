@@ -0,0 +1,659 @@
+// Package daemon keeps named counters resident in one process and serves
+// an HTTP API to create them, add addresses to them, query, reset,
+// snapshot and drop them, so services on a host, such as log shippers,
+// can push addresses under their own namespaces into one ipcounter.
+//
+// The routes are:
+//
+//	GET    /counters                   every counter's status
+//	PUT    /counters/{name}            create a counter; the body, if any, is a JSON Spec
+//	POST   /counters/{name}/add        add the addresses of the body, see AddFormat
+//	GET    /counters/{name}            the counter's status
+//	GET    /counters/{name}/prefixes   the busiest prefixes, ?len=N and ?top=K
+//	POST   /counters/{name}/reset      empty the counter
+//	POST   /counters/{name}/snapshot   save the counter to the snapshot directory
+//	DELETE /counters/{name}            drop the counter and its saved snapshot
+//
+// Replies are JSON; errors are {"error": "..."} with a 4xx or 5xx status.
+package daemon
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	// DefaultMaxBody is the largest add body accepted when Options.MaxBody
+	// is 0.
+	DefaultMaxBody = 256 << 20
+
+	// Counters read add bodies in small chunks with a short queue, so the
+	// read buffers take little of a counter's budget.
+	chunkSize  = 256 << 10
+	queueDepth = 4
+
+	specExt     = ".json"
+	snapshotExt = ".ipcset"
+
+	// DefaultPrefixLen and DefaultTop are the prefixes a prefixes query
+	// reports without ?len and ?top: the ten busiest /24s.
+	DefaultPrefixLen = 24
+	DefaultTop       = 10
+)
+
+// ErrClosed is returned, and served as 503, once the daemon is shutting
+// down.
+var ErrClosed = errors.New("daemon is shutting down")
+
+// validName is what a counter may be called; names become file names in
+// the snapshot directory.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,127}$`)
+
+// Options configures a Server.
+type Options struct {
+	// MaxMem caps the memory budgets of all counters together: a counter
+	// is only created if its budget fits in what the others left. 0 means
+	// no cap; otherwise every counter needs a budget.
+	MaxMem int64
+
+	// CounterMaxMem is the budget of a counter whose Spec sets none. 0
+	// means none.
+	CounterMaxMem int64
+
+	// SnapshotDir is where counters are saved, each as a snapshot and its
+	// Spec, and restored from. Empty disables snapshots.
+	SnapshotDir string
+
+	// MaxBody is the largest add body accepted, in bytes; 0 means
+	// DefaultMaxBody.
+	MaxBody int64
+
+	Logger *slog.Logger // nil for slog.Default()
+}
+
+// Spec is the body of a create: the options of a new counter. It is saved
+// with the counter's snapshot so a restart can recreate it.
+type Spec struct {
+	MaxMem string `json:"max_mem,omitempty"` // budget such as "64MB"; default Options.CounterMaxMem
+
+	StripPort     bool   `json:"strip_port,omitempty"`
+	Lenient       bool   `json:"lenient_parse,omitempty"`
+	Mapped        bool   `json:"accept_mapped,omitempty"`
+	CIDR          bool   `json:"expand_cidr,omitempty"`
+	Relaxed       bool   `json:"relaxed,omitempty"`
+	CommentPrefix string `json:"comment_prefix,omitempty"`
+}
+
+// Status is a counter as GET reports it.
+type Status struct {
+	Name    string            `json:"name"`
+	Unique  int64             `json:"unique"`
+	Lines   int64             `json:"lines"` // lines read by every add
+	Adds    int64             `json:"adds"`  // add requests completed, failed ones included
+	MaxMem  int64             `json:"max_mem,omitempty"`
+	Created time.Time         `json:"created"`
+	LastAdd *time.Time        `json:"last_add,omitempty"`
+	Spec    Spec              `json:"options"`
+	Stats   map[string]string `json:"stats,omitempty"` // the engine's statistics of the last add
+}
+
+// AddResult is the reply to an add.
+type AddResult struct {
+	Name   string `json:"name"`
+	New    int64  `json:"new"` // addresses of the body not in the counter before
+	Unique int64  `json:"unique"`
+	Lines  int64  `json:"lines"` // lines of the body
+}
+
+// ResetResult is the reply to a reset.
+type ResetResult struct {
+	Name    string `json:"name"`
+	Cleared int64  `json:"cleared"` // addresses the counter held
+}
+
+// PrefixesResult is the reply to a prefixes query.
+type PrefixesResult struct {
+	Name     string        `json:"name"`
+	Len      int           `json:"len"`
+	Prefixes int           `json:"prefixes"` // prefixes of Len holding any address
+	Top      []PrefixCount `json:"top"`      // the busiest first, ties in address order
+}
+
+// PrefixCount is the number of distinct addresses a counter holds in one
+// prefix.
+type PrefixCount struct {
+	Prefix string `json:"prefix"`
+	Unique int64  `json:"unique"`
+}
+
+// SnapshotResult is the reply to a snapshot.
+type SnapshotResult struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Unique int64  `json:"unique"`
+}
+
+// Server holds the counters and serves the API. Its methods are safe for
+// concurrent use.
+type Server struct {
+	opts Options
+	log  *slog.Logger
+	mux  *http.ServeMux
+
+	mu       sync.Mutex
+	counters map[string]*entry
+	reserved int64 // the budgets of the counters, against MaxMem
+	closed   bool
+}
+
+// entry is one named counter. Its mutex serializes the adds, which reset
+// the counter's run state, with snapshots, which must not run during an
+// add, and with dropping it; reads of its totals do not take it.
+type entry struct {
+	name    string
+	spec    Spec
+	maxMem  int64
+	created time.Time
+
+	mu      sync.Mutex
+	b       *concurrent.BitsetCounter
+	stats   *counter.Stats
+	dropped bool // removed from the server; waiting adds give up
+
+	lines   atomic.Int64
+	adds    atomic.Int64
+	lastAdd atomic.Int64 // UnixNano, 0 before the first add
+}
+
+// New returns a Server with no counters.
+func New(opts Options) *Server {
+	s := &Server{
+		opts:     opts,
+		log:      counter.Logger(opts.Logger),
+		mux:      http.NewServeMux(),
+		counters: make(map[string]*entry),
+	}
+	s.opts.MaxBody = cmp.Or(s.opts.MaxBody, DefaultMaxBody)
+	s.mux.HandleFunc("GET /counters", s.handleList)
+	s.mux.HandleFunc("PUT /counters/{name}", s.handleCreate)
+	s.mux.HandleFunc("POST /counters/{name}/add", s.handleAdd)
+	s.mux.HandleFunc("GET /counters/{name}", s.handleGet)
+	s.mux.HandleFunc("GET /counters/{name}/prefixes", s.handlePrefixes)
+	s.mux.HandleFunc("POST /counters/{name}/reset", s.handleReset)
+	s.mux.HandleFunc("POST /counters/{name}/snapshot", s.handleSnapshot)
+	s.mux.HandleFunc("DELETE /counters/{name}", s.handleDelete)
+	return s
+}
+
+// ServeHTTP serves the API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// httpError is an error with the status it is served with.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+func (e *httpError) Unwrap() error { return e.err }
+
+func errorf(status int, format string, args ...any) error {
+	return &httpError{status, fmt.Errorf(format, args...)}
+}
+
+// Create adds a counter called name with the options of spec, reserving
+// its budget against Options.MaxMem.
+func (s *Server) Create(name string, spec Spec) error {
+	if !validName.MatchString(name) {
+		return errorf(http.StatusBadRequest, "invalid counter name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	maxMem := s.opts.CounterMaxMem
+	if spec.MaxMem != "" {
+		n, err := counter.ParseBytes(spec.MaxMem)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "max_mem: %v", err)
+		}
+		maxMem = n
+	}
+	if maxMem > 0 {
+		spec.MaxMem = strconv.FormatInt(maxMem, 10) // a restore keeps the budget whatever the default then
+	}
+	if s.opts.MaxMem > 0 && maxMem == 0 {
+		return errorf(http.StatusBadRequest, "counter %s needs a max_mem within the daemon's %s budget",
+			name, counter.FormatBytes(s.opts.MaxMem))
+	}
+	e := &entry{name: name, spec: spec, maxMem: maxMem, created: time.Now(), stats: &counter.Stats{}}
+	opts := concurrent.Options{
+		Parse: utils.ParseOptions{
+			StripPort:     spec.StripPort,
+			Lenient:       spec.Lenient,
+			Mapped:        spec.Mapped,
+			CIDR:          spec.CIDR,
+			CommentPrefix: spec.CommentPrefix,
+			Lines:         &e.lines,
+		},
+		MaxMem:     maxMem,
+		ChunkSize:  chunkSize,
+		QueueDepth: queueDepth,
+		Stats:      e.stats,
+		Logger:     s.log.With("counter", name),
+	}
+	if spec.Relaxed {
+		opts.Parse.Relaxed = new(utils.Normalized)
+	}
+	b, err := concurrent.NewWithOptions(opts)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	e.b = b
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if _, ok := s.counters[name]; ok {
+		return errorf(http.StatusConflict, "counter %s already exists", name)
+	}
+	if s.opts.MaxMem > 0 && s.reserved+maxMem > s.opts.MaxMem {
+		return errorf(http.StatusInsufficientStorage, "a %s budget for %s does not fit: %s of the daemon's %s are reserved",
+			counter.FormatBytes(maxMem), name, counter.FormatBytes(s.reserved), counter.FormatBytes(s.opts.MaxMem))
+	}
+	s.counters[name] = e
+	s.reserved += maxMem
+	s.log.Info("counter created", "name", name, "max_mem", maxMem)
+	return nil
+}
+
+// lookup returns the counter called name.
+func (s *Server) lookup(name string) (*entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	e, ok := s.counters[name]
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "no counter %s", name)
+	}
+	return e, nil
+}
+
+// Add counts the addresses of r, one per line, into the counter called
+// name. Over the counter's budget the addresses that fit are kept and the
+// error wraps counter.ErrMemBudget.
+func (s *Server) Add(ctx context.Context, name string, r io.Reader) (AddResult, error) {
+	e, err := s.lookup(name)
+	if err != nil {
+		return AddResult{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.dropped {
+		return AddResult{}, errorf(http.StatusNotFound, "no counter %s", name)
+	}
+	before := e.lines.Load()
+	n, err := e.b.CountReader(ctx, r)
+	e.adds.Add(1)
+	e.lastAdd.Store(time.Now().UnixNano())
+	res := AddResult{Name: name, New: n, Unique: e.b.Count(), Lines: e.lines.Load() - before}
+	return res, err
+}
+
+// Status returns the counter called name.
+func (s *Server) Status(name string) (Status, error) {
+	e, err := s.lookup(name)
+	if err != nil {
+		return Status{}, err
+	}
+	return e.status(), nil
+}
+
+// status reports e without waiting for a running add; its totals are then
+// the add's progress so far.
+func (e *entry) status() Status {
+	st := Status{
+		Name:    e.name,
+		Unique:  e.b.Count(),
+		Lines:   e.lines.Load(),
+		Adds:    e.adds.Load(),
+		MaxMem:  e.maxMem,
+		Created: e.created,
+		Spec:    e.spec,
+		Stats:   e.stats.Map(),
+	}
+	if t := e.lastAdd.Load(); t != 0 {
+		last := time.Unix(0, t)
+		st.LastAdd = &last
+	}
+	return st
+}
+
+// Reset empties the counter called name, after any add in progress, and
+// returns how many addresses it held. Its shards stay allocated for the
+// adds to come, and its lines and adds keep their totals.
+func (s *Server) Reset(name string) (ResetResult, error) {
+	e, err := s.lookup(name)
+	if err != nil {
+		return ResetResult{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.dropped {
+		return ResetResult{}, errorf(http.StatusNotFound, "no counter %s", name)
+	}
+	cleared := e.b.Count()
+	e.b.Reset()
+	s.log.Info("counter reset", "name", name, "cleared", cleared)
+	return ResetResult{Name: name, Cleared: cleared}, nil
+}
+
+// Prefixes returns the top prefixes of length bits, 1 to 24, holding the
+// most distinct addresses of the counter called name, or all of them for
+// top 0. Like a status it does not wait for a running add, and its tally
+// takes 32 MB, one count per /24, while it runs.
+func (s *Server) Prefixes(name string, bits, top int) (PrefixesResult, error) {
+	if bits < 1 || bits > 24 {
+		return PrefixesResult{}, errorf(http.StatusBadRequest, "prefix length must be 1 to 24, got %d", bits)
+	}
+	if top < 0 {
+		return PrefixesResult{}, errorf(http.StatusBadRequest, "top must not be negative, got %d", top)
+	}
+	e, err := s.lookup(name)
+	if err != nil {
+		return PrefixesResult{}, err
+	}
+	subnets, seen := counter.TopSubnets(e.b.Density(), bits, top)
+	res := PrefixesResult{Name: name, Len: bits, Prefixes: seen, Top: make([]PrefixCount, len(subnets))}
+	for i, sn := range subnets {
+		res.Top[i] = PrefixCount{Prefix: sn.Prefix.String(), Unique: sn.Unique}
+	}
+	return res, nil
+}
+
+// List returns the status of every counter, by name.
+func (s *Server) List() ([]Status, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	entries := make([]*entry, 0, len(s.counters))
+	for _, e := range s.counters {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(entries, func(a, b *entry) int { return strings.Compare(a.name, b.name) })
+	list := make([]Status, len(entries))
+	for i, e := range entries {
+		list[i] = e.status()
+	}
+	return list, nil
+}
+
+// Snapshot saves the counter called name to the snapshot directory, after
+// any add in progress.
+func (s *Server) Snapshot(name string) (SnapshotResult, error) {
+	if s.opts.SnapshotDir == "" {
+		return SnapshotResult{}, errorf(http.StatusConflict, "the daemon has no snapshot directory")
+	}
+	e, err := s.lookup(name)
+	if err != nil {
+		return SnapshotResult{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.dropped {
+		return SnapshotResult{}, errorf(http.StatusNotFound, "no counter %s", name)
+	}
+	return s.save(e)
+}
+
+// save writes e's Spec, then its snapshot, to the snapshot directory. The
+// caller holds e.mu.
+func (s *Server) save(e *entry) (SnapshotResult, error) {
+	base := filepath.Join(s.opts.SnapshotDir, e.name)
+	err := counter.WriteFileAtomic(base+specExt, true, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e.spec)
+	})
+	if err != nil {
+		return SnapshotResult{}, err
+	}
+	if err := e.b.WriteSnapshotFile(base + snapshotExt); err != nil {
+		return SnapshotResult{}, err
+	}
+	return SnapshotResult{Name: e.name, Path: base + snapshotExt, Unique: e.b.Count()}, nil
+}
+
+// Delete drops the counter called name, after any add in progress,
+// releasing its memory and budget and removing its saved snapshot so a
+// restore does not bring it back.
+func (s *Server) Delete(name string) error {
+	s.mu.Lock()
+	e, ok := s.counters[name]
+	switch {
+	case s.closed:
+		s.mu.Unlock()
+		return ErrClosed
+	case !ok:
+		s.mu.Unlock()
+		return errorf(http.StatusNotFound, "no counter %s", name)
+	}
+	delete(s.counters, name)
+	s.mu.Unlock()
+
+	e.mu.Lock()
+	e.dropped = true
+	e.b.ResetAndFree()
+	err := e.b.Close()
+	e.mu.Unlock()
+
+	s.mu.Lock()
+	s.reserved -= e.maxMem
+	s.mu.Unlock()
+	if s.opts.SnapshotDir != "" {
+		base := filepath.Join(s.opts.SnapshotDir, name)
+		for _, p := range []string{base + snapshotExt, base + specExt} {
+			if rerr := os.Remove(p); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+				err = cmp.Or(err, rerr)
+			}
+		}
+	}
+	s.log.Info("counter dropped", "name", name)
+	return err
+}
+
+// Restore recreates every counter saved in the snapshot directory, with
+// its Spec and addresses, and returns how many there were. It stops at the
+// first that fails, such as one that no longer fits the daemon's budget.
+func (s *Server) Restore() (int, error) {
+	if s.opts.SnapshotDir == "" {
+		return 0, errors.New("restore needs a snapshot directory")
+	}
+	specs, err := filepath.Glob(filepath.Join(s.opts.SnapshotDir, "*"+specExt))
+	if err != nil {
+		return 0, err
+	}
+	slices.Sort(specs)
+	for i, path := range specs {
+		name := strings.TrimSuffix(filepath.Base(path), specExt)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return i, err
+		}
+		var spec Spec
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return i, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := s.Create(name, spec); err != nil {
+			return i, fmt.Errorf("restore %s: %w", name, err)
+		}
+		e, err := s.lookup(name)
+		if err != nil {
+			return i, err
+		}
+		n, err := e.b.LoadSnapshotFile(strings.TrimSuffix(path, specExt) + snapshotExt)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return i, fmt.Errorf("restore %s: %w", name, err)
+		}
+		s.log.Info("counter restored", "name", name, "unique", n)
+	}
+	return len(specs), nil
+}
+
+// Close stops serving the counters: requests after it fail with
+// ErrClosed. It waits for each running add or snapshot, saves every
+// counter if snapshot is set, then releases them, and returns the first
+// error.
+func (s *Server) Close(snapshot bool) error {
+	s.mu.Lock()
+	s.closed = true
+	entries := make([]*entry, 0, len(s.counters))
+	for _, e := range s.counters {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+	var first error
+	for _, e := range entries {
+		e.mu.Lock()
+		if snapshot && s.opts.SnapshotDir != "" {
+			if res, err := s.save(e); err != nil {
+				first = cmp.Or(first, fmt.Errorf("snapshot %s: %w", e.name, err))
+			} else {
+				s.log.Info("counter saved", "name", e.name, "unique", res.Unique)
+			}
+		}
+		e.dropped = true
+		if err := e.b.Close(); err != nil {
+			first = cmp.Or(first, err)
+		}
+		e.mu.Unlock()
+	}
+	return first
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	list, err := s.List()
+	reply(w, list, err)
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var spec Spec
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil && err != io.EOF {
+		reply(w, nil, errorf(http.StatusBadRequest, "counter options: %v", err))
+		return
+	}
+	name := r.PathValue("name")
+	if err := s.Create(name, spec); err != nil {
+		reply(w, nil, err)
+		return
+	}
+	st, err := s.Status(name)
+	replyStatus(w, http.StatusCreated, st, err)
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := AddFormat(r.Header.Get("Content-Type"), r.URL.Query().Get("field"), http.MaxBytesReader(w, r.Body, s.opts.MaxBody))
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	res, err := s.Add(r.Context(), r.PathValue("name"), body)
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		err = errorf(http.StatusRequestEntityTooLarge, "body over %s; the addresses before the cut were added (%d new)",
+			counter.FormatBytes(tooBig.Limit), res.New)
+	}
+	reply(w, res, err)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	st, err := s.Status(r.PathValue("name"))
+	reply(w, st, err)
+}
+
+func (s *Server) handlePrefixes(w http.ResponseWriter, r *http.Request) {
+	bits, top := DefaultPrefixLen, DefaultTop
+	for param, v := range map[string]*int{"len": &bits, "top": &top} {
+		if q := r.URL.Query().Get(param); q != "" {
+			n, err := strconv.Atoi(q)
+			if err != nil {
+				reply(w, nil, errorf(http.StatusBadRequest, "%s: %v", param, err))
+				return
+			}
+			*v = n
+		}
+	}
+	res, err := s.Prefixes(r.PathValue("name"), bits, top)
+	reply(w, res, err)
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	res, err := s.Reset(r.PathValue("name"))
+	reply(w, res, err)
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	res, err := s.Snapshot(r.PathValue("name"))
+	reply(w, res, err)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := s.Delete(r.PathValue("name")); err != nil {
+		reply(w, nil, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reply writes v as JSON with status 200, or err with its status.
+func reply(w http.ResponseWriter, v any, err error) {
+	replyStatus(w, http.StatusOK, v, err)
+}
+
+func replyStatus(w http.ResponseWriter, status int, v any, err error) {
+	if err != nil {
+		var he *httpError
+		switch {
+		case errors.As(err, &he):
+			status = he.status
+		case errors.Is(err, ErrClosed):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, counter.ErrMemBudget):
+			status = http.StatusInsufficientStorage
+		case errors.Is(err, context.Canceled):
+			status = http.StatusServiceUnavailable
+		default:
+			status = http.StatusInternalServerError
+		}
+		v = map[string]string{"error": err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
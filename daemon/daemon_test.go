@@ -0,0 +1,230 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// call sends a request to the test server and decodes a JSON reply into
+// out, returning the status.
+func call(t *testing.T, ts *httptest.Server, method, path, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, path, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+// lines formats the addresses 10.0.0.0 + i<<14 for i in [from, to), which
+// all fall in the first bitset shard, one per line.
+func lines(from, to int) string {
+	var b strings.Builder
+	for i := from; i < to; i++ {
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(10<<24|uint32(i)<<14))
+	}
+	return b.String()
+}
+
+// Counters are created within the daemon's budget, take concurrent adds
+// without losing or double-counting an address, stay independent of each
+// other, and come back from their snapshots after a restart unless they
+// were dropped.
+func TestDaemon(t *testing.T) {
+	dir := t.TempDir()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts := Options{MaxMem: 160 << 20, CounterMaxMem: 64 << 20, SnapshotDir: dir, MaxBody: 1 << 20, Logger: discard}
+	srv := New(opts)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	if st := call(t, ts, "PUT", "/counters/logins", "", nil); st != http.StatusCreated {
+		t.Fatalf("create: %d", st)
+	}
+	if st := call(t, ts, "PUT", "/counters/api", `{"max_mem": "80MB", "strip_port": true}`, nil); st != http.StatusCreated {
+		t.Fatalf("create with options: %d", st)
+	}
+	for path, want := range map[string]int{
+		"/counters/logins": http.StatusConflict,
+		"/counters/third":  http.StatusInsufficientStorage, // 144 of 160 MB reserved
+		"/counters/.x":     http.StatusBadRequest,
+	} {
+		if st := call(t, ts, "PUT", path, "", nil); st != want {
+			t.Errorf("create %s: %d, want %d", path, st, want)
+		}
+	}
+	if st := call(t, ts, "PUT", "/counters/bad", `{"max_mem": "lots"}`, nil); st != http.StatusBadRequest {
+		t.Errorf("create with a bad budget: %d", st)
+	}
+
+	// Eight clients add overlapping ranges of 10.0.0.0 + i<<14, i < 900
+	var wg sync.WaitGroup
+	for c := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var res AddResult
+			if st := call(t, ts, "POST", "/counters/logins/add", lines(c*100, c*100+200), &res); st != http.StatusOK || res.Lines != 200 {
+				t.Errorf("add %d: %d, %+v", c, st, res)
+			}
+		}()
+	}
+	wg.Wait()
+	var st Status
+	if code := call(t, ts, "GET", "/counters/logins", "", &st); code != http.StatusOK || st.Unique != 900 || st.Lines != 1600 || st.Adds != 8 {
+		t.Errorf("logins: %d, %+v; want 900 unique of 1600 lines in 8 adds", code, st)
+	}
+	var res AddResult
+	if code := call(t, ts, "POST", "/counters/api/add", "10.0.0.0:443\n10.0.64.0:80\nbad\n", &res); code != http.StatusOK || res.New != 2 || res.Unique != 2 {
+		t.Errorf("api: %d, %+v; want 2 new", code, res)
+	}
+	if code := call(t, ts, "POST", "/counters/api/add", strings.Repeat("x", 2<<20), nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: %d", code)
+	}
+	if code := call(t, ts, "POST", "/counters/nope/add", "1.2.3.4\n", nil); code != http.StatusNotFound {
+		t.Errorf("add to a missing counter: %d", code)
+	}
+
+	// Addresses over more shards than 64 MB allow keep what fits
+	var wide strings.Builder
+	for i := range 1 << 12 {
+		fmt.Fprintf(&wide, "%s\n", utils.FormatIPv4(20<<24|uint32(i)))
+	}
+	if code := call(t, ts, "POST", "/counters/logins/add", wide.String(), nil); code != http.StatusInsufficientStorage {
+		t.Errorf("over budget: %d", code)
+	}
+	if _, err := srv.Add(context.Background(), "logins", strings.NewReader(wide.String())); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("over budget: %v, want ErrMemBudget", err)
+	}
+
+	var list []Status
+	if code := call(t, ts, "GET", "/counters", "", &list); code != http.StatusOK || len(list) != 2 || list[0].Name != "api" || list[1].Name != "logins" {
+		t.Errorf("list: %d, %+v", code, list)
+	}
+	var snap SnapshotResult
+	if code := call(t, ts, "POST", "/counters/api/snapshot", "", &snap); code != http.StatusOK || snap.Unique != 2 {
+		t.Errorf("snapshot: %d, %+v", code, snap)
+	}
+	if code := call(t, ts, "DELETE", "/counters/api", "", nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "api"+snapshotExt)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the dropped counter's snapshot is still there: %v", err)
+	}
+	// Its budget is free again
+	if code := call(t, ts, "PUT", "/counters/third", "", nil); code != http.StatusCreated {
+		t.Errorf("create after delete: %d", code)
+	}
+
+	call(t, ts, "GET", "/counters/logins", "", &st)
+	if err := srv.Close(true); err != nil {
+		t.Fatal(err)
+	}
+	if code := call(t, ts, "GET", "/counters/logins", "", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("after close: %d", code)
+	}
+
+	again := New(opts)
+	defer again.Close(false)
+	if n, err := again.Restore(); err != nil || n != 2 {
+		t.Fatalf("restore: %d counters, %v; want logins and third", n, err)
+	}
+	got, err := again.Status("logins")
+	if err != nil || got.Unique != st.Unique || got.MaxMem != 64<<20 {
+		t.Errorf("restored logins: %+v, %v; want %d unique", got, err, st.Unique)
+	}
+}
+
+// callType is call with a Content-Type.
+func callType(t *testing.T, ts *httptest.Server, path, contentType, body string, out any) int {
+	t.Helper()
+	resp, err := ts.Client().Post(ts.URL+path, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("POST %s: %v in %q", path, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Adds take a JSON array or JSON lines as well as plain lines, prefixes
+// are tallied busiest first, and a reset empties the counter.
+func TestAddFormats(t *testing.T) {
+	srv := New(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer srv.Close(false)
+	if st := call(t, ts, "PUT", "/counters/edge", "", nil); st != http.StatusCreated {
+		t.Fatalf("create: %d", st)
+	}
+
+	for _, tc := range []struct {
+		path, contentType, body string
+		status                  int
+		new, lines              int64
+	}{
+		{"/counters/edge/add", "", "10.0.0.1", http.StatusOK, 1, 1},
+		{"/counters/edge/add", "text/plain; charset=utf-8", "10.0.0.1\n10.0.0.2\n", http.StatusOK, 1, 2},
+		{"/counters/edge/add", "application/json", `["10.0.1.1", "10.0.1.2", "10.0.0.1"]`, http.StatusOK, 2, 3},
+		{"/counters/edge/add", "application/json", `{"ip": "10.0.1.3"}`, http.StatusBadRequest, 0, 0},
+		{"/counters/edge/add", "application/x-ndjson",
+			"{\"ip\": \"10.1.0.1\", \"path\": \"/\"}\n\n{\"status\": 200}\n{\"ip\": \"10.0.1.1\"}", http.StatusOK, 1, 4},
+		{"/counters/edge/add?field=client.ip", "application/jsonl",
+			`{"client": {"ip": "10.1.0.2"}}` + "\n", http.StatusOK, 1, 1},
+		{"/counters/edge/add", "image/png", "", http.StatusUnsupportedMediaType, 0, 0},
+	} {
+		var res AddResult
+		st := callType(t, ts, tc.path, tc.contentType, tc.body, &res)
+		if st != tc.status || res.New != tc.new || res.Lines != tc.lines {
+			t.Errorf("%s %s %q: %d, %+v; want %d with %d new of %d lines", tc.path, tc.contentType, tc.body, st, res, tc.status, tc.new, tc.lines)
+		}
+	}
+
+	var pre PrefixesResult
+	if st := call(t, ts, "GET", "/counters/edge/prefixes?len=16&top=1", "", &pre); st != http.StatusOK ||
+		pre.Prefixes != 2 || len(pre.Top) != 1 || pre.Top[0] != (PrefixCount{"10.0.0.0/16", 4}) {
+		t.Errorf("prefixes: %d, %+v; want 10.0.0.0/16 with 4 of 2 prefixes", st, pre)
+	}
+	if st := call(t, ts, "GET", "/counters/edge/prefixes?len=25", "", nil); st != http.StatusBadRequest {
+		t.Errorf("prefixes of /25: %d", st)
+	}
+
+	var reset ResetResult
+	if st := callType(t, ts, "/counters/edge/reset", "", "", &reset); st != http.StatusOK || reset.Cleared != 6 {
+		t.Errorf("reset: %d, %+v; want 6 cleared", st, reset)
+	}
+	var res AddResult
+	if st := callType(t, ts, "/counters/edge/add", "", "10.0.0.1\n", &res); st != http.StatusOK || res.New != 1 || res.Unique != 1 {
+		t.Errorf("add after reset: %d, %+v", st, res)
+	}
+}
@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// AddFormat returns the body of an add, of media type contentType, as the
+// addresses a counter reads, one per line:
+//
+//	text/plain, or none    one address per line, as it is
+//	application/json       a JSON array of address strings
+//	application/x-ndjson   a JSON object per line, as log shippers stream
+//	                       events, the address being the string or number
+//	                       at field, dotted for a nested one, or at "ip"
+//	                       for an empty field; also application/jsonl
+//
+// A JSON line without the field is passed on as it is, to be skipped as
+// malformed, so every line of the body stays one line of the add.
+func AddFormat(contentType, field string, body io.Reader) (io.Reader, error) {
+	media := "text/plain"
+	if contentType != "" {
+		var err error
+		if media, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, errorf(http.StatusUnsupportedMediaType, "content type: %v", err)
+		}
+	}
+	switch {
+	case strings.HasPrefix(media, "text/"), media == "application/octet-stream":
+		return body, nil
+	case media == "application/json":
+		var ips []string
+		if err := json.NewDecoder(body).Decode(&ips); err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				return nil, errorf(http.StatusRequestEntityTooLarge, "body over %s; nothing was added", counter.FormatBytes(tooBig.Limit))
+			}
+			return nil, errorf(http.StatusBadRequest, "a JSON body must be an array of addresses: %v", err)
+		}
+		if len(ips) == 0 {
+			return strings.NewReader(""), nil
+		}
+		return strings.NewReader(strings.Join(ips, "\n") + "\n"), nil
+	case media == "application/x-ndjson", media == "application/jsonl":
+		extract, err := utils.ParseExtractor("json:"+cmp.Or(field, "ip"), 0)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "field: %v", err)
+		}
+		return &jsonLines{br: bufio.NewReader(body), extract: extract}, nil
+	}
+	return nil, errorf(http.StatusUnsupportedMediaType, "cannot add a %s body: send text/plain, application/json or application/x-ndjson", media)
+}
+
+// jsonLines reads a body of JSON lines as the addresses they hold, a line
+// each.
+type jsonLines struct {
+	br      *bufio.Reader
+	extract utils.Extractor
+	line    []byte // the line being read, across ReadSlice's buffer
+	out     []byte // what is left to return of the last line
+	err     error  // the body's error, once out is returned
+}
+
+func (j *jsonLines) Read(p []byte) (int, error) {
+	for len(j.out) == 0 {
+		if j.err != nil {
+			return 0, j.err
+		}
+		part, err := j.br.ReadSlice('\n')
+		j.line = append(j.line, part...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		j.err = err
+		if len(j.line) == 0 {
+			continue
+		}
+		line := bytes.TrimSpace(j.line)
+		if addr, ok := j.extract(line); ok {
+			line = addr
+		}
+		j.out = append(append(j.out[:0], line...), '\n')
+		j.line = j.line[:0]
+	}
+	n := copy(p, j.out)
+	j.out = j.out[n:]
+	return n, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/daemon"
+)
+
+// runDaemon implements `ipcounter daemon`, also run as `ipcounter serve`: keep named counters resident and
+// serve the daemon package's HTTP API on a unix socket or TCP address until
+// interrupted, then let running requests finish, optionally save every
+// counter, and exit.
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	addr := fs.String("addr", "unix:///run/ipcounter.sock", "where to listen: unix:///path/to.sock, tcp://host:port or host:port")
+	maxMem := fs.String("max-mem", "0", "cap on the memory budgets of all counters together, e.g. 4GB; each counter then needs a budget (0 = no cap)")
+	counterMaxMem := fs.String("counter-max-mem", "0", "memory budget of a counter created without max_mem, e.g. 512MB (0 = none)")
+	snapshotDir := fs.String("snapshot-dir", "", "directory counters are saved to by the snapshot route and restored from")
+	snapshotOnExit := fs.Bool("snapshot-on-exit", false, "save every counter to -snapshot-dir on shutdown")
+	restore := fs.Bool("restore", false, "recreate the counters saved in -snapshot-dir at startup")
+	maxBody := fs.String("max-body", "256MB", "largest add request body")
+	grace := fs.Duration("shutdown-timeout", 30*time.Second, "how long running requests may take to finish on shutdown before their adds are stopped")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter daemon|serve [-addr unix:///run/ipcounter.sock] [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	opts := daemon.Options{SnapshotDir: *snapshotDir}
+	for _, f := range []struct {
+		name string
+		val  string
+		dst  *int64
+	}{{"-max-mem", *maxMem, &opts.MaxMem}, {"-counter-max-mem", *counterMaxMem, &opts.CounterMaxMem}, {"-max-body", *maxBody, &opts.MaxBody}} {
+		n, err := counter.ParseBytes(f.val)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*f.dst = n
+	}
+	if (*snapshotOnExit || *restore) && *snapshotDir == "" {
+		return errors.New("-snapshot-on-exit and -restore need -snapshot-dir")
+	}
+	if *snapshotDir != "" {
+		if err := os.MkdirAll(*snapshotDir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	srv := daemon.New(opts)
+	if *restore {
+		n, err := srv.Restore()
+		if err != nil {
+			srv.Close(false)
+			return err
+		}
+		slog.Info("restored counters", "dir", *snapshotDir, "counters", n)
+	}
+	ln, err := listen(*addr)
+	if err != nil {
+		srv.Close(false)
+		return err
+	}
+
+	// Adds run under runCtx, so those still going after the grace period
+	// can be stopped; the counters keep what they added so far
+	runCtx, stopAdds := context.WithCancel(context.Background())
+	defer stopAdds()
+	hs := &http.Server{Handler: srv, BaseContext: func(net.Listener) context.Context { return runCtx }}
+	served := make(chan error, 1)
+	go func() { served <- hs.Serve(ln) }()
+	slog.Info("daemon listening", "addr", *addr)
+
+	ctx := interruptContext()
+	select {
+	case err := <-served:
+		srv.Close(*snapshotOnExit)
+		return err
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	if err := hs.Shutdown(shutdown); err != nil {
+		slog.Warn("requests still running at the shutdown timeout; stopping their adds", "err", err)
+		stopAdds()
+	}
+	return srv.Close(*snapshotOnExit)
+}
+
+// listen opens addr, a unix:// socket path, a tcp:// address or a bare
+// host:port. A socket file left by a daemon that is gone is replaced; one
+// that still answers is an error.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: another daemon is listening", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// runDelta implements `ipcounter delta`: load a baseline snapshot into the
+// concurrent engine's set and count the inputs into it, so the count is
+// of addresses the baseline did not hold, each once however often it
+// repeats. With -update the grown set replaces the baseline.
+func runDelta(args []string) error {
+	fs := flag.NewFlagSet("delta", flag.ExitOnError)
+	baseline := fs.String("baseline", "", "snapshot of the addresses already seen (required)")
+	update := fs.Bool("update", false, "write the baseline plus today's addresses back to -baseline; a missing baseline then starts empty")
+	ef := addEngineFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter delta -baseline FILE [-update] [flags] <filename>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *baseline == "" || fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	d, err := countDelta(interruptContext(), *baseline, *update, fs.Args(), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("New IPv4 addresses: %d\n", d.new)
+	fmt.Printf("Baseline IPv4 addresses: %d\n", d.baseline)
+	if *update {
+		fmt.Printf("Updated baseline IPv4 addresses: %d\n", d.updated)
+	}
+	return nil
+}
+
+// delta is what countDelta found.
+type delta struct {
+	new      int64 // addresses of the inputs the baseline lacked
+	baseline int64 // addresses of the baseline
+	updated  int64 // addresses of the baseline written back, with update
+}
+
+// countDelta counts the addresses of paths missing from the snapshot at
+// baseline and, with update, writes the grown set back to it; a missing
+// baseline then starts empty.
+func countDelta(ctx context.Context, baseline string, update bool, paths []string, opts counter.Options) (delta, error) {
+	if opts.InputFormat == "pcap" || opts.InputFormat == "parquet" {
+		return delta{}, fmt.Errorf("delta cannot read -input-format %s", opts.InputFormat)
+	}
+	if opts.StateFile != "" {
+		return delta{}, errors.New("delta keeps its set in -baseline, not -state-file")
+	}
+	c, err := counter.NewWithOptions("concurrent", opts)
+	if err != nil {
+		return delta{}, err
+	}
+	b := c.(*concurrent.BitsetCounter)
+
+	var d delta
+	d.baseline, err = b.LoadSnapshotFile(baseline)
+	if errors.Is(err, os.ErrNotExist) && update {
+		slog.Info("no baseline yet; starting empty", "baseline", baseline)
+	} else if err != nil {
+		return delta{}, fmt.Errorf("baseline: %w", err)
+	}
+
+	src := ipcount.File(paths[0])
+	if len(paths) > 1 {
+		src = ipcount.Files(paths...)
+	}
+	res, err := ipcount.Count(ctx, src, ipcount.WithEngine("concurrent"), ipcount.WithCounter(c), ipcount.WithOptions(opts))
+	if err != nil {
+		return delta{}, err
+	}
+	d.new = res.Unique
+	if update {
+		if err := b.WriteSnapshotFile(baseline); err != nil {
+			return delta{}, err
+		}
+		d.updated = b.Count()
+	}
+	return d, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// Against an empty baseline, or none with -update, the delta is the plain
+// count; against a baseline of the input itself it is 0; and -update
+// leaves the union behind for the next run.
+func TestCountDelta(t *testing.T) {
+	dir := t.TempDir()
+	var b strings.Builder
+	for ip := range 2000 {
+		fmt.Fprintf(&b, "10.%d.%d.1\n10.%d.%d.1\n", ip>>8, ip&0xff, ip>>8, ip&0xff)
+	}
+	input := filepath.Join(dir, "today.log")
+	if err := os.WriteFile(input, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.bits")
+	if err := concurrent.New().WriteSnapshotFile(empty); err != nil {
+		t.Fatal(err)
+	}
+	same := filepath.Join(dir, "same.bits")
+	set := concurrent.New()
+	if _, err := set.CountUniqueIPs(input); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.WriteSnapshotFile(same); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	paths := []string{input}
+	if d, err := countDelta(ctx, empty, false, paths, counter.Options{}); err != nil || d != (delta{new: 2000}) {
+		t.Errorf("empty baseline: %+v, %v", d, err)
+	}
+	if d, err := countDelta(ctx, same, false, paths, counter.Options{}); err != nil || d != (delta{baseline: 2000}) {
+		t.Errorf("baseline of the input: %+v, %v", d, err)
+	}
+	missing := filepath.Join(dir, "new.bits")
+	if _, err := countDelta(ctx, missing, false, paths, counter.Options{}); err == nil {
+		t.Error("a missing baseline was taken for an empty one without -update")
+	}
+	if d, err := countDelta(ctx, missing, true, paths, counter.Options{}); err != nil || d != (delta{new: 2000, updated: 2000}) {
+		t.Errorf("missing baseline with update: %+v, %v", d, err)
+	}
+	if d, err := countDelta(ctx, missing, true, paths, counter.Options{}); err != nil || d != (delta{baseline: 2000, updated: 2000}) {
+		t.Errorf("the updated baseline: %+v, %v", d, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcset"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// dumpEncodings maps the binary -dump-format values to their payload
+// encoding.
+var dumpEncodings = map[string]ipcset.Encoding{
+	"ipcset":     ipcset.Delta,
+	"ipcset-raw": ipcset.Raw,
+}
+
+// checkDumpFormat validates a -dump-format value.
+func checkDumpFormat(format string) error {
+	if _, ok := dumpEncodings[format]; !ok && format != "text" {
+		return fmt.Errorf("-dump-format must be text, ipcset or ipcset-raw, got %q", format)
+	}
+	return nil
+}
+
+// writeDump writes the distinct addresses of c's set to path in ascending
+// order, through a temp file renamed into place once complete: as one
+// dotted quad per line for text, or as an ipcset file recording sources
+// and the flags of fs that were set. The set is the concurrent engine's,
+// so with -state-file or -preload it holds those addresses too.
+func writeDump(c counter.Counter, path, format string, sources []string, fs *flag.FlagSet, sync bool) error {
+	b, ok := c.(*concurrent.BitsetCounter)
+	if !ok {
+		return fmt.Errorf("-dump needs -impl concurrent")
+	}
+	err := counter.WriteFileAtomic(path, sync, func(w io.Writer) error {
+		var err error
+		if format == "text" {
+			var buf []byte
+			b.Range(func(ip uint32) bool {
+				buf = append(utils.AppendIPv4(buf[:0], ip), '\n')
+				_, err = w.Write(buf)
+				return err == nil
+			})
+			return err
+		}
+		h := ipcset.Header{
+			Count:    uint64(b.Count()),
+			Encoding: dumpEncodings[format],
+			Source:   strings.Join(sources, ", "),
+			Created:  time.Now().UTC().Truncate(time.Second),
+			Options:  make(map[string]string),
+		}
+		fs.Visit(func(f *flag.Flag) { h.Options[f.Name] = f.Value.String() })
+		sw, err := ipcset.NewWriter(w, h)
+		if err != nil {
+			return err
+		}
+		b.Range(func(ip uint32) bool {
+			err = sw.Add(ip)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return sw.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("-dump: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/sample"
+)
+
+// runEstimate implements `ipcounter estimate`: sample the head and random
+// blocks of a file, measure its lines, and project what counting all of
+// it would take with each engine, next to what -impl auto would pick. The
+// projections price the engines as auto does, from the sample instead of
+// the worst case.
+func runEstimate(args []string) error {
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	budget := fs.String("sample-bytes", "64MB", "bytes to sample: the head plus random blocks, or just the head of an input that cannot be read at random")
+	sizeFlag := fs.String("size", "", "expected length of an input that cannot be read at random, e.g. 200GB, to project its head onto")
+	ef := addEngineFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter estimate [-sample-bytes 64MB] [-size SIZE] [flags] <filename>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	if opts.InputFormat != "" && opts.InputFormat != "text" {
+		return fmt.Errorf("estimate cannot read -input-format %s", opts.InputFormat)
+	}
+	n, err := counter.ParseBytes(*budget)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("-sample-bytes: want a positive size, got %q", *budget)
+	}
+	size := int64(-1)
+	if *sizeFlag != "" {
+		if size, err = counter.ParseBytes(*sizeFlag); err != nil {
+			return fmt.Errorf("-size: %w", err)
+		}
+	}
+	layout, err := bucket.LayoutForMem(opts.BucketMaxMem)
+	if err != nil {
+		return err
+	}
+
+	filename := fs.Arg(0)
+	s := sample.NewWithOptions(sample.Options{Parse: opts.Parse, MaxLine: opts.MaxLine, Block: opts.SampleBlock,
+		Seed: opts.Seed, Logger: opts.Logger})
+	p, err := s.Profile(interruptContext(), filename, n, size)
+	if err != nil {
+		return err
+	}
+	c, err := counter.NewWithOptions("auto", opts)
+	if err != nil {
+		return err
+	}
+	// Auto sees no size for an input it cannot stat
+	seen := p.FileSize
+	if p.HeadOnly {
+		seen = -1
+	}
+	sel := c.(*counter.Auto).Plan(seen)
+
+	fmt.Printf("Input: %s\n", filename)
+	switch {
+	case p.Complete:
+		fmt.Printf("Sampled: all %s, so the figures below are exact\n", counter.FormatBytes(p.Sampled))
+	case p.HeadOnly:
+		fmt.Printf("Sampled: the first %s only; the input cannot be read at random offsets\n", counter.FormatBytes(p.Sampled))
+	default:
+		fmt.Printf("Sampled: %s of %s in %d blocks including the head, seed %d\n",
+			counter.FormatBytes(p.Sampled), counter.FormatBytes(p.FileSize), p.Blocks, p.Seed)
+	}
+	fmt.Printf("Mean line length: %.1f bytes\n", p.LineBytes())
+	fmt.Printf("Lines holding an address: %.2f%%\n", 100*p.ValidRate())
+	fmt.Printf("Duplicate ratio in the sample: %.3f\n", p.DupRatio())
+	rate := p.ParseRate()
+	if rate > 0 {
+		fmt.Printf("Parse rate: %s/s per worker\n", counter.FormatBytes(int64(rate)))
+	}
+
+	if p.FileSize < 0 {
+		fmt.Println("Estimates: none without the input's length; pass -size")
+		fmt.Printf("-impl auto would pick: %s\n", sel)
+		return nil
+	}
+	// Figures from the whole input are exact; anything else is labelled
+	est := func(what string) string {
+		if p.Complete {
+			return strings.ToUpper(what[:1]) + what[1:] + ": "
+		}
+		return "Estimated " + what + ": ~"
+	}
+	proj := p.Projection()
+	lines := p.Read
+	if !p.Complete {
+		lines = int64(float64(proj.Size) / max(p.LineBytes(), 1))
+	}
+	fmt.Printf("%s%d\n", est("lines"), lines)
+	fmt.Printf("%s%d", est("distinct addresses"), proj.Distinct)
+	if !p.Complete {
+		fmt.Printf(", 95%% interval [%.0f, %.0f]", p.Low, p.High)
+		if p.Skewed() {
+			fmt.Print("; the input looks skewed, so likely higher")
+		}
+	}
+	fmt.Println()
+	overhead := concurrent.Overhead(concurrent.Options{Shards: opts.Shards, ChunkSize: opts.ChunkSize, QueueDepth: opts.QueueDepth})
+	fmt.Printf("%s%s (%d of %d shards) plus %s of buffers\n", est("concurrent peak memory"),
+		counter.FormatBytes(proj.BitsetMem()), proj.Shards, concurrent.DefaultShards, counter.FormatBytes(overhead))
+	fmt.Printf("%s%s\n", est("naive peak memory"), counter.FormatBytes(proj.NaiveMem()))
+	fmt.Printf("%s%s before compression\n", est("bucket temp disk"), counter.FormatBytes(layout.SpillBytes(proj.Addresses)))
+	if rate > 0 {
+		workers := runtime.NumCPU()
+		wall := time.Duration(float64(proj.Size) / (rate * float64(workers)) * float64(time.Second))
+		fmt.Printf("%s%s, %d-way parallel, not counting disk reads, the set or bucket's temp files\n", est("parse time"), wall.Round(time.Second), workers)
+	}
+	fmt.Printf("-impl auto would pick: %s\n", sel)
+	if p.HeadOnly {
+		return nil
+	}
+	worst := counter.WorstCase(p.FileSize)
+	fmt.Printf("Worst case auto decides on: concurrent %s, naive %s\n",
+		counter.FormatBytes(worst.BitsetMem()), counter.FormatBytes(worst.NaiveMem()))
+	return nil
+}
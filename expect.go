@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// expectedCount returns the count the summaries in path hold for a run
+// of sources: the file -result-file writes, or several of them one after
+// another, as cat joins them. The last summary of a successful count
+// whose inputs are sources, in order, wins.
+func expectedCount(path string, sources []string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	found := false
+	var count int64
+	for i := 1; ; i++ {
+		var s resultSummary
+		if err := dec.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("%s: summary %d: %w", path, i, err)
+		}
+		if s.Status != "ok" || s.Count == nil {
+			continue
+		}
+		paths := make([]string, len(s.Inputs))
+		for j, in := range s.Inputs {
+			paths[j] = in.Path
+		}
+		if slices.Equal(paths, sources) {
+			found, count = true, *s.Count
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("%s holds no successful count of %q", path, sources)
+	}
+	return count, nil
+}
+
+// checkCount checks the count of a run against -expect, when given, and
+// then the -fail-if-unique-* bounds. A count too far from the one expected
+// has the difference printed as a line of JSON and recorded in summary.
+func checkCount(u counter.Uniqueness, expect *counter.Expectation, gate counter.Thresholds, summary *resultSummary) error {
+	if expect != nil {
+		d := expect.Diff(u.Unique)
+		summary.expected(d)
+		if !d.OK {
+			b, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return &counter.ExpectationError{ExpectationDiff: d}
+		}
+	}
+	return gate.Check(u)
+}
+
+// expectation builds the expectation of -expect, -expect-file and
+// -expect-tolerance for a run of sources, nil when neither is given.
+func expectation(count int64, file, tolerance string, sources []string) (*counter.Expectation, error) {
+	switch {
+	case count < -1:
+		return nil, fmt.Errorf("-expect must not be negative, got %d", count)
+	case count >= 0 && file != "":
+		return nil, errors.New("-expect and -expect-file are exclusive")
+	case count < 0 && file == "":
+		if tolerance != "0" {
+			return nil, errors.New("-expect-tolerance needs -expect or -expect-file")
+		}
+		return nil, nil
+	}
+	if file != "" {
+		var err error
+		if count, err = expectedCount(file, sources); err != nil {
+			return nil, fmt.Errorf("-expect-file: %w", err)
+		}
+	}
+	tol, relative, err := counter.ParseTolerance(tolerance)
+	if err != nil {
+		return nil, fmt.Errorf("-expect-tolerance: %w", err)
+	}
+	return &counter.Expectation{Count: count, Tolerance: tol, Relative: relative}, nil
+}
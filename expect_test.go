@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// The summary one run writes is the next run's expectation: an equal
+// count passes, one off within the tolerance passes with the difference
+// recorded, and one off by more fails with ErrExpectation and the exit
+// status of its own.
+func TestExpectFile(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.txt")
+	if err := os.WriteFile(input, []byte("1.2.3.4\n5.6.7.8\n1.2.3.4\n9.9.9.9\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	baseline := filepath.Join(dir, "baseline.json")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("result-file", "", "")
+	if err := fs.Parse([]string{"-result-file", baseline, input}); err != nil {
+		t.Fatal(err)
+	}
+	s := newResultSummary(fs)
+	s.inputs(fs.Args())
+	res, err := ipcount.Count(context.Background(), ipcount.File(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.counted(res.Unique, false, 0, "concurrent")
+	if err := s.finish(baseline, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		count     int64
+		tolerance string
+		delta     int64
+		ok        bool
+	}{
+		{"exact", 3, "0", 0, true},
+		{"tolerated drift", 4, "1", 1, true},
+		{"tolerated relative drift", 2, "34%", -1, true},
+		{"violation", 5, "1", 2, false},
+		{"relative violation", 2, "33%", -1, false},
+	} {
+		expect, err := expectation(-1, baseline, tc.tolerance, []string{input})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if expect.Count != 3 {
+			t.Fatalf("%s: expected count %d from the summary, want 3", tc.name, expect.Count)
+		}
+		summary := &resultSummary{}
+		err = checkCount(counter.Uniqueness{Unique: tc.count}, expect, counter.Thresholds{}, summary)
+		d := summary.Expectation
+		if d == nil || d.Expected != 3 || d.Actual != tc.count || d.Delta != tc.delta || d.OK != tc.ok {
+			t.Errorf("%s: recorded %+v", tc.name, d)
+		}
+		var ee *counter.ExpectationError
+		switch {
+		case tc.ok && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case !tc.ok && (!errors.As(err, &ee) || ee.Delta != tc.delta || exitCode(err) != exitExpect || exitCategory(err) != "expectation"):
+			t.Errorf("%s: %v, exit %d; want an ExpectationError and exit %d", tc.name, err, exitCode(err), exitExpect)
+		}
+	}
+
+	// Concatenated summaries: the last for the inputs wins, others and
+	// failed runs are passed over
+	other := filepath.Join(dir, "other.json")
+	data, err := os.ReadFile(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fleet := filepath.Join(dir, "fleet.json")
+	joined := string(data) + `{"status": "ok", "count": 7, "inputs": [{"path": "` + input + `"}]}` +
+		`{"status": "failed", "count": 9, "inputs": [{"path": "` + input + `"}]}` +
+		`{"status": "ok", "count": 1, "inputs": [{"path": "` + other + `"}]}`
+	if err := os.WriteFile(fleet, []byte(joined), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := expectedCount(fleet, []string{input}); err != nil || n != 7 {
+		t.Errorf("fleet file: %d, %v; want 7", n, err)
+	}
+	if _, err := expectedCount(fleet, []string{input, other}); err == nil {
+		t.Error("fleet file gave a count for inputs it has no summary of")
+	}
+	if _, err := expectation(3, fleet, "0", []string{input}); err == nil {
+		t.Error("-expect and -expect-file together were accepted")
+	}
+}
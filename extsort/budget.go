@@ -0,0 +1,98 @@
+package extsort
+
+import (
+	"cmp"
+	"fmt"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/pipeline"
+)
+
+const (
+	minRunSize   = 1 << 16  // smallest run a memory budget scales runs down to
+	minChunkSize = 64 << 10 // smallest read chunk under a budget
+	minFanIn     = 4        // fewest runs merged at once under a budget
+
+	// overhead is what a count holds besides its buffers: the reader's
+	// buffer, the parser, goroutines and the runs' names.
+	overhead = 1 << 20
+)
+
+// plan is the sizing of a count's buffers.
+type plan struct {
+	workers    int // goroutines parsing the input into runs
+	chunkSize  int // bytes read at a time
+	queueDepth int // read chunks waiting for a worker
+	runSize    int // addresses a worker sorts into a run
+	fanIn      int // runs merged at once
+}
+
+// newPlan returns the sizing o asks for, defaults filled in.
+func newPlan(o Options, workers int) plan {
+	return plan{
+		workers:    workers,
+		chunkSize:  cmp.Or(o.ChunkSize, pipeline.DefaultChunkSize),
+		queueDepth: cmp.Or(o.QueueDepth, 2*workers),
+		runSize:    cmp.Or(o.RunSize, DefaultRunSize),
+		fanIn:      cmp.Or(o.FanIn, DefaultFanIn),
+	}
+}
+
+// buffers returns the memory of the plan besides the run buffers: the
+// read chunks queued, being parsed and being read into, each worker's
+// write buffer, and the read buffers of a merge with the write buffer of
+// the longer run it writes.
+func (p plan) buffers() int64 {
+	return int64(p.queueDepth+p.workers+1)*int64(p.chunkSize) +
+		int64(p.workers)*writeBufSize +
+		int64(p.fanIn)*readBufSize + writeBufSize +
+		overhead
+}
+
+// mem returns the expected peak memory of a count under the plan.
+func (p plan) mem() int64 {
+	return p.buffers() + int64(p.workers)*4*int64(p.runSize)
+}
+
+// fitBudget sizes the runs to what budget leaves of the other buffers,
+// first shrinking the read queue, the read chunks, the fan-in and the
+// workers while even runs of minRunSize addresses do not fit.
+func (p *plan) fitBudget(budget int64) error {
+	floor := min(p.runSize, minRunSize)
+	for {
+		if fit := (budget - p.buffers()) / int64(4*p.workers); fit >= int64(floor) {
+			p.runSize = int(min(int64(p.runSize), fit))
+			return nil
+		}
+		switch {
+		case p.queueDepth > p.workers:
+			p.queueDepth = p.workers
+		case p.chunkSize > minChunkSize:
+			p.chunkSize = max(minChunkSize, p.chunkSize/2)
+		case p.fanIn > minFanIn:
+			p.fanIn = max(minFanIn, p.fanIn/2)
+		case p.workers > 1:
+			p.workers = max(1, p.workers/2)
+			p.queueDepth = p.workers
+		default:
+			p.runSize = floor
+			return fmt.Errorf("%w: the extsort engine needs at least %s, budget is %s",
+				counter.ErrMemBudget, counter.FormatBytes(p.mem()), counter.FormatBytes(budget))
+		}
+	}
+}
+
+// MinMem returns the least memory a count can be fitted into with o, the
+// plan fitBudget falls back to at its smallest.
+func MinMem(o Options) int64 {
+	p := newPlan(o, 1)
+	p.queueDepth, p.chunkSize, p.fanIn = 1, min(p.chunkSize, minChunkSize), min(p.fanIn, minFanIn)
+	p.runSize = min(p.runSize, minRunSize)
+	return p.mem()
+}
+
+// String describes the plan, for -stats.
+func (p plan) String() string {
+	return fmt.Sprintf("%d workers, %s read chunks queued %d deep, runs of %d addresses, fan-in %d, estimated peak %s",
+		p.workers, counter.FormatBytes(int64(p.chunkSize)), p.queueDepth, p.runSize, p.fanIn, counter.FormatBytes(p.mem()))
+}
@@ -0,0 +1,296 @@
+// Package extsort counts unique IPv4 addresses exactly by external
+// sorting: workers parse the input into runs of addresses, each sorted,
+// stripped of repeats and written to a temp file, and a k-way merge of the
+// runs counts the distinct values. Memory is the workers' run buffers and
+// a read buffer per merged run, whatever the input holds, and the disk is
+// only written and read sequentially, a few files at a time, so it suits
+// inputs approaching the whole IPv4 space on machines where neither the
+// concurrent engine's 512 MB bitset nor the bucket engine's open bucket
+// files fit. Runs hold sorted values rather than bitset positions, so the
+// method carries over to wider keys.
+package extsort
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/pipeline"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	// DefaultRunSize is the addresses a worker sorts into a run at a
+	// time, 16 MB of them.
+	DefaultRunSize = 1 << 22
+
+	// DefaultFanIn is the runs merged at once; with more, runs are merged
+	// in rounds into longer ones first.
+	DefaultFanIn = 64
+)
+
+// Options configures an ExtSortCounter.
+type Options struct {
+	Parse      utils.ParseOptions // accepted address forms
+	MaxLine    int                // longest line accepted, 0 for utils.DefaultMaxLine
+	Workers    int                // goroutines parsing the input, 0 for runtime.NumCPU()
+	ChunkSize  int                // bytes handed to a worker at a time, 0 for pipeline.DefaultChunkSize
+	QueueDepth int                // read chunks waiting for a worker, 0 for two per worker
+
+	// RunSize is the addresses a worker keeps before sorting them into a
+	// run, 4 bytes each, 0 for DefaultRunSize.
+	RunSize int
+
+	// FanIn is the runs merged at once, at least 2, 0 for DefaultFanIn.
+	// It bounds the run files open during the merge.
+	FanIn int
+
+	// TempDir is where the runs are written; empty means os.TempDir.
+	// They take at most about 5 bytes per distinct address of each run,
+	// less the denser the run.
+	TempDir string
+
+	// MaxMem caps the bytes a count may take, 0 for no cap. RunSize is
+	// scaled down to what the read, write and merge buffers leave of it,
+	// and while runs of 64K addresses would not fit, QueueDepth,
+	// ChunkSize, FanIn and then Workers shrink; a budget too small even
+	// then fails the count with counter.ErrMemBudget.
+	MaxMem int64
+
+	Progress *counter.Progress // receives the input read, then the runs merged, nil for none
+	Stats    *counter.Stats    // receives the run tally, nil to discard
+	Logger   *slog.Logger      // receives the first few lines that fail to parse, nil for slog.Default()
+}
+
+// Validate reports whether o can build an ExtSortCounter.
+func (o Options) Validate() error {
+	switch {
+	case o.Workers < 0:
+		return fmt.Errorf("workers must not be negative, got %d", o.Workers)
+	case o.RunSize < 0:
+		return fmt.Errorf("run size must not be negative, got %d", o.RunSize)
+	case o.FanIn < 0 || o.FanIn == 1:
+		return fmt.Errorf("fan-in must be at least 2, got %d", o.FanIn)
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("extsort", func(o counter.Options) (counter.Counter, error) {
+		opts := fromCounter(o)
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("extsort: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+	counter.RegisterMinMem("extsort", func(o counter.Options) int64 {
+		return MinMem(fromCounter(o))
+	})
+}
+
+// fromCounter returns the Options of the engine-neutral o.
+func fromCounter(o counter.Options) Options {
+	return Options{
+		Parse:      o.Parse,
+		MaxLine:    o.MaxLine,
+		Workers:    o.Workers,
+		ChunkSize:  o.ChunkSize,
+		QueueDepth: o.QueueDepth,
+		TempDir:    o.TempDir,
+		MaxMem:     o.MaxMem,
+		Progress:   o.Progress,
+		Stats:      o.Stats,
+		Logger:     o.Logger,
+	}
+}
+
+// ExtSortCounter counts distinct IPv4s by sorting them into runs on disk
+// and merging the runs. A counter runs one count at a time.
+type ExtSortCounter struct {
+	opts    Options
+	log     *slog.Logger
+	plan    plan
+	planErr error // MaxMem too small for the plan, returned by every count
+}
+
+// New creates an ExtSortCounter with the default options.
+func New() *ExtSortCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates an ExtSortCounter with the given options. It
+// panics if opts fail Validate.
+func NewWithOptions(opts Options) *ExtSortCounter {
+	if err := opts.Validate(); err != nil {
+		panic("extsort: " + err.Error())
+	}
+	c := &ExtSortCounter{opts: opts, log: counter.Logger(opts.Logger)}
+	c.plan = newPlan(opts, cmp.Or(opts.Workers, runtime.NumCPU()))
+	if opts.MaxMem > 0 {
+		c.planErr = c.plan.fitBudget(opts.MaxMem)
+	}
+	return c
+}
+
+// CountUniqueIPs returns the number of distinct IPv4s in a file.
+func (c *ExtSortCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation.
+func (c *ExtSortCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	n, err := c.CountReader(ctx, file)
+	if err != nil && ctx.Err() == nil {
+		return 0, counter.WrapRead(filename, err)
+	}
+	return n, err
+}
+
+// CountReader counts distinct IPv4s read from r, writing its runs to a
+// new temp dir that is removed once the count ends.
+func (c *ExtSortCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	c.opts.Stats.Set("extsort plan", "%s", c.planString())
+	if c.planErr != nil {
+		return 0, c.planErr
+	}
+	base := cmp.Or(c.opts.TempDir, os.TempDir())
+	dir, err := os.MkdirTemp(base, "ipextsort-*")
+	if err != nil {
+		return 0, fmt.Errorf("extsort %w: cannot create run dir in %s: %w", counter.ErrSpill, base, err)
+	}
+	defer func() {
+		// Every run file is closed by now; Windows refuses to delete one
+		// that is still open
+		if err := counter.RemoveAll(dir); err != nil {
+			c.log.Warn("extsort temp dir left behind", "dir", dir, "err", err)
+		}
+	}()
+
+	runs := &runSet{dir: dir, progress: c.opts.Progress}
+	s := &sink{runs: runs, size: c.plan.runSize}
+	res, err := pipeline.Run(ctx, c.opts.Progress.Reader(r), s, pipeline.Options{
+		Parse:      c.opts.Parse,
+		MaxLine:    c.opts.MaxLine,
+		Skips:      counter.NewSkipLog(c.log),
+		Workers:    c.plan.workers,
+		ChunkSize:  c.plan.chunkSize,
+		QueueDepth: c.plan.queueDepth,
+		Progress:   c.opts.Progress,
+	})
+	c.opts.Stats.Set("oversized lines", "%d", res.Oversized)
+	if err != nil {
+		return 0, err
+	}
+	var ranges []span
+	for _, w := range s.workers {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+		w.ips, w.out = nil, nil // the merge's buffers take their place
+		ranges = append(ranges, w.ranges...)
+	}
+
+	c.opts.Progress.Phase("merge", "runs", int64(len(runs.paths)))
+	written := runs.written
+	rounds, n, err := c.merge(ctx, runs, ranges)
+	if err != nil {
+		return 0, err
+	}
+	c.opts.Stats.Set("extsort runs", "%d of up to %d addresses, %s written, merge depth %d",
+		len(runs.paths), s.size, counter.FormatBytes(written), rounds)
+	return n, nil
+}
+
+// planString describes the sizing a count will use, for -stats.
+func (c *ExtSortCounter) planString() string {
+	s := c.plan.String()
+	if c.opts.MaxMem > 0 {
+		s += " of " + counter.FormatBytes(c.opts.MaxMem) + " budget"
+	}
+	return s
+}
+
+// sink is the pipeline sink of a count, giving each worker a run buffer
+// of its own.
+type sink struct {
+	runs *runSet
+	size int
+
+	mu      sync.Mutex
+	workers []*worker
+}
+
+// Add is not called: every worker adds to its own run.
+func (s *sink) Add(uint32) bool {
+	panic("extsort: an address added to the shared sink")
+}
+
+func (s *sink) Worker(int) pipeline.Worker {
+	w := &worker{runs: s.runs, size: s.size, ips: make([]uint32, 0, s.size)}
+	s.mu.Lock()
+	s.workers = append(s.workers, w)
+	s.mu.Unlock()
+	return w
+}
+
+// worker keeps the addresses of its run until it is full, and the CIDR
+// blocks it parsed, merged in with the runs at the end.
+type worker struct {
+	runs   *runSet
+	size   int
+	ips    []uint32   // the run, never grown past size
+	out    *runWriter // writes each run through one buffer
+	ranges []span
+	err    error // the first run that failed to write
+}
+
+// Add keeps ip for the run, writing the run first if it is full, and
+// reports it as new, the count being the merge's rather than the sum of
+// what workers report.
+func (w *worker) Add(ip uint32) bool {
+	if len(w.ips) >= w.size {
+		if w.err != nil {
+			return false
+		}
+		w.err = w.flush()
+	}
+	w.ips = append(w.ips, ip)
+	return true
+}
+
+// AddRange keeps the block of a CIDR line whole.
+func (w *worker) AddRange(first, last uint32) int64 {
+	w.ranges = append(w.ranges, span{first, last})
+	return int64(last-first) + 1
+}
+
+// ChunkDone returns the error of a run written during the chunk.
+func (w *worker) ChunkDone([]byte, int64) error {
+	return w.err
+}
+
+// flush sorts the run, drops its repeats and writes it, if it holds any.
+func (w *worker) flush() error {
+	if len(w.ips) == 0 {
+		return nil
+	}
+	if w.out == nil {
+		w.out = newRunWriter(nil)
+	}
+	slices.Sort(w.ips)
+	err := w.runs.write(slices.Compact(w.ips), w.out)
+	w.ips = w.ips[:0]
+	return err
+}
@@ -0,0 +1,153 @@
+package extsort
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Runs small enough that every worker writes many, merged two at a time
+// over several rounds, with repeats across runs and CIDR blocks that
+// overlap each other and the runs, count as a map does, and the temp dir
+// is gone afterwards.
+func TestCountReader(t *testing.T) {
+	rng := rand.New(rand.NewPCG(43, 44))
+	want := make(map[uint32]bool)
+	var b strings.Builder
+	for range 50000 {
+		ip := rng.Uint32()
+		if rng.IntN(2) == 0 {
+			ip = 10<<24 | rng.Uint32N(1<<14) // repeats throughout
+		}
+		want[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	for _, cidr := range []string{"10.0.0.0/20", "10.0.8.0/22", "10.0.16.0/24", "255.255.255.0/24", "0.0.0.0/24"} {
+		fmt.Fprintf(&b, "%s\n", cidr)
+		p, err := utils.ParseCIDR([]byte(cidr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ip := p.Base; ; ip++ {
+			want[ip] = true
+			if ip == p.Last() {
+				break
+			}
+		}
+	}
+
+	tmp := t.TempDir()
+	stats := &counter.Stats{}
+	c := NewWithOptions(Options{RunSize: 4096, FanIn: 2, Workers: 3, ChunkSize: 64 << 10, TempDir: tmp, Stats: stats,
+		Parse: utils.ParseOptions{CIDR: true, MinPrefix: 8}, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("%d unique, want %d", n, len(want))
+	}
+	if s := stats.Map()["extsort runs"]; !strings.Contains(s, "merge depth") || strings.HasSuffix(s, "merge depth 1") {
+		t.Errorf("extsort runs %q, want several rounds of merges", s)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("%d entries left in the temp dir", len(left))
+	}
+
+	n, err = New().CountReader(context.Background(), strings.NewReader("\n"))
+	if n != 0 || err != nil {
+		t.Errorf("empty input: %d, %v", n, err)
+	}
+}
+
+// permReader yields n lines of distinct addresses twice over, the n
+// values of an odd multiple of the line number below 1<<20, without
+// holding the input in memory.
+type permReader struct {
+	n, i int
+	line []byte
+}
+
+func (r *permReader) Read(p []byte) (int, error) {
+	read := 0
+	for read < len(p) {
+		if len(r.line) == 0 {
+			if r.i == 2*r.n {
+				break
+			}
+			ip := uint32(r.i%r.n) * 2654435761 & (1<<20 - 1)
+			r.line = append(utils.AppendIPv4(r.line[:0], ip), '\n')
+			r.i++
+		}
+		c := copy(p[read:], r.line)
+		r.line = r.line[c:]
+		read += c
+	}
+	if read == 0 {
+		return 0, io.EOF
+	}
+	return read, nil
+}
+
+// Under a budget the runs, read chunks and merge shrink to fit: the heap
+// stays under MaxMem above what it held before, as with -max-mem, which
+// also sets it as the runtime's memory limit. A budget below MinMem fails
+// with ErrMemBudget before reading anything.
+func TestMaxMem(t *testing.T) {
+	const budget = 8 << 20
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base := ms.HeapAlloc
+	debug.SetMemoryLimit(int64(base) + budget)
+
+	stats := &counter.Stats{}
+	c := NewWithOptions(Options{MaxMem: budget, TempDir: t.TempDir(), Stats: stats})
+	sampler := counter.StartMemSampler(time.Millisecond)
+	n, err := c.CountReader(context.Background(), &permReader{n: 1 << 19})
+	peak := sampler.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1<<19 {
+		t.Errorf("%d unique, want %d", n, 1<<19)
+	}
+	if used := peak.HeapAlloc - base; used > budget {
+		t.Errorf("heap peaked %s above the start, budget %s; plan %s", counter.FormatBytes(int64(used)),
+			counter.FormatBytes(budget), stats.Map()["extsort plan"])
+	}
+	if s := stats.Map()["extsort runs"]; strings.HasPrefix(s, "1 ") {
+		t.Errorf("extsort runs %q, want the input split into several", s)
+	}
+
+	min := MinMem(Options{})
+	if _, err := NewWithOptions(Options{MaxMem: min}).CountReader(context.Background(), strings.NewReader("1.2.3.4\n")); err != nil {
+		t.Errorf("a budget of MinMem %s: %v", counter.FormatBytes(min), err)
+	}
+	_, err = NewWithOptions(Options{MaxMem: min - 1}).CountReader(context.Background(), strings.NewReader("1.2.3.4\n"))
+	if !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("a budget below MinMem: %v, want ErrMemBudget", err)
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte("1.2.3.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWithOptions(Options{MaxMem: min - 1}).CountUniqueIPs(path)
+	if !errors.Is(err, counter.ErrMemBudget) || errors.Is(err, counter.ErrRead) {
+		t.Errorf("a file over budget: %v, want ErrMemBudget and no read error", err)
+	}
+}
@@ -0,0 +1,304 @@
+package extsort
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+const (
+	readBufSize  = 64 << 10  // per run being merged
+	writeBufSize = 256 << 10 // per run being written
+)
+
+// runSet is the runs of a count, sorted files of distinct addresses, each
+// stored as the uvarint gaps between them, the first from 0.
+type runSet struct {
+	dir      string
+	progress *counter.Progress // receives the bytes written, nil for none
+
+	mu      sync.Mutex
+	next    int      // number of the next run file
+	paths   []string // the runs written so far
+	written int64    // bytes written to them
+}
+
+// create returns a new run file.
+func (rs *runSet) create() (*os.File, error) {
+	rs.mu.Lock()
+	path := filepath.Join(rs.dir, fmt.Sprintf("run%06d.bin", rs.next))
+	rs.next++
+	rs.mu.Unlock()
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("extsort %w: %w", counter.ErrSpill, err)
+	}
+	return f, nil
+}
+
+// add records run file f, closing it, once it holds size bytes.
+func (rs *runSet) add(f *os.File, size int64) error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("extsort %w: %w", counter.ErrSpill, err)
+	}
+	rs.mu.Lock()
+	rs.paths = append(rs.paths, f.Name())
+	rs.written += size
+	rs.mu.Unlock()
+	rs.progress.AddTemp(size)
+	return nil
+}
+
+// write writes ips, ascending and distinct, as a new run through w.
+func (rs *runSet) write(ips []uint32, w *runWriter) error {
+	f, err := rs.create()
+	if err != nil {
+		return err
+	}
+	w.reset(f)
+	for _, ip := range ips {
+		w.add(ip)
+	}
+	size, err := w.flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return rs.add(f, size)
+}
+
+// runWriter encodes ascending distinct addresses into a run file.
+type runWriter struct {
+	bw   *bufio.Writer
+	prev uint32
+	buf  [binary.MaxVarintLen32]byte
+	size int64
+}
+
+func newRunWriter(f io.Writer) *runWriter {
+	return &runWriter{bw: bufio.NewWriterSize(f, writeBufSize)}
+}
+
+// reset readies w to write a new run to f, reusing its buffer.
+func (w *runWriter) reset(f io.Writer) {
+	w.bw.Reset(f)
+	w.prev, w.size = 0, 0
+}
+
+func (w *runWriter) add(ip uint32) {
+	n := binary.PutUvarint(w.buf[:], uint64(ip-w.prev))
+	w.bw.Write(w.buf[:n]) // a write error sticks until flush
+	w.prev = ip
+	w.size += int64(n)
+}
+
+// flush writes what is buffered and returns the run's size.
+func (w *runWriter) flush() (int64, error) {
+	if err := w.bw.Flush(); err != nil {
+		return 0, fmt.Errorf("extsort %w: %w", counter.ErrSpill, err)
+	}
+	return w.size, nil
+}
+
+// merge merges the runs of rs, with the CIDR blocks in ranges, and returns
+// how many distinct addresses they hold. Runs beyond FanIn are first
+// merged FanIn at a time into longer runs, in rounds, so no more than
+// FanIn files are open at once; rounds counts the merges of every run,
+// the last included.
+func (c *ExtSortCounter) merge(ctx context.Context, rs *runSet, ranges []span) (rounds int, n int64, err error) {
+	fanIn := c.plan.fanIn
+	paths := rs.paths
+	w := newRunWriter(nil)
+	for len(paths) > fanIn {
+		rounds++
+		var longer []string
+		for i := 0; i < len(paths); i += fanIn {
+			batch := paths[i:min(i+fanIn, len(paths))]
+			f, err := rs.create()
+			if err != nil {
+				return rounds, 0, err
+			}
+			w.reset(f)
+			err = mergeRuns(ctx, batch, nil, w.add)
+			var size int64
+			if err == nil {
+				size, err = w.flush()
+			}
+			if err != nil {
+				f.Close()
+				return rounds, 0, err
+			}
+			if err := f.Close(); err != nil {
+				return rounds, 0, fmt.Errorf("extsort %w: %w", counter.ErrSpill, err)
+			}
+			for _, p := range batch {
+				os.Remove(p) // leaves room on the temp volume; the dir goes at the end
+			}
+			longer = append(longer, f.Name())
+			rs.progress.AddTemp(size)
+			c.opts.Progress.Add(0, int64(len(batch)))
+			c.log.Debug("extsort runs merged", "runs", len(batch), "bytes", size)
+		}
+		paths = longer
+	}
+	rounds++
+	err = mergeRuns(ctx, paths, ranges, func(uint32) { n++ })
+	c.opts.Progress.Add(0, int64(len(paths)))
+	return rounds, n, err
+}
+
+// mergeRuns calls fn with every distinct address of the runs at paths and
+// the blocks in ranges, in ascending order.
+func mergeRuns(ctx context.Context, paths []string, ranges []span, fn func(ip uint32)) error {
+	var h cursorHeap
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("extsort %w: %w", counter.ErrSpill, err)
+		}
+		defer f.Close()
+		if err := h.push(&runReader{br: bufio.NewReaderSize(f, readBufSize), name: p}); err != nil {
+			return err
+		}
+	}
+	if len(ranges) > 0 {
+		if err := h.push(newSpanCursor(ranges)); err != nil {
+			return err
+		}
+	}
+	var (
+		last  uint32
+		seen  bool
+		steps int
+	)
+	for len(h) > 0 {
+		if steps++; steps&(1<<20-1) == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		top := &h[0]
+		if !seen || top.v != last {
+			fn(top.v)
+			last, seen = top.v, true
+		}
+		v, ok, err := top.c.next()
+		switch {
+		case err != nil:
+			return err
+		case ok:
+			top.v = v
+			heap.Fix(&h, 0)
+		default:
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+// cursor yields ascending addresses, false once there are no more.
+type cursor interface {
+	next() (uint32, bool, error)
+}
+
+// runReader is a cursor over a run file.
+type runReader struct {
+	br   *bufio.Reader
+	name string
+	prev uint32
+}
+
+func (r *runReader) next() (uint32, bool, error) {
+	gap, err := binary.ReadUvarint(r.br)
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil || gap > uint64(^r.prev) {
+		return 0, false, fmt.Errorf("extsort %w: run %s is corrupt: %v", counter.ErrSpill, filepath.Base(r.name), cmp.Or(err, errors.New("address past 255.255.255.255")))
+	}
+	r.prev += uint32(gap)
+	return r.prev, true, nil
+}
+
+// span is an inclusive block of addresses from a CIDR line.
+type span struct {
+	first, last uint32
+}
+
+// spanCursor is a cursor over the addresses of blocks, sorted and
+// coalesced where they overlap or touch.
+type spanCursor struct {
+	spans []span
+	ip    uint32
+}
+
+func newSpanCursor(blocks []span) *spanCursor {
+	blocks = slices.Clone(blocks)
+	slices.SortFunc(blocks, func(a, b span) int { return cmp.Compare(a.first, b.first) })
+	merged := blocks[:1]
+	for _, b := range blocks[1:] {
+		top := &merged[len(merged)-1]
+		if uint64(b.first) <= uint64(top.last)+1 {
+			top.last = max(top.last, b.last)
+			continue
+		}
+		merged = append(merged, b)
+	}
+	return &spanCursor{spans: merged, ip: merged[0].first}
+}
+
+func (s *spanCursor) next() (uint32, bool, error) {
+	if len(s.spans) == 0 {
+		return 0, false, nil
+	}
+	ip := s.ip
+	if ip == s.spans[0].last {
+		s.spans = s.spans[1:]
+		if len(s.spans) > 0 {
+			s.ip = s.spans[0].first
+		}
+	} else {
+		s.ip++
+	}
+	return ip, true, nil
+}
+
+// cursorHeap is a min-heap of cursors by their current address.
+type cursorHeap []heapEntry
+
+type heapEntry struct {
+	v uint32
+	c cursor
+}
+
+// push adds c at its first address, if it has one.
+func (h *cursorHeap) push(c cursor) error {
+	v, ok, err := c.next()
+	if err != nil || !ok {
+		return err
+	}
+	heap.Push(h, heapEntry{v, c})
+	return nil
+}
+
+func (h cursorHeap) Len() int           { return len(h) }
+func (h cursorHeap) Less(i, j int) bool { return h[i].v < h[j].v }
+func (h cursorHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)        { *h = append(*h, x.(heapEntry)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
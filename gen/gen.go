@@ -0,0 +1,248 @@
+// Package gen writes synthetic IPv4 inputs with an exactly known number of
+// distinct addresses, for benchmarking and for checking the engines.
+//
+// Nothing proportional to the output is kept in memory: line p is computed
+// from p with seeded permutations, so a billion-line file streams out with
+// a few KB of state.
+package gen
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const maxIPv4 = uint64(1) << 32
+
+// Distribution selects how repeated lines pick their address.
+type Distribution int
+
+const (
+	Uniform Distribution = iota // every address equally likely
+	Zipf                        // a few addresses dominate, P(rank k) ∝ (1+k)^-S
+	HotSet                      // HotFrac of repeats come from the first Hot addresses
+)
+
+// ParseDistribution maps a -dist flag value to a Distribution. "subnet"
+// is uniform within Config.Subnet and is reported separately.
+func ParseDistribution(s string) (Distribution, error) {
+	switch s {
+	case "uniform", "subnet":
+		return Uniform, nil
+	case "zipf":
+		return Zipf, nil
+	case "hotset":
+		return HotSet, nil
+	}
+	return 0, fmt.Errorf("unknown distribution: %s", s)
+}
+
+// Config describes a generated input.
+type Config struct {
+	Lines   uint64 // total lines written, including malformed ones
+	Unique  uint64 // distinct addresses among them
+	Seed    int64  // PRNG seed; equal configs produce identical files
+	Shuffle bool   // random line order; otherwise addresses first appear in sequence
+
+	Dist    Distribution
+	S       float64     // Zipf exponent, > 1
+	Hot     uint64      // HotSet size
+	HotFrac float64     // HotSet share of repeated lines
+	Subnet  *utils.CIDR // restrict addresses to this prefix; nil for all of IPv4
+
+	InvalidFrac float64 // share of repeated lines replaced by malformed text
+}
+
+// Result reports what Write produced.
+type Result struct {
+	Unique  uint64 // distinct valid addresses written
+	Invalid uint64 // malformed lines written
+}
+
+// Validate reports whether cfg can be generated exactly.
+func (cfg Config) Validate() error {
+	space := maxIPv4
+	if cfg.Subnet != nil {
+		space = cfg.Subnet.Size()
+	}
+	switch {
+	case cfg.Unique > cfg.Lines:
+		return errors.New("unique must not exceed lines")
+	case cfg.Unique > space:
+		return fmt.Errorf("unique must not exceed the %d addresses available", space)
+	case cfg.Lines > 0 && cfg.Unique == 0:
+		return errors.New("unique must be at least 1 when lines > 0")
+	case cfg.Dist == Zipf && cfg.S <= 1:
+		return errors.New("zipf exponent must be > 1")
+	case cfg.Dist == HotSet && (cfg.Hot == 0 || cfg.Hot > cfg.Unique):
+		return errors.New("hot set size must be in [1, unique]")
+	case cfg.HotFrac < 0 || cfg.HotFrac > 1:
+		return errors.New("hot fraction must be in [0, 1]")
+	case cfg.InvalidFrac < 0 || cfg.InvalidFrac > 1:
+		return errors.New("invalid fraction must be in [0, 1]")
+	}
+	return nil
+}
+
+// malformed lines cycled through by InvalidFrac; none of them parse.
+var malformed = []string{"999.1.2.3", "1.2.3", "not-an-ip", "1.2.3.4.5", "01.2.3.4", "1.2.3.-4"}
+
+// Write writes cfg.Lines newline-terminated lines to w containing exactly
+// cfg.Unique distinct valid addresses.
+//
+// Line p has position q = order(p), where order is a seeded permutation in
+// shuffle mode and the identity otherwise. Positions below Unique are
+// coverage lines carrying address index q, so every index occurs at least
+// once; the remaining positions repeat an index drawn from Dist (or are
+// malformed), which can never add a new address.
+func Write(w io.Writer, cfg Config) (Result, error) {
+	if err := cfg.Validate(); err != nil {
+		return Result{}, err
+	}
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	bw := bufio.NewWriterSize(w, 1<<20)
+	buf := make([]byte, 0, 16)
+
+	var base uint32
+	space := maxIPv4
+	if cfg.Subnet != nil {
+		base, space = cfg.Subnet.Base, cfg.Subnet.Size()
+	}
+
+	var order *perm
+	var addr func(i uint64) uint32
+	if cfg.Shuffle {
+		order = newPerm(cfg.Lines, rng)
+		ips := newPerm(space, rng)
+		addr = func(i uint64) uint32 { return base + uint32(ips.at(i)) }
+	} else {
+		if cfg.Subnet == nil {
+			base = rng.Uint32()
+		}
+		addr = func(i uint64) uint32 { return base + uint32(i) }
+	}
+
+	var zipf *rand.Zipf
+	if cfg.Dist == Zipf && cfg.Unique > 0 {
+		zipf = rand.NewZipf(rng, cfg.S, 1, cfg.Unique-1)
+	}
+
+	// Unshuffled uniform output keeps each address's repeats adjacent.
+	clustered := order == nil && cfg.Dist == Uniform && cfg.InvalidFrac == 0
+	per, extra := uint64(0), uint64(0)
+	if cfg.Unique > 0 {
+		per, extra = cfg.Lines/cfg.Unique, cfg.Lines%cfg.Unique
+	}
+	var idx, left uint64
+
+	var res Result
+	for p := uint64(0); p < cfg.Lines; p++ {
+		var i uint64
+		switch {
+		case clustered:
+			if left == 0 {
+				if p > 0 {
+					idx++
+				}
+				left = per
+				if idx < extra {
+					left++
+				}
+			}
+			i = idx
+			left--
+		default:
+			q := p
+			if order != nil {
+				q = order.at(p)
+			}
+			if q < cfg.Unique {
+				i = q
+				break
+			}
+			if cfg.InvalidFrac > 0 && rng.Float64() < cfg.InvalidFrac {
+				buf = append(buf[:0], malformed[res.Invalid%uint64(len(malformed))]...)
+				res.Invalid++
+				i = ^uint64(0)
+				break
+			}
+			switch cfg.Dist {
+			case Zipf:
+				i = zipf.Uint64()
+			case HotSet:
+				if rng.Float64() < cfg.HotFrac {
+					i = uint64(rng.Int63n(int64(cfg.Hot)))
+				} else {
+					i = uint64(rng.Int63n(int64(cfg.Unique)))
+				}
+			default:
+				i = q % cfg.Unique
+			}
+		}
+		if i != ^uint64(0) {
+			buf = utils.AppendIPv4(buf[:0], addr(i))
+		}
+		buf = append(buf, '\n')
+		if _, err := bw.Write(buf); err != nil {
+			return Result{}, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return Result{}, err
+	}
+	res.Unique = cfg.Unique
+	return res, nil
+}
+
+// perm is a seeded bijection on [0, n): a balanced Feistel network over
+// the smallest even bit width covering n, with cycle walking to stay in
+// range.
+type perm struct {
+	n        uint64
+	halfBits uint
+	mask     uint64
+	keys     [4]uint64
+}
+
+func newPerm(n uint64, rng *rand.Rand) *perm {
+	bits := uint(2)
+	for bits < 64 && uint64(1)<<bits < n {
+		bits += 2
+	}
+	p := &perm{n: n, halfBits: bits / 2, mask: uint64(1)<<(bits/2) - 1}
+	for i := range p.keys {
+		p.keys[i] = rng.Uint64()
+	}
+	return p
+}
+
+func (p *perm) at(x uint64) uint64 {
+	for {
+		x = p.feistel(x)
+		if x < p.n {
+			return x
+		}
+	}
+}
+
+func (p *perm) feistel(x uint64) uint64 {
+	l, r := x>>p.halfBits, x&p.mask
+	for _, k := range p.keys {
+		l, r = r, l^(mix64(r^k)&p.mask)
+	}
+	return l<<p.halfBits | r
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,84 @@
+package gen
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Equal configs write identical files and another seed a different one,
+// and every file holds exactly Unique distinct addresses in Lines lines,
+// whatever the distribution and order.
+func TestWrite(t *testing.T) {
+	subnet, err := utils.ParseCIDR([]byte("192.168.0.0/16"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []Config{
+		{Lines: 10000, Unique: 1000},
+		{Lines: 10000, Unique: 1000, Shuffle: true},
+		{Lines: 10000, Unique: 1000, Shuffle: true, Dist: Zipf, S: 1.2},
+		{Lines: 10000, Unique: 1000, Shuffle: true, Dist: HotSet, Hot: 10, HotFrac: 0.9},
+		{Lines: 10000, Unique: 1000, Shuffle: true, Subnet: &subnet, InvalidFrac: 0.1},
+		{Lines: 5, Unique: 5},
+	} {
+		cfg.Seed = 42
+		var a, b, other bytes.Buffer
+		res, err := Write(&a, cfg)
+		if err != nil {
+			t.Fatalf("%+v: %v", cfg, err)
+		}
+		if _, err := Write(&b, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a.Bytes(), b.Bytes()) {
+			t.Errorf("%+v: two runs with seed 42 differ", cfg)
+		}
+		cfg.Seed = 43
+		if _, err := Write(&other, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(a.Bytes(), other.Bytes()) {
+			t.Errorf("%+v: seeds 42 and 43 write the same file", cfg)
+		}
+
+		seen := make(map[uint32]bool)
+		var lines, invalid uint64
+		for _, line := range bytes.Split(bytes.TrimSuffix(a.Bytes(), []byte("\n")), []byte("\n")) {
+			lines++
+			ip, err := utils.ParseIPv4(line)
+			if err != nil {
+				invalid++
+				continue
+			}
+			if cfg.Subnet != nil && !cfg.Subnet.Contains(ip) {
+				t.Errorf("%+v: %s outside the subnet", cfg, line)
+			}
+			seen[ip] = true
+		}
+		if lines != cfg.Lines || uint64(len(seen)) != cfg.Unique || invalid != res.Invalid || res.Unique != cfg.Unique {
+			t.Errorf("%+v: %d lines, %d unique, %d invalid; result %+v", cfg, lines, len(seen), invalid, res)
+		}
+	}
+}
+
+// A fixed seed pins the output itself, not just its repeatability within
+// one build: inputs generated for a benchmark or a CI check must stay the
+// same file across releases, or their recorded counts go stale.
+func TestWriteSeed(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Lines: 8, Unique: 5, Seed: 7},
+			"235.60.132.60\n235.60.132.60\n235.60.132.61\n235.60.132.61\n235.60.132.62\n235.60.132.62\n235.60.132.63\n235.60.132.64\n"},
+		{Config{Lines: 8, Unique: 5, Seed: 7, Shuffle: true},
+			"175.20.160.19\n224.40.177.73\n224.40.177.73\n172.67.106.191\n207.92.50.2\n172.67.106.191\n32.180.216.25\n32.180.216.25\n"},
+	} {
+		var b bytes.Buffer
+		if _, err := Write(&b, tc.cfg); err != nil || b.String() != tc.want {
+			t.Errorf("%+v: %q, %v; want %q", tc.cfg, b.String(), err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/Sveta-1999/IPCounter/gen"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// countFlag is a uint64 flag that also accepts exponent forms like 1e9.
+type countFlag uint64
+
+func (c *countFlag) String() string { return strconv.FormatUint(uint64(*c), 10) }
+
+func (c *countFlag) Set(s string) error {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		*c = countFlag(n)
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f != math.Trunc(f) || f > math.MaxUint64 {
+		return errors.New("must be a non-negative integer")
+	}
+	*c = countFlag(f)
+	return nil
+}
+
+// runGen implements `ipcounter gen`.
+func runGen(args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	lines, unique := countFlag(1000), countFlag(100)
+	fs.Var(&lines, "lines", "number of lines to write (accepts 1e9)")
+	fs.Var(&unique, "unique", "number of distinct addresses (accepts 1e8)")
+	out := fs.String("o", "-", "output file, - for stdout")
+	seed := fs.Int64("seed", 1, "PRNG seed")
+	shuffle := fs.Bool("shuffle", false, "random line order instead of clustered runs of sequential addresses")
+	dist := fs.String("dist", "uniform", "repeat distribution: uniform|zipf|hotset|subnet")
+	zipfS := fs.Float64("s", 1.1, "zipf exponent (> 1)")
+	hot := fs.Uint64("hot", 1000, "hotset size")
+	hotFrac := fs.Float64("hot-frac", 0.9, "share of repeats drawn from the hotset")
+	cidr := fs.String("cidr", "10.0.0.0/8", "address range for -dist subnet")
+	invalidFrac := fs.Float64("invalid-frac", 0, "share of repeated lines replaced by malformed text")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter gen [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	d, err := gen.ParseDistribution(*dist)
+	if err != nil {
+		return err
+	}
+	cfg := gen.Config{
+		Lines:       uint64(lines),
+		Unique:      uint64(unique),
+		Seed:        *seed,
+		Shuffle:     *shuffle,
+		Dist:        d,
+		S:           *zipfS,
+		Hot:         *hot,
+		HotFrac:     *hotFrac,
+		InvalidFrac: *invalidFrac,
+	}
+	if *dist == "subnet" {
+		c, err := utils.ParseCIDR([]byte(*cidr))
+		if err != nil {
+			return fmt.Errorf("-cidr: %w", err)
+		}
+		cfg.Subnet = &c
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	report := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	} else {
+		report = os.Stderr // keep the data stream clean
+	}
+
+	res, err := gen.Write(w, cfg)
+	if err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if res.Invalid > 0 {
+		fmt.Fprintf(report, "Malformed lines: %d\n", res.Invalid)
+	}
+	fmt.Fprintf(report, "Expected unique IPv4 addresses: %d\n", res.Unique)
+	return nil
+}
@@ -0,0 +1,80 @@
+package geoip
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Unknown is the code of addresses the database has no country for.
+const Unknown = "unknown"
+
+// Country returns the ISO 3166 code of ip, or Unknown.
+func (db *DB) Country(ip uint32) (string, error) {
+	off, err := db.lookup(ip)
+	if err != nil || off < 0 {
+		return Unknown, err
+	}
+	code, err := db.country(off)
+	return cmp.Or(code, Unknown), err
+}
+
+// Breakdown counts the addresses each yields per country. each is called
+// once and should call fn for every distinct address, as
+// concurrent.BitsetCounter.Range does, so the cost is one lookup per unique
+// address rather than per line. Records shared by many addresses are
+// decoded once.
+func (db *DB) Breakdown(each func(fn func(ip uint32) bool)) (Counts, error) {
+	counts := make(map[string]int64)
+	codes := make(map[int]string) // data offset -> ISO code
+	var err error
+	each(func(ip uint32) bool {
+		var off int
+		if off, err = db.lookup(ip); err != nil {
+			return false
+		}
+		if off < 0 {
+			counts[Unknown]++
+			return true
+		}
+		code, ok := codes[off]
+		if !ok {
+			if code, err = db.country(off); err != nil {
+				return false
+			}
+			code = cmp.Or(code, Unknown)
+			codes[off] = code
+		}
+		counts[code]++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Counts maps ISO country codes, and Unknown, to unique address counts.
+type Counts map[string]int64
+
+// Sorted returns the codes by descending count, ties by code.
+func (c Counts) Sorted() []string {
+	codes := make([]string, 0, len(c))
+	for code := range c {
+		codes = append(codes, code)
+	}
+	slices.SortFunc(codes, func(a, b string) int {
+		return cmp.Or(cmp.Compare(c[b], c[a]), cmp.Compare(a, b))
+	})
+	return codes
+}
+
+// String formats the counts as an aligned table, largest first.
+func (c Counts) String() string {
+	var sb strings.Builder
+	for _, code := range c.Sorted() {
+		fmt.Fprintf(&sb, "  %-8s %12d\n", code, c[code])
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,232 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// entry is one network of a fixture database and its record: a country
+// code, a registered country code if reg, or an empty record if code is
+// empty.
+type entry struct {
+	ip   string
+	bits int
+	code string
+	reg  bool
+}
+
+// fixture is a country database small enough to reason about: nested
+// networks, a record with only a registered country, an empty record and
+// networks at both ends of the address space.
+var fixture = []entry{
+	{"0.0.0.0", 32, "AQ", false},
+	{"10.0.0.0", 8, "US", false},
+	{"10.1.0.0", 16, "CA", false},
+	{"192.168.0.0", 24, "DE", false},
+	{"192.168.1.0", 24, "FR", true},
+	{"203.0.113.0", 25, "", false},
+	{"255.255.255.0", 24, "JP", false},
+}
+
+// A node's children are node indexes, emptyChild, or dataChild-off for
+// the record at data section offset off.
+const (
+	emptyChild = -1
+	dataChild  = -2
+)
+
+// buildMMDB encodes entries, least specific first, as a MaxMind DB with
+// the given record size. With ipVersion 6 the networks sit under ::/96
+// as IPv4 addresses do in the real country databases.
+func buildMMDB(t *testing.T, entries []entry, recordSize, ipVersion int) []byte {
+	t.Helper()
+	nodes := [][2]int{{emptyChild, emptyChild}}
+	var data []byte
+	for _, e := range entries {
+		rec := encMap(0)
+		switch {
+		case e.code == "":
+		case e.reg:
+			rec = append(encMap(1), encString("registered_country")...)
+			rec = append(rec, append(encMap(1), append(encString("iso_code"), encString(e.code)...)...)...)
+		default:
+			rec = append(encMap(1), encString("country")...)
+			rec = append(rec, append(encMap(1), append(encString("iso_code"), encString(e.code)...)...)...)
+		}
+		offset := len(data)
+		data = append(data, rec...)
+
+		ip, err := utils.ParseIPv4([]byte(e.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var path []int
+		if ipVersion == 6 {
+			path = make([]int, 96)
+		}
+		for b := range e.bits {
+			path = append(path, int(ip>>(31-b))&1)
+		}
+		node := 0
+		for i, bit := range path {
+			if i == len(path)-1 {
+				nodes[node][bit] = dataChild - offset
+				break
+			}
+			child := nodes[node][bit]
+			if child < 0 {
+				// A less specific network's record goes on in both halves
+				nodes = append(nodes, [2]int{child, child})
+				child = len(nodes) - 1
+				nodes[node][bit] = child
+			}
+			node = child
+		}
+	}
+
+	count := len(nodes)
+	var buf []byte
+	for _, n := range nodes {
+		var rec [2]uint64
+		for i, c := range n {
+			switch {
+			case c == emptyChild:
+				rec[i] = uint64(count)
+			case c <= dataChild:
+				rec[i] = uint64(count + 16 + dataChild - c)
+			default:
+				rec[i] = uint64(c)
+			}
+		}
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]), byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		case 28:
+			buf = append(buf, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]), byte(rec[0]>>24<<4|rec[1]>>24),
+				byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		default:
+			buf = binary.BigEndian.AppendUint32(buf, uint32(rec[0]))
+			buf = binary.BigEndian.AppendUint32(buf, uint32(rec[1]))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, encMap(3)...)
+	buf = append(buf, encString("node_count")...)
+	buf = append(buf, byte(typeUint32<<5|4))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(count))
+	buf = append(buf, encString("record_size")...)
+	buf = append(buf, byte(typeUint16<<5|2), 0, byte(recordSize))
+	buf = append(buf, encString("ip_version")...)
+	buf = append(buf, byte(typeUint16<<5|2), 0, byte(ipVersion))
+	return buf
+}
+
+func encMap(n int) []byte { return []byte{byte(typeMap<<5 | n)} }
+
+func encString(s string) []byte { return append([]byte{byte(typeString<<5 | len(s))}, s...) }
+
+// Lookups at either edge of every network and just outside it find the
+// most specific network's country, with every record size and with the
+// IPv4 tree of an IPv6 database.
+func TestCountry(t *testing.T) {
+	want := map[string]string{
+		"0.0.0.0":         "AQ",
+		"0.0.0.1":         Unknown,
+		"9.255.255.255":   Unknown,
+		"10.0.0.0":        "US",
+		"10.0.255.255":    "US",
+		"10.1.0.0":        "CA",
+		"10.1.255.255":    "CA",
+		"10.2.0.0":        "US",
+		"10.255.255.255":  "US",
+		"11.0.0.0":        Unknown,
+		"192.167.255.255": Unknown,
+		"192.168.0.0":     "DE",
+		"192.168.0.255":   "DE",
+		"192.168.1.0":     "FR", // registered country only
+		"192.168.1.255":   "FR",
+		"192.168.2.0":     Unknown,
+		"203.0.113.0":     Unknown, // an empty record
+		"203.0.113.127":   Unknown,
+		"203.0.113.128":   Unknown,
+		"255.255.254.255": Unknown,
+		"255.255.255.0":   "JP",
+		"255.255.255.255": "JP",
+	}
+	for _, version := range []int{4, 6} {
+		for _, size := range []int{24, 28, 32} {
+			path := filepath.Join(t.TempDir(), "country.mmdb")
+			if err := os.WriteFile(path, buildMMDB(t, fixture, size, version), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			db, err := Open(path)
+			if err != nil {
+				t.Fatalf("IPv%d, %d-bit records: %v", version, size, err)
+			}
+			for ip, code := range want {
+				addr, _ := utils.ParseIPv4([]byte(ip))
+				if got, err := db.Country(addr); err != nil || got != code {
+					t.Errorf("IPv%d, %d-bit records, %s: %s, %v, want %s", version, size, ip, got, err, code)
+				}
+			}
+		}
+	}
+}
+
+// Breakdown counts each address once under its country.
+func TestBreakdown(t *testing.T) {
+	db, err := parse(buildMMDB(t, fixture, 24, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []uint32
+	for _, s := range []string{"0.0.0.0", "10.0.0.1", "10.0.0.2", "10.1.0.1", "11.0.0.0", "192.168.1.1", "203.0.113.1", "255.255.255.255"} {
+		ip, _ := utils.ParseIPv4([]byte(s))
+		ips = append(ips, ip)
+	}
+	got, err := db.Breakdown(func(fn func(ip uint32) bool) {
+		for _, ip := range ips {
+			if !fn(ip) {
+				return
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Counts{"AQ": 1, "US": 2, "CA": 1, "FR": 1, "JP": 1, Unknown: 2}
+	if !maps.Equal(got, want) {
+		t.Errorf("breakdown %v, want %v", got, want)
+	}
+}
+
+// A missing file fails with the os error, and one that is no database, or
+// is cut short, with ErrCorrupt.
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Open(filepath.Join(dir, "missing.mmdb")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+	good := buildMMDB(t, fixture, 24, 4)
+	for name, data := range map[string][]byte{
+		"text":      []byte("10.0.0.1\n"),
+		"truncated": good[len(good)/2:],
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(path); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: %v, want ErrCorrupt", name, err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Package geoip looks up the country of IPv4 addresses in a MaxMind DB
+// (.mmdb) file such as GeoLite2-Country, with a minimal reader for the
+// parts of the format a country lookup needs: the metadata, the binary
+// search tree and the data section's maps and strings.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// metadataMarker precedes the metadata map at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// ErrCorrupt is returned for files that are not a readable MaxMind DB.
+var ErrCorrupt = errors.New("corrupt or unsupported mmdb file")
+
+// Data section types used by the reader.
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// DB is an in-memory MaxMind DB. It is safe for concurrent lookups.
+type DB struct {
+	buf        []byte
+	nodeCount  uint64
+	recordSize int    // bits per search tree record: 24, 28 or 32
+	data       []byte // data section
+	ipv4Start  uint64 // node where IPv4 lookups start
+}
+
+// Open reads the database at path. A missing file fails with the
+// os error; an unreadable one with ErrCorrupt.
+func Open(path string) (*DB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database: %w", err)
+	}
+	db, err := parse(buf)
+	if err != nil {
+		return nil, fmt.Errorf("geoip database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// parse validates buf's metadata and locates its tree and data section.
+func parse(buf []byte) (*DB, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata marker", ErrCorrupt)
+	}
+	md := decoder{buf: buf[i+len(metadataMarker):]}
+	meta, _, err := md.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", ErrCorrupt, err)
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrCorrupt)
+	}
+	nodeCount, ok1 := m["node_count"].(uint64)
+	recordSize, ok2 := m["record_size"].(uint64)
+	ipVersion, ok3 := m["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("%w: metadata lacks node_count, record_size or ip_version", ErrCorrupt)
+	}
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%w: record size %d", ErrCorrupt, recordSize)
+	}
+	treeSize := nodeCount * recordSize * 2 / 8
+	if treeSize+16 > uint64(i) {
+		return nil, fmt.Errorf("%w: search tree of %d nodes exceeds the file", ErrCorrupt, nodeCount)
+	}
+	db := &DB{
+		buf:        buf,
+		nodeCount:  nodeCount,
+		recordSize: int(recordSize),
+		data:       buf[treeSize+16 : i],
+	}
+	if ipVersion == 6 {
+		// IPv4 addresses live under ::/96; walk its 96 zero bits once
+		node := uint64(0)
+		for b := 0; b < 96 && node < nodeCount; b++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *DB) record(node uint64, bit int) uint64 {
+	switch db.recordSize {
+	case 24:
+		off := node*6 + uint64(bit)*3
+		b := db.buf[off : off+3]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		off := node * 7
+		b := db.buf[off : off+7]
+		if bit == 0 {
+			return uint64(b[3]&0xF0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0F)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		off := node*8 + uint64(bit)*4
+		return uint64(binary.BigEndian.Uint32(db.buf[off : off+4]))
+	}
+}
+
+// lookup returns the data section offset of ip's record, or -1 when the
+// database has no entry for it.
+func (db *DB) lookup(ip uint32) (int, error) {
+	node := db.ipv4Start
+	for b := 31; b >= 0 && node < db.nodeCount; b-- {
+		node = db.record(node, int(ip>>b)&1)
+	}
+	switch {
+	case node == db.nodeCount:
+		return -1, nil
+	case node < db.nodeCount:
+		return 0, fmt.Errorf("%w: search tree deeper than 32 bits", ErrCorrupt)
+	}
+	off := node - db.nodeCount - 16
+	if off >= uint64(len(db.data)) {
+		return 0, fmt.Errorf("%w: data pointer %d out of range", ErrCorrupt, off)
+	}
+	return int(off), nil
+}
+
+// country returns the ISO code of the record at the data offset: its
+// country, or registered_country when the record has none, "" for
+// neither.
+func (db *DB) country(off int) (string, error) {
+	d := decoder{buf: db.data}
+	v, _, err := d.decode(off, 0)
+	if err != nil {
+		return "", fmt.Errorf("%w: record at %d: %v", ErrCorrupt, off, err)
+	}
+	rec, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// decoder reads values from a data section. Records are small, so values
+// are decoded into plain Go maps, slices, strings and numbers.
+type decoder struct {
+	buf []byte
+}
+
+const maxDepth = 32 // nesting bound against pointer loops in corrupt files
+
+// decode returns the value at off and the offset just past it.
+func (d *decoder) decode(off, depth int) (any, int, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("nesting too deep")
+	}
+	typ, size, off, err := d.header(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		ptr, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[key], off, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, size)
+		for i := range a {
+			if a[i], off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+	if off+size > len(d.buf) {
+		return nil, 0, errors.New("value runs past the end")
+	}
+	b := d.buf[off : off+size]
+	switch typ {
+	case typeString:
+		return string(b), off + size, nil
+	case typeBytes, typeUint128:
+		return b, off + size, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off + size, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("bad float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off + size, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		if size > 8 {
+			return nil, 0, errors.New("bad integer size")
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, off + size, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported type %d", typ)
+}
+
+// header decodes the control byte(s) at off into a type and payload size.
+func (d *decoder) header(off int) (typ, size, next int, err error) {
+	if off >= len(d.buf) {
+		return 0, 0, 0, errors.New("offset past the end")
+	}
+	ctrl := d.buf[off]
+	off++
+	typ = int(ctrl >> 5)
+	if typ == typePointer {
+		return typ, int(ctrl & 0x1F), off, nil
+	}
+	if typ == typeExtended {
+		if off >= len(d.buf) {
+			return 0, 0, 0, errors.New("truncated type")
+		}
+		typ = 7 + int(d.buf[off])
+		off++
+	}
+	size = int(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28 // 1, 2 or 3 more bytes
+		if off+n > len(d.buf) {
+			return 0, 0, 0, errors.New("truncated size")
+		}
+		var v int
+		for _, c := range d.buf[off : off+n] {
+			v = v<<8 | int(c)
+		}
+		size = [...]int{29, 285, 65821}[n-1] + v
+		off += n
+	}
+	return typ, size, off, nil
+}
+
+// pointer decodes a pointer whose control byte carried bits and returns
+// its target and the offset just past it.
+func (d *decoder) pointer(bits, off int) (int, int, error) {
+	n := bits>>3 + 1 // 1 to 4 bytes follow
+	if off+n > len(d.buf) {
+		return 0, 0, errors.New("truncated pointer")
+	}
+	v := 0
+	if n < 4 {
+		v = bits & 0x7
+	}
+	for _, c := range d.buf[off : off+n] {
+		v = v<<8 | int(c)
+	}
+	v += [...]int{0, 2048, 526336, 0}[n-1]
+	return v, off + n, nil
+}
@@ -1,3 +1,3 @@
-module ipcounter
+module github.com/Sveta-1999/IPCounter
 
-go 1.21.2
+go 1.23
@@ -0,0 +1,341 @@
+// Package group counts unique IPv4 addresses per key in delimited records
+// such as "customer_id,ip": every distinct key gets its own set, and the
+// counts are written as "key,unique_count" rows sorted by key once the
+// input is read. Sets start as hash sets and only move to a bitset when
+// they grow large, so thousands of small groups stay small.
+package group
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/Sveta-1999/IPCounter/adaptive"
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	ctxCheckLines = 1 << 16         // lines between cancellation checks
+	bytesPerChunk = 1 * 1024 * 1024 // read buffer size
+)
+
+// OtherKey is the group that keys past MaxGroups are lumped into under
+// OverflowOther.
+const OtherKey = "__other__"
+
+// ErrTooManyGroups is returned under OverflowError when the input has more
+// than MaxGroups distinct keys.
+var ErrTooManyGroups = errors.New("too many groups")
+
+// errShortLine is what a line without both fields is noted as malformed
+// with.
+var errShortLine = errors.New("missing the key or address field")
+
+// Overflow is what happens to new keys once MaxGroups are tracked.
+type Overflow int
+
+const (
+	OverflowError Overflow = iota // fail with ErrTooManyGroups
+	OverflowOther                 // count them together under OtherKey
+)
+
+// ParseOverflow parses a -group-overflow value: error or other.
+func ParseOverflow(s string) (Overflow, error) {
+	switch s {
+	case "error":
+		return OverflowError, nil
+	case "other":
+		return OverflowOther, nil
+	}
+	return 0, fmt.Errorf("group overflow must be error or other, got %q", s)
+}
+
+// Options configures a GroupCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+
+	// KeyColumn and Column are the 1-based fields holding the key and
+	// the address; Column 0 means the first field that is not the key.
+	KeyColumn int
+	Column    int
+	Sep       byte // field separator, 0 for ','
+
+	// MaxGroups caps the distinct keys tracked, 0 for no cap; Overflow
+	// says what a key past the cap does. Keys are compared as raw bytes.
+	MaxGroups int
+	Overflow  Overflow
+
+	// Out receives a "key,unique_count" header and one row per key in
+	// ascending byte order; nil discards them.
+	Out io.Writer
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the group count and short lines, nil to discard
+	Logger   *slog.Logger      // receives the short-line warning, nil for slog.Default()
+}
+
+// Validate reports whether o can build a GroupCounter.
+func (o Options) Validate() error {
+	if o.KeyColumn < 1 {
+		return fmt.Errorf("key column must be positive, got %d", o.KeyColumn)
+	}
+	if o.Column < 0 || o.Column == o.KeyColumn {
+		return fmt.Errorf("address column must be positive and differ from the key column, got %d", o.Column)
+	}
+	if o.MaxGroups < 0 {
+		return fmt.Errorf("max groups must not be negative, got %d", o.MaxGroups)
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("group", func(o counter.Options) (counter.Counter, error) {
+		overflow, _ := ParseOverflow(cmp.Or(o.GroupOverflow, "error")) // validated by the caller
+		var sep byte
+		if o.FieldSep != "" {
+			sep = o.FieldSep[0]
+		}
+		opts := Options{
+			Parse:     o.Parse,
+			MaxLine:   o.MaxLine,
+			KeyColumn: cmp.Or(o.GroupColumn, 1),
+			Column:    o.Column,
+			Sep:       sep,
+			MaxGroups: o.MaxGroups,
+			Overflow:  overflow,
+			Out:       o.Output,
+			Stats:     o.Stats,
+			Progress:  o.Progress,
+			Logger:    o.Logger,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("group: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// GroupCounter counts unique IPs per key and overall.
+type GroupCounter struct {
+	opts Options
+}
+
+// NewWithOptions creates a GroupCounter with the given options. It panics
+// if opts fail Validate.
+func NewWithOptions(opts Options) *GroupCounter {
+	if err := opts.Validate(); err != nil {
+		panic("group: " + err.Error())
+	}
+	if opts.Column == 0 {
+		opts.Column = 1
+		if opts.KeyColumn == 1 {
+			opts.Column = 2
+		}
+	}
+	opts.Sep = cmp.Or(opts.Sep, ',')
+	if opts.Out == nil {
+		opts.Out = io.Discard
+	}
+	return &GroupCounter{opts: opts}
+}
+
+// CountUniqueIPs writes the per-key counts of a file to Options.Out and
+// returns the number of distinct IPv4s over all keys.
+func (c *GroupCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation, checked every
+// ctxCheckLines lines.
+func (c *GroupCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(ctx, file)
+}
+
+// CountReader is CountUniqueIPsContext on r.
+func (c *GroupCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	groups := make(map[string]*set)
+	total := newSet()
+	var other *set // OtherKey's set, outside the MaxGroups count
+	cr := utils.NewDelimChunkReader(c.opts.Progress.Reader(r), bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+	delim := c.opts.Parse.Delim()
+	var lines, oversized, short, lumped int64
+
+	for {
+		ch, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, counter.WrapRead("", err)
+		}
+		for data := ch.Data; len(data) > 0; {
+			var raw []byte
+			raw, data = utils.NextRecord(data, delim)
+			if lines++; lines%ctxCheckLines == 0 {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+			}
+			if len(raw) > maxLine {
+				oversized++
+				continue
+			}
+			line := c.opts.Parse.Trim(raw)
+			if len(line) == 0 || c.opts.Parse.IsComment(line) {
+				continue
+			}
+			key, ipField, ok := c.fields(line)
+			if !ok {
+				short++
+				c.opts.Parse.Malformed.Add(line, errShortLine)
+				continue
+			}
+			first, last, form, err := c.opts.Parse.ParseForm(ipField, ipField)
+			if err != nil {
+				c.opts.Parse.Malformed.Add(ipField, err)
+				continue
+			}
+			c.opts.Parse.Canon.Add(first, last, form)
+
+			g := groups[string(key)]
+			if g == nil {
+				if m := c.opts.MaxGroups; m > 0 && len(groups) >= m {
+					if c.opts.Overflow == OverflowError {
+						return 0, fmt.Errorf("%w: more than %d distinct keys, next %q", ErrTooManyGroups, m, key)
+					}
+					if other == nil {
+						other = newSet()
+					}
+					g = other
+					lumped++
+				} else {
+					g = newSet()
+					groups[string(key)] = g
+				}
+			}
+			for ip := first; ; ip++ {
+				g.add(ip)
+				total.add(ip)
+				if ip == last {
+					break
+				}
+			}
+		}
+		cr.Release(ch)
+	}
+
+	if other != nil {
+		groups[OtherKey] = other
+	}
+	if err := c.write(groups); err != nil {
+		return 0, err
+	}
+	c.opts.Stats.Set("oversized lines", "%d", oversized+cr.Oversized())
+	c.opts.Stats.Set("groups", "%d", len(groups))
+	c.opts.Stats.Set("short lines", "%d", short)
+	if lumped > 0 {
+		c.opts.Stats.Set("lines in "+OtherKey, "%d", lumped)
+	}
+	if short > 0 {
+		counter.Logger(c.opts.Logger).Warn("skipped lines without both fields", "lines", short,
+			"key_field", c.opts.KeyColumn, "field", c.opts.Column)
+	}
+	return total.count(), nil
+}
+
+// write writes the groups to Options.Out sorted by key.
+func (c *GroupCounter) write(groups map[string]*set) error {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	if _, err := fmt.Fprintln(c.opts.Out, "key,unique_count"); err != nil {
+		return fmt.Errorf("write groups: %w", err)
+	}
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(c.opts.Out, "%s,%d\n", k, groups[k].count()); err != nil {
+			return fmt.Errorf("write groups: %w", err)
+		}
+	}
+	return nil
+}
+
+// fields returns the trimmed key and address fields of line, and false
+// when it has too few fields or an empty key.
+func (c *GroupCounter) fields(line []byte) (key, ip []byte, ok bool) {
+	n := max(c.opts.KeyColumn, c.opts.Column)
+	for i := 1; i <= n; i++ {
+		end := bytes.IndexByte(line, c.opts.Sep)
+		if end < 0 {
+			if i < n {
+				return nil, nil, false
+			}
+			end = len(line)
+		}
+		switch i {
+		case c.opts.KeyColumn:
+			key = bytes.TrimSpace(line[:end])
+		case c.opts.Column:
+			ip = bytes.TrimSpace(line[:end])
+		}
+		if end < len(line) {
+			line = line[end+1:]
+		} else {
+			line = nil
+		}
+	}
+	return key, ip, len(key) > 0 && len(ip) > 0
+}
+
+// set holds the addresses of one group: a hash set while that is small,
+// moved into a bitset past adaptive.DefaultThreshold entries as the
+// adaptive engine does.
+type set struct {
+	m    map[uint32]struct{}
+	bits *concurrent.BitsetCounter
+	n    int64 // distinct addresses once in bits
+}
+
+func newSet() *set {
+	return &set{m: make(map[uint32]struct{})}
+}
+
+func (s *set) add(ip uint32) {
+	if s.bits != nil {
+		if s.bits.Add(ip) {
+			s.n++
+		}
+		return
+	}
+	s.m[ip] = struct{}{}
+	if len(s.m) >= adaptive.DefaultThreshold {
+		s.bits = concurrent.New()
+		for ip := range s.m {
+			s.bits.Add(ip)
+		}
+		s.n, s.m = int64(len(s.m)), nil
+	}
+}
+
+func (s *set) count() int64 {
+	if s.bits != nil {
+		return s.n
+	}
+	return int64(len(s.m))
+}
@@ -0,0 +1,105 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/naive"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Every key's count matches the naive engine run on that key's addresses
+// alone, keys are told apart by their raw bytes, and a group large
+// enough to move into a bitset keeps counting exactly.
+func TestCountReader(t *testing.T) {
+	rng := rand.New(rand.NewPCG(61, 62))
+	keys := []string{"acme", "ACME", " acme", "b", "zeta"}
+	perKey := make(map[string]*strings.Builder)
+	var b, all strings.Builder
+	b.WriteString("big,10.0.0.0/12\n")
+	for range 30000 {
+		k := keys[rng.IntN(len(keys))]
+		ip := utils.FormatIPv4(rng.Uint32N(5000) << 8)
+		fmt.Fprintf(&b, "%s,%s\n", k, ip)
+		fmt.Fprintf(&all, "%s\n", ip)
+		k = strings.TrimSpace(k)
+		if perKey[k] == nil {
+			perKey[k] = &strings.Builder{}
+		}
+		fmt.Fprintf(perKey[k], "%s\n", ip)
+	}
+	// The first /24 is in the /12 already; "c,d" has no address
+	b.WriteString("big,10.15.255.0/24\nbig,10.16.0.0/24\nc,d,1.2.3.4\n")
+
+	var out strings.Builder
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	exact := naive.NewWithOptions(naive.Options{Logger: discard})
+	c := NewWithOptions(Options{
+		KeyColumn: 1,
+		Parse:     utils.ParseOptions{CIDR: true, MinPrefix: 8},
+		Out:       &out,
+		Logger:    discard,
+	})
+	total, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{"big": 1<<20 + 256}
+	for k, lines := range perKey {
+		n, err := exact.CountReader(context.Background(), strings.NewReader(lines.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[k] = n
+	}
+	rows := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if rows[0] != "key,unique_count" {
+		t.Fatalf("header %q", rows[0])
+	}
+	var got []string
+	for _, row := range rows[1:] {
+		i := strings.LastIndexByte(row, ',')
+		key, count := row[:i], row[i+1:]
+		got = append(got, key)
+		if fmt.Sprint(want[key]) != count {
+			t.Errorf("key %q: %s, want %d", key, count, want[key])
+		}
+	}
+	if !slices.IsSorted(got) || len(got) != len(want) {
+		t.Errorf("keys %q, want %d sorted", got, len(want))
+	}
+
+	n, err := exact.CountReader(context.Background(), strings.NewReader(all.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != n+want["big"] {
+		t.Errorf("total %d, want %d", total, n+want["big"])
+	}
+}
+
+// Past MaxGroups keys new keys fail the run or share OtherKey.
+func TestMaxGroups(t *testing.T) {
+	input := "a,1.1.1.1\nb,1.1.1.2\na,1.1.1.3\nc,1.1.1.4\nd,1.1.1.4\nb,1.1.1.5\n"
+	c := NewWithOptions(Options{KeyColumn: 1, MaxGroups: 2})
+	if _, err := c.CountReader(context.Background(), strings.NewReader(input)); !errors.Is(err, ErrTooManyGroups) {
+		t.Errorf("error policy: %v, want ErrTooManyGroups", err)
+	}
+	var out strings.Builder
+	c = NewWithOptions(Options{KeyColumn: 1, MaxGroups: 2, Overflow: OverflowOther, Out: &out})
+	n, err := c.CountReader(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "key,unique_count\n" + OtherKey + ",1\na,2\nb,2\n"; n != 5 || out.String() != want {
+		t.Errorf("other policy: %d,\n%s\nwant 5,\n%s", n, out.String(), want)
+	}
+}
@@ -0,0 +1,75 @@
+// Package heatmap draws which parts of the IPv4 space a set covers: one
+// pixel per /24 along a Hilbert curve, colored by how many of its 256
+// addresses are present, so scanned ranges and busy networks stand out.
+package heatmap
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// Size is the width and height of the image: Size² pixels, one per /24.
+const Size = 4096
+
+// palette maps a /24's count to a color: black for none, then from dark
+// blue through purple and red to yellow and white for a full block, so a single
+// address is already visible against the background.
+var palette = func() color.Palette {
+	stops := []color.RGBA{
+		{0x30, 0x40, 0xc0, 0xff},
+		{0x90, 0x20, 0xa0, 0xff},
+		{0xe0, 0x30, 0x30, 0xff},
+		{0xff, 0xc0, 0x20, 0xff},
+		{0xff, 0xff, 0xff, 0xff},
+	}
+	p := color.Palette{color.RGBA{0, 0, 0, 0xff}}
+	for i := range 255 {
+		t := float64(i) / 254 * float64(len(stops)-1)
+		k := min(int(t), len(stops)-2)
+		f := t - float64(k)
+		a, b := stops[k], stops[k+1]
+		mix := func(x, y uint8) uint8 { return uint8(float64(x) + f*(float64(y)-float64(x)) + 0.5) }
+		p = append(p, color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 0xff})
+	}
+	return p
+}()
+
+// Render draws density, counter.Slash24s counts indexed by a /24's top
+// 24 bits as counter.DensityMapper returns them. 0.0.0.0/24 is the top
+// left pixel; the curve ends at 255.255.255.0/24 in the top right.
+func Render(density []uint16) (*image.Paletted, error) {
+	if len(density) != counter.Slash24s {
+		return nil, fmt.Errorf("heatmap: need %d /24 counts, got %d", counter.Slash24s, len(density))
+	}
+	img := image.NewPaletted(image.Rect(0, 0, Size, Size), palette)
+	for i, n := range density {
+		if n == 0 {
+			continue
+		}
+		x, y := hilbertXY(Size, uint32(i))
+		// Counts 1 to 256 onto the 255 colors after black
+		img.Pix[int(y)*img.Stride+int(x)] = uint8(1 + (int(min(n, 256))-1)*254/255)
+	}
+	return img, nil
+}
+
+// WriteFile renders density and writes it to path as a PNG, through a
+// temp file renamed into place once complete, fsynced first with sync.
+func WriteFile(path string, density []uint16, sync bool) error {
+	img, err := Render(density)
+	if err != nil {
+		return err
+	}
+	err = counter.WriteFileAtomic(path, sync, func(w io.Writer) error {
+		return png.Encode(w, img)
+	})
+	if err != nil {
+		return fmt.Errorf("heatmap: write %s: %w", path, err)
+	}
+	return nil
+}
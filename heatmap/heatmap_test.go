@@ -0,0 +1,107 @@
+package heatmap
+
+import (
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// The curve visits every cell of the grid once, each step to a neighbour,
+// so adjacent /24s are adjacent pixels.
+func TestHilbert(t *testing.T) {
+	const n = 64
+	seen := make(map[[2]uint32]bool)
+	var px, py uint32
+	for d := uint32(0); d < n*n; d++ {
+		x, y := hilbertXY(n, d)
+		if x >= n || y >= n || seen[[2]uint32{x, y}] {
+			t.Fatalf("step %d: cell %d,%d out of the grid or visited twice", d, x, y)
+		}
+		seen[[2]uint32{x, y}] = true
+		if d > 0 && max(x, px)-min(x, px)+max(y, py)-min(y, py) != 1 {
+			t.Fatalf("step %d: %d,%d is not next to %d,%d", d, x, y, px, py)
+		}
+		px, py = x, y
+	}
+}
+
+// Pixels land where the curve puts their /24, in the color of its count,
+// and the rest of the image stays black.
+func TestRender(t *testing.T) {
+	density := make([]uint16, counter.Slash24s)
+	want := map[[2]int]uint8{
+		{0, 0}:       1,   // 0.0.0.0/24, one address: the first color
+		{4095, 0}:    255, // 255.255.255.0/24, full: white
+		{0, 2048}:    127, // 64.0.0.0/24, half full
+		{2048, 2048}: 1,   // 128.0.0.0/24
+		{768, 768}:   255, // 10.0.0.0/24, over-counted, clamped
+	}
+	density[0x000000] = 1
+	density[0xffffff] = 256
+	density[0x400000] = 128
+	density[0x800000] = 1
+	density[0x0a0000] = 300
+
+	img, err := Render(density)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != Size || b.Dy() != Size {
+		t.Fatalf("image is %v", b)
+	}
+	for y := range Size {
+		for x := range Size {
+			if got, w := img.ColorIndexAt(x, y), want[[2]int{x, y}]; got != w {
+				t.Errorf("pixel %d,%d: color %d, want %d", x, y, got, w)
+			}
+		}
+	}
+	if c := img.Palette[0]; c != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("background %v", c)
+	}
+	if c := img.Palette[1]; c != (color.RGBA{0x30, 0x40, 0xc0, 0xff}) {
+		t.Errorf("a single address %v", c)
+	}
+	if c := img.Palette[255]; c != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("a full /24 %v", c)
+	}
+
+	if _, err := Render(density[1:]); err == nil {
+		t.Error("a density one /24 short was drawn")
+	}
+}
+
+// The written PNG decodes to the rendered pixels.
+func TestWriteFile(t *testing.T) {
+	density := make([]uint16, counter.Slash24s)
+	for i := range density {
+		if i%7919 == 0 {
+			density[i] = uint16(i % 257)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "map.png")
+	if err := WriteFile(path, density, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := Render(density)
+	for y := range Size {
+		for x := range Size {
+			if g, w := color.RGBAModel.Convert(got.At(x, y)), want.At(x, y); g != w {
+				t.Fatalf("pixel %d,%d: %v, rendered %v", x, y, g, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package heatmap
+
+// hilbertXY returns the cell at distance d along a Hilbert curve filling
+// an n×n grid, n a power of two, so that addresses close in number stay
+// close on the image: every aligned /k block is a square or a 2:1
+// rectangle.
+func hilbertXY(n, d uint32) (x, y uint32) {
+	for s := uint32(1); s < n; s *= 2 {
+		rx := 1 & (d / 2)
+		ry := 1 & (d ^ rx)
+		if ry == 0 {
+			if rx == 1 {
+				x, y = s-1-x, s-1-y
+			}
+			x, y = y, x
+		}
+		x += s * rx
+		y += s * ry
+		d /= 4
+	}
+	return x, y
+}
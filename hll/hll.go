@@ -0,0 +1,190 @@
+// Package hll estimates the number of unique IPv4 addresses with
+// HyperLogLog (Flajolet et al., 2007): every address is hashed to 64 bits,
+// the top p bits pick one of 2^p registers and the register keeps the
+// longest run of leading zeros seen in the rest. Memory is 2^p bytes,
+// 16 KB at the default precision, however large the input, for a
+// relative standard error of 1.04/sqrt(2^p).
+package hll
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/pipeline"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	DefaultPrecision = 14 // 16 KB of registers, about 0.81% relative standard error
+	MinPrecision     = 4
+	MaxPrecision     = 18 // 256 KB, about 0.2%
+)
+
+// Options configures an HLLCounter.
+type Options struct {
+	Parse      utils.ParseOptions // accepted address forms
+	MaxLine    int                // longest line accepted, 0 for utils.DefaultMaxLine
+	Workers    int                // goroutines parsing the input, 0 for runtime.NumCPU()
+	ChunkSize  int                // bytes handed to a worker at a time, 0 for pipeline.DefaultChunkSize
+	QueueDepth int                // read chunks waiting for a worker, 0 for two per worker
+
+	// Precision is log2 of the number of registers, between MinPrecision
+	// and MaxPrecision; 0 means DefaultPrecision. Each step up doubles the
+	// memory and divides the error by sqrt(2).
+	Precision int
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the estimate and its error, nil to discard
+}
+
+// Validate reports whether o can build an HLLCounter.
+func (o Options) Validate() error {
+	if o.Precision != 0 && (o.Precision < MinPrecision || o.Precision > MaxPrecision) {
+		return fmt.Errorf("precision must be between %d and %d, got %d", MinPrecision, MaxPrecision, o.Precision)
+	}
+	if o.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", o.Workers)
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("hll", func(o counter.Options) (counter.Counter, error) {
+		opts := Options{
+			Parse:      o.Parse,
+			MaxLine:    o.MaxLine,
+			Precision:  o.SketchPrecision,
+			Stats:      o.Stats,
+			Workers:    o.Workers,
+			ChunkSize:  o.ChunkSize,
+			QueueDepth: o.QueueDepth,
+			Progress:   o.Progress,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("hll: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// HLLCounter estimates unique IPs with a HyperLogLog sketch. It
+// implements counter.Estimator.
+type HLLCounter struct {
+	opts   Options
+	stdErr float64 // standard error of the last estimate
+}
+
+// New creates an HLLCounter with DefaultPrecision.
+func New() *HLLCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates an HLLCounter with the given options. It panics
+// if opts fail Validate.
+func NewWithOptions(opts Options) *HLLCounter {
+	if err := opts.Validate(); err != nil {
+		panic("hll: " + err.Error())
+	}
+	if opts.Precision == 0 {
+		opts.Precision = DefaultPrecision
+	}
+	return &HLLCounter{opts: opts}
+}
+
+// CountUniqueIPs returns the estimated number of distinct IPv4s in a file.
+func (c *HLLCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation.
+func (c *HLLCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(ctx, file)
+}
+
+// CountReader estimates the distinct IPv4s read from r. Pipeline workers
+// each fill their own sketch from the chunks they are handed, and the
+// sketches are merged once the input is exhausted, so memory stays at a
+// sketch and a couple of chunks per worker whatever the input size.
+func (c *HLLCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	c.stdErr = 0
+	sk := &sink{precision: c.opts.Precision}
+	res, err := pipeline.Run(ctx, c.opts.Progress.Reader(r), sk, pipeline.Options{
+		Parse:      c.opts.Parse,
+		MaxLine:    c.opts.MaxLine,
+		Workers:    c.opts.Workers,
+		ChunkSize:  c.opts.ChunkSize,
+		QueueDepth: c.opts.QueueDepth,
+		Progress:   c.opts.Progress,
+	})
+	c.opts.Stats.Set("oversized lines", "%d", res.Oversized)
+	if err != nil {
+		return 0, err
+	}
+
+	s := NewSketch(c.opts.Precision)
+	for _, w := range sk.workers {
+		s.Merge(w.sketch)
+	}
+	est, se := s.Estimate()
+	c.stdErr = se
+	rel := 0.0 // of an empty input, which has nothing to be relative to
+	if est > 0 {
+		rel = 100 * se / est
+	}
+	c.opts.Stats.Set("hll estimate", "%.0f ± %.0f (1σ, %.3f%%), 2^%d registers, %d empty",
+		est, se, rel, s.Precision(), s.Zeros())
+	return int64(math.Round(est)), nil
+}
+
+// StdError returns the standard error of the last estimate, 0 before the
+// first successful count.
+func (c *HLLCounter) StdError() float64 {
+	return c.stdErr
+}
+
+// sink is the pipeline sink of a count, handing each worker a sketch of
+// its own.
+type sink struct {
+	precision int
+
+	mu      sync.Mutex
+	workers []*worker
+}
+
+func (s *sink) Add(uint32) bool {
+	panic("hll: an address added to the shared sink")
+}
+
+func (s *sink) Worker(int) pipeline.Worker {
+	w := &worker{sketch: NewSketch(s.precision)}
+	s.mu.Lock()
+	s.workers = append(s.workers, w)
+	s.mu.Unlock()
+	return w
+}
+
+// worker adds the addresses it parses to its own sketch.
+type worker struct {
+	sketch *Sketch
+}
+
+// Add reports every address as new, a sketch not knowing; the count is
+// the merged sketches' estimate.
+func (w *worker) Add(ip uint32) bool {
+	w.sketch.Add(ip)
+	return true
+}
+
+func (w *worker) ChunkDone([]byte, int64) error {
+	return nil
+}
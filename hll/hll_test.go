@@ -0,0 +1,88 @@
+package hll
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The estimate lands within four standard errors of the true count from a
+// handful of addresses to many times the register count, and a sketch
+// merged from parts is the sketch of the whole.
+func TestEstimate(t *testing.T) {
+	rng := rand.New(rand.NewPCG(31, 32))
+	for _, p := range []int{MinPrecision, 10, DefaultPrecision} {
+		for _, n := range []int{1, 10, 1000, 20000, 300000} {
+			whole, a, b := NewSketch(p), NewSketch(p), NewSketch(p)
+			for i := range n {
+				ip := rng.Uint32()
+				whole.Add(ip)
+				if i%2 == 0 {
+					a.Add(ip)
+				} else {
+					b.Add(ip)
+				}
+				b.Add(ip) // a repeat changes nothing
+			}
+			est, se := whole.Estimate()
+			if d := math.Abs(est - float64(n)); d > 4*se+0.5 {
+				t.Errorf("p=%d, n=%d: %.0f ± %.0f", p, n, est, se)
+			}
+			a.Merge(b)
+			if got, _ := a.Estimate(); got != est {
+				t.Errorf("p=%d, n=%d: merged %.0f, whole %.0f", p, n, got, est)
+			}
+		}
+	}
+	if n, se := NewSketch(DefaultPrecision).Estimate(); n != 0 || se != 0 {
+		t.Errorf("empty: %.0f ± %.0f", n, se)
+	}
+}
+
+func TestCountReader(t *testing.T) {
+	var b strings.Builder
+	for i := range 50000 {
+		fmt.Fprintf(&b, "%s\n%s\n", utils.FormatIPv4(uint32(i)*2654435761), utils.FormatIPv4(uint32(i)*2654435761))
+	}
+	c := New()
+	n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se := c.StdError(); math.Abs(float64(n-50000)) > 4*se || se > 0.01*50000 {
+		t.Errorf("%d ± %.0f, want 50000", n, se)
+	}
+}
+
+// The estimate is the same whatever the workers, chunk size and queue
+// depth, merging the workers' sketches being the sketch of the whole.
+func TestCountReaderChunking(t *testing.T) {
+	var b strings.Builder
+	rng := rand.New(rand.NewPCG(33, 34))
+	for range 100000 {
+		b.WriteString(utils.FormatIPv4(rng.Uint32()%60000) + "\n")
+	}
+	input := b.String()
+	var want int64
+	for i, opts := range []Options{
+		{Workers: 1},
+		{Workers: 4, ChunkSize: 4096, QueueDepth: 1},
+		{Workers: 3, ChunkSize: 64 << 10},
+		{},
+	} {
+		n, err := NewWithOptions(opts).CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			want = n
+		} else if n != want {
+			t.Errorf("%+v: %d, want %d as with one worker", opts, n, want)
+		}
+	}
+}
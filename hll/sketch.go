@@ -0,0 +1,133 @@
+package hll
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Sketch is a HyperLogLog sketch of 2^p one-byte registers. It is not safe
+// for concurrent use; workers keep their own sketches and Merge them.
+type Sketch struct {
+	p    int
+	regs []uint8
+}
+
+// NewSketch returns an empty sketch of 2^p registers. It panics if p is
+// outside MinPrecision..MaxPrecision.
+func NewSketch(p int) *Sketch {
+	if p < MinPrecision || p > MaxPrecision {
+		panic(fmt.Sprintf("hll: precision must be between %d and %d, got %d", MinPrecision, MaxPrecision, p))
+	}
+	return &Sketch{p: p, regs: make([]uint8, 1<<p)}
+}
+
+// Precision returns log2 of the number of registers.
+func (s *Sketch) Precision() int {
+	return s.p
+}
+
+// Add hashes ip into the sketch: the top p bits of the hash pick the
+// register, which keeps the largest rank, one more than the leading zeros
+// of the remaining 64-p bits, it has seen.
+func (s *Sketch) Add(ip uint32) {
+	h := hash(ip)
+	q := 64 - s.p
+	rank := uint8(min(bits.LeadingZeros64(h<<s.p), q) + 1)
+	r := &s.regs[h>>q]
+	if rank > *r {
+		*r = rank
+	}
+}
+
+// Merge makes s a sketch of the union of both inputs by keeping the
+// larger of each pair of registers. It panics if the precisions differ.
+func (s *Sketch) Merge(o *Sketch) {
+	if o.p != s.p {
+		panic(fmt.Sprintf("hll: merging precision %d into %d", o.p, s.p))
+	}
+	for i, r := range o.regs {
+		s.regs[i] = max(s.regs[i], r)
+	}
+}
+
+// Zeros returns how many registers are still empty.
+func (s *Sketch) Zeros() int {
+	n := 0
+	for _, r := range s.regs {
+		if r == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Estimate returns the estimated number of distinct addresses added and
+// its standard error, 1.04/sqrt(m) of the estimate for m registers. It
+// uses Ertl's improved estimator ("New cardinality estimation algorithms
+// for HyperLogLog sketches", 2017), which works from the histogram of
+// register values and stays unbiased from empty to far beyond 2^32
+// without the small-range switch to linear counting or a bias table.
+func (s *Sketch) Estimate() (n, stdErr float64) {
+	q := 64 - s.p
+	m := float64(len(s.regs))
+	hist := make([]float64, q+2)
+	for _, r := range s.regs {
+		hist[r]++
+	}
+	if hist[0] == m {
+		return 0, 0
+	}
+	z := m * tau(1-hist[q+1]/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + hist[k])
+	}
+	z += m * sigma(hist[0]/m)
+	n = m * m / (2 * math.Ln2 * z)
+	return n, 1.04 / math.Sqrt(m) * n
+}
+
+// sigma is Ertl's σ(x) = x + Σ_{k≥1} x^(2^k)·2^(k-1), summed until it stops
+// changing, for the share x of empty registers, below 1.
+func sigma(x float64) float64 {
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+// tau is Ertl's τ(x) = (1 - x - Σ_{k≥1} (1 - x^(2^-k))²·2^-k) / 3, for the
+// share x of registers below the largest rank.
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// hash is the splitmix64 finalizer of ip as a uint64, the same hash the
+// kmv engine keeps, so that all 64 bits depend on every address bit.
+func hash(ip uint32) uint64 {
+	h := uint64(ip)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
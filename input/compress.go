@@ -0,0 +1,122 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// Codec is a compression format an input may be stored in.
+type Codec int
+
+const (
+	Uncompressed Codec = iota
+	Gzip
+	Zstd
+	Bzip2
+)
+
+// codecSniffSize is how much of an input SniffCodec needs to see.
+const codecSniffSize = 10
+
+func (c Codec) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Bzip2:
+		return "bzip2"
+	}
+	return "uncompressed"
+}
+
+// SniffCodec returns the codec whose magic head starts with, Uncompressed
+// if none. Besides its "BZh", bzip2 data must show the magic of its first
+// block or of its end, so text starting with those letters is not taken
+// for it.
+func SniffCodec(head []byte) Codec {
+	switch {
+	case len(head) >= 3 && head[0] == 0x1f && head[1] == 0x8b && head[2] == 8:
+		return Gzip
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	case len(head) >= 10 && string(head[:3]) == "BZh" && head[3] >= '1' && head[3] <= '9' &&
+		(string(head[4:10]) == "\x31\x41\x59\x26\x53\x59" || string(head[4:10]) == "\x17\x72\x45\x38\x50\x90"):
+		return Bzip2
+	}
+	return Uncompressed
+}
+
+// CodecByName returns the codec the extension of name stands for: .gz,
+// .zst or .bz2, Uncompressed for any other.
+func CodecByName(name string) Codec {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return Gzip
+	case strings.HasSuffix(name, ".zst"), strings.HasSuffix(name, ".tzst"):
+		return Zstd
+	case strings.HasSuffix(name, ".bz2"), strings.HasSuffix(name, ".tbz2"):
+		return Bzip2
+	}
+	return Uncompressed
+}
+
+// FileCodec returns the codec of the regular file filename by the magic
+// of its first bytes, whatever its name. Anything else, such as a pipe,
+// goes by its name, since sniffing would consume its first bytes.
+func FileCodec(filename string) (Codec, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return Uncompressed, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		return CodecByName(filename), nil
+	}
+	head := make([]byte, codecSniffSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Uncompressed, counter.WrapRead(filename, err)
+	}
+	return SniffCodec(head[:n]), nil
+}
+
+// NewDecompressor returns a reader of the data in r decompressed with c,
+// r itself for Uncompressed. Concatenated gzip members, zstd frames and
+// bzip2 streams are read one after another, as their command-line tools
+// do.
+func NewDecompressor(r io.Reader, c Codec) (io.Reader, error) {
+	switch c {
+	case Gzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return zr, nil
+	case Zstd:
+		return newZstdReader(r), nil
+	case Bzip2:
+		return bzip2.NewReader(r), nil
+	}
+	return r, nil
+}
+
+// Decompress returns a reader of the data in r, decompressed when it
+// starts with the magic of a codec, and the codec found. r is read through
+// a buffer either way, so the bytes sniffed are not lost.
+func Decompress(r io.Reader) (io.Reader, Codec, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(codecSniffSize)
+	c := SniffCodec(head)
+	zr, err := NewDecompressor(br, c)
+	return zr, c, err
+}
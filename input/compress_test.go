@@ -0,0 +1,159 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testText is the plaintext of testdata/text.zst, made by zstd -19 with a
+// checksum, and of testdata/text-fast.zst, made by zstd -1 without one:
+// 132 KiB of addresses, so the frames hold several blocks and reuse their
+// tables.
+func testText() []byte {
+	var b strings.Builder
+	rng := rand.New(rand.NewPCG(7, 8))
+	for b.Len() < 132<<10 {
+		fmt.Fprintf(&b, "10.0.%d.%d\n", rng.IntN(4), rng.IntN(64))
+	}
+	return []byte(b.String())
+}
+
+// testRuns is the plaintext of testdata/runs.zst: 3000 random bytes, which
+// zstd stores raw, then 150000 zeros, which it stores as a run.
+func testRuns() []byte {
+	b := make([]byte, 3000+150000)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 3000 {
+		b[i] = byte(rng.Uint32())
+	}
+	return b
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decompressAll(b []byte) ([]byte, Codec, error) {
+	r, c, err := Decompress(bytes.NewReader(b))
+	if err != nil {
+		return nil, c, err
+	}
+	out, err := io.ReadAll(r)
+	return out, c, err
+}
+
+func TestZstd(t *testing.T) {
+	text, runs := testText(), testRuns()
+	fixture := readFixture(t, "text.zst")
+
+	// A skippable frame between two frames is passed over
+	skippable := binary.LittleEndian.AppendUint32(nil, 0x184d2a53)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 5)
+	skippable = append(skippable, "abcde"...)
+	multi := append(append(append([]byte{}, fixture...), skippable...), readFixture(t, "runs.zst")...)
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"text.zst", fixture, text},
+		{"text-fast.zst", readFixture(t, "text-fast.zst"), text},
+		{"runs.zst", readFixture(t, "runs.zst"), runs},
+		{"concatenated", multi, append(append([]byte{}, text...), runs...)},
+	} {
+		got, c, err := decompressAll(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if c != Zstd {
+			t.Errorf("%s: codec %v, want zstd", tc.name, c)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: %d bytes decoded, not the %d expected", tc.name, len(got), len(tc.want))
+		}
+	}
+
+	// A flipped byte in the last block fails its checksum; a cut frame is
+	// reported, not taken for the end of the input
+	bad := bytes.Clone(fixture)
+	bad[len(bad)-10] ^= 0x40
+	if _, _, err := decompressAll(bad); !errors.Is(err, ErrCorruptZstd) {
+		t.Errorf("corrupt frame: %v, want %v", err, ErrCorruptZstd)
+	}
+	if _, _, err := decompressAll(fixture[:len(fixture)/2]); err == nil {
+		t.Error("truncated frame: no error")
+	}
+}
+
+// Damaged frames give an error or some output, never a panic.
+func TestZstdDamaged(t *testing.T) {
+	fixture := readFixture(t, "text-fast.zst")
+	rng := rand.New(rand.NewPCG(3, 4))
+	for range 500 {
+		b := bytes.Clone(fixture)
+		for range 1 + rng.IntN(4) {
+			b[4+rng.IntN(len(b)-4)] = byte(rng.Uint32())
+		}
+		decompressAll(b)
+	}
+}
+
+func TestGzipAndBzip2(t *testing.T) {
+	var gz bytes.Buffer
+	for _, member := range []string{"10.0.0.1\n", "10.0.0.2\n"} {
+		w := gzip.NewWriter(&gz)
+		w.Write([]byte(member))
+		w.Close()
+	}
+	bz := readFixture(t, "ips.bz2")
+	for _, tc := range []struct {
+		name  string
+		in    []byte
+		codec Codec
+		want  string
+	}{
+		{"gzip members", gz.Bytes(), Gzip, "10.0.0.1\n10.0.0.2\n"},
+		{"bzip2 streams", append(bytes.Clone(bz), bz...), Bzip2, strings.Repeat("10.0.0.1\n10.0.0.2\n10.0.0.1\n", 2)},
+		{"plain", []byte("BZh9 is text\n"), Uncompressed, "BZh9 is text\n"},
+	} {
+		got, c, err := decompressAll(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if c != tc.codec || string(got) != tc.want {
+			t.Errorf("%s: %v %q, want %v %q", tc.name, c, got, tc.codec, tc.want)
+		}
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for name, want := range map[string]Codec{
+		"ips.log.gz":   Gzip,
+		"logs.TGZ":     Gzip,
+		"ips.zst":      Zstd,
+		"logs.tar.zst": Zstd,
+		"ips.bz2":      Bzip2,
+		"ips.log":      Uncompressed,
+		"ips.gzip":     Uncompressed,
+	} {
+		if got := CodecByName(name); got != want {
+			t.Errorf("%s: %v, want %v", name, got, want)
+		}
+	}
+}
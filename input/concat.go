@@ -0,0 +1,134 @@
+package input
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// Concat reads several inputs back to back as one stream, opening each
+// only once the one before it is done, so a counter sees the union of
+// their lines in a single pass. An input that does not end in a newline
+// gets one, so its last line does not run into the next input's first.
+// It tells which input each byte came from through SourceAt; the newline
+// owed after an input is part of it.
+type Concat struct {
+	inputs  []counter.Input
+	cur     io.ReadCloser
+	pending bool // a newline is owed after the previous input
+	delim   byte // what lines end in, '\n' unless SetDelim says otherwise
+	raw     bool // join inputs as they are
+
+	mu     sync.Mutex
+	pos    int64         // bytes returned so far
+	starts []sourceStart // of the inputs opened so far, in order
+}
+
+// sourceStart is where an input begins in the stream.
+type sourceStart struct {
+	offset int64
+	src    counter.Source
+}
+
+var _ counter.Sourced = (*Concat)(nil)
+
+// NewConcat returns a stream over inputs in order.
+func NewConcat(inputs []counter.Input) *Concat {
+	return &Concat{inputs: inputs, delim: '\n'}
+}
+
+// SetDelim makes the stream end an input that lacks it with delim, such
+// as NUL, instead of a newline.
+func (c *Concat) SetDelim(delim byte) {
+	c.delim = delim
+}
+
+// SetRaw makes the stream join inputs as they are, with nothing between
+// them, for packed binary records.
+func (c *Concat) SetRaw() {
+	c.raw = true
+}
+
+// Read reads the concatenated inputs.
+func (c *Concat) Read(p []byte) (int, error) {
+	n, err := c.read(p)
+	c.mu.Lock()
+	c.pos += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *Concat) read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if c.pending && len(p) > 0 {
+				c.pending = false
+				p[0] = c.delim
+				return 1, nil
+			}
+			if len(c.inputs) == 0 {
+				return 0, io.EOF
+			}
+			r, err := c.inputs[0].Open()
+			if err != nil {
+				return 0, err
+			}
+			c.mu.Lock()
+			c.starts = append(c.starts, sourceStart{c.pos, c.inputs[0].Source()})
+			c.mu.Unlock()
+			c.cur, c.inputs = r, c.inputs[1:]
+		}
+		n, err := c.cur.Read(p)
+		if n > 0 {
+			c.pending = !c.raw && p[n-1] != c.delim
+		}
+		if err == io.EOF {
+			err = c.cur.Close()
+			c.cur = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// SourceAt returns the input holding the byte at offset and the offset
+// the next input starts at, -1 if none has been opened yet.
+func (c *Concat) SourceAt(offset int64) (counter.Source, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := sort.Search(len(c.starts), func(i int) bool { return c.starts[i].offset > offset }) - 1
+	if i < 0 {
+		return counter.Source{}, -1
+	}
+	end := int64(-1)
+	if i+1 < len(c.starts) {
+		end = c.starts[i+1].offset
+	}
+	return c.starts[i].src, end
+}
+
+// Size returns the total size of the inputs not yet opened, or -1 when
+// any of them is unknown.
+func (c *Concat) Size() int64 {
+	var n int64
+	for _, in := range c.inputs {
+		if in.Size < 0 {
+			return -1
+		}
+		n += in.Size
+	}
+	return n
+}
+
+// Close closes the input being read, if any.
+func (c *Concat) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	err := c.cur.Close()
+	c.cur = nil
+	return err
+}
@@ -0,0 +1,200 @@
+package input
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	imdsURL      = "http://169.254.169.254/latest"
+	containerURL = "http://169.254.170.2"
+	imdsTimeout  = 2 * time.Second
+)
+
+// ErrNoCredentials is returned when no source in the chain has AWS
+// credentials.
+var ErrNoCredentials = errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, configure ~/.aws/credentials, or run with an instance role")
+
+// credentials sign S3 requests.
+type credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string `json:"Token"`
+}
+
+// loadCredentials walks the standard chain: AWS_ACCESS_KEY_ID and
+// friends, the $AWS_PROFILE (or default) profile of the shared
+// credentials file, the ECS container endpoint, then the EC2 instance
+// metadata service.
+func loadCredentials(ctx context.Context) (credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return credentials{id, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if c, ok, err := fileCredentials(); ok || err != nil {
+		return c, err
+	}
+	client := &http.Client{Timeout: imdsTimeout}
+	if c, ok, err := containerCredentials(ctx, client); ok || err != nil {
+		return c, err
+	}
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		if c, err := instanceCredentials(ctx, client); err == nil {
+			return c, nil
+		}
+	}
+	return credentials{}, ErrNoCredentials
+}
+
+// fileCredentials reads the profile from $AWS_SHARED_CREDENTIALS_FILE or
+// ~/.aws/credentials. A missing file is not an error; a missing profile
+// in an existing file is.
+func fileCredentials() (credentials, bool, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return credentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return credentials{}, false, nil
+	} else if err != nil {
+		return credentials{}, false, fmt.Errorf("credentials: %w", err)
+	}
+	defer f.Close()
+
+	profile := firstNonEmpty(os.Getenv("AWS_PROFILE"), "default")
+	var c credentials
+	found, section := false, ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch v = strings.TrimSpace(v); strings.ToLower(strings.TrimSpace(k)) {
+		case "aws_access_key_id":
+			c.AccessKeyID = v
+		case "aws_secret_access_key":
+			c.SecretAccessKey = v
+		case "aws_session_token":
+			c.SessionToken = v
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return credentials{}, false, fmt.Errorf("credentials: %s: %w", path, err)
+	}
+	if !found {
+		if os.Getenv("AWS_PROFILE") == "" {
+			return credentials{}, false, nil
+		}
+		return credentials{}, false, fmt.Errorf("credentials: %s: no profile %q", path, profile)
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return credentials{}, false, fmt.Errorf("credentials: %s: profile %q lacks aws_access_key_id or aws_secret_access_key", path, profile)
+	}
+	return c, true, nil
+}
+
+// containerCredentials asks the ECS or EKS Pod Identity endpoint named by
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or _FULL_URI, if either is set.
+func containerCredentials(ctx context.Context, client *http.Client) (credentials, bool, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = containerURL + rel
+	}
+	if u == "" {
+		return credentials{}, false, nil
+	}
+	hdr := http.Header{}
+	if tok := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); tok != "" {
+		hdr.Set("Authorization", tok)
+	}
+	c, err := fetchCredentials(ctx, client, u, hdr)
+	if err != nil {
+		return credentials{}, false, fmt.Errorf("container credentials: %w", err)
+	}
+	return c, true, nil
+}
+
+// instanceCredentials asks IMDSv2 for the credentials of the instance's
+// role.
+func instanceCredentials(ctx context.Context, client *http.Client) (credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsURL+"/api/token", nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	token, err := fetch(client, req)
+	if err != nil {
+		return credentials{}, err
+	}
+	hdr := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	base := imdsURL + "/meta-data/iam/security-credentials/"
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, base, nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header = hdr
+	role, err := fetch(client, req)
+	if err != nil {
+		return credentials{}, err
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	return fetchCredentials(ctx, client, base+name, hdr)
+}
+
+// fetchCredentials GETs u and decodes the JSON credentials both the
+// container endpoint and IMDS answer with.
+func fetchCredentials(ctx context.Context, client *http.Client, u string, hdr http.Header) (credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	req.Header = hdr
+	body, err := fetch(client, req)
+	if err != nil {
+		return credentials{}, err
+	}
+	var c credentials
+	if err := json.Unmarshal(body, &c); err != nil {
+		return credentials{}, fmt.Errorf("%s: %w", u, err)
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return credentials{}, fmt.Errorf("%s: no AccessKeyId or SecretAccessKey", u)
+	}
+	return c, nil
+}
+
+// fetch sends req and returns the body of a 200 answer.
+func fetch(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s: %s", ErrStatus, req.URL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
@@ -0,0 +1,384 @@
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Entropy coding of zstd (RFC 8878): finite state entropy tables for the
+// sequence codes and Huffman weights, Huffman tables for literals, and the
+// bit streams both read.
+
+// backwardBits reads a zstd bit stream, which is written forwards and read
+// from its last byte back to its first, the highest bit of every byte
+// first. The last byte's highest set bit marks where the stream starts.
+// Reading past the start gives zeros and leaves n negative, which the
+// caller checks once a stream should be used up.
+type backwardBits struct {
+	b     []byte
+	off   int    // bytes of b not yet loaded, b[:off]
+	value uint64 // loaded bits, the next to read at bit n-1
+	n     int    // bits loaded and not read; negative past the start
+}
+
+func (r *backwardBits) init(b []byte) error {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return fmt.Errorf("%w: bit stream without an end mark", ErrCorruptZstd)
+	}
+	last := b[len(b)-1]
+	*r = backwardBits{b: b, off: len(b) - 1, value: uint64(last), n: bits.Len8(last) - 1}
+	r.fill()
+	return nil
+}
+
+// fill loads bytes until at least 57 bits are loaded or none are left.
+func (r *backwardBits) fill() {
+	for r.n <= 56 && r.off > 0 {
+		r.off--
+		r.value = r.value<<8 | uint64(r.b[r.off])
+		r.n += 8
+	}
+}
+
+// peek returns the next k bits, 0 < k <= 56, without reading them.
+func (r *backwardBits) peek(k int) uint64 {
+	if r.n >= k {
+		return r.value >> (r.n - k) & (1<<k - 1)
+	}
+	if r.n <= 0 {
+		return 0
+	}
+	return r.value << (k - r.n) & (1<<k - 1)
+}
+
+// read reads the next k bits, 0 <= k <= 31.
+func (r *backwardBits) read(k int) uint32 {
+	if k == 0 {
+		return 0
+	}
+	if r.n < k {
+		r.fill()
+	}
+	v := r.peek(k)
+	r.n -= k
+	return uint32(v)
+}
+
+// done reports whether the stream was read exactly to its start.
+func (r *backwardBits) done() bool {
+	return r.n == 0 && r.off == 0
+}
+
+// overflowed reports whether more bits were read than the stream holds.
+func (r *backwardBits) overflowed() bool {
+	return r.n < 0
+}
+
+// forwardBits reads the little-endian bit fields of an FSE table
+// description, lowest bit first.
+type forwardBits struct {
+	b   []byte
+	pos int // bits read
+}
+
+// peek returns the next k bits, k <= 32, zeros past the end.
+func (r *forwardBits) peek(k int) uint32 {
+	var word [8]byte
+	if i := r.pos / 8; i < len(r.b) {
+		copy(word[:], r.b[i:])
+	}
+	return uint32(binary.LittleEndian.Uint64(word[:])>>(r.pos%8)) & (1<<k - 1)
+}
+
+// fseEntry is one state of an FSE decoding table: the symbol it decodes
+// to, and the next state, newState plus the nbBits read after it.
+type fseEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	newState uint16
+}
+
+// fseTable is an FSE decoding table of 2^log states.
+type fseTable struct {
+	log   int
+	table []fseEntry
+}
+
+// readFSETable reads the FSE table description at the start of b, for
+// symbols up to maxSymbol and an accuracy log up to maxLog, and returns
+// the table and the bytes the description took.
+func readFSETable(b []byte, maxSymbol, maxLog int) (*fseTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, fmt.Errorf("%w: missing FSE table", ErrCorruptZstd)
+	}
+	r := forwardBits{b: b}
+	log := int(r.peek(4)) + 5
+	r.pos += 4
+	if log > maxLog {
+		return nil, 0, fmt.Errorf("%w: FSE accuracy log %d over %d", ErrCorruptZstd, log, maxLog)
+	}
+	var norm [256]int16
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	symbol := 0
+	prev0 := false
+	for remaining > 1 && symbol <= maxSymbol {
+		if prev0 {
+			// Runs of zero counts are given as 2-bit repeat fields, 3
+			// meaning three more zeros and another field
+			n := symbol
+			for r.peek(2) == 3 {
+				n += 3
+				r.pos += 2
+			}
+			n += int(r.peek(2))
+			r.pos += 2
+			if n > maxSymbol+1 {
+				return nil, 0, fmt.Errorf("%w: FSE zero run past the last symbol", ErrCorruptZstd)
+			}
+			symbol = n
+			if symbol > maxSymbol {
+				break
+			}
+		}
+		maxV := 2*threshold - 1 - remaining
+		var count int
+		if v := int(r.peek(nbBits - 1)); v < maxV {
+			count = v
+			r.pos += nbBits - 1
+		} else {
+			count = int(r.peek(nbBits)) & (2*threshold - 1)
+			if count >= threshold {
+				count -= maxV
+			}
+			r.pos += nbBits
+		}
+		count-- // -1 stands for a probability below 1
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		norm[symbol] = int16(count)
+		symbol++
+		prev0 = count == 0
+		for remaining < threshold && threshold > 1 {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	used := (r.pos + 7) / 8
+	if remaining != 1 || used > len(b) {
+		return nil, 0, fmt.Errorf("%w: FSE table description", ErrCorruptZstd)
+	}
+	t, err := buildFSETable(norm[:symbol], log)
+	return t, used, err
+}
+
+// buildFSETable spreads the normalized counts of the symbols over 2^log
+// states, the way an encoder does, and works out each state's successor.
+func buildFSETable(norm []int16, log int) (*fseTable, error) {
+	size := 1 << log
+	t := &fseTable{log: log, table: make([]fseEntry, size)}
+	next := make([]uint16, len(norm))
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			t.table[high].symbol = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = uint16(c)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for range max(c, 0) {
+			t.table[pos].symbol = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high { // skip the states of low-probability symbols
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, fmt.Errorf("%w: FSE counts do not fill the table", ErrCorruptZstd)
+	}
+	for i := range t.table {
+		e := &t.table[i]
+		n := next[e.symbol]
+		next[e.symbol]++
+		if n == 0 {
+			return nil, fmt.Errorf("%w: FSE table", ErrCorruptZstd)
+		}
+		e.nbBits = uint8(log + 1 - bits.Len16(n))
+		e.newState = n<<e.nbBits - uint16(size)
+	}
+	return t, nil
+}
+
+// rleTable returns the table of a single symbol, which reads no bits.
+func rleTable(symbol uint8) *fseTable {
+	return &fseTable{table: []fseEntry{{symbol: symbol}}}
+}
+
+// fseState is a position in an FSE table while decoding.
+type fseState struct {
+	t     *fseTable
+	state uint32
+}
+
+func (s *fseState) init(t *fseTable, r *backwardBits) {
+	s.t, s.state = t, r.read(t.log)
+}
+
+func (s *fseState) symbol() uint8 {
+	return s.t.table[s.state].symbol
+}
+
+func (s *fseState) update(r *backwardBits) {
+	e := s.t.table[s.state]
+	s.state = uint32(e.newState) + r.read(int(e.nbBits))
+}
+
+// maxHuffBits is the longest Huffman code in a zstd literals section.
+const maxHuffBits = 11
+
+// huffEntry is one slot of a Huffman decoding table: the symbol whose
+// code is a prefix of the slot's index, and the code's length.
+type huffEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// huffTable decodes Huffman codes of up to maxBits bits by looking the
+// next maxBits bits up.
+type huffTable struct {
+	maxBits int
+	table   []huffEntry
+}
+
+// readHuffTable reads the Huffman tree description at the start of b and
+// returns the table and the bytes the description took.
+func readHuffTable(b []byte) (*huffTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, fmt.Errorf("%w: missing Huffman tree", ErrCorruptZstd)
+	}
+	var weights [256]uint8
+	var n, used int
+	if hb := int(b[0]); hb < 128 {
+		// FSE-compressed weights, decoded with two interleaved states
+		if 1+hb > len(b) {
+			return nil, 0, fmt.Errorf("%w: Huffman weights past the block", ErrCorruptZstd)
+		}
+		data := b[1 : 1+hb]
+		t, k, err := readFSETable(data, 255, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		var r backwardBits
+		if err := r.init(data[k:]); err != nil {
+			return nil, 0, err
+		}
+		var s1, s2 fseState
+		s1.init(t, &r)
+		s2.init(t, &r)
+		for {
+			if n > 253 {
+				return nil, 0, fmt.Errorf("%w: too many Huffman weights", ErrCorruptZstd)
+			}
+			weights[n] = s1.symbol()
+			n++
+			s1.update(&r)
+			if r.overflowed() {
+				weights[n] = s2.symbol()
+				n++
+				break
+			}
+			weights[n] = s2.symbol()
+			n++
+			s2.update(&r)
+			if r.overflowed() {
+				weights[n] = s1.symbol()
+				n++
+				break
+			}
+		}
+		if n > 255 {
+			return nil, 0, fmt.Errorf("%w: too many Huffman weights", ErrCorruptZstd)
+		}
+		used = 1 + hb
+	} else {
+		// Weights as 4-bit fields, two to a byte
+		n = hb - 127
+		used = 1 + (n+1)/2
+		if used > len(b) {
+			return nil, 0, fmt.Errorf("%w: Huffman weights past the block", ErrCorruptZstd)
+		}
+		for i := range n {
+			weights[i] = b[1+i/2] >> (4 * (1 - i%2)) & 15
+		}
+	}
+
+	// The last symbol's weight is implied: whatever brings the total to
+	// the next power of two
+	var total uint32
+	for _, w := range weights[:n] {
+		if w > maxHuffBits {
+			return nil, 0, fmt.Errorf("%w: Huffman weight %d", ErrCorruptZstd, w)
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, fmt.Errorf("%w: Huffman weights all zero", ErrCorruptZstd)
+	}
+	maxBits := bits.Len32(total)
+	left := uint32(1)<<maxBits - total
+	if maxBits > maxHuffBits || left&(left-1) != 0 {
+		return nil, 0, fmt.Errorf("%w: Huffman weights do not sum to a power of two", ErrCorruptZstd)
+	}
+	weights[n] = uint8(bits.Len32(left))
+	n++
+
+	// Codes go out in order of weight, then of symbol, the longest first
+	h := &huffTable{maxBits: maxBits, table: make([]huffEntry, 1<<maxBits)}
+	pos := 0
+	for w := 1; w <= maxBits; w++ {
+		for s, sw := range weights[:n] {
+			if int(sw) != w {
+				continue
+			}
+			e := huffEntry{symbol: uint8(s), nbBits: uint8(maxBits + 1 - w)}
+			for i := range 1 << (w - 1) {
+				h.table[pos+i] = e
+			}
+			pos += 1 << (w - 1)
+		}
+	}
+	return h, used, nil
+}
+
+// decode fills out from the Huffman-coded stream b.
+func (h *huffTable) decode(out, b []byte) error {
+	var r backwardBits
+	if err := r.init(b); err != nil {
+		return err
+	}
+	for i := range out {
+		if r.n < h.maxBits {
+			r.fill()
+		}
+		e := h.table[r.peek(h.maxBits)]
+		out[i] = e.symbol
+		r.n -= int(e.nbBits)
+	}
+	if !r.done() {
+		return fmt.Errorf("%w: Huffman stream of %d bytes does not end with its literals", ErrCorruptZstd, len(b))
+	}
+	return nil
+}
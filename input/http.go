@@ -0,0 +1,341 @@
+// Package input opens remote inputs as streams for the engines that can
+// count a reader.
+package input
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+const (
+	DefaultTimeout = 30 * time.Second // wait for headers or the next body bytes
+	DefaultRetries = 5                // attempts in a row before giving up
+
+	maxBackoff = 10 * time.Second
+)
+
+var (
+	// ErrStatus is returned when the server answers with anything but
+	// 200 OK (or 206 to a resume).
+	ErrStatus = errors.New("unexpected HTTP status")
+	// ErrTruncated is returned when the body ends early and cannot be
+	// resumed, so a count never silently covers part of the input.
+	ErrTruncated = errors.New("input truncated")
+)
+
+// HTTPOptions configures OpenURL.
+type HTTPOptions struct {
+	// Timeout bounds the wait for response headers and for each read of
+	// the body, 0 for DefaultTimeout. A stalled body is resumed like a
+	// dropped connection.
+	Timeout time.Duration
+	// Retries is how many times in a row a failed request or broken body
+	// is retried, 0 for DefaultRetries and <0 for none.
+	Retries int
+	// Client sends the requests, nil for a client without overall timeout.
+	Client *http.Client
+	// Logger receives a warning before each retry, nil for slog.Default().
+	Logger *slog.Logger
+}
+
+// IsURL reports whether name is an http:// or https:// URL rather than
+// a file path.
+func IsURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// HTTPStream is the body of a GET, decompressed when the server sent it
+// gzip-encoded. When the connection breaks or stalls mid-body, the stream
+// asks for the rest with a Range request from the last byte it received
+// (of the encoded body, so the decompressor carries on undisturbed) and
+// returns ErrTruncated once the retries are used up.
+type HTTPStream struct {
+	body *rangeReader
+	r    io.Reader
+	size int64
+}
+
+// OpenURL sends a GET for url and returns its body as a stream. Non-200
+// answers fail with ErrStatus; 429 and 5xx answers are retried first.
+func OpenURL(ctx context.Context, url string, o HTTPOptions) (*HTTPStream, error) {
+	return open(&rangeReader{ctx: ctx, name: url, url: url, opts: o.withDefaults()})
+}
+
+// withDefaults fills in the zero fields of o.
+func (o HTTPOptions) withDefaults() HTTPOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	switch {
+	case o.Retries == 0:
+		o.Retries = DefaultRetries
+	case o.Retries < 0:
+		o.Retries = 0
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: o.Timeout,
+			ForceAttemptHTTP2:     true,
+		}}
+	}
+	return o
+}
+
+// open sends the first request of rr and wraps its body in a stream.
+func open(rr *rangeReader) (*HTTPStream, error) {
+	if err := rr.connect(); err != nil {
+		return nil, err
+	}
+	s := &HTTPStream{body: rr, r: rr, size: rr.resp.ContentLength}
+	switch enc := rr.resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(rr)
+		if err != nil {
+			rr.Close()
+			return nil, fmt.Errorf("%s: gzip body: %w", rr.name, err)
+		}
+		s.r, s.size = zr, -1
+	default:
+		rr.Close()
+		return nil, fmt.Errorf("%s: unsupported Content-Encoding %q", rr.name, enc)
+	}
+	return s, nil
+}
+
+// Read reads the decoded body.
+func (s *HTTPStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: %s: %v", ErrTruncated, s.body.name, err)
+	}
+	return n, err
+}
+
+// Size returns the length of the decoded body, or -1 when the server did
+// not say or sent it compressed.
+func (s *HTTPStream) Size() int64 {
+	return s.size
+}
+
+// Close releases the connection.
+func (s *HTTPStream) Close() error {
+	return s.body.Close()
+}
+
+// rangeReader reads the raw body of url, reconnecting with a Range
+// request after a transient failure.
+type rangeReader struct {
+	ctx  context.Context
+	name string // for messages, such as the s3:// form of url
+	url  string
+	opts HTTPOptions
+	// sign, if set, authorizes each request once its headers are final.
+	sign func(*http.Request) error
+	// statusError, if set, describes an answer that is neither 200 nor
+	// the expected 206; it may read the body.
+	statusError func(*http.Response) error
+
+	resp      *http.Response
+	cancel    context.CancelFunc // aborts the current request
+	stall     *time.Timer        // fires cancel when a read takes too long
+	validator string             // ETag or Last-Modified the resume must match
+	offset    int64              // raw body bytes returned so far
+	retries   int                // retries since the last byte received
+}
+
+// connect sends the GET, resuming at r.offset after the first response,
+// and retries transient failures.
+func (r *rangeReader) connect() error {
+	for {
+		err := r.get()
+		if err == nil {
+			return nil
+		}
+		if !r.retryable(err) {
+			return err
+		}
+		if err := r.backoff(err); err != nil {
+			return err
+		}
+	}
+}
+
+// get sends one request and checks its status.
+func (r *rangeReader) get() error {
+	ctx, cancel := context.WithCancel(r.ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("%s: %w", r.name, err)
+	}
+	// Asking for gzip ourselves keeps the transport from decoding it, so
+	// offsets stay in the encoded body a resume has to address
+	req.Header.Set("Accept-Encoding", "gzip")
+	resuming := r.resp != nil
+	if resuming {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(r.offset, 10)+"-")
+		if r.validator != "" {
+			req.Header.Set("If-Range", r.validator)
+		}
+	}
+	if r.sign != nil {
+		if err := r.sign(req); err != nil {
+			cancel()
+			return err
+		}
+	}
+	resp, err := r.opts.Client.Do(req)
+	if err != nil {
+		cancel()
+		return &transientError{err}
+	}
+
+	switch {
+	case !resuming && resp.StatusCode == http.StatusOK:
+		r.validator = validator(resp)
+	case resuming && resp.StatusCode == http.StatusPartialContent:
+		if start, ok := rangeStart(resp.Header.Get("Content-Range")); !ok || start != r.offset {
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("%w: %s: resume at byte %d got Content-Range %q",
+				ErrTruncated, r.name, r.offset, resp.Header.Get("Content-Range"))
+		}
+	case resuming && resp.StatusCode == http.StatusOK:
+		// The server ignored the range or the object changed since
+		resp.Body.Close()
+		cancel()
+		return fmt.Errorf("%w: %s: server cannot resume at byte %d", ErrTruncated, r.name, r.offset)
+	default:
+		err := fmt.Errorf("%w: %s: %s", ErrStatus, r.name, resp.Status)
+		if r.statusError != nil {
+			err = r.statusError(resp)
+		}
+		resp.Body.Close()
+		cancel()
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return &transientError{err}
+		}
+		return err
+	}
+	if r.resp != nil {
+		r.resp.Body.Close()
+		r.cancel()
+	}
+	r.resp, r.cancel = resp, cancel
+	return nil
+}
+
+// Read reads the raw body, resuming it after a broken connection.
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.stall == nil {
+			r.stall = time.AfterFunc(r.opts.Timeout, r.cancel)
+		} else {
+			r.stall.Reset(r.opts.Timeout)
+		}
+		n, err := r.resp.Body.Read(p)
+		stalled := !r.stall.Stop()
+		r.offset += int64(n)
+		if n > 0 {
+			r.retries = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if r.ctx.Err() != nil {
+			return n, r.ctx.Err()
+		}
+		if stalled {
+			err = fmt.Errorf("no data for %s", r.opts.Timeout)
+		}
+		if r.retries >= r.opts.Retries {
+			return n, fmt.Errorf("%w: %s after %d bytes: %v", ErrTruncated, r.name, r.offset, err)
+		}
+		if err := r.backoff(err); err != nil {
+			return n, err
+		}
+		r.stall = nil
+		if err := r.connect(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retryable reports whether err may go away on another attempt and
+// attempts remain.
+func (r *rangeReader) retryable(err error) bool {
+	var te *transientError
+	return errors.As(err, &te) && r.retries < r.opts.Retries && r.ctx.Err() == nil
+}
+
+// backoff waits before the next attempt, doubling the delay each time.
+func (r *rangeReader) backoff(cause error) error {
+	delay := min(500*time.Millisecond<<r.retries, maxBackoff)
+	r.retries++
+	counter.Logger(r.opts.Logger).Warn("request failed; retrying", "url", r.name, "err", cause, "delay", delay,
+		"attempt", r.retries, "max", r.opts.Retries)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// Close releases the current response.
+func (r *rangeReader) Close() error {
+	if r.stall != nil {
+		r.stall.Stop()
+	}
+	err := r.resp.Body.Close()
+	r.cancel()
+	return err
+}
+
+// transientError marks a failure worth retrying.
+type transientError struct{ err error }
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// validator returns the header a resume sends as If-Range so a changed
+// object is not stitched onto the old one: a strong ETag, else
+// Last-Modified.
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// rangeStart parses the first byte position of a "bytes a-b/n"
+// Content-Range.
+func rangeStart(s string) (int64, bool) {
+	s, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	s, _, ok = strings.Cut(s, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,148 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// readURL opens url with o and reads the whole stream.
+func readURL(url string, o HTTPOptions) ([]byte, error) {
+	o.Logger = quiet
+	s, err := OpenURL(context.Background(), url, o)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return io.ReadAll(s)
+}
+
+// A body comes back as sent, and gunzipped when the server sent it
+// gzip-encoded, with its size known only in the first case.
+func TestOpenURL(t *testing.T) {
+	text := testText()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(text)
+	zw.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gz" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gz.Bytes())
+			return
+		}
+		http.ServeContent(w, r, "in.txt", time.Time{}, bytes.NewReader(text))
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/plain", "/gz"} {
+		s, err := OpenURL(context.Background(), srv.URL+path, HTTPOptions{Logger: quiet})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(s)
+		s.Close()
+		if err != nil || !bytes.Equal(got, text) {
+			t.Errorf("%s: %d bytes, %v; want %d", path, len(got), err, len(text))
+		}
+		if want := map[string]int64{"/plain": int64(len(text)), "/gz": -1}[path]; s.Size() != want {
+			t.Errorf("%s: size %d, want %d", path, s.Size(), want)
+		}
+	}
+}
+
+// An answer other than 200 fails with ErrStatus, a 404 at once and a
+// lasting 503 once the retries are spent; a 503 that clears up is
+// retried past.
+func TestOpenURLStatus(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/down":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		case "/flaky":
+			if n%2 == 1 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			io.WriteString(w, "10.0.0.1\n")
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := readURL(srv.URL+"/missing", HTTPOptions{}); !errors.Is(err, ErrStatus) || calls.Load() != 1 {
+		t.Errorf("404: %v after %d requests", err, calls.Load())
+	}
+	calls.Store(0)
+	if _, err := readURL(srv.URL+"/down", HTTPOptions{Retries: 1}); !errors.Is(err, ErrStatus) || calls.Load() != 2 {
+		t.Errorf("503: %v after %d requests, want 2", err, calls.Load())
+	}
+	calls.Store(0)
+	if got, err := readURL(srv.URL+"/flaky", HTTPOptions{Retries: 1}); err != nil || string(got) != "10.0.0.1\n" {
+		t.Errorf("503 then 200: %q, %v", got, err)
+	}
+}
+
+// A body cut short is resumed with a Range request from the last byte
+// received when the server honours it, and fails with ErrTruncated, never
+// a clean EOF, when the server cannot resume or the retries run out.
+func TestOpenURLTruncated(t *testing.T) {
+	text := testText()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := calls.Add(1) == 1
+		if first || r.URL.Path == "/always" {
+			// Promise the whole body, send a third of it and drop the
+			// connection
+			w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(text[:len(text)/3])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if r.URL.Path == "/norange" {
+			w.Write(text)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "in.txt", time.Time{}, bytes.NewReader(text))
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path    string
+		retries int
+		resumed bool
+	}{
+		{"/resume", 1, true},
+		{"/norange", 1, false},
+		{"/always", 2, false},
+		{"/resume", -1, false},
+	} {
+		calls.Store(0)
+		got, err := readURL(srv.URL+tc.path, HTTPOptions{Retries: tc.retries})
+		if tc.resumed {
+			if err != nil || !bytes.Equal(got, text) {
+				t.Errorf("%s: %d bytes, %v; want all %d", tc.path, len(got), err, len(text))
+			}
+			continue
+		}
+		if !errors.Is(err, ErrTruncated) || len(got) >= len(text) {
+			t.Errorf("%s, %d retries: %d bytes, %v; want ErrTruncated", tc.path, tc.retries, len(got), err)
+		}
+	}
+}
@@ -0,0 +1,735 @@
+package input
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrBadParquet is returned for a file that is not Parquet, or whose
+// footer or pages are corrupt.
+var ErrBadParquet = errors.New("not a readable Parquet file")
+
+// Parquet physical types, compression codecs, encodings and page types,
+// from parquet.thrift.
+const (
+	pqInt32     = 1
+	pqInt64     = 2
+	pqByteArray = 6
+
+	pqRequired = 0
+	pqRepeated = 2
+
+	pqUncompressed = 0
+	pqSnappy       = 1
+	pqGzip         = 2
+
+	pqPlain          = 0
+	pqPlainDict      = 2
+	pqRLE            = 3
+	pqBitPacked      = 4
+	pqRLEDict        = 8
+	pqDataPage       = 0
+	pqIndexPage      = 1
+	pqDictionaryPage = 2
+	pqDataPageV2     = 3
+
+	parquetMagic = "PAR1"
+
+	// maxParquetChunk bounds a column chunk, which is read whole; larger
+	// sizes mean a corrupt footer.
+	maxParquetChunk = 1 << 31
+)
+
+var (
+	parquetTypes     = []string{"BOOLEAN", "INT32", "INT64", "INT96", "FLOAT", "DOUBLE", "BYTE_ARRAY", "FIXED_LEN_BYTE_ARRAY"}
+	parquetCodecs    = []string{"UNCOMPRESSED", "SNAPPY", "GZIP", "LZO", "BROTLI", "LZ4", "ZSTD", "LZ4_RAW"}
+	parquetEncodings = []string{"PLAIN", "GROUP_VAR_INT", "PLAIN_DICTIONARY", "RLE", "BIT_PACKED",
+		"DELTA_BINARY_PACKED", "DELTA_LENGTH_BYTE_ARRAY", "DELTA_BYTE_ARRAY", "RLE_DICTIONARY", "BYTE_STREAM_SPLIT"}
+)
+
+func pqName(names []string, v int32) string {
+	if v >= 0 && int(v) < len(names) {
+		return names[v]
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+// ParquetStats is what the row groups of a ParquetFile have decoded so
+// far.
+type ParquetStats struct {
+	RowGroups int
+	Values    int64 // addresses read
+	Nulls     int64 // null values, skipped
+	Malformed int64 // strings that do not parse and integers past 32 bits, skipped
+}
+
+// ParquetFile is an open Parquet file and one column of it, which holds
+// addresses as strings (BYTE_ARRAY), as INT32 read as unsigned, or as
+// INT64 up to 2^32-1. Each row group is read on its own, so several can
+// be decoded at once; only the chosen column's pages are read.
+type ParquetFile struct {
+	r      io.ReaderAt
+	typ    int32
+	maxDef int
+	chunks []parquetChunk
+	parse  func([]byte) (uint32, error)
+
+	values, nulls, malformed atomic.Int64
+}
+
+// parquetChunk is the column's chunk in one row group.
+type parquetChunk struct {
+	start, size int64 // the dictionary page, if any, and the data pages
+	codec       int32
+	values      int64 // values, nulls included
+}
+
+// parquetColumn is a leaf of the schema.
+type parquetColumn struct {
+	path     string // names from the root, joined by dots
+	typ      int32
+	maxDef   int
+	repeated bool
+}
+
+// OpenParquet reads the footer of the Parquet file r of size bytes and
+// finds column, a top-level name or a dotted path into nested groups.
+// parse turns a string value into an address. A missing column, an
+// unsupported type, codec or encoding and a repeated column are errors
+// here, before any page is read.
+func OpenParquet(r io.ReaderAt, size int64, column string, parse func([]byte) (uint32, error)) (*ParquetFile, error) {
+	if size < 12 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrBadParquet, size)
+	}
+	var head, tail [8]byte
+	if _, err := r.ReadAt(head[:4], 0); err != nil {
+		return nil, err
+	}
+	if _, err := r.ReadAt(tail[:], size-8); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(head[:4]) != parquetMagic || string(tail[4:]) != parquetMagic {
+		return nil, fmt.Errorf("%w: no PAR1 magic", ErrBadParquet)
+	}
+	n := int64(binary.LittleEndian.Uint32(tail[:4]))
+	if n > size-12 {
+		return nil, fmt.Errorf("%w: footer of %d bytes in a %d-byte file", ErrBadParquet, n, size)
+	}
+	meta := make([]byte, n)
+	if _, err := r.ReadAt(meta, size-8-n); err != nil && err != io.EOF {
+		return nil, err
+	}
+	cols, groups, err := parseParquetFooter(meta)
+	if err != nil {
+		return nil, fmt.Errorf("%w: footer: %v", ErrBadParquet, err)
+	}
+
+	i := slices.IndexFunc(cols, func(c parquetColumn) bool { return c.path == column })
+	if i < 0 {
+		names := make([]string, len(cols))
+		for j, c := range cols {
+			names[j] = c.path
+		}
+		return nil, fmt.Errorf("no column %q; the file has %s", column, strings.Join(names, ", "))
+	}
+	col := cols[i]
+	switch {
+	case col.repeated:
+		return nil, fmt.Errorf("column %q is repeated; only one value per row is supported", column)
+	case col.typ != pqByteArray && col.typ != pqInt32 && col.typ != pqInt64:
+		return nil, fmt.Errorf("column %q has physical type %s; addresses must be BYTE_ARRAY strings, INT32 or INT64",
+			column, pqName(parquetTypes, col.typ))
+	}
+	f := &ParquetFile{r: r, typ: col.typ, maxDef: col.maxDef, parse: parse}
+	for _, g := range groups {
+		c, ok := g[column]
+		if !ok {
+			return nil, fmt.Errorf("%w: a row group has no chunk for column %q", ErrBadParquet, column)
+		}
+		if c.err != nil {
+			return nil, fmt.Errorf("column %q: %w", column, c.err)
+		}
+		if c.start < 4 || c.size < 0 || c.size > maxParquetChunk || c.start+c.size > size-8-n {
+			return nil, fmt.Errorf("%w: column chunk at %d of %d bytes is outside the data", ErrBadParquet, c.start, c.size)
+		}
+		f.chunks = append(f.chunks, c.parquetChunk)
+	}
+	return f, nil
+}
+
+// footerChunk is a column chunk as the footer describes it, with why it
+// cannot be read, if so.
+type footerChunk struct {
+	parquetChunk
+	err error
+}
+
+// parseParquetFooter decodes the FileMetaData: the schema's leaf columns
+// and, per row group, the chunk of each column by path.
+func parseParquetFooter(meta []byte) ([]parquetColumn, []map[string]footerChunk, error) {
+	type element struct {
+		name     string
+		typ      int32
+		hasType  bool
+		rep      int32
+		children int32
+	}
+	var schema []element
+	var groups []map[string]footerChunk
+	t := &thriftReader{b: meta}
+	err := t.structFields(func(id int16, typ byte) error {
+		switch {
+		case id == 2 && typ == thriftList:
+			return t.structList(func() error {
+				var e element
+				err := t.structFields(func(id int16, typ byte) error {
+					var err error
+					switch {
+					case id == 1 && typ == thriftI32:
+						e.typ, err = t.i32()
+						e.hasType = true
+					case id == 3 && typ == thriftI32:
+						e.rep, err = t.i32()
+					case id == 4 && typ == thriftBinary:
+						var b []byte
+						b, err = t.binary()
+						e.name = string(b)
+					case id == 5 && typ == thriftI32:
+						e.children, err = t.i32()
+					default:
+						err = t.skip(typ)
+					}
+					return err
+				})
+				schema = append(schema, e)
+				return err
+			})
+		case id == 4 && typ == thriftList:
+			return t.structList(func() error {
+				g, err := t.rowGroup()
+				groups = append(groups, g)
+				return err
+			})
+		}
+		return t.skip(typ)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(schema) == 0 {
+		return nil, nil, errors.New("empty schema")
+	}
+
+	// The schema is the tree flattened depth first, the root first
+	var cols []parquetColumn
+	next := 1
+	var walk func(n int32, prefix string, maxDef int, repeated bool) error
+	walk = func(n int32, prefix string, maxDef int, repeated bool) error {
+		for range n {
+			if next >= len(schema) {
+				return errors.New("schema ends inside a group")
+			}
+			e := schema[next]
+			next++
+			path, def, rep := e.name, maxDef, repeated || e.rep == pqRepeated
+			if prefix != "" {
+				path = prefix + "." + e.name
+			}
+			if e.rep != pqRequired {
+				def++
+			}
+			if e.children > 0 || !e.hasType {
+				if err := walk(e.children, path, def, rep); err != nil {
+					return err
+				}
+				continue
+			}
+			cols = append(cols, parquetColumn{path: path, typ: e.typ, maxDef: def, repeated: rep})
+		}
+		return nil
+	}
+	return cols, groups, walk(schema[0].children, "", 0, false)
+}
+
+// structList calls elem for each element of a list of structs.
+func (t *thriftReader) structList(elem func() error) error {
+	et, n, err := t.list()
+	if err != nil {
+		return err
+	}
+	if et != thriftStruct {
+		return fmt.Errorf("thrift: list of type %d, want structs", et)
+	}
+	for range n {
+		if err := elem(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowGroup decodes a RowGroup's column chunks, keyed by path.
+func (t *thriftReader) rowGroup() (map[string]footerChunk, error) {
+	chunks := make(map[string]footerChunk)
+	err := t.structFields(func(id int16, typ byte) error {
+		if id != 1 || typ != thriftList {
+			return t.skip(typ)
+		}
+		return t.structList(func() error {
+			var c footerChunk
+			var path string
+			var external bool
+			err := t.structFields(func(id int16, typ byte) error {
+				switch {
+				case id == 1 && typ == thriftBinary:
+					p, err := t.binary()
+					external = len(p) > 0
+					return err
+				case id == 3 && typ == thriftStruct:
+					var err error
+					path, err = t.columnMeta(&c)
+					return err
+				}
+				return t.skip(typ)
+			})
+			if external {
+				c.err = errors.New("the column chunk is in another file")
+			}
+			chunks[path] = c
+			return err
+		})
+	})
+	return chunks, err
+}
+
+// columnMeta decodes a ColumnMetaData into c and returns its path.
+func (t *thriftReader) columnMeta(c *footerChunk) (string, error) {
+	var path []string
+	var data, dict int64
+	err := t.structFields(func(id int16, typ byte) error {
+		var err error
+		switch {
+		case id == 2 && typ == thriftList: // encodings
+			var et byte
+			var n int
+			if et, n, err = t.list(); err != nil || et != thriftI32 {
+				return listTypeErr(err, et)
+			}
+			for range n {
+				e, err := t.i32()
+				if err != nil {
+					return err
+				}
+				switch e {
+				case pqPlain, pqPlainDict, pqRLE, pqBitPacked, pqRLEDict:
+				default:
+					c.err = fmt.Errorf("unsupported encoding %s; PLAIN and dictionary encodings are", pqName(parquetEncodings, e))
+				}
+			}
+		case id == 3 && typ == thriftList: // path_in_schema
+			var et byte
+			var n int
+			if et, n, err = t.list(); err != nil || et != thriftBinary {
+				return listTypeErr(err, et)
+			}
+			for range n {
+				p, err := t.binary()
+				if err != nil {
+					return err
+				}
+				path = append(path, string(p))
+			}
+		case id == 4 && typ == thriftI32:
+			c.codec, err = t.i32()
+			if c.codec != pqUncompressed && c.codec != pqSnappy && c.codec != pqGzip && c.err == nil {
+				c.err = fmt.Errorf("unsupported compression %s; UNCOMPRESSED, SNAPPY and GZIP are", pqName(parquetCodecs, c.codec))
+			}
+		case id == 5 && typ == thriftI64:
+			c.values, err = t.varint()
+		case id == 7 && typ == thriftI64:
+			c.size, err = t.varint()
+		case id == 9 && typ == thriftI64:
+			data, err = t.varint()
+		case id == 11 && typ == thriftI64:
+			dict, err = t.varint()
+		default:
+			err = t.skip(typ)
+		}
+		return err
+	})
+	c.start = data
+	if dict > 0 && dict < data {
+		c.start = dict
+	}
+	return strings.Join(path, "."), err
+}
+
+func listTypeErr(err error, et byte) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("thrift: list of type %d", et)
+}
+
+// RowGroups returns the number of row groups.
+func (f *ParquetFile) RowGroups() int {
+	return len(f.chunks)
+}
+
+// RowGroupSize returns the bytes RowGroup(i) yields, 4 per value, nulls
+// included.
+func (f *ParquetFile) RowGroupSize(i int) int64 {
+	return 4 * f.chunks[i].values
+}
+
+// RowGroup returns the addresses of row group i as packed big-endian
+// uint32s, ready for a binary-be counter. Its column chunk is read when
+// the first address is.
+func (f *ParquetFile) RowGroup(i int) io.Reader {
+	return &parquetRowGroup{f: f, chunk: f.chunks[i]}
+}
+
+// Stats returns what the row groups have decoded so far.
+func (f *ParquetFile) Stats() ParquetStats {
+	return ParquetStats{RowGroups: len(f.chunks), Values: f.values.Load(), Nulls: f.nulls.Load(), Malformed: f.malformed.Load()}
+}
+
+// parquetRowGroup decodes the pages of one column chunk.
+type parquetRowGroup struct {
+	f     *ParquetFile
+	chunk parquetChunk
+	data  []byte // the column chunk, nil until the first Read
+	pos   int
+	read  int64 // values decoded, nulls included
+	dict  []uint32
+	bad   []bool // dictionary entries that are not addresses
+	out   []byte
+	buf   []byte // decompressed page
+	err   error
+}
+
+func (g *parquetRowGroup) Read(p []byte) (int, error) {
+	for len(g.out) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+		if g.read >= g.chunk.values {
+			return 0, io.EOF
+		}
+		g.out = g.out[:0]
+		g.err = g.nextPage()
+	}
+	n := copy(p, g.out)
+	g.out = g.out[n:]
+	return n, nil
+}
+
+// pageHeader is the part of a PageHeader the decoder uses.
+type pageHeader struct {
+	typ          int32
+	uncompressed int32
+	compressed   int32
+	values       int32 // data and dictionary pages
+	encoding     int32
+	defEncoding  int32 // data page v1
+	defLen       int32 // data page v2
+	repLen       int32 // data page v2
+	v2Compressed bool
+}
+
+func (t *thriftReader) pageHeader() (pageHeader, error) {
+	h := pageHeader{v2Compressed: true, defEncoding: pqRLE}
+	err := t.structFields(func(id int16, typ byte) error {
+		var err error
+		switch {
+		case id == 1 && typ == thriftI32:
+			h.typ, err = t.i32()
+		case id == 2 && typ == thriftI32:
+			h.uncompressed, err = t.i32()
+		case id == 3 && typ == thriftI32:
+			h.compressed, err = t.i32()
+		case (id == 5 || id == 7 || id == 8) && typ == thriftStruct:
+			// Data, dictionary and data v2 headers share num_values
+			// and number their encoding apart
+			err = t.structFields(func(sid int16, typ byte) error {
+				var err error
+				switch {
+				case sid == 1 && typ == thriftI32:
+					h.values, err = t.i32()
+				case sid == 2 && typ == thriftI32 && id != 8, sid == 4 && typ == thriftI32 && id == 8:
+					h.encoding, err = t.i32()
+				case sid == 3 && typ == thriftI32 && id == 5:
+					h.defEncoding, err = t.i32()
+				case sid == 5 && typ == thriftI32 && id == 8:
+					h.defLen, err = t.i32()
+				case sid == 6 && typ == thriftI32 && id == 8:
+					h.repLen, err = t.i32()
+				case sid == 7 && id == 8 && (typ == thriftTrue || typ == thriftFalse):
+					h.v2Compressed = typ == thriftTrue
+				default:
+					err = t.skip(typ)
+				}
+				return err
+			})
+		default:
+			err = t.skip(typ)
+		}
+		return err
+	})
+	return h, err
+}
+
+// nextPage decodes the next page of the chunk into g.out or g.dict.
+func (g *parquetRowGroup) nextPage() error {
+	if g.data == nil {
+		g.data = make([]byte, g.chunk.size)
+		if _, err := g.f.r.ReadAt(g.data, g.chunk.start); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	if g.pos >= len(g.data) {
+		return fmt.Errorf("%w: column chunk ends after %d of %d values", ErrBadParquet, g.read, g.chunk.values)
+	}
+	t := &thriftReader{b: g.data[g.pos:]}
+	h, err := t.pageHeader()
+	if err != nil {
+		return fmt.Errorf("%w: page header: %v", ErrBadParquet, err)
+	}
+	g.pos += t.pos
+	if h.compressed < 0 || int(h.compressed) > len(g.data)-g.pos || h.uncompressed < 0 || h.values < 0 {
+		return fmt.Errorf("%w: page of %d bytes past the column chunk", ErrBadParquet, h.compressed)
+	}
+	page := g.data[g.pos : g.pos+int(h.compressed)]
+	g.pos += int(h.compressed)
+
+	switch h.typ {
+	case pqDictionaryPage:
+		body, err := g.decompress(page, int(h.uncompressed))
+		if err != nil {
+			return err
+		}
+		if h.encoding != pqPlain && h.encoding != pqPlainDict {
+			return fmt.Errorf("unsupported dictionary encoding %s", pqName(parquetEncodings, h.encoding))
+		}
+		g.dict, g.bad = g.dict[:0], g.bad[:0]
+		return g.plain(body, int(h.values), func(ip uint32, ok bool) {
+			g.dict = append(g.dict, ip)
+			g.bad = append(g.bad, !ok)
+		})
+	case pqDataPage:
+		body, err := g.decompress(page, int(h.uncompressed))
+		if err != nil {
+			return err
+		}
+		var defs []byte
+		if g.f.maxDef > 0 {
+			if h.defEncoding != pqRLE {
+				return fmt.Errorf("unsupported definition level encoding %s", pqName(parquetEncodings, h.defEncoding))
+			}
+			if len(body) < 4 {
+				return fmt.Errorf("%w: short definition levels", ErrBadParquet)
+			}
+			n := binary.LittleEndian.Uint32(body)
+			if uint64(n) > uint64(len(body)-4) {
+				return fmt.Errorf("%w: definition levels past the page", ErrBadParquet)
+			}
+			defs, body = body[4:4+n], body[4+n:]
+		}
+		return g.values(body, defs, int(h.values), h.encoding)
+	case pqDataPageV2:
+		levels := int64(h.repLen) + int64(h.defLen)
+		if h.repLen < 0 || h.defLen < 0 || levels > int64(len(page)) {
+			return fmt.Errorf("%w: levels past the page", ErrBadParquet)
+		}
+		defs, body := page[h.repLen:levels], page[levels:]
+		if h.v2Compressed {
+			if body, err = g.decompress(body, int(int64(h.uncompressed)-levels)); err != nil {
+				return err
+			}
+		}
+		return g.values(body, defs, int(h.values), h.encoding)
+	case pqIndexPage:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown page type %d", ErrBadParquet, h.typ)
+}
+
+// decompress returns page decoded with the chunk's codec, n bytes long.
+func (g *parquetRowGroup) decompress(page []byte, n int) ([]byte, error) {
+	var out []byte
+	var err error
+	switch g.chunk.codec {
+	case pqUncompressed:
+		return page, nil
+	case pqSnappy:
+		out, err = DecodeSnappy(g.buf, page)
+	case pqGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(page)); err == nil {
+			out = slices.Grow(g.buf[:0], n)[:n]
+			_, err = io.ReadFull(zr, out)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", pqName(parquetCodecs, g.chunk.codec))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s page: %v", ErrBadParquet, pqName(parquetCodecs, g.chunk.codec), err)
+	}
+	if len(out) != n {
+		return nil, fmt.Errorf("%w: page decompressed to %d bytes, want %d", ErrBadParquet, len(out), n)
+	}
+	g.buf = out
+	return out, nil
+}
+
+// values decodes a data page of n values, nulls included, whose
+// definition levels are defs (nil for a required column) and whose
+// non-null values are body, and appends the addresses to g.out.
+func (g *parquetRowGroup) values(body, defs []byte, n int, encoding int32) error {
+	present := n
+	if g.f.maxDef > 0 {
+		present = 0
+		full := uint32(g.f.maxDef)
+		err := rleHybrid(defs, bits.Len(uint(g.f.maxDef)), n, func(level uint32) {
+			if level == full {
+				present++
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var values, malformed int64
+	emit := func(ip uint32, ok bool) {
+		if !ok {
+			malformed++
+			return
+		}
+		values++
+		g.out = binary.BigEndian.AppendUint32(g.out, ip)
+	}
+	var err error
+	switch encoding {
+	case pqPlain:
+		err = g.plain(body, present, emit)
+	case pqPlainDict, pqRLEDict:
+		if len(body) < 1 {
+			return fmt.Errorf("%w: empty dictionary indices", ErrBadParquet)
+		}
+		var bad error
+		err = rleHybrid(body[1:], int(body[0]), present, func(i uint32) {
+			if int64(i) >= int64(len(g.dict)) {
+				bad = fmt.Errorf("%w: dictionary index %d of %d entries", ErrBadParquet, i, len(g.dict))
+				return
+			}
+			emit(g.dict[i], !g.bad[i])
+		})
+		err = cmp.Or(err, bad)
+	default:
+		return fmt.Errorf("unsupported encoding %s; PLAIN and dictionary encodings are", pqName(parquetEncodings, encoding))
+	}
+	if err != nil {
+		return err
+	}
+	g.read += int64(n)
+	g.f.values.Add(values)
+	g.f.malformed.Add(malformed)
+	g.f.nulls.Add(int64(n - present))
+	return nil
+}
+
+// plain decodes n PLAIN values of the column's type, calling emit with
+// each address and whether it is one.
+func (g *parquetRowGroup) plain(b []byte, n int, emit func(ip uint32, ok bool)) error {
+	switch g.f.typ {
+	case pqInt32:
+		if len(b) < 4*n {
+			return fmt.Errorf("%w: %d INT32 values in %d bytes", ErrBadParquet, n, len(b))
+		}
+		for i := range n {
+			emit(binary.LittleEndian.Uint32(b[4*i:]), true)
+		}
+	case pqInt64:
+		if len(b) < 8*n {
+			return fmt.Errorf("%w: %d INT64 values in %d bytes", ErrBadParquet, n, len(b))
+		}
+		for i := range n {
+			v := binary.LittleEndian.Uint64(b[8*i:])
+			emit(uint32(v), v <= math.MaxUint32)
+		}
+	default:
+		for range n {
+			if len(b) < 4 {
+				return fmt.Errorf("%w: BYTE_ARRAY values past the page", ErrBadParquet)
+			}
+			l := binary.LittleEndian.Uint32(b)
+			if uint64(l) > uint64(len(b)-4) {
+				return fmt.Errorf("%w: BYTE_ARRAY value past the page", ErrBadParquet)
+			}
+			ip, err := g.f.parse(bytes.TrimSpace(b[4 : 4+l]))
+			emit(ip, err == nil)
+			b = b[4+l:]
+		}
+	}
+	return nil
+}
+
+// rleHybrid decodes n values of width bits from Parquet's RLE/bit-packed
+// hybrid encoding, without its length prefix.
+func rleHybrid(b []byte, width, n int, fn func(uint32)) error {
+	if width > 32 {
+		return fmt.Errorf("%w: %d-bit levels or indices", ErrBadParquet, width)
+	}
+	bytesPer := (width + 7) / 8
+	for n > 0 {
+		h, k := binary.Uvarint(b)
+		if k <= 0 {
+			return fmt.Errorf("%w: RLE data ends %d values short", ErrBadParquet, n)
+		}
+		b = b[k:]
+		if h&1 == 0 { // run of one value
+			count := h >> 1
+			if len(b) < bytesPer {
+				return fmt.Errorf("%w: short RLE run", ErrBadParquet)
+			}
+			var v uint32
+			for i := bytesPer - 1; i >= 0; i-- {
+				v = v<<8 | uint32(b[i])
+			}
+			b = b[bytesPer:]
+			for ; count > 0 && n > 0; count-- {
+				fn(v)
+				n--
+			}
+			continue
+		}
+		// Groups of 8 values packed least significant bit first
+		groups := h >> 1
+		if groups > uint64(len(b)) || groups*uint64(width) > uint64(len(b)) {
+			return fmt.Errorf("%w: short bit-packed run", ErrBadParquet)
+		}
+		packed := b[:groups*uint64(width)]
+		b = b[len(packed):]
+		mask := uint64(1)<<width - 1
+		for i := 0; i < int(groups)*8 && n > 0; i++ {
+			bit := i * width
+			var w uint64
+			for j := 0; j < 5 && bit/8+j < len(packed); j++ {
+				w |= uint64(packed[bit/8+j]) << (8 * j)
+			}
+			fn(uint32(w >> (bit % 8) & mask))
+			n--
+		}
+	}
+	return nil
+}
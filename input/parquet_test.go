@@ -0,0 +1,74 @@
+package input
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// testdata/flows.parquet has two row groups of a string column src_addr
+// (dictionary pages, snappy, then a gzip v2 page, with nulls and a
+// malformed value), a required INT32 dst_addr, an optional INT64 src_int
+// with a value past 32 bits, and a DOUBLE column, bytes.
+func openFlows(t *testing.T, column string) (*ParquetFile, error) {
+	t.Helper()
+	f, err := os.Open("testdata/flows.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return OpenParquet(f, st.Size(), column, utils.ParseOptions{}.Parse)
+}
+
+func TestParquetColumns(t *testing.T) {
+	for _, tc := range []struct {
+		column string
+		unique int
+		stats  ParquetStats
+	}{
+		{"src_addr", 6, ParquetStats{RowGroups: 2, Values: 15, Nulls: 3, Malformed: 1}},
+		{"dst_addr", 5, ParquetStats{RowGroups: 2, Values: 19}},
+		{"src_int", 5, ParquetStats{RowGroups: 2, Values: 14, Nulls: 4, Malformed: 1}},
+	} {
+		pf, err := openFlows(t, tc.column)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.column, err)
+		}
+		seen := make(map[uint32]bool)
+		for i := range pf.RowGroups() {
+			b, err := io.ReadAll(pf.RowGroup(i))
+			if err != nil {
+				t.Fatalf("%s: row group %d: %v", tc.column, i, err)
+			}
+			for ; len(b) >= 4; b = b[4:] {
+				seen[binary.BigEndian.Uint32(b)] = true
+			}
+		}
+		if len(seen) != tc.unique {
+			t.Errorf("%s: %d unique, want %d", tc.column, len(seen), tc.unique)
+		}
+		if st := pf.Stats(); st != tc.stats {
+			t.Errorf("%s: stats %+v, want %+v", tc.column, st, tc.stats)
+		}
+	}
+}
+
+func TestParquetColumnErrors(t *testing.T) {
+	for column, want := range map[string]string{
+		"src":   `no column "src"; the file has src_addr, dst_addr, src_int, bytes`,
+		"bytes": `column "bytes" has physical type DOUBLE`,
+	} {
+		_, err := openFlows(t, column)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", column, err, want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package input
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrBadCapture is returned for a file that is neither classic pcap nor
+// pcapng, or whose framing (not a packet inside it) is broken.
+var ErrBadCapture = errors.New("not a readable pcap or pcapng capture")
+
+// PcapField selects which address of each IPv4 packet a PcapStream emits.
+type PcapField int
+
+const (
+	PcapSrc  PcapField = iota // source address
+	PcapDst                   // destination address
+	PcapBoth                  // source, then destination
+)
+
+// ParsePcapField parses a -pcap-field value: src, dst or both.
+func ParsePcapField(s string) (PcapField, error) {
+	switch s {
+	case "src":
+		return PcapSrc, nil
+	case "dst":
+		return PcapDst, nil
+	case "both":
+		return PcapBoth, nil
+	}
+	return 0, fmt.Errorf("pcap field must be src, dst or both, got %q", s)
+}
+
+// Link-layer header types, from the tcpdump.org LINKTYPE list.
+const (
+	linkNull     = 0   // BSD loopback, 4-byte address family in host order
+	linkEthernet = 1   // Ethernet II, with 802.1Q/802.1ad tags
+	linkRaw      = 101 // raw IP
+	linkLoop     = 108 // OpenBSD loopback, family in network order
+	linkSLL      = 113 // Linux cooked capture v1
+	linkIPv4     = 228 // raw IPv4
+	linkSLL2     = 276 // Linux cooked capture v2
+)
+
+const (
+	pcapngSHB = 0x0A0D0D0A // section header block
+	pcapngIDB = 1          // interface description block
+	pcapngSPB = 3          // simple packet block
+	pcapngEPB = 6          // enhanced packet block
+
+	maxPcapRecord = 1 << 24 // larger frames mean a corrupt length field
+)
+
+// PcapStats is what a PcapStream has seen so far.
+type PcapStats struct {
+	Packets   int64 // frames read
+	IPv4      int64 // frames holding an IPv4 packet
+	Other     int64 // ARP, IPv6 and other non-IPv4 frames, skipped
+	Malformed int64 // truncated or invalid frames and headers, skipped
+}
+
+// PcapStream reads a classic pcap or pcapng capture and returns the chosen
+// address of every IPv4 packet as a packed big-endian uint32, ready for a
+// binary-be counter. Ethernet (with VLAN tags), raw IP, Linux cooked and
+// loopback link types are understood; frames it cannot parse are skipped
+// and counted, never guessed at.
+type PcapStream struct {
+	r     *bufio.Reader
+	field PcapField
+	ng    bool
+	order binary.ByteOrder
+	link  int   // classic pcap: the file's link type
+	links []int // pcapng: link type per interface of the current section
+	out   []byte
+	frame []byte
+	stats PcapStats
+}
+
+// NewPcapStream reads the file header of the capture in r.
+func NewPcapStream(r io.Reader, field PcapField) (*PcapStream, error) {
+	s := &PcapStream{r: bufio.NewReaderSize(r, 256*1024), field: field}
+	magic, err := s.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCapture, err)
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngSHB {
+		s.ng = true
+		return s, nil // the section header is read as the first block
+	}
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(s.r, hdr); err != nil {
+		return nil, fmt.Errorf("%w: short file header", ErrBadCapture)
+	}
+	switch binary.LittleEndian.Uint32(hdr) {
+	case 0xa1b2c3d4, 0xa1b23c4d: // microsecond, nanosecond timestamps
+		s.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		s.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: unknown magic %x", ErrBadCapture, hdr[:4])
+	}
+	s.link = int(s.order.Uint32(hdr[20:]) & 0xffff)
+	if !knownLink(s.link) {
+		return nil, fmt.Errorf("%w: unsupported link type %d", ErrBadCapture, s.link)
+	}
+	return s, nil
+}
+
+// Read returns the next packed addresses.
+func (s *PcapStream) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		var err error
+		if s.ng {
+			err = s.nextBlock()
+		} else {
+			err = s.nextRecord()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// Stats returns the packet counts so far.
+func (s *PcapStream) Stats() PcapStats {
+	return s.stats
+}
+
+// nextRecord reads one classic pcap record.
+func (s *PcapStream) nextRecord() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return fmt.Errorf("%w: truncated record header", ErrBadCapture)
+	}
+	n := s.order.Uint32(hdr[8:])
+	if n > maxPcapRecord {
+		return fmt.Errorf("%w: record of %d bytes", ErrBadCapture, n)
+	}
+	if err := s.readFrame(int(n)); err != nil {
+		return err
+	}
+	s.packet(s.link, s.frame)
+	return nil
+}
+
+// nextBlock reads one pcapng block, handling the packets and the headers
+// that say how to read them and skipping everything else.
+func (s *PcapStream) nextBlock() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return fmt.Errorf("%w: truncated block header", ErrBadCapture)
+	}
+	typ := binary.BigEndian.Uint32(hdr[:])
+	if typ == pcapngSHB {
+		// The byte-order magic after the length decides how to read
+		// the length itself and the rest of the section
+		bom, err := s.r.Peek(4)
+		if err != nil {
+			return fmt.Errorf("%w: truncated section header", ErrBadCapture)
+		}
+		switch binary.LittleEndian.Uint32(bom) {
+		case 0x1A2B3C4D:
+			s.order = binary.LittleEndian
+		case 0x4D3C2B1A:
+			s.order = binary.BigEndian
+		default:
+			return fmt.Errorf("%w: bad section byte-order magic", ErrBadCapture)
+		}
+		s.links = s.links[:0]
+	} else {
+		if s.order == nil {
+			return fmt.Errorf("%w: block before the section header", ErrBadCapture)
+		}
+		typ = s.order.Uint32(hdr[:])
+	}
+	total := s.order.Uint32(hdr[4:])
+	if total < 12 || total%4 != 0 || total > maxPcapRecord {
+		return fmt.Errorf("%w: block of %d bytes", ErrBadCapture, total)
+	}
+	if err := s.readFrame(int(total) - 8); err != nil {
+		return err
+	}
+	body := s.frame[:len(s.frame)-4] // without the trailing length
+
+	switch typ {
+	case pcapngIDB:
+		if len(body) < 8 {
+			return fmt.Errorf("%w: short interface block", ErrBadCapture)
+		}
+		s.links = append(s.links, int(s.order.Uint16(body)))
+	case pcapngEPB:
+		if len(body) < 20 {
+			s.stats.Packets++
+			s.stats.Malformed++
+			return nil
+		}
+		iface, capLen := s.order.Uint32(body), s.order.Uint32(body[12:])
+		if int(iface) >= len(s.links) || int(capLen) > len(body)-20 {
+			s.stats.Packets++
+			s.stats.Malformed++
+			return nil
+		}
+		s.packet(s.links[iface], body[20:20+capLen])
+	case pcapngSPB:
+		if len(body) < 4 || len(s.links) == 0 {
+			s.stats.Packets++
+			s.stats.Malformed++
+			return nil
+		}
+		// The captured length is what fits in the block, up to the
+		// original length
+		data := body[4:]
+		data = data[:min(len(data), int(s.order.Uint32(body)))]
+		s.packet(s.links[0], data)
+	}
+	return nil
+}
+
+// readFrame reads n bytes into s.frame.
+func (s *PcapStream) readFrame(n int) error {
+	if cap(s.frame) < n {
+		s.frame = make([]byte, n)
+	}
+	s.frame = s.frame[:n]
+	if _, err := io.ReadFull(s.r, s.frame); err != nil {
+		return fmt.Errorf("%w: truncated packet", ErrBadCapture)
+	}
+	return nil
+}
+
+// packet finds the IPv4 header in a frame of the given link type and
+// queues its addresses.
+func (s *PcapStream) packet(link int, frame []byte) {
+	s.stats.Packets++
+	ip, ok := ipv4Payload(link, frame)
+	if !ok {
+		s.stats.Malformed++
+		return
+	}
+	if ip == nil {
+		s.stats.Other++
+		return
+	}
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[0]&0x0f < 5 {
+		s.stats.Malformed++
+		return
+	}
+	s.stats.IPv4++
+	if s.field != PcapDst {
+		s.out = append(s.out, ip[12:16]...)
+	}
+	if s.field != PcapSrc {
+		s.out = append(s.out, ip[16:20]...)
+	}
+}
+
+// ipv4Payload returns the part of frame after its link-layer header when
+// it carries IPv4, nil with ok when it carries something else, and !ok
+// when the link header itself is cut short.
+func ipv4Payload(link int, frame []byte) (ip []byte, ok bool) {
+	switch link {
+	case linkEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+		etype, rest := binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for etype == 0x8100 || etype == 0x88a8 || etype == 0x9100 {
+			if len(rest) < 4 {
+				return nil, false
+			}
+			etype, rest = binary.BigEndian.Uint16(rest[2:]), rest[4:]
+		}
+		if etype != 0x0800 {
+			return nil, true
+		}
+		return rest, true
+	case linkRaw:
+		if len(frame) == 0 {
+			return nil, false
+		}
+		if frame[0]>>4 != 4 {
+			return nil, true // IPv6
+		}
+		return frame, true
+	case linkIPv4:
+		return frame, true
+	case linkSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		if binary.BigEndian.Uint16(frame[14:]) != 0x0800 {
+			return nil, true
+		}
+		return frame[16:], true
+	case linkSLL2:
+		if len(frame) < 20 {
+			return nil, false
+		}
+		if binary.BigEndian.Uint16(frame) != 0x0800 {
+			return nil, true
+		}
+		return frame[20:], true
+	case linkNull, linkLoop:
+		if len(frame) < 4 {
+			return nil, false
+		}
+		// AF_INET is 2 everywhere; NULL stores it in the capturing
+		// host's byte order, which the file does not record
+		if binary.LittleEndian.Uint32(frame) != 2 && binary.BigEndian.Uint32(frame) != 2 {
+			return nil, true
+		}
+		return frame[4:], true
+	}
+	return nil, true
+}
+
+// knownLink reports whether ipv4Payload understands link.
+func knownLink(link int) bool {
+	switch link {
+	case linkNull, linkEthernet, linkRaw, linkLoop, linkSLL, linkIPv4, linkSLL2:
+		return true
+	}
+	return false
+}
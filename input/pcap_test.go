@@ -0,0 +1,104 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// testdata/capture.pcap is a little-endian Ethernet capture of seven
+// frames: IPv4 packets 10.0.0.1 and 10.0.0.2 to 192.168.1.1, 10.0.0.1 to
+// 8.8.8.8 behind an 802.1Q tag and 10.0.0.3 to 192.168.1.2, with an ARP
+// frame, an IPv6 frame and a frame cut short between them.
+//
+// testdata/capture.pcapng has two sections. The first, little-endian,
+// has a Linux cooked and a raw IP interface: enhanced packets 172.16.0.1
+// (cooked) and 172.16.0.2 (raw) to 1.1.1.1, a block of an unknown type,
+// a simple packet 172.16.0.1 to 1.0.0.1 on the first interface and an
+// enhanced packet on an interface that does not exist. The second,
+// big-endian, has an Ethernet interface and 172.16.0.3 to 1.1.1.1.
+func readCapture(t *testing.T, name string, field PcapField) ([]string, PcapStats) {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewPcapStream(bytes.NewReader(data), field)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	packed, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var addrs []string
+	for ; len(packed) >= 4; packed = packed[4:] {
+		addrs = append(addrs, utils.FormatIPv4(binary.BigEndian.Uint32(packed)))
+	}
+	if len(packed) != 0 {
+		t.Errorf("%s: %d bytes left over", name, len(packed))
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs), s.Stats()
+}
+
+func TestPcapCaptures(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		field PcapField
+		want  []string
+		stats PcapStats
+	}{
+		{"capture.pcap", PcapSrc, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			PcapStats{Packets: 7, IPv4: 4, Other: 2, Malformed: 1}},
+		{"capture.pcap", PcapDst, []string{"192.168.1.1", "192.168.1.2", "8.8.8.8"},
+			PcapStats{Packets: 7, IPv4: 4, Other: 2, Malformed: 1}},
+		{"capture.pcap", PcapBoth, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "192.168.1.1", "192.168.1.2", "8.8.8.8"},
+			PcapStats{Packets: 7, IPv4: 4, Other: 2, Malformed: 1}},
+		{"capture.pcapng", PcapSrc, []string{"172.16.0.1", "172.16.0.2", "172.16.0.3"},
+			PcapStats{Packets: 5, IPv4: 4, Malformed: 1}},
+		{"capture.pcapng", PcapDst, []string{"1.0.0.1", "1.1.1.1"},
+			PcapStats{Packets: 5, IPv4: 4, Malformed: 1}},
+	} {
+		got, stats := readCapture(t, tc.name, tc.field)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s field %d: %v, want %v", tc.name, tc.field, got, tc.want)
+		}
+		if stats != tc.stats {
+			t.Errorf("%s field %d: stats %+v, want %+v", tc.name, tc.field, stats, tc.stats)
+		}
+	}
+}
+
+// A capture cut short anywhere past its file header fails with
+// ErrBadCapture rather than ending quietly at the last whole packet, as
+// does a file that is no capture at all.
+func TestPcapTruncated(t *testing.T) {
+	for _, name := range []string{"capture.pcap", "capture.pcapng"} {
+		data, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cut := range []int{1, 4, 17, len(data) / 2} {
+			s, err := NewPcapStream(bytes.NewReader(data[:len(data)-cut]), PcapSrc)
+			if err == nil {
+				_, err = io.ReadAll(s)
+			}
+			if !errors.Is(err, ErrBadCapture) {
+				t.Errorf("%s less its last %d bytes: %v, want ErrBadCapture", name, cut, err)
+			}
+		}
+	}
+	if _, err := NewPcapStream(bytes.NewReader([]byte("10.0.0.1\n10.0.0.2\n10.0.0.3\n")), PcapSrc); !errors.Is(err, ErrBadCapture) {
+		t.Errorf("a text file: %v, want ErrBadCapture", err)
+	}
+	if _, err := NewPcapStream(bytes.NewReader(nil), PcapSrc); !errors.Is(err, ErrBadCapture) {
+		t.Errorf("an empty file: %v, want ErrBadCapture", err)
+	}
+}
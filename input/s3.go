@@ -0,0 +1,193 @@
+package input
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	emptySHA256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	// ErrAccessDenied is returned when S3 rejects the credentials or
+	// they lack permission for the object.
+	ErrAccessDenied = errors.New("access denied")
+	// ErrNotFound is returned when the bucket or key does not exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// S3Options configures OpenS3.
+type S3Options struct {
+	HTTPOptions
+	// Region is the bucket's region, "" for $AWS_REGION, then
+	// $AWS_DEFAULT_REGION, then us-east-1.
+	Region string
+	// Endpoint replaces the AWS endpoint, e.g. for MinIO, and switches
+	// to path-style addressing; "" for $AWS_ENDPOINT_URL_S3 or
+	// $AWS_ENDPOINT_URL.
+	Endpoint string
+}
+
+// IsS3 reports whether name is an s3://bucket/key object.
+func IsS3(name string) bool {
+	return strings.HasPrefix(name, "s3://")
+}
+
+// OpenS3 streams the object named by an s3://bucket/key URL with a GET
+// signed with Signature Version 4, resuming it like OpenURL. Credentials
+// come from the standard chain: the environment, the shared credentials
+// file, then a container or EC2 instance role. A rejected request fails
+// with ErrAccessDenied, a missing bucket or key with ErrNotFound and a
+// body that ends early with ErrTruncated.
+func OpenS3(ctx context.Context, name string, o S3Options) (*HTTPStream, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(name, "s3://"), "/")
+	if !ok || bucket == "" || key == "" {
+		return nil, fmt.Errorf("%s: want s3://bucket/key", name)
+	}
+	region := firstNonEmpty(o.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), defaultRegion)
+	u, err := objectURL(bucket, key, region, firstNonEmpty(o.Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	creds, err := loadCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	ho := o.HTTPOptions.withDefaults()
+	return open(&rangeReader{
+		ctx:  ctx,
+		name: name,
+		url:  u.String(),
+		opts: ho,
+		sign: func(req *http.Request) error {
+			signV4(req, creds, region, time.Now())
+			return nil
+		},
+		statusError: func(resp *http.Response) error {
+			return s3Error(name, region, resp)
+		},
+	})
+}
+
+// objectURL addresses key in bucket: virtual-hosted on AWS unless the
+// bucket name has dots, which the wildcard certificate does not cover,
+// and path-style on a custom endpoint.
+func objectURL(bucket, key, region, endpoint string) (*url.URL, error) {
+	var u *url.URL
+	path := "/" + key
+	switch {
+	case endpoint != "":
+		var err error
+		if u, err = url.Parse(endpoint); err != nil {
+			return nil, fmt.Errorf("endpoint: %w", err)
+		}
+		path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + path
+	case strings.Contains(bucket, "."):
+		u = &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+		path = "/" + bucket + path
+	default:
+		u = &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com"}
+	}
+	u.Path, u.RawPath = path, uriEncode(path)
+	return u, nil
+}
+
+// signV4 adds the AWS Signature Version 4 headers for an S3 GET to req.
+// Only host and the x-amz- headers are signed, so the Range a resume
+// adds does not need a new signature scheme.
+func signV4(req *http.Request, c credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + emptySHA256 + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+		headers += "x-amz-security-token:" + c.SessionToken + "\n"
+		signed += ";x-amz-security-token"
+	}
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers, signed, emptySHA256,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + c.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent-encodes every byte of an S3 path but the unreserved
+// characters and '/', as SigV4 expects.
+func uriEncode(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error turns an error answer into ErrAccessDenied, ErrNotFound or
+// ErrStatus, with S3's error code and message from the XML body.
+func s3Error(name, region string, resp *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+		Region  string
+	}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	detail := resp.Status
+	if body.Code != "" {
+		detail = body.Code + ": " + body.Message
+	}
+	if r := firstNonEmpty(resp.Header.Get("X-Amz-Bucket-Region"), body.Region); r != "" && r != region {
+		return fmt.Errorf("%w: %s: %s (the bucket is in %s; use -s3-region %s)", ErrStatus, name, detail, r, r)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %s: %s", ErrAccessDenied, name, detail)
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s: %s", ErrNotFound, name, detail)
+	}
+	return fmt.Errorf("%w: %s: %s", ErrStatus, name, detail)
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
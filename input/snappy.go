@@ -0,0 +1,151 @@
+package input
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errBadSnappy = errors.New("corrupt snappy block")
+
+// DecodeSnappy decompresses a raw snappy block, the format of Parquet's
+// SNAPPY codec (not the framed stream format), into dst's storage.
+func DecodeSnappy(dst, src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > 1<<31 {
+		return nil, errBadSnappy
+	}
+	src = src[k:]
+	if uint64(cap(dst)) < n {
+		dst = make([]byte, 0, n)
+	}
+	dst = dst[:0]
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0: // literal, its length in the tag or the 1 to 4 bytes after it
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errBadSnappy
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length <= 0 || len(src) < length || uint64(len(dst)+length) > n {
+				return nil, errBadSnappy
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1: // copy, 3-bit length and 11-bit offset
+			if len(src) < 2 {
+				return nil, errBadSnappy
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2: // copy, 2-byte offset
+			if len(src) < 3 {
+				return nil, errBadSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3: // copy, 4-byte offset
+			if len(src) < 5 {
+				return nil, errBadSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errBadSnappy
+		}
+		// The copy may overlap what it appends, repeating a short run
+		start := len(dst) - offset
+		for i := range length {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errBadSnappy
+	}
+	return dst, nil
+}
+
+// snappyMaxOffset is the furthest back EncodeSnappy copies from, so every
+// copy fits the 2-byte offset form.
+const snappyMaxOffset = 1<<16 - 1
+
+// EncodeSnappy compresses src into a raw snappy block appended to dst,
+// which DecodeSnappy reads back. It matches greedily on 4-byte hashes,
+// trading ratio for speed as snappy does.
+func EncodeSnappy(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	var table [1 << 14]int32 // 1 + the last position of each hash
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := v * 0x1e35a7bd >> 18
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > snappyMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != v {
+			i++
+			continue
+		}
+		n := 4
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = appendSnappyLiteral(dst, src[lit:i])
+		dst = appendSnappyCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return appendSnappyLiteral(dst, src[lit:])
+}
+
+// appendSnappyLiteral appends lit as one literal element.
+func appendSnappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	switch n := uint32(len(lit) - 1); {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// appendSnappyCopy appends copies of length bytes from offset back, at
+// most 64 bytes an element and never fewer than 4.
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length < 12 && offset < 2048 {
+		return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+	}
+	return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+}
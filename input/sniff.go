@@ -0,0 +1,131 @@
+package input
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+const (
+	// SniffSize is how much of an input Sniff looks at.
+	SniffSize = 64 * 1024
+	// MinPrintable is the share of the bytes sniffed that must be text
+	// for an input to pass as text.
+	MinPrintable = 0.9
+)
+
+// Framing is what Sniff found at the start of an input.
+type Framing struct {
+	Bytes     int     // bytes sniffed
+	Printable float64 // share of them in printable characters, whitespace and the delimiter
+	Delim     byte    // what records end in: the delimiter asked for, or NUL if only that ends them
+	Records   int     // record ends seen
+	CRLF      int     // of them newlines after a carriage return
+}
+
+// Sniff looks at the start of an input, data, whose records should end in
+// delim. An input sniffed for newlines that has NULs and no newline at
+// all has Delim 0.
+func Sniff(data []byte, delim byte) Framing {
+	f := Framing{Bytes: len(data), Delim: delim, Records: bytes.Count(data, []byte{delim})}
+	if nuls := bytes.Count(data, []byte{0}); delim == '\n' && f.Records == 0 && nuls > 0 {
+		f.Delim, f.Records = 0, nuls
+	}
+	if f.Delim == '\n' {
+		f.CRLF = bytes.Count(data, []byte("\r\n"))
+	}
+	var text int
+	for i := 0; i < len(data); {
+		r, n := utf8.DecodeRune(data[i:])
+		switch {
+		case data[i] == f.Delim, r == '\t', r == '\n', r == '\r', r == '\v', r == '\f':
+			text += n
+		case r == utf8.RuneError && n == 1:
+			// A rune cut off by the end of the sniff is not binary
+			if len(data)-i < utf8.UTFMax && !utf8.FullRune(data[i:]) {
+				text += len(data) - i
+				n = len(data) - i
+			}
+		case r >= 0x20 && r != 0x7f:
+			text += n
+		}
+		i += n
+	}
+	if len(data) > 0 {
+		f.Printable = float64(text) / float64(len(data))
+	}
+	return f
+}
+
+// Text returns why an input that starts as f does not look like records
+// of text ending in its delimiter, with lines up to maxLine long, or ""
+// if it does.
+func (f Framing) Text(maxLine int) string {
+	switch {
+	case f.Bytes == 0:
+		return ""
+	case f.Printable < MinPrintable:
+		return fmt.Sprintf("only %.0f%% of its first %s is text", 100*f.Printable, counter.FormatBytes(int64(f.Bytes)))
+	case f.Records == 0 && f.Bytes > maxLine:
+		return fmt.Sprintf("its first %s hold no %s", counter.FormatBytes(int64(f.Bytes)), delimName(f.Delim))
+	}
+	return ""
+}
+
+// String describes the framing for -stats, such as "LF" or "NUL-separated".
+func (f Framing) String() string {
+	switch {
+	case f.Records == 0:
+		return "a single record"
+	case f.Delim == 0:
+		return "NUL-separated"
+	case f.Delim != '\n':
+		return fmt.Sprintf("%q-separated", f.Delim)
+	case f.CRLF == f.Records:
+		return "CRLF"
+	case f.CRLF > 0:
+		return "mixed LF and CRLF"
+	}
+	return "LF"
+}
+
+// delimName names a record delimiter in a message.
+func delimName(delim byte) string {
+	if delim == '\n' {
+		return "newline"
+	}
+	return fmt.Sprintf("%q", delim)
+}
+
+// SniffFile sniffs the first SniffSize bytes of the regular file path,
+// decompressed if it is compressed. It reports false, without an error,
+// for anything else, such as a pipe, whose bytes it would consume, and
+// for compressed data too corrupt to start decoding, which the count
+// reports.
+func SniffFile(path string, delim byte) (Framing, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Framing{}, false, &counter.OpenError{Path: path, Err: err}
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		return Framing{}, false, nil
+	}
+	r, c, err := Decompress(f)
+	if err != nil {
+		return Framing{}, false, nil
+	}
+	buf := make([]byte, SniffSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		if c != Uncompressed {
+			return Framing{}, false, nil
+		}
+		return Framing{}, false, counter.WrapRead(path, err)
+	}
+	return Sniff(buf[:n], delim), true, nil
+}
@@ -0,0 +1,197 @@
+package input
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// ErrCorruptTar is returned when a tar archive or one of its members
+// cannot be read; the message names the member.
+var ErrCorruptTar = errors.New("corrupt tar archive")
+
+// tarMagic is the "ustar" signature at offset 257 of a tar header block,
+// shared by the POSIX and GNU formats.
+var tarMagic = []byte("ustar")
+
+// IsTarName reports whether name ends in .tar, or in .tar or .t followed
+// by the extension of a codec, such as .tar.gz or .tgz.
+func IsTarName(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".gz", ".zst", ".bz2", ""} {
+		if strings.HasSuffix(name, ".tar"+ext) || ext != "" && strings.HasSuffix(name, ".t"+ext[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTar reports whether filename is a tar archive, plain or compressed: by
+// its name, or for a regular file by the magic of its first block. A pipe
+// is never sniffed, since that would consume its first bytes.
+func IsTar(filename string) (bool, error) {
+	if IsTarName(filename) {
+		return true, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		return false, nil
+	}
+	r, _, err := Decompress(f)
+	if err != nil {
+		return false, nil // not compressed after all, or too short to tell
+	}
+	block := make([]byte, 262)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(block[257:262], tarMagic), nil
+}
+
+// Member describes one archive member TarStream read.
+type Member struct {
+	Name  string
+	Bytes int64
+	Lines int64
+}
+
+// TarStream reads the regular members of a tar archive, compressed or not,
+// back to back as one stream, so a counter sees the union of their lines
+// in a single pass. Directories, links and other non-regular entries are
+// skipped, as are members whose name does not match the filter. A member
+// that does not end in a newline gets one, so its last line does not run
+// into the next member's first.
+type TarStream struct {
+	tr      *tar.Reader
+	pattern string
+	cur     *Member // member being read, nil between members
+	last    string  // name of the last member started, for errors
+	pending bool    // a newline is owed after the previous member
+	delim   byte    // what lines end in, '\n' unless SetDelim says otherwise
+	raw     bool    // join members as they are
+	members []Member
+	skipped int
+}
+
+// NewTarStream reads the archive in r, keeping only members whose full
+// name or base name matches pattern (a path.Match glob, "" for all).
+func NewTarStream(r io.Reader, pattern string) (*TarStream, error) {
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("member pattern %q: %w", pattern, err)
+		}
+	}
+	zr, _, err := Decompress(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptTar, err)
+	}
+	return &TarStream{tr: tar.NewReader(zr), pattern: pattern, delim: '\n'}, nil
+}
+
+// SetDelim makes the stream treat delim, such as NUL, as the end of a
+// record: it is what a member missing one gets and what Lines counts.
+func (s *TarStream) SetDelim(delim byte) {
+	s.delim = delim
+}
+
+// SetRaw makes the stream join members as they are, with nothing between
+// them, for packed binary records.
+func (s *TarStream) SetRaw() {
+	s.raw = true
+}
+
+// Read reads the concatenated members.
+func (s *TarStream) Read(p []byte) (int, error) {
+	for {
+		if s.cur == nil {
+			if s.pending && len(p) > 0 {
+				s.pending = false
+				p[0] = s.delim
+				return 1, nil
+			}
+			if err := s.next(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := s.tr.Read(p)
+		s.cur.Bytes += int64(n)
+		s.cur.Lines += int64(bytes.Count(p[:n], []byte{s.delim}))
+		if n > 0 {
+			s.pending = !s.raw && p[n-1] != s.delim
+		}
+		if err == io.EOF {
+			if s.pending {
+				s.cur.Lines++
+			}
+			s.members = append(s.members, *s.cur)
+			s.cur = nil
+			err = nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("%w: member %q: %v", ErrCorruptTar, s.cur.Name, err)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// next advances to the next regular member that passes the filter, or
+// returns io.EOF at the end of the archive. A filter that matched nothing
+// is an error rather than a count of zero.
+func (s *TarStream) next() error {
+	for {
+		hdr, err := s.tr.Next()
+		if err == io.EOF {
+			if s.pattern != "" && len(s.members) == 0 {
+				return fmt.Errorf("no regular members match %q", s.pattern)
+			}
+			return io.EOF
+		}
+		if err != nil {
+			if s.last == "" {
+				return fmt.Errorf("%w: first header: %v", ErrCorruptTar, err)
+			}
+			return fmt.Errorf("%w: header after member %q: %v", ErrCorruptTar, s.last, err)
+		}
+		s.last = hdr.Name
+		if !hdr.FileInfo().Mode().IsRegular() || !s.matches(hdr.Name) {
+			s.skipped++
+			continue
+		}
+		s.cur = &Member{Name: hdr.Name}
+		return nil
+	}
+}
+
+func (s *TarStream) matches(name string) bool {
+	if s.pattern == "" {
+		return true
+	}
+	full, _ := path.Match(s.pattern, name)
+	base, _ := path.Match(s.pattern, path.Base(name))
+	return full || base
+}
+
+// Members returns the members read completely so far, in archive order.
+func (s *TarStream) Members() []Member {
+	return s.members
+}
+
+// Skipped returns the number of entries passed over as non-regular or
+// filtered out.
+func (s *TarStream) Skipped() int {
+	return s.skipped
+}
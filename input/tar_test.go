@@ -0,0 +1,110 @@
+package input
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+// buildTar writes an archive of a directory, two regular members, the
+// first without a final newline, a symlink and a FIFO between them, and
+// a README at the top.
+func buildTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "logs/", Mode: 0o755}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "logs/a.txt", Mode: 0o644}, "10.0.0.1\n10.0.0.2"},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "logs/latest", Linkname: "a.txt"}, ""},
+		{tar.Header{Typeflag: tar.TypeFifo, Name: "logs/pipe", Mode: 0o644}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "logs/b.txt", Mode: 0o644}, "10.0.0.3\n10.0.0.1\n"},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "README", Mode: 0o644}, "not addresses\n"},
+	} {
+		e.hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The regular members come back to back, a newline added after the one
+// without, and the directory, link and FIFO are skipped; the same holds
+// for the archive gzipped, and a pattern keeps only the members it
+// matches by full or base name.
+func TestTarStream(t *testing.T) {
+	archive := buildTar(t)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(archive)
+	zw.Close()
+
+	all := "10.0.0.1\n10.0.0.2\n10.0.0.3\n10.0.0.1\nnot addresses\n"
+	for _, tc := range []struct {
+		name, pattern string
+		archive       []byte
+		want          string
+		members       []Member
+		skipped       int
+	}{
+		{"plain", "", archive, all, []Member{
+			{"logs/a.txt", 17, 2}, {"logs/b.txt", 18, 2}, {"README", 14, 1},
+		}, 3},
+		{"gzipped", "", gz.Bytes(), all, nil, 3},
+		{"base name", "*.txt", archive, "10.0.0.1\n10.0.0.2\n10.0.0.3\n10.0.0.1\n", nil, 4},
+		{"full name", "logs/b.*", archive, "10.0.0.3\n10.0.0.1\n", nil, 5},
+	} {
+		s, err := NewTarStream(bytes.NewReader(tc.archive), tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(s)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%s: %q, %v; want %q", tc.name, got, err, tc.want)
+		}
+		if tc.members != nil && !slices.Equal(s.Members(), tc.members) {
+			t.Errorf("%s: members %+v, want %+v", tc.name, s.Members(), tc.members)
+		}
+		if s.Skipped() != tc.skipped {
+			t.Errorf("%s: %d skipped, want %d", tc.name, s.Skipped(), tc.skipped)
+		}
+	}
+}
+
+// A pattern matching no regular member is an error rather than an empty
+// count, and an archive cut off inside a header or a member fails with
+// ErrCorruptTar.
+func TestTarStreamErrors(t *testing.T) {
+	archive := buildTar(t)
+	s, err := NewTarStream(bytes.NewReader(archive), "*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(s); err == nil {
+		t.Error("no member matches *.log, yet no error")
+	}
+
+	// Cut inside the second header, and inside the first member's data
+	for _, cut := range []int{512 + 10, 2*512 + 5} {
+		s, err := NewTarStream(bytes.NewReader(archive[:cut]), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(s); !errors.Is(err, ErrCorruptTar) {
+			t.Errorf("cut at %d: %v", cut, err)
+		}
+	}
+}
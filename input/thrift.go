@@ -0,0 +1,195 @@
+package input
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Thrift compact protocol types, as in a field header's low nibble.
+const (
+	thriftStop   = 0
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+// maxThriftDepth bounds struct nesting, so a corrupt footer cannot
+// recurse without end.
+const maxThriftDepth = 32
+
+var errThriftShort = errors.New("thrift: truncated")
+
+// thriftReader decodes the Thrift compact protocol Parquet uses for its
+// footer and page headers. Only what those need is here: structs are
+// walked field by field, and fields the caller does not want are skipped.
+type thriftReader struct {
+	b     []byte
+	pos   int
+	depth int
+}
+
+func (t *thriftReader) byte() (byte, error) {
+	if t.pos >= len(t.b) {
+		return 0, errThriftShort
+	}
+	c := t.b[t.pos]
+	t.pos++
+	return c, nil
+}
+
+func (t *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(t.b[t.pos:])
+	if n <= 0 {
+		return 0, errThriftShort
+	}
+	t.pos += n
+	return v, nil
+}
+
+// varint reads a zigzag varint, the encoding of i16, i32 and i64.
+func (t *thriftReader) varint() (int64, error) {
+	v, err := t.uvarint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (t *thriftReader) i32() (int32, error) {
+	v, err := t.varint()
+	return int32(v), err
+}
+
+func (t *thriftReader) binary() ([]byte, error) {
+	n, err := t.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(t.b)-t.pos) {
+		return nil, errThriftShort
+	}
+	b := t.b[t.pos : t.pos+int(n)]
+	t.pos += int(n)
+	return b, nil
+}
+
+// list reads a list or set header: the element type and count.
+func (t *thriftReader) list() (typ byte, n int, err error) {
+	h, err := t.byte()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := uint64(h >> 4)
+	if size == 15 {
+		if size, err = t.uvarint(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if size > uint64(len(t.b)-t.pos) {
+		// Every element takes at least a byte
+		return 0, 0, errThriftShort
+	}
+	return h & 0x0f, int(size), nil
+}
+
+// structFields calls field for each field of the struct at the reader,
+// with its id and type, until the stop field. field must read or skip
+// the value. Booleans are carried in the type, thriftTrue or thriftFalse,
+// and have no value to read.
+func (t *thriftReader) structFields(field func(id int16, typ byte) error) error {
+	if t.depth++; t.depth > maxThriftDepth {
+		return errors.New("thrift: structs nested too deep")
+	}
+	defer func() { t.depth-- }()
+	var id int16
+	for {
+		h, err := t.byte()
+		if err != nil {
+			return err
+		}
+		typ := h & 0x0f
+		if typ == thriftStop {
+			return nil
+		}
+		if delta := h >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			v, err := t.varint()
+			if err != nil {
+				return err
+			}
+			id = int16(v)
+		}
+		if err := field(id, typ); err != nil {
+			return err
+		}
+	}
+}
+
+// skip reads past a value of type typ.
+func (t *thriftReader) skip(typ byte) error {
+	switch typ {
+	case thriftTrue, thriftFalse:
+		return nil
+	case thriftByte:
+		_, err := t.byte()
+		return err
+	case thriftI16, thriftI32, thriftI64:
+		_, err := t.uvarint()
+		return err
+	case thriftDouble:
+		if len(t.b)-t.pos < 8 {
+			return errThriftShort
+		}
+		t.pos += 8
+		return nil
+	case thriftBinary:
+		_, err := t.binary()
+		return err
+	case thriftList, thriftSet:
+		et, n, err := t.list()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if et == thriftTrue || et == thriftFalse {
+				// A boolean element is a byte of its own
+				et = thriftByte
+			}
+			if err := t.skip(et); err != nil {
+				return err
+			}
+		}
+		return nil
+	case thriftMap:
+		n, err := t.uvarint()
+		if err != nil || n == 0 {
+			return err
+		}
+		kv, err := t.byte()
+		if err != nil {
+			return err
+		}
+		for range n {
+			for _, et := range []byte{kv >> 4, kv & 0x0f} {
+				if et == thriftTrue || et == thriftFalse {
+					et = thriftByte
+				}
+				if err := t.skip(et); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case thriftStruct:
+		return t.structFields(func(_ int16, typ byte) error { return t.skip(typ) })
+	}
+	return fmt.Errorf("thrift: unknown type %d", typ)
+}
@@ -0,0 +1,587 @@
+package input
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCorruptZstd is returned when a zstd stream cannot be decoded.
+var ErrCorruptZstd = errors.New("corrupt zstd stream")
+
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50 // low 4 bits free
+	zstdMaxBlock       = 128 << 10
+
+	// maxZstdWindow is the largest window a frame may ask for, the limit
+	// the reference decoder applies by default. Frames written with
+	// --long=28 or more need more memory than a count should take.
+	maxZstdWindow = 1 << 27
+)
+
+// Base values and extra bits of the literals length and match length
+// codes, RFC 8878 section 3.1.1.3.2.1.1.
+var (
+	zstdLLBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLLBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMLBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMLBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// The predefined distributions of the sequence codes, for blocks that
+// do not describe their own.
+var zstdLLDefault, zstdOFDefault, zstdMLDefault = mustFSETable([]int16{
+	4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+	-1, -1, -1, -1,
+}, 6), mustFSETable([]int16{
+	1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+}, 5), mustFSETable([]int16{
+	1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+	-1, -1, -1, -1, -1,
+}, 6)
+
+func mustFSETable(norm []int16, log int) *fseTable {
+	t, err := buildFSETable(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// zstdReader decompresses a stream of zstd frames (RFC 8878), one block at
+// a time, keeping the frame's window of decoded bytes for matches to copy
+// from. Skippable frames are passed over. Dictionaries are not supported.
+type zstdReader struct {
+	r   *bufio.Reader
+	err error // sticky, io.EOF after the last frame
+
+	hist []byte // the frame decoded so far, from a window back
+	out  int    // hist[out:] is not yet returned by Read
+
+	inFrame  bool
+	window   int   // how far back matches reach
+	maxBlock int   // largest block of the frame
+	size     int64 // content size from the header, -1 if absent
+	produced int64
+	checksum bool
+	xx       xxh64
+
+	block      []byte // the compressed block being decoded
+	lits       []byte
+	huff       *huffTable // last Huffman table, for treeless literals
+	ll, of, ml *fseTable  // last sequence tables, for repeat mode
+	rep        [3]int     // repeat offsets
+}
+
+func newZstdReader(r io.Reader) *zstdReader {
+	return &zstdReader{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.out == len(z.hist) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.hist[z.out:])
+	z.out += n
+	return n, nil
+}
+
+// next decodes the following block, starting a frame first if need be.
+func (z *zstdReader) next() error {
+	if !z.inFrame {
+		if err := z.frameHeader(); err != nil {
+			return err
+		}
+	}
+	var hdr [3]byte
+	if err := z.readFull(hdr[:]); err != nil {
+		return err
+	}
+	h := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	last, typ, size := h&1 == 1, h>>1&3, h>>3
+	if typ != 1 && size > z.maxBlock {
+		return fmt.Errorf("%w: block of %d bytes over the frame's %d", ErrCorruptZstd, size, z.maxBlock)
+	}
+
+	// Matches reach a window back, so only that much is kept in front
+	if keep := min(z.window, len(z.hist)); len(z.hist)+zstdMaxBlock > cap(z.hist) {
+		copy(z.hist, z.hist[len(z.hist)-keep:])
+		z.hist = z.hist[:keep]
+	}
+	start := len(z.hist)
+	switch typ {
+	case 0: // raw
+		z.hist = z.hist[:start+size]
+		if err := z.readFull(z.hist[start:]); err != nil {
+			return err
+		}
+	case 1: // RLE: one byte, size times
+		if size > z.maxBlock {
+			return fmt.Errorf("%w: block of %d bytes over the frame's %d", ErrCorruptZstd, size, z.maxBlock)
+		}
+		c, err := z.r.ReadByte()
+		if err != nil {
+			return z.truncated(err)
+		}
+		z.hist = z.hist[:start+size]
+		for i := range z.hist[start:] {
+			z.hist[start+i] = c
+		}
+	case 2:
+		z.block = z.block[:size]
+		if err := z.readFull(z.block); err != nil {
+			return err
+		}
+		if err := z.compressedBlock(z.block); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: reserved block type", ErrCorruptZstd)
+	}
+	z.out = start
+	z.produced += int64(len(z.hist) - start)
+	if z.checksum {
+		z.xx.write(z.hist[start:])
+	}
+	if last {
+		return z.frameEnd()
+	}
+	return nil
+}
+
+// frameHeader reads up to and including the header of the next zstd
+// frame, skipping skippable frames, and readies the reader for its
+// blocks. It returns io.EOF at a clean end of the input.
+func (z *zstdReader) frameHeader() error {
+	var magic [4]byte
+	for {
+		if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+			if err == io.EOF {
+				return io.EOF
+			}
+			return z.truncated(err)
+		}
+		m := binary.LittleEndian.Uint32(magic[:])
+		if m == zstdMagic {
+			break
+		}
+		if m&^15 != zstdSkippableMagic {
+			return fmt.Errorf("%w: bad frame magic %#08x", ErrCorruptZstd, m)
+		}
+		if err := z.readFull(magic[:]); err != nil {
+			return err
+		}
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(magic[:]))); err != nil {
+			return z.truncated(err)
+		}
+	}
+
+	fhd, err := z.r.ReadByte()
+	if err != nil {
+		return z.truncated(err)
+	}
+	if fhd&8 != 0 {
+		return fmt.Errorf("%w: reserved frame header bit set", ErrCorruptZstd)
+	}
+	single := fhd&32 != 0
+	z.checksum = fhd&4 != 0
+	window := 0
+	if !single {
+		wd, err := z.r.ReadByte()
+		if err != nil {
+			return z.truncated(err)
+		}
+		log := 10 + int(wd>>3)
+		if log > 31 {
+			return fmt.Errorf("%w: window log %d", ErrCorruptZstd, log)
+		}
+		window = 1<<log + (1<<log)/8*int(wd&7)
+	}
+	var field [8]byte
+	if n := [4]int{0, 1, 2, 4}[fhd&3]; n > 0 {
+		if err := z.readFull(field[:n]); err != nil {
+			return err
+		}
+		if id := binary.LittleEndian.Uint32(field[:4]); id != 0 {
+			return fmt.Errorf("zstd frame needs dictionary %d, which is not supported", id)
+		}
+	}
+	z.size = -1
+	fcsSize := [4]int{0, 2, 4, 8}[fhd>>6]
+	if single && fcsSize == 0 {
+		fcsSize = 1
+	}
+	if fcsSize > 0 {
+		field = [8]byte{}
+		if err := z.readFull(field[:fcsSize]); err != nil {
+			return err
+		}
+		z.size = int64(binary.LittleEndian.Uint64(field[:]))
+		if fcsSize == 2 {
+			z.size += 256
+		}
+		if z.size < 0 {
+			return fmt.Errorf("%w: content size", ErrCorruptZstd)
+		}
+	}
+	if single {
+		window = int(min(z.size, maxZstdWindow+1))
+	}
+	if window > maxZstdWindow {
+		return fmt.Errorf("zstd frame needs a %d MB window, over the %d MB supported; recompress without --long",
+			window>>20, maxZstdWindow>>20)
+	}
+
+	z.inFrame = true
+	z.window = window
+	z.maxBlock = min(window, zstdMaxBlock)
+	z.produced = 0
+	z.xx.reset()
+	z.huff, z.ll, z.of, z.ml = nil, nil, nil, nil
+	z.rep = [3]int{1, 4, 8}
+	if need := 2*window + zstdMaxBlock; cap(z.hist) < need {
+		z.hist = make([]byte, 0, need)
+	}
+	z.hist, z.out = z.hist[:0], 0
+	if z.block == nil {
+		z.block = make([]byte, 0, zstdMaxBlock)
+		z.lits = make([]byte, zstdMaxBlock)
+	}
+	return nil
+}
+
+// frameEnd checks the size and checksum of the frame just decoded.
+func (z *zstdReader) frameEnd() error {
+	z.inFrame = false
+	if z.size >= 0 && z.produced != z.size {
+		return fmt.Errorf("%w: frame of %d bytes holds %d", ErrCorruptZstd, z.size, z.produced)
+	}
+	if !z.checksum {
+		return nil
+	}
+	var sum [4]byte
+	if err := z.readFull(sum[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != uint32(z.xx.sum()) {
+		return fmt.Errorf("%w: content checksum mismatch", ErrCorruptZstd)
+	}
+	return nil
+}
+
+// compressedBlock decodes a compressed block, its literals section and
+// then its sequences, onto the end of hist.
+func (z *zstdReader) compressedBlock(b []byte) error {
+	lits, n, err := z.literals(b)
+	if err != nil {
+		return err
+	}
+	return z.sequences(b[n:], lits)
+}
+
+// literals decodes the literals section at the start of b and returns
+// the literals and the bytes the section took.
+func (z *zstdReader) literals(b []byte) ([]byte, int, error) {
+	short := fmt.Errorf("%w: literals section past the block", ErrCorruptZstd)
+	if len(b) == 0 {
+		return nil, 0, short
+	}
+	typ, format := b[0]&3, b[0]>>2&3
+	if typ < 2 {
+		// Raw or RLE, with a 5-, 12- or 20-bit size
+		var size, hl int
+		switch format {
+		case 0, 2:
+			size, hl = int(b[0]>>3), 1
+		case 1:
+			if len(b) < 2 {
+				return nil, 0, short
+			}
+			size, hl = int(b[0]>>4)|int(b[1])<<4, 2
+		case 3:
+			if len(b) < 3 {
+				return nil, 0, short
+			}
+			size, hl = int(b[0]>>4)|int(b[1])<<4|int(b[2])<<12, 3
+		}
+		if size > zstdMaxBlock {
+			return nil, 0, fmt.Errorf("%w: %d literals", ErrCorruptZstd, size)
+		}
+		if typ == 0 {
+			if hl+size > len(b) {
+				return nil, 0, short
+			}
+			return b[hl : hl+size], hl + size, nil
+		}
+		if hl >= len(b) {
+			return nil, 0, short
+		}
+		lits := z.lits[:size]
+		for i := range lits {
+			lits[i] = b[hl]
+		}
+		return lits, hl + 1, nil
+	}
+
+	// Huffman-coded, in one stream or four, with a new table or the last
+	var regen, comp, hl int
+	streams := 4
+	switch format {
+	case 0, 1:
+		if len(b) < 3 {
+			return nil, 0, short
+		}
+		h := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		regen, comp, hl = h>>4&0x3ff, h>>14&0x3ff, 3
+		if format == 0 {
+			streams = 1
+		}
+	case 2:
+		if len(b) < 4 {
+			return nil, 0, short
+		}
+		h := binary.LittleEndian.Uint32(b)
+		regen, comp, hl = int(h>>4&0x3fff), int(h>>18&0x3fff), 4
+	case 3:
+		if len(b) < 5 {
+			return nil, 0, short
+		}
+		h := uint64(binary.LittleEndian.Uint32(b)) | uint64(b[4])<<32
+		regen, comp, hl = int(h>>4&0x3ffff), int(h>>22&0x3ffff), 5
+	}
+	if regen > zstdMaxBlock {
+		return nil, 0, fmt.Errorf("%w: %d literals", ErrCorruptZstd, regen)
+	}
+	if hl+comp > len(b) {
+		return nil, 0, short
+	}
+	data := b[hl : hl+comp]
+	if typ == 2 {
+		h, n, err := readHuffTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		z.huff, data = h, data[n:]
+	} else if z.huff == nil {
+		return nil, 0, fmt.Errorf("%w: treeless literals before any Huffman table", ErrCorruptZstd)
+	}
+	lits := z.lits[:regen]
+	if streams == 1 {
+		return lits, hl + comp, z.huff.decode(lits, data)
+	}
+	if len(data) < 6 {
+		return nil, 0, short
+	}
+	seg := (regen + 3) / 4
+	if 3*seg > regen {
+		return nil, 0, fmt.Errorf("%w: %d literals in four streams", ErrCorruptZstd, regen)
+	}
+	data, jump := data[6:], data[:6]
+	for i := range 4 {
+		n := len(data)
+		if i < 3 {
+			n = int(binary.LittleEndian.Uint16(jump[2*i:]))
+		}
+		if n > len(data) {
+			return nil, 0, short
+		}
+		out := lits[i*seg : min((i+1)*seg, regen)]
+		if err := z.huff.decode(out, data[:n]); err != nil {
+			return nil, 0, err
+		}
+		data = data[n:]
+	}
+	return lits, hl + comp, nil
+}
+
+// sequences decodes the sequences section b and carries the sequences
+// out: each copies its literals from lits and then its match from hist.
+// The literals left after the last sequence end the block.
+func (z *zstdReader) sequences(b, lits []byte) error {
+	short := fmt.Errorf("%w: sequences section past the block", ErrCorruptZstd)
+	if len(b) == 0 {
+		return short
+	}
+	nb, k := int(b[0]), 1
+	switch {
+	case nb == 0:
+		if len(b) != 1 {
+			return fmt.Errorf("%w: data after an empty sequences section", ErrCorruptZstd)
+		}
+		z.hist = append(z.hist, lits...)
+		return nil
+	case nb == 255:
+		if len(b) < 3 {
+			return short
+		}
+		nb, k = int(b[1])|int(b[2])<<8+0x7f00, 3
+	case nb >= 128:
+		if len(b) < 2 {
+			return short
+		}
+		nb, k = (nb-128)<<8|int(b[1]), 2
+	}
+	if k >= len(b) {
+		return short
+	}
+	modes := b[k]
+	k++
+	if modes&3 != 0 {
+		return fmt.Errorf("%w: reserved sequence mode bits set", ErrCorruptZstd)
+	}
+	var err error
+	var n int
+	if z.ll, n, err = seqTable(b[k:], modes>>6, z.ll, zstdLLDefault, 35, 9); err != nil {
+		return err
+	}
+	k += n
+	if z.of, n, err = seqTable(b[k:], modes>>4&3, z.of, zstdOFDefault, 31, 8); err != nil {
+		return err
+	}
+	k += n
+	if z.ml, n, err = seqTable(b[k:], modes>>2&3, z.ml, zstdMLDefault, 52, 9); err != nil {
+		return err
+	}
+	k += n
+
+	var r backwardBits
+	if err := r.init(b[k:]); err != nil {
+		return err
+	}
+	var ll, of, ml fseState
+	ll.init(z.ll, &r)
+	of.init(z.of, &r)
+	ml.init(z.ml, &r)
+	start := len(z.hist)
+	for i := range nb {
+		ofCode, mlCode, llCode := of.symbol(), ml.symbol(), ll.symbol()
+		offVal := 1<<ofCode + int(r.read(int(ofCode)))
+		matchLen := int(zstdMLBase[mlCode] + r.read(int(zstdMLBits[mlCode])))
+		litLen := int(zstdLLBase[llCode] + r.read(int(zstdLLBits[llCode])))
+
+		var offset int
+		if offVal > 3 {
+			offset = offVal - 3
+			z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+		} else {
+			if litLen == 0 {
+				offVal++
+			}
+			switch offVal {
+			case 1:
+				offset = z.rep[0]
+			case 2:
+				offset = z.rep[1]
+				z.rep = [3]int{offset, z.rep[0], z.rep[2]}
+			case 3:
+				offset = z.rep[2]
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			case 4:
+				offset = z.rep[0] - 1
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			}
+		}
+		if i < nb-1 {
+			ll.update(&r)
+			ml.update(&r)
+			of.update(&r)
+		}
+
+		if litLen > len(lits) {
+			return fmt.Errorf("%w: sequence takes more literals than are left", ErrCorruptZstd)
+		}
+		if len(z.hist)-start+litLen+matchLen > z.maxBlock {
+			return fmt.Errorf("%w: block decodes to over %d bytes", ErrCorruptZstd, z.maxBlock)
+		}
+		z.hist = append(z.hist, lits[:litLen]...)
+		lits = lits[litLen:]
+		if offset <= 0 || offset > len(z.hist) || offset > z.window {
+			return fmt.Errorf("%w: match offset %d out of the window", ErrCorruptZstd, offset)
+		}
+		// Copy from a fixed start: each pass doubles what can be copied
+		// at once when the match overlaps itself
+		from := len(z.hist) - offset
+		for matchLen > 0 {
+			n := min(matchLen, len(z.hist)-from)
+			z.hist = append(z.hist, z.hist[from:from+n]...)
+			matchLen -= n
+		}
+	}
+	if !r.done() {
+		return fmt.Errorf("%w: sequence bit stream does not end with its sequences", ErrCorruptZstd)
+	}
+	if len(z.hist)-start+len(lits) > z.maxBlock {
+		return fmt.Errorf("%w: block decodes to over %d bytes", ErrCorruptZstd, z.maxBlock)
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+// seqTable returns the table a sequence code is decoded with, for the
+// compression mode in the block's modes byte, and the bytes its
+// description took from the start of b.
+func seqTable(b []byte, mode byte, last, predefined *fseTable, maxSymbol, maxLog int) (*fseTable, int, error) {
+	switch mode {
+	case 0:
+		return predefined, 0, nil
+	case 1:
+		if len(b) == 0 {
+			return nil, 0, fmt.Errorf("%w: sequences section past the block", ErrCorruptZstd)
+		}
+		if int(b[0]) > maxSymbol {
+			return nil, 0, fmt.Errorf("%w: RLE sequence code %d", ErrCorruptZstd, b[0])
+		}
+		return rleTable(b[0]), 1, nil
+	case 2:
+		return readFSETable(b, maxSymbol, maxLog)
+	}
+	if last == nil {
+		return nil, 0, fmt.Errorf("%w: repeated sequence table before any", ErrCorruptZstd)
+	}
+	return last, 0, nil
+}
+
+// readFull fills p from the input, reporting a short read as truncation.
+func (z *zstdReader) readFull(p []byte) error {
+	if _, err := io.ReadFull(z.r, p); err != nil {
+		return z.truncated(err)
+	}
+	return nil
+}
+
+// truncated turns the end of the input inside a frame into an error of
+// its own; other read errors pass through.
+func (z *zstdReader) truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated", ErrCorruptZstd)
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/ipcset"
+)
+
+// runInspect implements `ipcounter inspect`: check each ipcset file
+// written with -dump-format ipcset down to its checksum and print its
+// metadata and address count. The addresses are streamed, not loaded.
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter inspect <file.ipcset>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	for i, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		h, err := ipcset.Scan(f, nil)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("File: %s\n", path)
+		fmt.Printf("Format: ipcset version %s, %s\n", ipcset.Magic[6:], h.Encoding)
+		fmt.Printf("Addresses: %d\n", h.Count)
+		fmt.Printf("Source: %s\n", h.Source)
+		fmt.Printf("Created: %s\n", h.Created.Format(time.RFC3339))
+		names := make([]string, 0, len(h.Options))
+		for name := range h.Options {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Printf("Option: -%s=%s\n", name, h.Options[name])
+		}
+		fmt.Println("Checksum: ok")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package ipcount_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Every engine that reads lines once tallies the same forms: a line in
+// two forms is in both rows, a CIDR line adds its block, and an address
+// also written plainly somewhere is not among those only written
+// non-canonically.
+func TestCanonReport(t *testing.T) {
+	input := "1.2.3.4\n1.2.3.4 \n01.2.3.4\n\"5.6.7.8\"\n [9.9.9.9]\n9.9.9.9:80\n::ffff:7.7.7.7\n\t010.0.0.1\n10.1.0.0/30 \nbad\n"
+	want := []utils.CanonRow{
+		{Form: "whitespace", Lines: 4, Addresses: 7},
+		{Form: "leading zeros", Lines: 2, Addresses: 2},
+		{Form: "quoted", Lines: 1, Addresses: 1},
+		{Form: "bracketed", Lines: 1, Addresses: 1},
+		{Form: "port", Lines: 1, Addresses: 1},
+		{Form: "ipv4-mapped", Lines: 1, Addresses: 1},
+	}
+	const only = 8 // all but 1.2.3.4
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, e := range []struct {
+		name string
+		opts counter.Options
+	}{
+		{name: "naive"},
+		{name: "concurrent"},
+		{name: "concurrent", opts: counter.Options{Mmap: true}},
+		{name: "bucket"},
+		{name: "adaptive"},
+		{name: "roaring"},
+		{name: "extsort"},
+		{name: "kmv"},
+		{name: "hll"},
+		{name: "linear"},
+	} {
+		canon := new(utils.Canonical)
+		opts := e.opts
+		opts.TempDir = t.TempDir()
+		opts.Parse = utils.ParseOptions{Lenient: true, StripPort: true, Mapped: true, CIDR: true,
+			Relaxed: new(utils.Normalized), Canon: canon}
+		if _, err := ipcount.Count(context.Background(), ipcount.File(path),
+			ipcount.WithEngine(e.name), ipcount.WithOptions(opts), ipcount.WithLogger(discard)); err != nil {
+			t.Fatalf("%s %+v: %v", e.name, e.opts, err)
+		}
+		if got := canon.Rows(); !slices.Equal(got, want) {
+			t.Errorf("%s %+v: %v, want %v", e.name, e.opts, got, want)
+		}
+		if got := canon.NonCanonicalOnly(); got != only {
+			t.Errorf("%s %+v: %d only written non-canonically, want %d", e.name, e.opts, got, only)
+		}
+	}
+}
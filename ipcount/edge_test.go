@@ -0,0 +1,104 @@
+package ipcount_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Inputs with next to nothing in them, or with Windows line endings, a
+// BOM and no-break spaces, must count the same in every engine and every
+// way of reading a file, and a blank one must be reported as such instead
+// of read.
+func TestEdgeCaseInputs(t *testing.T) {
+	fixtures := []struct {
+		name   string
+		data   string
+		unique int64
+		lines  int64
+		blank  string // the input stat of the engines that skip a blank file
+	}{
+		{"empty", "", 0, 0, "empty, nothing to count"},
+		{"newlines", "\n\n\n", 0, 3, "3 blank lines, nothing to count"},
+		{"whitespace", " \t\r\n\n  ", 0, 3, "3 blank lines, nothing to count"},
+		{"single ip without newline", "1.2.3.4", 1, 1, ""},
+		{"single invalid line", "garbage\n", 0, 1, ""},
+		{"crlf", "1.2.3.4\r\n5.6.7.8\r\n\r\n1.2.3.4\r\n", 2, 4, ""},
+		{"crlf without final newline", "1.2.3.4\r\n5.6.7.8\r", 2, 2, ""},
+		{"bom with mixed endings", "\xef\xbb\xbf1.2.3.4\r\n5.6.7.8\n1.2.3.4\r\n\xc2\xa09.9.9.9\xc2\xa0\n\n5.6.7.8\r\n10.0.0.1", 4, 7, ""},
+	}
+	engines := []struct {
+		name  string
+		opts  counter.Options
+		lines bool // counts lines for the unique ratio
+		skip  bool // skips a blank file
+	}{
+		{name: "naive", lines: true, skip: true},
+		{name: "concurrent", lines: true, skip: true},
+		{name: "concurrent", opts: counter.Options{Mmap: true}, lines: true, skip: true},
+		{name: "concurrent", opts: counter.Options{Segmented: true}, lines: true, skip: true},
+		{name: "bucket", lines: true, skip: true},
+		{name: "bucket", opts: counter.Options{BucketMemBuffer: -1}, lines: true, skip: true},
+		{name: "auto", lines: true, skip: true},
+		{name: "adaptive", lines: true},
+		{name: "roaring", lines: true},
+		{name: "extsort", lines: true},
+		{name: "linear"},
+		{name: "kmv"},
+		{name: "hll"},
+		{name: "sample"},
+		{name: "all"},
+	}
+	dir := t.TempDir()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, f := range fixtures {
+		path := filepath.Join(dir, strings.ReplaceAll(f.name, " ", "-"))
+		if err := os.WriteFile(path, []byte(f.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range engines {
+			stats := &counter.Stats{}
+			opts := e.opts
+			opts.Shards = 64
+			opts.TempDir = filepath.Join(dir, "tmp")
+			opts.Parse = utils.ParseOptions{Lines: new(atomic.Int64)}
+			if err := os.MkdirAll(opts.TempDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			res, err := ipcount.Count(context.Background(), ipcount.File(path),
+				ipcount.WithEngine(e.name), ipcount.WithOptions(opts), ipcount.WithStats(stats), ipcount.WithLogger(discard))
+			if err != nil {
+				t.Errorf("%s, %s %+v: %v", f.name, e.name, e.opts, err)
+				continue
+			}
+			if res.Unique != f.unique {
+				t.Errorf("%s, %s %+v: %d unique, want %d", f.name, e.name, e.opts, res.Unique, f.unique)
+			}
+			if e.lines && res.Lines != f.lines {
+				t.Errorf("%s, %s %+v: %d lines, want %d", f.name, e.name, e.opts, res.Lines, f.lines)
+			}
+			if !e.skip || f.blank == "" {
+				continue
+			}
+			got := stats.String() + "\n"
+			if want := "input: " + f.blank + "\n"; !strings.Contains(got, want) {
+				t.Errorf("%s, %s %+v: stats lack %q:\n%s", f.name, e.name, e.opts, want, got)
+			}
+			if e.name == "bucket" && !strings.Contains(got, "bucket pass 2: skipped") {
+				t.Errorf("%s, %s %+v: pass 2 was not skipped:\n%s", f.name, e.name, e.opts, got)
+			}
+		}
+	}
+	if left, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(left) > 0 {
+		t.Errorf("%d spill dirs left behind", len(left))
+	}
+}
@@ -0,0 +1,105 @@
+package ipcount_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+func ExampleCount() {
+	dir, err := os.MkdirTemp("", "ipcount")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	if err := os.WriteFile(path, []byte("10.0.0.1\n10.0.0.2\n10.0.0.1\n192.168.1.1\n"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	res, err := ipcount.Count(context.Background(), ipcount.File(path),
+		ipcount.WithEngine("concurrent"), ipcount.WithShards(64))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("unique:", res.Unique)
+	// Output: unique: 3
+}
+
+func ExampleCount_files() {
+	dir, err := os.MkdirTemp("", "ipcount")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	day1 := filepath.Join(dir, "day1.log")
+	day2 := filepath.Join(dir, "day2.log")
+	if err := os.WriteFile(day1, []byte("10.0.0.1\n10.0.0.2\n"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(day2, []byte("10.0.0.2\n10.0.0.3\n"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	missing := filepath.Join(dir, "day3.log")
+	res, err := ipcount.Count(context.Background(), ipcount.Files(day1, day2, missing),
+		ipcount.WithEngine("bucket"), ipcount.WithTempDir(dir), ipcount.WithBucketWorkers(2),
+		ipcount.WithSkipFailed())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("unique:", res.Unique)
+	for _, s := range res.Skipped {
+		fmt.Println("skipped:", filepath.Base(s.Name))
+	}
+	// Output:
+	// unique: 3
+	// skipped: day3.log
+}
+
+// A data-quality gate: a feed that repeats one record fails the ratio
+// bound, and the values checked are there for a policy of one's own.
+func ExampleCount_thresholds() {
+	feed := strings.Repeat("10.0.0.1\n", 999) + "# exporter v2\n10.0.0.2\n"
+	parse := utils.ParseOptions{CommentPrefix: "#", Lines: new(atomic.Int64)}
+	res, err := ipcount.Count(context.Background(), ipcount.Reader(strings.NewReader(feed)),
+		ipcount.WithEngine("naive"), ipcount.WithParse(parse))
+	if err != nil {
+		log.Fatal(err)
+	}
+	u := res.Uniqueness()
+	fmt.Printf("%d unique of %d lines\n", u.Unique, u.Lines)
+	gate := counter.Thresholds{MinUnique: 1, MinRatio: 0.005}
+	fmt.Println(gate.Check(u))
+	// Output:
+	// 2 unique of 1001 lines
+	// unique ratio 0.001998 (2 unique of 1001 lines) is below the minimum of 0.005
+}
+
+// Every engine is a counter.Counter of files, and all but sample are also
+// a counter.ReaderCounter of streams, so a program can embed one without
+// the ipcount package.
+func Example_engine() {
+	c, err := counter.NewWithOptions("bucket", counter.Options{TempDir: os.TempDir()})
+	if err != nil {
+		log.Fatal(err)
+	}
+	rc, ok := c.(counter.ReaderCounter)
+	if !ok {
+		log.Fatal("bucket cannot count a stream")
+	}
+	n, err := rc.CountReader(context.Background(), strings.NewReader("10.0.0.1\n10.0.0.2\n10.0.0.1\n"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("unique:", n)
+	// Output: unique: 2
+}
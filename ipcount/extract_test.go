@@ -0,0 +1,46 @@
+package ipcount_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// An extractor picks the address out of every line for each engine,
+// whichever way it splits and parses its input.
+func TestWithExtractor(t *testing.T) {
+	var b strings.Builder
+	for i := range 20000 {
+		fmt.Fprintf(&b, `{"seq":%d,"ip":"10.0.%d.%d","ua":"x, y"}`+"\n", i, i%300/256, i%300%256)
+	}
+	b.WriteString("{\"seq\":-1}\n")
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	field := []byte(`"ip":"`)
+	extract := func(line []byte) ([]byte, bool) {
+		_, rest, ok := bytes.Cut(line, field)
+		if !ok {
+			return nil, false
+		}
+		addr, _, ok := bytes.Cut(rest, []byte(`"`))
+		return addr, ok
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, engine := range []string{"naive", "concurrent", "bucket", "adaptive", "reference"} {
+		res, err := ipcount.Count(context.Background(), ipcount.File(path),
+			ipcount.WithEngine(engine), ipcount.WithLogger(discard), ipcount.WithTempDir(t.TempDir()), ipcount.WithExtractor(extract))
+		if err != nil || res.Unique != 300 {
+			t.Errorf("%s: %d, %v, want 300", engine, res.Unique, err)
+		}
+	}
+}
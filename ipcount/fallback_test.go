@@ -0,0 +1,79 @@
+package ipcount_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// An input spread over more shards than the budget allows makes
+// concurrent stop; a Fallback then recounts a file or a seekable reader
+// with bucket, without counting the aborted run's lines, and fails like
+// concurrent on a stream it cannot rewind.
+func TestFallback(t *testing.T) {
+	rng := rand.New(rand.NewPCG(11, 12))
+	var b strings.Builder
+	seen := make(map[uint32]bool)
+	const lines = 50000
+	for range lines {
+		ip := rng.Uint32()
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	input := b.String()
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newFallback := func() (*counter.Fallback, *counter.Stats, *atomic.Int64) {
+		stats, n := &counter.Stats{}, new(atomic.Int64)
+		return counter.NewFallback(counter.Options{MaxMem: 16 << 20, Shards: 1024, ChunkSize: 4096, QueueDepth: 1,
+			AutoFallback: true, TempDir: t.TempDir(), Stats: stats, Logger: discard,
+			Parse: utils.ParseOptions{Lines: n}}), stats, n
+	}
+
+	for _, tc := range []struct {
+		name  string
+		count func(f *counter.Fallback) (int64, error)
+	}{
+		{"file", func(f *counter.Fallback) (int64, error) { return f.CountUniqueIPs(path) }},
+		{"reader", func(f *counter.Fallback) (int64, error) {
+			return f.CountReader(context.Background(), strings.NewReader(input))
+		}},
+		{"ipcount", func(f *counter.Fallback) (int64, error) {
+			res, err := ipcount.Count(context.Background(), ipcount.File(path), ipcount.WithCounter(f))
+			return res.Unique, err
+		}},
+	} {
+		f, stats, n := newFallback()
+		got, err := tc.count(f)
+		if err != nil || got != int64(len(seen)) {
+			t.Errorf("%s: %d, %v, want %d", tc.name, got, err, len(seen))
+		}
+		if !f.FellBack() || f.Counter() == nil || !strings.Contains(stats.String(), "auto fallback: concurrent stopped") {
+			t.Errorf("%s: did not fall back:\n%s", tc.name, stats)
+		}
+		if n.Load() != lines {
+			t.Errorf("%s: %d lines, want %d", tc.name, n.Load(), lines)
+		}
+	}
+
+	f, _, _ := newFallback()
+	stream := io.MultiReader(strings.NewReader(input))
+	if _, err := f.CountReader(context.Background(), stream); !errors.Is(err, counter.ErrMemBudget) || f.FellBack() {
+		t.Errorf("stream: %v, fell back %v, want ErrMemBudget", err, f.FellBack())
+	}
+}
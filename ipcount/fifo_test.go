@@ -0,0 +1,82 @@
+//go:build linux || darwin
+
+package ipcount_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// Every engine counts a named pipe, which has no size and can be read
+// only once, as it counts the same lines in a regular file, reading the
+// pipe directly or spooling it first.
+func TestFIFO(t *testing.T) {
+	var b strings.Builder
+	for i := range 20000 {
+		fmt.Fprintf(&b, "10.%d.%d.1\n", i%5000>>8, i%5000&0xff)
+	}
+	input := b.String()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, name := range counter.Names() {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "in.txt")
+		if err := os.WriteFile(file, []byte(input), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want, err := ipcount.Count(context.Background(), ipcount.File(file),
+			ipcount.WithEngine(name), ipcount.WithTempDir(dir), ipcount.WithLogger(discard))
+		if err != nil {
+			t.Errorf("%s, regular file: %v", name, err)
+			continue
+		}
+		fifo := filepath.Join(dir, "in.fifo")
+		if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		written := make(chan error, 1)
+		go func() {
+			f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+			if err != nil {
+				written <- err
+				return
+			}
+			_, err = io.WriteString(f, input)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			written <- err
+		}()
+
+		res, err := ipcount.Count(context.Background(), ipcount.File(fifo),
+			ipcount.WithEngine(name), ipcount.WithTempDir(dir), ipcount.WithLogger(discard))
+		// Let a writer the engine never read from finish
+		if f, ferr := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0); ferr == nil {
+			f.Close()
+		}
+		werr := <-written
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if werr != nil {
+			t.Errorf("%s: writing the pipe: %v", name, werr)
+		}
+		if name == "concurrent" && res.Unique != 5000 {
+			t.Errorf("%s: %d unique, want 5000", name, res.Unique)
+		}
+		if res.Unique != want.Unique || res.Lines != want.Lines {
+			t.Errorf("%s: %d unique in %d lines, %d in %d from a regular file", name, res.Unique, res.Lines, want.Unique, want.Lines)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package ipcount_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A filter keeps the addresses outside it out of every engine's count,
+// those that parse lines in one pass and binary input included, without
+// making their lines malformed.
+func TestFilter(t *testing.T) {
+	var b strings.Builder
+	var packed []byte
+	for i := range 20000 {
+		ip := uint32(10)<<24 | uint32(i%500)
+		if i%2 == 1 {
+			ip = uint32(192)<<24 | 168<<16 | uint32(i%700)
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+		packed = binary.BigEndian.AppendUint32(packed, ip)
+	}
+	dir := t.TempDir()
+	text, bin := filepath.Join(dir, "in.txt"), filepath.Join(dir, "in.bin")
+	if err := os.WriteFile(text, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bin, packed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The even lines hold 250 addresses of 10.0.0.0/8, the odd ones 350
+	// of 192.168.0.0/16
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tc := range []struct {
+		include, exclude string
+		want, filtered   int64
+	}{
+		{"10.0.0.0/8", "", 250, 10000},
+		{"", "10.0.0.0/8", 350, 10000},
+		{"", "10.0.0.0/8,192.168.0.0/22", 0, 20000},
+	} {
+		include, err := utils.ParsePrefixes(tc.include)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exclude, err := utils.ParsePrefixes(tc.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, engine := range []string{"naive", "concurrent", "bucket", "adaptive", "roaring", "extsort", "reference", "concurrent binary"} {
+			filter, err := utils.NewFilter(include, exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := counter.Options{TempDir: t.TempDir(), Parse: utils.ParseOptions{Filter: filter, Malformed: &utils.Malformed{}}}
+			path := text
+			if engine == "concurrent binary" {
+				engine, path, opts.InputFormat = "concurrent", bin, "binary-be"
+			}
+			res, err := ipcount.Count(context.Background(), ipcount.File(path),
+				ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithLogger(discard))
+			if err != nil || res.Unique != tc.want {
+				t.Errorf("%s %v: %d, %v, want %d", engine, tc, res.Unique, err, tc.want)
+			}
+			if n := opts.Parse.Malformed.Lines(); n != 0 || filter.Lines() != tc.filtered {
+				t.Errorf("%s %v: %d lines filtered and %d malformed, want %d and none", engine, tc, filter.Lines(), n, tc.filtered)
+			}
+		}
+	}
+}
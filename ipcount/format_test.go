@@ -0,0 +1,48 @@
+package ipcount_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The first and last addresses, 0.0.0.0 and 255.255.255.255, count in
+// every engine whichever way they are written, and the one past the last
+// is malformed rather than wrapped around to 0.0.0.0.
+func TestBoundaryAddresses(t *testing.T) {
+	dir := t.TempDir()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tc := range []struct {
+		format utils.IPFormat
+		input  string
+	}{
+		{utils.FormatDotted, "0.0.0.0\n255.255.255.255\n0.0.0.0\n255.255.255.255\n256.0.0.0\n"},
+		{utils.FormatInt, "0\n4294967295\n4294967296\n0\n"},
+		{utils.FormatHex, "0x0\n0xFFFFFFFF\n0x100000000\nffffffff\n"},
+		{utils.FormatAuto, "0.0.0.0\n4294967295\n0xffffffff\n4294967296\n0\n"},
+	} {
+		path := filepath.Join(dir, "in.txt")
+		if err := os.WriteFile(path, []byte(tc.input), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, engine := range []string{"naive", "concurrent", "bucket", "adaptive", "roaring", "extsort", "reference", "auto"} {
+			malformed := &utils.Malformed{}
+			opts := counter.Options{Parse: utils.ParseOptions{Format: tc.format, Malformed: malformed}, TempDir: dir}
+			res, err := ipcount.Count(context.Background(), ipcount.File(path),
+				ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithLogger(discard))
+			if err != nil {
+				t.Fatalf("format %d, %s: %v", tc.format, engine, err)
+			}
+			if res.Unique != 2 || malformed.Lines() != 1 {
+				t.Errorf("format %d, %s: %d unique, %d malformed; want 2 and 1", tc.format, engine, res.Unique, malformed.Lines())
+			}
+		}
+	}
+}
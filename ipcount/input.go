@@ -0,0 +1,541 @@
+package ipcount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/input"
+)
+
+// inputOptions configures how countInput opens what it is given, from
+// the Options passed to Count.
+type inputOptions struct {
+	s3       input.S3Options
+	member   string         // glob filter on tar members, "" for all
+	parallel int            // inputs read at once, <= 1 for one after another
+	stats    *counter.Stats // receives per-file and per-member counts, nil to discard
+	skip     *skipList      // with several inputs, collects those that fail instead of aborting; nil to abort
+	progress io.Writer      // with several inputs, reports each as it is opened; nil for none
+	delim    byte           // what records end in, for joining inputs and counting lines
+	binary   bool           // inputs are packed 4-byte records, joined as they are
+	pcap     bool           // inputs are packet captures, decoded to binary records
+	field    input.PcapField
+	throttle *counter.Limiter // caps the bytes read from all inputs together, nil for none
+	noCache  bool             // drop local files' pages from the page cache behind the read position
+
+	parquet string                       // inputs are Parquet files and this their column of addresses, "" otherwise
+	parse   func([]byte) (uint32, error) // reads a Parquet string value as an address
+}
+
+// countInput runs c on filename, streaming it when it is an http(s) URL,
+// an s3:// object, Stdin, a compressed file or a tar archive. Only engines
+// that can count a reader take those.
+func countInput(ctx context.Context, c counter.Counter, impl, filename string, o inputOptions) (int64, error) {
+	if o.parquet != "" {
+		return countParquet(ctx, c, impl, []string{filename}, o)
+	}
+	isTar, err := isTarInput(filename)
+	if err != nil {
+		return 0, err
+	}
+	if o.member != "" && !isTar {
+		return 0, fmt.Errorf("-member needs a tar archive, got %s", filename)
+	}
+	codec := input.Uncompressed
+	if !isStream(filename) && !isTar {
+		if codec, err = input.FileCodec(filename); err != nil {
+			return 0, err
+		}
+	}
+	if !isStream(filename) && !isTar && codec == input.Uncompressed && !o.pcap && o.throttle == nil {
+		return counter.Count(ctx, c, filename)
+	}
+	rc, ok := c.(counter.ReaderCounter)
+	if !ok && o.throttle != nil {
+		return 0, fmt.Errorf("-impl %s reads the file itself and cannot be throttled with -max-read-mbps", impl)
+	}
+	if !ok {
+		return 0, fmt.Errorf("-impl %s cannot read a stream such as a URL, compressed file or tar archive; extract, decompress or download the input first", impl)
+	}
+	r, err := openInput(ctx, filename, isTar, o)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return rc.CountReader(ctx, r)
+}
+
+// countInputs runs c on the union of several inputs: one after another as
+// a single stream, or with o.parallel > 1 that many at once into the
+// engine's shared set. -stats gets the lines and bytes read from each.
+// With o.skip, an input that cannot be opened or read is recorded there
+// and counted as far as it was read, and the others carry on.
+func countInputs(ctx context.Context, c counter.Counter, impl string, filenames []string, o inputOptions) (int64, error) {
+	if o.parquet != "" {
+		return countParquet(ctx, c, impl, filenames, o)
+	}
+	inputs := make([]counter.Input, 0, len(filenames))
+	for i, name := range filenames {
+		size, isTar, err := inspectInput(name, o)
+		if err != nil {
+			if o.skip == nil {
+				return 0, err
+			}
+			o.skip.add(name, err)
+			continue
+		}
+		inputs = append(inputs, counter.Input{Name: name, Index: i, Size: size, Open: func() (io.ReadCloser, error) {
+			if o.progress != nil {
+				fmt.Fprintf(o.progress, "file %d/%d: %s\n", i+1, len(filenames), name)
+			}
+			r, err := openInput(ctx, name, isTar, o)
+			if err != nil {
+				if o.skip == nil || ctx.Err() != nil {
+					return nil, err
+				}
+				o.skip.add(name, err)
+				return io.NopCloser(strings.NewReader("")), nil
+			}
+			return &fileStats{r: r, name: name, start: time.Now(), stats: o.stats, skip: o.skip, ctx: ctx, delim: o.delim}, nil
+		}})
+	}
+
+	if o.parallel > 1 {
+		pc, ok := c.(counter.ParallelCounter)
+		if !ok {
+			return 0, fmt.Errorf("-parallel-files needs -impl auto, concurrent or bucket, got %s", impl)
+		}
+		return pc.CountParallel(ctx, inputs, o.parallel)
+	}
+	rc, ok := c.(counter.ReaderCounter)
+	if !ok {
+		return 0, fmt.Errorf("-impl %s counts a single file", impl)
+	}
+	s := input.NewConcat(inputs)
+	s.SetDelim(o.delim)
+	if o.binary {
+		s.SetRaw()
+	}
+	defer s.Close()
+	return rc.CountReader(ctx, s)
+}
+
+// countParquet runs c on column o.parquet of local Parquet files. Every
+// footer is read first, so a missing column or an unsupported type fails
+// before any page is; then each row group is an input of its own, and a
+// ParallelCounter decodes up to a CPU's worth of them at once, or
+// o.parallel if that is more. -stats gets the values read from each file.
+func countParquet(ctx context.Context, c counter.Counter, impl string, filenames []string, o inputOptions) (int64, error) {
+	if o.throttle != nil {
+		return 0, errors.New("-max-read-mbps cannot throttle -input-format parquet")
+	}
+	var inputs []counter.Input
+	var files []*parquetInput
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range filenames {
+		f, err := openParquet(name, o)
+		if err != nil {
+			if o.skip == nil {
+				return 0, err
+			}
+			o.skip.add(name, err)
+			continue
+		}
+		files = append(files, f)
+		for i := range f.pf.RowGroups() {
+			inputs = append(inputs, counter.Input{
+				Name:  fmt.Sprintf("%s row group %d", name, i),
+				Index: len(inputs),
+				Size:  f.pf.RowGroupSize(i),
+				Open: func() (io.ReadCloser, error) {
+					return io.NopCloser(&parquetRowGroup{r: f.pf.RowGroup(i), name: name, group: i}), nil
+				},
+			})
+		}
+	}
+
+	if pc, ok := c.(counter.ParallelCounter); ok {
+		return pc.CountParallel(ctx, inputs, max(o.parallel, min(runtime.NumCPU(), len(inputs))))
+	}
+	rc, ok := c.(counter.ReaderCounter)
+	if !ok {
+		return 0, fmt.Errorf("-input-format parquet needs -impl concurrent, got %s", impl)
+	}
+	s := input.NewConcat(inputs)
+	s.SetRaw()
+	defer s.Close()
+	return rc.CountReader(ctx, s)
+}
+
+// openParquet opens the local Parquet file name and reads its footer.
+func openParquet(name string, o inputOptions) (*parquetInput, error) {
+	if IsRemote(name) {
+		return nil, fmt.Errorf("%s: -input-format parquet reads local files only; download it first", name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, &counter.OpenError{Path: name, Err: err}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, &counter.OpenError{Path: name, Err: err}
+	}
+	pf, err := input.OpenParquet(f, fi.Size(), o.parquet, o.parse)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &parquetInput{pf: pf, f: f, name: name, stats: o.stats}, nil
+}
+
+// parquetInput is an open Parquet file; closing it records the values
+// its row groups decoded in stats.
+type parquetInput struct {
+	pf    *input.ParquetFile
+	f     *os.File
+	name  string
+	stats *counter.Stats
+}
+
+func (p *parquetInput) Close() error {
+	st := p.pf.Stats()
+	p.stats.Set("values of "+p.name, "%d row groups, %d addresses, %d null, %d malformed",
+		st.RowGroups, st.Values, st.Nulls, st.Malformed)
+	return p.f.Close()
+}
+
+// parquetRowGroup prefixes the errors of a row group with where it is.
+type parquetRowGroup struct {
+	r     io.Reader
+	name  string
+	group int
+}
+
+func (g *parquetRowGroup) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%s: row group %d: %w", g.name, g.group, err)
+	}
+	return n, err
+}
+
+// inspectInput checks name before any input is read and returns its size,
+// -1 for a stream or a compressed file, and whether it is a tar archive.
+func inspectInput(name string, o inputOptions) (size int64, isTar bool, err error) {
+	if isTar, err = isTarInput(name); err != nil {
+		return 0, false, err
+	}
+	if o.member != "" && !isTar {
+		return 0, false, fmt.Errorf("-member needs a tar archive, got %s", name)
+	}
+	size = -1
+	if !isStream(name) && !isTar {
+		codec, err := input.FileCodec(name)
+		if err != nil {
+			return 0, false, err
+		}
+		if codec != input.Uncompressed {
+			return size, false, nil
+		}
+		if size, err = counter.InputSize(name); err != nil {
+			return 0, false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return size, isTar, nil
+}
+
+// IsRemote reports whether name is an http(s) URL or an s3:// object
+// rather than a local path.
+func IsRemote(name string) bool {
+	return input.IsURL(name) || input.IsS3(name)
+}
+
+// isStream reports whether name is read as a stream rather than a local
+// file: a remote input or Stdin.
+func isStream(name string) bool {
+	return name == Stdin || IsRemote(name)
+}
+
+// isTarInput reports whether name is a tar archive, by name for remote
+// inputs and also by content for local files. Stdin is never taken for
+// one, since looking would consume it.
+func isTarInput(name string) (bool, error) {
+	if name == Stdin {
+		return false, nil
+	}
+	if IsRemote(name) {
+		return input.IsTarName(name), nil
+	}
+	return input.IsTar(name)
+}
+
+// openInput opens name as a stream: a URL, an S3 object, Stdin or a local
+// file, decompressed when it starts with the magic of a codec, and read
+// member by member when it is a tar archive.
+func openInput(ctx context.Context, name string, isTar bool, o inputOptions) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case input.IsS3(name):
+		r, err = input.OpenS3(ctx, name, o.s3)
+	case input.IsURL(name):
+		r, err = input.OpenURL(ctx, name, o.s3.HTTPOptions)
+	case name == Stdin:
+		r = io.NopCloser(newStdinReader(ctx, os.Stdin))
+	default:
+		if r, err = os.Open(name); err != nil {
+			err = &counter.OpenError{Path: name, Err: err}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := r.(*os.File); ok && o.noCache {
+		r = wrapInput(r, func(r io.Reader) io.Reader { return counter.DropBehind(f, 0, r) })
+	}
+	if o.throttle != nil {
+		r = wrapInput(r, func(r io.Reader) io.Reader { return counter.ThrottleReader(ctx, r, o.throttle) })
+	}
+	if !isTar {
+		// A tar archive is decompressed by its TarStream
+		zr, codec, err := input.Decompress(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if codec == input.Uncompressed {
+			r = wrapInput(r, func(io.Reader) io.Reader { return zr })
+		} else {
+			r = &wrappedInput{r: zr, c: r, size: -1} // the size decompressed is unknown
+		}
+	}
+	if o.pcap {
+		if isTar {
+			r.Close()
+			return nil, fmt.Errorf("%s: -input-format pcap cannot read a tar archive; extract the captures first", name)
+		}
+		ps, err := input.NewPcapStream(r, o.field)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return &pcapInput{ps: ps, c: r, name: name, stats: o.stats}, nil
+	}
+	if !isTar {
+		return r, nil
+	}
+	ts, err := input.NewTarStream(r, o.member)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	ts.SetDelim(o.delim)
+	if o.binary {
+		ts.SetRaw()
+	}
+	return &tarInput{ts: ts, c: r, name: name, stats: o.stats}, nil
+}
+
+// wrappedInput is an input read through another reader, such as the
+// -max-read-mbps limiter. It keeps the input's size, a local file's or a
+// stream's Size, so auto still picks an engine by it.
+type wrappedInput struct {
+	r    io.Reader
+	c    io.Closer
+	size int64
+}
+
+func wrapInput(r io.ReadCloser, wrap func(io.Reader) io.Reader) *wrappedInput {
+	size := int64(-1)
+	switch s := r.(type) {
+	case interface{ Size() int64 }:
+		size = s.Size()
+	case *os.File:
+		if st, err := s.Stat(); err == nil && st.Mode().IsRegular() {
+			size = st.Size()
+		}
+	}
+	return &wrappedInput{r: wrap(r), c: r, size: size}
+}
+
+func (w *wrappedInput) Read(p []byte) (int, error) { return w.r.Read(p) }
+
+func (w *wrappedInput) Close() error { return w.c.Close() }
+
+func (w *wrappedInput) Size() int64 { return w.size }
+
+// stdinReader reads Stdin in a goroutine of its own, so a count waiting
+// on a pipe or terminal that has nothing more to say yet stops when ctx
+// is canceled, as on an interrupt, rather than when the next bytes
+// arrive. The goroutine reads one buffer ahead and stays blocked after a
+// cancellation; Stdin is read once per process, so it is not missed.
+type stdinReader struct {
+	ctx  context.Context
+	next chan stdinRead
+	buf  []byte
+	err  error
+}
+
+type stdinRead struct {
+	b   []byte
+	err error
+}
+
+func newStdinReader(ctx context.Context, r io.Reader) *stdinReader {
+	s := &stdinReader{ctx: ctx, next: make(chan stdinRead)}
+	go func() {
+		for {
+			b := make([]byte, 64<<10)
+			n, err := r.Read(b)
+			select {
+			case s.next <- stdinRead{b[:n], err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *stdinReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		select {
+		case next := <-s.next:
+			s.buf, s.err = next.b, next.err
+		case <-s.ctx.Done():
+			return 0, s.ctx.Err()
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// tarInput is an open archive; closing it records its members in stats.
+type tarInput struct {
+	ts    *input.TarStream
+	c     io.Closer
+	name  string
+	stats *counter.Stats
+}
+
+func (t *tarInput) Read(p []byte) (int, error) {
+	n, err := t.ts.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%s: %w", t.name, err)
+	}
+	return n, err
+}
+
+func (t *tarInput) Close() error {
+	for _, m := range t.ts.Members() {
+		t.stats.Set("member "+m.Name, "%d lines, %s", m.Lines, counter.FormatBytes(m.Bytes))
+	}
+	t.stats.Set("members of "+t.name, "%d read, %d skipped", len(t.ts.Members()), t.ts.Skipped())
+	return t.c.Close()
+}
+
+// pcapInput is an open capture; closing it records its packet counts in
+// stats.
+type pcapInput struct {
+	ps    *input.PcapStream
+	c     io.Closer
+	name  string
+	stats *counter.Stats
+}
+
+func (p *pcapInput) Read(b []byte) (int, error) {
+	n, err := p.ps.Read(b)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%s: %w", p.name, err)
+	}
+	return n, err
+}
+
+func (p *pcapInput) Close() error {
+	st := p.ps.Stats()
+	p.stats.Set("packets of "+p.name, "%d read, %d IPv4, %d other, %d malformed", st.Packets, st.IPv4, st.Other, st.Malformed)
+	return p.c.Close()
+}
+
+// Skipped is a source left out of a count by WithSkipFailed, and why.
+type Skipped struct {
+	Name string
+	Err  error
+}
+
+// skipList collects the inputs skipped during a count. Inputs read in
+// parallel add to it concurrently.
+type skipList struct {
+	mu      sync.Mutex
+	entries []Skipped
+}
+
+func (l *skipList) add(name string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, Skipped{name, err})
+}
+
+// fileStats counts the lines and bytes read from one of several inputs
+// and records them in stats when it is closed. Read errors are prefixed
+// with the input's name, since several may be open at once; with skip
+// they end the input instead and are recorded there.
+type fileStats struct {
+	r     io.ReadCloser
+	name  string
+	start time.Time
+	lines int64
+	bytes int64
+	last  byte
+	delim byte
+	stats *counter.Stats
+	skip  *skipList
+	ctx   context.Context
+}
+
+func (f *fileStats) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.bytes += int64(n)
+	f.lines += int64(bytes.Count(p[:n], []byte{f.delim}))
+	if n > 0 {
+		f.last = p[n-1]
+	}
+	if err != nil && err != io.EOF {
+		if f.skip != nil && f.ctx.Err() == nil {
+			f.skip.add(f.name, fmt.Errorf("after %s: %w", counter.FormatBytes(f.bytes), err))
+			return n, io.EOF
+		}
+		err = fmt.Errorf("%s: %w", f.name, err)
+	}
+	return n, err
+}
+
+func (f *fileStats) Close() error {
+	if f.bytes > 0 && f.last != f.delim {
+		f.lines++
+	}
+	f.stats.Set("file "+f.name, "%d lines, %s in %s", f.lines, counter.FormatBytes(f.bytes),
+		time.Since(f.start).Round(time.Millisecond))
+	return f.r.Close()
+}
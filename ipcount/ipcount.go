@@ -0,0 +1,443 @@
+// Package ipcount is the stable entry point for counting unique IPv4
+// addresses from another program. Count opens a source the way the CLI
+// does, a local file, an http(s) URL, an s3:// object or a tar archive of
+// any of them, and runs an engine on it:
+//
+//	res, err := ipcount.Count(ctx, ipcount.File("access.log"),
+//		ipcount.WithEngine("concurrent"), ipcount.WithShards(4096))
+//
+// The engines stay in their own packages, registered with package
+// counter; Options reach them as counter.Options, so every engine knob
+// the CLI has is available through WithOptions.
+package ipcount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/input"
+	"github.com/Sveta-1999/IPCounter/utils"
+
+	// Every engine, so WithEngine can name any of them
+	_ "github.com/Sveta-1999/IPCounter/adaptive"
+	_ "github.com/Sveta-1999/IPCounter/bucket"
+	_ "github.com/Sveta-1999/IPCounter/concurrent"
+	_ "github.com/Sveta-1999/IPCounter/extsort"
+	_ "github.com/Sveta-1999/IPCounter/group"
+	_ "github.com/Sveta-1999/IPCounter/hll"
+	_ "github.com/Sveta-1999/IPCounter/ipv6"
+	_ "github.com/Sveta-1999/IPCounter/kmv"
+	_ "github.com/Sveta-1999/IPCounter/linear"
+	_ "github.com/Sveta-1999/IPCounter/naive"
+	_ "github.com/Sveta-1999/IPCounter/pair"
+	_ "github.com/Sveta-1999/IPCounter/reference"
+	_ "github.com/Sveta-1999/IPCounter/roaring"
+	_ "github.com/Sveta-1999/IPCounter/sample"
+	_ "github.com/Sveta-1999/IPCounter/window"
+)
+
+// Source is what Count reads: one input, several read into one set, or
+// an already open stream.
+type Source struct {
+	names   []string
+	several bool
+	r       io.Reader
+}
+
+// Stdin is the name File and Files take for the standard input, which is
+// streamed like a URL.
+const Stdin = "-"
+
+// File is a single local path, http(s) URL, s3:// object or Stdin. Local
+// files are handed to the engine by name, so it can map or split them;
+// the rest are streamed. A tar archive is read member by member.
+func File(name string) Source {
+	return Source{names: []string{name}}
+}
+
+// Files is the union of several inputs, each of them as File takes it,
+// read one after another or with WithParallelFiles several at once. Even
+// a single name is counted this way, with per-file statistics.
+func Files(names ...string) Source {
+	return Source{names: names, several: true}
+}
+
+// Reader is a stream such as a pipe, which only engines that can count a
+// stream take.
+func Reader(r io.Reader) Source {
+	return Source{r: r}
+}
+
+// Result is the outcome of a successful Count.
+type Result struct {
+	Unique   int64   // distinct addresses, or their estimate with Estimate
+	Estimate bool    // the engine estimates, such as linear or kmv
+	StdError float64 // standard error of an estimate, 0 for an exact count
+	Lines    int64   // lines read, when Parse.Lines counted them; 0 otherwise
+
+	// Phases is what each phase of the count did and how long it took,
+	// with WithPhases or WithProgressFunc.
+	Phases []counter.PhaseTime
+
+	// Skipped lists the sources WithSkipFailed left out, in the order
+	// they failed.
+	Skipped []Skipped
+
+	// Sources is what each of several sources contributed, in source
+	// order, when the engine tallies them; concurrent does.
+	Sources []counter.SourceTally
+
+	// Counter is the engine that counted, for follow-up queries such as
+	// breakdowns, prefix sweeps or the auto selection. A
+	// *concurrent.BitsetCounter holding a state file or mapping must be
+	// closed by the caller.
+	Counter counter.Counter
+}
+
+// Uniqueness returns the values counter.Thresholds are checked against.
+func (r Result) Uniqueness() counter.Uniqueness {
+	return counter.Uniqueness{Unique: r.Unique, Lines: r.Lines}
+}
+
+// Option configures Count.
+type Option func(*config)
+
+type config struct {
+	engine    string
+	opts      counter.Options
+	counter   counter.Counter
+	limiter   *counter.Limiter
+	skip      bool
+	forceText bool
+	in        inputOptions
+
+	progress []progressFunc
+	phases   bool
+}
+
+// progressFunc is a WithProgressFunc: fn called every interval.
+type progressFunc struct {
+	every time.Duration
+	fn    func(counter.ProgressReport)
+}
+
+// WithEngine selects the engine registered under name; the default is
+// auto, which picks one from the input size and free memory.
+func WithEngine(name string) Option {
+	return func(c *config) { c.engine = name }
+}
+
+// WithCounter counts with c instead of a new engine, such as one that
+// has loaded a snapshot or is reused across calls; engine options are
+// then c's own. WithEngine still names it in errors.
+func WithCounter(c counter.Counter) Option {
+	return func(cfg *config) { cfg.counter = c }
+}
+
+// WithOptions sets every engine option at once. Options given after it
+// change single fields.
+func WithOptions(o counter.Options) Option {
+	return func(c *config) { c.opts = o }
+}
+
+// WithShards sets the concurrent engine's bitset partitions, a power of
+// two.
+func WithShards(n int) Option {
+	return func(c *config) { c.opts.Shards = n }
+}
+
+// WithBucketWorkers sets how many buckets the bucket engine counts at
+// once in pass 2.
+func WithBucketWorkers(n int) Option {
+	return func(c *config) { c.opts.BucketWorkers = n }
+}
+
+// WithTempDir sets where the bucket engine spills and where streams that
+// must be read twice are copied to.
+func WithTempDir(dir string) Option {
+	return func(c *config) { c.opts.TempDir = dir }
+}
+
+// WithMaxMem sets a memory budget in bytes, as counter.Options.MaxMem.
+func WithMaxMem(n int64) Option {
+	return func(c *config) { c.opts.MaxMem = n }
+}
+
+// WithAddressSpace declares the IPv4 block every address is in, such as
+// 100.64.0.0/10, as counter.Options.AddressSpace: the concurrent engine
+// sizes its bitset to the block and skips addresses outside it.
+func WithAddressSpace(p netip.Prefix) Option {
+	return func(c *config) { c.opts.AddressSpace = p }
+}
+
+// WithParse sets which lines are read as addresses: formats, ports,
+// CIDR blocks, comments and the like.
+func WithParse(p utils.ParseOptions) Option {
+	return func(c *config) { c.opts.Parse = p }
+}
+
+// WithExtractor makes every engine read each line's address from the
+// part of it fn returns, as Parse.Extract, such as a field of a JSON
+// event; lines fn returns false for are skipped as malformed. fn is
+// called from several goroutines at once.
+func WithExtractor(fn utils.Extractor) Option {
+	return func(c *config) { c.opts.Parse.Extract = fn }
+}
+
+// WithStats collects run statistics in s, from the engine and from
+// opening the inputs.
+func WithStats(s *counter.Stats) Option {
+	return func(c *config) { c.opts.Stats = s }
+}
+
+// WithLogger sends warnings and events to l instead of slog.Default().
+func WithLogger(l *slog.Logger) Option {
+	return func(c *config) { c.opts.Logger = l }
+}
+
+// WithReadLimiter caps the bytes read with l, which may be shared by
+// several calls, instead of a limiter of Options.MaxReadRate per call.
+func WithReadLimiter(l *counter.Limiter) Option {
+	return func(c *config) { c.limiter = l }
+}
+
+// WithParallelFiles reads up to n of Files at once into one set, with
+// engines that can.
+func WithParallelFiles(n int) Option {
+	return func(c *config) { c.in.parallel = n }
+}
+
+// WithSkipFailed makes a source of Files that cannot be opened or read
+// be left out, as far as it was read, instead of failing the count; the
+// failures are in Result.Skipped.
+func WithSkipFailed() Option {
+	return func(c *config) { c.skip = true }
+}
+
+// WithForceText counts local files that do not look like delimited text
+// at the start, which otherwise fail the count with a NotTextError.
+func WithForceText() Option {
+	return func(c *config) { c.forceText = true }
+}
+
+// WithProgress writes a line to w as each of Files is opened.
+func WithProgress(w io.Writer) Option {
+	return func(c *config) { c.in.progress = w }
+}
+
+// WithProgressFunc calls fn every interval while the count runs, and
+// once more when it ends, with how far it has got: the bytes read of
+// the inputs' total, when their sizes are known, lines, the unique count
+// so far where the engine keeps one, and an estimate of the time left;
+// for the bucket engine, pass 1's bytes and then pass 2's buckets. fn
+// runs on a goroutine of its own. Every engine but sample reports; one
+// given with WithCounter only if built with counter.Options.Progress.
+// Given more than once, each fn follows the same count at its own
+// interval.
+func WithProgressFunc(interval time.Duration, fn func(counter.ProgressReport)) Option {
+	return func(c *config) {
+		if fn != nil && interval > 0 {
+			c.progress = append(c.progress, progressFunc{interval, fn})
+		}
+	}
+}
+
+// WithPhases times the phases of the count for Result.Phases, following
+// the engine as WithProgressFunc does but without reports. The engines
+// that count lines only for it, concurrent among them, then count them.
+func WithPhases() Option {
+	return func(c *config) { c.phases = true }
+}
+
+// WithS3 sets the region, credentials and HTTP behavior for s3:// and
+// http(s) sources.
+func WithS3(o input.S3Options) Option {
+	return func(c *config) { c.in.s3 = o }
+}
+
+// WithMember counts only the tar members whose name or base name match
+// glob.
+func WithMember(glob string) Option {
+	return func(c *config) { c.in.member = glob }
+}
+
+// WithPcap reads the sources as pcap or pcapng captures and counts field
+// of every IPv4 packet.
+func WithPcap(field input.PcapField) Option {
+	return func(c *config) { c.in.pcap, c.in.field = true, field }
+}
+
+// WithParquet reads the sources as Parquet files and counts the addresses
+// in column, a string or integer column; a nested one is named by its
+// dotted path. Only local files can be read.
+func WithParquet(column string) Option {
+	return func(c *config) { c.in.parquet = column }
+}
+
+// Count counts the distinct addresses in src. Once ctx is canceled it
+// stops and returns ctx.Err(). A local file that does not look like
+// delimited text at the start fails it with a counter.NotTextError, see
+// WithForceText.
+func Count(ctx context.Context, src Source, opts ...Option) (Result, error) {
+	cfg := config{engine: "auto", in: inputOptions{parallel: 1}}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	if cfg.in.pcap || cfg.in.parquet != "" {
+		// Captures and Parquet columns are decoded to packed addresses
+		// before the engine
+		cfg.opts.InputFormat = "binary-be"
+	}
+	var skip *skipList
+	if cfg.skip {
+		skip = &skipList{}
+	}
+	if src.r == nil {
+		sniffSkip := skip
+		if !src.several {
+			sniffSkip = nil
+		}
+		var err error
+		if src.names, err = sniffInputs(src.names, &cfg, sniffSkip); err != nil {
+			return Result{}, err
+		}
+	}
+	if len(cfg.progress) > 0 {
+		p := counter.NewProgress(progressTotal(src, cfg.in))
+		cfg.opts.Progress = p
+		reportCtx, stop := context.WithCancel(ctx)
+		var reported sync.WaitGroup
+		for _, pf := range cfg.progress {
+			reported.Add(1)
+			go func() {
+				defer reported.Done()
+				p.Report(reportCtx, pf.every, pf.fn)
+			}()
+		}
+		defer func() {
+			stop()
+			reported.Wait()
+		}()
+	} else if cfg.phases {
+		cfg.opts.Progress = counter.NewProgress(-1)
+	}
+	c := cfg.counter
+	if c == nil {
+		var err error
+		if c, err = counter.NewWithOptions(cfg.engine, cfg.opts); err != nil {
+			return Result{}, err
+		}
+	}
+	in := cfg.in
+	in.stats = cfg.opts.Stats
+	in.delim = cfg.opts.Parse.Delim()
+	in.binary = counter.BinaryOrder(cfg.opts.InputFormat) != nil
+	in.noCache = cfg.opts.NoCache
+	in.parse = cfg.opts.Parse.Parse
+	in.throttle = cfg.limiter
+	if in.throttle == nil {
+		in.throttle = counter.NewLimiter(cfg.opts.MaxReadRate)
+	}
+	if in.s3.Logger == nil {
+		in.s3.Logger = cfg.opts.Logger
+	}
+	in.skip = skip
+
+	start := time.Now()
+	var n int64
+	var err error
+	switch {
+	case src.r != nil:
+		rc, ok := c.(counter.ReaderCounter)
+		if !ok {
+			return Result{}, fmt.Errorf("-impl %s counts a file and cannot read a stream", cfg.engine)
+		}
+		n, err = rc.CountReader(ctx, src.r)
+	case len(src.names) == 0 && in.skip != nil && len(in.skip.entries) > 0:
+		// Every input was left out when sniffed
+	case len(src.names) == 0:
+		return Result{}, errors.New("no source to count")
+	case src.several:
+		n, err = countInputs(ctx, c, cfg.engine, src.names, in)
+	default:
+		n, err = countInput(ctx, c, cfg.engine, src.names[0], in)
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		return Result{}, err
+	}
+
+	res := Result{Unique: n, Counter: c}
+	if in.skip != nil {
+		res.Skipped = in.skip.entries
+	}
+	if e, ok := c.(counter.Estimator); ok {
+		res.Estimate, res.StdError = true, e.StdError()
+	}
+	if sc, ok := c.(counter.SourceCounter); ok {
+		res.Sources = sc.Sources()
+	}
+	stats := cfg.opts.Stats
+	if in.throttle != nil && cfg.limiter == nil {
+		read, _ := in.throttle.Totals()
+		stats.Set("read throttle", "%s; %s/s over the run", in.throttle,
+			counter.FormatBytes(int64(float64(read)/max(elapsed.Seconds(), 1e-3))))
+	}
+	if _, all := c.(*counter.Verify); !all {
+		// -impl all parses the input once per engine
+		p := cfg.opts.Parse
+		if p.Comments != nil {
+			stats.Set("comment lines", "%d", p.Comments.Load())
+		}
+		if p.Filter != nil {
+			stats.Set("filtered lines", "%d", p.Filter.Lines())
+		}
+		if p.Relaxed != nil {
+			stats.Set("relaxed lines", "%d indented, %d blank, %d quoted, %d bracketed",
+				p.Relaxed.Indented.Load(), p.Relaxed.Blank.Load(), p.Relaxed.Quoted.Load(), p.Relaxed.Bracketed.Load())
+		}
+	}
+	if p := cfg.opts.Progress; p != nil {
+		res.Phases = p.Phases()
+	}
+	if p := cfg.opts.Parse.Lines; p != nil {
+		res.Lines = p.Load()
+		stats.Set("unique ratio", "%s", res.Uniqueness())
+	}
+	return res, nil
+}
+
+// progressTotal returns the bytes of src an engine will read, -1 when any
+// of it is a stream or a compressed file or tar archive, whose size
+// decompressed or unpacked is only known at the end, or is decoded from
+// captures or Parquet.
+func progressTotal(src Source, in inputOptions) int64 {
+	if in.pcap || in.parquet != "" {
+		return -1
+	}
+	if src.r != nil {
+		if s, ok := src.r.(interface{ Size() int64 }); ok {
+			return s.Size()
+		}
+		return -1
+	}
+	var total int64
+	for _, name := range src.names {
+		size, _, err := inspectInput(name, in)
+		if err != nil || size < 0 {
+			return -1
+		}
+		total += size
+	}
+	return total
+}
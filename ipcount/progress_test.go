@@ -0,0 +1,88 @@
+package ipcount_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// The last progress report of a count has read the whole file, in the
+// bucket engine's last pass done all of its work, and counts what the
+// count found.
+func TestProgressFunc(t *testing.T) {
+	data := "1.2.3.4\n5.6.7.8\n1.2.3.4\n9.9.9.9\n"
+	path := filepath.Join(t.TempDir(), "addrs.log")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, engine := range []string{"naive", "concurrent", "bucket", "kmv"} {
+		var last counter.ProgressReport
+		reports := 0
+		opts := counter.Options{TempDir: t.TempDir()}
+		res, err := ipcount.Count(context.Background(), ipcount.File(path),
+			ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithLogger(discard),
+			ipcount.WithProgressFunc(time.Hour, func(r counter.ProgressReport) {
+				last = r
+				reports++
+			}))
+		if err != nil || res.Unique != 3 {
+			t.Fatalf("%s: %d, %v; want 3", engine, res.Unique, err)
+		}
+		if reports != 1 {
+			t.Errorf("%s: %d reports, want the last one only", engine, reports)
+		}
+		if last.Total < 0 || last.Done != last.Total {
+			t.Errorf("%s: %s, want all of the work done", engine, last)
+		}
+		if last.Phase == "reading" || last.Phase == "pass 1" {
+			if last.Total != int64(len(data)) {
+				t.Errorf("%s: %s, want %d bytes", engine, last, len(data))
+			}
+		}
+		if engine != "kmv" && last.Unique != 3 {
+			t.Errorf("%s: %s, want 3 unique", engine, last)
+		}
+	}
+}
+
+// WithPhases times every phase of a count: one that read the whole file,
+// and for the bucket engine a second that counted its buckets.
+func TestWithPhases(t *testing.T) {
+	data := "1.2.3.4\n5.6.7.8\n1.2.3.4\n9.9.9.9\n"
+	path := filepath.Join(t.TempDir(), "addrs.log")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, engine := range []string{"naive", "concurrent", "bucket", "hll"} {
+		opts := counter.Options{TempDir: t.TempDir()}
+		res, err := ipcount.Count(context.Background(), ipcount.File(path),
+			ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithLogger(discard), ipcount.WithPhases())
+		if err != nil || res.Unique != 3 {
+			t.Fatalf("%s: %d, %v; want 3", engine, res.Unique, err)
+		}
+		want := []string{"reading"}
+		if engine == "bucket" {
+			want = []string{"pass 1", "pass 2"}
+		}
+		if len(res.Phases) != len(want) {
+			t.Fatalf("%s: phases %+v, want %v", engine, res.Phases, want)
+		}
+		for i, p := range res.Phases {
+			if p.Name != want[i] || p.Elapsed <= 0 {
+				t.Errorf("%s: phase %d is %+v, want %s", engine, i, p, want[i])
+			}
+		}
+		if p := res.Phases[0]; p.Unit != "bytes" || p.Done != int64(len(data)) {
+			t.Errorf("%s: first phase %+v, want %d bytes", engine, p, len(data))
+		}
+	}
+}
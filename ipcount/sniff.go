@@ -0,0 +1,103 @@
+package ipcount
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/input"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// sniffInputs looks at the start of each local file of names before any
+// engine reads one, and returns the names to count. An input that does
+// not look like delimited text fails the count, or with skip is recorded
+// there and left out, unless the config forces text. When every input is
+// NUL-separated and no delimiter was asked for, NUL becomes the delimiter.
+// -stats gets the framing found.
+func sniffInputs(names []string, cfg *config, skip *skipList) ([]string, error) {
+	if counter.BinaryOrder(cfg.opts.InputFormat) != nil {
+		return names, nil
+	}
+	type sniffed struct {
+		name string
+		f    input.Framing
+	}
+	var found []sniffed
+	for _, name := range names {
+		if isStream(name) {
+			continue
+		}
+		// Errors opening an input are left for the count to report, or
+		// skip, as for any other input
+		if isTar, err := isTarInput(name); err != nil || isTar {
+			continue
+		}
+		f, ok, err := input.SniffFile(name, cfg.opts.Parse.Delim())
+		if err != nil || !ok {
+			continue
+		}
+		found = append(found, sniffed{name, f})
+	}
+	if len(found) == 0 {
+		return names, nil
+	}
+
+	nul := true
+	for _, s := range found {
+		nul = nul && s.f.Delim == 0
+	}
+	if nul && cfg.opts.Parse.RecordSep == "" && cfg.counter == nil && len(found) == len(names) {
+		cfg.opts.Parse.RecordSep = "\x00"
+		counter.Logger(cfg.opts.Logger).Info("input is NUL-separated; counting NUL-delimited records", "input", found[0].name)
+	}
+
+	maxLine := cmp.Or(cfg.opts.MaxLine, utils.DefaultMaxLine)
+	var left map[string]bool
+	var framings []string
+	inputs := make(map[string]int)
+	for _, s := range found {
+		reason := s.f.Text(maxLine)
+		if reason == "" && s.f.Delim != cfg.opts.Parse.Delim() {
+			reason = "its records end in NUL, not newlines"
+		}
+		if reason != "" && !cfg.forceText {
+			err := &counter.NotTextError{Path: s.name, Reason: reason}
+			if skip == nil {
+				return nil, err
+			}
+			skip.add(s.name, err)
+			if left == nil {
+				left = make(map[string]bool)
+			}
+			left[s.name] = true
+			continue
+		}
+		framing := s.f.String()
+		if inputs[framing] == 0 {
+			framings = append(framings, framing)
+		}
+		inputs[framing]++
+	}
+
+	if len(framings) == 1 {
+		cfg.opts.Stats.Set("input framing", "%s", framings[0])
+	} else if len(framings) > 1 {
+		parts := make([]string, len(framings))
+		for i, framing := range framings {
+			parts[i] = fmt.Sprintf("%d %s", inputs[framing], framing)
+		}
+		cfg.opts.Stats.Set("input framing", "%s", strings.Join(parts, ", "))
+	}
+	if left == nil {
+		return names, nil
+	}
+	kept := make([]string, 0, len(names)-len(left))
+	for _, name := range names {
+		if !left[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,108 @@
+package ipcount_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// A binary input fails the count before any engine reads it unless text
+// is forced, a NUL-separated one is counted by its NULs, and a text file
+// of LF and CRLF lines passes without a word logged.
+func TestSniffInputs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rng := rand.New(rand.NewPCG(5, 6))
+	random := make([]byte, 100<<10)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+	binary := write("addrs.bin", random)
+	nul := write("addrs.nul", []byte("1.2.3.4\x005.6.7.8\x001.2.3.4\x009.9.9.9\x00"))
+	text := write("addrs.txt", []byte("1.2.3.4\n5.6.7.8\r\n1.2.3.4\n"))
+
+	var logged bytes.Buffer
+	warn := slog.New(slog.NewTextHandler(&logged, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	for _, engine := range []string{"naive", "concurrent", "bucket"} {
+		opts := counter.Options{TempDir: dir}
+		_, err := ipcount.Count(context.Background(), ipcount.File(binary),
+			ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithLogger(warn))
+		var nt *counter.NotTextError
+		if !errors.Is(err, counter.ErrNotText) || !errors.As(err, &nt) || nt.Path != binary {
+			t.Errorf("%s, binary input: %v, want a NotTextError", engine, err)
+		}
+		logged.Reset()
+
+		stats := &counter.Stats{}
+		res, err := ipcount.Count(context.Background(), ipcount.File(nul),
+			ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithStats(stats), ipcount.WithLogger(warn))
+		if err != nil || res.Unique != 3 {
+			t.Errorf("%s, NUL-separated input: %d, %v; want 3", engine, res.Unique, err)
+		}
+		if got := stats.Map()["input framing"]; got != "NUL-separated" {
+			t.Errorf("%s, NUL-separated input: framing %q", engine, got)
+		}
+
+		stats = &counter.Stats{}
+		res, err = ipcount.Count(context.Background(), ipcount.File(text),
+			ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithStats(stats), ipcount.WithLogger(warn))
+		if err != nil || res.Unique != 2 {
+			t.Errorf("%s, text input: %d, %v; want 2", engine, res.Unique, err)
+		}
+		if got := stats.Map()["input framing"]; got != "mixed LF and CRLF" {
+			t.Errorf("%s, text input: framing %q", engine, got)
+		}
+		if logged.Len() > 0 {
+			t.Errorf("%s: warnings on NUL-separated or text input:\n%s", engine, logged.String())
+		}
+	}
+
+	// Forced, the binary input is read as lines, none of them addresses
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if res, err := ipcount.Count(context.Background(), ipcount.File(binary), ipcount.WithForceText(), ipcount.WithLogger(discard)); err != nil || res.Unique != 0 {
+		t.Errorf("forced binary input: %d, %v; want 0", res.Unique, err)
+	}
+	// Among several inputs, skip leaves it out
+	res, err := ipcount.Count(context.Background(), ipcount.Files(text, binary), ipcount.WithSkipFailed(), ipcount.WithLogger(discard))
+	if err != nil || res.Unique != 2 || len(res.Skipped) != 1 || !errors.Is(res.Skipped[0].Err, counter.ErrNotText) {
+		t.Errorf("skipping binary input: %d, %v, %v", res.Unique, res.Skipped, err)
+	}
+}
+
+// A compressed input is sniffed and counted by what it decompresses to,
+// whatever its name, by the engines that map or split plain files too.
+func TestCompressedInput(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("1.2.3.4\n5.6.7.8\n1.2.3.4\n9.9.9.9\n"))
+	w.Close()
+	path := filepath.Join(t.TempDir(), "addrs.log")
+	if err := os.WriteFile(path, gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, engine := range []string{"naive", "concurrent", "bucket"} {
+		opts := counter.Options{TempDir: t.TempDir(), Mmap: true}
+		res, err := ipcount.Count(context.Background(), ipcount.File(path),
+			ipcount.WithEngine(engine), ipcount.WithOptions(opts), ipcount.WithLogger(discard))
+		if err != nil || res.Unique != 3 {
+			t.Errorf("%s: %d, %v; want 3", engine, res.Unique, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package ipcount_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// Several files counted into one set report what each contributed, read
+// one after another or in parallel, with chunks small enough that some
+// straddle two files.
+func TestSourceTallies(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, from, to, invalidEvery int) (string, int64, int64) {
+		var b strings.Builder
+		var lines, invalid int64
+		for k := from; k < to; k++ {
+			fmt.Fprintf(&b, "10.0.%d.%d\n", k/256, k%256)
+			lines++
+			if invalidEvery > 0 && k%invalidEvery == 0 {
+				b.WriteString("not an address\n")
+				lines++
+				invalid++
+			}
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path, lines, invalid
+	}
+	a, aLines, aInvalid := write("a.txt", 0, 1000, 100)
+	b, bLines, bInvalid := write("b.txt", 500, 2000, 200)
+	// c repeats one address
+	var rep strings.Builder
+	for range 600 {
+		rep.WriteString("10.9.9.9\n")
+	}
+	c := filepath.Join(dir, "c.txt")
+	if err := os.WriteFile(c, []byte(rep.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := []counter.SourceTally{
+		{Source: counter.Source{Name: a, Index: 0}, Lines: aLines, Invalid: aInvalid, New: 1000},
+		{Source: counter.Source{Name: b, Index: 1}, Lines: bLines, Invalid: bInvalid, New: 1000},
+		{Source: counter.Source{Name: c, Index: 2}, Lines: 600, New: 1},
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, parallel := range []int{0, 3} {
+		stats := &counter.Stats{}
+		res, err := ipcount.Count(context.Background(), ipcount.Files(a, b, c),
+			ipcount.WithEngine("concurrent"), ipcount.WithOptions(counter.Options{Shards: 64, ChunkSize: concurrent.MinChunkSize}),
+			ipcount.WithParallelFiles(parallel), ipcount.WithStats(stats), ipcount.WithLogger(discard))
+		if err != nil {
+			t.Fatalf("parallel %d: %v", parallel, err)
+		}
+		if res.Unique != 2001 {
+			t.Errorf("parallel %d: %d unique, want 2001", parallel, res.Unique)
+		}
+		if len(res.Sources) != len(want) {
+			t.Fatalf("parallel %d: %d sources, want %d: %+v", parallel, len(res.Sources), len(want), res.Sources)
+		}
+		var sum int64
+		for i, got := range res.Sources {
+			w := want[i]
+			sum += got.New
+			if parallel > 1 {
+				// Which file first saw an address the others share is a race
+				w.New = got.New
+			}
+			if got != w {
+				t.Errorf("parallel %d: source %d is %+v, want %+v", parallel, i, got, w)
+			}
+		}
+		if sum != res.Unique {
+			t.Errorf("parallel %d: sources add up to %d new, want %d", parallel, sum, res.Unique)
+		}
+		if got := stats.Sources(); len(got) != len(want) {
+			t.Errorf("parallel %d: stats hold %d sources, want %d", parallel, len(got), len(want))
+		}
+	}
+
+	// OnNewIPFrom names the file each new address came from
+	var mu sync.Mutex
+	from := make(map[uint32]counter.Source)
+	bc, err := concurrent.NewWithOptions(concurrent.Options{Shards: 64, ChunkSize: concurrent.MinChunkSize,
+		OnNewIPFrom: func(ip uint32, src counter.Source) {
+			mu.Lock()
+			defer mu.Unlock()
+			if prev, ok := from[ip]; ok {
+				t.Errorf("%#x reported twice, from %v and %v", ip, prev, src)
+			}
+			from[ip] = src
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipcount.Count(context.Background(), ipcount.Files(a, b, c), ipcount.WithCounter(bc), ipcount.WithLogger(discard)); err != nil {
+		t.Fatal(err)
+	}
+	per := make([]int64, len(want))
+	for ip, src := range from {
+		per[src.Index]++
+		k := int(ip - 10<<24)
+		wantIndex := 0
+		switch {
+		case ip == 10<<24|9<<16|9<<8|9:
+			wantIndex = 2
+		case k >= 1000:
+			wantIndex = 1
+		}
+		if src.Index != wantIndex || src.Name != want[wantIndex].Name {
+			t.Errorf("%#x reported from %+v, want source %d", ip, src, wantIndex)
+		}
+	}
+	for i, n := range per {
+		if n != want[i].New {
+			t.Errorf("%d new addresses reported from source %d, want %d", n, i, want[i].New)
+		}
+	}
+}
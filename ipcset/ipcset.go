@@ -0,0 +1,242 @@
+// Package ipcset reads and writes the ipcset export format, a sorted set
+// of IPv4 addresses that describes itself and carries its own checksum,
+// so a set shipped between hosts can be checked for truncation or
+// corruption before it is used.
+//
+// A file is the magic, whose last two bytes are the format version; the
+// address count as a little-endian uint64; the payload encoding as one
+// byte; the length of the metadata as a little-endian uint32 and the
+// metadata itself as JSON; the payload; and a CRC-32C of everything
+// before it as a little-endian uint32. The payload holds the addresses in
+// ascending order, either as big-endian uint32s (Raw) or, since they are
+// sorted, the first address and then the gap to each next one as
+// unsigned varints (Delta), about 1 to 3 bytes an address for dense sets.
+package ipcset
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// Magic starts every ipcset file; its last two bytes are the version.
+const Magic = "ipcdmp01"
+
+// maxMeta bounds the metadata a reader accepts, so a corrupt length does
+// not make it allocate gigabytes.
+const maxMeta = 1 << 20
+
+// ErrBadSet is returned for a file that is truncated, corrupt or written
+// by another format version.
+var ErrBadSet = errors.New("bad ipcset file")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Encoding is how the payload stores the addresses.
+type Encoding byte
+
+const (
+	Raw   Encoding = 0 // 4-byte big-endian addresses
+	Delta Encoding = 1 // unsigned varints: the first address, then each gap
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case Raw:
+		return "raw"
+	case Delta:
+		return "delta-varint"
+	}
+	return fmt.Sprintf("encoding %d", byte(e))
+}
+
+// Header describes a set: how many addresses it has, how they are
+// stored, and where they came from.
+type Header struct {
+	Count    uint64   `json:"-"`
+	Encoding Encoding `json:"-"`
+
+	Source  string            `json:"source,omitempty"`  // the input, or inputs, counted
+	Created time.Time         `json:"created"`           // when the set was written
+	Options map[string]string `json:"options,omitempty"` // the settings it was counted with, by flag name
+}
+
+// Writer writes a set to an underlying writer: the header on creation,
+// then each address passed to Add, then the checksum on Close.
+type Writer struct {
+	bw   *bufio.Writer
+	w    io.Writer
+	sum  hash.Hash32
+	h    Header
+	n    uint64
+	prev uint32
+	buf  [binary.MaxVarintLen64]byte
+}
+
+// NewWriter writes h to w and returns a Writer for its h.Count addresses.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.Encoding != Raw && h.Encoding != Delta {
+		return nil, fmt.Errorf("ipcset: unknown %s", h.Encoding)
+	}
+	meta, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	sw := &Writer{w: w, sum: crc32.New(crc32c), h: h}
+	sw.bw = bufio.NewWriterSize(io.MultiWriter(w, sw.sum), 64<<10)
+	sw.bw.WriteString(Magic)
+	binary.Write(sw.bw, binary.LittleEndian, h.Count)
+	sw.bw.WriteByte(byte(h.Encoding))
+	binary.Write(sw.bw, binary.LittleEndian, uint32(len(meta)))
+	sw.bw.Write(meta)
+	return sw, nil
+}
+
+// Add appends ip, which must be above every address added before it.
+func (w *Writer) Add(ip uint32) error {
+	if w.n > 0 && ip <= w.prev {
+		return fmt.Errorf("ipcset: %d added after %d; addresses must ascend", ip, w.prev)
+	}
+	if w.n == w.h.Count {
+		return fmt.Errorf("ipcset: more than the %d addresses of the header", w.h.Count)
+	}
+	if w.h.Encoding == Raw {
+		binary.BigEndian.PutUint32(w.buf[:4], ip)
+		w.bw.Write(w.buf[:4])
+	} else {
+		gap := ip
+		if w.n > 0 {
+			gap = ip - w.prev
+		}
+		w.bw.Write(binary.AppendUvarint(w.buf[:0], uint64(gap)))
+	}
+	w.prev = ip
+	w.n++
+	return nil
+}
+
+// Close writes the checksum once the header's count of addresses was
+// added. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.n != w.h.Count {
+		return fmt.Errorf("ipcset: %d addresses added, the header says %d", w.n, w.h.Count)
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.w.Write(binary.LittleEndian.AppendUint32(nil, w.sum.Sum32()))
+	return err
+}
+
+// Scan reads the set in r, calling fn, if set, with each address in
+// ascending order, and returns its header. It holds one address at a
+// time, and checks the whole file: the order, the count, the checksum
+// and that nothing follows it. On error fn may have seen part of the set.
+func Scan(r io.Reader, fn func(ip uint32)) (Header, error) {
+	var h Header
+	in := &summer{br: bufio.NewReaderSize(r, 64<<10), sum: crc32.New(crc32c)}
+
+	fixed := make([]byte, len(Magic)+8+1+4)
+	if _, err := io.ReadFull(in, fixed); err != nil {
+		return h, fmt.Errorf("%w: short header: %v", ErrBadSet, err)
+	}
+	if magic := string(fixed[:len(Magic)]); magic != Magic {
+		if strings.HasPrefix(magic, Magic[:6]) {
+			return h, fmt.Errorf("%w: format version %s, this build reads %s", ErrBadSet, magic[6:], Magic[6:])
+		}
+		return h, fmt.Errorf("%w: not an ipcset file (magic %q)", ErrBadSet, magic)
+	}
+	rest := fixed[len(Magic):]
+	h.Count = binary.LittleEndian.Uint64(rest)
+	h.Encoding = Encoding(rest[8])
+	metaLen := binary.LittleEndian.Uint32(rest[9:])
+	if h.Count > 1<<32 {
+		return h, fmt.Errorf("%w: %d addresses", ErrBadSet, h.Count)
+	}
+	if h.Encoding != Raw && h.Encoding != Delta {
+		return h, fmt.Errorf("%w: unknown %s", ErrBadSet, h.Encoding)
+	}
+	if metaLen > maxMeta {
+		return h, fmt.Errorf("%w: %d bytes of metadata", ErrBadSet, metaLen)
+	}
+	meta := make([]byte, metaLen)
+	if _, err := io.ReadFull(in, meta); err != nil {
+		return h, fmt.Errorf("%w: short metadata: %v", ErrBadSet, err)
+	}
+	if err := json.Unmarshal(meta, &h); err != nil {
+		return h, fmt.Errorf("%w: metadata: %v", ErrBadSet, err)
+	}
+
+	var (
+		prev uint64
+		raw  [4]byte
+	)
+	for i := range h.Count {
+		var ip uint64
+		if h.Encoding == Raw {
+			if _, err := io.ReadFull(in, raw[:]); err != nil {
+				return h, fmt.Errorf("%w: address %d of %d: %v", ErrBadSet, i+1, h.Count, err)
+			}
+			ip = uint64(binary.BigEndian.Uint32(raw[:]))
+		} else {
+			gap, err := binary.ReadUvarint(in)
+			if err != nil {
+				return h, fmt.Errorf("%w: address %d of %d: %v", ErrBadSet, i+1, h.Count, err)
+			}
+			if gap >= 1<<32 || (i > 0 && gap == 0) {
+				return h, fmt.Errorf("%w: address %d of %d out of order", ErrBadSet, i+1, h.Count)
+			}
+			ip = prev + gap
+			if i == 0 {
+				ip = gap
+			}
+		}
+		if ip > 1<<32-1 || (i > 0 && ip <= prev) {
+			return h, fmt.Errorf("%w: address %d of %d out of order", ErrBadSet, i+1, h.Count)
+		}
+		prev = ip
+		if fn != nil {
+			fn(uint32(ip))
+		}
+	}
+
+	want := in.sum.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(in.br, trailer[:]); err != nil {
+		return h, fmt.Errorf("%w: missing checksum: %v", ErrBadSet, err)
+	}
+	if got := binary.LittleEndian.Uint32(trailer[:]); got != want {
+		return h, fmt.Errorf("%w: checksum %08x, want %08x", ErrBadSet, got, want)
+	}
+	if _, err := in.br.ReadByte(); err != io.EOF {
+		return h, fmt.Errorf("%w: trailing data", ErrBadSet)
+	}
+	return h, nil
+}
+
+// summer reads through br, adding every byte it hands out to sum.
+type summer struct {
+	br  *bufio.Reader
+	sum hash.Hash32
+}
+
+func (s *summer) Read(p []byte) (int, error) {
+	n, err := s.br.Read(p)
+	s.sum.Write(p[:n])
+	return n, err
+}
+
+func (s *summer) ReadByte() (byte, error) {
+	c, err := s.br.ReadByte()
+	if err == nil {
+		s.sum.Write([]byte{c})
+	}
+	return c, err
+}
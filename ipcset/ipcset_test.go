@@ -0,0 +1,113 @@
+package ipcset
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A set written in either encoding reads back address for address with
+// its metadata, including the ends of the address space and no
+// addresses at all.
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	set := []uint32{0, 1, 255, 1 << 24, 0xffffffff}
+	for range 10000 {
+		set = append(set, rng.Uint32())
+	}
+	slices.Sort(set)
+	set = slices.Compact(set)
+
+	for _, enc := range []Encoding{Raw, Delta} {
+		for _, ips := range [][]uint32{set, nil} {
+			want := Header{
+				Count: uint64(len(ips)), Encoding: enc, Source: "access.log",
+				Created: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+				Options: map[string]string{"expand-cidr": "true"},
+			}
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range ips {
+				if err := w.Add(ip); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var got []uint32
+			h, err := Scan(&buf, func(ip uint32) { got = append(got, ip) })
+			if err != nil {
+				t.Fatalf("%s, %d addresses: %v", enc, len(ips), err)
+			}
+			if !slices.Equal(got, ips) {
+				t.Errorf("%s: read %d addresses back, want %d", enc, len(got), len(ips))
+			}
+			if h.Count != want.Count || h.Encoding != enc || h.Source != want.Source ||
+				!h.Created.Equal(want.Created) || h.Options["expand-cidr"] != "true" {
+				t.Errorf("%s: header %+v, want %+v", enc, h, want)
+			}
+		}
+	}
+}
+
+// Truncation, a flipped bit anywhere, trailing bytes and another version
+// are all caught, and the writer refuses addresses out of order or
+// beyond the header's count.
+func TestCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{Count: 1000, Encoding: Delta, Source: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range uint32(1000) {
+		if err := w.Add(i * 7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	for n := range len(good) {
+		if _, err := Scan(bytes.NewReader(good[:n]), nil); !errors.Is(err, ErrBadSet) {
+			t.Fatalf("truncated to %d of %d bytes: %v", n, len(good), err)
+		}
+	}
+	for i := range good {
+		bad := bytes.Clone(good)
+		bad[i] ^= 0x10
+		if _, err := Scan(bytes.NewReader(bad), nil); !errors.Is(err, ErrBadSet) {
+			t.Fatalf("byte %d flipped: %v", i, err)
+		}
+	}
+	if _, err := Scan(bytes.NewReader(append(bytes.Clone(good), 0)), nil); !errors.Is(err, ErrBadSet) {
+		t.Errorf("trailing byte: %v", err)
+	}
+	future := bytes.Clone(good)
+	copy(future[6:8], "02")
+	if _, err := Scan(bytes.NewReader(future), nil); !errors.Is(err, ErrBadSet) {
+		t.Errorf("version 02: %v", err)
+	}
+
+	w, err = NewWriter(&bytes.Buffer{}, Header{Count: 2, Encoding: Raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(5); err == nil {
+		t.Error("a repeated address was accepted")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("closed with fewer addresses than the header's count")
+	}
+}
@@ -0,0 +1,416 @@
+// Package ipv6 counts distinct IPv6 addresses, or IPv6 and IPv4 addresses
+// together. An address is a 128-bit key, far past what a bitset of the
+// space could hold, so addresses go into a hash set while there are few;
+// past Threshold they are spread by hash over the partitions of a
+// bucket.RecordSpill on disk, and each partition is counted on its own by
+// sorting, as the pair engine counts its pairs.
+package ipv6
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	// DefaultThreshold is the hash set size at which addresses start
+	// going to disk: about 200 MB of map.
+	DefaultThreshold = 1 << 22
+
+	// DefaultPartitions is how many partitions spilled addresses are
+	// spread over; pass 2 sorts one at a time per worker, 1/256 of them.
+	DefaultPartitions = 256
+
+	bytesPerChunk    = 2 * 1024 * 1024 // read chunk size
+	stageSize        = 4 * 1024        // per-partition batch before a write to the spill
+	ctxCheckLines    = 1 << 16         // lines between cancellation checks
+	recordSize       = 16              // a spilled address, big-endian
+	defaultMaxWorker = 8               // beyond this pass 2 is usually disk-bound
+)
+
+// ErrNotIPv6 is the error of a line with less than two colons, such as
+// an IPv4 address, to FamilyIPv6.
+var ErrNotIPv6 = errors.New("not an IPv6 address")
+
+var colon = []byte{':'}
+
+// Family is which addresses a count takes.
+type Family int
+
+const (
+	FamilyIPv6 Family = iota // IPv6 addresses; IPv4 lines are invalid
+	FamilyAny                // both, IPv4 addresses as ::ffff:a.b.c.d
+)
+
+// ParseFamily maps a -family value other than ipv4 to a Family.
+func ParseFamily(s string) (Family, error) {
+	switch s {
+	case "", "ipv6":
+		return FamilyIPv6, nil
+	case "any":
+		return FamilyAny, nil
+	}
+	return 0, fmt.Errorf("unknown address family: %s", s)
+}
+
+// String returns the -family value of f.
+func (f Family) String() string {
+	if f == FamilyAny {
+		return "any"
+	}
+	return "ipv6"
+}
+
+// Options configures an IPv6Counter.
+type Options struct {
+	// Parse is how IPv4 lines are read with FamilyAny. Of its options
+	// IPv6 lines honor the trimming, comments and StripPort, which takes
+	// a port after a bracketed address, as in "[2001:db8::1]:443".
+	Parse   utils.ParseOptions
+	MaxLine int    // longest line accepted, 0 for utils.DefaultMaxLine
+	Family  Family // which addresses are counted
+
+	// Threshold is the number of distinct addresses kept in a hash set
+	// before they are spilled; 0 means DefaultThreshold.
+	Threshold int
+	// Partitions is how many partitions spilled addresses are spread
+	// over, 0 for DefaultPartitions; more means less memory per
+	// partition in pass 2.
+	Partitions int
+	// Workers is how many partitions are counted at once in pass 2,
+	// 0 for min(NumCPU, 8).
+	Workers int
+	// MemBuffer is how many bytes of addresses a partition keeps in
+	// memory before it gets a file, as bucket.Options.MemBuffer.
+	MemBuffer int
+
+	TempDir      string             // where addresses are spilled, "" for os.TempDir
+	Compress     bucket.Compression // encoding of the spill files
+	MaxWriteRate int64              // bytes per second written to the spill files, 0 for no cap
+	NoCache      bool               // drop the spill files' pages from the page cache
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the spill, invalid and oversized lines, nil to discard
+	Logger   *slog.Logger      // receives the first invalid lines, nil for slog.Default()
+}
+
+// Validate reports whether o can build an IPv6Counter.
+func (o Options) Validate() error {
+	if o.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative, got %d", o.Threshold)
+	}
+	if o.Partitions < 0 || o.Partitions > 1<<16 {
+		return fmt.Errorf("partitions must be 0 to %d, got %d", 1<<16, o.Partitions)
+	}
+	if o.Parse.CIDR {
+		return fmt.Errorf("CIDR blocks cannot be counted address by address in IPv6")
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("ipv6", func(o counter.Options) (counter.Counter, error) {
+		compress, _ := bucket.ParseCompression(o.SpillCompress) // validated by the caller
+		family, _ := ParseFamily(o.Family)
+		opts := Options{
+			Parse:        o.Parse,
+			MaxLine:      o.MaxLine,
+			Family:       family,
+			Workers:      o.BucketWorkers,
+			MemBuffer:    o.BucketMemBuffer,
+			TempDir:      o.TempDir,
+			Compress:     compress,
+			MaxWriteRate: o.MaxWriteRate,
+			NoCache:      o.NoCache,
+			Stats:        o.Stats,
+			Progress:     o.Progress,
+			Logger:       o.Logger,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("ipv6: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// IPv6Counter counts distinct IPv6 addresses. It implements
+// counter.Counter and counter.ReaderCounter.
+type IPv6Counter struct {
+	opts Options
+}
+
+// New creates an IPv6Counter of IPv6 addresses.
+func New() *IPv6Counter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates an IPv6Counter with the given options. It panics
+// if opts fail Validate.
+func NewWithOptions(opts Options) *IPv6Counter {
+	if err := opts.Validate(); err != nil {
+		panic("ipv6: " + err.Error())
+	}
+	opts.Threshold = cmp.Or(opts.Threshold, DefaultThreshold)
+	opts.Partitions = cmp.Or(opts.Partitions, DefaultPartitions)
+	return &IPv6Counter{opts: opts}
+}
+
+// CountUniqueIPs returns the number of distinct addresses in a file.
+func (c *IPv6Counter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation, checked every
+// ctxCheckLines lines and between partitions.
+func (c *IPv6Counter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(ctx, file)
+}
+
+// addr is an address as its upper and lower 64 bits.
+type addr struct{ hi, lo uint64 }
+
+// run is the state of one count.
+type run struct {
+	set   map[addr]struct{} // distinct addresses, nil once spilled
+	spill *bucket.RecordSpill
+	stage [][]byte // per-partition records not yet written to spill
+}
+
+// CountReader is CountUniqueIPsContext on r.
+func (c *IPv6Counter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	ru := &run{set: make(map[addr]struct{})}
+	defer func() {
+		if ru.spill != nil {
+			ru.spill.Remove()
+		}
+	}()
+
+	cr := utils.NewDelimChunkReader(c.opts.Progress.Reader(r), bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+	delim := c.opts.Parse.Delim()
+	skips := counter.NewSkipLog(c.opts.Logger)
+	var lines, oversized, invalid, v4 int64
+	for {
+		ch, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, counter.WrapRead("", err)
+		}
+		for data := ch.Data; len(data) > 0; {
+			var raw []byte
+			raw, data = utils.NextRecord(data, delim)
+			if lines++; lines%ctxCheckLines == 0 {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+			}
+			if len(raw) > maxLine {
+				oversized++
+				continue
+			}
+			line := c.opts.Parse.Trim(raw)
+			if len(line) == 0 || c.opts.Parse.IsComment(line) {
+				continue
+			}
+			a, isV4, err := c.parse(line)
+			if err != nil {
+				invalid++
+				c.opts.Parse.Malformed.Add(line, err)
+				skips.Add(line, err)
+				continue
+			}
+			if isV4 {
+				v4++
+			}
+			if err := c.add(ru, a); err != nil {
+				return 0, err
+			}
+		}
+		cr.Release(ch)
+	}
+
+	c.opts.Stats.Set("oversized lines", "%d", oversized+cr.Oversized())
+	c.opts.Stats.Set("invalid lines", "%d", invalid)
+	if c.opts.Family == FamilyAny {
+		c.opts.Stats.Set("ipv4 lines", "%d", v4)
+	}
+	if ru.spill == nil {
+		c.opts.Stats.Set("ipv6 set", "hash set of %d addresses", len(ru.set))
+		return int64(len(ru.set)), nil
+	}
+	for i, recs := range ru.stage {
+		if err := ru.spill.Write(i, recs); err != nil {
+			return 0, err
+		}
+	}
+	if err := ru.spill.Close(); err != nil {
+		return 0, err
+	}
+	c.opts.Stats.Set("ipv6 set", "spilled past %d addresses to %d partitions", c.opts.Threshold, c.opts.Partitions)
+	c.opts.Stats.Set("ipv6 spill", "%s", ru.spill)
+	return c.countPartitions(ctx, ru.spill)
+}
+
+// parse returns the address of line, and whether it was an IPv4 one, or
+// why it has none. A line with less than two colons, such as "1.2.3.4"
+// or with a port "1.2.3.4:80", is IPv4 to FamilyAny and invalid
+// otherwise.
+func (c *IPv6Counter) parse(line []byte) (a addr, v4 bool, err error) {
+	if bytes.Count(line, colon) < 2 && line[0] != '[' { // IPv6 has two colons at least
+		if c.opts.Family != FamilyAny {
+			return addr{}, false, ErrNotIPv6
+		}
+		ip, err := c.opts.Parse.Parse(line)
+		if err != nil {
+			return addr{}, true, err
+		}
+		a.hi, a.lo = utils.MappedIPv6(ip)
+		return a, true, nil
+	}
+	if c.opts.Parse.StripPort {
+		a.hi, a.lo, err = utils.ParseIPv6HostPort(line)
+	} else {
+		a.hi, a.lo, err = utils.ParseIPv6(line)
+	}
+	return a, false, err
+}
+
+// add records one address, spilling the hash set once it reaches
+// Threshold.
+func (c *IPv6Counter) add(ru *run, a addr) error {
+	if ru.spill == nil {
+		ru.set[a] = struct{}{}
+		if len(ru.set) < c.opts.Threshold {
+			return nil
+		}
+		return c.startSpill(ru)
+	}
+	return c.stage(ru, a)
+}
+
+// startSpill moves the hash set's addresses to a new spill, which every
+// address goes to from then on.
+func (c *IPv6Counter) startSpill(ru *run) error {
+	sp, err := bucket.NewRecordSpill(bucket.RecordSpillOptions{
+		Partitions:   c.opts.Partitions,
+		RecordSize:   recordSize,
+		MemBuffer:    c.opts.MemBuffer,
+		TempDir:      c.opts.TempDir,
+		Compress:     c.opts.Compress,
+		MaxWriteRate: c.opts.MaxWriteRate,
+		NoCache:      c.opts.NoCache,
+	})
+	if err != nil {
+		return err
+	}
+	counter.Logger(c.opts.Logger).Debug("ipv6 set spilling", "addresses", len(ru.set), "partitions", c.opts.Partitions)
+	ru.spill, ru.stage = sp, make([][]byte, c.opts.Partitions)
+	for a := range ru.set {
+		if err := c.stage(ru, a); err != nil {
+			return err
+		}
+	}
+	ru.set = nil
+	return nil
+}
+
+// stage queues a for its partition, writing the batch once it fills.
+// Equal addresses always land in the same partition.
+func (c *IPv6Counter) stage(ru *run, a addr) error {
+	i := int(mix64(a.hi^mix64(a.lo)) % uint64(len(ru.stage)))
+	ru.stage[i] = binary.BigEndian.AppendUint64(ru.stage[i], a.hi)
+	ru.stage[i] = binary.BigEndian.AppendUint64(ru.stage[i], a.lo)
+	if len(ru.stage[i]) < stageSize {
+		return nil
+	}
+	err := ru.spill.Write(i, ru.stage[i])
+	ru.stage[i] = ru.stage[i][:0]
+	return err
+}
+
+// countPartitions runs pass 2: a pool of workers loads a partition at a
+// time, sorts it and counts its distinct addresses. Partitions hold
+// disjoint addresses, so their counts add up.
+func (c *IPv6Counter) countPartitions(ctx context.Context, sp *bucket.RecordSpill) (int64, error) {
+	parts := sp.Touched()
+	workers := c.opts.Workers
+	if workers <= 0 {
+		workers = min(runtime.NumCPU(), defaultMaxWorker)
+	}
+	var (
+		next     atomic.Int64 // next position in parts to claim
+		total    atomic.Int64
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for range min(workers, len(parts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var addrs []addr
+			for !failed.Load() {
+				j := int(next.Add(1) - 1)
+				if j >= len(parts) {
+					return
+				}
+				addrs = addrs[:0]
+				err := sp.Read(ctx, parts[j], func(recs []byte) {
+					for ; len(recs) >= recordSize; recs = recs[recordSize:] {
+						addrs = append(addrs, addr{binary.BigEndian.Uint64(recs), binary.BigEndian.Uint64(recs[8:])})
+					}
+				})
+				if err == nil {
+					err = ctx.Err()
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+					return
+				}
+				slices.SortFunc(addrs, func(a, b addr) int {
+					return cmp.Or(cmp.Compare(a.hi, b.hi), cmp.Compare(a.lo, b.lo))
+				})
+				total.Add(int64(len(slices.Compact(addrs))))
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return total.Load(), nil
+}
+
+// mix64 is the splitmix64 finalizer, spreading addresses that share a
+// prefix over every partition.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
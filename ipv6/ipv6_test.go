@@ -0,0 +1,76 @@
+package ipv6
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The spilled count must match the hash set's, whether partitions stay
+// in memory, go to files or share them compressed, and with FamilyAny an
+// IPv4 address and its ::ffff: form must be counted once.
+func TestSpillMatchesHashSet(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	var b strings.Builder
+	v6, any := make(map[netip.Addr]bool), make(map[netip.Addr]bool)
+	for range 50000 {
+		var a [16]byte
+		a[0], a[1], a[15] = 0x20, 0x01, byte(rng.Uint32())
+		a[8] = byte(rng.Uint32N(100))
+		addr := netip.AddrFrom16(a)
+		line := addr.String()
+		switch rng.IntN(4) {
+		case 0:
+			line = strings.ToUpper(addr.StringExpanded())
+			v6[addr] = true
+		case 1:
+			ip := 10<<24 | rng.Uint32N(3000)
+			addr = netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)})
+			if line = addr.String(); rng.IntN(2) == 0 {
+				line = "::ffff:" + line
+				v6[netip.AddrFrom16(addr.As16())] = true
+			}
+			addr = netip.AddrFrom16(addr.As16())
+		default:
+			v6[addr] = true
+		}
+		any[addr] = true
+		fmt.Fprintf(&b, "%s\n", line)
+	}
+	input := b.String()
+
+	for _, o := range []Options{
+		{},
+		{Threshold: 1000, Partitions: 16},
+		{Threshold: 1000, Partitions: 7, Compress: bucket.CompressFlate, TempDir: t.TempDir()},
+	} {
+		for _, family := range []Family{FamilyIPv6, FamilyAny} {
+			o.Family, o.Logger = family, slog.New(slog.NewTextHandler(io.Discard, nil))
+			want := len(v6)
+			if family == FamilyAny {
+				want = len(any)
+			}
+			n, err := NewWithOptions(o).CountReader(context.Background(), strings.NewReader(input))
+			if err != nil {
+				t.Fatalf("%+v: %v", o, err)
+			}
+			if n != int64(want) {
+				t.Errorf("%+v: %d addresses, want %d", o, n, want)
+			}
+		}
+	}
+
+	n, err := NewWithOptions(Options{Family: FamilyAny, Parse: utils.ParseOptions{StripPort: true}}).CountReader(context.Background(),
+		strings.NewReader("[2001:db8::1]:443\n2001:db8::1\n[2001:db8::1]\n192.0.2.1:80\n::ffff:192.0.2.1\n"))
+	if err != nil || n != 2 {
+		t.Errorf("bracketed and with ports: %d, %v, want 2", n, err)
+	}
+}
@@ -0,0 +1,232 @@
+// Package kmv estimates the number of unique IPv4 addresses with a
+// k-minimum-values (bottom-k) sketch: every address is hashed to 64 bits
+// and only the k smallest distinct hashes are kept, so memory is a few
+// hundred KB whatever the input. Sketches serialize to a small file and
+// merge into a sketch of the union, so counts from separate runs can be
+// combined offline.
+package kmv
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	DefaultK = 4096    // about 1.6% relative standard error
+	MinK     = 3       // the estimate divides by k-2
+	MaxK     = 1 << 24 // keeps a serialized sketch under 128 MB
+
+	bytesPerChunk = 2 * 1024 * 1024 // read chunk size
+)
+
+// Options configures a KMVCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+	Workers int                // goroutines parsing the input, 0 for runtime.NumCPU()
+
+	// K is the number of hash values kept, between MinK and MaxK; 0 means
+	// DefaultK. The relative standard error is about 1/sqrt(K-2).
+	K int
+
+	// SketchOut, if set, is where the final sketch is written after a
+	// successful count, for a later sketch-merge.
+	SketchOut string
+
+	// Sync fsyncs the SketchOut file before it is renamed into place.
+	Sync bool
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the estimate and its error, nil to discard
+}
+
+// Validate reports whether o can build a KMVCounter.
+func (o Options) Validate() error {
+	if o.K != 0 && (o.K < MinK || o.K > MaxK) {
+		return fmt.Errorf("k must be between %d and %d, got %d", MinK, MaxK, o.K)
+	}
+	if o.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", o.Workers)
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("kmv", func(o counter.Options) (counter.Counter, error) {
+		opts := Options{
+			Parse:     o.Parse,
+			MaxLine:   o.MaxLine,
+			K:         o.SketchK,
+			SketchOut: o.SketchOut,
+			Sync:      o.Fsync,
+			Stats:     o.Stats,
+			Workers:   o.Workers,
+			Progress:  o.Progress,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("kmv: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// KMVCounter estimates unique IPs with a k-minimum-values sketch. It
+// implements counter.Estimator.
+type KMVCounter struct {
+	opts   Options
+	sketch *Sketch // sketch of the last successful count
+}
+
+// New creates a KMVCounter keeping DefaultK values.
+func New() *KMVCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a KMVCounter with the given options. It panics if
+// opts fail Validate.
+func NewWithOptions(opts Options) *KMVCounter {
+	if err := opts.Validate(); err != nil {
+		panic("kmv: " + err.Error())
+	}
+	if opts.K == 0 {
+		opts.K = DefaultK
+	}
+	return &KMVCounter{opts: opts}
+}
+
+// CountUniqueIPs returns the estimated number of distinct IPv4s in a file.
+func (c *KMVCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation.
+func (c *KMVCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(ctx, file)
+}
+
+// CountReader estimates the distinct IPv4s read from r. Workers each fill
+// their own sketch from the chunks they are handed, and the sketches are
+// merged once the input is exhausted.
+func (c *KMVCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	c.sketch = nil
+	cr := utils.NewDelimChunkReader(c.opts.Progress.Reader(r), bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+
+	numWorkers := cmp.Or(c.opts.Workers, runtime.NumCPU())
+	chunkChan := make(chan utils.Chunk, numWorkers*2)
+	sketches := make([]*Sketch, numWorkers)
+	var oversized atomic.Int64
+	var wg sync.WaitGroup
+	for i := range sketches {
+		sketches[i] = NewSketch(c.opts.K)
+		wg.Add(1)
+		go func(s *Sketch) {
+			defer wg.Done()
+			for ch := range chunkChan {
+				if ctx.Err() == nil {
+					oversized.Add(c.sketchChunk(ch.Data, maxLine, s))
+				}
+				cr.Release(ch)
+			}
+		}(sketches[i])
+	}
+
+	// Producer: errors only break out of the loop so the workers are
+	// always shut down
+	var readErr error
+	for ctx.Err() == nil {
+		ch, err := cr.Next()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		chunkChan <- ch
+	}
+	close(chunkChan)
+	wg.Wait()
+	c.opts.Stats.Set("oversized lines", "%d", oversized.Load()+cr.Oversized())
+	if readErr != nil {
+		return 0, counter.WrapRead("", readErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s := sketches[0]
+	for _, o := range sketches[1:] {
+		s.Merge(o)
+	}
+	est, se := s.Estimate()
+	c.sketch = s
+	c.opts.Stats.Set("kmv estimate", "%.0f ± %.0f (1σ), %d of k = %d values kept", est, se, s.Len(), s.K())
+	if c.opts.SketchOut != "" {
+		if err := s.WriteFile(c.opts.SketchOut, c.opts.Sync); err != nil {
+			return 0, err
+		}
+	}
+	return int64(math.Round(est)), nil
+}
+
+// Sketch returns the sketch of the last successful count, or nil.
+func (c *KMVCounter) Sketch() *Sketch {
+	return c.sketch
+}
+
+// StdError returns the standard error of the last estimate, 0 when the
+// input had fewer than k distinct addresses and the count is exact.
+func (c *KMVCounter) StdError() float64 {
+	if c.sketch == nil {
+		return 0
+	}
+	_, se := c.sketch.Estimate()
+	return se
+}
+
+// sketchChunk adds the hash of every valid line in chunk to s and returns
+// how many lines were skipped for exceeding maxLine.
+func (c *KMVCounter) sketchChunk(chunk []byte, maxLine int, s *Sketch) int64 {
+	var oversized int64
+	delim := c.opts.Parse.Delim()
+	for data := chunk; len(data) > 0; {
+		var raw []byte
+		raw, data = utils.NextRecord(data, delim)
+		if len(raw) > maxLine {
+			oversized++
+			continue
+		}
+		line := c.opts.Parse.Trim(raw)
+		if len(line) == 0 {
+			continue
+		}
+		first, last, form, err := c.opts.Parse.ParseForm(raw, line)
+		if err != nil {
+			c.opts.Parse.Malformed.Add(line, err)
+			continue
+		}
+		c.opts.Parse.Canon.Add(first, last, form)
+		for ip := first; ; ip++ {
+			s.Add(Hash(ip))
+			if ip == last {
+				break
+			}
+		}
+	}
+	return oversized
+}
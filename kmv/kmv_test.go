@@ -0,0 +1,105 @@
+package kmv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Below k distinct addresses the count is exact; beyond, the estimate
+// lands within four standard errors of the true count, and a sketch
+// merged from two overlapping parts is the sketch of their union.
+func TestEstimate(t *testing.T) {
+	rng := rand.New(rand.NewPCG(51, 52))
+	for _, k := range []int{MinK, 256, DefaultK} {
+		for _, n := range []int{0, 2, 1000, 20000, 200000} {
+			whole, a, b := NewSketch(k), NewSketch(k), NewSketch(k)
+			for i := range n {
+				h := Hash(rng.Uint32())
+				whole.Add(h)
+				if i%3 != 0 {
+					a.Add(h)
+				}
+				if i%3 != 1 {
+					b.Add(h)
+				}
+			}
+			est, se := whole.Estimate()
+			if n < k && (est != float64(n) || se != 0) {
+				t.Errorf("k=%d, n=%d: %.0f ± %.0f, want exact", k, n, est, se)
+			}
+			if math.Abs(est-float64(n)) > 4*se+float64(n)/1e4 {
+				t.Errorf("k=%d, n=%d: %.0f ± %.0f", k, n, est, se)
+			}
+			a.Merge(b)
+			if !slices.Equal(a.Values(), whole.Values()) {
+				t.Errorf("k=%d, n=%d: merged sketch differs from the whole", k, n)
+			}
+		}
+	}
+}
+
+// Workers each sketch part of the input and their merge estimates the
+// whole; repeated lines change nothing.
+func TestCountReader(t *testing.T) {
+	var b strings.Builder
+	want := NewSketch(DefaultK)
+	for i := range 100000 {
+		ip := uint32(i) * 2654435761
+		want.Add(Hash(ip))
+		fmt.Fprintf(&b, "%s\n%s\n", utils.FormatIPv4(ip), utils.FormatIPv4(ip))
+	}
+	c := NewWithOptions(Options{Workers: 4})
+	n, err := c.CountReader(context.Background(), strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se := c.StdError(); math.Abs(float64(n-100000)) > 4*se || se > 0.02*100000 {
+		t.Errorf("%d ± %.0f, want 100000", n, se)
+	}
+	if !slices.Equal(c.Sketch().Values(), want.Values()) {
+		t.Error("the merged worker sketches differ from a sketch of the whole input")
+	}
+}
+
+// A sketch survives serialization unchanged, and a corrupt one is
+// rejected with ErrBadSketch.
+func TestRoundTrip(t *testing.T) {
+	s := NewSketch(64)
+	for ip := range uint32(1000) {
+		s.Add(Hash(ip))
+	}
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSketch(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.K() != s.K() || !slices.Equal(got.Values(), s.Values()) {
+		t.Error("the sketch read back differs")
+	}
+	data := buf.Bytes()
+	swapped := slices.Clone(data)
+	copy(swapped[len(data)-16:], data[len(data)-8:])
+	copy(swapped[len(data)-8:], data[len(data)-16:len(data)-8])
+	for name, bad := range map[string][]byte{
+		"short":     data[:len(data)-1],
+		"trailing":  append(slices.Clone(data), 0),
+		"magic":     append([]byte("ipckmv99"), data[8:]...),
+		"unordered": swapped,
+	} {
+		if _, err := ReadSketch(bytes.NewReader(bad)); !errors.Is(err, ErrBadSketch) {
+			t.Errorf("%s: %v, want ErrBadSketch", name, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package kmv
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// fileMagic starts every serialized sketch; the trailing digit is the
+// format version.
+const fileMagic = "ipckmv01"
+
+// ErrBadSketch is returned when a serialized sketch is malformed.
+var ErrBadSketch = errors.New("malformed kmv sketch")
+
+// Hash maps an address to the 64-bit value a sketch keeps: the splitmix64
+// finalizer of the address as a uint64. Other systems exchanging sketches
+// with ipcounter must hash the same way.
+func Hash(ip uint32) uint64 {
+	h := uint64(ip)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// Sketch keeps the k smallest distinct hash values it has seen in a
+// bounded max-heap, so the largest kept value, the one the estimate uses,
+// is always at the root. It is not safe for concurrent use; workers keep
+// their own sketches and Merge them.
+type Sketch struct {
+	k    int
+	heap maxHeap
+	kept map[uint64]struct{} // values in heap, to skip duplicates
+}
+
+// NewSketch returns an empty sketch keeping up to k values. It panics if
+// k is below MinK.
+func NewSketch(k int) *Sketch {
+	if k < MinK {
+		panic(fmt.Sprintf("kmv: k must be at least %d, got %d", MinK, k))
+	}
+	return &Sketch{k: k, kept: make(map[uint64]struct{}, k)}
+}
+
+// K returns the most values s keeps.
+func (s *Sketch) K() int {
+	return s.k
+}
+
+// Len returns the number of values s currently keeps.
+func (s *Sketch) Len() int {
+	return len(s.heap)
+}
+
+// Add offers hash value h to the sketch.
+func (s *Sketch) Add(h uint64) {
+	if len(s.heap) == s.k && h >= s.heap[0] {
+		return // the common case once the sketch is full
+	}
+	if _, ok := s.kept[h]; ok {
+		return
+	}
+	s.kept[h] = struct{}{}
+	if len(s.heap) < s.k {
+		heap.Push(&s.heap, h)
+		return
+	}
+	delete(s.kept, s.heap[0])
+	s.heap[0] = h
+	heap.Fix(&s.heap, 0)
+}
+
+// Merge adds every value of o to s, making s a sketch of the union of
+// both inputs. With different k the union keeps s's k; merging into the
+// sketch with the smaller k keeps the estimate unbiased.
+func (s *Sketch) Merge(o *Sketch) {
+	for _, h := range o.heap {
+		s.Add(h)
+	}
+}
+
+// Values returns the kept hash values in ascending order.
+func (s *Sketch) Values() []uint64 {
+	vals := slices.Clone([]uint64(s.heap))
+	slices.Sort(vals)
+	return vals
+}
+
+// Estimate returns the estimated number of distinct values added and its
+// standard error. A sketch that is not yet full holds every distinct
+// value, so its count is exact; otherwise the estimate is (k-1)/max, with
+// max the largest kept value scaled to [0, 1), and the relative standard
+// error about 1/sqrt(k-2).
+func (s *Sketch) Estimate() (n, stdErr float64) {
+	if len(s.heap) < s.k {
+		return float64(len(s.heap)), 0
+	}
+	maxKept := float64(s.heap[0]) / math.Exp2(64)
+	n = float64(s.k-1) / maxKept
+	return n, n / math.Sqrt(float64(s.k-2))
+}
+
+// WriteTo serializes s as the magic "ipckmv01", k and the number of values
+// as little-endian uint32s, then the values in ascending order as
+// little-endian uint64s.
+func (s *Sketch) WriteTo(w io.Writer) (int64, error) {
+	vals := s.Values()
+	buf := make([]byte, 0, len(fileMagic)+8+8*len(vals))
+	buf = append(buf, fileMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(s.k))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vals)))
+	for _, v := range vals {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadSketch decodes a sketch written by WriteTo.
+func ReadSketch(r io.Reader) (*Sketch, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(fileMagic)+8)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("%w: short header: %v", ErrBadSketch, err)
+	}
+	if string(hdr[:len(fileMagic)]) != fileMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrBadSketch, hdr[:len(fileMagic)])
+	}
+	k := binary.LittleEndian.Uint32(hdr[len(fileMagic):])
+	n := binary.LittleEndian.Uint32(hdr[len(fileMagic)+4:])
+	if k < MinK || k > MaxK || n > k {
+		return nil, fmt.Errorf("%w: %d values with k = %d", ErrBadSketch, n, k)
+	}
+	s := NewSketch(int(k))
+	var rec [8]byte
+	var prev uint64
+	for i := uint32(0); i < n; i++ {
+		if _, err := io.ReadFull(br, rec[:]); err != nil {
+			return nil, fmt.Errorf("%w: value %d of %d: %v", ErrBadSketch, i, n, err)
+		}
+		v := binary.LittleEndian.Uint64(rec[:])
+		if i > 0 && v <= prev {
+			return nil, fmt.Errorf("%w: values not strictly ascending", ErrBadSketch)
+		}
+		prev = v
+		s.Add(v)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data", ErrBadSketch)
+	}
+	return s, nil
+}
+
+// WriteFile serializes s to path through a temp file renamed into place
+// once complete, fsynced first with sync.
+func (s *Sketch) WriteFile(path string, sync bool) error {
+	err := counter.WriteFileAtomic(path, sync, func(w io.Writer) error {
+		_, err := s.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("write sketch: %w", err)
+	}
+	return nil
+}
+
+// ReadFile decodes the sketch stored at path.
+func ReadFile(path string) (*Sketch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open sketch: %w", err)
+	}
+	defer f.Close()
+	s, err := ReadSketch(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// maxHeap is a container/heap max-heap of hash values.
+type maxHeap []uint64
+
+func (h maxHeap) Len() int           { return len(h) }
+func (h maxHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h maxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x any)        { *h = append(*h, x.(uint64)) }
+func (h *maxHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,73 @@
+package linear
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// distinctInput returns n distinct random addresses and an input with
+// each of them on two lines.
+func distinctInput(rng *rand.Rand, n int) ([]uint32, string) {
+	var b strings.Builder
+	ips := make([]uint32, 0, n)
+	seen := make(map[uint32]bool, n)
+	for len(ips) < n {
+		ip := rng.Uint32()
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		ips = append(ips, ip)
+		fmt.Fprintf(&b, "%s\n%s\n", utils.FormatIPv4(ip), utils.FormatIPv4(ip))
+	}
+	return ips, b.String()
+}
+
+// The estimate lands within four of its standard errors of the exact
+// count at load factors from a hundredth of the bitmap to three times it.
+func TestEstimate(t *testing.T) {
+	const bits = 16
+	m := 1 << bits
+	rng := rand.New(rand.NewPCG(41, 42))
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, n := range []int{0, 1, m / 100, m / 4, m, 3 * m} {
+		c := NewWithOptions(Options{Bits: bits, Logger: discard})
+		_, input := distinctInput(rng, n)
+		got, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("load %.2f: %v", float64(n)/float64(m), err)
+		}
+		if se := c.StdError(); math.Abs(float64(got-int64(n))) > 4*se+0.5 {
+			t.Errorf("load %.2f: %d ± %.0f, want %d", float64(n)/float64(m), got, se, n)
+		}
+	}
+}
+
+// A bitmap with every bit set fails with ErrSaturated instead of giving
+// an estimate of infinity, and the Sketch of the same input reports the
+// count at which it is expected to fill.
+func TestSaturated(t *testing.T) {
+	ips, input := distinctInput(rand.New(rand.NewPCG(43, 44)), 20000)
+	c := NewWithOptions(Options{Bits: MinBits, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if n, err := c.CountReader(context.Background(), strings.NewReader(input)); !errors.Is(err, ErrSaturated) {
+		t.Errorf("20000 addresses in 2^%d bits: %d, %v, want ErrSaturated", MinBits, n, err)
+	}
+
+	s := NewSketch(MinBits)
+	for _, ip := range ips {
+		s.Add(ip)
+	}
+	m := float64(int(1) << MinBits)
+	if got, want := s.Estimate(), int64(math.Round(m*math.Log(m))); got != want {
+		t.Errorf("saturated sketch: %d, want m·ln(m) = %d", got, want)
+	}
+}
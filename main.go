@@ -1,42 +1,897 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"ipcounter/bucket"
-	"ipcounter/concurrent"
-	"ipcounter/naive"
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/input"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/ipv6"
+	"github.com/Sveta-1999/IPCounter/pair"
+	"github.com/Sveta-1999/IPCounter/sample"
+	"github.com/Sveta-1999/IPCounter/utils"
 )
 
+// commands are the subcommands selected by the first argument.
+var commands = map[string]func(args []string) error{
+	"bench":     runBench,
+	"daemon":    runDaemon,
+	"delta":     runDelta,
+	"diff":      runDiff,
+	"estimate":  runEstimate,
+	"gen":       runGen,
+	"inspect":   runInspect,
+	"intersect": runIntersect,
+	"map":       runMap,
+	"merge":     runMerge,
+
+	"serve":        runDaemon, // an alias of daemon
+	"sketch-merge": runSketchMerge,
+	"sort-dump":    runSortDump,
+	"validate":     runValidate,
+	"watch":        runWatch,
+	"window":       runWindow,
+}
+
+// Exit statuses of a count that fails, so a script can tell a missing
+// input from a full temp volume from a disk that failed partway through.
+// Other errors exit with 1.
+const (
+	exitOpen  = 2 // an input could not be opened
+	exitSpill = 3 // temp files could not be created, written or read back
+	exitRead  = 4 // an input failed partway through
+
+	// exitThreshold is a count that succeeded but fell below a
+	// -fail-if-unique-* bound, after the results are printed.
+	exitThreshold = 5
+
+	// exitExpect is a count that succeeded but differs from -expect or
+	// -expect-file by more than -expect-tolerance, after the results and
+	// the difference are printed.
+	exitExpect = 6
+
+	// exitMalformed is a -strict count of text input that skipped lines
+	// which failed to parse, after the results and the first of the
+	// lines are printed.
+	exitMalformed = 7
+
+	// exitTimeout is a count stopped by -timeout, the status timeout(1)
+	// exits with.
+	exitTimeout = 124
+)
+
+// exitStatuses maps the errors a run can fail with to the status main
+// exits with and the category -result-file records, the first match
+// winning; anything else exits with 1 as "error". exitCode and -help both
+// read it, so the statuses documented are the ones used.
+var exitStatuses = []struct {
+	code     int
+	category string
+	errs     []error
+	doc      string
+}{
+	{exitOpen, "open_input", []error{counter.ErrOpenInput}, "an input could not be opened"},
+	{exitSpill, "spill", []error{counter.ErrSpill, bucket.ErrInsufficientSpace}, "temp files could not be created, written or read back"},
+	{exitRead, "read", []error{counter.ErrRead}, "an input failed partway through"},
+	{exitThreshold, "threshold", []error{counter.ErrThreshold}, "the count fell below a -fail-if-unique-* bound, after the results are printed"},
+	{exitExpect, "expectation", []error{counter.ErrExpectation}, "the count differs from -expect or -expect-file by more than -expect-tolerance, after the results and the difference are printed"},
+	{exitMalformed, "malformed", []error{counter.ErrMalformed}, "-strict and lines of text input failed to parse, after the results and the first of them are printed"},
+	{exitInterrupted, "interrupted", []error{context.Canceled}, "interrupted by SIGINT or SIGTERM"},
+	{exitTimeout, "timeout", []error{context.DeadlineExceeded}, "stopped by -timeout"},
+	{1, "memory_budget", []error{counter.ErrMemBudget}, "the engine would have gone over its memory budget"},
+	{1, "not_text", []error{counter.ErrNotText}, "an input does not look like delimited text; see -force-text"},
+	{1, "count_mismatch", []error{counter.ErrCountMismatch}, "-verify-count found the running count wrong"},
+}
+
+// exitEntry returns the entry of exitStatuses err matches, or -1.
+func exitEntry(err error) int {
+	for i, st := range exitStatuses {
+		for _, target := range st.errs {
+			if errors.Is(err, target) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// exitCode returns the status main exits with for err, 0 for nil.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if i := exitEntry(err); i >= 0 {
+		return exitStatuses[i].code
+	}
+	return 1
+}
+
+// exitCategory returns the category -result-file records for err.
+func exitCategory(err error) string {
+	if i := exitEntry(err); i >= 0 {
+		return exitStatuses[i].category
+	}
+	return "error"
+}
+
+// printExitStatuses writes the exit statuses of a count to w, for -help.
+func printExitStatuses(w io.Writer) {
+	fmt.Fprintln(w, "Exit status:")
+	fmt.Fprintf(w, "  %-4d%s\n", 0, "success")
+	for _, st := range exitStatuses {
+		fmt.Fprintf(w, "  %-4d%s (%s)\n", st.code, st.doc, st.category)
+	}
+	fmt.Fprintf(w, "  %-4d%s\n", 1, "any other failure (error)")
+}
+
+// flagPassed reports whether the flag called name was set on the command
+// line of fs, rather than left at its default.
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// implName describes the engine that counted: the -impl given, with
+// auto's selection or a fallback from concurrent to bucket.
+func implName(c counter.Counter, fb *counter.Fallback, impl string) string {
+	if a, ok := c.(*counter.Auto); ok {
+		return fmt.Sprintf("auto -> %s", a.Selection())
+	} else if fb != nil && fb.FellBack() {
+		return "concurrent -> bucket (over the memory budget)"
+	}
+	return impl
+}
+
+// errUsage is returned by run after printing the usage message.
+var errUsage = errors.New("usage")
+
+// main is the single exit point: every failure comes back from run as an
+// error, is logged once and picks the exit status.
 func main() {
-	impl := flag.String("impl", "bucket", "counter impl: naive|concurrent|bucket")
-	flag.Parse()
-	if flag.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: ipcounter [-impl naive|concurrent|bucket] <filename>")
+	err := run()
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, errUsage):
 		os.Exit(1)
+	case errors.Is(err, context.Canceled):
+		os.Exit(exitInterrupted)
+	}
+	slog.Error(err.Error())
+	os.Exit(exitCode(err))
+}
+
+// run parses the command line, runs the count or subcommand and prints
+// the results.
+func run() (err error) {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			return cmd(os.Args[2:])
+		}
 	}
-	filename := flag.Arg(0)
 
+	impl := flag.String("impl", "auto", "counter impl: "+strings.Join(counter.Names(), "|")+" (list to print them)")
+	ef := addEngineFlags(flag.CommandLine)
+	stats := flag.Bool("stats", false, "print run statistics to stderr")
+	output := flag.String("output", "text", "how to print the count: text, or json, one object with the engine, lines, malformed lines, bytes read, time per phase and peak memory")
+	asnTable := flag.String("asn-table", "", "also print unique counts per origin AS from this prefix-to-AS table, e.g. pfx2as.txt (concurrent engine)")
+	progress := flag.Bool("progress", false, "print to stderr every -progress-interval how much of the input has been read, lines, unique addresses so far and the time left; the bucket engine's pass 2 by buckets")
+	progressEvery := flag.Duration("progress-interval", 5*time.Second, "with -progress, how often to print")
+	metricsAddr := flag.String("metrics-addr", "", "serve the count's progress at http://ADDR/metrics in the Prometheus text format while it runs, e.g. :9090")
+	timeout := flag.Duration("timeout", 0, "stop the count once it has run this long, e.g. 10m, cleaning up as on an interrupt, and exit with status 124 (0 = no limit)")
+	httpTimeout := flag.Duration("http-timeout", input.DefaultTimeout, "for a URL input, longest wait for response headers or the next body bytes before resuming")
+	parallelFiles := flag.Int("parallel-files", 1, "with several inputs, read up to this many at once into one set (auto, concurrent and bucket engines)")
+	member := flag.String("member", "", "for a tar archive, count only members whose name or base name matches this glob, e.g. 'access-*.log'")
+	s3Region := flag.String("s3-region", "", "for an s3:// input, the bucket's region (default $AWS_REGION, then us-east-1)")
+	httpRetries := flag.Int("http-retries", input.DefaultRetries, "for a URL input, attempts in a row before a failed request or broken body is an error (0 = none)")
+	manifest := flag.String("manifest", "", "also count every source listed in this file, one path or URL per line (# comments allowed)")
+	forceText := flag.Bool("force-text", false, "count local inputs whose first 64 KB do not look like newline-separated text, which fail the count otherwise")
+	onError := flag.String("on-error", "abort", "with several inputs, what a source that fails does: abort|skip (skip counts the rest and lists the failures)")
+	pcapField := flag.String("pcap-field", "src", "with -input-format pcap, which address of each IPv4 packet to count: src|dst|both")
+	geoipDB := flag.String("geoip", "", "also print unique counts per country from this MaxMind DB, e.g. GeoLite2-Country.mmdb (concurrent engine)")
+	prefixSweep := flag.String("prefix-sweep", "", "also print the exact number of distinct prefixes of these lengths, e.g. 8,16,24,32 (concurrent and bucket engines)")
+	sweepFormat := flag.String("prefix-sweep-format", "text", "how -prefix-sweep prints: text|json")
+	byPrefix := flag.Int("by-prefix", 0, "also print the unique count of every prefix of this length, 1 to 24, e.g. 16 for /16s, the busiest first (concurrent and bucket engines)")
+	topN := flag.Int("top", 10, "with -by-prefix, how many of the busiest prefixes to print (0 = all)")
+	topIPs := flag.Int("top-ips", 0, "also print this many of the addresses seen most often, each with how many times it was, the most frequent first; with -min-occurrences only those seen that often (bucket engine)")
+	heatmapOut := flag.String("heatmap", "", "also write a 4096x4096 PNG of the address space to this file, one pixel per /24 along a Hilbert curve (concurrent and bucket engines)")
+	cacheDir := flag.String("cache-dir", "", "keep counts of single local files in this directory, e.g. ~/.cache/ipcounter, and reuse them while the file and the options that affect the count are unchanged")
+	cacheVerify := flag.Bool("cache-verify", false, "with -cache-dir, count even on a hit and fail if the cached count differs")
+	noResultCache := flag.Bool("no-result-cache", false, "with -cache-dir, neither use nor store a cached count")
+	cacheMax := flag.Int("cache-max-entries", 1000, "with -cache-dir, keep at most this many counts, dropping the least recently used (0 = no limit)")
+	minUnique := flag.Int64("fail-if-unique-below", 0, "after printing the results, exit with status 5 if fewer than this many unique addresses were counted (0 = no bound)")
+	inclPreload := flag.Bool("include-preloaded", false, "with -preload, report the addresses of the list and the input together instead of the new ones")
+	dump := flag.String("dump", "", "also write the distinct addresses to this file in ascending order (concurrent engine)")
+	dumpFormat := flag.String("dump-format", "text", "how -dump writes: text, one address per line, or ipcset, a checksummed binary file with metadata that ipcounter inspect checks (ipcset-raw stores 4-byte addresses instead of varint gaps)")
+	dumpStream := flag.Bool("dump-stream", false, "with -dump, append each address to the file as the count first finds it instead of writing them sorted at the end, with flush points, so an interrupted count leaves what it found; ipcounter sort-dump sorts the file afterwards (text format only)")
+	resumeDump := flag.Bool("resume-dump", false, "with -dump, set the addresses a -dump-stream count left in the file before counting and append only the ones it lacks, reporting the count of both; implies -dump-stream")
+	bucketStats := flag.String("bucket-stats", "", "also write each bucket's record bytes, unique count and pass-2 time to this file as JSON (bucket engine)")
+	subsampleRates := flag.String("subsample-rates", "", "also print the exact unique count of a sample by address at each of these rates, e.g. 0.01,0.1,0.5, and of the whole input, deciding membership by a hash of the address (concurrent and bucket engines)")
+	strictExamples := flag.Int("strict-examples", 10, "with -strict, malformed lines quoted when the count fails, numbered for a single local file")
+	canonReport := flag.Bool("canon-report", false, "also print how many counted lines and distinct addresses were written in each non-canonical form (whitespace, leading zeros, quotes, brackets, port, ::ffff:) and how many addresses never appeared written plainly")
+	replay := flag.String("replay", "", "instead of counting, re-parse the input's chunks as recorded in this -record trace one at a time and report the first whose byte range or address count differs")
+	minRatio := flag.Float64("fail-if-unique-ratio-below", 0, "after printing the results, exit with status 5 if unique addresses per line read fall below this, e.g. 0.005 (0 = no bound)")
+	expectCount := flag.Int64("expect", -1, "after printing the results, exit with status 6 and print the difference as a line of JSON if the unique count is not this (-1 = no expectation)")
+	expectFile := flag.String("expect-file", "", "like -expect, with the count in this -result-file summary of a run of the same inputs; summaries of several runs may be concatenated, the last for these inputs winning")
+	expectTolerance := flag.String("expect-tolerance", "0", "with -expect or -expect-file, how far the count may be off: a number of addresses, or a percentage of the expected count such as 0.1%")
+	resultFile := flag.String("result-file", "", "when the run ends, successful or not, replace this file with a JSON summary: count, engine, inputs, timings, stats and any error's category")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter [flags] <filename|glob|url|s3://bucket/key|->...")
+		fmt.Fprintln(os.Stderr, "       ipcounter [flags] -manifest <list>")
+		fmt.Fprintln(os.Stderr, "       ipcounter bench [flags] <filename>")
+		fmt.Fprintln(os.Stderr, "       ipcounter daemon|serve [-addr unix:///run/ipcounter.sock] [flags]")
+		fmt.Fprintln(os.Stderr, "       ipcounter delta -baseline FILE [-update] [flags] <filename>...")
+		fmt.Fprintln(os.Stderr, "       ipcounter diff|intersect [flags] <a> <b>")
+		fmt.Fprintln(os.Stderr, "       ipcounter estimate [-sample-bytes 64MB] [-size SIZE] [flags] <filename>")
+		fmt.Fprintln(os.Stderr, "       ipcounter gen [flags]")
+		fmt.Fprintln(os.Stderr, "       ipcounter inspect <file.ipcset>...")
+		fmt.Fprintln(os.Stderr, "       ipcounter map -o FILE.png [flags] <filename>...")
+		fmt.Fprintln(os.Stderr, "       ipcounter merge [-o FILE] <snapshot|file.ipcset>...")
+		fmt.Fprintln(os.Stderr, "       ipcounter sketch-merge [flags] <sketch>...")
+		fmt.Fprintln(os.Stderr, "       ipcounter sort-dump [-o FILE] [flags] <dump>")
+		fmt.Fprintln(os.Stderr, "       ipcounter watch -dir DIR -state-file FILE [flags]")
+		fmt.Fprintln(os.Stderr, "       ipcounter window -state-dir DIR [-window 7] [flags] <filename>...")
+		flag.PrintDefaults()
+		printExitStatuses(os.Stderr)
+	}
+	flag.Parse()
+	var summary *resultSummary
+	if *resultFile != "" {
+		summary = newResultSummary(flag.CommandLine)
+		defer func() { err = summary.finish(*resultFile, err, *ef.fsync) }()
+	}
+	if *impl == "list" {
+		for _, name := range counter.Names() {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	if *replay != "" {
+		if flag.NArg() != 1 {
+			return errors.New("-replay needs exactly one input, the file the trace was recorded from")
+		}
+		return runReplay(*replay, flag.Arg(0), opts)
+	}
+	if opts.FromBuckets != "" {
+		// Only the bucket engine can resume from kept buckets, and the
+		// input file is optional
+		switch *impl {
+		case "auto", "bucket":
+			*impl = "bucket"
+		default:
+			return fmt.Errorf("-from-buckets needs -impl bucket, got %s", *impl)
+		}
+	} else if opts.ResumeBuckets != "" {
+		// Only the bucket engine checkpoints its passes, and only of a
+		// file it can read again from where it stopped
+		switch {
+		case *impl != "auto" && *impl != "bucket":
+			return fmt.Errorf("-resume needs -impl bucket, got %s", *impl)
+		case flag.NArg() != 1:
+			return fmt.Errorf("-resume needs exactly one input, got %d", flag.NArg())
+		}
+		*impl = "bucket"
+	} else if opts.Window > 0 && *impl != "auto" && *impl != "window" {
+		return fmt.Errorf("-window needs -impl window, got %s", *impl)
+	} else if opts.GroupColumn > 0 && *impl != "auto" && *impl != "group" {
+		return fmt.Errorf("-group-by-column needs -impl group, got %s", *impl)
+	} else if *ef.pair && *impl != "auto" && *impl != "pair" {
+		return fmt.Errorf("-pair needs -impl pair, got %s", *impl)
+	} else if opts.Family != "" && *impl != "auto" && *impl != "ipv6" {
+		// The bitset engines and sketches hold IPv4's 32-bit addresses
+		return fmt.Errorf("-family %s needs -impl ipv6, got %s", opts.Family, *impl)
+	} else if opts.Family == "" && *impl == "ipv6" && flagPassed(flag.CommandLine, "family") {
+		// The ipv6 engine's own default is IPv6 alone
+		return errors.New("-family ipv4 cannot be counted by -impl ipv6; use -family any for IPv4 and IPv6 in one count")
+	} else if opts.SampleFraction > 0 && *impl != "auto" && *impl != "sample" {
+		return fmt.Errorf("-sample needs -impl sample, got %s", *impl)
+	} else if opts.SketchOut != "" && *impl != "kmv" {
+		return fmt.Errorf("-sketch-out needs -impl kmv, got %s", *impl)
+	} else if opts.FirstSeen != "" && *impl != "auto" && *impl != "naive" {
+		return fmt.Errorf("-first-seen needs -impl naive, got %s", *impl)
+	} else if flag.NArg() < 1 && *manifest == "" && !stdinPiped() {
+		flag.Usage()
+		return errUsage
+	}
+	if opts.Family != "" {
+		*impl = "ipv6"
+	}
+	if opts.MinOccurrences > 1 || *topIPs > 0 || *bucketStats != "" {
+		// Only the bucket engine keeps a count per address, or has buckets
+		switch *impl {
+		case "auto", "bucket":
+			*impl = "bucket"
+		default:
+			name := "-min-occurrences"
+			if *topIPs > 0 {
+				name = "-top-ips"
+			} else if *bucketStats != "" {
+				name = "-bucket-stats"
+			}
+			return fmt.Errorf("%s needs -impl bucket, got %s", name, *impl)
+		}
+	}
+	if opts.Checkpoint.Every > 0 && *impl != "auto" && *impl != "concurrent" && *impl != "bucket" {
+		name := "-checkpoint-every"
+		if opts.Checkpoint.Curve {
+			name = "-curve"
+		}
+		return fmt.Errorf("%s needs -impl concurrent or bucket, got %s", name, *impl)
+	}
+	if len(opts.Checkpoint.Shares) > 0 && *impl != "auto" && *impl != "naive" && *impl != "concurrent" && *impl != "bucket" {
+		return fmt.Errorf("-uniques-at needs -impl naive, concurrent or bucket, got %s", *impl)
+	}
+	if opts.StateFile != "" {
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		default:
+			return fmt.Errorf("-state-file needs -impl concurrent, got %s", *impl)
+		}
+	}
+	if opts.FirstSeen != "" {
+		// Only naive reads lines in order on one goroutine, so the
+		// first line it sees an address on is the earliest
+		*impl = "naive"
+	}
+	if *dump != "" {
+		// Only concurrent keeps the set to walk in order
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		default:
+			return fmt.Errorf("-dump needs -impl concurrent, got %s", *impl)
+		}
+		if err := checkDumpFormat(*dumpFormat); err != nil {
+			return err
+		}
+		if *dumpStream || *resumeDump {
+			if *dumpFormat != "text" {
+				return fmt.Errorf("-dump-stream writes text, not -dump-format %s", *dumpFormat)
+			}
+			opts.StreamDump, opts.ResumeDump = *dump, *resumeDump
+		}
+	} else if *dumpStream || *resumeDump {
+		return errors.New("-dump-stream and -resume-dump need -dump")
+	}
+	if opts.Record != "" {
+		// Only concurrent cuts the input into chunks for workers
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		default:
+			return fmt.Errorf("-record needs -impl concurrent, got %s", *impl)
+		}
+	}
+	if opts.AddressSpace.IsValid() {
+		// Only concurrent keeps a bitset it can bound to the block
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		default:
+			return fmt.Errorf("-address-space needs -impl concurrent, got %s", *impl)
+		}
+	}
+	if opts.Preload != "" {
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		default:
+			return fmt.Errorf("-preload needs -impl concurrent, got %s", *impl)
+		}
+	} else if *inclPreload {
+		return errors.New("-include-preloaded needs -preload")
+	}
+	if opts.BitsetFile != "" || opts.BitsetSwap {
+		// Auto would pick by RAM, which the mapped bitset does not need
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		default:
+			return fmt.Errorf("-bitset-file and -bitset-swap need -impl concurrent, got %s", *impl)
+		}
+	}
+	field, err := input.ParsePcapField(*pcapField)
+	if err != nil {
+		return fmt.Errorf("-pcap-field: %v", err)
+	}
+	inputFormat := opts.InputFormat
+	isPcap := inputFormat == "pcap"
+	isParquet := inputFormat == "parquet"
+	if isPcap || isParquet {
+		// Captures and Parquet columns are decoded to packed addresses
+		// before the engine
+		opts.InputFormat = "binary-be"
+	}
+	if opts.Record != "" && (isPcap || isParquet) {
+		return fmt.Errorf("-record traces the input's own bytes, which -input-format %s decodes first", inputFormat)
+	}
+	if counter.BinaryOrder(opts.InputFormat) != nil {
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		default:
+			return fmt.Errorf("-input-format %s needs -impl concurrent, got %s", inputFormat, *impl)
+		}
+	}
+	if *onError != "abort" && *onError != "skip" {
+		return fmt.Errorf("-on-error must be abort or skip, got %q", *onError)
+	}
+	if *parallelFiles < 1 {
+		return fmt.Errorf("-parallel-files must be at least 1, got %d", *parallelFiles)
+	}
+	if opts.SampleFraction > 0 {
+		*impl = "sample"
+	}
+	if opts.Window > 0 || *impl == "window" {
+		*impl = "window"
+		opts.Output = os.Stdout
+	}
+	if opts.GroupColumn > 0 || *impl == "group" {
+		*impl = "group"
+		opts.Output = os.Stdout
+	}
+	if *ef.pair {
+		*impl = "pair"
+	}
+	gate := counter.Thresholds{MinUnique: *minUnique, MinRatio: *minRatio}
+	if err := gate.Validate(); err != nil {
+		return fmt.Errorf("-fail-if-unique-*: %w", err)
+	}
+	if gate.NeedsLines() {
+		// Window reads lines without Trim, all and sample read them more
+		// than once or in part, and binary input has no lines
+		switch {
+		case *impl == "all" || *impl == "sample" || *impl == "window":
+			return fmt.Errorf("-fail-if-unique-ratio-below cannot count the lines of -impl %s", *impl)
+		case counter.BinaryOrder(opts.InputFormat) != nil:
+			return fmt.Errorf("-fail-if-unique-ratio-below needs text input, got -input-format %s", inputFormat)
+		}
+		opts.Parse.Lines = new(atomic.Int64)
+	}
+	if *canonReport {
+		switch {
+		case *impl == "all" || *impl == "sample" || *impl == "pair":
+			return fmt.Errorf("-canon-report cannot tally the lines of -impl %s", *impl)
+		case counter.BinaryOrder(opts.InputFormat) != nil:
+			return fmt.Errorf("-canon-report needs text input, got -input-format %s", inputFormat)
+		}
+		opts.Parse.Canon = new(utils.Canonical)
+	}
+	if *strictExamples < 0 {
+		return fmt.Errorf("-strict-examples must not be negative, got %d", *strictExamples)
+	}
+	if counter.BinaryOrder(opts.InputFormat) == nil {
+		// All and sample read lines more than once or in part, so their
+		// skipped lines add up to no input's
+		switch *impl {
+		case "all", "sample":
+			if opts.Strict {
+				return fmt.Errorf("-strict cannot check every line of -impl %s", *impl)
+			}
+		default:
+			opts.Parse.Malformed = &utils.Malformed{Keep: *strictExamples}
+		}
+	}
+	bd, err := loadBreakdowns(*geoipDB, *asnTable, impl)
+	if err != nil {
+		return err
+	}
+	if opts.PrefixSweep, err = counter.ParsePrefixLengths(*prefixSweep); err != nil {
+		return fmt.Errorf("-prefix-sweep: %w", err)
+	}
+	if *sweepFormat != "text" && *sweepFormat != "json" {
+		return fmt.Errorf("-prefix-sweep-format must be text or json, got %q", *sweepFormat)
+	}
+	if *byPrefix < 0 || *byPrefix > 24 {
+		return fmt.Errorf("-by-prefix must be 1 to 24, the /24s being the finest the engines tally, got %d", *byPrefix)
+	}
+	if *progress {
+		// All reads the input once per engine and sample only part of it
+		switch {
+		case *impl == "all" || *impl == "sample":
+			return fmt.Errorf("-progress cannot follow the reads of -impl %s", *impl)
+		case *progressEvery <= 0:
+			return fmt.Errorf("-progress-interval must be positive, got %s", *progressEvery)
+		}
+	}
+	if *metricsAddr != "" && (*impl == "all" || *impl == "sample") {
+		return fmt.Errorf("-metrics-addr cannot follow the reads of -impl %s", *impl)
+	}
+	if *timeout < 0 {
+		return fmt.Errorf("-timeout must not be negative, got %s", *timeout)
+	}
+	if *topN < 0 {
+		return fmt.Errorf("-top must not be negative, got %d", *topN)
+	}
+	if *topIPs < 0 {
+		return fmt.Errorf("-top-ips must not be negative, got %d", *topIPs)
+	}
+	opts.TopAddresses = *topIPs
+	opts.Density = *heatmapOut != "" || *byPrefix > 0
+	if opts.SubsampleRates, err = counter.ParseSubsampleRates(*subsampleRates); err != nil {
+		return fmt.Errorf("-subsample-rates: %w", err)
+	}
+	if n := len(opts.SubsampleRates); n > 0 {
+		if opts.SubsampleRates[n-1] != 1 {
+			// The full count comes from the same walk, so it matches the
+			// set the subsamples were drawn from, as after -state-file
+			opts.SubsampleRates = append(opts.SubsampleRates, 1)
+		}
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		case "bucket":
+		default:
+			return fmt.Errorf("-subsample-rates needs -impl concurrent or bucket, got %s", *impl)
+		}
+	}
+	if len(opts.PrefixSweep) > 0 || opts.Density {
+		switch *impl {
+		case "auto", "concurrent":
+			*impl = "concurrent"
+		case "bucket":
+		default:
+			name := "-prefix-sweep"
+			if *heatmapOut != "" {
+				name = "-heatmap"
+			} else if *byPrefix > 0 {
+				name = "-by-prefix"
+			}
+			return fmt.Errorf("%s needs -impl concurrent or bucket, got %s", name, *impl)
+		}
+		if opts.AddressSpace.IsValid() {
+			return errors.New("-prefix-sweep, -heatmap and -by-prefix need the full address space, not -address-space")
+		}
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("-output must be text or json, got %q", *output)
+	}
+	jsonOut := *output == "json"
+	if jsonOut {
+		switch {
+		case *impl == "window" || *impl == "group" || *impl == "pair":
+			return fmt.Errorf("-output json holds one count, not the output of -impl %s", *impl)
+		case opts.StateFile != "" || (opts.Preload != "" && !*inclPreload):
+			return errors.New("-output json holds one count, not the new and the seen addresses of -state-file or -preload")
+		case *geoipDB != "" || *asnTable != "" || len(opts.PrefixSweep) > 0 || *byPrefix > 0 || *topIPs > 0 || len(opts.SubsampleRates) > 0 || *canonReport:
+			return errors.New("-output json cannot be combined with -geoip, -asn-table, -prefix-sweep, -by-prefix, -top-ips, -subsample-rates or -canon-report, which print to stdout too")
+		}
+		if opts.Parse.Lines == nil && counter.BinaryOrder(opts.InputFormat) == nil && *impl != "all" && *impl != "sample" {
+			opts.Parse.Lines = new(atomic.Int64)
+		}
+	}
+	if opts.AutoFallback {
+		if *impl != "auto" && *impl != "concurrent" {
+			return fmt.Errorf("-auto-fallback needs -impl auto or concurrent, got %s", *impl)
+		}
+		if name := concurrentOnly(opts, *dump != "" || *geoipDB != "" || *asnTable != ""); name != "" {
+			return fmt.Errorf("-auto-fallback cannot be combined with %s, which the bucket engine does not provide", name)
+		}
+	}
+	args := flag.Args()
+	if len(args) == 0 && *manifest == "" {
+		args = []string{ipcount.Stdin} // piped in, as checked above
+	}
+	sources, err := expandInputs(args)
+	if err != nil {
+		return err
+	}
+	summary.inputs(sources)
+	if *manifest != "" {
+		listed, err := readManifest(*manifest)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, listed...)
+		summary.inputs(listed)
+	}
+	expect, err := expectation(*expectCount, *expectFile, *expectTolerance, sources)
+	if err != nil {
+		return err
+	}
+	if opts.Record != "" && len(sources) != 1 {
+		return errors.New("-record needs exactly one input, since offsets are into a single file")
+	}
+	if opts.FirstSeen != "" && len(sources) != 1 {
+		return errors.New("-first-seen needs exactly one input, since offsets are into a single file")
+	}
+	if opts.Checkpoint.Curve && len(sources) != 1 {
+		return errors.New("-curve needs exactly one input")
+	}
+	if len(opts.Checkpoint.Shares) > 0 && len(sources) != 1 {
+		return errors.New("-uniques-at needs exactly one input, since the shares are of a single file")
+	}
+	if *stats || summary != nil {
+		opts.Stats = &counter.Stats{}
+		if summary != nil {
+			summary.stats = opts.Stats
+		}
+	}
+	if *cacheDir == "" && (*cacheVerify || *noResultCache) {
+		return errors.New("-cache-verify and -no-result-cache need -cache-dir")
+	}
+	if *cacheMax < 0 {
+		return fmt.Errorf("-cache-max-entries must not be negative, got %d", *cacheMax)
+	}
 	var (
-		count int64
-		err   error
+		cache     *resultCache
+		key       string
+		cached    cacheEntry
+		hit       bool
+		verifyErr error
 	)
+	if *cacheDir != "" && !*noResultCache {
+		extras := *geoipDB != "" || *asnTable != "" || len(opts.PrefixSweep) > 0 || opts.Density || *topIPs > 0 || *bucketStats != "" ||
+			len(opts.SubsampleRates) > 0 || *dump != "" || opts.Record != "" || *canonReport
+		if why := uncacheable(sources, *impl, opts, extras); why != "" {
+			counter.Logger(opts.Logger).Info("not using the result cache", "reason", why)
+		} else {
+			cache = &resultCache{dir: *cacheDir, maxEntries: *cacheMax}
+			if key, err = cache.key(sources[0], *impl, opts, inputFormat, *pcapField, *ef.column, *member, ef.extractKey()); err != nil {
+				return err
+			}
+			cached, hit = cache.get(key)
+		}
+	}
+	if hit && !*cacheVerify {
+		printUnique(cached.Count, cached.Estimate, cached.StdError)
+		summary.counted(cached.Count, cached.Estimate, cached.StdError, cmp.Or(cached.Impl, *impl))
+		if *stats {
+			fmt.Fprintf(os.Stderr, "impl: %s\n", cmp.Or(cached.Impl, *impl))
+			fmt.Fprintf(os.Stderr, "result cache: hit, counted %s\n", cached.Counted.Format(time.RFC3339))
+		}
+		return checkCount(counter.Uniqueness{Unique: cached.Count}, expect, gate, summary)
+	}
+	if opts.MaxMem > 0 {
+		// Make the GC work harder near the budget instead of growing past it
+		debug.SetMemoryLimit(opts.MaxMem)
+	}
+
+	var curve *bufio.Writer
+	if opts.Checkpoint.Curve {
+		f, err := os.Create(*ef.curve)
+		if err != nil {
+			return fmt.Errorf("-curve: %w", err)
+		}
+		defer f.Close()
+		curve = bufio.NewWriter(f)
+		opts.Checkpoint.Out = curve
+	}
 
-	switch *impl {
-	case "naive":
-		count, err = naive.New().CountUniqueIPs(filename)
-	case "concurrent":
-		count, err = concurrent.New().CountUniqueIPs(filename)
-	case "bucket":
-		count, err = bucket.CountUniqueIPs(filename)
-	default:
-		log.Fatalf("unknown impl: %s", *impl)
+	ctx := interruptContext()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	var sampler *counter.MemSampler
+	if *stats || jsonOut {
+		sampler = counter.StartMemSampler(10 * time.Millisecond)
+	}
+	start := time.Now()
+	countOpts := []ipcount.Option{
+		ipcount.WithEngine(*impl),
+		ipcount.WithOptions(opts),
+		ipcount.WithS3(input.S3Options{
+			HTTPOptions: input.HTTPOptions{Timeout: *httpTimeout, Retries: cmp.Or(*httpRetries, -1), Logger: opts.Logger},
+			Region:      *s3Region,
+		}),
+		ipcount.WithMember(*member),
+		ipcount.WithParallelFiles(*parallelFiles),
+	}
+	if *progress {
+		countOpts = append(countOpts, ipcount.WithProgressFunc(*progressEvery, func(r counter.ProgressReport) {
+			fmt.Fprintln(os.Stderr, "progress:", r)
+		}))
+	}
+	if *metricsAddr != "" {
+		m, err := startMetrics(*metricsAddr, opts.Parse.Malformed)
+		if err != nil {
+			return err
+		}
+		defer m.close()
+		countOpts = append(countOpts, ipcount.WithProgressFunc(time.Second, m.report))
+	}
+	if *manifest != "" {
+		countOpts = append(countOpts, ipcount.WithProgress(os.Stderr))
+	}
+	if jsonOut && *impl != "all" && *impl != "sample" {
+		// All reads the input once per engine and sample only part of it
+		countOpts = append(countOpts, ipcount.WithPhases())
+	}
+	if isPcap {
+		countOpts = append(countOpts, ipcount.WithPcap(field))
+	}
+	if isParquet {
+		countOpts = append(countOpts, ipcount.WithParquet(*ef.column))
+	}
+	if *onError == "skip" {
+		countOpts = append(countOpts, ipcount.WithSkipFailed())
+	}
+	if *forceText {
+		countOpts = append(countOpts, ipcount.WithForceText())
+	}
+	if opts.AutoFallback && *impl == "concurrent" {
+		countOpts = append(countOpts, ipcount.WithCounter(counter.NewFallback(opts)))
+	}
+	src := ipcount.File(sources[0])
+	if len(sources) > 1 || *manifest != "" {
+		src = ipcount.Files(sources...)
+	}
+	res, err := ipcount.Count(ctx, src, countOpts...)
+	elapsed := time.Since(start)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("count stopped after -timeout %s: %w", *timeout, err)
 	}
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		return err
+	}
+	if curve != nil {
+		if err := curve.Flush(); err != nil {
+			return fmt.Errorf("-curve: %w", err)
+		}
+	}
+	c, count := res.Counter, res.Unique
+	fb, _ := c.(*counter.Fallback)
+	if fb != nil {
+		c = fb.Counter()
+	}
+	if *onError == "skip" {
+		printSkipped(res.Skipped, len(sources))
+	}
+	if v, ok := c.(*counter.Verify); ok {
+		fmt.Fprintln(os.Stderr, "all engines agree:")
+		fmt.Fprintln(os.Stderr, v.Report())
+	}
+	if s, ok := c.(*sample.SampleCounter); ok {
+		fmt.Fprintln(os.Stderr, s.Result())
+	}
+	if b, ok := c.(*concurrent.BitsetCounter); ok && opts.StateFile != "" {
+		fmt.Printf("New IPv4 addresses: %d\n", count)
+		fmt.Printf("Ever seen IPv4 addresses: %d\n", b.Count())
+	} else if b, ok := c.(*concurrent.BitsetCounter); ok && opts.Preload != "" {
+		if *inclPreload {
+			res.Unique = b.Count() // the gates judge what is printed
+			if !jsonOut {
+				printUnique(res.Unique, res.Estimate, res.StdError)
+			}
+		} else {
+			fmt.Printf("New IPv4 addresses: %d\n", count)
+		}
+	} else if b, ok := c.(*concurrent.BitsetCounter); ok && opts.ResumeDump {
+		// The dump holds what the interrupted count found of the same
+		// input, so the set is the input's
+		res.Unique = b.Count()
+		if !jsonOut {
+			printUnique(res.Unique, res.Estimate, res.StdError)
+		}
+	} else if _, ok := c.(*ipv6.IPv6Counter); ok {
+		family := "IPv6"
+		if opts.Family == "any" {
+			family = "IPv4 and IPv6"
+		}
+		if !jsonOut {
+			fmt.Printf("Unique %s addresses: %d\n", family, count)
+		}
+	} else if p, ok := c.(*pair.PairCounter); ok {
+		fmt.Printf("Unique address pairs: %d\n", count)
+		if opts.PairEndpoints {
+			sources, destinations := p.Endpoints()
+			fmt.Printf("Distinct sources: %d\n", sources)
+			fmt.Printf("Distinct destinations: %d\n", destinations)
+		}
+	} else {
+		if !jsonOut {
+			printUnique(count, res.Estimate, res.StdError)
+		}
+		if cache != nil {
+			name := *impl
+			if a, ok := c.(*counter.Auto); ok {
+				name = fmt.Sprintf("auto -> %s", a.Selection())
+			}
+			if err := cache.put(key, cacheEntry{
+				Source: sources[0], Impl: name, Count: count,
+				Estimate: res.Estimate, StdError: res.StdError, Counted: time.Now(),
+			}); err != nil {
+				return err
+			}
+			switch {
+			case hit && cached.Count != count:
+				// Fail once the engine is closed and the stats printed
+				verifyErr = fmt.Errorf("result cache: cached count %d for %s, recounted %d; entry replaced", cached.Count, sources[0], count)
+				opts.Stats.Set("result cache", "mismatch")
+			case hit:
+				opts.Stats.Set("result cache", "verified")
+			default:
+				opts.Stats.Set("result cache", "stored")
+			}
+		}
+	}
+	summary.counted(res.Unique, res.Estimate, res.StdError, implName(c, fb, *impl))
+	if err := bd.print(c); err != nil {
+		return err
+	}
+	if err := printPrefixSweep(c, *sweepFormat); err != nil {
+		return err
+	}
+	printTopSubnets(c, *byPrefix, *topN)
+	printTopAddresses(c)
+	printSubsamples(c)
+	printCanonReport(opts.Parse.Canon)
+	if *heatmapOut != "" {
+		if err := writeHeatmap(c, *heatmapOut, opts.Fsync); err != nil {
+			return err
+		}
+	}
+	if *dump != "" && opts.StreamDump == "" {
+		if err := writeDump(c, *dump, *dumpFormat, sources, flag.CommandLine, opts.Fsync); err != nil {
+			return err
+		}
+	}
+	if *bucketStats != "" {
+		if err := writeBucketStats(c, *bucketStats, opts.Fsync); err != nil {
+			return err
+		}
+	}
+	if b, ok := c.(*concurrent.BitsetCounter); ok {
+		if err := b.Close(); err != nil {
+			return err
+		}
+	}
+
+	if m := opts.Parse.Malformed; m != nil {
+		opts.Stats.Set("malformed lines", "%d", m.Lines())
+	}
+	var peak counter.MemPeak
+	if sampler != nil {
+		peak = sampler.Stop()
+	}
+	if jsonOut {
+		if err := newCountOutput(res, fb, *impl, opts, elapsed, peak).print(); err != nil {
+			return err
+		}
+	}
+	if *stats {
+		fmt.Fprintf(os.Stderr, "impl: %s\n", implName(c, fb, *impl))
+		fmt.Fprintf(os.Stderr, "elapsed: %s\n", elapsed.Round(time.Millisecond))
+		fmt.Fprintf(os.Stderr, "peak memory: %s\n", peak)
+		if s := opts.Stats.String(); s != "" {
+			fmt.Fprintln(os.Stderr, s)
+		}
+	}
+	if verifyErr != nil {
+		return verifyErr
+	}
+	reread := malformedReread(sources, *impl, opts)
+	if *manifest != "" {
+		reread = ""
+	}
+	if err := reportMalformed(opts.Parse.Malformed, opts.Strict, reread, opts.Parse, opts.MaxLine, counter.Logger(opts.Logger)); err != nil {
+		return err
 	}
-	fmt.Printf("Unique IPv4 addresses: %d\n", count)
+	return checkCount(res.Uniqueness(), expect, gate, summary)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/input"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// reportMalformed tells how many lines of text input the count skipped
+// because they failed to parse. Without -strict that is a warning; with
+// it the run fails with a *counter.MalformedError, once up to keep of the
+// lines are quoted on stderr. They are numbered when reread names a file
+// that can be parsed again in order to find them, else they are the
+// examples the workers kept, in no particular order.
+func reportMalformed(m *utils.Malformed, strict bool, reread string, parse utils.ParseOptions, maxLine int, log *slog.Logger) error {
+	n := m.Lines()
+	if n == 0 {
+		return nil
+	}
+	if !strict {
+		log.Warn("skipped lines that failed to parse", "lines", n)
+		return nil
+	}
+	keep := min(int64(m.Keep), n)
+	var numbered []invalidLine
+	if reread != "" && keep > 0 {
+		found, err := numberMalformed(reread, parse, maxLine, int(keep))
+		if err != nil {
+			log.Info("cannot number the malformed lines", "err", err)
+		} else if int64(len(found)) == keep {
+			numbered = found
+		}
+	}
+	switch {
+	case numbered != nil:
+		fmt.Fprintf(os.Stderr, "malformed lines: %d, the first %d:\n", n, keep)
+		for _, bad := range numbered {
+			fmt.Fprintf(os.Stderr, "  line %d: %q: %v\n", bad.line, bad.text, bad.err)
+		}
+	case keep > 0:
+		fmt.Fprintf(os.Stderr, "malformed lines: %d, among them:\n", n)
+		for _, bad := range m.Examples() {
+			fmt.Fprintf(os.Stderr, "  %q: %v\n", bad.Text, bad.Err)
+		}
+	}
+	return &counter.MalformedError{Lines: n}
+}
+
+// malformedReread returns the input to read again for the numbers of the
+// malformed lines, or "" when there is none: only one local file, not a
+// tar archive, whose lines are each an address, so that a line the engine
+// skipped is one ParseBlock rejects.
+func malformedReread(sources []string, impl string, opts counter.Options) string {
+	if len(sources) != 1 || sources[0] == ipcount.Stdin || ipcount.IsRemote(sources[0]) {
+		return ""
+	}
+	switch impl {
+	case "pair", "group", "window", "ipv6":
+		return ""
+	}
+	if opts.AddressSpace.IsValid() {
+		return "" // the addresses outside it parse
+	}
+	if fi, err := os.Stat(sources[0]); err != nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+	if isTar, err := input.IsTar(sources[0]); err != nil || isTar {
+		return ""
+	}
+	return sources[0]
+}
+
+// numberMalformed reads path again from the start, one chunk at a time,
+// and returns its first n lines that fail to parse, numbered as validate
+// numbers them.
+func numberMalformed(path string, parse utils.ParseOptions, maxLine, n int) ([]invalidLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, _, err := input.Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	// The tallies were taken by the count
+	parse.Lines, parse.Comments, parse.Relaxed, parse.Canon, parse.Malformed = nil, nil, nil, nil, nil
+	delim := parse.Delim()
+	cr := utils.NewDelimChunkReader(r, validateChunk, maxLine, delim)
+	maxLine = cmp.Or(maxLine, utils.DefaultMaxLine)
+	var found []invalidLine
+	var lines int64
+	for len(found) < n {
+		c, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rep chunkReport
+		validateChunkData(c.Data, parse, maxLine, delim, n-len(found), &rep)
+		cr.Release(c)
+		for _, bad := range rep.invalid {
+			bad.line += lines
+			found = append(found, bad)
+		}
+		lines += rep.lines
+	}
+	return found, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Every engine notes the lines it skips, comments aside, and a strict run
+// fails with them numbered from the start of the file.
+func TestStrictMalformed(t *testing.T) {
+	var b strings.Builder
+	var want []int64
+	for i := range 30000 {
+		switch {
+		case i%7001 == 6:
+			want = append(want, int64(i+1))
+			fmt.Fprintf(&b, "bad %d\n", i)
+		case i%5000 == 0:
+			b.WriteString("# comment\n")
+		default:
+			fmt.Fprintf(&b, "10.0.%d.%d\n", i>>8&255, i&255)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, impl := range []string{"naive", "concurrent", "bucket", "kmv"} {
+		opts := counter.Options{Logger: discard, Strict: true}
+		opts.Parse.CommentPrefix = "#"
+		opts.Parse.Malformed = &utils.Malformed{Keep: 3}
+		if _, err := ipcount.Count(context.Background(), ipcount.File(path), ipcount.WithEngine(impl), ipcount.WithOptions(opts)); err != nil {
+			t.Fatalf("%s: %v", impl, err)
+		}
+		if n := opts.Parse.Malformed.Lines(); n != int64(len(want)) {
+			t.Errorf("%s: %d malformed lines, want %d", impl, n, len(want))
+		}
+		err := reportMalformed(opts.Parse.Malformed, true, "", opts.Parse, 0, discard)
+		var me *counter.MalformedError
+		if !errors.As(err, &me) || !errors.Is(err, counter.ErrMalformed) || me.Lines != int64(len(want)) {
+			t.Errorf("%s: %v, want %d malformed lines", impl, err, len(want))
+		}
+	}
+
+	found, err := numberMalformed(path, utils.ParseOptions{CommentPrefix: "#"}, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for _, bad := range found {
+		got = append(got, bad.line)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want[:3]) {
+		t.Errorf("numbered lines %v, want %v", got, want[:3])
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// readManifest returns the sources listed in a manifest: one path, URL or
+// s3:// object per line, blank lines and lines starting with # ignored.
+// Relative paths are taken from the manifest's directory, so a manifest
+// and the files it lists can move together.
+func readManifest(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	defer f.Close()
+	var sources []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !ipcount.IsRemote(line) && !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		sources = append(sources, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no sources", path)
+	}
+	return sources, nil
+}
+
+// expandInputs returns the sources named on the command line, with each
+// glob pattern replaced by the files it matches in lexical order, so that
+// hundreds of hourly files can be named as 'logs/*.log' without running
+// into the shell's argument limit. A pattern matching nothing is an
+// error, and directories it matches are left out. Remote sources, Stdin
+// and names that exist as given are kept as they are; Stdin may appear
+// once.
+func expandInputs(args []string) ([]string, error) {
+	var sources []string
+	stdin := false
+	for _, arg := range args {
+		if arg == ipcount.Stdin {
+			if stdin {
+				return nil, errors.New("standard input (-) named more than once")
+			}
+			stdin = true
+		}
+		if arg == ipcount.Stdin || ipcount.IsRemote(arg) || !strings.ContainsAny(arg, "*?[") {
+			sources = append(sources, arg)
+			continue
+		}
+		if _, err := os.Lstat(arg); err == nil {
+			sources = append(sources, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", arg, err)
+		}
+		n := len(sources)
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+				continue
+			}
+			sources = append(sources, m)
+		}
+		if len(sources) == n {
+			return nil, fmt.Errorf("%s: no files match", arg)
+		}
+	}
+	return sources, nil
+}
+
+// stdinPiped reports whether the standard input is a pipe or a file
+// rather than a terminal, so a run without inputs can count it.
+func stdinPiped() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// printSkipped writes the skipped inputs and their errors to stderr, if
+// any, so a partial count says what it is missing.
+func printSkipped(skipped []ipcount.Skipped, total int) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "skipped %d of %d inputs:\n", len(skipped), total)
+	for _, e := range skipped {
+		fmt.Fprintf(os.Stderr, "  %s: %v\n", e.Name, e.Err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// Patterns expand to the files they match in order, leaving directories
+// out; names that exist as given, URLs and stdin are kept as they are.
+func TestExpandInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.log", "a.log", "c.txt", "[odd].log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d.log"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	in := func(name string) string { return filepath.Join(dir, name) }
+
+	got, err := expandInputs([]string{in("*.log"), ipcount.Stdin, in("[odd].log"), "https://example.com/x*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{in("[odd].log"), in("a.log"), in("b.log"), ipcount.Stdin, in("[odd].log"), "https://example.com/x*.log"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, args := range [][]string{{in("*.csv")}, {in("d.*")}, {ipcount.Stdin, in("c.txt"), ipcount.Stdin}} {
+		if got, err := expandInputs(args); err == nil {
+			t.Errorf("%q: %q, want an error", args, got)
+		}
+	}
+}
+
+// A manifest's sources count as one input: relative paths are taken from
+// the manifest's directory, and with -on-error skip a missing file and a
+// URL answering 404 are listed as skipped while the rest count; without
+// it the first failure ends the count.
+func TestManifestOnError(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone.log" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "10.0.0.9\n10.0.0.1\n")
+	}))
+	defer srv.Close()
+	write("a.log", "10.0.0.1\n10.0.0.2\n")
+	abs := write("b.log", "10.0.0.2\n10.0.0.3\n")
+	manifest := write("sources.txt", strings.Join([]string{
+		"# yesterday's logs",
+		"a.log",
+		"",
+		abs,
+		"missing.log",
+		srv.URL + "/gone.log",
+		srv.URL + "/live.log",
+	}, "\n"))
+
+	sources, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "a.log"), abs, filepath.Join(dir, "missing.log"), srv.URL + "/gone.log", srv.URL + "/live.log"}
+	if !slices.Equal(sources, want) {
+		t.Fatalf("sources %q, want %q", sources, want)
+	}
+
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts := []ipcount.Option{ipcount.WithEngine("naive"), ipcount.WithLogger(discard)}
+	res, err := ipcount.Count(context.Background(), ipcount.Files(sources...), append(opts, ipcount.WithSkipFailed())...)
+	if err != nil || res.Unique != 4 {
+		t.Fatalf("skipping: %d, %v; want 4", res.Unique, err)
+	}
+	var skipped []string
+	for _, s := range res.Skipped {
+		skipped = append(skipped, s.Name)
+	}
+	if !slices.Equal(skipped, []string{filepath.Join(dir, "missing.log"), srv.URL + "/gone.log"}) {
+		t.Errorf("skipped %v", res.Skipped)
+	}
+	if _, err := ipcount.Count(context.Background(), ipcount.Files(sources...), opts...); err == nil {
+		t.Error("without skipping, failed sources gave no error")
+	}
+
+	if _, err := readManifest(write("empty.txt", "# nothing yet\n\n")); err == nil {
+		t.Error("a manifest listing no sources was accepted")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/heatmap"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// runMap implements `ipcounter map`: count the inputs into one set and
+// draw it with writeHeatmap, as -heatmap does after a normal count.
+func runMap(args []string) error {
+	fs := flag.NewFlagSet("map", flag.ExitOnError)
+	out := fs.String("o", "", "PNG file to write (required)")
+	impl := fs.String("impl", "concurrent", "engine building the set: concurrent|bucket")
+	ef := addEngineFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter map -o FILE.png [flags] <filename>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *out == "" || fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *impl != "concurrent" && *impl != "bucket" {
+		return fmt.Errorf("map needs -impl concurrent or bucket, got %s", *impl)
+	}
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	if opts.InputFormat == "pcap" || opts.InputFormat == "parquet" {
+		return fmt.Errorf("map cannot read -input-format %s; count the files with -heatmap instead", opts.InputFormat)
+	}
+	opts.Density = true
+	c, err := counter.NewWithOptions(*impl, opts)
+	if err != nil {
+		return err
+	}
+	if b, ok := c.(*concurrent.BitsetCounter); ok {
+		defer b.Close()
+	}
+
+	ctx := interruptContext()
+	src := ipcount.File(fs.Arg(0))
+	if fs.NArg() > 1 {
+		src = ipcount.Files(fs.Args()...)
+	}
+	res, err := ipcount.Count(ctx, src, ipcount.WithEngine(*impl), ipcount.WithCounter(c), ipcount.WithOptions(opts))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Unique IPv4 addresses: %d\n", res.Unique)
+	return writeHeatmap(c, *out, opts.Fsync)
+}
+
+// writeHeatmap draws the per-/24 density of c's set, counted with
+// Options.Density, as a PNG at path, fsynced with sync.
+func writeHeatmap(c counter.Counter, path string, sync bool) error {
+	dm, ok := c.(counter.DensityMapper)
+	if !ok {
+		return fmt.Errorf("-heatmap needs -impl concurrent or bucket")
+	}
+	return heatmap.WriteFile(path, dm.Density(), sync)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/ipcset"
+)
+
+// Snapshots and ipcset files load into one set holding their union, and
+// a corrupt file is refused.
+func TestLoadState(t *testing.T) {
+	dir := t.TempDir()
+	a, b := concurrent.New(), concurrent.New()
+	for ip := uint32(0); ip < 5000; ip++ {
+		a.Add(10<<24 | ip*7) // a dense /16, saved as a bitmap
+	}
+	for ip := uint32(0); ip < 100; ip++ {
+		b.Add(10<<24 | ip*7)
+		b.Add(192<<24 | 168<<16 | ip)
+	}
+	snapA, snapB := filepath.Join(dir, "a.bits"), filepath.Join(dir, "b.bits")
+	if err := a.WriteSnapshotFile(snapA); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteSnapshotFile(snapB); err != nil {
+		t.Fatal(err)
+	}
+	dump := filepath.Join(dir, "c.ipcset")
+	f, err := os.Create(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := ipcset.NewWriter(f, ipcset.Header{Count: 2, Encoding: ipcset.Delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Add(8<<24 | 8<<16 | 8<<8 | 8)
+	w.Add(192<<24 | 168<<16 | 1)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	union := concurrent.New()
+	for path, want := range map[string]int64{snapA: 5000, snapB: 200, dump: 2} {
+		n, err := loadState(union, path)
+		if err != nil || n != want {
+			t.Fatalf("%s: got %d, %v, want %d", path, n, err, want)
+		}
+	}
+	if got, want := union.Count(), int64(5000+100+1); got != want {
+		t.Errorf("union: got %d, want %d", got, want)
+	}
+
+	data, err := os.ReadFile(snapB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	bad := filepath.Join(dir, "bad.bits")
+	if err := os.WriteFile(bad, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(concurrent.New(), bad); err == nil {
+		t.Error("corrupt snapshot loaded")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// metricsServer serves the progress of a running count at /metrics in the
+// Prometheus text format, for -metrics-addr.
+type metricsServer struct {
+	last      atomic.Pointer[counter.ProgressReport]
+	malformed *utils.Malformed // lines skipped so far, nil if not followed
+	hs        *http.Server
+}
+
+// startMetrics listens on addr and serves the reports given to report
+// until close.
+func startMetrics(addr string, malformed *utils.Malformed) (*metricsServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("-metrics-addr: %w", err)
+	}
+	m := &metricsServer{malformed: malformed}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m)
+	m.hs = &http.Server{Handler: mux}
+	go func() {
+		if err := m.hs.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("metrics server stopped", "err", err)
+		}
+	}()
+	slog.Debug("metrics listening", "addr", ln.Addr())
+	return m, nil
+}
+
+// report keeps r as the latest progress of the count.
+func (m *metricsServer) report(r counter.ProgressReport) {
+	m.last.Store(&r)
+}
+
+// close stops serving.
+func (m *metricsServer) close() {
+	m.hs.Close()
+}
+
+func (m *metricsServer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r := m.last.Load()
+	if r == nil {
+		r = &counter.ProgressReport{Unique: -1} // before the first report
+	}
+	writeMetrics(w, *r, m.malformed)
+}
+
+// writeMetrics writes r, with the lines malformed has seen if it is not
+// nil, in the Prometheus text format.
+func writeMetrics(w io.Writer, r counter.ProgressReport, malformed *utils.Malformed) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP ipcounter_%s %s\n# TYPE ipcounter_%s %s\n", name, help, name, typ)
+	}
+	if r.Phase != "" {
+		labels := fmt.Sprintf("{phase=%q,unit=%q}", r.Phase, r.Unit)
+		metric("phase_done", "gauge", "Work done in the current phase, in its unit.")
+		fmt.Fprintf(w, "ipcounter_phase_done%s %d\n", labels, r.Done)
+		if r.Total >= 0 {
+			metric("phase_total", "gauge", "Work in the current phase, in its unit.")
+			fmt.Fprintf(w, "ipcounter_phase_total%s %d\n", labels, r.Total)
+		}
+		metric("phase_elapsed_seconds", "gauge", "Time since the current phase started.")
+		fmt.Fprintf(w, "ipcounter_phase_elapsed_seconds%s %g\n", labels, r.PhaseElapsed.Seconds())
+	}
+	metric("lines", "gauge", "Lines read in the current phase, 0 if the engine does not count them.")
+	fmt.Fprintf(w, "ipcounter_lines %d\n", r.Lines)
+	if r.Unique >= 0 {
+		metric("unique", "gauge", "Distinct addresses counted so far.")
+		fmt.Fprintf(w, "ipcounter_unique %d\n", r.Unique)
+	}
+	if malformed != nil {
+		metric("malformed_lines_total", "counter", "Lines that failed to parse.")
+		fmt.Fprintf(w, "ipcounter_malformed_lines_total %d\n", malformed.Lines())
+	}
+	metric("temp_bytes_written_total", "counter", "Bytes written to temp files, after compression.")
+	fmt.Fprintf(w, "ipcounter_temp_bytes_written_total %d\n", r.TempBytes)
+	if len(r.WorkerBytes) > 0 {
+		metric("worker_bytes_total", "counter", "Input bytes each parsing worker has handled.")
+		for i, n := range r.WorkerBytes {
+			fmt.Fprintf(w, "ipcounter_worker_bytes_total{worker=\"%d\"} %d\n", i, n)
+		}
+	}
+	metric("elapsed_seconds", "gauge", "Time since the count started.")
+	fmt.Fprintf(w, "ipcounter_elapsed_seconds %g\n", r.Elapsed.Seconds())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A report prints as Prometheus samples, labelled by phase and worker,
+// leaving out what is unknown: the total of a pipe and a unique count
+// only known at the end.
+func TestWriteMetrics(t *testing.T) {
+	m := &utils.Malformed{}
+	m.Add([]byte("bad"), utils.ErrInvalidChar)
+	r := counter.ProgressReport{Phase: "pass 1", Unit: "bytes", Done: 4096, Total: -1, Lines: 300, Unique: -1,
+		Elapsed: 3 * time.Second, PhaseElapsed: 2 * time.Second, TempBytes: 1200, WorkerBytes: []int64{3000, 1096}}
+	var b strings.Builder
+	writeMetrics(&b, r, m)
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		`ipcounter_phase_done{phase="pass 1",unit="bytes"} 4096`,
+		`ipcounter_phase_elapsed_seconds{phase="pass 1",unit="bytes"} 2`,
+		`ipcounter_lines 300`,
+		`ipcounter_malformed_lines_total 1`,
+		`ipcounter_temp_bytes_written_total 1200`,
+		`ipcounter_worker_bytes_total{worker="0"} 3000`,
+		`ipcounter_worker_bytes_total{worker="1"} 1096`,
+		`ipcounter_elapsed_seconds 3`,
+	}
+	if g, w := strings.Join(got, "\n"), strings.Join(want, "\n"); g != w {
+		t.Errorf("metrics:\n%s\nwant:\n%s", g, w)
+	}
+	if !strings.Contains(b.String(), "# TYPE ipcounter_worker_bytes_total counter\n") {
+		t.Errorf("no TYPE line for the worker bytes:\n%s", b.String())
+	}
+}
@@ -17,44 +17,281 @@ Cons:
 */
 
 import (
-	"ipcounter/utils"
-	"bufio"
+	"bytes"
+	"cmp"
+	"context"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
-	"strings"
+	"strconv"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	ctxCheckLines  = 1 << 16         // lines between cancellation and budget checks
+	bytesPerChunk  = 1 * 1024 * 1024 // read buffer size
+	mapEntryBytes  = 40              // approximate map cost per distinct address
+	firstSeenBytes = 16              // a firstSeen entry, for Options.FirstSeen
 )
 
-type NaiveCounter struct{}
+// Options configures a NaiveCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+	MaxMem  int64              // fail with counter.ErrMemBudget once the map outgrows this, 0 for no cap
+	Retries int                // reopen attempts in a row after a transient read error, 0 for none
+	NoCache bool               // drop the file's pages from the page cache behind the read position
+
+	// RejectMapped turns down IPv4-mapped lines such as "::ffff:1.2.3.4",
+	// which naive counts as their IPv4 address whatever Parse.Mapped
+	// says, as it did when it parsed with net.ParseIP.
+	RejectMapped bool
+
+	// FirstSeen, if set, is where an "ip,offset" CSV is written after a
+	// successful count: one row per distinct address, in order of first
+	// appearance, giving the byte offset in the input of the line it
+	// first appeared on.
+	FirstSeen string
+	Sync      bool // fsync the FirstSeen file before it is renamed into place
+
+	// Checkpoint's Shares, if any, get the running count at those shares
+	// of the input, exact since lines are read in order. Its Every is
+	// not supported.
+	Checkpoint counter.Checkpoint
+
+	Progress *counter.Progress // receives the input read and the count so far, nil for none
+	Stats    *counter.Stats    // receives the oversized line count and extreme addresses, nil to discard
+	Logger   *slog.Logger      // receives the first few lines that fail to parse and a summary, nil for slog.Default()
+}
+
+func init() {
+	counter.Register("naive", func(o counter.Options) (counter.Counter, error) {
+		return NewWithOptions(Options{Parse: o.Parse, MaxLine: o.MaxLine, MaxMem: o.MaxMem, Retries: o.ReadRetries,
+			NoCache: o.NoCache, FirstSeen: o.FirstSeen, Sync: o.Fsync, Stats: o.Stats, Progress: o.Progress, Logger: o.Logger,
+			Checkpoint: counter.Checkpoint{Shares: o.Checkpoint.Shares, Table: o.Checkpoint.Table}}), nil
+	})
+}
+
+type NaiveCounter struct {
+	opts Options
+	log  *slog.Logger
+}
 
 func New() *NaiveCounter {
-	return &NaiveCounter{}
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a NaiveCounter with the given options.
+func NewWithOptions(opts Options) *NaiveCounter {
+	if !opts.RejectMapped {
+		opts.Parse.Mapped = true
+	}
+	return &NaiveCounter{opts: opts, log: counter.Logger(opts.Logger)}
 }
 
 func (c *NaiveCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation, checked every
+// ctxCheckLines lines.
+func (c *NaiveCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return 0, fmt.Errorf("failed to open file: %w", err)
+		return 0, &counter.OpenError{Path: filename, Err: err}
 	}
 	defer file.Close()
+	lines, blank, err := counter.BlankFile(file, c.opts.Parse.Delim())
+	if err != nil {
+		return 0, counter.WrapRead(filename, err)
+	}
+	if blank {
+		counter.NoteBlank(c.opts.Stats, c.opts.Parse, lines)
+		return c.CountReader(ctx, bytes.NewReader(nil))
+	}
+	var size int64
+	if st, err := file.Stat(); err == nil && st.Mode().IsRegular() {
+		size = st.Size()
+	}
+	r := counter.NewRetryFile(ctx, file, c.opts.Retries, c.opts.Stats, c.log)
+	defer r.Close()
+	if c.opts.NoCache {
+		return c.countReader(ctx, counter.DropBehind(file, 0, r), size)
+	}
+	return c.countReader(ctx, r, size)
+}
 
+// CountUniqueIPsFS counts distinct IPv4s in the file name of fsys, such
+// as an embed.FS or fstest.MapFS.
+func (c *NaiveCounter) CountUniqueIPsFS(fsys fs.FS, name string) (int64, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return 0, &counter.OpenError{Path: name, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(context.Background(), file)
+}
+
+// CountReader counts distinct IPv4s read from r.
+func (c *NaiveCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	return c.countReader(ctx, r, 0)
+}
+
+// countReader is CountReader of an input of size bytes, 0 if unknown.
+func (c *NaiveCounter) countReader(ctx context.Context, r io.Reader, size int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	skips := counter.NewSkipLog(c.log)
 	uniqueIPs := make(map[uint32]struct{})
-	scanner := bufio.NewScanner(file)
+	cr := utils.NewDelimChunkReader(r, bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+	oversized := int64(0)
+	lines := 0
+	delim := c.opts.Parse.Delim()
+	plain := c.opts.Parse.Plain()
+	var ext *counter.Extremes
+	if c.opts.Stats != nil {
+		ext = new(counter.Extremes)
+	}
+	var seen []firstSeen // in order of first appearance, so by offset
+	perIP := int64(mapEntryBytes)
+	if c.opts.FirstSeen != "" {
+		perIP += firstSeenBytes
+	}
+	meter := counter.NewMeter(c.opts.Checkpoint, func() int64 { return int64(len(uniqueIPs)) }, false)
+	meter.SetSize(size)
+	var metered, meteredLines, end int64 // input and lines added to meter, input read
+	var progressed int64                 // lines added to Progress
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	for {
+		ch, err := cr.Next()
+		if err == io.EOF {
+			break
 		}
-		ipInt, err := utils.IPToUint32(line)
 		if err != nil {
-			continue
+			return 0, counter.WrapRead("", err)
+		}
+		end = ch.Offset + int64(len(ch.Data))
+		for data := ch.Data; len(data) > 0; {
+			at := ch.Offset + int64(len(ch.Data)-len(data))
+			if meter != nil {
+				// Every line before at is counted
+				meter.Add(int64(lines)-meteredLines, at-metered)
+				metered, meteredLines = at, int64(lines)
+			}
+			var raw []byte
+			var first, last uint32
+			var ok bool
+			if plain {
+				// One pass over the line; the lines it turns down are
+				// parsed again below
+				var next int
+				first, next, ok = utils.ParseIPv4Line(data, 0)
+				raw, data = data[:next], data[next:]
+				if len(raw) > 0 && raw[len(raw)-1] == '\n' {
+					raw = raw[:len(raw)-1]
+				}
+				last, ok = first, ok && len(raw) <= maxLine
+			} else {
+				raw, data = utils.NextRecord(data, delim)
+			}
+			if lines++; lines%ctxCheckLines == 0 {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				if m := c.opts.MaxMem; m > 0 && int64(len(uniqueIPs))*perIP > m {
+					return 0, fmt.Errorf("%w: %d distinct addresses need about %s of %s budget; use the concurrent or bucket engine",
+						counter.ErrMemBudget, len(uniqueIPs), counter.FormatBytes(int64(len(uniqueIPs))*perIP), counter.FormatBytes(m))
+				}
+			}
+			switch {
+			case ok:
+				if !c.opts.Parse.Filter.Allow(first) {
+					continue
+				}
+			case len(raw) > maxLine:
+				oversized++
+				continue
+			default:
+				line := c.opts.Parse.Trim(raw)
+				if len(line) == 0 {
+					continue
+				}
+				var form utils.Form
+				var err error
+				if first, last, form, err = c.opts.Parse.ParseForm(raw, line); err != nil {
+					c.opts.Parse.Malformed.Add(line, err)
+					skips.Add(line, err)
+					continue
+				}
+				c.opts.Parse.Canon.Add(first, last, form)
+			}
+			for ip := first; ; ip++ {
+				n := len(uniqueIPs)
+				if uniqueIPs[ip] = struct{}{}; len(uniqueIPs) > n {
+					ext.Add(ip)
+					if c.opts.FirstSeen != "" {
+						seen = append(seen, firstSeen{ip, at})
+					}
+				}
+				if ip == last {
+					break
+				}
+			}
 		}
-		uniqueIPs[ipInt] = struct{}{}
+		c.opts.Progress.Add(int64(lines)-progressed, int64(len(ch.Data)))
+		c.opts.Progress.SetUnique(int64(len(uniqueIPs)))
+		progressed = int64(lines)
+		cr.Release(ch)
 	}
+	meter.Add(int64(lines)-meteredLines, end-metered)
+	meter.Finish()
 
-	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("error reading file: %w", err)
+	c.opts.Stats.Set("oversized lines", "%d", oversized+cr.Oversized())
+	ext.Report(c.opts.Stats)
+	if c.opts.FirstSeen != "" {
+		if err := writeFirstSeen(c.opts.FirstSeen, seen, c.opts.Sync); err != nil {
+			return 0, err
+		}
 	}
-
+	c.log.Info("naive count done", "unique", len(uniqueIPs), "oversized", oversized+cr.Oversized(),
+		"elapsed", time.Since(start).Round(time.Millisecond))
 	return int64(len(uniqueIPs)), nil
-}
\ No newline at end of file
+}
+
+// firstSeen is an address and the offset of the line it first appeared on.
+type firstSeen struct {
+	ip  uint32
+	off int64
+}
+
+// writeFirstSeen writes seen to path as "ip,offset" CSV with a header,
+// through a temp file renamed into place once complete.
+func writeFirstSeen(path string, seen []firstSeen, sync bool) error {
+	err := counter.WriteFileAtomic(path, sync, func(w io.Writer) error {
+		if _, err := io.WriteString(w, "ip,offset\n"); err != nil {
+			return err
+		}
+		var buf []byte
+		for _, s := range seen {
+			buf = utils.AppendIPv4(buf[:0], s.ip)
+			buf = append(buf, ',')
+			buf = strconv.AppendInt(buf, s.off, 10)
+			if _, err := w.Write(append(buf, '\n')); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("write first-seen file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package naive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Offsets must be those of the first line an address is on, though its
+// repeats spread over many chunks and reads cut lines anywhere, and must
+// count the BOM and a line too long for a chunk.
+func TestFirstSeenOffsets(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	var b strings.Builder
+	b.WriteString("\xef\xbb\xbf") // BOM
+	var want strings.Builder
+	want.WriteString("ip,offset\n")
+	seen := make(map[uint32]bool)
+	for i := range 400000 {
+		if i == 1000 {
+			b.WriteString(strings.Repeat("x", bytesPerChunk+1000) + "\n")
+		}
+		ip := rng.Uint32N(20000) << 8
+		if !seen[ip] {
+			seen[ip] = true
+			fmt.Fprintf(&want, "%s,%d\n", utils.FormatIPv4(ip), b.Len())
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	if b.Len() < 3*bytesPerChunk {
+		t.Fatalf("input of %d bytes spans too few chunks", b.Len())
+	}
+	input := b.String()
+
+	for _, half := range []bool{false, true} {
+		out := filepath.Join(t.TempDir(), "first.csv")
+		c := NewWithOptions(Options{MaxLine: 64, FirstSeen: out})
+		var r io.Reader = strings.NewReader(input)
+		if half {
+			r = iotest.HalfReader(r)
+		}
+		n, err := c.CountReader(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(seen)) {
+			t.Errorf("half reads %v: %d unique, want %d", half, n, len(seen))
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want.String() {
+			t.Errorf("half reads %v: first-seen file differs from the offsets of first lines", half)
+		}
+	}
+}
+
+// Every address of the fixture appears in its first half, so the table
+// reaches all of them at 50%, exactly, whether the shares are of a file's
+// bytes or of a stream's lines.
+func TestUniquesAt(t *testing.T) {
+	var b strings.Builder
+	for range 2 {
+		for i := range 1000 { // 15-byte lines, so shares of bytes are of lines too
+			fmt.Fprintf(&b, "10.1%02d.1%02d.100\n", i/100, i%100)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []bool{true, false} {
+		var out strings.Builder
+		c := NewWithOptions(Options{Checkpoint: counter.Checkpoint{Shares: []float64{0.25, 0.5, 0.75}, Table: &out}})
+		var err error
+		if file {
+			_, err = c.CountUniqueIPs(path)
+		} else {
+			_, err = c.CountReader(context.Background(), strings.NewReader(b.String()))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "percent_of_file,unique_so_far,percent_of_final_uniques\n25,500,50.00\n50,1000,100.00\n75,1000,100.00\n"
+		if !file {
+			want = "# shares of the 2000 lines, the input's size being unknown; counts are kept every 2 lines, so a row may be that late\n" + want
+		}
+		if out.String() != want {
+			t.Errorf("file %v: table\n%s\nwant\n%s", file, out.String(), want)
+		}
+	}
+}
+
+// IPv4-mapped lines, which net.ParseIP let through, count as their IPv4
+// address without Parse.Mapped, and are invalid with RejectMapped.
+func TestMappedLines(t *testing.T) {
+	input := "10.0.0.1\n::ffff:10.0.0.1\n::ffff:10.0.0.2\n::FFFF:10.0.0.3\n"
+	for _, tc := range []struct {
+		reject bool
+		want   int64
+	}{
+		{false, 3},
+		{true, 1},
+	} {
+		c := NewWithOptions(Options{RejectMapped: tc.reject})
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil || n != tc.want {
+			t.Errorf("reject mapped %v: %d, %v; want %d", tc.reject, n, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/adaptive"
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/group"
+	"github.com/Sveta-1999/IPCounter/hll"
+	"github.com/Sveta-1999/IPCounter/kmv"
+	"github.com/Sveta-1999/IPCounter/linear"
+	"github.com/Sveta-1999/IPCounter/pair"
+	"github.com/Sveta-1999/IPCounter/sample"
+	"github.com/Sveta-1999/IPCounter/utils"
+	"github.com/Sveta-1999/IPCounter/window"
+)
+
+// engineFlags holds the flags shared by every command that runs engines.
+type engineFlags struct {
+	stripPort *bool
+	lenient   *bool
+	mapped    *bool
+	ipFormat  *string
+	extract   *string
+	include   *string
+	exclude   *string
+	cidr      *bool
+	minPrefix *int
+	comment   *string
+	inline    *bool
+	relaxed   *bool
+	delim     *string
+	maxLine   *int
+	retries   *int
+	maxRead   *int
+	maxMem    *string
+	watchdog  *bool
+	fallback  *bool
+	mmap      *bool
+	noCache   *bool
+	fsync     *bool
+	stream    *string
+	segmented *bool
+	workers   *int
+	chunkSize *string
+	queue     *int
+	stateFile *string
+	preload   *string
+	addrSpace *string
+	bsFile    *string
+	bsSwap    *bool
+	inFormat  *string
+	strict    *bool
+	checkpt   *string
+	curve     *string
+	curveN    *string
+	sharesAt  *string
+	bitset    *string
+	numa      *string
+	shards    *int
+	shardStat *bool
+	verify    *bool
+	record    *string
+	sketch    *int
+	kmvK      *int
+	hllP      *int
+	adaptive  *int
+	sketchOut *string
+	firstSeen *string
+
+	window      *time.Duration
+	windowLag   *time.Duration
+	windowSlide *time.Duration
+	timeExtract *string
+	timeFormat  *string
+	timeField   *int
+
+	groupBy       *int
+	column        *string
+	fieldSep      *string
+	maxGroups     *int
+	groupOverflow *string
+
+	pair          *bool
+	family        *string
+	columns       *string
+	pairEndpoints *bool
+
+	sample      *float64
+	sampleBlock *string
+	seed        *int64
+
+	bucketWorkers   *int
+	bucketMaxMem    *string
+	buckets         *int
+	bucketMemBuffer *string
+	dedupCache      *int
+	bucketSplit     *string
+	maxOpenFiles    *int
+	skewWarn        *float64
+	bucketOverlap   *bool
+	minOccurrences  *int
+	maxWrite        *int
+	tmpDir          *string
+	spaceCheck      *string
+	spillCompress   *string
+	partition       *string
+	keepBuckets     *string
+	fromBuckets     *string
+	resumeBuckets   *string
+	resumeEvery     *string
+
+	verbose   *verbosity
+	quiet     *bool
+	logFormat *string
+
+	// logLevel is the level without -v or -q: warn, or info for
+	// commands whose progress messages are their output.
+	logLevel slog.Level
+}
+
+// addEngineFlags registers the shared engine flags on fs.
+func addEngineFlags(fs *flag.FlagSet) *engineFlags {
+	return &engineFlags{
+		stripPort: fs.Bool("strip-port", false, "accept host:port lines and ignore the port"),
+		lenient:   fs.Bool("lenient-parse", false, "accept leading zeros in octets as decimal"),
+		mapped:    fs.Bool("accept-mapped", false, "accept IPv4-mapped IPv6 forms like ::ffff:1.2.3.4"),
+		ipFormat:  fs.String("ip-format", "dotted", "address encoding: dotted|int|hex|auto"),
+		extract:   fs.String("extract", "plain", "where each line's address is: plain for the whole line, csv:N for the Nth field split at -field-sep, field:N for the Nth whitespace-separated field, json:PATH for a field of a JSON object (dotted when nested) or regex:RE for the match of RE or of its group"),
+		include:   fs.String("include", "", "count only addresses in these IPv4 prefixes, comma separated, e.g. 10.0.0.0/8, with rfc1918, loopback and cgnat for their blocks, or @FILE for one per line"),
+		exclude:   fs.String("exclude", "", "leave out addresses in these IPv4 prefixes, as for -include, e.g. rfc1918"),
+		cidr:      fs.Bool("expand-cidr", false, "count every address of a.b.c.d/len lines"),
+		minPrefix: fs.Int("cidr-min-prefix", utils.DefaultMinPrefix, "with -expand-cidr, skip blocks shorter than this prefix length"),
+		comment:   fs.String("comment-prefix", "", "skip lines starting with this, e.g. '#', after trimming whitespace"),
+		relaxed:   fs.Bool("relaxed", false, `accept addresses wrapped in quotes or brackets, e.g. "1.2.3.4" or [1.2.3.4]; -stats counts each kind of cleanup`),
+		delim:     fs.String("delim", `\n`, `byte that ends each record: \n, \0 for NUL-separated input, ';', \t or \xHH`),
+		inline:    fs.Bool("strip-inline-comments", false, "cut each line at its first unquoted comment prefix ('#' if -comment-prefix is unset) before parsing"),
+		maxMem:    fs.String("max-mem", "0", "memory budget, e.g. 256MB: auto picks an engine that fits and engines error out instead of exceeding it (0 = none)"),
+		watchdog:  fs.Bool("mem-watchdog", false, "concurrent: sample the bitset plus the Go heap during the run and stop once they pass -max-mem, or without it the memory free when the run began"),
+		fallback:  fs.Bool("auto-fallback", false, "auto, concurrent: when concurrent goes over its memory budget on a local file, release the bitset and recount the file with bucket (implies -mem-watchdog)"),
+		maxLine:   fs.Int("max-line", utils.DefaultMaxLine, "longest line in bytes; longer lines are skipped without buffering them"),
+		retries:   fs.Int("max-retries", counter.DefaultReadRetries, "reopen a local file at the offset reached after a transient read error (EIO, ESTALE), and retry a transient write to a bucket spill file, up to this many times in a row (naive, concurrent, bucket; 0 = none)"),
+		maxRead:   fs.Int("max-read-mbps", 0, "read the inputs at no more than this many MiB/s, sparing the disk for other services (0 = no cap)"),
+		mmap:      fs.Bool("mmap", false, "concurrent: memory-map the input instead of streaming it"),
+		noCache:   fs.Bool("no-cache", false, "naive, concurrent, bucket: drop the input's and spill files' pages from the page cache once read (Linux), so a one-shot scan of a huge file does not evict other workloads"),
+		fsync:     fs.Bool("fsync", false, "fsync bucket spill files, the -keep-buckets manifest and the files written by -sketch-out, -first-seen, -bucket-stats and -heatmap before closing them, so they survive a power loss"),
+		stream:    fs.String("stream-engine", "", "auto: concurrent|bucket for a pipe or other input of unknown size (default: by available memory)"),
+		segmented: fs.Bool("segmented", false, "concurrent: each worker reads its own byte range of the file"),
+		workers:   fs.Int("workers", 0, "concurrent, adaptive, kmv, hll, roaring, extsort, bucket pass 1: goroutines parsing the input (0 = one per CPU)"),
+		chunkSize: fs.String("chunk-size", "2MB", "concurrent, roaring, extsort, hll: bytes read and handed to a worker at a time (4KB to 64MB)"),
+		queue:     fs.Int("queue-depth", 0, "concurrent, roaring, extsort, hll: read chunks that may wait for a worker (0 = two per worker)"),
+		inFormat:  fs.String("input-format", "text", "text, binary-be|binary-le for packed 4-byte addresses, pcap for packet captures, or parquet with -column; all but text are read by the concurrent engine only, and -impl auto picks it"),
+		strict:    fs.Bool("strict", false, "fail on text lines that do not parse, once the rest are counted, and on binary input that ends with a partial record, instead of warning"),
+		checkpt:   fs.String("checkpoint-every", "", "concurrent, bucket: print the running unique count to stderr every N lines, or every SIZE bytes such as 1GB (bucket: an estimate until the end)"),
+		curve:     fs.String("curve", "", "concurrent, bucket: write lines_processed,cumulative_unique CSV rows to this file every -curve-every, ending with the whole input, to see whether the count plateaus (bucket: estimates)"),
+		curveN:    fs.String("curve-every", "1000000", "-curve: lines between rows, or a SIZE such as 1GB for bytes"),
+		sharesAt:  fs.String("uniques-at", "", "naive, concurrent, bucket: print to stderr how many distinct addresses had appeared by these percentages of the input, e.g. 1,10,50, as percent_of_file,unique_so_far,percent_of_final_uniques CSV; of bytes for a plain file, of lines otherwise (bucket: estimates, of lines)"),
+		stateFile: fs.String("state-file", "", "concurrent: keep every address ever counted in this 512 MB sparse file and report the ones new to it"),
+		addrSpace: fs.String("address-space", "", "concurrent: the IPv4 block every address is in, e.g. 100.64.0.0/10; the bitset spans just it and addresses outside are skipped as invalid (selects -impl concurrent)"),
+		preload:   fs.String("preload", "", "concurrent: set the addresses listed in this file, one per line and parsed like the input, before counting, and report the ones new to it; a line that fails to parse is an error"),
+		bsFile:    fs.String("bitset-file", "", "concurrent: keep the bitset in a scratch file created at this path (removed at once) instead of RAM, so the OS can page cold shards out on a low-memory host"),
+		bsSwap:    fs.Bool("bitset-swap", false, "concurrent: keep the bitset in anonymous mapped memory the OS can swap out instead of the Go heap"),
+		bitset:    fs.String("bitset", "auto", "concurrent: shared|local|auto (local with 8+ workers) bitset mode"),
+		numa:      fs.String("numa-groups", "1", "concurrent: split the workers into this many groups, each with a bitset of its own merged at the end, to keep atomics within one socket of a many-core host; auto for one group per NUMA node, pinned to its CPUs (1 = one group)"),
+		shards:    fs.Int("shards", concurrent.DefaultShards, "concurrent: number of bitset shards (power of two)"),
+		shardStat: fs.Bool("shard-stats", false, "concurrent: with -stats, summarize how the set's bits spread over the shards and check their popcounts against the count"),
+		verify:    fs.Bool("verify-count", false, "concurrent, bucket: recount the set by popcount after reading and fail if it differs from the running count"),
+		record:    fs.String("record", "", "concurrent: write each chunk's byte range, addresses parsed and new count to this trace file, for -replay"),
+		sketch:    fs.Int("sketch-bits", linear.DefaultBits, "linear: log2 of the bitmap size (10 to 32)"),
+		kmvK:      fs.Int("k", kmv.DefaultK, "kmv: number of smallest hash values kept"),
+		hllP:      fs.Int("precision", hll.DefaultPrecision, "hll: log2 of the number of registers (4 to 18); the relative standard error is 1.04/sqrt(2^N)"),
+		adaptive:  fs.Int("adaptive-threshold", adaptive.DefaultThreshold, "adaptive: hash set entries before switching to the bitset"),
+		sketchOut: fs.String("sketch-out", "", "kmv: write the final sketch to this file for sketch-merge"),
+		firstSeen: fs.String("first-seen", "", "naive: write ip,offset CSV to this file, giving the byte offset of each distinct address's first line (selects -impl naive)"),
+
+		window:      fs.Duration("window", 0, "count unique addresses per window of this length, e.g. 1h, from timestamped lines (selects -impl window)"),
+		windowLag:   fs.Duration("window-lag", 0, "window: how far out of order a line may be and still land in its window (0 = one window)"),
+		timeExtract: fs.String("time-extract", "plain", "window: where each line's timestamp is instead of -time-field, as for -extract, e.g. json:ts"),
+		windowSlide: fs.Duration("window-slide", 0, "window: slide the window by this step instead, e.g. 1h with -window 24h, writing the unique count of the last -window at the end of each step (0 = tiled windows)"),
+		timeFormat:  fs.String("time-format", "RFC3339", "window: RFC3339|RFC1123|DateTime|unix|unixms or a Go time layout"),
+		timeField:   fs.Int("time-field", 1, "window: 1-based whitespace-separated field holding the timestamp; the address is field 1, or 2 if the timestamp is"),
+
+		groupBy:       fs.Int("group-by-column", 0, "count unique addresses per distinct value of this 1-based field, e.g. a customer ID (selects -impl group)"),
+		column:        fs.String("column", "", "group: 1-based field holding the address (default 2); parquet: the column of addresses, dotted for a nested one"),
+		fieldSep:      fs.String("field-sep", ",", `group, pair, -extract csv: byte separating fields: ',', \t, ';', \xHH, or ' ' for runs of blanks (pair)`),
+		maxGroups:     fs.Int("max-groups", 0, "group: most distinct keys tracked (0 = no limit)"),
+		groupOverflow: fs.String("group-overflow", "error", "group: error|other for keys past -max-groups; other counts them together as "+group.OtherKey),
+
+		pair:          fs.Bool("pair", false, "count distinct (source, destination) address pairs of lines holding two addresses instead of addresses (selects -impl pair)"),
+		columns:       fs.String("columns", "1,2", "pair: 1-based fields holding the source and destination addresses"),
+		pairEndpoints: fs.Bool("pair-endpoints", false, "pair: also count distinct sources and destinations in the same pass"),
+
+		family: fs.String("family", "ipv4", "address family counted: ipv4, ipv6, or any for both in one set, an IPv4 address being the same as its ::ffff:a.b.c.d form; ipv6 and any select -impl ipv6, a hash set spilled to partitions like the bucket engine's, which counts IPv6 alone without -family and refuses an explicit ipv4"),
+
+		sample:      fs.Float64("sample", 0, "estimate from this random share of the file, e.g. 0.01, instead of counting it all (selects -impl sample)"),
+		sampleBlock: fs.String("sample-block", "64KB", "sample: bytes per randomly placed read"),
+		seed:        fs.Int64("seed", 1, "sample: seed for the block choice"),
+
+		bucketWorkers:   fs.Int("bucket-workers", 0, "bucket: buckets counted in parallel in pass 2 (0 = min(NumCPU, 8))"),
+		bucketMaxMem:    fs.String("max-bucket-mem", "2MB", "bucket: largest pass-2 bitset; picks the bucket count (512KB to 32MB)"),
+		buckets:         fs.Int("buckets", 0, "bucket: number of buckets, a power of two from 16 to 1024, instead of picking it by -max-bucket-mem"),
+		bucketMemBuffer: fs.String("bucket-mem-buffer", "64KB", "bucket: records a bucket keeps in memory before spilling to disk (0 = always spill)"),
+		dedupCache:      fs.Int("bucket-dedup-cache", bucket.DefaultDedupCache, "bucket: written addresses each bucket remembers in pass 1, across workers, so that repeats of one address are written once, 8 bytes each (0 = write every line)"),
+		bucketSplit:     fs.String("bucket-split", "2GB", "bucket: once a bucket's spill file reaches this size, send its later records to 256 sub-buckets by the next byte, counted in parallel in pass 2 (0 = never split)"),
+		maxOpenFiles:    fs.Int("bucket-max-open-files", 0, "bucket: spill files pass 1 keeps open at once; below the bucket count, consecutive buckets share a file, for containers with a low open file limit or Windows (0 = as many as the limit allows)"),
+		bucketOverlap:   fs.Bool("bucket-overlap", false, "bucket: start pass 2 on the buckets whose records are final while pass 1 is still flushing and closing the other files"),
+		skewWarn:        fs.Float64("bucket-skew-warn", bucket.DefaultSkewWarn, "bucket: warn when one bucket holds more than this share of the records, since pass 2 then waits on it (1 = never)"),
+		minOccurrences:  fs.Int("min-occurrences", 1, "bucket: count only addresses seen at least this many times (1 to 65535)"),
+		maxWrite:        fs.Int("max-write-mbps", 0, "bucket: write pass-1 spill files at no more than this many MiB/s (0 = no cap)"),
+		tmpDir:          fs.String("tmpdir", "", "bucket, extsort: directory for pass-1 spill files or sorted runs (default $TMPDIR or /tmp, %TMP% on Windows)"),
+		spaceCheck:      fs.String("space-check", "warn", "bucket: warn|abort|off when the temp volume looks too small for the spill"),
+		spillCompress:   fs.String("spill-compress", "none", "bucket: none|snappy|lz4|flate compression of spill files"),
+		partition:       fs.String("partition", "topbyte", "bucket: topbyte|hash assignment of addresses to buckets; hash keeps buckets even on skewed input"),
+		keepBuckets:     fs.String("keep-buckets", "", "bucket: write pass-1 files into this empty directory and keep them"),
+		fromBuckets:     fs.String("from-buckets", "", "bucket: skip pass 1 and count the files a -keep-buckets run left in this directory"),
+		resumeBuckets:   fs.String("resume", "", "bucket: checkpoint both passes in this directory, and go on from where a run killed there stopped"),
+		resumeEvery:     fs.String("resume-every", "1GB", "with -resume, the input read between pass-1 checkpoints"),
+
+		verbose:   addVerbosity(fs),
+		quiet:     fs.Bool("q", false, "log errors only"),
+		logFormat: fs.String("log-format", "text", "log format on stderr: text|json"),
+		logLevel:  slog.LevelWarn,
+	}
+}
+
+// extractKey returns -extract as the result cache keys it: with the
+// separator that splits fields for csv, "" for plain.
+func (f *engineFlags) extractKey() string {
+	switch {
+	case *f.extract == "plain":
+		return ""
+	case strings.HasPrefix(*f.extract, "csv:"):
+		return *f.extract + " " + *f.fieldSep
+	}
+	return *f.extract
+}
+
+// filter returns the filter of -include and -exclude, nil without them.
+func (f *engineFlags) filter() (*utils.Filter, error) {
+	if *f.include == "" && *f.exclude == "" {
+		return nil, nil
+	}
+	include, err := prefixList(*f.include)
+	if err != nil {
+		return nil, fmt.Errorf("-include: %w", err)
+	}
+	exclude, err := prefixList(*f.exclude)
+	if err != nil {
+		return nil, fmt.Errorf("-exclude: %w", err)
+	}
+	filter, err := utils.NewFilter(include, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("-include, -exclude: %w", err)
+	}
+	return filter, nil
+}
+
+// prefixList parses an -include or -exclude list, or with a leading @ the
+// file it names, one list per line with # comments.
+func prefixList(s string) ([]netip.Prefix, error) {
+	name, ok := strings.CutPrefix(s, "@")
+	if !ok {
+		return utils.ParsePrefixes(s)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		p, err := utils.ParsePrefixes(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", name, i+1, err)
+		}
+		prefixes = append(prefixes, p...)
+	}
+	return prefixes, nil
+}
+
+// verbosity is a -v flag that may be repeated: once for info, twice for
+// debug.
+type verbosity int
+
+func addVerbosity(fs *flag.FlagSet) *verbosity {
+	v := new(verbosity)
+	fs.Var(v, "v", "log run summaries; repeat (-v -v) for debug events such as passes, buckets and worker pools")
+	return v
+}
+
+func (v *verbosity) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *verbosity) IsBoolFlag() bool { return true }
+
+func (v *verbosity) Set(s string) error {
+	if s == "true" {
+		*v++
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("must be a count or -v alone, got %q", s)
+	}
+	*v = verbosity(n)
+	return nil
+}
+
+// logger builds the logger -v, -q and -log-format ask for and makes it
+// slog's default, so the CLI's own messages follow the same settings.
+// Text keeps the log package's format.
+func (f *engineFlags) logger() (*slog.Logger, error) {
+	if *f.quiet && *f.verbose > 0 {
+		return nil, fmt.Errorf("-q and -v are mutually exclusive")
+	}
+	level := f.logLevel
+	switch {
+	case *f.quiet:
+		level = slog.LevelError
+	case *f.verbose == 1:
+		level = slog.LevelInfo
+	case *f.verbose > 1:
+		level = slog.LevelDebug
+	}
+	switch *f.logFormat {
+	case "text":
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	default:
+		return nil, fmt.Errorf("-log-format must be text or json, got %q", *f.logFormat)
+	}
+	return slog.Default(), nil
+}
+
+// options converts the parsed flags into engine options.
+func (f *engineFlags) options() (counter.Options, error) {
+	logger, err := f.logger()
+	if err != nil {
+		return counter.Options{}, err
+	}
+	format, err := utils.ParseIPFormat(*f.ipFormat)
+	if err != nil {
+		return counter.Options{}, err
+	}
+	if *f.comment != "" && strings.TrimSpace(*f.comment) != *f.comment {
+		return counter.Options{}, fmt.Errorf("-comment-prefix must not start or end with whitespace, got %q", *f.comment)
+	}
+	switch *f.inFormat {
+	case "text", "binary-be", "binary-le", "pcap", "parquet":
+	default:
+		return counter.Options{}, fmt.Errorf("-input-format must be text, binary-be, binary-le, pcap or parquet, got %q", *f.inFormat)
+	}
+	column := 2
+	switch {
+	case *f.inFormat == "parquet":
+		if *f.column == "" {
+			return counter.Options{}, errors.New("-input-format parquet needs -column, the name of the column of addresses")
+		}
+	case *f.column != "":
+		if column, err = strconv.Atoi(*f.column); err != nil {
+			return counter.Options{}, fmt.Errorf("-column must be a 1-based field number, got %q", *f.column)
+		}
+	}
+	sep, err := parseDelim(*f.delim)
+	if err != nil {
+		return counter.Options{}, err
+	}
+	checkpoint, err := counter.ParseCheckpoint(*f.checkpt)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-checkpoint-every: %w", err)
+	}
+	if *f.curve != "" {
+		if checkpoint.Every > 0 {
+			return counter.Options{}, errors.New("-curve and -checkpoint-every are mutually exclusive")
+		}
+		if checkpoint, err = counter.ParseCheckpoint(*f.curveN); err != nil {
+			return counter.Options{}, fmt.Errorf("-curve-every: %w", err)
+		}
+		if checkpoint.Every == 0 {
+			return counter.Options{}, errors.New("-curve-every must be positive")
+		}
+		checkpoint.Curve = true
+	}
+	if checkpoint.Shares, err = counter.ParseShares(*f.sharesAt); err != nil {
+		return counter.Options{}, fmt.Errorf("-uniques-at: %w", err)
+	}
+	if *f.minPrefix < 0 || *f.minPrefix > 32 {
+		return counter.Options{}, fmt.Errorf("-cidr-min-prefix must be between 0 and 32, got %d", *f.minPrefix)
+	}
+	if *f.maxLine < 1 {
+		return counter.Options{}, fmt.Errorf("-max-line must be positive, got %d", *f.maxLine)
+	}
+	if *f.retries < 0 {
+		return counter.Options{}, fmt.Errorf("-max-retries must not be negative, got %d", *f.retries)
+	}
+	if *f.maxRead < 0 || *f.maxWrite < 0 {
+		return counter.Options{}, fmt.Errorf("-max-read-mbps and -max-write-mbps must not be negative")
+	}
+	maxMem, err := counter.ParseBytes(*f.maxMem)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-max-mem: %w", err)
+	}
+	switch *f.stream {
+	case "", "concurrent", "bucket":
+	default:
+		return counter.Options{}, fmt.Errorf("-stream-engine must be concurrent or bucket, got %q", *f.stream)
+	}
+	mode, err := concurrent.ParseBitsetMode(*f.bitset)
+	if err != nil {
+		return counter.Options{}, err
+	}
+	numaGroups := concurrent.NUMAAuto
+	if *f.numa != "auto" {
+		if numaGroups, err = strconv.Atoi(*f.numa); err != nil || numaGroups < 1 {
+			return counter.Options{}, fmt.Errorf("-numa-groups must be auto or at least 1, got %q", *f.numa)
+		}
+	}
+	if *f.workers < 0 {
+		return counter.Options{}, fmt.Errorf("-workers must not be negative, got %d", *f.workers)
+	}
+	chunkSize, err := counter.ParseBytes(*f.chunkSize)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-chunk-size: %w", err)
+	}
+	if chunkSize == 0 {
+		chunkSize = concurrent.DefaultChunkSize
+	}
+	var space netip.Prefix
+	if *f.addrSpace != "" {
+		if space, err = netip.ParsePrefix(*f.addrSpace); err != nil || !space.Addr().Is4() {
+			return counter.Options{}, fmt.Errorf("-address-space must be an IPv4 block such as 100.64.0.0/10, got %q", *f.addrSpace)
+		}
+		space = space.Masked()
+	}
+	copts := concurrent.Options{
+		Shards: *f.shards, Bitset: mode, NUMAGroups: numaGroups, MaxMem: maxMem, StateFile: *f.stateFile, Checkpoint: checkpoint, AddressSpace: space,
+		BitsetFile: *f.bsFile, BitsetSwap: *f.bsSwap,
+		Workers: *f.workers, ChunkSize: int(chunkSize), QueueDepth: *f.queue,
+		Record: *f.record, Mmap: *f.mmap, Segmented: *f.segmented,
+	}
+	if err := copts.Validate(); err != nil {
+		return counter.Options{}, err
+	}
+	if err := (linear.Options{Bits: *f.sketch}).Validate(); err != nil {
+		return counter.Options{}, fmt.Errorf("-sketch-bits: %w", err)
+	}
+	if err := (kmv.Options{K: *f.kmvK}).Validate(); err != nil {
+		return counter.Options{}, fmt.Errorf("-k: %w", err)
+	}
+	if err := (hll.Options{Precision: *f.hllP}).Validate(); err != nil {
+		return counter.Options{}, fmt.Errorf("-precision: %w", err)
+	}
+	if *f.adaptive < 1 {
+		return counter.Options{}, fmt.Errorf("-adaptive-threshold must be positive, got %d", *f.adaptive)
+	}
+	if *f.window < 0 || *f.windowLag < 0 || *f.windowSlide < 0 {
+		return counter.Options{}, fmt.Errorf("-window, -window-lag and -window-slide must not be negative")
+	}
+	if *f.windowSlide > 0 {
+		switch {
+		case *f.window == 0:
+			return counter.Options{}, errors.New("-window-slide needs -window")
+		case *f.window%*f.windowSlide != 0:
+			return counter.Options{}, fmt.Errorf("-window %s must be a multiple of -window-slide %s", *f.window, *f.windowSlide)
+		case *f.windowLag > 0:
+			return counter.Options{}, errors.New("-window-lag does not apply to a sliding window, which takes lines up to -window behind")
+		}
+	}
+	if _, err := window.ParseTimeFormat(*f.timeFormat); err != nil {
+		return counter.Options{}, fmt.Errorf("-time-format: %w", err)
+	}
+	if *f.window > 0 && *f.sample > 0 {
+		return counter.Options{}, fmt.Errorf("-window and -sample are mutually exclusive")
+	}
+	if *f.groupBy < 0 {
+		return counter.Options{}, fmt.Errorf("-group-by-column must not be negative, got %d", *f.groupBy)
+	}
+	if *f.groupBy > 0 && (*f.window > 0 || *f.sample > 0) {
+		return counter.Options{}, fmt.Errorf("-group-by-column, -window and -sample are mutually exclusive")
+	}
+	fieldSep, err := parseByte(*f.fieldSep)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-field-sep %w", err)
+	}
+	extract, err := utils.ParseExtractor(*f.extract, fieldSep)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-extract: %w", err)
+	}
+	if extract != nil && (*f.pair || *f.groupBy > 0 || *f.family != "ipv4") {
+		return counter.Options{}, errors.New("-extract cannot be combined with -pair, -group-by-column or -family, which read fields of their own")
+	}
+	timeExtract, err := utils.ParseExtractor(*f.timeExtract, fieldSep)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-time-extract: %w", err)
+	}
+	if extract != nil && *f.inFormat != "text" {
+		return counter.Options{}, fmt.Errorf("-extract needs text input, got -input-format %s", *f.inFormat)
+	}
+	filter, err := f.filter()
+	if err != nil {
+		return counter.Options{}, err
+	}
+	if filter != nil && (*f.pair || *f.family != "ipv4" || *f.fromBuckets != "") {
+		return counter.Options{}, errors.New("-include and -exclude cannot be combined with -pair, -family or -from-buckets")
+	}
+	if _, err := group.ParseOverflow(*f.groupOverflow); err != nil {
+		return counter.Options{}, fmt.Errorf("-group-overflow: %w", err)
+	}
+	if err := (group.Options{KeyColumn: max(*f.groupBy, 1), Column: column, MaxGroups: *f.maxGroups}).Validate(); err != nil {
+		return counter.Options{}, fmt.Errorf("-group-by-column, -column, -max-groups: %w", err)
+	}
+	pairColumns, err := parsePairColumns(*f.columns)
+	if err != nil {
+		return counter.Options{}, err
+	}
+	if err := (pair.Options{Columns: pairColumns}).Validate(); err != nil {
+		return counter.Options{}, fmt.Errorf("-columns: %w", err)
+	}
+	if *f.pair && *f.inFormat != "text" {
+		return counter.Options{}, fmt.Errorf("-pair needs text input, got -input-format %s", *f.inFormat)
+	}
+	if *f.pair && (*f.groupBy > 0 || *f.window > 0 || *f.sample > 0) {
+		return counter.Options{}, errors.New("-pair, -group-by-column, -window and -sample are mutually exclusive")
+	}
+	if *f.addrSpace != "" && (*f.pair || *f.groupBy > 0 || *f.window > 0 || *f.sample > 0) {
+		return counter.Options{}, errors.New("-address-space cannot be combined with -pair, -group-by-column, -window or -sample")
+	}
+	if *f.preload != "" && (*f.pair || *f.groupBy > 0 || *f.window > 0 || *f.sample > 0) {
+		return counter.Options{}, errors.New("-preload cannot be combined with -pair, -group-by-column, -window or -sample")
+	}
+	if *f.firstSeen != "" && (*f.pair || *f.groupBy > 0 || *f.window > 0 || *f.sample > 0) {
+		return counter.Options{}, errors.New("-first-seen cannot be combined with -pair, -group-by-column, -window or -sample")
+	}
+	family := *f.family
+	switch family {
+	case "ipv4":
+		family = ""
+	case "ipv6", "any":
+		switch {
+		case *f.inFormat != "text":
+			return counter.Options{}, fmt.Errorf("-family %s needs text input, got -input-format %s", family, *f.inFormat)
+		case *f.cidr:
+			return counter.Options{}, fmt.Errorf("-family %s cannot count -expand-cidr blocks", family)
+		case *f.pair || *f.groupBy > 0 || *f.window > 0 || *f.sample > 0:
+			return counter.Options{}, fmt.Errorf("-family %s cannot be combined with -pair, -group-by-column, -window or -sample", family)
+		case *f.addrSpace != "" || *f.preload != "" || *f.firstSeen != "" || *f.stateFile != "":
+			return counter.Options{}, fmt.Errorf("-family %s cannot be combined with -address-space, -preload, -first-seen or -state-file", family)
+		}
+	default:
+		return counter.Options{}, fmt.Errorf("-family must be ipv4, ipv6 or any, got %q", family)
+	}
+	if *f.timeField < 1 {
+		return counter.Options{}, fmt.Errorf("-time-field must be positive, got %d", *f.timeField)
+	}
+	sampleBlock, err := counter.ParseBytes(*f.sampleBlock)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-sample-block: %w", err)
+	}
+	if sampleBlock < 1 || sampleBlock > 1<<30 {
+		return counter.Options{}, fmt.Errorf("-sample-block must be between 1B and 1GB, got %s", *f.sampleBlock)
+	}
+	if err := (sample.Options{Fraction: *f.sample}).Validate(); err != nil {
+		return counter.Options{}, fmt.Errorf("-sample: %w", err)
+	}
+	if *f.sample > 0 && *f.fromBuckets != "" {
+		return counter.Options{}, fmt.Errorf("-sample and -from-buckets are mutually exclusive")
+	}
+	bucketMaxMem, err := counter.ParseBytes(*f.bucketMaxMem)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-max-bucket-mem: %w", err)
+	}
+	if _, err := bucket.LayoutForMem(bucketMaxMem); err != nil {
+		return counter.Options{}, fmt.Errorf("-max-bucket-mem: %w", err)
+	}
+	if n := *f.buckets; n != 0 {
+		if n < 16 || n > 1024 || n&(n-1) != 0 {
+			return counter.Options{}, fmt.Errorf("-buckets must be a power of two from 16 to 1024, got %d", n)
+		}
+		if *f.bucketMaxMem != "2MB" {
+			return counter.Options{}, errors.New("-buckets and -max-bucket-mem both pick the bucket count and are mutually exclusive")
+		}
+		// Each bucket's pass-2 bitset covers the addresses under its prefix
+		bucketMaxMem = int64(1) << 32 / int64(n) / 8
+	}
+	if _, err := bucket.ParseSpaceCheck(*f.spaceCheck); err != nil {
+		return counter.Options{}, err
+	}
+	if *f.keepBuckets != "" && *f.fromBuckets != "" {
+		return counter.Options{}, fmt.Errorf("-keep-buckets and -from-buckets are mutually exclusive")
+	}
+	if *f.resumeBuckets != "" && (*f.keepBuckets != "" || *f.fromBuckets != "" || *f.sample > 0) {
+		return counter.Options{}, fmt.Errorf("-resume keeps its own buckets and cannot be combined with -keep-buckets, -from-buckets or -sample")
+	}
+	if _, err := bucket.ParseCompression(*f.spillCompress); err != nil {
+		return counter.Options{}, err
+	}
+	if _, err := bucket.ParsePartition(*f.partition); err != nil {
+		return counter.Options{}, err
+	}
+	memBuffer, err := counter.ParseBytes(*f.bucketMemBuffer)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-bucket-mem-buffer: %w", err)
+	}
+	if memBuffer == 0 {
+		memBuffer = -1 // always spill
+	}
+	dedupCache := *f.dedupCache
+	switch {
+	case dedupCache < 0 || dedupCache > 1<<16:
+		return counter.Options{}, fmt.Errorf("-bucket-dedup-cache must be between 0 and %d, got %d", 1<<16, dedupCache)
+	case dedupCache == 0:
+		dedupCache = -1 // write every line
+	}
+	bucketSplit, err := counter.ParseBytes(*f.bucketSplit)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-bucket-split: %w", err)
+	}
+	if bucketSplit == 0 {
+		bucketSplit = -1 // never split
+	}
+	resumeEvery, err := counter.ParseBytes(*f.resumeEvery)
+	if err != nil {
+		return counter.Options{}, fmt.Errorf("-resume-every: %w", err)
+	}
+	if resumeEvery < 1 {
+		return counter.Options{}, fmt.Errorf("-resume-every must be positive, got %s", *f.resumeEvery)
+	}
+	if *f.maxOpenFiles < 0 {
+		return counter.Options{}, fmt.Errorf("-bucket-max-open-files must not be negative, got %d", *f.maxOpenFiles)
+	}
+	if w := *f.skewWarn; !(w > 0 && w <= 1) {
+		return counter.Options{}, fmt.Errorf("-bucket-skew-warn must be above 0 and at most 1, got %g", w)
+	}
+	if n := *f.minOccurrences; n < 1 || n > bucket.MaxMinOccurrences {
+		return counter.Options{}, fmt.Errorf("-min-occurrences must be 1 to %d, got %d", bucket.MaxMinOccurrences, n)
+	}
+	parse := utils.ParseOptions{
+		Format: format, StripPort: *f.stripPort, Lenient: *f.lenient, Mapped: *f.mapped,
+		CIDR: *f.cidr, MinPrefix: *f.minPrefix,
+		CommentPrefix: *f.comment, InlineComments: *f.inline,
+		Extract: extract, Filter: filter, RecordSep: sep,
+	}
+	if *f.comment != "" || *f.inline {
+		parse.Comments = new(atomic.Int64)
+	}
+	if *f.relaxed {
+		parse.Relaxed = new(utils.Normalized)
+	}
+	return counter.Options{
+		Parse:        parse,
+		MaxLine:      *f.maxLine,
+		ReadRetries:  *f.retries,
+		MaxReadRate:  int64(*f.maxRead) << 20,
+		MaxMem:       maxMem,
+		MemWatchdog:  *f.watchdog || *f.fallback,
+		AutoFallback: *f.fallback,
+		Mmap:         *f.mmap,
+		NoCache:      *f.noCache,
+		Fsync:        *f.fsync,
+		Segmented:    *f.segmented,
+		Workers:      *f.workers,
+		ChunkSize:    int(chunkSize),
+		QueueDepth:   *f.queue,
+		Bitset:       *f.bitset,
+		NUMAGroups:   numaGroups,
+		Shards:       *f.shards,
+		ShardStats:   *f.shardStat,
+		VerifyCount:  *f.verify,
+		Record:       *f.record,
+		StateFile:    *f.stateFile,
+		Preload:      *f.preload,
+		BitsetFile:   *f.bsFile,
+		BitsetSwap:   *f.bsSwap,
+		InputFormat:  *f.inFormat,
+		Strict:       *f.strict,
+		Checkpoint:   checkpoint,
+
+		AddressSpace: space,
+		StreamEngine: *f.stream,
+
+		SketchBits:      *f.sketch,
+		SketchK:         *f.kmvK,
+		SketchPrecision: *f.hllP,
+		SketchOut:       *f.sketchOut,
+		FirstSeen:       *f.firstSeen,
+
+		AdaptiveThreshold: *f.adaptive,
+
+		Window:      *f.window,
+		WindowLag:   *f.windowLag,
+		WindowSlide: *f.windowSlide,
+		TimeExtract: timeExtract,
+		TimeFormat:  *f.timeFormat,
+		TimeField:   *f.timeField,
+
+		GroupColumn:   *f.groupBy,
+		Column:        column,
+		FieldSep:      string(fieldSep),
+		MaxGroups:     *f.maxGroups,
+		GroupOverflow: *f.groupOverflow,
+
+		PairColumns:   pairColumns,
+		PairEndpoints: *f.pairEndpoints,
+		Family:        family,
+
+		SampleFraction: *f.sample,
+		SampleBlock:    int(sampleBlock),
+		Seed:           *f.seed,
+
+		BucketWorkers:    *f.bucketWorkers,
+		BucketMaxMem:     bucketMaxMem,
+		BucketMemBuffer:  int(memBuffer),
+		BucketDedupCache: dedupCache,
+		BucketSplit:      bucketSplit,
+		BucketOpenFiles:  *f.maxOpenFiles,
+		BucketSkewWarn:   *f.skewWarn,
+		BucketOverlap:    *f.bucketOverlap,
+		MinOccurrences:   *f.minOccurrences,
+		MaxWriteRate:     int64(*f.maxWrite) << 20,
+		TempDir:          *f.tmpDir,
+		SpaceCheck:       *f.spaceCheck,
+		SpillCompress:    *f.spillCompress,
+		BucketPartition:  *f.partition,
+		KeepBuckets:      *f.keepBuckets,
+		FromBuckets:      *f.fromBuckets,
+		ResumeBuckets:    *f.resumeBuckets,
+		ResumeEvery:      resumeEvery,
+
+		Logger: logger,
+	}, nil
+}
+
+// parseDelim reads the -delim value: a single byte, or an escape such as
+// \0, \n, \t or \x1e. A newline is returned as "", the default.
+func parseDelim(s string) (string, error) {
+	d, err := parseByte(s)
+	if err != nil {
+		return "", fmt.Errorf("-delim %w", err)
+	}
+	if d == '\n' {
+		return "", nil
+	}
+	return string(d), nil
+}
+
+// parseByte reads a single byte given literally or as an escape such as
+// \0, \t or \x1e.
+// parsePairColumns parses -columns, the source and destination fields
+// as "SRC,DST".
+func parsePairColumns(s string) ([2]int, error) {
+	a, b, ok := strings.Cut(s, ",")
+	src, err1 := strconv.Atoi(strings.TrimSpace(a))
+	dst, err2 := strconv.Atoi(strings.TrimSpace(b))
+	if !ok || err1 != nil || err2 != nil {
+		return [2]int{}, fmt.Errorf("-columns must be two 1-based field numbers such as 1,2, got %q", s)
+	}
+	return [2]int{src, dst}, nil
+}
+
+func parseByte(s string) (byte, error) {
+	d := s
+	switch {
+	case s == `\0`:
+		d = "\x00"
+	case strings.HasPrefix(s, `\`):
+		u, err := strconv.Unquote(`"` + s + `"`)
+		if err != nil {
+			return 0, fmt.Errorf("%q: not a valid escape", s)
+		}
+		d = u
+	}
+	if len(d) != 1 {
+		return 0, fmt.Errorf("must be a single byte, got %q", s)
+	}
+	return d[0], nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// countOutput is what -output json prints on stdout in place of the
+// count: one JSON object with how the run got it, for metrics pipelines
+// and comparisons of engines. Fields a run does not know are left out.
+type countOutput struct {
+	Unique         int64         `json:"unique"`
+	Estimate       bool          `json:"estimate,omitempty"`
+	StdError       float64       `json:"std_error,omitempty"`
+	Engine         string        `json:"engine"`           // the engine that counted
+	Reason         string        `json:"reason,omitempty"` // why -impl auto or -auto-fallback picked it
+	Lines          *int64        `json:"lines,omitempty"`
+	MalformedLines *int64        `json:"malformed_lines,omitempty"`
+	FilteredLines  *int64        `json:"filtered_lines,omitempty"` // with -include or -exclude
+	Bytes          *int64        `json:"bytes,omitempty"`
+	ElapsedSeconds float64       `json:"elapsed_seconds"`
+	Phases         []phaseOutput `json:"phases,omitempty"`
+	PeakMemory     memOutput     `json:"peak_memory"`
+}
+
+// phaseOutput is a phase of the count, as in -progress.
+type phaseOutput struct {
+	Name           string  `json:"name"`
+	Unit           string  `json:"unit"` // what done counts: bytes, or buckets in the bucket engine's pass 2
+	Done           int64   `json:"done"`
+	Lines          int64   `json:"lines,omitempty"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// memOutput is the peak memory of the run, in bytes, as in -stats.
+type memOutput struct {
+	Heap int64 `json:"heap"`
+	Sys  int64 `json:"sys"`
+	RSS  int64 `json:"rss,omitempty"` // 0 where the OS does not tell
+}
+
+// newCountOutput returns the output of a count that took elapsed, its
+// lines and bytes where the count tallied them: the bytes are those the
+// engine read, after decompression, in the phases that read the input.
+func newCountOutput(res ipcount.Result, fb *counter.Fallback, impl string, opts counter.Options, elapsed time.Duration, peak counter.MemPeak) countOutput {
+	out := countOutput{
+		Unique:         res.Unique,
+		Estimate:       res.Estimate,
+		StdError:       res.StdError,
+		Engine:         impl,
+		ElapsedSeconds: elapsed.Seconds(),
+		PeakMemory:     memOutput{Heap: int64(peak.HeapAlloc), Sys: int64(peak.Sys), RSS: peak.RSS},
+	}
+	if a, ok := res.Counter.(*counter.Auto); ok {
+		sel := a.Selection()
+		out.Engine, out.Reason = sel.Engine, sel.Reason
+	} else if fb != nil && fb.FellBack() {
+		out.Engine, out.Reason = "bucket", "concurrent went over the memory budget"
+	}
+	if opts.Parse.Lines != nil {
+		out.Lines = &res.Lines
+	}
+	if m := opts.Parse.Malformed; m != nil {
+		n := m.Lines()
+		out.MalformedLines = &n
+	}
+	if f := opts.Parse.Filter; f != nil {
+		n := f.Lines()
+		out.FilteredLines = &n
+	}
+	if len(res.Phases) > 0 {
+		var bytes int64
+		for _, p := range res.Phases {
+			out.Phases = append(out.Phases, phaseOutput{
+				Name: p.Name, Unit: p.Unit, Done: p.Done, Lines: p.Lines, ElapsedSeconds: p.Elapsed.Seconds(),
+			})
+			if p.Unit == "bytes" {
+				bytes += p.Done
+			}
+		}
+		out.Bytes = &bytes
+	}
+	return out
+}
+
+// print writes o to stdout as a line of JSON.
+func (o countOutput) print() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(o)
+}
@@ -0,0 +1,485 @@
+// Package pair counts distinct (source, destination) address pairs in
+// records holding two addresses, such as the flow log line
+// "10.0.0.1,192.0.2.7". A pair is a 64-bit key, past what the 2^32-bit
+// sets of the other engines hold, so pairs go into a hash set while there
+// are few; past Threshold they are spread by hash over the partitions of
+// a bucket.RecordSpill on disk, and each partition is counted on its own
+// by sorting, as the bucket engine counts its buckets. Distinct sources
+// and destinations can be counted in the same pass.
+package pair
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/adaptive"
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	// DefaultThreshold is the hash set size at which pairs start going to
+	// disk: about 160 MB of map.
+	DefaultThreshold = 1 << 22
+
+	// DefaultPartitions is how many partitions spilled pairs are spread
+	// over; pass 2 sorts one at a time per worker, 1/256 of the pairs.
+	DefaultPartitions = 256
+
+	bytesPerChunk    = 2 * 1024 * 1024 // read chunk size
+	stageSize        = 4 * 1024        // per-partition batch before a write to the spill
+	ctxCheckLines    = 1 << 16         // lines between cancellation checks
+	recordSize       = 8               // a spilled pair: source and destination, big-endian
+	defaultMaxWorker = 8               // beyond this pass 2 is usually disk-bound
+)
+
+// Options configures a PairCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms, for each field
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+
+	// Columns are the 1-based fields holding the source and the
+	// destination; zero means 1 and 2.
+	Columns [2]int
+	// Sep separates fields, 0 for ','. A blank, ' ', splits at runs of
+	// spaces and tabs instead, for whitespace-separated text.
+	Sep byte
+
+	// Threshold is the number of distinct pairs kept in a hash set
+	// before they are spilled; 0 means DefaultThreshold.
+	Threshold int
+	// Partitions is how many partitions spilled pairs are spread over,
+	// 0 for DefaultPartitions; more means less memory per partition in
+	// pass 2.
+	Partitions int
+	// Workers is how many partitions are counted at once in pass 2,
+	// 0 for min(NumCPU, 8).
+	Workers int
+	// MemBuffer is how many bytes of pairs a partition keeps in memory
+	// before it gets a file, as bucket.Options.MemBuffer.
+	MemBuffer int
+
+	TempDir      string             // where pairs are spilled, "" for os.TempDir
+	Compress     bucket.Compression // encoding of the spill files
+	MaxWriteRate int64              // bytes per second written to the spill files, 0 for no cap
+	NoCache      bool               // drop the spill files' pages from the page cache
+
+	// Endpoints also counts the distinct sources and destinations of the
+	// valid lines, for Endpoints.
+	Endpoints bool
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the spill, invalid and oversized lines, nil to discard
+	Logger   *slog.Logger      // receives the first invalid lines, nil for slog.Default()
+}
+
+// Validate reports whether o can build a PairCounter.
+func (o Options) Validate() error {
+	src, dst := o.columns()
+	if src < 1 || dst < 1 || src == dst {
+		return fmt.Errorf("source and destination columns must be positive and differ, got %d and %d", src, dst)
+	}
+	if o.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative, got %d", o.Threshold)
+	}
+	if o.Partitions < 0 || o.Partitions > 1<<16 {
+		return fmt.Errorf("partitions must be 0 to %d, got %d", 1<<16, o.Partitions)
+	}
+	return nil
+}
+
+// columns returns Columns with zero meaning 1 and 2.
+func (o Options) columns() (src, dst int) {
+	if o.Columns == [2]int{} {
+		return 1, 2
+	}
+	return o.Columns[0], o.Columns[1]
+}
+
+func init() {
+	counter.Register("pair", func(o counter.Options) (counter.Counter, error) {
+		compress, _ := bucket.ParseCompression(o.SpillCompress) // validated by the caller
+		var sep byte
+		if o.FieldSep != "" {
+			sep = o.FieldSep[0]
+		}
+		opts := Options{
+			Parse:        o.Parse,
+			MaxLine:      o.MaxLine,
+			Columns:      o.PairColumns,
+			Sep:          sep,
+			Workers:      o.BucketWorkers,
+			MemBuffer:    o.BucketMemBuffer,
+			TempDir:      o.TempDir,
+			Compress:     compress,
+			MaxWriteRate: o.MaxWriteRate,
+			NoCache:      o.NoCache,
+			Endpoints:    o.PairEndpoints,
+			Stats:        o.Stats,
+			Progress:     o.Progress,
+			Logger:       o.Logger,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("pair: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// PairCounter counts distinct (source, destination) pairs. It implements
+// counter.Counter and counter.ReaderCounter; its count is of pairs, not
+// addresses.
+type PairCounter struct {
+	opts     Options
+	src, dst int
+
+	sources, destinations int64 // of the last run, with Endpoints
+}
+
+// New creates a PairCounter of the first two comma-separated fields.
+func New() *PairCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a PairCounter with the given options. It panics
+// if opts fail Validate.
+func NewWithOptions(opts Options) *PairCounter {
+	if err := opts.Validate(); err != nil {
+		panic("pair: " + err.Error())
+	}
+	opts.Sep = cmp.Or(opts.Sep, ',')
+	opts.Threshold = cmp.Or(opts.Threshold, DefaultThreshold)
+	opts.Partitions = cmp.Or(opts.Partitions, DefaultPartitions)
+	c := &PairCounter{opts: opts}
+	c.src, c.dst = opts.columns()
+	return c
+}
+
+// Endpoints returns the distinct sources and destinations of the last
+// run with Options.Endpoints, both 0 without it.
+func (c *PairCounter) Endpoints() (sources, destinations int64) {
+	return c.sources, c.destinations
+}
+
+// CountUniqueIPs returns the number of distinct pairs in a file.
+func (c *PairCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation, checked every
+// ctxCheckLines lines and between partitions.
+func (c *PairCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(ctx, file)
+}
+
+// run is the state of one count.
+type run struct {
+	set   map[uint64]struct{} // distinct pairs, nil once spilled
+	spill *bucket.RecordSpill
+	stage [][]byte // per-partition records not yet written to spill
+
+	sources, destinations *endpointSet // with Endpoints
+}
+
+// CountReader is CountUniqueIPsContext on r.
+func (c *PairCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	c.sources, c.destinations = 0, 0
+	ru := &run{set: make(map[uint64]struct{})}
+	if c.opts.Endpoints {
+		ru.sources, ru.destinations = newEndpointSet(), newEndpointSet()
+	}
+	defer func() {
+		if ru.spill != nil {
+			ru.spill.Remove()
+		}
+	}()
+
+	cr := utils.NewDelimChunkReader(c.opts.Progress.Reader(r), bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+	delim := c.opts.Parse.Delim()
+	skips := counter.NewSkipLog(c.opts.Logger)
+	var lines, oversized, invalid int64
+	for {
+		ch, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, counter.WrapRead("", err)
+		}
+		for data := ch.Data; len(data) > 0; {
+			var raw []byte
+			raw, data = utils.NextRecord(data, delim)
+			if lines++; lines%ctxCheckLines == 0 {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+			}
+			if len(raw) > maxLine {
+				oversized++
+				continue
+			}
+			line := c.opts.Parse.Trim(raw)
+			if len(line) == 0 || c.opts.Parse.IsComment(line) {
+				continue
+			}
+			src, dst, err := c.parse(line)
+			if err != nil {
+				invalid++
+				c.opts.Parse.Malformed.Add(line, err)
+				skips.Add(line, err)
+				continue
+			}
+			if err := c.add(ru, src, dst); err != nil {
+				return 0, err
+			}
+		}
+		cr.Release(ch)
+	}
+
+	c.opts.Stats.Set("oversized lines", "%d", oversized+cr.Oversized())
+	c.opts.Stats.Set("invalid lines", "%d", invalid)
+	if ru.sources != nil {
+		c.sources, c.destinations = ru.sources.count(), ru.destinations.count()
+	}
+	if ru.spill == nil {
+		c.opts.Stats.Set("pair set", "hash set of %d pairs", len(ru.set))
+		return int64(len(ru.set)), nil
+	}
+	for i, recs := range ru.stage {
+		if err := ru.spill.Write(i, recs); err != nil {
+			return 0, err
+		}
+	}
+	if err := ru.spill.Close(); err != nil {
+		return 0, err
+	}
+	c.opts.Stats.Set("pair set", "spilled past %d pairs to %d partitions", c.opts.Threshold, c.opts.Partitions)
+	c.opts.Stats.Set("pair spill", "%s", ru.spill)
+	return c.countPartitions(ctx, ru.spill)
+}
+
+// parse returns the source and destination of line, or why it has none.
+func (c *PairCounter) parse(line []byte) (src, dst uint32, err error) {
+	sf, df, ok := c.fields(line)
+	if !ok {
+		return 0, 0, fmt.Errorf("no fields %d and %d", c.src, c.dst)
+	}
+	if src, err = c.opts.Parse.Parse(sf); err != nil {
+		return 0, 0, fmt.Errorf("source: %w", err)
+	}
+	if dst, err = c.opts.Parse.Parse(df); err != nil {
+		return 0, 0, fmt.Errorf("destination: %w", err)
+	}
+	return src, dst, nil
+}
+
+// fields returns the trimmed source and destination fields of line, and
+// false when it has too few fields or either is empty.
+func (c *PairCounter) fields(line []byte) (src, dst []byte, ok bool) {
+	for i := 1; i <= max(c.src, c.dst); i++ {
+		if line == nil {
+			return nil, nil, false
+		}
+		var f []byte
+		f, line = c.cut(line)
+		switch i {
+		case c.src:
+			src = bytes.TrimSpace(f)
+		case c.dst:
+			dst = bytes.TrimSpace(f)
+		}
+	}
+	return src, dst, len(src) > 0 && len(dst) > 0
+}
+
+// cut splits line at its first separator; rest is nil after the last
+// field.
+func (c *PairCounter) cut(line []byte) (field, rest []byte) {
+	if c.opts.Sep == ' ' {
+		i := bytes.IndexAny(line, " \t")
+		if i < 0 {
+			return line, nil
+		}
+		return line[:i], bytes.TrimLeft(line[i:], " \t")
+	}
+	i := bytes.IndexByte(line, c.opts.Sep)
+	if i < 0 {
+		return line, nil
+	}
+	return line[:i], line[i+1:]
+}
+
+// add records one pair, spilling the hash set once it reaches Threshold.
+func (c *PairCounter) add(ru *run, src, dst uint32) error {
+	if ru.sources != nil {
+		ru.sources.add(src)
+		ru.destinations.add(dst)
+	}
+	key := uint64(src)<<32 | uint64(dst)
+	if ru.spill == nil {
+		ru.set[key] = struct{}{}
+		if len(ru.set) < c.opts.Threshold {
+			return nil
+		}
+		return c.startSpill(ru)
+	}
+	return c.stage(ru, key)
+}
+
+// startSpill moves the hash set's pairs to a new spill, which every pair
+// goes to from then on.
+func (c *PairCounter) startSpill(ru *run) error {
+	sp, err := bucket.NewRecordSpill(bucket.RecordSpillOptions{
+		Partitions:   c.opts.Partitions,
+		RecordSize:   recordSize,
+		MemBuffer:    c.opts.MemBuffer,
+		TempDir:      c.opts.TempDir,
+		Compress:     c.opts.Compress,
+		MaxWriteRate: c.opts.MaxWriteRate,
+		NoCache:      c.opts.NoCache,
+	})
+	if err != nil {
+		return err
+	}
+	counter.Logger(c.opts.Logger).Debug("pair set spilling", "pairs", len(ru.set), "partitions", c.opts.Partitions)
+	ru.spill, ru.stage = sp, make([][]byte, c.opts.Partitions)
+	for key := range ru.set {
+		if err := c.stage(ru, key); err != nil {
+			return err
+		}
+	}
+	ru.set = nil
+	return nil
+}
+
+// stage queues key for its partition, writing the batch once it fills.
+// Equal pairs always land in the same partition.
+func (c *PairCounter) stage(ru *run, key uint64) error {
+	i := int(mix64(key) % uint64(len(ru.stage)))
+	ru.stage[i] = binary.BigEndian.AppendUint64(ru.stage[i], key)
+	if len(ru.stage[i]) < stageSize {
+		return nil
+	}
+	err := ru.spill.Write(i, ru.stage[i])
+	ru.stage[i] = ru.stage[i][:0]
+	return err
+}
+
+// countPartitions runs pass 2: a pool of workers loads a partition at a
+// time, sorts it and counts its distinct pairs. Partitions hold disjoint
+// pairs, so their counts add up.
+func (c *PairCounter) countPartitions(ctx context.Context, sp *bucket.RecordSpill) (int64, error) {
+	parts := sp.Touched()
+	workers := c.opts.Workers
+	if workers <= 0 {
+		workers = min(runtime.NumCPU(), defaultMaxWorker)
+	}
+	var (
+		next     atomic.Int64 // next position in parts to claim
+		total    atomic.Int64
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for range min(workers, len(parts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var keys []uint64
+			for !failed.Load() {
+				j := int(next.Add(1) - 1)
+				if j >= len(parts) {
+					return
+				}
+				keys = keys[:0]
+				err := sp.Read(ctx, parts[j], func(recs []byte) {
+					for ; len(recs) >= recordSize; recs = recs[recordSize:] {
+						keys = append(keys, binary.BigEndian.Uint64(recs))
+					}
+				})
+				if err == nil {
+					err = ctx.Err()
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+					return
+				}
+				slices.Sort(keys)
+				total.Add(int64(len(slices.Compact(keys))))
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return total.Load(), nil
+}
+
+// mix64 is the splitmix64 finalizer, spreading pairs that share a
+// source or a destination over every partition.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// endpointSet holds the distinct sources or destinations: a hash set
+// while that is small, moved into a bitset past adaptive.DefaultThreshold
+// entries, as package group's sets are.
+type endpointSet struct {
+	m    map[uint32]struct{}
+	bits *concurrent.BitsetCounter
+	n    int64 // distinct addresses once in bits
+}
+
+func newEndpointSet() *endpointSet {
+	return &endpointSet{m: make(map[uint32]struct{})}
+}
+
+func (s *endpointSet) add(ip uint32) {
+	if s.bits != nil {
+		if s.bits.Add(ip) {
+			s.n++
+		}
+		return
+	}
+	s.m[ip] = struct{}{}
+	if len(s.m) >= adaptive.DefaultThreshold {
+		s.bits = concurrent.New()
+		for ip := range s.m {
+			s.bits.Add(ip)
+		}
+		s.n, s.m = int64(len(s.m)), nil
+	}
+}
+
+func (s *endpointSet) count() int64 {
+	if s.bits != nil {
+		return s.n
+	}
+	return int64(len(s.m))
+}
@@ -0,0 +1,45 @@
+package pair
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The spilled count must match the hash set's, whether partitions stay
+// in memory, go to files or share them compressed.
+func TestSpillMatchesHashSet(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var b strings.Builder
+	seen := make(map[[2]uint32]bool)
+	for range 50000 {
+		src, dst := rng.Uint32N(300), rng.Uint32N(300)
+		seen[[2]uint32{src, dst}] = true
+		fmt.Fprintf(&b, "%s,%s\n", utils.FormatIPv4(src<<8), utils.FormatIPv4(dst))
+	}
+	input := b.String()
+
+	for _, o := range []Options{
+		{},
+		{Threshold: 1000, Partitions: 16},
+		{Threshold: 1000, Partitions: 7, Compress: bucket.CompressFlate, TempDir: t.TempDir()},
+	} {
+		o.Endpoints = true
+		c := NewWithOptions(o)
+		n, err := c.CountReader(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("%+v: %v", o, err)
+		}
+		if n != int64(len(seen)) {
+			t.Errorf("%+v: %d pairs, want %d", o, n, len(seen))
+		}
+		if src, dst := c.Endpoints(); src != 300 || dst != 300 {
+			t.Errorf("%+v: %d sources and %d destinations, want 300 each", o, src, dst)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"bytes"
+	"cmp"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Parser turns text records into addresses for a Sink: it drops lines
+// longer than MaxLine, trims and parses the rest with Parse, and skips
+// the ones that fail to parse or that Check rejects. Run parses with one;
+// readers that split the input themselves, such as over a mapped file,
+// can use one directly. It is safe for concurrent use.
+type Parser struct {
+	Parse     utils.ParseOptions
+	MaxLine   int                            // 0 means utils.DefaultMaxLine
+	Check     func(first, last uint32) error // nil accepts every address
+	Skips     *counter.SkipLog               // nil drops skipped lines silently
+	Oversized *atomic.Int64                  // counts the lines dropped for MaxLine, nil to not count them
+	Invalid   *atomic.Int64                  // counts the lines skipped as unparsable or rejected, nil to not count them
+}
+
+// Chunk adds the addresses of every record in data, whole records ending
+// in Parse's delimiter, and returns how many were new to s. With Plain
+// options each line is scanned and parsed in one pass, and only the lines
+// that pass turns down go through Line.
+func (p *Parser) Chunk(data []byte, s Sink) int64 {
+	if p.Parse.Plain() {
+		return p.plainChunk(data, s)
+	}
+	delim := p.Parse.Delim()
+	var n int64
+	for len(data) > 0 {
+		var raw []byte
+		raw, data = utils.NextRecord(data, delim)
+		n += p.Line(raw, s)
+	}
+	return n
+}
+
+// plainChunk is Chunk with utils.ParseIPv4Line.
+func (p *Parser) plainChunk(data []byte, s Sink) int64 {
+	maxLine := cmp.Or(p.MaxLine, utils.DefaultMaxLine)
+	var n int64
+	for start := 0; start < len(data); {
+		ip, next, ok := utils.ParseIPv4Line(data, start)
+		end := next
+		if end > start && data[end-1] == '\n' {
+			end--
+		}
+		switch {
+		case !ok || end-start > maxLine:
+			n += p.Line(data[start:end], s)
+		case !p.Parse.Filter.Allow(ip):
+		case p.Check != nil:
+			if err := p.Check(ip, ip); err != nil {
+				p.skip(bytes.TrimSpace(data[start:end]), err)
+				break
+			}
+			fallthrough
+		default:
+			if s.Add(ip) {
+				n++
+			}
+		}
+		start = next
+	}
+	return n
+}
+
+// Line adds the address of one raw record, or with Parse.CIDR every
+// address of its block, and returns how many were new to s.
+func (p *Parser) Line(raw []byte, s Sink) int64 {
+	if len(raw) > cmp.Or(p.MaxLine, utils.DefaultMaxLine) {
+		if p.Oversized != nil {
+			p.Oversized.Add(1)
+		}
+		return 0
+	}
+	line := p.Parse.Trim(raw)
+	if len(line) == 0 {
+		return 0
+	}
+	first, last, form, err := p.Parse.ParseForm(raw, line)
+	if err == nil && p.Check != nil {
+		err = p.Check(first, last)
+	}
+	if err != nil {
+		p.skip(line, err)
+		return 0
+	}
+	p.Parse.Canon.Add(first, last, form)
+	if first == last {
+		if s.Add(first) {
+			return 1
+		}
+		return 0
+	}
+	if rs, ok := s.(RangeSink); ok {
+		return rs.AddRange(first, last)
+	}
+	var n int64
+	for ip := first; ; ip++ {
+		if s.Add(ip) {
+			n++
+		}
+		if ip == last {
+			return n
+		}
+	}
+}
+
+// skip counts and logs a trimmed line that failed to parse or that Check
+// rejected.
+func (p *Parser) skip(line []byte, err error) {
+	if p.Invalid != nil && !utils.Ignored(err) {
+		p.Invalid.Add(1)
+	}
+	p.Parse.Malformed.Add(line, err)
+	p.Skips.Add(line, err)
+}
@@ -0,0 +1,341 @@
+// Package pipeline reads IPv4 addresses from a stream with a pool of
+// workers and hands them to a Sink. A producer cuts the input into chunks
+// on record boundaries, or packed 4-byte records, and workers split and
+// parse the chunks concurrently, calling Sink.Add for every address. The
+// concurrent engine counts through it with its bitset as the sink; other
+// sinks can forward the addresses or rewrite them instead of counting.
+package pipeline
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// DefaultChunkSize is the bytes the producer hands a worker at a time.
+const DefaultChunkSize = 2 * 1024 * 1024
+
+// Sink takes the addresses a pipeline parses. Add is called from many
+// workers at once and reports whether ip was new to the sink; sinks that
+// do not track addresses report true.
+type Sink interface {
+	Add(ip uint32) bool
+}
+
+// RangeSink is a Sink that takes the addresses of a CIDR line at once,
+// returning how many were new; other sinks get them one by one.
+type RangeSink interface {
+	Sink
+	AddRange(first, last uint32) int64
+}
+
+// Splitter is a Sink that gives each worker a sink of its own, such as a
+// private buffer, so that workers do not contend on it.
+type Splitter interface {
+	Sink
+	Worker(i int) Worker
+}
+
+// Worker is the sink of one worker of a Splitter. ChunkDone is called
+// once the worker has added the addresses of each chunk, data being the
+// chunk and seq its number in reading order, to flush or fold them; an
+// error stops the run and is returned.
+type Worker interface {
+	Sink
+	ChunkDone(data []byte, seq int64) error
+}
+
+// Options configures Run.
+type Options struct {
+	Parse  utils.ParseOptions // accepted address forms and the record delimiter
+	Binary binary.ByteOrder   // read packed 4-byte addresses instead of lines, nil for text
+
+	// MaxLine is the longest line accepted; longer ones are skipped
+	// without being buffered. 0 means utils.DefaultMaxLine.
+	MaxLine int
+
+	// Check, if set, vets the addresses of each parsed line; a line it
+	// rejects is skipped like one that failed to parse.
+	Check func(first, last uint32) error
+
+	Skips *counter.SkipLog // samples skipped lines, nil to drop them silently
+
+	Workers    int // goroutines parsing chunks, 0 for NumCPU
+	ChunkSize  int // bytes read at a time, 0 for DefaultChunkSize
+	QueueDepth int // chunks that may wait for a worker, 0 for 2 per worker
+
+	// Seq numbers the chunks in reading order, shared by runs that should
+	// number theirs as one input; nil numbers from 1.
+	Seq *atomic.Int64
+
+	// Stop, if set, is polled before each chunk is read or parsed; once
+	// it reports true the run ends early without an error, as for a
+	// budget the caller enforces.
+	Stop func() bool
+
+	// Trace, if set, records every chunk's range and counts as workers
+	// finish it, for Replay to check the run's chunk boundaries against.
+	Trace *Recorder
+
+	// Progress, if set, receives the bytes each worker parses; the bytes
+	// read are the caller's to report, as they may come before any
+	// decompression or framing.
+	Progress *counter.Progress
+
+	// Source, if set, labels everything the run reads, which is then
+	// tallied in Result.Sources. A reader that is a counter.Sourced has
+	// its chunks split where one of its sources ends and another begins,
+	// and tallied per source, without it. Other runs tally nothing and
+	// pay nothing for it.
+	Source *counter.Source
+
+	// Job, if set, has the chunks parsed on the workers of the Pool it
+	// belongs to, with its queue depth, instead of on Workers goroutines
+	// of the run's own.
+	Job *counter.PoolJob
+}
+
+// Result is what a run read.
+type Result struct {
+	New       int64 // addresses the sink reported new
+	Oversized int64 // lines longer than Options.MaxLine, skipped
+	Partial   int   // trailing bytes of binary input short of a record, ignored
+
+	// Sources holds what each source contributed, in source order, when
+	// the run tallied them.
+	Sources []counter.SourceTally
+}
+
+// Run reads r, parses its addresses and adds them to sink until r ends,
+// ctx is done or Options.Stop reports true. Whatever ends it, every
+// worker has exited by the time Run returns; a read error is returned as
+// a *counter.ReadError.
+func Run(ctx context.Context, r io.Reader, sink Sink, o Options) (Result, error) {
+	workers := cmp.Or(o.Workers, runtime.NumCPU())
+	if o.Job != nil {
+		workers = o.Job.Workers()
+	}
+	size := cmp.Or(o.ChunkSize, DefaultChunkSize)
+	var (
+		src    source
+		lines  *utils.ChunkReader
+		recs   *utils.RecordReader
+		over   atomic.Int64
+		parser = &Parser{Parse: o.Parse, MaxLine: o.MaxLine, Check: o.Check, Skips: o.Skips, Oversized: &over}
+	)
+	if o.Binary != nil {
+		recs = utils.NewRecordReader(r, size, 4)
+		src = recs
+	} else {
+		lines = utils.NewDelimChunkReader(r, size, o.MaxLine, o.Parse.Delim())
+		src = lines
+	}
+	seq := o.Seq
+	if seq == nil {
+		seq = new(atomic.Int64)
+	}
+	sourced, _ := r.(counter.Sourced)
+	var tallies []*sourceTallies
+	if sourced != nil || o.Source != nil {
+		tallies = make([]*sourceTallies, workers)
+	}
+	var (
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		failed.Store(true)
+	}
+	stopped := func() bool {
+		return ctx.Err() != nil || failed.Load() || (o.Stop != nil && o.Stop())
+	}
+
+	// Workers add up their own new addresses; a chunk's pooled buffer goes
+	// back to the reader once it is parsed
+	counts := make([]int64, workers)
+	split, _ := sink.(Splitter)
+	process := make([]func(c seqChunk), workers)
+	for i := range workers {
+		var s Sink = sink
+		var w Worker
+		if split != nil {
+			w = split.Worker(i)
+			s = w
+		}
+		var t *tally
+		if o.Trace != nil {
+			t = &tally{Sink: s}
+			s = t
+		}
+		var st *sourceTallies
+		var sw SourcedWorker
+		if tallies != nil {
+			st = newSourceTallies(parser)
+			tallies[i] = st
+			sw, _ = w.(SourcedWorker)
+		}
+		process[i] = func(c seqChunk) {
+			if !stopped() {
+				var n int64
+				switch {
+				case st != nil:
+					n = st.chunk(c, o, s, sw)
+				case o.Binary != nil:
+					n = addRecords(c.Data, o.Binary, o.Parse.Filter, s)
+				default:
+					n = parser.Chunk(c.Data, s)
+				}
+				counts[i] += n
+				o.Progress.AddWorker(i, int64(len(c.Data)))
+				if t != nil {
+					o.Trace.chunk(TraceChunk{Seq: c.seq, Offset: c.Offset, Size: int64(len(c.Data)), Parsed: t.n, New: n})
+					t.n = 0
+				}
+				if w != nil {
+					if err := w.ChunkDone(c.Data, c.seq); err != nil {
+						fail(err)
+					}
+				}
+			}
+			src.Release(c.Chunk)
+		}
+	}
+	send, done := startWorkers(ctx, process, o)
+
+	// Producer: errors only break out of the loop so the cleanup below
+	// always runs
+	var readErr error
+	for !stopped() {
+		c, err := src.Next()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		sc := seqChunk{Chunk: c, seq: seq.Add(1)}
+		if tallies != nil {
+			sc.pieces = pieces(c, sourced, o.Source)
+		}
+		if !send(sc) {
+			src.Release(c)
+			break
+		}
+	}
+	done()
+
+	res := Result{Oversized: over.Load()}
+	if tallies != nil {
+		res.Sources = mergeTallies(tallies)
+	}
+	if lines != nil {
+		res.Oversized += lines.Oversized()
+	} else {
+		res.Partial = recs.Partial()
+	}
+	switch {
+	case readErr != nil:
+		return res, counter.WrapRead("", readErr)
+	case firstErr != nil:
+		return res, firstErr
+	case ctx.Err() != nil:
+		return res, ctx.Err()
+	}
+	for _, n := range counts {
+		res.New += n
+	}
+	return res, nil
+}
+
+// startWorkers starts the workers of a run, worker i parsing with
+// process[i], and returns send, which hands them a chunk and reports false
+// if ctx ended first, and done, which waits for them to parse every chunk
+// sent. With o.Job the pool's workers parse them instead.
+func startWorkers(ctx context.Context, process []func(c seqChunk), o Options) (send func(c seqChunk) bool, done func()) {
+	if j := o.Job; j != nil {
+		send = func(c seqChunk) bool {
+			return j.Submit(ctx, func(i int) { process[i](c) }) == nil
+		}
+		return send, j.Wait
+	}
+	chunks := make(chan seqChunk, cmp.Or(o.QueueDepth, 2*len(process)))
+	var wg sync.WaitGroup
+	for _, p := range process {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				p(c)
+			}
+		}()
+	}
+	send = func(c seqChunk) bool {
+		chunks <- c
+		return true
+	}
+	done = func() {
+		close(chunks)
+		wg.Wait()
+	}
+	return send, done
+}
+
+// source is what a run reads: a ChunkReader of lines or a RecordReader of
+// packed addresses.
+type source interface {
+	Next() (utils.Chunk, error)
+	Release(c utils.Chunk)
+}
+
+// seqChunk is a chunk with its number in reading order and, in runs that
+// tally their sources, its pieces from each.
+type seqChunk struct {
+	utils.Chunk
+	seq    int64
+	pieces []piece
+}
+
+// addRecords adds every packed address in chunk that filter allows to s.
+// The two standard byte orders get their own loops so decoding inlines
+// instead of going through the ByteOrder interface.
+func addRecords(chunk []byte, order binary.ByteOrder, filter *utils.Filter, s Sink) int64 {
+	var n int64
+	if filter != nil {
+		for i := 0; i+4 <= len(chunk); i += 4 {
+			if ip := order.Uint32(chunk[i:]); filter.Allow(ip) && s.Add(ip) {
+				n++
+			}
+		}
+		return n
+	}
+	switch order {
+	case binary.BigEndian:
+		for i := 0; i+4 <= len(chunk); i += 4 {
+			if s.Add(binary.BigEndian.Uint32(chunk[i:])) {
+				n++
+			}
+		}
+	case binary.LittleEndian:
+		for i := 0; i+4 <= len(chunk); i += 4 {
+			if s.Add(binary.LittleEndian.Uint32(chunk[i:])) {
+				n++
+			}
+		}
+	default:
+		for i := 0; i+4 <= len(chunk); i += 4 {
+			if s.Add(order.Uint32(chunk[i:])) {
+				n++
+			}
+		}
+	}
+	return n
+}
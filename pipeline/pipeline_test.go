@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Both sinks see every address of every form the parse options accept,
+// a CIDR line as each of its addresses, whether workers have their own
+// sinks or share one, and never a line that is too long or fails to
+// parse.
+func TestRun(t *testing.T) {
+	input := "# list\n1.2.3.4:80\n  5.6.7.8\nbad\n1.2.3.4\n10.0.0.0/30\n" + strings.Repeat("9", 100) + "\n::ffff:5.6.7.8\n"
+	o := Options{MaxLine: 64, ChunkSize: 16, Workers: 3, Parse: utils.ParseOptions{
+		CommentPrefix: "#", StripPort: true, Mapped: true, CIDR: true, MinPrefix: 24}}
+	want := []string{"1.2.3.4", "1.2.3.4", "10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "5.6.7.8", "5.6.7.8"}
+
+	var c Counter
+	res, err := Run(context.Background(), strings.NewReader(input), &c, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.New != 6 || c.Count() != 6 || res.Oversized != 1 {
+		t.Errorf("counter: %+v, count %d; want 6 new and 1 oversized", res, c.Count())
+	}
+
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	for _, sink := range []Sink{w, struct{ Sink }{w}} { // with and without a sink per worker
+		out.Reset()
+		res, err := Run(context.Background(), strings.NewReader(input), sink, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(out.String())
+		slices.Sort(lines)
+		if res.New != int64(len(want)) || !slices.Equal(lines, want) {
+			t.Errorf("writer: %d new, wrote %q, want %q", res.New, lines, want)
+		}
+	}
+}
+
+// Packed records count like lines, a partial record at the end is
+// reported, and Stop ends a run early without an error.
+func TestRunBinary(t *testing.T) {
+	var in []byte
+	for _, ip := range []uint32{1, 2, 1, 3} {
+		in = binary.LittleEndian.AppendUint32(in, ip)
+	}
+	in = append(in, 0xff, 0xff)
+	var c Counter
+	res, err := Run(context.Background(), bytes.NewReader(in), &c, Options{Binary: binary.LittleEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.New != 3 || res.Partial != 2 {
+		t.Errorf("%+v, want 3 new and a 2-byte partial record", res)
+	}
+
+	var stopped Counter
+	res, err = Run(context.Background(), bytes.NewReader(in), &stopped, Options{Binary: binary.LittleEndian, Stop: func() bool { return true }})
+	if err != nil || res.New != 0 {
+		t.Errorf("stopped run: %+v, %v", res, err)
+	}
+}
+
+// discard is a Sink doing nothing, to measure the pipeline alone.
+type discard struct{}
+
+func (discard) Add(uint32) bool { return true }
+
+func BenchmarkRun(b *testing.B) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var text []byte
+	for range 1 << 20 {
+		text = fmt.Appendf(text, "%s\n", utils.FormatIPv4(10<<24|rng.Uint32N(1<<20)))
+	}
+	for _, bc := range []struct {
+		name string
+		sink func() Sink
+	}{
+		{"discard", func() Sink { return discard{} }},
+		{"counter", func() Sink { return new(Counter) }},
+		{"writer", func() Sink { return NewWriter(io.Discard) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(text)))
+			for range b.N {
+				if _, err := Run(context.Background(), bytes.NewReader(text), bc.sink(), Options{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Counter is a Sink that counts distinct addresses, the concurrent
+// engine's count without its options: a bitset of 65536 pages of 8 KB,
+// one per /16, allocated as addresses land in them, up to 512 MB for the
+// whole space. Each worker tallies its new addresses and folds them in
+// once a chunk is done. The zero value is ready to use.
+type Counter struct {
+	pages [1 << 16]atomic.Pointer[[1024]uint64]
+	n     atomic.Int64
+}
+
+// Add marks ip as seen and reports whether it was new.
+func (c *Counter) Add(ip uint32) bool {
+	if !c.set(ip) {
+		return false
+	}
+	c.n.Add(1)
+	return true
+}
+
+// set marks ip as seen without counting it.
+func (c *Counter) set(ip uint32) bool {
+	page := c.pages[ip>>16].Load()
+	if page == nil {
+		page = new([1024]uint64)
+		if !c.pages[ip>>16].CompareAndSwap(nil, page) {
+			page = c.pages[ip>>16].Load()
+		}
+	}
+	mask := uint64(1) << (ip & 63)
+	return atomic.OrUint64(&page[ip>>6&1023], mask)&mask == 0
+}
+
+// Count returns the number of distinct addresses added. While a run is
+// adding it lags by the chunks workers have not finished.
+func (c *Counter) Count() int64 {
+	return c.n.Load()
+}
+
+// Worker returns a sink of one worker that counts into c.
+func (c *Counter) Worker(int) Worker {
+	return &counterWorker{c: c}
+}
+
+// counterWorker is one worker's view of a Counter, keeping its count off
+// the shared total until a chunk is done.
+type counterWorker struct {
+	c *Counter
+	n int64
+}
+
+func (w *counterWorker) Add(ip uint32) bool {
+	if !w.c.set(ip) {
+		return false
+	}
+	w.n++
+	return true
+}
+
+func (w *counterWorker) ChunkDone([]byte, int64) error {
+	w.c.n.Add(w.n)
+	w.n = 0
+	return nil
+}
+
+// Writer is a Sink that writes every address it is given to an
+// io.Writer as a dotted quad on a line of its own, whatever form the
+// input had it in: ports, padding, mapped IPv6 and comments are gone,
+// and a CIDR line becomes a line per address. It does not remove
+// repeats. Each worker collects the lines of a chunk and writes them at
+// once, so a chunk's lines stay together and in input order but chunks
+// come out in the order workers finish them.
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+	buf []byte
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Add writes ip's line, reporting true. A write error is kept for Err.
+func (w *Writer) Add(ip uint32) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(utils.AppendIPv4(w.buf[:0], ip), '\n')
+	w.write(w.buf)
+	return true
+}
+
+// write writes p unless an earlier write failed. The caller holds w.mu.
+func (w *Writer) write(p []byte) error {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return w.err
+}
+
+// Err returns the first error writing to the underlying writer.
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Worker returns a sink of one worker that buffers its lines.
+func (w *Writer) Worker(int) Worker {
+	return &writerWorker{w: w}
+}
+
+// writerWorker holds the lines of the chunk one worker is parsing.
+type writerWorker struct {
+	w   *Writer
+	buf []byte
+}
+
+func (ww *writerWorker) Add(ip uint32) bool {
+	ww.buf = append(utils.AppendIPv4(ww.buf, ip), '\n')
+	return true
+}
+
+func (ww *writerWorker) ChunkDone([]byte, int64) error {
+	if len(ww.buf) == 0 {
+		return nil
+	}
+	ww.w.mu.Lock()
+	defer ww.w.mu.Unlock()
+	err := ww.w.write(ww.buf)
+	ww.buf = ww.buf[:0]
+	return err
+}
@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"sync/atomic"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// SourcedWorker is a Worker that is told which source the addresses it
+// is about to get came from, in runs that tally their sources.
+type SourcedWorker interface {
+	Worker
+	SetSource(src counter.Source)
+}
+
+// piece is the part of a chunk read from one source, up to index end of
+// its data.
+type piece struct {
+	src counter.Source
+	end int
+}
+
+// pieces splits c at the boundaries between the sources of a stream that
+// has them, or labels all of it src.
+func pieces(c utils.Chunk, sourced counter.Sourced, src *counter.Source) []piece {
+	if sourced == nil {
+		return []piece{{*src, len(c.Data)}}
+	}
+	var ps []piece
+	for at := 0; at < len(c.Data); {
+		s, end := sourced.SourceAt(c.Offset + int64(at))
+		next := len(c.Data)
+		if end >= 0 && end-c.Offset < int64(next) {
+			next = int(end - c.Offset)
+		}
+		ps = append(ps, piece{s, next})
+		at = next
+	}
+	return ps
+}
+
+// sourceTallies is one worker's per-source figures. Its parser counts the
+// worker's invalid lines, so each piece's share is a difference.
+type sourceTallies struct {
+	parser  *Parser
+	invalid atomic.Int64
+	by      map[int]*counter.SourceTally
+}
+
+func newSourceTallies(p *Parser) *sourceTallies {
+	t := &sourceTallies{by: make(map[int]*counter.SourceTally)}
+	wp := *p
+	wp.Invalid = &t.invalid
+	t.parser = &wp
+	return t
+}
+
+// chunk adds the addresses of c piece by piece, telling w, if set, where
+// each came from, and returns how many were new to s.
+func (t *sourceTallies) chunk(c seqChunk, o Options, s Sink, w SourcedWorker) int64 {
+	var total int64
+	from := 0
+	for _, p := range c.pieces {
+		data := c.Data[from:p.end]
+		from = p.end
+		if w != nil {
+			w.SetSource(p.src)
+		}
+		before := t.invalid.Load()
+		var n, lines int64
+		if o.Binary != nil {
+			n, lines = addRecords(data, o.Binary, o.Parse.Filter, s), int64(len(data)/4)
+		} else {
+			n, lines = t.parser.Chunk(data, s), utils.CountRecords(data, o.Parse.Delim())
+		}
+		tally := t.by[p.src.Index]
+		if tally == nil {
+			tally = &counter.SourceTally{Source: p.src}
+			t.by[p.src.Index] = tally
+		}
+		tally.Add(counter.SourceTally{Lines: lines, Invalid: t.invalid.Load() - before, New: n})
+		total += n
+	}
+	return total
+}
+
+// mergeTallies adds up the workers' tallies per source, in source order.
+func mergeTallies(workers []*sourceTallies) []counter.SourceTally {
+	all := make(map[int]counter.SourceTally)
+	for _, w := range workers {
+		for i, t := range w.by {
+			cur := all[i]
+			cur.Source = t.Source
+			cur.Add(*t)
+			all[i] = cur
+		}
+	}
+	return slices.SortedFunc(maps.Values(all), func(a, b counter.SourceTally) int { return cmp.Compare(a.Index, b.Index) })
+}
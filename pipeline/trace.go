@@ -0,0 +1,289 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// TraceMagic starts every chunk trace; its last two bytes are the version.
+//
+// A trace is the magic, then one record per chunk in the order workers
+// finished them, each the chunk's number in reading order, its offset,
+// its size, the addresses parsed from it and how many of those were new,
+// as unsigned varints; then a 0, which no chunk number is, and the number
+// of chunks. It holds no input data, about 10 bytes a chunk.
+const TraceMagic = "ipctrc01"
+
+// ErrBadTrace is returned for a trace that is truncated, corrupt or
+// written by another format version.
+var ErrBadTrace = errors.New("bad chunk trace")
+
+// TraceChunk is one chunk of a recorded run.
+type TraceChunk struct {
+	Seq    int64 // number in reading order, from 1
+	Offset int64 // position of its first byte in the input, counting a skipped BOM
+	Size   int64 // bytes
+	Parsed int64 // addresses handed to the sink, every address of a CIDR line
+	New    int64 // of those, how many the sink reported new
+}
+
+// Recorder writes the chunks of a run, as Options.Trace, to a trace. It
+// is safe for concurrent use by the workers.
+type Recorder struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	n   int64
+	buf []byte
+	err error
+}
+
+// NewRecorder writes the trace header to w and returns a Recorder for
+// the chunks that follow.
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{w: bufio.NewWriter(w)}
+	r.w.WriteString(TraceMagic)
+	return r
+}
+
+// chunk appends c to the trace.
+func (r *Recorder) chunk(c TraceChunk) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = r.buf[:0]
+	for _, v := range []int64{c.Seq, c.Offset, c.Size, c.Parsed, c.New} {
+		r.buf = binary.AppendUvarint(r.buf, uint64(v))
+	}
+	if _, err := r.w.Write(r.buf); err != nil && r.err == nil {
+		r.err = err
+	}
+	r.n++
+}
+
+// Close ends the trace with the number of chunks recorded and flushes it,
+// returning the first write error. It does not close the underlying
+// writer.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(binary.AppendUvarint(binary.AppendUvarint(nil, 0), uint64(r.n)))
+	if err := r.w.Flush(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// ReadTrace reads a trace written by a Recorder and returns its chunks in
+// reading order.
+func ReadTrace(r io.Reader) ([]TraceChunk, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(TraceMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("%w: short header: %v", ErrBadTrace, err)
+	}
+	if string(magic) != TraceMagic {
+		return nil, fmt.Errorf("%w: not a chunk trace (magic %q)", ErrBadTrace, magic)
+	}
+	var chunks []TraceChunk
+	for {
+		seq, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: chunk %d: %v", ErrBadTrace, len(chunks)+1, err)
+		}
+		if seq == 0 {
+			break
+		}
+		c := TraceChunk{Seq: int64(seq)}
+		for _, v := range []*int64{&c.Offset, &c.Size, &c.Parsed, &c.New} {
+			u, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, fmt.Errorf("%w: chunk %d: %v", ErrBadTrace, len(chunks)+1, err)
+			}
+			*v = int64(u)
+		}
+		chunks = append(chunks, c)
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing chunk count: %v", ErrBadTrace, err)
+	}
+	if n != uint64(len(chunks)) {
+		return nil, fmt.Errorf("%w: %d chunks, the trace says %d", ErrBadTrace, len(chunks), n)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data", ErrBadTrace)
+	}
+	slices.SortFunc(chunks, func(a, b TraceChunk) int { return cmp.Compare(a.Seq, b.Seq) })
+	for i := 1; i < len(chunks); i++ {
+		if chunks[i].Seq == chunks[i-1].Seq {
+			return nil, fmt.Errorf("%w: chunk %d recorded twice", ErrBadTrace, chunks[i].Seq)
+		}
+	}
+	return chunks, nil
+}
+
+// ReplayResult is what Replay found.
+type ReplayResult struct {
+	Chunks   int   // chunks replayed
+	Parsed   int64 // addresses parsed from them
+	Unique   int64 // distinct addresses among them
+	Recorded int64 // the recorded chunks' new addresses added up
+
+	// Bad is the first chunk whose range or parse differs from the
+	// recording, nil if none does.
+	Bad *Mismatch
+}
+
+// Mismatch is a chunk that Replay found to differ from its recording.
+type Mismatch struct {
+	Chunk  TraceChunk // as recorded
+	Parsed int64      // addresses the replay parsed from it
+	New    int64      // of those, how many were new in reading order
+	Reason string
+}
+
+func (m *Mismatch) String() string {
+	return fmt.Sprintf("chunk %d, bytes %d to %d: %s (recorded %d parsed, %d new; replay %d parsed, %d new)",
+		m.Chunk.Seq, m.Chunk.Offset, m.Chunk.Offset+m.Chunk.Size, m.Reason, m.Chunk.Parsed, m.Chunk.New, m.Parsed, m.New)
+}
+
+// Replay re-reads the recorded chunks of the size-byte input r one after
+// another on one goroutine, parsing them as Run would with o, and stops
+// at the first chunk that does not start where the previous one ended,
+// short of lines longer than o.MaxLine the reader skips, does not end on a
+// record, or parses to a different number of addresses. Which worker saw
+// an address first varies between runs, so the new addresses of each
+// chunk are only compared added up, as Unique against Recorded.
+func Replay(r io.ReaderAt, size int64, chunks []TraceChunk, o Options) (ReplayResult, error) {
+	var (
+		res    ReplayResult
+		set    Counter
+		parser = &Parser{Parse: o.Parse, MaxLine: o.MaxLine, Check: o.Check}
+		delim  = o.Parse.Delim()
+		end    int64
+		data   []byte
+	)
+	for i, c := range chunks {
+		res.Recorded += c.New
+		bad := func(reason string, args ...any) (ReplayResult, error) {
+			res.Bad = &Mismatch{Chunk: c, Reason: fmt.Sprintf(reason, args...)}
+			return res, nil
+		}
+		if c.Offset+c.Size > size {
+			return bad("runs past the end of the %d-byte input", size)
+		}
+		if c.Offset < end {
+			return bad("overlaps the previous chunk by %d bytes", end-c.Offset)
+		}
+		if err := replayGap(r, end, c.Offset, o, i == 0, false); err != nil {
+			return bad("starts %d bytes after the previous chunk: %v", c.Offset-end, err)
+		}
+		data = slices.Grow(data[:0], int(c.Size))[:c.Size]
+		if _, err := r.ReadAt(data, c.Offset); err != nil {
+			return res, err
+		}
+		t := &tally{Sink: &set}
+		var n int64
+		if o.Binary != nil {
+			if c.Size%4 != 0 {
+				return bad("%d bytes is not a whole number of records", c.Size)
+			}
+			n = addRecords(data, o.Binary, o.Parse.Filter, t)
+		} else {
+			if len(data) > 0 && data[len(data)-1] != delim && c.Offset+c.Size < size {
+				return bad("does not end on a record")
+			}
+			n = parser.Chunk(data, t)
+		}
+		res.Chunks++
+		res.Parsed += t.n
+		if t.n != c.Parsed {
+			res.Bad = &Mismatch{Chunk: c, Parsed: t.n, New: n,
+				Reason: fmt.Sprintf("%d addresses parsed, recorded %d", t.n, c.Parsed)}
+			return res, nil
+		}
+		end = c.Offset + c.Size
+	}
+	res.Unique = set.Count()
+	if err := replayGap(r, end, size, o, len(chunks) == 0, true); err != nil && len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		res.Bad = &Mismatch{Chunk: last, Parsed: last.Parsed,
+			Reason: fmt.Sprintf("the input goes on for %d bytes after it: %v", size-end, err)}
+	}
+	return res, nil
+}
+
+// replayGap reports why the bytes [from, to) of r, between two chunks or
+// after the last one, could not have been skipped by the reader: only a
+// leading BOM, lines longer than o.MaxLine and, at the end, a partial
+// record of binary input can be.
+func replayGap(r io.ReaderAt, from, to int64, o Options, first, last bool) error {
+	if from == to {
+		return nil
+	}
+	if o.Binary != nil {
+		if last && to-from < 4 {
+			return nil
+		}
+		return errors.New("binary input has no lines to skip")
+	}
+	gap := make([]byte, to-from)
+	if _, err := r.ReadAt(gap, from); err != nil {
+		return err
+	}
+	if first && from == 0 {
+		gap = bytes.TrimPrefix(gap, []byte("\xef\xbb\xbf")) // the UTF-8 BOM the reader skips
+	}
+	maxLine := cmp.Or(o.MaxLine, utils.DefaultMaxLine)
+	delim := o.Parse.Delim()
+	for len(gap) > 0 {
+		i := bytes.IndexByte(gap, delim)
+		if i < 0 && !last {
+			return errors.New("the skipped bytes do not end on a record")
+		}
+		if i < 0 {
+			i = len(gap)
+		}
+		if i <= maxLine {
+			return fmt.Errorf("a %d-byte line was skipped, but only lines over %d bytes are", i, maxLine)
+		}
+		gap = gap[min(i+1, len(gap)):]
+	}
+	return nil
+}
+
+// tally is a sink that counts the addresses handed to its Sink, for the
+// Parsed count of a trace.
+type tally struct {
+	Sink
+	n int64
+}
+
+func (t *tally) Add(ip uint32) bool {
+	t.n++
+	return t.Sink.Add(ip)
+}
+
+func (t *tally) AddRange(first, last uint32) int64 {
+	t.n += int64(last-first) + 1
+	if rs, ok := t.Sink.(RangeSink); ok {
+		return rs.AddRange(first, last)
+	}
+	var n int64
+	for ip := first; ; ip++ {
+		if t.Sink.Add(ip) {
+			n++
+		}
+		if ip == last {
+			return n
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A trace of a correct run replays clean, over a BOM and lines too long
+// to buffer; a run whose parser drops one address, or a trace whose
+// chunk boundary moved, is pinned to that chunk; a cut trace is refused.
+func TestRecordReplay(t *testing.T) {
+	rng := rand.New(rand.NewPCG(13, 14))
+	var b strings.Builder
+	b.WriteString("\xef\xbb\xbf")
+	const target = "203.0.113.7"
+	targetAt := -1
+	for i := range 20000 {
+		switch {
+		case i == 12345:
+			targetAt = b.Len()
+			b.WriteString(target + "\n")
+		case i%2500 == 0:
+			b.WriteString(strings.Repeat("x", 300) + "\n")
+		default:
+			fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(10<<24|rng.Uint32N(1<<14)))
+		}
+	}
+	input := []byte(b.String())
+	o := Options{MaxLine: 64, ChunkSize: 4096, Workers: 4}
+
+	record := func(o Options) ([]TraceChunk, int64) {
+		var trace bytes.Buffer
+		o.Trace = NewRecorder(&trace)
+		var c Counter
+		if _, err := Run(context.Background(), bytes.NewReader(input), &c, o); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Trace.Close(); err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := ReadTrace(bytes.NewReader(trace.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cut := trace.Bytes()[:trace.Len()-1]
+		if _, err := ReadTrace(bytes.NewReader(cut)); !errors.Is(err, ErrBadTrace) {
+			t.Errorf("cut trace: %v, want ErrBadTrace", err)
+		}
+		return chunks, c.Count()
+	}
+	replay := func(chunks []TraceChunk) ReplayResult {
+		res, err := Replay(bytes.NewReader(input), int64(len(input)), chunks, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	clean, unique := record(o)
+	res := replay(clean)
+	if res.Bad != nil || res.Chunks != len(clean) || res.Unique != unique || res.Recorded != unique {
+		t.Fatalf("clean run: %+v, bad %v; want %d chunks, %d unique", res, res.Bad, len(clean), unique)
+	}
+
+	// A parser that loses the target's line, as a boundary bug would
+	faulty := o
+	faulty.Check = func(first, last uint32) error {
+		if utils.FormatIPv4(first) == target {
+			return errors.New("injected fault")
+		}
+		return nil
+	}
+	chunks, _ := record(faulty)
+	res = replay(chunks)
+	if m := res.Bad; m == nil || int(m.Chunk.Offset) > targetAt || targetAt >= int(m.Chunk.Offset+m.Chunk.Size) || m.Parsed != m.Chunk.Parsed+1 {
+		t.Errorf("faulty parser: %v, want the chunk holding byte %d", m, targetAt)
+	}
+
+	k := len(clean) / 2
+	clean[k].Offset++
+	clean[k].Size--
+	if m := replay(clean).Bad; m == nil || m.Chunk.Seq != clean[k].Seq {
+		t.Errorf("moved boundary: %v, want chunk %d", m, clean[k].Seq)
+	}
+}
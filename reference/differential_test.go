@@ -0,0 +1,200 @@
+package reference_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/reference"
+	"github.com/Sveta-1999/IPCounter/utils"
+
+	_ "github.com/Sveta-1999/IPCounter/bucket"
+	_ "github.com/Sveta-1999/IPCounter/naive"
+)
+
+var (
+	diffSeed   = flag.Uint64("diff-seed", 1, "seed of the inputs TestDifferential generates")
+	diffRounds = flag.Int("diff-rounds", 100, "inputs TestDifferential generates")
+)
+
+// engine is one way of counting an input that must agree with the
+// reference.
+type engine struct {
+	desc string
+	name string
+	opts counter.Options
+}
+
+var engines = []engine{
+	{desc: "naive", name: "naive"},
+	{desc: "concurrent", name: "concurrent", opts: counter.Options{Shards: 4096, ChunkSize: concurrent.MinChunkSize}},
+	{desc: "concurrent mmap", name: "concurrent", opts: counter.Options{Shards: 4096, ChunkSize: concurrent.MinChunkSize, Mmap: true}},
+	{desc: "concurrent segmented", name: "concurrent", opts: counter.Options{Shards: 4096, ChunkSize: concurrent.MinChunkSize, Segmented: true}},
+	{desc: "bucket", name: "bucket"},
+	{desc: "bucket spilled", name: "bucket", opts: counter.Options{BucketMemBuffer: -1}},
+	{desc: "bucket by hash", name: "bucket", opts: counter.Options{BucketMemBuffer: -1, BucketPartition: "hash"}},
+}
+
+// genInput returns random lines, with repeats, invalid lines, blank
+// lines and stray whitespace, and the addresses its valid lines hold in
+// order. Some inputs end without a newline or start with a BOM.
+func genInput(rng *rand.Rand) ([]string, []uint32) {
+	pool := make([]uint32, 1+rng.IntN(50))
+	for i := range pool {
+		pool[i] = rng.Uint32()
+		if rng.IntN(2) == 0 {
+			pool[i] &= 0xff00ffff // a few /8s and /16s in common
+		}
+	}
+	invalid := []string{"garbage", "1.2.3", "1.2.3.4.5", "256.1.2.3", "1..2.3", "-1.2.3.4", "1.2.3.4x", "::1"}
+	n := rng.IntN(1000)
+	lines := make([]string, 0, n+1)
+	var want []uint32
+	for range n {
+		switch k := rng.IntN(20); {
+		case k == 0:
+			lines = append(lines, invalid[rng.IntN(len(invalid))])
+		case k == 1:
+			lines = append(lines, []string{"", " ", "\t", "\r"}[rng.IntN(4)])
+		default:
+			ip := pool[rng.IntN(len(pool))]
+			if k == 2 {
+				ip = rng.Uint32()
+			}
+			line := utils.FormatIPv4(ip)
+			switch rng.IntN(8) {
+			case 0:
+				line = "  " + line + "\t"
+			case 1:
+				line += "\r"
+			}
+			lines = append(lines, line)
+			want = append(want, ip)
+		}
+	}
+	if len(lines) > 0 && rng.IntN(8) == 0 {
+		lines[0] = "\xef\xbb\xbf" + lines[0]
+	}
+	return lines, want
+}
+
+// join returns lines as an input, with or without a final newline.
+func join(lines []string, final bool) string {
+	s := strings.Join(lines, "\n")
+	if final && len(lines) > 0 {
+		s += "\n"
+	}
+	return s
+}
+
+// counts returns what the reference and each engine count in input, and
+// whether they all agree.
+func counts(t *testing.T, dir, input string) ([]int64, bool) {
+	t.Helper()
+	path := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	want, err := reference.NewWithOptions(reference.Options{Logger: discard}).CountUniqueIPs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []int64{want}
+	agree := true
+	for _, e := range engines {
+		opts := e.opts
+		opts.TempDir, opts.Logger = dir, discard
+		c, err := counter.NewWithOptions(e.name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.CountUniqueIPs(path)
+		if err != nil {
+			t.Fatalf("%s: %v", e.desc, err)
+		}
+		got = append(got, n)
+		agree = agree && n == want
+	}
+	return got, agree
+}
+
+// shrink removes runs of lines from a failing input, halving the run
+// length down to single lines, for as long as the engines still disagree.
+func shrink(t *testing.T, dir string, lines []string, final bool) []string {
+	for size := len(lines) / 2; size > 0; size /= 2 {
+		for i := 0; i+size <= len(lines); {
+			try := slices.Concat(lines[:i], lines[i+size:])
+			if _, agree := counts(t, dir, join(try, final)); !agree {
+				lines = try
+				continue
+			}
+			i += size
+		}
+	}
+	return lines
+}
+
+// Random inputs count the same in the reference and in every engine, and
+// the reference accepts just the addresses of their valid lines. A
+// disagreement is shrunk to the fewest lines that still show it; rerun
+// one with -diff-seed and -diff-rounds.
+func TestDifferential(t *testing.T) {
+	rng := rand.New(rand.NewPCG(*diffSeed, 0))
+	dir := t.TempDir()
+	ref := reference.NewWithOptions(reference.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	for round := range *diffRounds {
+		lines, want := genInput(rng)
+		final := rng.IntN(4) > 0
+		input := join(lines, final)
+		if _, err := ref.CountReader(context.Background(), strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		if got := ref.Accepted(); !slices.Equal(got, want) {
+			t.Fatalf("seed %d round %d: reference accepted %d addresses, want %d", *diffSeed, round, len(got), len(want))
+		}
+		if _, agree := counts(t, dir, input); agree {
+			continue
+		}
+		small := shrink(t, dir, lines, final)
+		got, _ := counts(t, dir, join(small, final))
+		var b strings.Builder
+		fmt.Fprintf(&b, "seed %d round %d: engines disagree on %d lines, shrunk from %d:\n%q\nreference: %d", *diffSeed, round, len(small), len(lines), join(small, final), got[0])
+		for i, e := range engines {
+			fmt.Fprintf(&b, "\n%s: %d", e.desc, got[i+1])
+		}
+		t.Fatal(b.String())
+	}
+	if left, _ := os.ReadDir(dir); len(left) > 1 {
+		t.Errorf("%d entries left in the temp dir, want just the input", len(left))
+	}
+}
+
+// A budget stops the count once the accepted addresses would not fit,
+// CIDR blocks included, and one they fit in changes nothing.
+func TestMaxMem(t *testing.T) {
+	input := "10.0.0.1\n10.0.0.1\n10.0.0.2\n"
+	opts := reference.Options{MaxMem: 3 * 8}
+	if n, err := reference.NewWithOptions(opts).CountReader(context.Background(), strings.NewReader(input)); err != nil || n != 2 {
+		t.Errorf("budget of 3 addresses: %d, %v, want 2", n, err)
+	}
+	opts.MaxMem = 2 * 8
+	if _, err := reference.NewWithOptions(opts).CountReader(context.Background(), strings.NewReader(input)); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("budget of 2 addresses: %v, want ErrMemBudget", err)
+	}
+	opts = reference.Options{MaxMem: 64 << 10, Parse: utils.ParseOptions{CIDR: true}}
+	if _, err := reference.NewWithOptions(opts).CountReader(context.Background(), strings.NewReader("10.0.0.0/16\n")); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("a /16 in 64 KB: %v, want ErrMemBudget", err)
+	}
+}
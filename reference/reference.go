@@ -0,0 +1,152 @@
+package reference
+
+/*
+Package reference provides an engine so plain it is obviously correct,
+to check the fast engines against.
+
+It reads the input one line at a time on one goroutine, parses each line
+the way every engine does and keeps every accepted address, in input
+order; the count is the number of distinct values once they are sorted.
+There is no concurrency, no pooling and no chunking, so it needs 4 bytes
+per accepted line, twice that while they are sorted, and suits test-sized
+inputs only; a budget only stops it once they would not fit.
+*/
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	ctxCheckLines = 1 << 16 // lines between cancellation checks
+	acceptedBytes = 8       // an accepted address and its place in the sorted copy
+)
+
+// Options configures a ReferenceCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+	MaxMem  int64              // fail with counter.ErrMemBudget once the accepted addresses and their sorted copy would pass this, 0 for no cap
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the oversized line count, nil to discard
+	Logger   *slog.Logger      // receives the first few lines that fail to parse, nil for slog.Default()
+}
+
+func init() {
+	counter.Register("reference", func(o counter.Options) (counter.Counter, error) {
+		return NewWithOptions(Options{Parse: o.Parse, MaxLine: o.MaxLine, MaxMem: o.MaxMem, Stats: o.Stats, Progress: o.Progress, Logger: o.Logger}), nil
+	})
+}
+
+// ReferenceCounter counts distinct IPv4s the slow, obvious way. It is
+// not safe for concurrent use.
+type ReferenceCounter struct {
+	opts     Options
+	log      *slog.Logger
+	accepted []uint32
+}
+
+func New() *ReferenceCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a ReferenceCounter with the given options.
+func NewWithOptions(opts Options) *ReferenceCounter {
+	return &ReferenceCounter{opts: opts, log: counter.Logger(opts.Logger)}
+}
+
+func (c *ReferenceCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation, checked every
+// ctxCheckLines lines.
+func (c *ReferenceCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	n, err := c.CountReader(ctx, file)
+	if err != nil && ctx.Err() == nil {
+		return 0, counter.WrapRead(filename, err)
+	}
+	return n, err
+}
+
+// CountReader counts distinct IPv4s read from r.
+func (c *ReferenceCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	skips := counter.NewSkipLog(c.log)
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+	delim := c.opts.Parse.Delim()
+	br := bufio.NewReader(c.opts.Progress.Reader(r))
+	if _, err := utils.SkipBOM(br); err != nil {
+		return 0, counter.WrapRead("", err)
+	}
+	c.accepted = c.accepted[:0]
+	limit := c.opts.MaxMem / acceptedBytes
+	var oversized int64
+	for lines := 1; ; lines++ {
+		raw, err := br.ReadBytes(delim)
+		if err != nil && err != io.EOF {
+			return 0, counter.WrapRead("", err)
+		}
+		if len(raw) == 0 && err == io.EOF {
+			break
+		}
+		if lines%ctxCheckLines == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+		if raw[len(raw)-1] == delim {
+			raw = raw[:len(raw)-1]
+		}
+		if len(raw) > maxLine {
+			oversized++
+		} else if line := c.opts.Parse.Trim(raw); len(line) > 0 {
+			first, last, form, perr := c.opts.Parse.ParseForm(raw, line)
+			if perr != nil {
+				c.opts.Parse.Malformed.Add(line, perr)
+				skips.Add(line, perr)
+			} else {
+				c.opts.Parse.Canon.Add(first, last, form)
+				for ip := first; ; ip++ {
+					if c.opts.MaxMem > 0 && int64(len(c.accepted)) >= limit {
+						return 0, fmt.Errorf("%w: more than %d accepted addresses need over %s; use another engine",
+							counter.ErrMemBudget, limit, counter.FormatBytes(c.opts.MaxMem))
+					}
+					c.accepted = append(c.accepted, ip)
+					if ip == last {
+						break
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	c.opts.Stats.Set("oversized lines", "%d", oversized)
+	distinct := slices.Compact(slices.Sorted(slices.Values(c.accepted)))
+	return int64(len(distinct)), nil
+}
+
+// Accepted returns every address the last count accepted, repeats
+// included, in input order; a CIDR line gives each address of its block.
+func (c *ReferenceCounter) Accepted() []uint32 {
+	return slices.Clone(c.accepted)
+}
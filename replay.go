@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/pipeline"
+)
+
+// runReplay implements -replay: re-parse the chunks of the -record trace
+// at tracePath over the file they were cut from, one at a time, and fail
+// with the first chunk whose range or address count differs from the
+// recording. The parse flags must be the ones the trace was recorded
+// with.
+func runReplay(tracePath, path string, opts counter.Options) error {
+	tf, err := os.Open(tracePath)
+	if err != nil {
+		return err
+	}
+	chunks, err := pipeline.ReadTrace(tf)
+	tf.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", tracePath, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("-replay needs a regular file, got %s", path)
+	}
+	res, err := pipeline.Replay(f, st.Size(), chunks, pipeline.Options{
+		Parse:   opts.Parse,
+		Binary:  counter.BinaryOrder(opts.InputFormat),
+		MaxLine: opts.MaxLine,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Chunks replayed: %d of %d\n", res.Chunks, len(chunks))
+	fmt.Printf("Addresses parsed: %d\n", res.Parsed)
+	if res.Bad != nil {
+		return fmt.Errorf("replay: %s", res.Bad)
+	}
+	fmt.Printf("Unique IPv4 addresses: %d\n", res.Unique)
+	if res.Recorded != res.Unique {
+		return fmt.Errorf("replay: every chunk parses as recorded, but the recorded new addresses add up to %d, not %d: the set, not the chunking, lost or double-counted addresses",
+			res.Recorded, res.Unique)
+	}
+	return nil
+}
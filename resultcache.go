@@ -0,0 +1,286 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// fingerprintSpan is how much of each end of an input the cache key
+// hashes. Appending to or rewriting a log changes its size or its tail,
+// so the ends catch what the size and mtime miss without reading it all.
+const fingerprintSpan = 1 << 20
+
+// resultCache keeps the counts of earlier runs in a directory, one JSON
+// file per result, named by the hash of everything the count depends on.
+// A hit is touched, and past maxEntries the least recently used entries,
+// by modification time, are removed: atime is often not kept up to date.
+type resultCache struct {
+	dir        string
+	maxEntries int
+}
+
+// cacheEntry is what a cache file holds: the count and how it is printed.
+type cacheEntry struct {
+	Source   string    `json:"source"`
+	Impl     string    `json:"impl"`
+	Count    int64     `json:"count"`
+	Estimate bool      `json:"estimate,omitempty"`
+	StdError float64   `json:"std_error,omitempty"`
+	Counted  time.Time `json:"counted"`
+}
+
+// cacheKey is what a count depends on: the input's identity and content,
+// and the engine and options that change the result. Options that only
+// change how fast or in how much memory it is reached are left out.
+type cacheKey struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"mtime"`
+	Fingerprint string `json:"fingerprint"`
+	Impl        string `json:"impl"`
+
+	Format          utils.IPFormat `json:"format"`
+	StripPort       bool           `json:"strip_port"`
+	Lenient         bool           `json:"lenient"`
+	Mapped          bool           `json:"mapped"`
+	CIDR            bool           `json:"cidr"`
+	MinPrefix       int            `json:"min_prefix"`
+	CommentPrefix   string         `json:"comment_prefix"`
+	InlineComments  bool           `json:"inline_comments"`
+	Relaxed         bool           `json:"relaxed"`
+	RecordSep       string         `json:"record_sep"`
+	Extract         string         `json:"extract"`
+	Filter          string         `json:"filter"`
+	MaxLine         int            `json:"max_line"`
+	InputFormat     string         `json:"input_format"`
+	Strict          bool           `json:"strict"`
+	PcapField       string         `json:"pcap_field"`
+	ParquetColumn   string         `json:"parquet_column"`
+	Member          string         `json:"member"`
+	MinOccurrences  int            `json:"min_occurrences"`
+	SketchBits      int            `json:"sketch_bits"`
+	SketchK         int            `json:"sketch_k"`
+	SketchPrecision int            `json:"sketch_precision"`
+}
+
+// uncacheable returns why a run cannot use the cache, or "" if it can:
+// only a single local file counted to a single number is cached.
+func uncacheable(sources []string, impl string, opts counter.Options, extras bool) string {
+	switch {
+	case len(sources) != 1:
+		return "more than one input"
+	case ipcount.IsRemote(sources[0]):
+		return "remote input"
+	case impl == "window" || impl == "group" || impl == "all" || impl == "sample":
+		return "-impl " + impl + " prints more than a count"
+	case impl == "pair":
+		return "-impl pair counts pairs, not addresses"
+	case impl == "ipv6":
+		return "-impl ipv6 counts IPv6 addresses"
+	case opts.StateFile != "":
+		return "-state-file counts against a saved set"
+	case opts.Preload != "":
+		return "-preload counts against a list"
+	case opts.SketchOut != "" || opts.KeepBuckets != "" || opts.ResumeBuckets != "" || opts.FirstSeen != "":
+		return "the run writes files besides the count"
+	case opts.Checkpoint.Metered():
+		return "-checkpoint-every and -uniques-at report running counts"
+	case extras:
+		return "breakdowns, -prefix-sweep, -heatmap, -by-prefix and -top-ips need the set"
+	case opts.Parse.Lines != nil:
+		return "-fail-if-unique-ratio-below and -output json need the lines read"
+	case opts.Strict && opts.Parse.Malformed != nil:
+		return "-strict needs every line parsed"
+	}
+	if fi, err := os.Stat(sources[0]); err != nil || !fi.Mode().IsRegular() {
+		return "input is not a regular file"
+	}
+	return ""
+}
+
+// key returns the name of the cache file for counting path with impl and
+// opts. inputFormat is -input-format as given, as pcap and parquet are
+// read as binary, and extract is -extract, since Parse.Extract is a func.
+func (rc *resultCache) key(path, impl string, opts counter.Options, inputFormat, pcapField, column, member, extract string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	fp, err := fingerprint(f, fi.Size())
+	if err != nil {
+		return "", fmt.Errorf("result cache: fingerprint %s: %w", path, err)
+	}
+	p := opts.Parse
+	k := cacheKey{
+		Path:        abs,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime().UnixNano(),
+		Fingerprint: fp,
+		Impl:        impl,
+
+		Format:          p.Format,
+		StripPort:       p.StripPort,
+		Lenient:         p.Lenient,
+		Mapped:          p.Mapped,
+		CIDR:            p.CIDR,
+		MinPrefix:       p.MinPrefix,
+		CommentPrefix:   p.CommentPrefix,
+		InlineComments:  p.InlineComments,
+		Relaxed:         p.Relaxed != nil,
+		RecordSep:       p.RecordSep,
+		Extract:         extract,
+		Filter:          p.Filter.String(),
+		MaxLine:         opts.MaxLine,
+		InputFormat:     inputFormat,
+		Strict:          opts.Strict,
+		Member:          member,
+		MinOccurrences:  max(opts.MinOccurrences, 1),
+		SketchBits:      opts.SketchBits,
+		SketchK:         opts.SketchK,
+		SketchPrecision: opts.SketchPrecision,
+	}
+	switch inputFormat {
+	case "pcap":
+		k.PcapField = pcapField
+	case "parquet":
+		k.ParquetColumn = column
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// fingerprint hashes the first and last fingerprintSpan bytes of f, or
+// all of it when it is no longer than both.
+func fingerprint(f *os.File, size int64) (string, error) {
+	h := sha256.New()
+	if size <= 2*fingerprintSpan {
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, fingerprintSpan)); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, io.NewSectionReader(f, size-fingerprintSpan, fingerprintSpan)); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (rc *resultCache) path(key string) string {
+	return filepath.Join(rc.dir, key+".json")
+}
+
+// get returns the entry stored under key, and false if there is none. A
+// hit is touched so eviction keeps it; an unreadable entry is a miss.
+func (rc *resultCache) get(key string) (cacheEntry, bool) {
+	var e cacheEntry
+	b, err := os.ReadFile(rc.path(key))
+	if err != nil {
+		return e, false
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return e, false
+	}
+	now := time.Now()
+	os.Chtimes(rc.path(key), now, now)
+	return e, true
+}
+
+// put stores e under key through a temp file renamed into place, so a
+// concurrent run never reads half an entry, then evicts past maxEntries.
+func (rc *resultCache) put(key string, e cacheEntry) error {
+	if err := os.MkdirAll(rc.dir, 0o755); err != nil {
+		return fmt.Errorf("result cache: %w", err)
+	}
+	f, err := os.CreateTemp(rc.dir, key+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("result cache: %w", err)
+	}
+	defer os.Remove(f.Name()) // after a successful rename there is nothing left to remove
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(e); err != nil {
+		f.Close()
+		return fmt.Errorf("result cache: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("result cache: %w", err)
+	}
+	if err := os.Rename(f.Name(), rc.path(key)); err != nil {
+		return fmt.Errorf("result cache: %w", err)
+	}
+	return rc.evict()
+}
+
+// evict removes the least recently used entries past maxEntries.
+func (rc *resultCache) evict() error {
+	if rc.maxEntries <= 0 {
+		return nil
+	}
+	dirents, err := os.ReadDir(rc.dir)
+	if err != nil {
+		return fmt.Errorf("result cache: %w", err)
+	}
+	var entries []fs.FileInfo
+	for _, d := range dirents {
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			continue
+		}
+		if fi, err := d.Info(); err == nil {
+			entries = append(entries, fi)
+		}
+	}
+	if len(entries) <= rc.maxEntries {
+		return nil
+	}
+	slices.SortFunc(entries, func(a, b fs.FileInfo) int {
+		return cmp.Compare(a.ModTime().UnixNano(), b.ModTime().UnixNano())
+	})
+	for _, fi := range entries[:len(entries)-rc.maxEntries] {
+		if err := os.Remove(filepath.Join(rc.dir, fi.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("result cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// printUnique writes the count line of a run, ~ and the standard error
+// marking an estimate.
+func printUnique(count int64, estimate bool, stdErr float64) {
+	if estimate {
+		fmt.Printf("Unique IPv4 addresses: ~%d (± %.0f)\n", count, stdErr)
+	} else {
+		fmt.Printf("Unique IPv4 addresses: %d\n", count)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// A stored count is found again under the same key and missed under the
+// key of anything that changes the result: the input's content, size or
+// modification time, the engine, or an option such as SketchK. Options
+// that only change the speed leave the key alone.
+func TestResultCache(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.txt")
+	if err := os.WriteFile(input, []byte("10.0.0.1\n10.0.0.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rc := &resultCache{dir: filepath.Join(dir, "cache")}
+	opts := counter.Options{SketchK: 1024}
+	key := func(impl string, o counter.Options) string {
+		t.Helper()
+		k, err := rc.key(input, impl, o, "text", "", "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	k := key("kmv", opts)
+	if _, ok := rc.get(k); ok {
+		t.Fatal("hit in an empty cache")
+	}
+	want := cacheEntry{Source: input, Impl: "kmv", Count: 2, Estimate: true, StdError: 0.5, Counted: time.Now().UTC().Truncate(time.Second)}
+	if err := rc.put(k, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := rc.get(k); !ok || got != want {
+		t.Errorf("hit: %+v, %v; want %+v", got, ok, want)
+	}
+	faster := opts
+	faster.Workers, faster.ChunkSize = 3, 64<<10
+	if key("kmv", faster) != k {
+		t.Error("workers and chunk size changed the key")
+	}
+
+	otherK := opts
+	otherK.SketchK = 4096
+	lines := opts
+	lines.MaxLine = 64
+	for name, other := range map[string]string{
+		"SketchK": key("kmv", otherK),
+		"MaxLine": key("kmv", lines),
+		"engine":  key("hll", opts),
+	} {
+		if other == k {
+			t.Errorf("changing %s kept the key", name)
+		} else if _, ok := rc.get(other); ok {
+			t.Errorf("changing %s hit", name)
+		}
+	}
+
+	// Same size, new content and time: the fingerprint and mtime miss
+	if err := os.WriteFile(input, []byte("10.0.0.1\n10.0.0.3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(input, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if k2 := key("kmv", opts); k2 == k {
+		t.Error("rewriting the input kept the key")
+	} else if _, ok := rc.get(k2); ok {
+		t.Error("rewritten input hit")
+	}
+}
+
+// Past maxEntries the entries touched longest ago go first, a hit
+// counting as a touch.
+func TestResultCacheEvict(t *testing.T) {
+	rc := &resultCache{dir: t.TempDir(), maxEntries: 2}
+	old := time.Now().Add(-time.Hour)
+	for i, k := range []string{"a", "b"} {
+		if err := rc.put(k, cacheEntry{Count: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		at := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(rc.path(k), at, at)
+	}
+	if _, ok := rc.get("a"); !ok { // a is now the most recent
+		t.Fatal("a missing")
+	}
+	if err := rc.put("c", cacheEntry{Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := rc.get(k); ok != want {
+			t.Errorf("%s kept: %v, want %v", k, ok, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// resultSummary is what -result-file holds: how a run ended, for batch
+// jobs that read a file instead of stdout. Numbers are plain JSON
+// numbers and times RFC 3339, whatever the locale.
+type resultSummary struct {
+	Status      string            `json:"status"` // ok or failed
+	ExitStatus  int               `json:"exit_status"`
+	Count       *int64            `json:"count,omitempty"` // nil when the run failed before counting
+	Estimate    bool              `json:"estimate,omitempty"`
+	StdError    float64           `json:"std_error,omitempty"`
+	Engine      string            `json:"engine,omitempty"`
+	OptionsHash string            `json:"options_hash"`
+	Inputs      []inputIdentity   `json:"inputs"`
+	Started     time.Time         `json:"started"`
+	Finished    time.Time         `json:"finished"`
+	Stats       map[string]string `json:"stats,omitempty"`
+	Error       *resultError      `json:"error,omitempty"`
+
+	Expectation *counter.ExpectationDiff `json:"expectation,omitempty"` // the count against -expect or -expect-file
+
+	stats *counter.Stats
+}
+
+// inputIdentity names an input, with the size and modification time of
+// a local file.
+type inputIdentity struct {
+	Path    string     `json:"path"`
+	Size    *int64     `json:"size,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+}
+
+// resultError is why a run failed: the category of its exit status and
+// the message logged.
+type resultError struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// newResultSummary starts the summary of a run started now with the
+// flags set on fs, hashing them, -result-file and -expect* aside, so runs
+// with the same options can be told apart from others.
+func newResultSummary(fs *flag.FlagSet) *resultSummary {
+	h := sha256.New()
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "result-file" && !strings.HasPrefix(f.Name, "expect") {
+			fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value)
+		}
+	})
+	return &resultSummary{OptionsHash: hex.EncodeToString(h.Sum(nil)), Inputs: []inputIdentity{}, Started: time.Now()}
+}
+
+// inputs records the sources of the run.
+func (s *resultSummary) inputs(sources []string) {
+	if s == nil {
+		return
+	}
+	for _, src := range sources {
+		id := inputIdentity{Path: src}
+		if !ipcount.IsRemote(src) {
+			if fi, err := os.Stat(src); err == nil {
+				size, mtime := fi.Size(), fi.ModTime()
+				id.Size, id.ModTime = &size, &mtime
+			}
+		}
+		s.Inputs = append(s.Inputs, id)
+	}
+}
+
+// counted records the count printed and the engine that gave it.
+func (s *resultSummary) counted(n int64, estimate bool, stdErr float64, engine string) {
+	if s == nil {
+		return
+	}
+	s.Count, s.Estimate, s.StdError, s.Engine = &n, estimate, stdErr, engine
+}
+
+// expected records how the count compares to the one expected.
+func (s *resultSummary) expected(d counter.ExpectationDiff) {
+	if s == nil {
+		return
+	}
+	s.Expectation = &d
+}
+
+// finish writes the summary of a run that ended with err to path and
+// returns err, or the write's own error after a run that succeeded. The
+// file is replaced through a temp file, so a run that crashes leaves the
+// previous summary or none, never a partial one.
+func (s *resultSummary) finish(path string, err error, sync bool) error {
+	if s == nil {
+		return err
+	}
+	s.Finished = time.Now()
+	s.Status, s.ExitStatus = "ok", exitCode(err)
+	if err != nil {
+		s.Status = "failed"
+		s.Error = &resultError{Category: exitCategory(err), Message: err.Error()}
+	}
+	s.Stats = s.stats.Map()
+	werr := counter.WriteFileAtomic(path, sync, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	})
+	if werr == nil {
+		return err
+	}
+	werr = fmt.Errorf("-result-file: %w", werr)
+	if err == nil {
+		return werr
+	}
+	slog.Error(werr.Error())
+	return err
+}
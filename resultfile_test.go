@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// A run that fails still replaces the summary, with the error's category
+// and exit status, and one that succeeds after it clears them; nothing
+// but the summary is left in its directory.
+func TestResultFileFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "result.json")
+	missing := filepath.Join(dir, "missing.log")
+	if err := os.WriteFile(path, []byte(`{"status": "ok", "count": 42}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	read := func() resultSummary {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s resultSummary
+		if err := json.Unmarshal(b, &s); err != nil {
+			t.Fatalf("%v in %s", err, b)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("%d entries in the summary's directory, want just it", len(entries))
+		}
+		return s
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("impl", "auto", "")
+	fs.String("result-file", "", "")
+	if err := fs.Parse([]string{"-impl", "bucket", "-result-file", path, missing}); err != nil {
+		t.Fatal(err)
+	}
+	s := newResultSummary(fs)
+	s.inputs(fs.Args())
+	_, runErr := ipcount.Count(context.Background(), ipcount.File(missing), ipcount.WithEngine("bucket"))
+	if err := s.finish(path, runErr, false); err != runErr {
+		t.Fatalf("finish returned %v, want the run's %v", err, runErr)
+	}
+	got := read()
+	if got.Status != "failed" || got.ExitStatus != exitOpen || got.Count != nil {
+		t.Errorf("status %q, exit %d, count %v; want failed, %d and none", got.Status, got.ExitStatus, got.Count, exitOpen)
+	}
+	if got.Error == nil || got.Error.Category != "open_input" || got.Error.Message != runErr.Error() {
+		t.Errorf("error %+v, want open_input: %v", got.Error, runErr)
+	}
+	if len(got.Inputs) != 1 || got.Inputs[0].Path != missing || got.Inputs[0].Size != nil {
+		t.Errorf("inputs %+v, want %s without a size", got.Inputs, missing)
+	}
+	if got.OptionsHash == "" || got.Finished.Before(got.Started) {
+		t.Errorf("options hash %q, started %v, finished %v", got.OptionsHash, got.Started, got.Finished)
+	}
+
+	// A failure of the count outranks one writing the summary
+	mismatch := &counter.CountMismatchError{Set: "bitset", Counted: 11, Recount: 10}
+	s = newResultSummary(fs)
+	if err := s.finish(filepath.Join(dir, "absent", "result.json"), mismatch, false); err != mismatch {
+		t.Errorf("finish into a missing directory returned %v, want the run's error", err)
+	}
+	s = newResultSummary(fs)
+	if err := s.finish(path, mismatch, false); err != mismatch {
+		t.Fatal(err)
+	}
+	if got := read(); got.ExitStatus != 1 || got.Error == nil || got.Error.Category != "count_mismatch" {
+		t.Errorf("exit %d, error %+v; want 1 and count_mismatch", got.ExitStatus, got.Error)
+	}
+
+	s = newResultSummary(fs)
+	s.counted(7, false, 0, "bucket")
+	if err := s.finish(path, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got.Status != "ok" || got.ExitStatus != 0 || got.Error != nil || got.Count == nil || *got.Count != 7 {
+		t.Errorf("%+v, want ok with a count of 7", got)
+	}
+	if !errors.Is(s.finish(filepath.Join(dir, "absent", "result.json"), nil, false), os.ErrNotExist) {
+		t.Error("a summary that cannot be written should fail a run that succeeded")
+	}
+}
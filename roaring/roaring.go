@@ -0,0 +1,205 @@
+// Package roaring counts unique IPv4 addresses exactly in a roaring
+// bitmap (Chambi et al., 2016): the space is cut into its 65536 /16s and
+// each one holding an address gets a container, a sorted array of the
+// low halves while it is sparse and a bitmap once that is smaller. Memory
+// follows how many distinct addresses the input has and how they cluster,
+// not how many lines it has or how much of the space it spans, so it
+// suits inputs that touch a small or skewed part of IPv4, where the
+// concurrent engine's shards are mostly empty and the bucket engine
+// spills every repeat to disk.
+package roaring
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/pipeline"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Options configures a RoaringCounter.
+type Options struct {
+	Parse      utils.ParseOptions // accepted address forms
+	MaxLine    int                // longest line accepted, 0 for utils.DefaultMaxLine
+	Workers    int                // goroutines parsing the input, 0 for runtime.NumCPU()
+	ChunkSize  int                // bytes handed to a worker at a time, 0 for pipeline.DefaultChunkSize
+	QueueDepth int                // read chunks waiting for a worker, 0 for two per worker
+
+	// MaxMem caps the memory of a count, 0 for no cap. Overhead comes
+	// out of it first, and a count fails with counter.ErrMemBudget at
+	// once if that leaves nothing, or as soon as the containers outgrow
+	// the rest.
+	MaxMem int64
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives the container tally, nil to discard
+	Logger   *slog.Logger      // receives the first few lines that fail to parse, nil for slog.Default()
+}
+
+// Validate reports whether o can build a RoaringCounter.
+func (o Options) Validate() error {
+	if o.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", o.Workers)
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("roaring", func(o counter.Options) (counter.Counter, error) {
+		opts := Options{
+			Parse:      o.Parse,
+			MaxLine:    o.MaxLine,
+			Workers:    o.Workers,
+			ChunkSize:  o.ChunkSize,
+			QueueDepth: o.QueueDepth,
+			MaxMem:     o.MaxMem,
+			Progress:   o.Progress,
+			Stats:      o.Stats,
+			Logger:     o.Logger,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("roaring: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// RoaringCounter counts distinct IPv4s into a roaring Set. Workers parse
+// chunks concurrently, each keeping the addresses of its chunk and adding
+// them sorted once the chunk is parsed, so a container's lock is taken
+// once a chunk rather than once an address. A counter runs one count at a
+// time.
+type RoaringCounter struct {
+	opts Options
+	set  *Set
+}
+
+// New creates a RoaringCounter with the default options.
+func New() *RoaringCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a RoaringCounter with the given options. It
+// panics if opts fail Validate.
+func NewWithOptions(opts Options) *RoaringCounter {
+	if err := opts.Validate(); err != nil {
+		panic("roaring: " + err.Error())
+	}
+	return &RoaringCounter{opts: opts}
+}
+
+// CountUniqueIPs returns the number of distinct IPv4s in a file.
+func (c *RoaringCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation.
+func (c *RoaringCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	n, err := c.CountReader(ctx, file)
+	if err != nil && ctx.Err() == nil {
+		return 0, counter.WrapRead(filename, err)
+	}
+	return n, err
+}
+
+// Overhead returns the memory a count with opts takes besides the
+// containers: the container slots and their locks, the read chunks
+// queued or being parsed, and the addresses each worker keeps of its
+// chunk, 4 bytes for every line of at least 8.
+func Overhead(opts Options) int64 {
+	workers := cmp.Or(opts.Workers, runtime.NumCPU())
+	queued := cmp.Or(opts.QueueDepth, 2*workers)
+	chunk := int64(cmp.Or(opts.ChunkSize, pipeline.DefaultChunkSize))
+	return 1<<16*8 + lockStripes*64 + int64(queued+workers)*chunk + int64(workers)*chunk/2
+}
+
+// CountReader counts distinct IPv4s read from r into a new set.
+func (c *RoaringCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	overhead := Overhead(c.opts)
+	if m := c.opts.MaxMem; m > 0 && overhead >= m {
+		return 0, fmt.Errorf("%w: the roaring engine's slots and read buffers need %s, budget is %s; lower -workers or -chunk-size",
+			counter.ErrMemBudget, counter.FormatBytes(overhead), counter.FormatBytes(m))
+	}
+	set := NewSet()
+	c.set = set
+	over := func() bool { return c.opts.MaxMem > 0 && overhead+set.Bytes() > c.opts.MaxMem }
+	res, err := pipeline.Run(ctx, c.opts.Progress.Reader(r), sink{set}, pipeline.Options{
+		Parse:      c.opts.Parse,
+		MaxLine:    c.opts.MaxLine,
+		Skips:      counter.NewSkipLog(counter.Logger(c.opts.Logger)),
+		Workers:    c.opts.Workers,
+		ChunkSize:  c.opts.ChunkSize,
+		QueueDepth: c.opts.QueueDepth,
+		Progress:   c.opts.Progress,
+		Stop:       over,
+	})
+	c.opts.Stats.Set("oversized lines", "%d", res.Oversized)
+	if err != nil {
+		return 0, err
+	}
+	if over() {
+		return 0, fmt.Errorf("%w: roaring set grew to %s, over the %s left of the %s budget; use the bucket engine",
+			counter.ErrMemBudget, counter.FormatBytes(set.Bytes()), counter.FormatBytes(c.opts.MaxMem-overhead), counter.FormatBytes(c.opts.MaxMem))
+	}
+	arrays, bitmaps := set.Containers()
+	c.opts.Stats.Set("roaring containers", "%d arrays, %d bitmaps, %s", arrays, bitmaps, counter.FormatBytes(set.Bytes()))
+	return set.Count(), nil
+}
+
+// Set returns the set of the last count, nil before the first.
+func (c *RoaringCounter) Set() *Set {
+	return c.set
+}
+
+// sink is the pipeline sink of a count: the set, which workers add to a
+// chunk at a time.
+type sink struct {
+	set *Set
+}
+
+func (s sink) Add(ip uint32) bool {
+	return s.set.Add(ip)
+}
+
+func (s sink) Worker(int) pipeline.Worker {
+	return &worker{set: s.set}
+}
+
+// worker keeps the addresses of the chunk it is parsing.
+type worker struct {
+	set  *Set
+	ips  []uint32
+	lows []uint16
+}
+
+// Add keeps ip for ChunkDone and reports it as new, the count being the
+// set's rather than the sum of what workers report.
+func (w *worker) Add(ip uint32) bool {
+	w.ips = append(w.ips, ip)
+	return true
+}
+
+// AddRange adds the block of a CIDR line at once.
+func (w *worker) AddRange(first, last uint32) int64 {
+	return w.set.AddRange(first, last)
+}
+
+// ChunkDone adds the chunk's addresses to the set in ascending order.
+func (w *worker) ChunkDone([]byte, int64) error {
+	slices.Sort(w.ips)
+	_, w.lows = w.set.AddSorted(w.ips, w.lows)
+	w.ips = w.ips[:0]
+	return nil
+}
@@ -0,0 +1,122 @@
+package roaring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Addresses added one at a time, in sorted batches and as ranges, from
+// several goroutines, give the set of a map, through containers that stay
+// arrays and ones that turn into bitmaps.
+func TestSet(t *testing.T) {
+	rng := rand.New(rand.NewPCG(41, 42))
+	s := NewSet()
+	want := make(map[uint32]bool)
+	var batches [][]uint32
+	for g := range 4 {
+		var batch []uint32
+		for range 20000 {
+			var ip uint32
+			switch rng.IntN(3) {
+			case 0:
+				ip = rng.Uint32() // a sparse container
+			case 1:
+				ip = 10<<24 | uint32(g)<<16 | rng.Uint32N(1<<16) // past arrayMax
+			default:
+				ip = 172<<24 | 16<<16 | rng.Uint32N(3000) // shared, and stays an array
+			}
+			batch = append(batch, ip, ip)
+			want[ip] = true
+		}
+		batches = append(batches, batch)
+	}
+	ranges := [][2]uint32{{192<<24 | 168<<16 | 0xfff0, 192<<24 | 169<<16 | 0x20}, {10 << 24, 10<<24 | 0xff}}
+	for _, r := range ranges {
+		for ip := r[0]; ip <= r[1]; ip++ {
+			want[ip] = true
+		}
+	}
+
+	var added int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for g, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int64
+			if g%2 == 0 {
+				slices.Sort(batch)
+				n, _ = s.AddSorted(batch, nil)
+			} else {
+				for _, ip := range batch {
+					if s.Add(ip) {
+						n++
+					}
+				}
+			}
+			n += s.AddRange(ranges[g%2][0], ranges[g%2][1])
+			mu.Lock()
+			added += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if got := s.Count(); got != int64(len(want)) || added != got {
+		t.Errorf("count %d, %d reported new, want %d", got, added, len(want))
+	}
+	for ip := range want {
+		if !s.Contains(ip) {
+			t.Fatalf("%s missing", utils.FormatIPv4(ip))
+		}
+	}
+	for range 1000 {
+		if ip := rng.Uint32(); s.Contains(ip) != want[ip] {
+			t.Fatalf("%s: contains %v", utils.FormatIPv4(ip), !want[ip])
+		}
+	}
+	if arrays, bitmaps := s.Containers(); bitmaps != 4 || arrays < 1000 {
+		t.Errorf("%d arrays, %d bitmaps", arrays, bitmaps)
+	}
+	var each []uint32
+	s.Each(func(ip uint32) { each = append(each, ip) })
+	if len(each) != len(want) || !slices.IsSorted(each) {
+		t.Errorf("Each gave %d addresses, sorted %v; want %d ascending", len(each), slices.IsSorted(each), len(want))
+	}
+}
+
+// A count is exact, repeats and CIDR lines included, and one whose set
+// outgrows what Overhead leaves of MaxMem fails with counter.ErrMemBudget.
+func TestCountReader(t *testing.T) {
+	var b strings.Builder
+	for i := range 50000 {
+		ip := uint32(i) * 2654435761
+		fmt.Fprintf(&b, "%s\n%s\nbad\n", utils.FormatIPv4(ip), utils.FormatIPv4(ip))
+	}
+	b.WriteString("10.1.2.0/24\n")
+	opts := Options{Parse: utils.ParseOptions{CIDR: true}, ChunkSize: 64 << 10, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	n, err := NewWithOptions(opts).CountReader(context.Background(), strings.NewReader(b.String()))
+	if want := int64(50000 + 256); err != nil || n != want {
+		t.Errorf("%d, %v, want %d", n, err, want)
+	}
+	opts.MaxMem = Overhead(opts) + 64<<10
+	if _, err := NewWithOptions(opts).CountReader(context.Background(), strings.NewReader(b.String())); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("over budget: %v", err)
+	}
+	opts.MaxMem = Overhead(opts)
+	if _, err := NewWithOptions(opts).CountReader(context.Background(), strings.NewReader("10.0.0.1\n")); !errors.Is(err, counter.ErrMemBudget) {
+		t.Errorf("a budget that only holds the read buffers: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package roaring
+
+import (
+	"math/bits"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// arrayMax is the most addresses a container keeps as a sorted array
+	// of low halves, 2 bytes each; one more and its 8 KB bitmap is smaller.
+	arrayMax = 4096
+
+	bitmapWords = 1 << 16 / 64
+	bitmapBytes = bitmapWords * 8
+
+	// lockStripes is the number of mutexes the containers share, container
+	// h taking lock h%lockStripes, so workers adding to different /16s
+	// seldom wait on each other.
+	lockStripes = 1024
+)
+
+// Set is a set of IPv4 addresses kept as a roaring bitmap: one container
+// per /16 holding any of them, found by the address's top 16 bits, that
+// keeps the low 16 bits as a sorted array while it holds up to arrayMax
+// and as a 64 Kbit bitmap beyond. Memory follows what the set holds, 2
+// bytes an address for sparse blocks and at most 8 KB per /16, plus 512
+// KB of container slots, instead of the concurrent engine's shards sized
+// by the space they cover. It is safe for concurrent use; the zero value
+// is not, use NewSet.
+type Set struct {
+	containers [1 << 16]*container // container h guarded by locks[h%lockStripes]
+	locks      []stripe
+	n          atomic.Int64 // addresses held
+	bytes      atomic.Int64 // held by the containers
+}
+
+// stripe is a mutex alone on its cache line.
+type stripe struct {
+	sync.Mutex
+	_ [56]byte
+}
+
+// container holds the low halves of the addresses of one /16: array
+// sorted and without repeats until bitmap replaces it.
+type container struct {
+	array  []uint16
+	bitmap *[bitmapWords]uint64
+}
+
+// NewSet returns an empty Set.
+func NewSet() *Set {
+	return &Set{locks: make([]stripe, lockStripes)}
+}
+
+// Add adds ip and reports whether it was new.
+func (s *Set) Add(ip uint32) bool {
+	h := ip >> 16
+	l := &s.locks[h%lockStripes]
+	l.Lock()
+	c := s.container(h)
+	size := c.size()
+	if !c.add(uint16(ip)) {
+		l.Unlock()
+		return false
+	}
+	s.note(c, size, 1)
+	l.Unlock()
+	return true
+}
+
+// AddRange adds every address from first to last and returns how many
+// were new.
+func (s *Set) AddRange(first, last uint32) int64 {
+	var lows []uint16
+	var added int64
+	for h := first >> 16; ; h++ {
+		lo, hi := uint32(0), uint32(0xffff)
+		if h == first>>16 {
+			lo = first & 0xffff
+		}
+		if h == last>>16 {
+			hi = last & 0xffff
+		}
+		lows = lows[:0]
+		for v := lo; v <= hi; v++ {
+			lows = append(lows, uint16(v))
+		}
+		added += s.addSorted(h, lows)
+		if h == last>>16 {
+			return added
+		}
+	}
+}
+
+// AddSorted adds ips, ascending with repeats allowed, taking each
+// container's lock once for all of its addresses, and returns how many
+// were new. lows is scratch space, returned grown for the next call.
+func (s *Set) AddSorted(ips []uint32, lows []uint16) (int64, []uint16) {
+	var added int64
+	for len(ips) > 0 {
+		h := ips[0] >> 16
+		lows = lows[:0]
+		i := 0
+		for ; i < len(ips) && ips[i]>>16 == h; i++ {
+			lows = append(lows, uint16(ips[i]))
+		}
+		added += s.addSorted(h, lows)
+		ips = ips[i:]
+	}
+	return added, lows
+}
+
+// addSorted adds the ascending low halves lows to container h.
+func (s *Set) addSorted(h uint32, lows []uint16) int64 {
+	l := &s.locks[h%lockStripes]
+	l.Lock()
+	defer l.Unlock()
+	c := s.container(h)
+	size := c.size()
+	added := int64(c.addSorted(lows))
+	s.note(c, size, added)
+	return added
+}
+
+// container returns container h, creating it empty. The caller holds its
+// lock.
+func (s *Set) container(h uint32) *container {
+	c := s.containers[h]
+	if c == nil {
+		c = &container{}
+		s.containers[h] = c
+	}
+	return c
+}
+
+// note adds what c, which took size bytes before, gained to the totals.
+func (s *Set) note(c *container, size, added int64) {
+	if added != 0 {
+		s.n.Add(added)
+	}
+	if grown := c.size() - size; grown != 0 {
+		s.bytes.Add(grown)
+	}
+}
+
+// Count returns the number of addresses in the set.
+func (s *Set) Count() int64 {
+	return s.n.Load()
+}
+
+// Bytes returns the memory the containers hold, not counting the fixed
+// container slots.
+func (s *Set) Bytes() int64 {
+	return s.bytes.Load()
+}
+
+// Contains reports whether ip is in the set.
+func (s *Set) Contains(ip uint32) bool {
+	h := ip >> 16
+	l := &s.locks[h%lockStripes]
+	l.Lock()
+	defer l.Unlock()
+	c := s.containers[h]
+	return c != nil && c.contains(uint16(ip))
+}
+
+// Each calls fn with every address of the set in ascending order. It must
+// not be called while addresses are being added.
+func (s *Set) Each(fn func(ip uint32)) {
+	for h, c := range s.containers {
+		if c == nil {
+			continue
+		}
+		high := uint32(h) << 16
+		if c.bitmap == nil {
+			for _, lo := range c.array {
+				fn(high | uint32(lo))
+			}
+			continue
+		}
+		for i, word := range c.bitmap {
+			for ; word != 0; word &= word - 1 {
+				fn(high | uint32(i*64+bits.TrailingZeros64(word)))
+			}
+		}
+	}
+}
+
+// Containers returns how many containers are arrays and how many are
+// bitmaps. It must not be called while addresses are being added.
+func (s *Set) Containers() (arrays, bitmaps int) {
+	for _, c := range s.containers {
+		switch {
+		case c == nil:
+		case c.bitmap != nil:
+			bitmaps++
+		default:
+			arrays++
+		}
+	}
+	return arrays, bitmaps
+}
+
+// size returns the bytes c's addresses take up.
+func (c *container) size() int64 {
+	if c.bitmap != nil {
+		return bitmapBytes
+	}
+	return int64(cap(c.array)) * 2
+}
+
+func (c *container) contains(lo uint16) bool {
+	if c.bitmap != nil {
+		return c.bitmap[lo/64]&(1<<(lo%64)) != 0
+	}
+	_, found := slices.BinarySearch(c.array, lo)
+	return found
+}
+
+// add adds lo and reports whether it was new.
+func (c *container) add(lo uint16) bool {
+	if c.bitmap == nil {
+		i, found := slices.BinarySearch(c.array, lo)
+		if found {
+			return false
+		}
+		if len(c.array) < arrayMax {
+			c.array = slices.Insert(c.array, i, lo)
+			return true
+		}
+		c.toBitmap()
+	}
+	w, mask := &c.bitmap[lo/64], uint64(1)<<(lo%64)
+	if *w&mask != 0 {
+		return false
+	}
+	*w |= mask
+	return true
+}
+
+// addSorted adds the ascending low halves lows and returns how many were
+// new. Into an array they are merged from the back, in place once it has
+// grown, so a chunk adding a few addresses to a block costs one pass
+// over it rather than one insertion each.
+func (c *container) addSorted(lows []uint16) int {
+	if c.bitmap == nil {
+		// Keep the ones not already held, once each
+		fresh := lows[:0]
+		j := 0
+		for _, lo := range lows {
+			if len(fresh) > 0 && fresh[len(fresh)-1] == lo {
+				continue
+			}
+			for j < len(c.array) && c.array[j] < lo {
+				j++
+			}
+			if j < len(c.array) && c.array[j] == lo {
+				continue
+			}
+			fresh = append(fresh, lo)
+		}
+		if len(fresh) == 0 {
+			return 0
+		}
+		if len(c.array)+len(fresh) <= arrayMax {
+			old := len(c.array)
+			c.array = slices.Grow(c.array, len(fresh))[:old+len(fresh)]
+			i, j := old-1, len(fresh)-1
+			for k := len(c.array) - 1; j >= 0; k-- {
+				if i >= 0 && c.array[i] > fresh[j] {
+					c.array[k] = c.array[i]
+					i--
+				} else {
+					c.array[k] = fresh[j]
+					j--
+				}
+			}
+			return len(fresh)
+		}
+		c.toBitmap()
+		lows = fresh
+	}
+	added := 0
+	for _, lo := range lows {
+		w, mask := &c.bitmap[lo/64], uint64(1)<<(lo%64)
+		added += int(^*w & mask >> (lo % 64))
+		*w |= mask
+	}
+	return added
+}
+
+// toBitmap turns c's array into a bitmap.
+func (c *container) toBitmap() {
+	c.bitmap = new([bitmapWords]uint64)
+	for _, lo := range c.array {
+		c.bitmap[lo/64] |= 1 << (lo % 64)
+	}
+	c.array = nil
+}
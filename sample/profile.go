@@ -0,0 +1,139 @@
+package sample
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// Profile is what a sample says about the shape of an input, for judging
+// what counting all of it will take before committing to the run.
+type Profile struct {
+	Result
+	HeadOnly bool // the input cannot be read at random offsets, so only its head was sampled
+	Complete bool // the sample is the whole input and its figures are exact
+}
+
+// Profile samples filename for its shape: its head, where a format
+// problem shows first, and random blocks of the rest, about budget bytes
+// in all; Options.Fraction is not used. An input that is not a regular
+// file would have to be spooled in full to be read at random, so only its
+// first budget bytes are sampled; size is then its expected length, or -1
+// when unknown, and a profile of unknown size projects nothing.
+func (c *SampleCounter) Profile(ctx context.Context, filename string, budget, size int64) (Profile, error) {
+	n, err := counter.InputSize(filename)
+	if err != nil {
+		return Profile{}, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return Profile{}, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	block := int64(c.opts.Block)
+
+	if n >= 0 {
+		offsets := pickBlocks(n, block, min(1, float64(budget)/float64(max(n, 1))), c.opts.Seed)
+		if n > 0 && (len(offsets) == 0 || offsets[0] != 0) {
+			offsets = append([]int64{0}, offsets...)
+		}
+		r, err := c.sample(ctx, file, filename, n, offsets)
+		if err != nil {
+			return Profile{}, err
+		}
+		return Profile{Result: r, Complete: r.Sampled == n}, nil
+	}
+
+	head := make([]byte, budget)
+	m, err := io.ReadFull(&ctxReader{ctx: ctx, r: file}, head)
+	complete := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	if err != nil && !complete {
+		if ctx.Err() != nil {
+			return Profile{}, ctx.Err()
+		}
+		return Profile{}, &counter.ReadError{Path: filename, Offset: int64(m), Err: err}
+	}
+	head = head[:m]
+	if !complete {
+		// The last line may go on past the head
+		head = head[:bytes.LastIndexByte(head, c.opts.Parse.Delim())+1]
+	}
+	hn := int64(len(head))
+	r, err := c.sample(ctx, bytes.NewReader(head), filename, hn, pickBlocks(hn, block, 1, c.opts.Seed))
+	if err != nil {
+		return Profile{}, err
+	}
+	p := Profile{Result: r, HeadOnly: true, Complete: complete}
+	if !complete {
+		p.FileSize = size
+		p.Estimate, p.Low, p.High, p.ExpectedSingletons = 0, 0, 0, 0
+		if size > 0 {
+			p.FileSize = max(size, hn)
+			p.extrapolate()
+		}
+	}
+	return p, nil
+}
+
+// LineBytes returns the mean length of the sampled lines with their
+// delimiters, 0 for an empty sample.
+func (p Profile) LineBytes() float64 {
+	if p.Read == 0 {
+		return 0
+	}
+	return float64(p.Sampled) / float64(p.Read)
+}
+
+// ValidRate returns the share of the sampled lines holding an address.
+func (p Profile) ValidRate() float64 {
+	if p.Read == 0 {
+		return 0
+	}
+	return float64(p.Parsed) / float64(p.Read)
+}
+
+// ParseRate returns the bytes a worker parsed per second in the sample,
+// 0 when too little was parsed to time.
+func (p Profile) ParseRate() float64 {
+	if p.ParseTime <= 0 {
+		return 0
+	}
+	return float64(p.Sampled) / p.ParseTime.Seconds()
+}
+
+// Projection scales the sample to the whole input, or returns it as is
+// when it is the whole input. A profile of unknown size projects nothing.
+func (p Profile) Projection() counter.Projection {
+	if p.Complete {
+		return counter.Projection{Size: p.Sampled, Addresses: p.Lines, Distinct: p.Distinct, Shards: p.Shards}
+	}
+	if p.FileSize <= 0 || p.Sampled == 0 {
+		return counter.Projection{Size: max(p.FileSize, 0)}
+	}
+	q := float64(p.Sampled) / float64(p.FileSize)
+	distinct := int64(math.Round(p.Estimate))
+	return counter.Projection{
+		Size:      p.FileSize,
+		Addresses: int64(math.Round(float64(p.Lines) / q)),
+		Distinct:  distinct,
+		Shards:    counter.ProjectShards(distinct, p.Distinct, p.Shards),
+	}
+}
+
+// ctxReader stops a read once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,76 @@
+package sample
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// A profile of random blocks projects the file's lines, distinct
+// addresses and shards close to the truth, one that reads the whole file
+// is exact, and the worst case it is shown next to is the one auto
+// decides on.
+func TestProfile(t *testing.T) {
+	const lines, distinct = 400000, 50000
+	// Every address repeats equally often, as the extrapolation assumes
+	rng := rand.New(rand.NewPCG(3, 4))
+	ips := make([]uint32, lines)
+	for i := range distinct {
+		ip := rng.Uint32()
+		for j := range lines / distinct {
+			ips[j*distinct+i] = ip
+		}
+	}
+	rng.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	var b strings.Builder
+	seen, shards := make(map[uint32]bool), make(map[int]bool)
+	for i, ip := range ips {
+		seen[ip], shards[counter.BitsetShard(ip)] = true, true
+		if i%100 == 0 {
+			b.WriteString("junk\n")
+		}
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	near := func(got, want int64) bool { return math.Abs(float64(got-want)) <= 0.05*float64(want) }
+
+	c := NewWithOptions(Options{Block: 4096, Seed: 7})
+	p, err := c.Profile(context.Background(), path, int64(b.Len()/10), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj := p.Projection()
+	if p.Complete || p.HeadOnly || !near(proj.Addresses, lines) || !near(proj.Distinct, int64(len(seen))) || !near(proj.Shards, int64(len(shards))) {
+		t.Errorf("10%% sample: %+v projects %+v, want about %d addresses, %d distinct in %d shards",
+			p.Result, proj, lines, len(seen), len(shards))
+	}
+	if r := p.ValidRate(); math.Abs(r-100.0/101) > 0.005 {
+		t.Errorf("valid rate %.4f, want about %.4f", r, 100.0/101)
+	}
+
+	p, err = c.Profile(context.Background(), path, int64(b.Len()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := counter.Projection{Size: int64(b.Len()), Addresses: lines, Distinct: int64(len(seen)), Shards: int64(len(shards))}
+	if got := p.Projection(); !p.Complete || got != want || p.Read != lines+lines/100 {
+		t.Errorf("whole file: %+v, %d lines read; want %+v", got, p.Read, want)
+	}
+
+	worst := counter.WorstCase(int64(b.Len()))
+	sel := counter.SelectBudget(int64(b.Len()), 0, 16<<20)
+	if !strings.Contains(sel.Reason, counter.FormatBytes(worst.BitsetMem())) {
+		t.Errorf("auto decided on %q, not the worst-case bitset %s", sel.Reason, counter.FormatBytes(worst.BitsetMem()))
+	}
+}
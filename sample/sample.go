@@ -0,0 +1,452 @@
+// Package sample gives a quick estimate of the number of unique IPv4
+// addresses in a huge file by reading only a random subset of it. Random
+// fixed-size blocks are read, aligned to whole lines, and the distinct
+// addresses among the sampled lines are counted exactly; the total is then
+// extrapolated with an occupancy ("birthday") model that assumes every
+// address is repeated about equally often. Skewed inputs break that
+// assumption, so the duplicate ratio and singleton counts of the sample are
+// reported alongside the estimate.
+package sample
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	DefaultFraction = 0.01      // share of the file read
+	DefaultBlock    = 64 * 1024 // bytes per sampled block
+
+	z95 = 1.959964 // two-sided 95% normal quantile
+
+	// skewTolerance is how far the sample's singleton count may stray from
+	// the model's expectation before the estimate is flagged as unreliable.
+	skewTolerance = 0.25
+)
+
+// utf8BOM is skipped at the start of the file, as the streaming readers do.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Options configures a SampleCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+
+	// Fraction is the share of the file's bytes to read, in (0, 1]; 0
+	// means DefaultFraction. Together with the file size it sets the byte
+	// budget.
+	Fraction float64
+
+	// Block is the size of each randomly placed read, 0 for DefaultBlock.
+	// Smaller blocks sample more independently when lines are clustered
+	// by address, at the cost of more seeks.
+	Block int
+
+	// Seed seeds the block choice; equal seeds read the same blocks.
+	Seed int64
+
+	// TempDir holds the copy of a pipe, which cannot be read at random
+	// offsets, "" for os.TempDir.
+	TempDir string
+
+	Stats  *counter.Stats // receives the sample summary, nil to discard
+	Logger *slog.Logger   // receives the skew warning and spool notices, nil for slog.Default()
+}
+
+// Validate reports whether o can build a SampleCounter.
+func (o Options) Validate() error {
+	if o.Fraction < 0 || o.Fraction > 1 || math.IsNaN(o.Fraction) {
+		return fmt.Errorf("sample fraction must be in (0, 1], got %g", o.Fraction)
+	}
+	if o.Block < 0 {
+		return fmt.Errorf("sample block must be positive, got %d", o.Block)
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("sample", func(o counter.Options) (counter.Counter, error) {
+		opts := Options{
+			Parse:    o.Parse,
+			MaxLine:  o.MaxLine,
+			Fraction: o.SampleFraction,
+			Block:    o.SampleBlock,
+			Seed:     o.Seed,
+			TempDir:  o.TempDir,
+			Stats:    o.Stats,
+			Logger:   o.Logger,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("sample: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// Result describes one sampling run.
+type Result struct {
+	FileSize int64
+	Sampled  int64 // bytes read, the blocks' total length
+	Blocks   int
+	Seed     int64
+
+	Lines      int64 // valid address lines in the sample
+	Distinct   int64 // distinct addresses among them
+	Singletons int64 // addresses seen exactly once in the sample
+	Read       int64 // lines read, blank and invalid ones included
+	Parsed     int64 // of them holding an address or block
+	Shards     int64 // default-size bitset shards the distinct addresses fall in
+
+	// ParseTime is the time spent parsing the sampled lines, summed over
+	// the workers.
+	ParseTime time.Duration
+
+	Estimate float64 // extrapolated distinct addresses in the file
+	Low      float64 // 95% confidence bounds under the model
+	High     float64
+
+	ExpectedSingletons float64 // singletons the model predicts for Estimate
+}
+
+// DupRatio returns the share of sampled lines that repeat an address
+// already in the sample, 0 for an empty sample.
+func (r Result) DupRatio() float64 {
+	if r.Lines == 0 {
+		return 0
+	}
+	return 1 - float64(r.Distinct)/float64(r.Lines)
+}
+
+// Skewed reports whether the sample's frequencies contradict the model's
+// equal-repetition assumption: heavy hitters leave fewer singletons than a
+// uniform input would, and the estimate then tends to be too low.
+func (r Result) Skewed() bool {
+	if r.Distinct == r.Lines || r.ExpectedSingletons == 0 {
+		return false
+	}
+	return math.Abs(float64(r.Singletons)-r.ExpectedSingletons) > skewTolerance*r.ExpectedSingletons
+}
+
+// String reports the estimate, its interval and the assumptions behind it.
+func (r Result) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "sampled %s of %s (%.3g%%) in %d blocks, seed %d\n",
+		counter.FormatBytes(r.Sampled), counter.FormatBytes(r.FileSize),
+		100*float64(r.Sampled)/float64(max(r.FileSize, 1)), r.Blocks, r.Seed)
+	fmt.Fprintf(&sb, "sample: %d lines, %d distinct, duplicate ratio %.3f, %d singletons (%.0f expected)\n",
+		r.Lines, r.Distinct, r.DupRatio(), r.Singletons, r.ExpectedSingletons)
+	fmt.Fprintf(&sb, "estimate: ~%.0f, 95%% interval [%.0f, %.0f]\n", r.Estimate, r.Low, r.High)
+	if r.Skewed() {
+		sb.WriteString("skewed: the singleton count is far from what equal repetition predicts;\n")
+		sb.WriteString("        the interval covers sampling noise only and the true count is likely higher\n")
+	}
+	sb.WriteString("assumes: sampled blocks are representative (lines not ordered by address),\n")
+	sb.WriteString("         every address repeats about equally often; heavy skew makes the estimate too low")
+	return sb.String()
+}
+
+// SampleCounter estimates unique IPs from a random sample of a file. It
+// implements counter.Estimator.
+type SampleCounter struct {
+	opts   Options
+	result Result
+}
+
+// New creates a SampleCounter reading DefaultFraction of the file.
+func New() *SampleCounter {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a SampleCounter with the given options. It panics
+// if opts fail Validate.
+func NewWithOptions(opts Options) *SampleCounter {
+	if err := opts.Validate(); err != nil {
+		panic("sample: " + err.Error())
+	}
+	opts.Fraction = cmp.Or(opts.Fraction, DefaultFraction)
+	opts.Block = cmp.Or(opts.Block, DefaultBlock)
+	return &SampleCounter{opts: opts}
+}
+
+// CountUniqueIPs returns the estimated number of distinct IPv4s in a file.
+func (c *SampleCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation. Inputs that
+// are not regular files are copied to Options.TempDir first, so sampling
+// a pipe saves no reading.
+func (c *SampleCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	c.result = Result{}
+	filename, cleanup, err := counter.Spool(ctx, filename, c.opts.TempDir, c.opts.Logger)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+
+	r, err := c.sample(ctx, file, file.Name(), st.Size(), pickBlocks(st.Size(), int64(c.opts.Block), c.opts.Fraction, c.opts.Seed))
+	if err != nil {
+		return 0, err
+	}
+	c.result = r
+	c.opts.Stats.Set("sample", "%d of %d bytes in %d blocks, duplicate ratio %.3f",
+		r.Sampled, r.FileSize, r.Blocks, r.DupRatio())
+	if r.Skewed() {
+		counter.Logger(c.opts.Logger).Warn("input looks skewed and the estimate is unreliable",
+			"singletons", r.Singletons, "expected", int64(r.ExpectedSingletons))
+	}
+	return int64(math.Round(r.Estimate)), nil
+}
+
+// Result returns the outcome of the last successful run.
+func (c *SampleCounter) Result() Result {
+	return c.result
+}
+
+// StdError returns the standard error implied by the last run's 95%
+// interval.
+func (c *SampleCounter) StdError() float64 {
+	return (c.result.High - c.result.Low) / (2 * z95)
+}
+
+// sample reads the blocks at offsets of src, a size-byte input called
+// name, in parallel and extrapolates.
+func (c *SampleCounter) sample(ctx context.Context, src io.ReaderAt, name string, size int64, offsets []int64) (Result, error) {
+	block := int64(c.opts.Block)
+	r := Result{FileSize: size, Blocks: len(offsets), Seed: c.opts.Seed}
+	for _, off := range offsets {
+		r.Sampled += min(block, size-off)
+	}
+
+	// Workers collect the sampled addresses; sorting them afterwards gives
+	// exact distinct and singleton counts in 4 bytes per sampled line
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+	numWorkers := runtime.NumCPU()
+	ips := make([][]uint32, numWorkers)
+	var (
+		next      atomic.Int64
+		oversized atomic.Int64
+		read      atomic.Int64
+		parsed    atomic.Int64
+		parsing   atomic.Int64
+		errOnce   sync.Once
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	for w := range numWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, block+int64(maxLine)+2)
+			for ctx.Err() == nil {
+				i := int(next.Add(1) - 1)
+				if i >= len(offsets) {
+					return
+				}
+				var t tally
+				var err error
+				ips[w], t, err = c.readBlock(src, name, size, offsets[i], block, maxLine, buf, ips[w])
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+				oversized.Add(t.oversized)
+				read.Add(t.lines)
+				parsed.Add(t.parsed)
+				parsing.Add(int64(t.parsing))
+			}
+		}()
+	}
+	wg.Wait()
+	c.opts.Stats.Set("oversized lines", "%d", oversized.Load())
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if firstErr != nil {
+		return Result{}, firstErr
+	}
+
+	r.Read, r.Parsed, r.ParseTime = read.Load(), parsed.Load(), time.Duration(parsing.Load())
+	all := slices.Concat(ips...)
+	slices.Sort(all)
+	r.Lines = int64(len(all))
+	shards := make(map[int]struct{})
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j] == all[i] {
+			j++
+		}
+		r.Distinct++
+		if j-i == 1 {
+			r.Singletons++
+		}
+		shards[counter.BitsetShard(all[i])] = struct{}{}
+		i = j
+	}
+	r.Shards = int64(len(shards))
+	r.extrapolate()
+	return r, nil
+}
+
+// tally counts what readBlock did with a block's lines.
+type tally struct {
+	lines     int64         // lines starting in the block
+	parsed    int64         // of them holding an address or block
+	oversized int64         // of them skipped for running past maxLine
+	parsing   time.Duration // spent trimming and parsing them
+}
+
+// readBlock appends the addresses of the lines starting in
+// [off, off+block) of src to ips and returns it with a tally of the
+// lines. A line belongs to the block holding its first byte, so adjacent
+// blocks never sample a line twice.
+func (c *SampleCounter) readBlock(src io.ReaderAt, name string, size, off, block int64, maxLine int, buf []byte, ips []uint32) (_ []uint32, t tally, _ error) {
+	start := max(off-1, 0) // one byte early tells whether off starts a line
+	end := min(size, off+block+int64(maxLine)+1)
+	data := buf[:end-start]
+	if _, err := src.ReadAt(data, start); err != nil && err != io.EOF {
+		return ips, t, &counter.ReadError{Path: name, Offset: start, Err: err}
+	}
+	limit := off + block - start // lines must start before this index
+	delim := c.opts.Parse.Delim()
+	pos := int64(0)
+	if off == 0 {
+		if bytes.HasPrefix(data, utf8BOM) {
+			pos = int64(len(utf8BOM))
+		}
+	} else {
+		i := bytes.IndexByte(data, delim)
+		if i < 0 {
+			t.oversized = 1
+			return ips, t, nil
+		}
+		pos = int64(i) + 1
+	}
+
+	began := time.Now()
+	defer func() { t.parsing = time.Since(began) }()
+	for pos < limit && pos < int64(len(data)) {
+		raw := data[pos:]
+		i := bytes.IndexByte(raw, delim)
+		switch {
+		case i >= 0:
+			raw = raw[:i]
+		case end < size:
+			t.oversized++ // the line runs past maxLine
+			return ips, t, nil
+		}
+		pos += int64(len(raw)) + 1
+		t.lines++
+		if len(raw) > maxLine {
+			t.oversized++
+			continue
+		}
+		line := c.opts.Parse.Trim(raw)
+		if len(line) == 0 {
+			continue
+		}
+		first, last, err := c.opts.Parse.ParseBlock(line)
+		if err != nil {
+			continue
+		}
+		t.parsed++
+		for ip := first; ; ip++ {
+			ips = append(ips, ip)
+			if ip == last {
+				break
+			}
+		}
+	}
+	return ips, t, nil
+}
+
+// pickBlocks returns the ascending offsets of the random distinct blocks
+// that cover about fraction of a size-byte file.
+func pickBlocks(size, block int64, fraction float64, seed int64) []int64 {
+	slots := (size + block - 1) / block
+	want := min(slots, int64(math.Ceil(fraction*float64(size)/float64(block))))
+	// Floyd's algorithm: want distinct slots in O(want) memory
+	rng := rand.New(rand.NewSource(seed))
+	chosen := make(map[int64]struct{}, want)
+	for j := slots - want; j < slots; j++ {
+		t := rng.Int63n(j + 1)
+		if _, dup := chosen[t]; dup {
+			t = j
+		}
+		chosen[t] = struct{}{}
+	}
+	offsets := make([]int64, 0, want)
+	for s := range chosen {
+		offsets = append(offsets, s*block)
+	}
+	slices.Sort(offsets)
+	return offsets
+}
+
+// extrapolate fills in the estimate and its interval. With a fraction q of
+// the N lines sampled, an address repeated c = N/D times is missed by the
+// sample with probability (1-q)^c, so the sample is expected to hold
+// D·(1-(1-q)^c) distinct addresses. The estimate solves that for the
+// observed count; the interval maps the binomial spread of the observed
+// count through the same model.
+func (r *Result) extrapolate() {
+	if r.Sampled == 0 || r.Lines == 0 {
+		return
+	}
+	q := float64(r.Sampled) / float64(r.FileSize)
+	total := float64(r.Lines) / q // estimated valid lines in the file
+	d := float64(r.Distinct)
+	r.Estimate = solve(d, total, q)
+
+	c := total / r.Estimate
+	p := 1 - math.Pow(1-q, c)
+	sd := math.Sqrt(r.Estimate * p * (1 - p))
+	r.Low = solve(max(d-z95*sd, 0), total, q)
+	r.High = solve(d+z95*sd, total, q)
+	r.ExpectedSingletons = r.Estimate * c * q * math.Pow(1-q, c-1)
+}
+
+// solve returns the D in [d, total] whose expected sample distinct count
+// D·(1-(1-q)^(total/D)) is d. The expectation grows with D, so bisection
+// finds it; a d above the largest possible expectation gives total.
+func solve(d, total, q float64) float64 {
+	expected := func(D float64) float64 { return D * (1 - math.Pow(1-q, total/D)) }
+	lo, hi := d, total
+	if lo >= hi || expected(hi) <= d {
+		return max(hi, lo)
+	}
+	for range 100 {
+		mid := (lo + hi) / 2
+		if expected(mid) < d {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
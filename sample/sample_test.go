@@ -0,0 +1,106 @@
+package sample
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// The blocks cover the requested share of the file to within a block,
+// are distinct, aligned and inside it, and the seed alone decides them.
+func TestPickBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		size, block int64
+		fraction    float64
+	}{
+		{100 << 20, 64 << 10, 0.01},
+		{100 << 20, 4 << 10, 0.05},
+		{1 << 20, 64 << 10, 0.5},
+		{1<<20 + 17, 64 << 10, 1},
+		{1000, 64 << 10, 0.01},
+	} {
+		offsets := pickBlocks(tc.size, tc.block, tc.fraction, 42)
+		slots := (tc.size + tc.block - 1) / tc.block
+		want := min(slots, int64(math.Ceil(tc.fraction*float64(tc.size)/float64(tc.block))))
+		if int64(len(offsets)) != want {
+			t.Errorf("%+v: %d blocks, want %d", tc, len(offsets), want)
+		}
+		if covered := int64(len(offsets)) * tc.block; covered < int64(tc.fraction*float64(tc.size)) && covered < tc.size {
+			t.Errorf("%+v: blocks cover %d bytes", tc, covered)
+		}
+		for i, off := range offsets {
+			if off%tc.block != 0 || off >= tc.size || i > 0 && off <= offsets[i-1] {
+				t.Errorf("%+v: offset %d of %v", tc, off, offsets)
+				break
+			}
+		}
+		if again := pickBlocks(tc.size, tc.block, tc.fraction, 42); !slices.Equal(again, offsets) {
+			t.Errorf("%+v: the same seed picked other blocks", tc)
+		}
+		if other := pickBlocks(tc.size, tc.block, tc.fraction, 43); want < slots && slices.Equal(other, offsets) {
+			t.Errorf("%+v: another seed picked the same blocks", tc)
+		}
+	}
+}
+
+// On a file where every address repeats equally often, in random order,
+// the sample reads its share of the bytes and the estimate lands within a
+// few percent of the true count, inside its 95% interval and unflagged;
+// reading the whole file gives the exact count. Every seed tried does as
+// well.
+func TestSampleEstimate(t *testing.T) {
+	const lines, distinct = 1000000, 100000
+	rng := rand.New(rand.NewPCG(5, 6))
+	ips := make([]uint32, lines)
+	for i := range distinct {
+		ip := rng.Uint32()
+		for j := range lines / distinct {
+			ips[j*distinct+i] = ip
+		}
+	}
+	rng.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	var b strings.Builder
+	seen := map[uint32]bool{}
+	for _, ip := range ips {
+		seen[ip] = true
+		fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+	}
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := float64(len(seen))
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, fraction := range []float64{0.05, 0.2} {
+		for seed := range int64(3) {
+			c := NewWithOptions(Options{Fraction: fraction, Block: 4096, Seed: seed, Logger: discard})
+			n, err := c.CountUniqueIPs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := c.Result()
+			if rate := float64(r.Sampled) / float64(r.FileSize); math.Abs(rate-fraction) > 4096/float64(r.FileSize) {
+				t.Errorf("fraction %g, seed %d: read %.4f of the file", fraction, seed, rate)
+			}
+			if math.Abs(float64(n)-want) > 0.05*want || want < r.Low || want > r.High || r.Skewed() {
+				t.Errorf("fraction %g, seed %d: %d in [%.0f, %.0f], skewed %v; want %.0f",
+					fraction, seed, n, r.Low, r.High, r.Skewed(), want)
+			}
+		}
+	}
+
+	c := NewWithOptions(Options{Fraction: 1, Logger: discard})
+	if n, err := c.CountUniqueIPs(path); err != nil || float64(n) != want || c.Result().Sampled != int64(b.Len()) {
+		t.Errorf("whole file: %d, %v, %d bytes read; want %.0f", n, err, c.Result().Sampled, want)
+	}
+}
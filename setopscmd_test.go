@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+)
+
+// Two logs, or a log and a snapshot, compare to the overlap and the
+// differences of their sets, repeats counted once, across shards either
+// side leaves empty.
+func TestCompareSets(t *testing.T) {
+	dir := t.TempDir()
+	var a, b strings.Builder
+	for ip := uint32(0); ip < 3000; ip++ {
+		fmt.Fprintf(&a, "10.0.%d.%d\n", ip>>8, ip&0xff)
+		if ip%3 == 0 {
+			fmt.Fprintf(&b, "10.0.%d.%d\n10.0.%d.%d\n", ip>>8, ip&0xff, ip>>8, ip&0xff)
+		}
+	}
+	for ip := uint32(0); ip < 500; ip++ {
+		fmt.Fprintf(&b, "192.168.%d.%d\n", ip>>8, ip&0xff)
+	}
+	pathA, pathB := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")
+	if err := os.WriteFile(pathA, []byte(a.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pathB, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	snapB := filepath.Join(dir, "b.bits")
+	set := concurrent.New()
+	if _, err := set.CountUniqueIPs(pathB); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.WriteSnapshotFile(snapB); err != nil {
+		t.Fatal(err)
+	}
+
+	want := setComparison{a: 3000, b: 1000 + 500, both: 1000}
+	for _, other := range []string{pathB, snapB} {
+		got, err := compareSets(context.Background(), pathA, other, counter.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("against %s: got %+v, want %+v", filepath.Base(other), got, want)
+		}
+	}
+	if savedSet(pathA) || !savedSet(snapB) {
+		t.Error("a log taken for a saved set or a snapshot for a log")
+	}
+}
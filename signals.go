@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted is the conventional status for a run stopped by SIGINT.
+const exitInterrupted = 130
+
+// interruptContext returns a context canceled by the first SIGINT or
+// SIGTERM, giving engines the chance to stop their workers and remove
+// their temp files. A second signal exits immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Fprintln(os.Stderr, "interrupted, cleaning up (interrupt again to force exit)")
+		cancel()
+		<-sigs
+		os.Exit(exitInterrupted)
+	}()
+	return ctx
+}
@@ -0,0 +1,82 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mainArgsEnv carries the command line main runs with in the child
+// process of a test, separated by unit separators.
+const mainArgsEnv = "IPCOUNTER_TEST_MAIN_ARGS"
+
+// runMainChild runs main with the arguments in mainArgsEnv, if set, and
+// does not return; main exits the process.
+func runMainChild() {
+	if args := os.Getenv(mainArgsEnv); args != "" {
+		os.Args = append([]string{"ipcounter"}, strings.Split(args, "\x1f")...)
+		main()
+		os.Exit(0)
+	}
+}
+
+// A SIGINT while the bucket engine is in pass 1 stops the count with
+// status 130 and leaves no bucket files behind in -tmpdir.
+func TestInterrupt(t *testing.T) {
+	runMainChild()
+	tmp := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInterrupt$")
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join([]string{"-impl", "bucket", "-tmpdir", tmp, "-"}, "\x1f"))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10000 {
+		fmt.Fprintf(stdin, "10.%d.%d.1\n", i>>8, i&0xff)
+	}
+
+	// Wait for pass 1 to make its bucket dir, then interrupt it
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if dirs, _ := filepath.Glob(filepath.Join(tmp, "ipbuckets-*")); len(dirs) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			cmd.Wait()
+			t.Fatalf("no bucket dir in %s after 10s\n%s", tmp, stderr.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("still running 10s after SIGINT\n%s", stderr.String())
+	}
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitInterrupted {
+		t.Errorf("exit %v, want status %d\n%s", err, exitInterrupted, stderr.String())
+	}
+	if left, _ := os.ReadDir(tmp); len(left) > 0 {
+		t.Errorf("%d entries left in -tmpdir, first %s", len(left), left[0].Name())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/kmv"
+)
+
+// runSketchMerge implements `ipcounter sketch-merge`: read sketches written
+// with -sketch-out, merge them into a sketch of the union of their inputs
+// and print its estimate.
+func runSketchMerge(args []string) error {
+	fs := flag.NewFlagSet("sketch-merge", flag.ExitOnError)
+	out := fs.String("o", "", "also write the merged sketch to this file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter sketch-merge [flags] <sketch>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	sketches := make([]*kmv.Sketch, fs.NArg())
+	smallest := 0
+	for i, path := range fs.Args() {
+		s, err := kmv.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sketches[i] = s
+		if s.K() < sketches[smallest].K() {
+			smallest = i
+		}
+	}
+	// The union is only as precise as the smallest sketch: merge into it
+	// so every kept value is one of the k smallest of the union
+	merged := sketches[smallest]
+	for i, s := range sketches {
+		if i != smallest {
+			merged.Merge(s)
+		}
+	}
+
+	est, se := merged.Estimate()
+	fmt.Printf("Unique IPv4 addresses (union of %d sketches): ~%.0f (± %.0f)\n", len(sketches), est, se)
+	if *out != "" {
+		return merged.WriteFile(*out, false)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sveta-1999/IPCounter/bucket"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// runSortDump implements `ipcounter sort-dump`: read a -dump-stream file,
+// its addresses in the order they were found and its flush points, with
+// the bucket engine, and write the addresses in ascending order as a text
+// -dump would, as pass 2 walks the buckets. Memory is the bucket engine's,
+// whatever the size of the dump.
+func runSortDump(args []string) error {
+	fs := flag.NewFlagSet("sort-dump", flag.ExitOnError)
+	out := fs.String("o", "", "write the sorted addresses to this file instead of replacing the dump")
+	tempDir := fs.String("temp-dir", "", "directory for the bucket files (default $TMPDIR)")
+	fsync := fs.Bool("fsync", false, "fsync the sorted file before renaming it into place")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter sort-dump [-o FILE] [flags] <dump>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+	ctx := interruptContext()
+	var n int64
+	err := counter.WriteFileAtomic(cmp.Or(*out, path), *fsync, func(w io.Writer) error {
+		var buf []byte
+		c := bucket.NewWithOptions(bucket.Options{
+			Parse:   utils.ParseOptions{CommentPrefix: "#"}, // the flush points
+			TempDir: *tempDir,
+			Sorted: func(ip uint32) error {
+				buf = append(utils.AppendIPv4(buf[:0], ip), '\n')
+				_, err := w.Write(buf)
+				return err
+			},
+		})
+		var err error
+		n, err = c.CountUniqueIPsContext(ctx, path)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("sort-dump: %w", err)
+	}
+	fmt.Printf("Unique IPv4 addresses: %d\n", n)
+	return nil
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"bytes"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Form flags the non-canonical ways a line wrote its address, as
+// ParseForm reports them; 0 is a plain address alone on its line.
+type Form uint8
+
+const (
+	FormSpace       Form = 1 << iota // leading or trailing whitespace
+	FormLeadingZero                  // an octet with leading zeros, read as decimal with Lenient
+	FormQuoted                       // surrounding quotes, removed with Relaxed
+	FormBracketed                    // surrounding brackets, removed with Relaxed
+	FormPort                         // a ":port" suffix, removed with StripPort
+	FormMapped                       // an IPv4-mapped IPv6 prefix, removed with Mapped
+
+	numForms = iota
+)
+
+var formNames = [numForms]string{"whitespace", "leading zeros", "quoted", "bracketed", "port", "ipv4-mapped"}
+
+// Canonical tallies, for ParseOptions.Canon, the addresses counted from
+// each non-canonical form: the lines of each Form bit, the distinct
+// addresses they gave, and how many distinct addresses were never seen
+// written canonically, which is the part of a count that the leniency
+// settings decide. Like Normalized it is shared by every copy of the
+// options, so workers add to it concurrently. Its sets are bitsets paged
+// per /16, so the canonical one grows to 512 MB for addresses spread over
+// the whole space.
+type Canonical struct {
+	// Lines counts the counted lines written in each form, indexed by the
+	// position of its Form bit.
+	Lines [numForms]atomic.Int64
+
+	sets  [numForms]pagedSet
+	other pagedSet // reached through any non-canonical form
+	canon pagedSet // reached through the canonical form
+}
+
+// CanonRow is one form's line of a canonicalization report.
+type CanonRow struct {
+	Form      string
+	Lines     int64 // lines counted that wrote their address this way
+	Addresses int64 // distinct addresses among them
+}
+
+// Add notes the addresses [first, last] of one counted line written in
+// form. It does nothing on a nil Canonical.
+func (c *Canonical) Add(first, last uint32, form Form) {
+	if c == nil {
+		return
+	}
+	if form == 0 {
+		c.canon.addRange(first, last)
+		return
+	}
+	c.other.addRange(first, last)
+	for i := range numForms {
+		if form&(1<<i) != 0 {
+			c.Lines[i].Add(1)
+			c.sets[i].addRange(first, last)
+		}
+	}
+}
+
+// Rows returns a row for each form some counted line was written in, in
+// the order of the Form bits. A line written in several forms is in each
+// of their rows.
+func (c *Canonical) Rows() []CanonRow {
+	var rows []CanonRow
+	for i := range numForms {
+		if n := c.Lines[i].Load(); n > 0 {
+			rows = append(rows, CanonRow{Form: formNames[i], Lines: n, Addresses: c.sets[i].count(nil)})
+		}
+	}
+	return rows
+}
+
+// NonCanonicalOnly returns how many distinct addresses were only ever
+// seen written in a non-canonical form; a parser that accepted none of
+// those forms would count that many fewer.
+func (c *Canonical) NonCanonicalOnly() int64 {
+	return c.other.count(&c.canon)
+}
+
+// addrForm returns the Form of an address o.Parse accepted: the prefix
+// and suffix it stripped and the leading zeros it read past.
+func (o ParseOptions) addrForm(b []byte) Form {
+	switch {
+	case o.Format == FormatInt || o.Format == FormatHex:
+		return 0
+	case o.Format == FormatAuto && bytes.IndexByte(b, '.') < 0:
+		return 0
+	}
+	var f Form
+	if o.Mapped {
+		if s := StripMappedPrefix(b); len(s) != len(b) {
+			f, b = f|FormMapped, s
+		}
+	}
+	if o.StripPort {
+		if i := bytes.IndexByte(b, ':'); i >= 0 {
+			f, b = f|FormPort, b[:i]
+		}
+	}
+	if o.Lenient {
+		for i := 0; i+1 < len(b); i++ {
+			if (i == 0 || b[i-1] == '.') && b[i] == '0' && b[i+1] != '.' {
+				f |= FormLeadingZero
+				break
+			}
+		}
+	}
+	return f
+}
+
+// pagedSet is a set of addresses as a bitset of 65536 pages of 8 KB, one
+// per /16, allocated as addresses land in them.
+type pagedSet struct {
+	pages [1 << 16]atomic.Pointer[[1024]uint64]
+}
+
+func (s *pagedSet) page(i uint32) *[1024]uint64 {
+	p := s.pages[i].Load()
+	if p == nil {
+		p = new([1024]uint64)
+		if !s.pages[i].CompareAndSwap(nil, p) {
+			p = s.pages[i].Load()
+		}
+	}
+	return p
+}
+
+// addRange adds the addresses [first, last], a word at a time.
+func (s *pagedSet) addRange(first, last uint32) {
+	for pg := first >> 16; ; pg++ {
+		p := s.page(pg)
+		lo, hi := uint32(0), uint32(1<<16-1)
+		if pg == first>>16 {
+			lo = first & 0xffff
+		}
+		if pg == last>>16 {
+			hi = last & 0xffff
+		}
+		for w := lo >> 6; w <= hi>>6; w++ {
+			mask := ^uint64(0)
+			if w == lo>>6 {
+				mask &= ^uint64(0) << (lo & 63)
+			}
+			if w == hi>>6 {
+				mask &= ^uint64(0) >> (63 - hi&63)
+			}
+			if atomic.LoadUint64(&p[w])&mask != mask {
+				atomic.OrUint64(&p[w], mask)
+			}
+		}
+		if pg == last>>16 {
+			return
+		}
+	}
+}
+
+// count returns the number of addresses in s and not in minus, if set.
+func (s *pagedSet) count(minus *pagedSet) int64 {
+	var n int64
+	for i := range s.pages {
+		p := s.pages[i].Load()
+		if p == nil {
+			continue
+		}
+		var q *[1024]uint64
+		if minus != nil {
+			q = minus.pages[i].Load()
+		}
+		for w := range p {
+			x := atomic.LoadUint64(&p[w])
+			if q != nil {
+				x &^= atomic.LoadUint64(&q[w])
+			}
+			n += int64(bits.OnesCount64(x))
+		}
+	}
+	return n
+}
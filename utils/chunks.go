@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// DefaultMaxLine is the longest line engines accept by default. A valid
+// line is at most 15 bytes of address plus whitespace (or a port, or a
+// mapped prefix); anything near this long is corrupt input.
+const DefaultMaxLine = 4 * 1024
+
+// Chunk is a run of complete lines returned by ChunkReader.Next.
+type Chunk struct {
+	Data   []byte
+	Offset int64   // position of Data[0] in the stream, counting a skipped BOM
+	buf    *[]byte // pooled buffer backing Data, nil if not pooled
+}
+
+// ChunkReader reads a stream in chunks that end at a line boundary, for
+// handing whole lines to parallel workers. Each chunk starts with the
+// carried partial line of the previous read; only the carry is copied.
+// Chunk buffers are pooled and come back through Release, which any
+// goroutine may call.
+//
+// A partial line longer than maxLine is never buffered: the reader drops
+// what it has of it, skips ahead to the next newline and counts it in
+// Oversized. This bounds memory on corrupt input without newlines.
+//
+// Lines end in a newline unless the reader was made with
+// NewDelimChunkReader, which splits records at another byte instead.
+type ChunkReader struct {
+	r         *bufio.Reader
+	size      int
+	maxLine   int
+	delim     byte
+	pool      sync.Pool
+	carry     []byte
+	skipping  bool  // discarding the rest of an oversized line
+	started   bool  // BOM checked
+	err       error // sticky error, returned once the carry is flushed
+	oversized int64
+	pos       int64 // stream bytes read so far; the carry ends here
+}
+
+// NewChunkReader returns a ChunkReader reading chunks of about size bytes
+// from r; maxLine <= 0 means DefaultMaxLine. A leading UTF-8 BOM is
+// skipped.
+func NewChunkReader(r io.Reader, size, maxLine int) *ChunkReader {
+	return NewDelimChunkReader(r, size, maxLine, '\n')
+}
+
+// NewDelimChunkReader is NewChunkReader for records ending in delim, such
+// as NUL or ';', in place of lines; maxLine then bounds a record.
+func NewDelimChunkReader(r io.Reader, size, maxLine int, delim byte) *ChunkReader {
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLine
+	}
+	cr := &ChunkReader{r: bufio.NewReader(r), size: size, maxLine: maxLine, delim: delim}
+	cr.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return cr
+}
+
+// Next returns the next chunk of complete lines; its last line may lack a
+// newline only at the end of the stream. It returns io.EOF after the last
+// chunk, or the first read error.
+func (cr *ChunkReader) Next() (Chunk, error) {
+	if !cr.started {
+		cr.started = true
+		n, err := SkipBOM(cr.r)
+		if err != nil {
+			cr.err = err
+		}
+		cr.pos = int64(n)
+	}
+	for cr.err == nil {
+		bp := cr.pool.Get().(*[]byte)
+		buf := *bp
+		if len(cr.carry) > len(buf)/2 {
+			// Not enough room after the carry: use a one-off buffer
+			cr.pool.Put(bp)
+			buf = make([]byte, len(cr.carry)+cr.size)
+			bp = nil
+		}
+		off := copy(buf, cr.carry)
+		start := cr.pos - int64(off)
+		n, err := cr.r.Read(buf[off:])
+		cr.pos += int64(n)
+		if n == 0 && err != nil {
+			cr.Release(Chunk{buf: bp})
+			cr.err = err
+			break
+		}
+
+		data := buf[:off+n]
+		if cr.skipping { // the carry is empty while skipping
+			i := bytes.IndexByte(data, cr.delim)
+			if i < 0 {
+				cr.Release(Chunk{buf: bp})
+				continue
+			}
+			cr.skipping = false
+			data = data[i+1:]
+			start += int64(i + 1)
+		}
+
+		cut := bytes.LastIndexByte(data, cr.delim)
+		tail := data[cut+1:]
+		if len(tail) > cr.maxLine {
+			cr.oversized++
+			cr.skipping = true
+			tail = nil
+		}
+		// Save remainder after last newline before the buffer changes hands
+		cr.carry = append(cr.carry[:0], tail...)
+		if cut == -1 { // no complete line yet
+			cr.Release(Chunk{buf: bp})
+			continue
+		}
+		return Chunk{Data: data[:cut+1], Offset: start, buf: bp}, nil
+	}
+
+	// Flush the leftover tail without newline once, unless a read error
+	// may have cut it short
+	if len(cr.carry) > 0 && cr.err == io.EOF {
+		c := Chunk{Data: cr.carry, Offset: cr.pos - int64(len(cr.carry))}
+		cr.carry = nil
+		return c, nil
+	}
+	return Chunk{}, cr.err
+}
+
+// Release returns c's buffer to the pool once its lines are processed.
+func (cr *ChunkReader) Release(c Chunk) {
+	if c.buf != nil {
+		cr.pool.Put(c.buf)
+	}
+}
+
+// Oversized returns how many lines the reader dropped for exceeding
+// maxLine. Lines that fit inside one chunk are left to the caller.
+func (cr *ChunkReader) Oversized() int64 {
+	return cr.oversized
+}
+
+// NextLine splits the first line off data, returning it without its
+// newline and the rest after it. A final line without a newline is
+// returned whole with an empty rest. It never allocates, so engines can
+// walk a chunk in place:
+//
+//	for data := chunk; len(data) > 0; {
+//		var line []byte
+//		line, data = utils.NextLine(data)
+//		...
+//	}
+func NextLine(data []byte) (line, rest []byte) {
+	return NextRecord(data, '\n')
+}
+
+// NextRecord is NextLine for records ending in delim.
+func NextRecord(data []byte, delim byte) (record, rest []byte) {
+	if i := bytes.IndexByte(data, delim); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+// CountRecords returns how many records NextRecord splits data into.
+func CountRecords(data []byte, delim byte) int64 {
+	n := int64(bytes.Count(data, []byte{delim}))
+	if len(data) > 0 && data[len(data)-1] != delim {
+		n++
+	}
+	return n
+}
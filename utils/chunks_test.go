@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"cmp"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Workers hold chunks, some of them across many later reads, while the
+// reader goes on and takes buffers from the pool, and hand them back in
+// any order; no chunk changes under a worker before it is released, and
+// the chunks together give every line but the oversized ones exactly
+// once. Run with -race, which sees a buffer handed out again while a
+// worker still reads it.
+func TestChunkReaderRelease(t *testing.T) {
+	const size, maxLine = 256, 1000
+	rng := rand.New(rand.NewPCG(171, 172))
+	var b strings.Builder
+	b.WriteString("\xef\xbb\xbf")
+	var want []string
+	for range 20000 {
+		var line string
+		switch rng.IntN(50) {
+		case 0: // longer than half a buffer: a one-off buffer
+			line = strings.Repeat("y", size/2+rng.IntN(size))
+		case 1: // too long for maxLine and a buffer after it: dropped
+			line = strings.Repeat("z", maxLine+size+1+rng.IntN(size))
+		default:
+			line = FormatIPv4(rng.Uint32())
+		}
+		if len(line) <= maxLine+size {
+			want = append(want, line)
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("10.0.0.1") // no final newline
+	want = append(want, "10.0.0.1")
+	input := b.String()
+
+	cr := NewChunkReader(strings.NewReader(input), size, maxLine)
+	chunks := make(chan Chunk, 4)
+	type span struct {
+		off  int64
+		data string
+	}
+	var (
+		mu    sync.Mutex
+		spans []span
+		wg    sync.WaitGroup
+	)
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(w), 173))
+			var held []Chunk
+			check := func(c Chunk) {
+				if end := c.Offset + int64(len(c.Data)); end > int64(len(input)) || string(c.Data) != input[c.Offset:end] {
+					t.Errorf("chunk at %d changed before it was released", c.Offset)
+				}
+			}
+			for c := range chunks {
+				check(c)
+				mu.Lock()
+				spans = append(spans, span{c.Offset, string(c.Data)})
+				mu.Unlock()
+				held = append(held, c)
+				runtime.Gosched()
+				for len(held) > 0 && rng.IntN(3) > 0 {
+					i := rng.IntN(len(held))
+					check(held[i])
+					cr.Release(held[i])
+					held = slices.Delete(held, i, i+1)
+				}
+			}
+			for _, c := range held {
+				check(c)
+				cr.Release(c)
+			}
+		}()
+	}
+	for {
+		c, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks <- c
+	}
+	close(chunks)
+	wg.Wait()
+
+	slices.SortFunc(spans, func(x, y span) int { return cmp.Compare(x.off, y.off) })
+	var got []string
+	for _, s := range spans {
+		for data := []byte(s.data); len(data) > 0; {
+			var line []byte
+			line, data = NextLine(data)
+			got = append(got, string(line))
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("chunks give %d lines, want the %d in the input", len(got), len(want))
+	}
+	if n := cr.Oversized(); n == 0 {
+		t.Errorf("no oversized lines dropped")
+	}
+}
+
+// Reading a stream chunk by chunk, each released once its lines are
+// walked; with -benchmem, allocs/op over chunks/op should stay near
+// zero, the pooled buffers being reused rather than a slice made per
+// chunk.
+func BenchmarkChunkReader(b *testing.B) {
+	rng := rand.New(rand.NewPCG(174, 175))
+	var buf bytes.Buffer
+	for buf.Len() < 16<<20 {
+		buf.WriteString(FormatIPv4(rng.Uint32()) + "\n")
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	var chunks int
+	for range b.N {
+		cr := NewChunkReader(bytes.NewReader(data), 64<<10, 0)
+		for {
+			c, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			chunks++
+			CountRecords(c.Data, '\n')
+			cr.Release(c)
+		}
+	}
+	b.ReportMetric(float64(chunks)/float64(b.N), "chunks/op")
+}
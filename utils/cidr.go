@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// CIDR is an IPv4 prefix with its host bits cleared.
+type CIDR struct {
+	Base uint32
+	Bits int // prefix length, 0-32
+}
+
+// ParseCIDR parses "a.b.c.d/len". Host bits below the prefix are cleared,
+// so 10.1.2.3/8 becomes 10.0.0.0/8.
+func ParseCIDR(b []byte) (CIDR, error) {
+	slash := bytes.IndexByte(b, '/')
+	if slash < 0 {
+		return CIDR{}, errors.New("missing prefix length")
+	}
+	ip, err := ParseIPv4(b[:slash])
+	if err != nil {
+		return CIDR{}, err
+	}
+	bits := 0
+	lenPart := b[slash+1:]
+	if len(lenPart) == 0 || len(lenPart) > 2 {
+		return CIDR{}, fmt.Errorf("invalid prefix length %q", lenPart)
+	}
+	for _, c := range lenPart {
+		if c < '0' || c > '9' {
+			return CIDR{}, fmt.Errorf("invalid prefix length %q", lenPart)
+		}
+		bits = bits*10 + int(c-'0')
+	}
+	if bits > 32 {
+		return CIDR{}, fmt.Errorf("invalid prefix length %q", lenPart)
+	}
+	c := CIDR{Bits: bits}
+	c.Base = ip & c.Mask()
+	return c, nil
+}
+
+// Mask returns the netmask of c.
+func (c CIDR) Mask() uint32 {
+	if c.Bits == 0 {
+		return 0
+	}
+	return ^uint32(0) << (32 - c.Bits)
+}
+
+// Size returns the number of addresses in c.
+func (c CIDR) Size() uint64 {
+	return uint64(1) << (32 - c.Bits)
+}
+
+// Last returns the highest address in c.
+func (c CIDR) Last() uint32 {
+	return c.Base | ^c.Mask()
+}
+
+// Contains reports whether ip is inside c.
+func (c CIDR) Contains(ip uint32) bool {
+	return ip&c.Mask() == c.Base
+}
+
+func (c CIDR) String() string {
+	return fmt.Sprintf("%s/%d", FormatIPv4(c.Base), c.Bits)
+}
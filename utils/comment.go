@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+)
+
+// ErrComment is returned by ParseBlock for a line that is only a comment,
+// so callers can tell it from a malformed address.
+var ErrComment = errors.New("comment line")
+
+// DefaultCommentPrefix marks inline comments when no CommentPrefix is set.
+const DefaultCommentPrefix = "#"
+
+// hasComments reports whether o skips or strips comments at all, so the
+// common case costs two field checks per line.
+func (o ParseOptions) hasComments() bool {
+	return o.CommentPrefix != "" || o.InlineComments
+}
+
+// IsComment reports whether the trimmed line starts with CommentPrefix,
+// for callers that split lines into fields before parsing. A comment
+// line is added to o.Comments.
+func (o ParseOptions) IsComment(line []byte) bool {
+	p := o.CommentPrefix
+	if p == "" || len(line) < len(p) || string(line[:len(p)]) != p {
+		return false
+	}
+	if o.Comments != nil {
+		o.Comments.Add(1)
+	}
+	return true
+}
+
+// stripComment returns the trimmed line without its comment and false
+// when nothing but a comment is left.
+func (o ParseOptions) stripComment(line []byte) ([]byte, bool) {
+	if o.IsComment(line) {
+		return nil, false
+	}
+	if !o.InlineComments {
+		return line, true
+	}
+	line = bytes.TrimSpace(cutComment(line, cmp.Or(o.CommentPrefix, DefaultCommentPrefix)))
+	if len(line) == 0 {
+		if o.Comments != nil {
+			o.Comments.Add(1)
+		}
+		return nil, false
+	}
+	return line, true
+}
+
+// cutComment returns line up to the first prefix outside single or double
+// quotes.
+func cutComment(line []byte, prefix string) []byte {
+	if bytes.IndexByte(line, prefix[0]) < 0 {
+		return line
+	}
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case bytes.HasPrefix(line[i:], []byte(prefix)):
+			return line[:i]
+		}
+	}
+	return line
+}
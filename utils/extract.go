@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Extractor returns the part of a trimmed line that holds its address,
+// such as one column of a CSV record or one field of a JSON event, and
+// false when the line has none. It must be safe for concurrent use.
+type Extractor func(line []byte) (addr []byte, ok bool)
+
+// ErrNoAddress is returned by ParseBlock for a line ParseOptions.Extract
+// finds no address field in.
+var ErrNoAddress = errors.New("no address field")
+
+// ParseExtractor returns the Extractor for spec:
+//
+//	plain         the whole line, as without an extractor (nil)
+//	csv:N         the Nth field, 1-based, of records separated by sep,
+//	              which may be double-quoted with "" for a quote
+//	field:N       the Nth run of non-blanks, as in a web server log
+//	json:PATH     the string or number at PATH of a JSON object per
+//	              line, with dots for nested objects, as in client.ip
+//	regex:RE      the first match of RE, or of its first group if it
+//	              has one
+func ParseExtractor(spec string, sep byte) (Extractor, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "plain":
+		if arg != "" {
+			return nil, fmt.Errorf("extractor plain takes no argument, got %q", spec)
+		}
+		return nil, nil
+	case "csv", "field":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("extractor %s needs a 1-based field number, got %q", kind, spec)
+		}
+		if kind == "field" {
+			return func(line []byte) ([]byte, bool) { return blankField(line, n) }, nil
+		}
+		return func(line []byte) ([]byte, bool) { return csvField(line, n, sep) }, nil
+	case "json":
+		if arg == "" || strings.HasPrefix(arg, ".") || strings.HasSuffix(arg, ".") || strings.Contains(arg, "..") {
+			return nil, fmt.Errorf("extractor json needs a field name, dotted for a nested one, got %q", spec)
+		}
+		path := strings.Split(arg, ".")
+		return func(line []byte) ([]byte, bool) { return jsonField(line, path) }, nil
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("extractor regex: %w", err)
+		}
+		if re.NumSubexp() == 0 {
+			return func(line []byte) ([]byte, bool) {
+				m := re.Find(line)
+				return m, m != nil
+			}, nil
+		}
+		return func(line []byte) ([]byte, bool) {
+			m := re.FindSubmatchIndex(line)
+			if m == nil || m[2] < 0 {
+				return nil, false
+			}
+			return line[m[2]:m[3]], true
+		}, nil
+	}
+	return nil, fmt.Errorf("extractor must be plain, csv:N, field:N, json:PATH or regex:RE, got %q", spec)
+}
+
+// csvField returns field n of line, fields separated by sep, without the
+// quotes around a quoted one.
+func csvField(line []byte, n int, sep byte) ([]byte, bool) {
+	for i := 1; ; i++ {
+		var field []byte
+		if len(line) > 0 && line[0] == '"' {
+			// A quoted field ends at a quote not doubled
+			end := 1
+			for {
+				q := bytes.IndexByte(line[end:], '"')
+				if q < 0 {
+					return nil, false
+				}
+				end += q + 1
+				if end < len(line) && line[end] == '"' {
+					end++
+					continue
+				}
+				break
+			}
+			field, line = line[1:end-1], line[end:]
+			if len(line) > 0 && line[0] != sep {
+				return nil, false
+			}
+		} else {
+			end := bytes.IndexByte(line, sep)
+			if end < 0 {
+				end = len(line)
+			}
+			field, line = line[:end], line[end:]
+		}
+		if i == n {
+			return field, true
+		}
+		if len(line) == 0 {
+			return nil, false
+		}
+		line = line[1:] // the separator
+	}
+}
+
+// blankField returns the nth run of bytes other than spaces and tabs.
+func blankField(line []byte, n int) ([]byte, bool) {
+	for i := 1; ; i++ {
+		line = bytes.TrimLeft(line, " \t")
+		if len(line) == 0 {
+			return nil, false
+		}
+		end := bytes.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		if i == n {
+			return line[:end], true
+		}
+		line = line[end:]
+	}
+}
+
+// jsonField returns the value at path in the JSON object line: the
+// contents of a string without escapes, or a number. Objects on the way
+// are scanned, not decoded, and other values are skipped over.
+func jsonField(line []byte, path []string) ([]byte, bool) {
+	s := jsonScanner{b: line}
+	for depth, key := range path {
+		if !s.enter(key) {
+			return nil, false
+		}
+		if depth < len(path)-1 {
+			continue
+		}
+		s.space()
+		if s.peek() == '"' {
+			v, ok := s.str()
+			if !ok || bytes.IndexByte(v, '\\') >= 0 {
+				return nil, false
+			}
+			return v, true
+		}
+		start := s.i
+		for s.i < len(s.b) && strings.IndexByte("+-.0123456789eE", s.b[s.i]) >= 0 {
+			s.i++
+		}
+		return s.b[start:s.i], s.i > start
+	}
+	return nil, false
+}
+
+// jsonScanner walks a JSON text without decoding it.
+type jsonScanner struct {
+	b []byte
+	i int
+}
+
+func (s *jsonScanner) space() {
+	for s.i < len(s.b) && (s.b[s.i] == ' ' || s.b[s.i] == '\t' || s.b[s.i] == '\r' || s.b[s.i] == '\n') {
+		s.i++
+	}
+}
+
+func (s *jsonScanner) peek() byte {
+	if s.i < len(s.b) {
+		return s.b[s.i]
+	}
+	return 0
+}
+
+// enter moves into the object at the scanner to just past the ':' after
+// key, reporting false if it is not an object or has no such key. Keys
+// are compared as written, escapes and all.
+func (s *jsonScanner) enter(key string) bool {
+	s.space()
+	if s.peek() != '{' {
+		return false
+	}
+	s.i++
+	for {
+		s.space()
+		if s.peek() != '"' {
+			return false // '}' or broken
+		}
+		k, ok := s.str()
+		if !ok {
+			return false
+		}
+		s.space()
+		if s.peek() != ':' {
+			return false
+		}
+		s.i++
+		if string(k) == key {
+			return true
+		}
+		if !s.skip() {
+			return false
+		}
+		s.space()
+		if s.peek() != ',' {
+			return false
+		}
+		s.i++
+	}
+}
+
+// str reads the string at the scanner and returns its raw contents.
+func (s *jsonScanner) str() ([]byte, bool) {
+	start := s.i + 1
+	for j := start; j < len(s.b); j++ {
+		switch s.b[j] {
+		case '\\':
+			j++
+		case '"':
+			s.i = j + 1
+			return s.b[start:j], true
+		}
+	}
+	return nil, false
+}
+
+// skip moves past the value at the scanner.
+func (s *jsonScanner) skip() bool {
+	s.space()
+	switch s.peek() {
+	case '"':
+		_, ok := s.str()
+		return ok
+	case '{', '[':
+		depth := 0
+		for s.i < len(s.b) {
+			switch s.b[s.i] {
+			case '"':
+				if _, ok := s.str(); !ok {
+					return false
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					s.i++
+					return true
+				}
+			}
+			s.i++
+		}
+		return false
+	}
+	// A number, true, false or null
+	start := s.i
+	for s.i < len(s.b) && strings.IndexByte(",}] \t\r\n", s.b[s.i]) < 0 {
+		s.i++
+	}
+	return s.i > start
+}
@@ -0,0 +1,67 @@
+package utils
+
+import "testing"
+
+func TestParseExtractor(t *testing.T) {
+	for _, tc := range []struct {
+		spec, line string
+		want       string // "" for no address
+	}{
+		{"csv:3", `1,"Mozilla/5.0 (X11, Linux)",10.0.0.1`, "10.0.0.1"},
+		{"csv:2", `1,"say ""hi"", then go",x`, `say ""hi"", then go`},
+		{"csv:1", `"10.0.0.1",x`, "10.0.0.1"},
+		{"csv:4", "a,b,c", ""},
+		{"csv:2", `a,"unterminated`, ""},
+		{"csv:1", `"a"b,c`, ""},
+		{"field:1", "10.1.1.1 - - [01/May/2024:12:00:03 +0000] \"GET / HTTP/1.1\" 200", "10.1.1.1"},
+		{"field:2", " \ta \t b c", "b"},
+		{"field:3", "a b", ""},
+		{"json:ip", `{"ip":"10.0.0.1"}`, "10.0.0.1"},
+		{"json:client.ip", `{"msg":"a, \"b\" {x}","tags":[{"ip":"9.9.9.9"}],"n":null,"client":{"port":5,"ip":"10.0.0.2"}}`, "10.0.0.2"},
+		{"json:client.ip", ` { "client" : { "ip" : 167772161 } } `, "167772161"},
+		{"json:client.ip", `{"client":"10.0.0.1"}`, ""},
+		{"json:ip", `{"other":{"ip":"10.0.0.1"}}`, ""},
+		{"json:ip", `{"ip":"10.0.0\u002e1"}`, ""},
+		{"json:ip", `not json`, ""},
+		{"json:ip", `{"ip":`, ""},
+		{"regex:client=(\\S+)", "user=a client=10.0.0.3 x", "10.0.0.3"},
+		{"regex:[0-9]+(?:\\.[0-9]+){3}", "from 10.0.0.4 to", "10.0.0.4"},
+		{"regex:[0-9]+(\\.[0-9]+){3}", "from 10.0.0.4 to", ".4"},
+		{"regex:ip=(x)?", "ip=", ""},
+	} {
+		ex, err := ParseExtractor(tc.spec, ',')
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		got, ok := ex([]byte(tc.line))
+		if ok != (tc.want != "") || string(got) != tc.want {
+			t.Errorf("%s of %q: %q, %v, want %q", tc.spec, tc.line, got, ok, tc.want)
+		}
+	}
+
+	for _, spec := range []string{"csv:0", "csv:x", "field:", "json:", "json:a..b", "regex:(", "xml:ip", "plain:1"} {
+		if _, err := ParseExtractor(spec, ','); err == nil {
+			t.Errorf("%s accepted", spec)
+		}
+	}
+	if ex, err := ParseExtractor("plain", ','); ex != nil || err != nil {
+		t.Errorf("plain: %v, want no extractor", err)
+	}
+
+	// Lines without an address fail as such; comments go first, and the
+	// address is parsed with the rest of the options
+	ex, _ := ParseExtractor("json:ip", ',')
+	o := ParseOptions{Extract: ex, CommentPrefix: "#", StripPort: true}
+	if first, _, err := o.ParseBlock([]byte(`{"ip":" 10.0.0.1:443 "}`)); err != nil || first != 0x0a000001 {
+		t.Errorf("address with a port: %s, %v", FormatIPv4(first), err)
+	}
+	if _, _, err := o.ParseBlock([]byte(`{"host":"a"}`)); err != ErrNoAddress {
+		t.Errorf("no field: %v, want %v", err, ErrNoAddress)
+	}
+	if _, _, err := o.ParseBlock([]byte(`# {"ip":"10.0.0.1"}`)); err != ErrComment {
+		t.Errorf("comment: %v, want %v", err, ErrComment)
+	}
+	if o.Plain() {
+		t.Error("options with an extractor are plain")
+	}
+}
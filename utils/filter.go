@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrFiltered is returned by ParseBlock for an address, or a block, that
+// ParseOptions.Filter keeps out of the count. Like ErrComment it marks a
+// line that is not malformed; see Ignored.
+var ErrFiltered = errors.New("address filtered out")
+
+// ErrBlockFiltered is returned by ParseBlock for a CIDR block only part
+// of which ParseOptions.Filter lets through, which is not one range.
+var ErrBlockFiltered = errors.New("cidr block partly filtered out")
+
+// Ignored reports whether err, from ParseBlock, is for a line that holds
+// nothing to count by design, a comment or a filtered address, rather
+// than one that failed to parse.
+func Ignored(err error) bool {
+	return errors.Is(err, ErrComment) || errors.Is(err, ErrFiltered)
+}
+
+// Filter is the set of addresses that count: those in an included
+// prefix, every address when none is, and in no excluded one. It is kept
+// as sorted, disjoint ranges, so each address costs a binary search over
+// them, and shared like Canonical by every copy of the options, workers
+// adding the lines it turns away concurrently. A nil *Filter lets
+// everything through.
+type Filter struct {
+	starts, ends []uint32
+
+	filtered atomic.Int64
+}
+
+// NewFilter returns the Filter of include, none meaning the whole space,
+// less exclude. Every prefix must be IPv4.
+func NewFilter(include, exclude []netip.Prefix) (*Filter, error) {
+	in, err := prefixRanges(include)
+	if err != nil {
+		return nil, err
+	}
+	out, err := prefixRanges(exclude)
+	if err != nil {
+		return nil, err
+	}
+	if len(include) == 0 {
+		in = [][2]uint32{{0, math.MaxUint32}}
+	}
+	f := &Filter{}
+	for _, r := range in {
+		first := uint64(r[0])
+		for _, x := range out {
+			if uint64(x[1]) < first || x[0] > r[1] {
+				continue
+			}
+			if uint64(x[0]) > first {
+				f.add(uint32(first), x[0]-1)
+			}
+			first = uint64(x[1]) + 1
+		}
+		if first <= uint64(r[1]) {
+			f.add(uint32(first), r[1])
+		}
+	}
+	if len(f.starts) == 0 {
+		return nil, errors.New("the excluded prefixes cover every included address")
+	}
+	return f, nil
+}
+
+// add appends the range [first, last], past every range so far, merging
+// it into the last one when they touch.
+func (f *Filter) add(first, last uint32) {
+	if n := len(f.ends); n > 0 && f.ends[n-1] != math.MaxUint32 && f.ends[n-1]+1 == first {
+		f.ends[n-1] = last
+		return
+	}
+	f.starts = append(f.starts, first)
+	f.ends = append(f.ends, last)
+}
+
+// prefixRanges returns the prefixes as sorted, merged ranges.
+func prefixRanges(prefixes []netip.Prefix) ([][2]uint32, error) {
+	var rs [][2]uint32
+	for _, p := range prefixes {
+		if !p.Addr().Is4() {
+			return nil, fmt.Errorf("%s is not an IPv4 prefix", p)
+		}
+		a := p.Masked().Addr().As4()
+		first := uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3])
+		rs = append(rs, [2]uint32{first, first | uint32(math.MaxUint32)>>p.Bits()})
+	}
+	slices.SortFunc(rs, func(a, b [2]uint32) int { return cmp.Compare(a[0], b[0]) })
+	var merged [][2]uint32
+	for _, r := range rs {
+		if n := len(merged); n > 0 && (merged[n-1][1] == math.MaxUint32 || r[0] <= merged[n-1][1]+1) {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// Allow reports whether ip counts, adding it to the lines filtered out
+// when it does not. A nil Filter allows every address.
+func (f *Filter) Allow(ip uint32) bool {
+	if f == nil || f.contains(ip) {
+		return true
+	}
+	f.filtered.Add(1)
+	return false
+}
+
+// contains reports whether ip is in one of the ranges.
+func (f *Filter) contains(ip uint32) bool {
+	i, found := slices.BinarySearch(f.starts, ip)
+	return found || i > 0 && ip <= f.ends[i-1]
+}
+
+// check returns nil when every address of [first, last] counts,
+// ErrFiltered, adding the line to those filtered out, when none does, and
+// ErrBlockFiltered otherwise.
+func (f *Filter) check(first, last uint32) error {
+	if first == last {
+		if f.Allow(first) {
+			return nil
+		}
+		return ErrFiltered
+	}
+	// The first range that ends at or after first
+	i, found := slices.BinarySearch(f.starts, first)
+	if !found && i > 0 && first <= f.ends[i-1] {
+		i--
+	}
+	switch {
+	case i < len(f.starts) && f.starts[i] <= first && last <= f.ends[i]:
+		return nil
+	case i < len(f.starts) && f.starts[i] <= last:
+		return ErrBlockFiltered
+	}
+	f.filtered.Add(1)
+	return ErrFiltered
+}
+
+// Lines returns how many lines were filtered out, 0 for a nil Filter.
+func (f *Filter) Lines() int64 {
+	if f == nil {
+		return 0
+	}
+	return f.filtered.Load()
+}
+
+// String lists the ranges that count, as "10.0.0.0-10.255.255.255", comma
+// separated, the same for filters that let the same addresses through,
+// and "" for a nil Filter.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	var b strings.Builder
+	for i := range f.starts {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(FormatIPv4(f.starts[i]) + "-" + FormatIPv4(f.ends[i]))
+	}
+	return b.String()
+}
+
+// namedPrefixes are the lists ParsePrefixes accepts by name.
+var namedPrefixes = map[string]string{
+	"rfc1918":  "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16",
+	"loopback": "127.0.0.0/8",
+	"cgnat":    "100.64.0.0/10",
+}
+
+// ParsePrefixes parses a comma-separated list of IPv4 prefixes, such as
+// "10.0.0.0/8,192.168.1.0/24". A bare address is a /32, and rfc1918,
+// loopback and cgnat stand for their blocks.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if named, ok := namedPrefixes[f]; ok {
+			p, err := ParsePrefixes(named)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p...)
+			continue
+		}
+		var p netip.Prefix
+		var err error
+		if strings.Contains(f, "/") {
+			p, err = netip.ParsePrefix(f)
+		} else {
+			var a netip.Addr
+			if a, err = netip.ParseAddr(f); err == nil {
+				p = netip.PrefixFrom(a, a.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !p.Addr().Is4() {
+			return nil, fmt.Errorf("%s is not an IPv4 prefix", f)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	include, err := ParsePrefixes("10.0.0.0/8, 192.168.1.7, 0.0.0.0/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := ParsePrefixes("rfc1918,10.1.2.3/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything included is excluded again but for 0.0.0.0
+	if f, err := NewFilter(include, exclude); err != nil || f.String() != "0.0.0.0-0.0.0.0" {
+		t.Fatalf("%v, %v", f, err)
+	}
+	exclude, _ = ParsePrefixes("10.1.0.0/16,10.255.255.255")
+	f, err := NewFilter(include[:1], exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "10.0.0.0-10.0.255.255,10.2.0.0-10.255.255.254"; f.String() != want {
+		t.Errorf("ranges %s, want %s", f, want)
+	}
+	cidr := ParseOptions{CIDR: true, MinPrefix: 8, Filter: f}
+	for _, tc := range []struct {
+		line string
+		want error
+	}{
+		{"10.0.0.1", nil},
+		{"10.1.0.1", ErrFiltered},
+		{"10.255.255.254", nil},
+		{"10.255.255.255", ErrFiltered},
+		{"9.255.255.255", ErrFiltered},
+		{"11.0.0.0", ErrFiltered},
+		{"10.0.0.0/16", nil},
+		{"10.0.0.0/15", ErrBlockFiltered},
+		{"10.1.0.0/24", ErrFiltered},
+		{"10.128.0.0/9", ErrBlockFiltered},
+		{"11.0.0.0/8", ErrFiltered},
+		{"8.0.0.0/8", ErrFiltered},
+	} {
+		if _, _, err := cidr.ParseBlock([]byte(tc.line)); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.line, err, tc.want)
+		}
+	}
+	if n := f.Lines(); n != 7 {
+		t.Errorf("%d lines filtered, want 7", n)
+	}
+
+	all, err := NewFilter(nil, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0.0.0.0-10.0.255.255,10.2.0.0-10.255.255.254,11.0.0.0-255.255.255.255"; all.String() != want {
+		t.Errorf("ranges %s, want %s", all, want)
+	}
+	if !all.Allow(0xFFFFFFFF) || all.Allow(10<<24|1<<16) {
+		t.Error("the top address filtered or 10.1.0.0 let through")
+	}
+	if _, err := ParsePrefixes("::1/128"); err == nil {
+		t.Error("an IPv6 prefix accepted")
+	}
+	if _, err := ParsePrefixes("10.0.0.0/33"); err == nil {
+		t.Error("a /33 accepted")
+	}
+}
@@ -0,0 +1,29 @@
+package utils
+
+// FormatIPv4 renders ip as a dotted-quad string.
+func FormatIPv4(ip uint32) string {
+	var buf [15]byte
+	return string(AppendIPv4(buf[:0], ip))
+}
+
+// AppendIPv4 appends the dotted-quad form of ip to dst without allocating
+// when dst has room for 15 more bytes.
+func AppendIPv4(dst []byte, ip uint32) []byte {
+	dst = appendOctet(dst, byte(ip>>24))
+	dst = append(dst, '.')
+	dst = appendOctet(dst, byte(ip>>16))
+	dst = append(dst, '.')
+	dst = appendOctet(dst, byte(ip>>8))
+	dst = append(dst, '.')
+	return appendOctet(dst, byte(ip))
+}
+
+func appendOctet(dst []byte, v byte) []byte {
+	if v >= 100 {
+		dst = append(dst, '0'+v/100)
+	}
+	if v >= 10 {
+		dst = append(dst, '0'+v/10%10)
+	}
+	return append(dst, '0'+v%10)
+}
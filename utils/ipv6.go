@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+)
+
+// IPv6 parse errors, alongside ErrEmpty and ErrInvalidChar.
+var (
+	ErrEmptyGroup     = errors.New("empty group")
+	ErrGroupLength    = errors.New("group longer than 4 hex digits")
+	ErrTooFewGroups   = errors.New("too few groups")
+	ErrTooManyGroups  = errors.New("too many groups")
+	ErrDoubleEllipsis = errors.New("more than one ::")
+)
+
+// ParseIPv6 parses an IPv6 address in the forms of RFC 4291: eight groups
+// of 1-4 hex digits separated by colons, with at most one "::" standing
+// for one or more zero groups, and optionally a dotted-quad IPv4 address
+// as the last 32 bits, as in "::ffff:192.0.2.1". Hex digits may be of
+// either case. A zone ("%eth0"), brackets or a port are rejected. The
+// address is returned as its upper and lower 64 bits.
+func ParseIPv6(b []byte) (hi, lo uint64, err error) {
+	if len(b) == 0 {
+		return 0, 0, ErrEmpty
+	}
+	var groups [8]uint16
+	n, ellipsis := 0, -1
+	i := 0
+	if len(b) >= 2 && b[0] == ':' && b[1] == ':' {
+		ellipsis, i = 0, 2
+	}
+	for i < len(b) {
+		if n == 8 {
+			return 0, 0, ErrTooManyGroups
+		}
+		j, v := i, uint16(0)
+		for ; j < len(b) && j-i <= 4; j++ {
+			d, ok := hexDigit(b[j])
+			if !ok {
+				break
+			}
+			v = v<<4 | uint16(d)
+		}
+		if j < len(b) && b[j] == '.' {
+			// An embedded IPv4 address ends the address
+			if n > 6 {
+				return 0, 0, ErrTooManyGroups
+			}
+			ip, err := ParseIPv4(b[i:])
+			if err != nil {
+				return 0, 0, err
+			}
+			groups[n], groups[n+1] = uint16(ip>>16), uint16(ip)
+			n += 2
+			break
+		}
+		switch {
+		case j-i > 4:
+			return 0, 0, ErrGroupLength
+		case j == i && j < len(b) && b[j] != ':':
+			return 0, 0, ErrInvalidChar
+		case j == i:
+			return 0, 0, ErrEmptyGroup
+		}
+		groups[n] = v
+		n++
+		if i = j; i == len(b) {
+			break
+		}
+		if b[i] != ':' {
+			return 0, 0, ErrInvalidChar
+		}
+		if i++; i == len(b) {
+			return 0, 0, ErrEmptyGroup // a trailing single colon
+		}
+		if b[i] == ':' {
+			if ellipsis >= 0 {
+				return 0, 0, ErrDoubleEllipsis
+			}
+			ellipsis = n
+			i++
+		}
+	}
+	switch {
+	case ellipsis < 0 && n < 8:
+		return 0, 0, ErrTooFewGroups
+	case ellipsis >= 0 && n == 8:
+		return 0, 0, ErrTooManyGroups // "::" stands for at least one group
+	case ellipsis >= 0:
+		zeros := 8 - n
+		copy(groups[ellipsis+zeros:], groups[ellipsis:n])
+		clear(groups[ellipsis : ellipsis+zeros])
+	}
+	for k := range 4 {
+		hi = hi<<16 | uint64(groups[k])
+		lo = lo<<16 | uint64(groups[4+k])
+	}
+	return hi, lo, nil
+}
+
+// ParseIPv6HostPort parses an IPv6 address, or one in brackets optionally
+// followed by ":port", as in "[2001:db8::1]:443". A bare address cannot
+// carry a port, its colons being ambiguous.
+func ParseIPv6HostPort(b []byte) (hi, lo uint64, err error) {
+	if len(b) == 0 || b[0] != '[' {
+		return ParseIPv6(b)
+	}
+	end := bytes.IndexByte(b, ']')
+	if end < 0 {
+		return 0, 0, ErrInvalidChar
+	}
+	if rest := b[end+1:]; len(rest) > 0 && (rest[0] != ':' || !validPort(rest[1:])) {
+		return 0, 0, ErrInvalidPort
+	}
+	return ParseIPv6(b[1:end])
+}
+
+// MappedIPv6 returns the IPv4-mapped IPv6 address ::ffff:a.b.c.d of ip as
+// its upper and lower 64 bits, so IPv4 addresses can share a set with
+// IPv6 ones.
+func MappedIPv6(ip uint32) (hi, lo uint64) {
+	return 0, 0xffff<<32 | uint64(ip)
+}
+
+// FormatIPv6 returns the RFC 5952 text of the address with upper and
+// lower 64 bits hi and lo.
+func FormatIPv6(hi, lo uint64) string {
+	var a [16]byte
+	for k := range 8 {
+		a[k] = byte(hi >> (56 - 8*k))
+		a[8+k] = byte(lo >> (56 - 8*k))
+	}
+	return netip.AddrFrom16(a).String()
+}
+
+// hexDigit returns the value of the hex digit c.
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// ParseIPv6 takes what net/netip takes as an IPv6 address without a zone,
+// to the same 128 bits, and turns down everything else, on addresses in
+// every written form and on those forms cut or spliced at random.
+func TestParseIPv6(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		err error
+	}{
+		{"::", nil},
+		{"::1", nil},
+		{"2001:DB8::1", nil},
+		{"1::", nil},
+		{"::ffff:192.0.2.1", nil},
+		{"64:ff9b::192.0.2.1", nil},
+		{"1:2:3:4:5:6:1.2.3.4", nil},
+		{"", ErrEmpty},
+		{"1.2.3.4", ErrTooFewGroups},
+		{"1:2:3:4:5:6:7", ErrTooFewGroups},
+		{"1:2:3:4:5:6:7:8:9", ErrTooManyGroups},
+		{"1:2:3:4::5:6:7:8", ErrTooManyGroups},
+		{"1::2::3", ErrDoubleEllipsis},
+		{"12345::", ErrGroupLength},
+		{":1::", ErrEmptyGroup},
+		{"1:", ErrEmptyGroup},
+		{":::", ErrEmptyGroup},
+		{"fe80::1%eth0", ErrInvalidChar},
+		{"g::", ErrInvalidChar},
+		{"::ffff:1.2.3.04", ErrLeadingZero},
+	} {
+		_, _, err := ParseIPv6([]byte(c.in))
+		if !errors.Is(err, c.err) {
+			t.Errorf("%q: %v, want %v", c.in, err, c.err)
+		}
+	}
+
+	rng := rand.New(rand.NewPCG(21, 22))
+	var forms []string
+	for range 2000 {
+		var a [16]byte
+		for k := range a {
+			if rng.IntN(3) > 0 { // runs of zero groups for "::"
+				a[k] = byte(rng.Uint32())
+			}
+		}
+		addr := netip.AddrFrom16(a)
+		forms = append(forms, addr.String(), addr.StringExpanded(), strings.ToUpper(addr.String()))
+		if rng.IntN(4) == 0 {
+			forms = append(forms, "::ffff:"+netip.AddrFrom4([4]byte(a[12:])).String())
+		}
+	}
+	for _, s := range forms {
+		checkIPv6(t, s)
+		checkIPv6(t, s[:rng.IntN(len(s))])
+		checkIPv6(t, s[:rng.IntN(len(s))]+forms[rng.IntN(len(forms))][rng.IntN(8):])
+	}
+}
+
+// checkIPv6 checks ParseIPv6 against netip.ParseAddr on s.
+func checkIPv6(t *testing.T, s string) {
+	t.Helper()
+	hi, lo, err := ParseIPv6([]byte(s))
+	want, werr := netip.ParseAddr(s)
+	if werr != nil || !want.Is6() || want.Zone() != "" {
+		if err == nil {
+			t.Errorf("%q: accepted as %s, netip turns it down", s, FormatIPv6(hi, lo))
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%q: %v, netip takes it as %s", s, err, want)
+	} else if got := FormatIPv6(hi, lo); got != want.String() {
+		t.Errorf("%q: %s, want %s", s, got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+import "bytes"
+
+// Plain reports whether o reads newline-separated strict dotted quads and
+// nothing more: no other format, ports, prefixes, blocks, comments,
+// quotes, extractor or tallies. Engines can then parse lines with ParseIPv4Line,
+// which gives the same addresses as Trim and ParseForm in one pass.
+func (o ParseOptions) Plain() bool {
+	return o.Format == FormatDotted && !o.StripPort && !o.Lenient && !o.Mapped && !o.CIDR &&
+		!o.hasComments() && o.Relaxed == nil && o.Canon == nil && o.Lines == nil && o.Extract == nil && o.RecordSep == ""
+}
+
+// ParseIPv4Line parses the line of chunk starting at start in one pass:
+// it skips ASCII whitespace, reads a strict dotted quad and skips
+// whitespace again up to the newline, a "\r" of CRLF included. It returns
+// the index just past the newline, or len(chunk) for a final line without
+// one, and whether the line held an address that ParseIPv4 accepts after
+// bytes.TrimSpace. A blank or invalid line, or one with whitespace outside
+// ASCII, reports false; callers that log or count rejected lines parse
+// chunk[start:next] again the general way.
+func ParseIPv4Line(chunk []byte, start int) (ip uint32, next int, ok bool) {
+	i := start
+	for i < len(chunk) && isLineSpace(chunk[i]) {
+		i++
+	}
+	var n int
+	ip, n, ok = dottedQuad(chunk[i:])
+	if i += n; ok {
+		for i < len(chunk) && isLineSpace(chunk[i]) {
+			i++
+		}
+		if i == len(chunk) {
+			return ip, i, true
+		}
+		if chunk[i] == '\n' {
+			return ip, i + 1, true
+		}
+	}
+	if nl := bytes.IndexByte(chunk[i:], '\n'); nl >= 0 {
+		return 0, i + nl + 1, false
+	}
+	return 0, len(chunk), false
+}
+
+// dottedQuad reads a strict dotted quad at the start of b the way
+// parseIPv4Fast does, and returns its length.
+func dottedQuad(b []byte) (uint32, int, bool) {
+	var ip uint32
+	i := 0
+	for k := 0; k < 4; k++ {
+		if i >= len(b) {
+			return 0, i, false
+		}
+		first := uint32(b[i]) - '0' // wraps for bytes below '0'
+		if first > 9 {
+			return 0, i, false
+		}
+		v, n := first, 1
+		if i+1 < len(b) {
+			if d := uint32(b[i+1]) - '0'; d <= 9 {
+				v, n = v*10+d, 2
+				if i+2 < len(b) {
+					if d := uint32(b[i+2]) - '0'; d <= 9 {
+						v, n = v*10+d, 3
+					}
+				}
+			}
+		}
+		if v > 255 || (n > 1 && first == 0) {
+			return 0, i, false
+		}
+		ip = ip<<8 | v
+		i += n
+		if k < 3 {
+			if i >= len(b) || b[i] != '.' {
+				return 0, i, false
+			}
+			i++
+		}
+	}
+	return ip, i, true
+}
+
+// isLineSpace reports whether c is ASCII whitespace other than the
+// newline that ends a line.
+func isLineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f'
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// checkLines walks chunk with ParseIPv4Line and checks every line against
+// ParseIPv4 after bytes.TrimSpace: the same boundaries as NextRecord, the
+// same address for every line accepted, and no accepted line turned down
+// unless it has bytes outside ASCII, which TrimSpace may read as spaces.
+func checkLines(t *testing.T, chunk []byte) {
+	t.Helper()
+	rest := chunk
+	for start := 0; start < len(chunk); {
+		var raw []byte
+		raw, rest = NextRecord(rest, '\n')
+		ip, next, ok := ParseIPv4Line(chunk, start)
+		if want := len(chunk) - len(rest); next != want {
+			t.Fatalf("line %q at %d: next %d, want %d", raw, start, next, want)
+		}
+		want, err := ParseIPv4(bytes.TrimSpace(raw))
+		switch {
+		case ok && (err != nil || ip != want):
+			t.Fatalf("line %q: accepted as %s, ParseIPv4 gives %s, %v", raw, FormatIPv4(ip), FormatIPv4(want), err)
+		case !ok && ip != 0:
+			t.Fatalf("line %q: turned down with address %s", raw, FormatIPv4(ip))
+		case !ok && err == nil && !hasNonASCII(raw):
+			t.Fatalf("line %q: turned down, ParseIPv4 gives %s", raw, FormatIPv4(want))
+		}
+		start = next
+	}
+}
+
+func hasNonASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestParseIPv4Line(t *testing.T) {
+	for _, chunk := range []string{
+		"1.2.3.4\n",
+		"1.2.3.4",
+		"1.2.3.4\r\n5.6.7.8\r\n",
+		"\n\n  \n\t\r\n",
+		"  10.0.0.1 \t\n255.255.255.255\n0.0.0.0",
+		"1.2.3\n1.2.3.4.5\n256.1.1.1\n01.2.3.4\n1.2.3.04\n1.2.3.4x\n1..2.3\n.1.2.3\n1.2.3.\n",
+		"1.2.3.1234\n1.2.3.4 5\n1.2.3.4\x00\n\xc2\xa01.2.3.4\n1.2.3.4\xc2\x85\n",
+		"1.2.3.4\r",
+		"\r\n",
+	} {
+		checkLines(t, []byte(chunk))
+	}
+	ip, next, ok := ParseIPv4Line([]byte("x\n 192.168.1.1\r\ny"), 2)
+	if !ok || ip != 0xc0a80101 || next != 16 {
+		t.Errorf("line at 2: %s, %d, %v; want 192.168.1.1, 16, true", FormatIPv4(ip), next, ok)
+	}
+}
+
+// Random chunks of addresses, near misses and whitespace split into the
+// same lines as NextRecord and accept the same addresses as ParseIPv4.
+func FuzzParseIPv4Line(f *testing.F) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 64 {
+		var b bytes.Buffer
+		for range rng.IntN(20) {
+			ws := []string{"", " ", "\t", "\r", "  ", "\v\f"}
+			fmt.Fprintf(&b, "%s%d.%d.%d.%d%s\n", ws[rng.IntN(len(ws))],
+				rng.IntN(300), rng.IntN(300), rng.IntN(300), rng.IntN(1100), ws[rng.IntN(len(ws))])
+		}
+		f.Add(b.Bytes())
+	}
+	f.Add([]byte("1.2.3.4\r\n\n 001.2.3.4\n1.2.3.4"))
+	f.Fuzz(func(t *testing.T, chunk []byte) {
+		checkLines(t, chunk)
+	})
+}
+
+func BenchmarkParseIPv4Line(b *testing.B) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	var buf bytes.Buffer
+	for buf.Len() < 1<<20 {
+		fmt.Fprintf(&buf, "%s\n", FormatIPv4(rng.Uint32()))
+	}
+	chunk := buf.Bytes()
+	b.Run("one-pass", func(b *testing.B) {
+		b.SetBytes(int64(len(chunk)))
+		for range b.N {
+			for start := 0; start < len(chunk); {
+				_, start, _ = ParseIPv4Line(chunk, start)
+			}
+		}
+	})
+	b.Run("trim-then-parse", func(b *testing.B) {
+		b.SetBytes(int64(len(chunk)))
+		for range b.N {
+			for data := chunk; len(data) > 0; {
+				var raw []byte
+				raw, data = NextRecord(data, '\n')
+				ParseIPv4(bytes.TrimSpace(raw))
+			}
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// malformedLen is the longest prefix of a malformed line kept as an
+// example.
+const malformedLen = 80
+
+// Malformed tallies, for ParseOptions.Malformed, the lines an engine
+// skipped because they failed to parse, comments aside, and keeps the
+// first Keep of them as examples. Like Canonical it is shared by every
+// copy of the options, so workers add to it concurrently; lines that
+// parse never touch it.
+type Malformed struct {
+	Keep int // examples kept
+
+	lines    atomic.Int64
+	mu       sync.Mutex
+	examples []MalformedLine
+}
+
+// MalformedLine is an example of a line that failed to parse.
+type MalformedLine struct {
+	Text string // the trimmed line, cut to 80 bytes
+	Err  error
+}
+
+// Add notes a trimmed line that failed to parse with err. It does nothing
+// on a nil Malformed or for a comment line or filtered address.
+func (m *Malformed) Add(line []byte, err error) {
+	if m == nil || Ignored(err) {
+		return
+	}
+	if m.lines.Add(1) > int64(m.Keep) {
+		return
+	}
+	m.mu.Lock()
+	m.examples = append(m.examples, MalformedLine{Text: string(line[:min(len(line), malformedLen)]), Err: err})
+	m.mu.Unlock()
+}
+
+// Lines returns how many lines failed to parse, 0 for a nil Malformed.
+func (m *Malformed) Lines() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.lines.Load()
+}
+
+// Examples returns the examples kept. Workers add them as they come, so
+// with several they need not be the first lines of the input.
+func (m *Malformed) Examples() []MalformedLine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MalformedLine(nil), m.examples...)
+}
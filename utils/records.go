@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// RecordReader reads a stream of packed fixed-size records, such as
+// 4-byte addresses, in chunks holding only whole records. Chunk buffers
+// are pooled like ChunkReader's and come back through Release.
+type RecordReader struct {
+	r       io.Reader
+	recSize int
+	pool    sync.Pool
+	partial int   // bytes of a trailing incomplete record
+	err     error // sticky error
+	pos     int64 // stream bytes read so far
+}
+
+// NewRecordReader returns a RecordReader reading chunks of about size
+// bytes, rounded down to whole records of recSize bytes, from r.
+func NewRecordReader(r io.Reader, size, recSize int) *RecordReader {
+	size = max(size/recSize, 1) * recSize
+	rr := &RecordReader{r: r, recSize: recSize}
+	rr.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return rr
+}
+
+// Next returns the next chunk of whole records. It returns io.EOF after
+// the last chunk, or the first read error. Bytes after the last whole
+// record are left out and reported by Partial.
+func (rr *RecordReader) Next() (Chunk, error) {
+	if rr.err != nil {
+		return Chunk{}, rr.err
+	}
+	bp := rr.pool.Get().(*[]byte)
+	n, err := io.ReadFull(rr.r, *bp)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		rr.partial = n % rr.recSize
+		n -= rr.partial
+		err = io.EOF
+	}
+	if err != nil {
+		rr.err = err
+	}
+	if n == 0 {
+		rr.Release(Chunk{buf: bp})
+		return Chunk{}, rr.err
+	}
+	c := Chunk{Data: (*bp)[:n], Offset: rr.pos, buf: bp}
+	rr.pos += int64(n)
+	return c, nil
+}
+
+// Release returns c's buffer to the pool once its records are processed.
+func (rr *RecordReader) Release(c Chunk) {
+	if c.buf != nil {
+		rr.pool.Put(c.buf)
+	}
+}
+
+// Partial returns the length of the incomplete record the stream ended
+// with, 0 if it ended on a record boundary.
+func (rr *RecordReader) Partial() int {
+	return rr.partial
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Normalized counts what ParseOptions.Relaxed cleaned up, one count for
+// each piece of framing removed, to show how dirty a feed is. Like
+// Comments it is shared by every copy of the options, so workers add to
+// it concurrently; clean lines touch none of the counters.
+type Normalized struct {
+	Indented  atomic.Int64 // leading or trailing whitespace, such as tab indentation, trimmed
+	Blank     atomic.Int64 // whitespace-only lines skipped, such as those of a double-spaced dump
+	Quoted    atomic.Int64 // surrounding "..." or '...' removed
+	Bracketed atomic.Int64 // surrounding [...] removed
+}
+
+// Trim returns raw without surrounding whitespace, as every engine reads
+// a line. With o.Relaxed set it also counts the lines that had any beyond
+// their line ending, and those that had nothing else, and with o.Lines
+// every line.
+func (o ParseOptions) Trim(raw []byte) []byte {
+	if o.Lines != nil {
+		o.Lines.Add(1)
+	}
+	line := bytes.TrimSpace(raw)
+	if o.Relaxed != nil {
+		o.Relaxed.trimmed(raw, line)
+	}
+	return line
+}
+
+func (n *Normalized) trimmed(raw, line []byte) {
+	if len(line) == 0 {
+		n.Blank.Add(1)
+		return
+	}
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	raw = bytes.TrimSuffix(raw, []byte("\r"))
+	if len(raw) != len(line) {
+		n.Indented.Add(1)
+	}
+}
+
+// unwrap strips the matching quotes or brackets around a trimmed line,
+// and the whitespace inside them, as often as they nest: `"1.2.3.4"`,
+// `[1.2.3.4]` and `[ '1.2.3.4' ]` all come out as 1.2.3.4, with the Form
+// bits of what was removed. It slices line rather than copying it.
+func (n *Normalized) unwrap(line []byte) ([]byte, Form) {
+	var form Form
+	for len(line) >= 2 {
+		first, last := line[0], line[len(line)-1]
+		switch {
+		case (first == '"' || first == '\'') && last == first:
+			n.Quoted.Add(1)
+			form |= FormQuoted
+		case first == '[' && last == ']':
+			n.Bracketed.Add(1)
+			form |= FormBracketed
+		default:
+			return line, form
+		}
+		line = bytes.TrimSpace(line[1 : len(line)-1])
+	}
+	return line, form
+}
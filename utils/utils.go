@@ -1,160 +1,506 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"strings"
+	"sync/atomic"
 )
 
-func IPToUint32(ipStr string) (uint32, error) {
-	ip := net.ParseIP(strings.TrimSpace(ipStr)).To4()
-	if ip == nil {
-		return 0, fmt.Errorf("invalid IPv4 address: %s", ipStr)
+// ParseOptions selects which textual variants are accepted on top of
+// plain dotted-quad IPv4. The zero value accepts dotted-quad only.
+type ParseOptions struct {
+	Format    IPFormat // textual encoding of each address
+	StripPort bool     // accept a single trailing ":port" suffix
+	Lenient   bool     // accept leading zeros in octets as decimal
+	Mapped    bool     // accept "::ffff:a.b.c.d" and "::ffff:0:a.b.c.d"
+
+	// CIDR makes ParseBlock accept "a.b.c.d/len" blocks, meaning every
+	// address in them was seen. Blocks shorter than MinPrefix (0 for
+	// DefaultMinPrefix) are rejected with ErrBlockTooLarge, so a stray
+	// "0.0.0.0/0" does not mark the whole address space.
+	CIDR      bool
+	MinPrefix int
+
+	// CommentPrefix makes ParseBlock reject lines starting with it with
+	// ErrComment, "" to treat them as any other line. InlineComments also
+	// cuts each line at its first CommentPrefix (DefaultCommentPrefix if
+	// unset) outside quotes. Comments, if set, counts the comment lines;
+	// it is shared by every copy of the options, so workers add to it
+	// concurrently.
+	CommentPrefix  string
+	InlineComments bool
+	Comments       *atomic.Int64
+
+	// Relaxed, if set, makes ParseBlock strip quotes and brackets around
+	// the address, as in `"1.2.3.4"` or `[1.2.3.4]`, and Trim count the
+	// indented and blank lines, all of it added up there. Nil parses
+	// exactly as before.
+	Relaxed *Normalized
+
+	// Canon, if set, makes ParseForm work out the Form of each address
+	// for engines to tally there. Nil keeps ParseForm to ParseBlock.
+	Canon *Canonical
+
+	// Lines, if set, counts every line Trim is given, that is every line
+	// read but those too long to parse, for a unique ratio. It is shared
+	// like Comments; nil, as usual, keeps the atomic add off each line.
+	Lines *atomic.Int64
+
+	// Malformed, if set, counts the lines the engines skip for failing to
+	// parse and keeps a few of them, for -strict. Nil, as usual, costs
+	// nothing.
+	Malformed *Malformed
+
+	// Extract, if set, picks the address out of each line before it is
+	// parsed, as from a column of a CSV or a field of JSON events; lines
+	// it finds none in fail with ErrNoAddress. Comments are skipped
+	// before it, and quotes and brackets removed by Relaxed after it.
+	Extract Extractor
+
+	// Filter, if set, makes ParseBlock reject the addresses outside it
+	// with ErrFiltered, and blocks partly outside it with
+	// ErrBlockFiltered. Engines that parse lines in one pass check it with
+	// Allow.
+	Filter *Filter
+
+	// RecordSep is the byte that ends each record, "" for a newline. With
+	// another separator, such as "\x00" or ";", a newline is just
+	// whitespace around a record.
+	RecordSep string
+}
+
+// Delim returns the byte records end in.
+func (o ParseOptions) Delim() byte {
+	if o.RecordSep == "" {
+		return '\n'
 	}
+	return o.RecordSep[0]
+}
 
-	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3]), nil
+// DefaultMinPrefix is the shortest CIDR prefix ParseBlock accepts by
+// default: a /16, 65536 addresses.
+const DefaultMinPrefix = 16
+
+// ErrBlockTooLarge is returned by ParseBlock for blocks shorter than the
+// configured minimum prefix.
+var ErrBlockTooLarge = errors.New("cidr block too large")
+
+// IPFormat is the textual encoding of addresses in the input.
+type IPFormat int
+
+const (
+	FormatDotted IPFormat = iota // a.b.c.d
+	FormatInt                    // decimal uint32, e.g. 3405803777
+	FormatHex                    // hex uint32, e.g. 0xCB007101
+	FormatAuto                   // dotted-quad, or integer when the line has no dot
+)
+
+// ParseIPFormat maps a -ip-format flag value to an IPFormat.
+func ParseIPFormat(s string) (IPFormat, error) {
+	switch s {
+	case "", "dotted":
+		return FormatDotted, nil
+	case "int":
+		return FormatInt, nil
+	case "hex":
+		return FormatHex, nil
+	case "auto":
+		return FormatAuto, nil
+	}
+	return 0, fmt.Errorf("unknown ip format: %s", s)
 }
 
-func ParseIPv4(b []byte) (uint32, error) {
-	var ip, part uint32
-	pos := 0
+// Parse parses an already trimmed line according to o.
+func (o ParseOptions) Parse(b []byte) (uint32, error) {
+	switch o.Format {
+	case FormatInt:
+		return ParseIPv4Int(b)
+	case FormatHex:
+		return ParseIPv4Hex(b)
+	case FormatAuto:
+		if bytes.IndexByte(b, '.') < 0 {
+			if len(b) > 2 && b[0] == '0' && (b[1] == 'x' || b[1] == 'X') {
+				return ParseIPv4Hex(b)
+			}
+			return ParseIPv4Int(b)
+		}
+	}
+	if o.Mapped {
+		b = StripMappedPrefix(b)
+	}
+	if o.StripPort {
+		var err error
+		if b, err = stripPort(b); err != nil {
+			return 0, err
+		}
+	}
+	return parseIPv4(b, o.Lenient)
+}
 
-	// Octet 1 (1-3 digits)
-	if pos >= len(b) {
-		return 0, errors.New("too short")
+// ParseBlock parses an already trimmed line into the inclusive range of
+// addresses it stands for: a single address, or with o.CIDR the block of
+// an "a.b.c.d/len" line, whose host bits are ignored.
+func (o ParseOptions) ParseBlock(b []byte) (first, last uint32, err error) {
+	return o.parseBlock(b, nil)
+}
+
+// ParseForm is ParseBlock for line, trimmed from raw by Trim, that with
+// o.Canon set also returns the Form the address was written in. Without
+// it the form is 0 and nothing beyond ParseBlock is done.
+func (o ParseOptions) ParseForm(raw, line []byte) (first, last uint32, form Form, err error) {
+	if o.Canon == nil {
+		first, last, err = o.ParseBlock(line)
+		return first, last, 0, err
 	}
-	c := b[pos]
-	if c < '0' || c > '9' {
-		return 0, errors.New("invalid digit")
+	if first, last, err = o.parseBlock(line, &form); err != nil {
+		return 0, 0, 0, err
 	}
-	part = uint32(c - '0')
-	pos++
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	if raw = bytes.TrimSuffix(raw, []byte("\r")); len(raw) != len(line) {
+		form |= FormSpace
+	}
+	return first, last, form, nil
+}
 
-	if pos < len(b) {
-		c = b[pos]
-		if c >= '0' && c <= '9' {
-			part = part*10 + uint32(c-'0')
-			pos++
-			if pos < len(b) {
-				c = b[pos]
-				if c >= '0' && c <= '9' {
-					part = part*10 + uint32(c-'0')
-					if part > 255 {
-						return 0, errors.New("invalid octet")
-					}
-					pos++
-				}
-			}
+// parseBlock is ParseBlock, adding the Form of the address to form if set.
+func (o ParseOptions) parseBlock(b []byte, form *Form) (first, last uint32, err error) {
+	if o.hasComments() {
+		var ok bool
+		if b, ok = o.stripComment(b); !ok {
+			return 0, 0, ErrComment
 		}
 	}
-	ip = part
-	if pos >= len(b) || b[pos] != '.' {
-		return 0, errors.New("expected dot")
+	if o.Extract != nil {
+		var ok bool
+		if b, ok = o.Extract(b); !ok {
+			return 0, 0, ErrNoAddress
+		}
+		b = bytes.TrimSpace(b)
+	}
+	if o.Relaxed != nil {
+		var f Form
+		b, f = o.Relaxed.unwrap(b)
+		if form != nil {
+			*form |= f
+		}
+	}
+	addr := b
+	if o.CIDR {
+		if a, length, ok := bytes.Cut(b, []byte("/")); ok {
+			addr = a
+			first, last, err = o.parseCIDR(a, length)
+		} else {
+			first, err = o.Parse(b)
+			last = first
+		}
+	} else {
+		first, err = o.Parse(b)
+		last = first
+	}
+	if err == nil && o.Filter != nil {
+		err = o.Filter.check(first, last)
 	}
-	pos++
-	part = 0
+	if err == nil && form != nil {
+		*form |= o.addrForm(addr)
+	}
+	return first, last, err
+}
 
-	// Octet 2 (1-3 digits)
-	if pos >= len(b) {
-		return 0, errors.New("too short")
+// parseCIDR parses the address and prefix length of a CIDR block.
+func (o ParseOptions) parseCIDR(addr, length []byte) (first, last uint32, err error) {
+	ip, err := o.Parse(addr)
+	if err != nil {
+		return 0, 0, err
 	}
-	c = b[pos]
-	if c < '0' || c > '9' {
-		return 0, errors.New("invalid digit")
+	bits := 0
+	for _, c := range length {
+		if c < '0' || c > '9' || bits > 32 {
+			return 0, 0, fmt.Errorf("invalid prefix length %q", length)
+		}
+		bits = bits*10 + int(c-'0')
+	}
+	if len(length) == 0 || bits > 32 {
+		return 0, 0, fmt.Errorf("invalid prefix length %q", length)
 	}
-	part = uint32(c - '0')
-	pos++
+	if min := cmp.Or(o.MinPrefix, DefaultMinPrefix); bits < min {
+		return 0, 0, fmt.Errorf("%w: /%d is shorter than /%d", ErrBlockTooLarge, bits, min)
+	}
+	host := uint32(math.MaxUint32) >> bits // 0 for a /32
+	return ip &^ host, ip | host, nil
+}
 
-	if pos < len(b) {
-		c = b[pos]
-		if c >= '0' && c <= '9' {
-			part = part*10 + uint32(c-'0')
-			pos++
-			if pos < len(b) {
-				c = b[pos]
-				if c >= '0' && c <= '9' {
-					part = part*10 + uint32(c-'0')
-					if part > 255 {
-						return 0, errors.New("invalid octet")
-					}
-					pos++
-				}
-			}
+// ParseIPv4HostPort parses "a.b.c.d" optionally followed by ":port",
+// where port is 0-65535. Anything else after the address is rejected.
+func ParseIPv4HostPort(b []byte) (uint32, error) {
+	b, err := stripPort(b)
+	if err != nil {
+		return 0, err
+	}
+	return ParseIPv4(b)
+}
+
+// stripPort removes a ":port" suffix if present.
+func stripPort(b []byte) ([]byte, error) {
+	if i := bytes.IndexByte(b, ':'); i >= 0 {
+		if !validPort(b[i+1:]) {
+			return nil, ErrInvalidPort
 		}
+		return b[:i], nil
+	}
+	return b, nil
+}
+
+// StripMappedPrefix removes an IPv4-mapped ("::ffff:") or IPv4-translated
+// ("::ffff:0:") IPv6 prefix so the embedded dotted-quad can be parsed into
+// the same uint32 space. Other IPv6 forms are returned unchanged and will
+// fail IPv4 parsing.
+func StripMappedPrefix(b []byte) []byte {
+	if len(b) < 7 || b[0] != ':' || b[1] != ':' || !bytes.EqualFold(b[2:6], []byte("ffff")) || b[6] != ':' {
+		return b
+	}
+	rest := b[7:]
+	if len(rest) > 2 && rest[0] == '0' && rest[1] == ':' {
+		rest = rest[2:]
 	}
-	ip = (ip << 8) | part
-	if pos >= len(b) || b[pos] != '.' {
-		return 0, errors.New("expected dot")
+	if bytes.IndexByte(rest, ':') >= 0 {
+		return b // general IPv6 tail, not an embedded IPv4
 	}
-	pos++
-	part = 0
+	return rest
+}
 
-	// Octet 3 (1-3 digits)
-	if pos >= len(b) {
-		return 0, errors.New("too short")
+// validPort reports whether p is a decimal port number in 0-65535.
+func validPort(p []byte) bool {
+	if len(p) == 0 || len(p) > 5 {
+		return false
 	}
-	c = b[pos]
-	if c < '0' || c > '9' {
-		return 0, errors.New("invalid digit")
+	n := 0
+	for _, c := range p {
+		if c < '0' || c > '9' {
+			return false
+		}
+		n = n*10 + int(c-'0')
 	}
-	part = uint32(c - '0')
-	pos++
+	return n <= 65535
+}
 
-	if pos < len(b) {
-		c = b[pos]
-		if c >= '0' && c <= '9' {
-			part = part*10 + uint32(c-'0')
-			pos++
-			if pos < len(b) {
-				c = b[pos]
-				if c >= '0' && c <= '9' {
-					part = part*10 + uint32(c-'0')
-					if part > 255 {
-						return 0, errors.New("invalid octet")
+func IPToUint32(ipStr string) (uint32, error) {
+	ip := net.ParseIP(strings.TrimSpace(ipStr)).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IPv4 address: %s", ipStr)
+	}
+
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3]), nil
+}
+
+// Parse errors returned by ParseIPv4 and its variants. They are sentinel
+// values so callers can categorize bad lines with errors.Is.
+var (
+	ErrEmpty         = errors.New("empty address")
+	ErrInvalidChar   = errors.New("invalid character")
+	ErrEmptyOctet    = errors.New("empty octet")
+	ErrTooFewOctets  = errors.New("too few octets")
+	ErrTooManyOctets = errors.New("too many octets")
+	ErrOctetRange    = errors.New("octet out of range")
+	ErrLeadingZero   = errors.New("leading zero in octet")
+	ErrInvalidPort   = errors.New("invalid port")
+	ErrIntRange      = errors.New("integer address out of range")
+)
+
+// ParseIPv4 parses a strict dotted-quad: exactly four decimal octets of
+// 1-3 digits, each <= 255, with no leading zeros ("010" is rejected rather
+// than guessing between octal and decimal).
+func ParseIPv4(b []byte) (uint32, error) {
+	return parseIPv4(b, false)
+}
+
+// ParseIPv4Fast is ParseIPv4 for callers that only need to know whether b
+// is an address, such as a hot loop that counts the rest: it accepts the
+// same addresses but reports false instead of working out an error, and
+// does not allocate.
+func ParseIPv4Fast(b []byte) (uint32, bool) {
+	return parseIPv4Fast(b, false)
+}
+
+// ParseIPv4Lenient is like ParseIPv4 but accepts leading zeros, reading
+// them as decimal ("010.1.1.1" is 10.1.1.1).
+func ParseIPv4Lenient(b []byte) (uint32, error) {
+	return parseIPv4(b, true)
+}
+
+// parseIPv4 tries the fast path first; anything it turns down goes
+// through the general loop, which also works out the error.
+func parseIPv4(b []byte, lenient bool) (uint32, error) {
+	if ip, ok := parseIPv4Fast(b, lenient); ok {
+		return ip, nil
+	}
+	return parseIPv4Slow(b, lenient)
+}
+
+// parseIPv4Fast parses the well-formed case: 7 to 15 bytes of four 1-3
+// digit octets joined by dots. Each octet is read with at most three
+// unsigned digit checks, so a valid address costs about one comparison
+// per byte and no loop bookkeeping. It reports false for anything else,
+// including every invalid address, without saying why.
+func parseIPv4Fast(b []byte, lenient bool) (uint32, bool) {
+	if len(b) < 7 || len(b) > 15 {
+		return 0, false
+	}
+	var ip uint32
+	i := 0
+	for k := 0; k < 4; k++ {
+		if i >= len(b) {
+			return 0, false
+		}
+		first := uint32(b[i]) - '0' // wraps for bytes below '0'
+		if first > 9 {
+			return 0, false
+		}
+		v, n := first, 1
+		if i+1 < len(b) {
+			if d := uint32(b[i+1]) - '0'; d <= 9 {
+				v, n = v*10+d, 2
+				if i+2 < len(b) {
+					if d := uint32(b[i+2]) - '0'; d <= 9 {
+						v, n = v*10+d, 3
 					}
-					pos++
 				}
 			}
 		}
+		if v > 255 || (!lenient && n > 1 && first == 0) {
+			return 0, false
+		}
+		ip = ip<<8 | v
+		i += n
+		if k < 3 {
+			if i >= len(b) || b[i] != '.' {
+				return 0, false
+			}
+			i++
+		}
 	}
-	ip = (ip << 8) | part
-	if pos >= len(b) || b[pos] != '.' {
-		return 0, errors.New("expected dot")
+	return ip, i == len(b)
+}
+
+// parseIPv4Slow parses any input byte by byte and returns the sentinel
+// error for the first thing wrong with it.
+func parseIPv4Slow(b []byte, lenient bool) (uint32, error) {
+	if len(b) == 0 {
+		return 0, ErrEmpty
 	}
-	pos++
-	part = 0
+	var ip uint32
+	octets, pos := 0, 0
+	for {
+		start := pos
+		var part uint32
+		for pos < len(b) && b[pos] >= '0' && b[pos] <= '9' {
+			if pos-start == 3 {
+				return 0, ErrOctetRange // 4+ digits can't be <= 255
+			}
+			part = part*10 + uint32(b[pos]-'0')
+			pos++
+		}
+		if pos == start {
+			if pos < len(b) && b[pos] != '.' {
+				return 0, ErrInvalidChar
+			}
+			return 0, ErrEmptyOctet
+		}
+		if part > 255 {
+			return 0, ErrOctetRange
+		}
+		if !lenient && pos-start > 1 && b[start] == '0' {
+			return 0, ErrLeadingZero
+		}
+		ip = ip<<8 | part
+		octets++
 
-	// Octet 4 (1-3 digits, no trailing dot)
-	if pos >= len(b) {
-		return 0, errors.New("too short")
+		if pos == len(b) {
+			break
+		}
+		if b[pos] != '.' {
+			return 0, ErrInvalidChar
+		}
+		if octets == 4 {
+			return 0, ErrTooManyOctets
+		}
+		pos++
 	}
-	c = b[pos]
-	if c < '0' || c > '9' {
-		return 0, errors.New("invalid digit")
+	if octets < 4 {
+		return 0, ErrTooFewOctets
 	}
-	part = uint32(c - '0')
-	pos++
+	return ip, nil
+}
 
-	if pos < len(b) {
-		c = b[pos]
-		if c >= '0' && c <= '9' {
-			part = part*10 + uint32(c-'0')
-			pos++
-			if pos < len(b) {
-				c = b[pos]
-				if c >= '0' && c <= '9' {
-					part = part*10 + uint32(c-'0')
-					if part > 255 {
-						return 0, errors.New("invalid octet")
-					}
-					pos++
-				}
-			}
+// ParseIPv4Int parses an address written as a decimal integer in [0, 2^32).
+func ParseIPv4Int(b []byte) (uint32, error) {
+	if len(b) == 0 {
+		return 0, ErrEmpty
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidChar
 		}
+		n = n*10 + uint64(c-'0')
+		if n > math.MaxUint32 {
+			return 0, ErrIntRange
+		}
+	}
+	return uint32(n), nil
+}
+
+// ParseIPv4Hex parses an address written as a hex integer with an
+// optional 0x prefix, e.g. "0xCB007101".
+func ParseIPv4Hex(b []byte) (uint32, error) {
+	if len(b) > 2 && b[0] == '0' && (b[1] == 'x' || b[1] == 'X') {
+		b = b[2:]
 	}
-	if pos != len(b) {
-		return 0, errors.New("extra data")
+	if len(b) == 0 {
+		return 0, ErrEmpty
 	}
-	return (ip << 8) | part, nil
-}
\ No newline at end of file
+	var n uint64
+	for _, c := range b {
+		var d byte
+		switch {
+		case c >= '0' && c <= '9':
+			d = c - '0'
+		case c >= 'a' && c <= 'f':
+			d = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			d = c - 'A' + 10
+		default:
+			return 0, ErrInvalidChar
+		}
+		n = n<<4 | uint64(d)
+		if n > math.MaxUint32 {
+			return 0, ErrIntRange
+		}
+	}
+	return uint32(n), nil
+}
+
+// utf8BOM is the byte order mark some Windows tools prepend to text files.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// SkipBOM discards a UTF-8 byte order mark at the current position of r
+// and returns the number of bytes skipped. Lines are trimmed with
+// bytes.TrimSpace, which already covers "\r" from CRLF endings and Unicode
+// spaces such as U+00A0, so the BOM is the only framing artifact that needs
+// separate handling.
+func SkipBOM(r *bufio.Reader) (int, error) {
+	head, err := r.Peek(len(utf8BOM))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return 0, err
+	}
+	if bytes.Equal(head, utf8BOM) {
+		return r.Discard(len(utf8BOM))
+	}
+	return 0, nil
+}
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseIPv4(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string // "" when invalid
+		err     error
+		lenient string // the lenient result, if it differs
+	}{
+		{"0.0.0.0", "0.0.0.0", nil, ""},
+		{"255.255.255.255", "255.255.255.255", nil, ""},
+		{"1.2.3.4", "1.2.3.4", nil, ""},
+		{"01.2.3.4", "", ErrLeadingZero, "1.2.3.4"},
+		{"1.2.3.004", "", ErrLeadingZero, "1.2.3.4"},
+		{"000.000.000.000", "", ErrLeadingZero, "0.0.0.0"},
+		{"999.1.1.1", "", ErrOctetRange, ""},
+		{"256.1.1.1", "", ErrOctetRange, ""},
+		{"1.1.1.1000", "", ErrOctetRange, ""},
+		{"1.2.3", "", ErrTooFewOctets, ""},
+		{"1.2.3.4.5", "", ErrTooManyOctets, ""},
+		{"1.2.3.4.", "", ErrTooManyOctets, ""},
+		{"1..3.4", "", ErrEmptyOctet, ""},
+		{".1.2.3", "", ErrEmptyOctet, ""},
+		{"", "", ErrEmpty, ""},
+		{" 1.2.3.4", "", ErrInvalidChar, ""},
+		{"1.2.3.4 ", "", ErrInvalidChar, ""},
+		{"+1.2.3.4", "", ErrInvalidChar, ""},
+		{"1.2.3.-4", "", ErrInvalidChar, ""},
+		{"1.2.3.4x", "", ErrInvalidChar, ""},
+	} {
+		ip, err := ParseIPv4([]byte(tc.in))
+		if got := formatOK(ip, err == nil); got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%q: %q, %v; want %q, %v", tc.in, got, err, tc.want, tc.err)
+		}
+		fast, ok := ParseIPv4Fast([]byte(tc.in))
+		if got := formatOK(fast, ok); got != tc.want {
+			t.Errorf("fast %q: %q, want %q", tc.in, got, tc.want)
+		}
+		want := tc.want
+		if tc.lenient != "" {
+			want = tc.lenient
+		}
+		ip, err = ParseIPv4Lenient([]byte(tc.in))
+		if got := formatOK(ip, err == nil); got != want {
+			t.Errorf("lenient %q: %q, %v; want %q", tc.in, got, err, want)
+		}
+	}
+}
+
+// Every address of one to four octets drawn from tricky spellings, and of
+// five from a few, parses through the fast and slow paths and through
+// ParseOptions, strict and lenient, as the reference does, and fails with
+// one of the typed errors.
+func TestParseIPv4Exhaustive(t *testing.T) {
+	tricky := []string{"", "0", "00", "000", "0000", "01", "001", "010", "1", "9", "10", "99", "199",
+		"255", "256", "300", "999", "1000", "x", " 1", "+1"}
+	typed := []error{ErrEmpty, ErrInvalidChar, ErrEmptyOctet, ErrTooFewOctets, ErrTooManyOctets, ErrOctetRange, ErrLeadingZero}
+	check := func(s string) {
+		lenientWant, lenientOK := lenientIPv4(s)
+		strictOK := lenientOK
+		for _, p := range strings.Split(s, ".") {
+			strictOK = strictOK && (len(p) == 1 || p[0] != '0')
+		}
+		for _, lenient := range []bool{false, true} {
+			want, ok := lenientWant, lenientOK
+			if !lenient {
+				ok = strictOK
+			}
+			fast, fastOK := parseIPv4Fast([]byte(s), lenient)
+			slow, err := parseIPv4Slow([]byte(s), lenient)
+			parsed, perr := ParseOptions{Lenient: lenient}.Parse([]byte(s))
+			switch {
+			case fastOK != ok || ok && fast != want:
+				t.Fatalf("fast %q (lenient %v): %s, %v; want %s, %v", s, lenient, FormatIPv4(fast), fastOK, FormatIPv4(want), ok)
+			case (err == nil) != ok || ok && slow != want:
+				t.Fatalf("slow %q (lenient %v): %s, %v; want %s, %v", s, lenient, FormatIPv4(slow), err, FormatIPv4(want), ok)
+			case (perr == nil) != ok || ok && parsed != want || !errors.Is(perr, err):
+				t.Fatalf("ParseOptions %q (lenient %v): %s, %v; slow path %v", s, lenient, FormatIPv4(parsed), perr, err)
+			case err != nil && !slices.ContainsFunc(typed, func(e error) bool { return errors.Is(err, e) }):
+				t.Fatalf("%q (lenient %v): untyped error %v", s, lenient, err)
+			}
+		}
+	}
+	var parts []string
+	var walk func(octets int, from []string)
+	walk = func(octets int, from []string) {
+		if octets == 0 {
+			check(strings.Join(parts, "."))
+			return
+		}
+		for _, p := range from {
+			parts = append(parts, p)
+			walk(octets-1, from)
+			parts = parts[:len(parts)-1]
+		}
+	}
+	for octets := 1; octets <= 4; octets++ {
+		walk(octets, tricky)
+	}
+	walk(5, []string{"0", "1", "01", "255", "256"})
+}
+
+// A single trailing ":port" of 0-65535 is stripped with StripPort, and
+// only then; a missing or out-of-range port, a second colon and bracketed
+// or IPv6-looking hosts are rejected.
+func TestParseIPv4HostPort(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string // "" when invalid
+		err  error
+	}{
+		{"1.2.3.4", "1.2.3.4", nil},
+		{"1.2.3.4:0", "1.2.3.4", nil},
+		{"1.2.3.4:80", "1.2.3.4", nil},
+		{"255.255.255.255:65535", "255.255.255.255", nil},
+		{"1.2.3.4:00080", "1.2.3.4", nil},
+		{"1.2.3.4:", "", ErrInvalidPort},
+		{"1.2.3.4:65536", "", ErrInvalidPort},
+		{"1.2.3.4:99999", "", ErrInvalidPort},
+		{"1.2.3.4:123456", "", ErrInvalidPort},
+		{"1.2.3.4:-1", "", ErrInvalidPort},
+		{"1.2.3.4: 80", "", ErrInvalidPort},
+		{"1.2.3.4:80:90", "", ErrInvalidPort},
+		{"1.2.3.4:http", "", ErrInvalidPort},
+		{":80", "", ErrEmpty},
+		{":::80", "", ErrInvalidPort},
+		{"[1.2.3.4]:80", "", ErrInvalidChar},
+		{"[::1]:80", "", ErrInvalidPort},
+		{"[::ffff:1.2.3.4]:80", "", ErrInvalidPort},
+		{"01.2.3.4:80", "", ErrLeadingZero},
+	} {
+		ip, err := ParseIPv4HostPort([]byte(tc.in))
+		if got := formatOK(ip, err == nil); got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%q: %q, %v; want %q, %v", tc.in, got, err, tc.want, tc.err)
+		}
+		ip, err = ParseOptions{StripPort: true}.Parse([]byte(tc.in))
+		if got := formatOK(ip, err == nil); got != tc.want {
+			t.Errorf("StripPort %q: %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+		if _, err := (ParseOptions{}).Parse([]byte(tc.in)); err == nil && tc.in != "1.2.3.4" {
+			t.Errorf("%q accepted without StripPort", tc.in)
+		}
+	}
+	o := ParseOptions{StripPort: true}
+	for port := range 65536 {
+		line := []byte("10.20.30.40:" + strconv.Itoa(port))
+		if ip, err := o.Parse(line); err != nil || ip != 10<<24|20<<16|30<<8|40 {
+			t.Fatalf("%s: %s, %v", line, FormatIPv4(ip), err)
+		}
+	}
+}
+
+func formatOK(ip uint32, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return FormatIPv4(ip)
+}
+
+// lenientIPv4 parses four dot-separated octets of 1-3 decimal digits
+// each, the reference ParseIPv4Lenient is fuzzed against.
+func lenientIPv4(s string) (uint32, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return 0, false
+	}
+	var ip uint32
+	for _, p := range parts {
+		if len(p) < 1 || len(p) > 3 || strings.Trim(p, "0123456789") != "" {
+			return 0, false
+		}
+		v, _ := strconv.Atoi(p)
+		if v > 255 {
+			return 0, false
+		}
+		ip = ip<<8 | uint32(v)
+	}
+	return ip, true
+}
+
+// ParseIPv4 and ParseIPv4Fast accept exactly the addresses net/netip
+// does, leading zeros, whitespace and octets past 255 being errors, and
+// ParseIPv4Lenient those with leading zeros as well.
+func FuzzParseIPv4(f *testing.F) {
+	for _, s := range []string{
+		"1.2.3.4", "0.0.0.0", "255.255.255.255", "01.2.3.4", "00.0.0.0", "1.2.3.04",
+		"999.1.1.1", "256.256.256.256", "1.2.3.1000", "1.2.3", "1.2.3.4.5", "1.2.3.4.",
+		"1..3.4", " 1.2.3.4", "1.2.3.4\n", "1.2.3.4\r", "１.2.3.4", "1.2.3.4:80", "::ffff:1.2.3.4",
+		"4294967295", "0x1.2.3.4", "1.2.3.+4", "",
+	} {
+		f.Add(s)
+	}
+	rng := rand.New(rand.NewPCG(5, 6))
+	for range 64 {
+		f.Add(fmt.Sprintf("%0*d.%d.%d.%d", rng.IntN(4), rng.IntN(300), rng.IntN(300), rng.IntN(300), rng.IntN(1100)))
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		a, err := netip.ParseAddr(s)
+		valid := err == nil && a.Is4()
+		ip, err := ParseIPv4([]byte(s))
+		if (err == nil) != valid || valid && netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}) != a {
+			t.Errorf("ParseIPv4(%q) = %s, %v; netip: %v", s, FormatIPv4(ip), err, a)
+		}
+		if fast, ok := ParseIPv4Fast([]byte(s)); ok != (err == nil) || ok && fast != ip {
+			t.Errorf("ParseIPv4Fast(%q) = %s, %v; ParseIPv4: %s, %v", s, FormatIPv4(fast), ok, FormatIPv4(ip), err)
+		}
+		want, ok := lenientIPv4(s)
+		if ip, err := ParseIPv4Lenient([]byte(s)); (err == nil) != ok || ok && ip != want {
+			t.Errorf("ParseIPv4Lenient(%q) = %s, %v; want %s, %v", s, FormatIPv4(ip), err, FormatIPv4(want), ok)
+		}
+	})
+}
+
+func BenchmarkParseIPv4(b *testing.B) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	lines := make([][]byte, 4096)
+	var size int64
+	for i := range lines {
+		lines[i] = []byte(FormatIPv4(rng.Uint32()))
+		size += int64(len(lines[i]))
+	}
+	b.Run("fast", func(b *testing.B) {
+		b.SetBytes(size)
+		for range b.N {
+			for _, l := range lines {
+				ParseIPv4Fast(l)
+			}
+		}
+	})
+	b.Run("slow", func(b *testing.B) {
+		b.SetBytes(size)
+		for range b.N {
+			for _, l := range lines {
+				parseIPv4Slow(l, false)
+			}
+		}
+	})
+}
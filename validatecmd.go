@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	validateSamples   = 20          // invalid lines quoted per file
+	validateSampleLen = 80          // bytes of each quoted line
+	validateChunk     = 1024 * 1024 // read chunk size
+)
+
+// invalidLine is one line that failed to parse, numbered within its chunk
+// until the chunks are put back in order.
+type invalidLine struct {
+	line int64
+	text string
+	err  error
+}
+
+// chunkReport is what a validate worker found in one chunk.
+type chunkReport struct {
+	lines, parsed, blank, comments, oversized int64
+
+	minLen, maxLen int // raw length of non-blank lines, -1 before the first
+	invalid        []invalidLine
+	endsWithDelim  bool
+}
+
+// fileReport is the chunk reports of one file added up in input order.
+// Oversized lines count as invalid.
+type fileReport struct {
+	chunkReport
+	invalidTotal int64
+	empty        bool
+}
+
+// runValidate implements `ipcounter validate`: read each file through the
+// same chunked reader and parser as the engines, without counting, and
+// report how much of it parses. It fails if any file has more invalid
+// lines than -tolerance allows.
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	tolerance := fs.Float64("tolerance", 0, "fraction of non-blank lines allowed to fail to parse, e.g. 0.001")
+	ef := addEngineFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter validate [flags] <file>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *tolerance < 0 || *tolerance > 1 {
+		return fmt.Errorf("-tolerance must be between 0 and 1, got %g", *tolerance)
+	}
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	if opts.InputFormat != "text" {
+		return errors.New("validate reads text input only")
+	}
+
+	var failed []string
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return &counter.OpenError{Path: name, Err: err}
+		}
+		rep, err := validate(f, opts.Parse, opts.MaxLine)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if fs.NArg() > 1 {
+			fmt.Printf("%s:\n", name)
+		}
+		rep.print(opts.Parse.Delim())
+		checked := rep.lines - rep.blank - rep.comments
+		if rep.invalidTotal > 0 && float64(rep.invalidTotal) > *tolerance*float64(checked) {
+			failed = append(failed, name)
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s has more invalid lines than -tolerance %g allows", failed[0], *tolerance)
+	}
+	return fmt.Errorf("%d files have more invalid lines than -tolerance %g allows", len(failed), *tolerance)
+}
+
+// validate runs r through the parser on NumCPU workers and adds up their
+// reports in input order, so line numbers count from the start of r.
+// Lines the reader drops unbuffered for exceeding maxLine are only
+// counted, so the numbers of later lines are one short for each of them.
+func validate(r io.Reader, parse utils.ParseOptions, maxLine int) (fileReport, error) {
+	delim := parse.Delim()
+	cr := utils.NewDelimChunkReader(r, validateChunk, maxLine, delim)
+	maxLine = cmp.Or(maxLine, utils.DefaultMaxLine)
+
+	type job struct {
+		c   utils.Chunk
+		rep *chunkReport
+	}
+	jobs := make(chan job, runtime.NumCPU()*2)
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				validateChunkData(j.c.Data, parse, maxLine, delim, validateSamples, j.rep)
+				cr.Release(j.c)
+			}
+		}()
+	}
+
+	// Reports are kept in reading order; each is written by one worker
+	// and read only after they are all done
+	var reps []*chunkReport
+	var readErr error
+	for {
+		c, err := cr.Next()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		rep := &chunkReport{minLen: -1, maxLen: -1}
+		reps = append(reps, rep)
+		jobs <- job{c, rep}
+	}
+	close(jobs)
+	wg.Wait()
+	if readErr != nil {
+		return fileReport{}, counter.WrapRead("", readErr)
+	}
+
+	total := fileReport{chunkReport: chunkReport{minLen: -1, maxLen: -1}, empty: len(reps) == 0}
+	total.oversized = cr.Oversized()
+	for _, rep := range reps {
+		for _, bad := range rep.invalid {
+			if len(total.invalid) < validateSamples {
+				bad.line += total.lines
+				total.invalid = append(total.invalid, bad)
+			}
+		}
+		total.invalidTotal += rep.lines - rep.parsed - rep.blank - rep.comments
+		total.lines += rep.lines
+		total.parsed += rep.parsed
+		total.blank += rep.blank
+		total.comments += rep.comments
+		total.oversized += rep.oversized
+		if rep.minLen >= 0 && (total.minLen < 0 || rep.minLen < total.minLen) {
+			total.minLen = rep.minLen
+		}
+		total.maxLen = max(total.maxLen, rep.maxLen)
+		total.endsWithDelim = rep.endsWithDelim
+	}
+	total.lines += cr.Oversized()
+	total.invalidTotal += cr.Oversized()
+	return total, nil
+}
+
+// validateChunkData parses every line of data into rep, quoting the first
+// keep invalid ones.
+func validateChunkData(data []byte, parse utils.ParseOptions, maxLine int, delim byte, keep int, rep *chunkReport) {
+	rep.endsWithDelim = len(data) > 0 && data[len(data)-1] == delim
+	for len(data) > 0 {
+		var raw []byte
+		raw, data = utils.NextRecord(data, delim)
+		rep.lines++
+		if len(raw) > maxLine {
+			rep.oversized++
+			continue
+		}
+		line := bytes.TrimSpace(raw)
+		if len(line) == 0 {
+			rep.blank++
+			continue
+		}
+		if rep.minLen < 0 || len(raw) < rep.minLen {
+			rep.minLen = len(raw)
+		}
+		rep.maxLen = max(rep.maxLen, len(raw))
+		_, _, err := parse.ParseBlock(line)
+		switch {
+		case err == nil || errors.Is(err, utils.ErrFiltered):
+			// A filtered address is well formed
+			rep.parsed++
+		case errors.Is(err, utils.ErrComment):
+			rep.comments++
+		case len(rep.invalid) < keep:
+			text := string(line[:min(len(line), validateSampleLen)])
+			rep.invalid = append(rep.invalid, invalidLine{line: rep.lines, text: text, err: err})
+		}
+	}
+}
+
+// print writes the report to stdout as "key: value" lines.
+func (r fileReport) print(delim byte) {
+	fmt.Printf("lines: %d\n", r.lines)
+	fmt.Printf("parsed: %d\n", r.parsed)
+	fmt.Printf("invalid: %d (%d oversized)\n", r.invalidTotal, r.oversized)
+	fmt.Printf("blank: %d\n", r.blank)
+	if r.comments > 0 {
+		fmt.Printf("comments: %d\n", r.comments)
+	}
+	if r.minLen >= 0 {
+		fmt.Printf("line length: min %d, max %d bytes\n", r.minLen, r.maxLen)
+	}
+	ends := "ends with newline"
+	if delim != '\n' {
+		ends = fmt.Sprintf("ends with %q", delim)
+	}
+	switch {
+	case r.empty:
+		fmt.Printf("%s: empty file\n", ends)
+	case r.endsWithDelim:
+		fmt.Printf("%s: yes\n", ends)
+	default:
+		fmt.Printf("%s: no\n", ends)
+	}
+	if checked := r.lines - r.blank - r.comments; r.invalidTotal > 0 {
+		fmt.Printf("invalid share: %.4g%%\n", 100*float64(r.invalidTotal)/float64(checked))
+	}
+	for _, bad := range r.invalid {
+		fmt.Printf("  line %d: %q: %v\n", bad.line, bad.text, bad.err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Validating input of several read chunks adds up every kind of line
+// across them, numbers the quoted invalid lines from the start of the
+// input, leaves the oversized line out of the lengths, and notices the
+// missing final newline.
+func TestValidate(t *testing.T) {
+	const lines = 300000 // about 4 MB, so several chunks
+	var b strings.Builder
+	var wantBad []int64
+	blank, comments := int64(0), int64(0)
+	for i := int64(1); i <= lines; i++ {
+		switch {
+		case i%50000 == 7:
+			fmt.Fprintf(&b, "10.0.0.%d00\n", i%7+3) // out of range
+			wantBad = append(wantBad, i)
+		case i%1000 == 0:
+			b.WriteString("   \n")
+			blank++
+		case i%1000 == 1:
+			b.WriteString("# rotated\n")
+			comments++
+		default:
+			b.WriteString(utils.FormatIPv4(uint32(i)) + "\n")
+		}
+	}
+	b.WriteString(strings.Repeat("9", 600) + "\n") // over MaxLine
+	b.WriteString("10.1.1.1")
+
+	parse := utils.ParseOptions{CommentPrefix: "#"}
+	rep, err := validate(strings.NewReader(b.String()), parse, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := lines - int64(len(wantBad)) - blank - comments + 1
+	if rep.lines != lines+2 || rep.parsed != valid || rep.blank != blank || rep.comments != comments {
+		t.Errorf("%d lines, %d parsed, %d blank, %d comments; want %d, %d, %d, %d",
+			rep.lines, rep.parsed, rep.blank, rep.comments, lines+2, valid, blank, comments)
+	}
+	if rep.invalidTotal != int64(len(wantBad))+1 || rep.oversized != 1 {
+		t.Errorf("%d invalid, %d oversized; want %d, 1", rep.invalidTotal, rep.oversized, len(wantBad)+1)
+	}
+	var gotBad []int64
+	for _, bad := range rep.invalid {
+		gotBad = append(gotBad, bad.line)
+	}
+	if fmt.Sprint(gotBad) != fmt.Sprint(wantBad) {
+		t.Errorf("invalid lines quoted at %v, want %v", gotBad, wantBad)
+	}
+	if rep.endsWithDelim || rep.empty || rep.minLen != len("0.0.0.2") || rep.maxLen != len("0.4.147.224") {
+		t.Errorf("ends with newline %v, empty %v, line length %d to %d", rep.endsWithDelim, rep.empty, rep.minLen, rep.maxLen)
+	}
+
+	if rep, err := validate(strings.NewReader(""), parse, 0); err != nil || !rep.empty || rep.lines != 0 {
+		t.Errorf("empty input: %+v, %v", rep, err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+// pending is a candidate file not yet counted: its size and modification
+// time when last polled, and since when they have not changed.
+type pending struct {
+	size   int64
+	mtime  time.Time
+	stable time.Time
+}
+
+// runWatch implements `ipcounter watch`: poll a directory for files
+// matching a pattern and count each one into a state-file backed bitset
+// once it has stopped growing, logging how many of its addresses were new
+// and the running total. The names of counted files go to a list next to
+// the state file so a restart picks up where the last run stopped.
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to watch (required)")
+	pattern := fs.String("pattern", "*", "count only files whose name matches this glob, e.g. '*.log'")
+	interval := fs.Duration("interval", 2*time.Second, "how often to list the directory")
+	settle := fs.Duration("settle", 10*time.Second, "how long a file's size and modification time must stay unchanged before it is counted")
+	processed := fs.String("processed", "", "list of counted file names (default the -state-file path with .done appended)")
+	ef := addEngineFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter watch -dir DIR -state-file FILE [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dir == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if _, err := filepath.Match(*pattern, ""); err != nil {
+		return fmt.Errorf("-pattern %q: %w", *pattern, err)
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+	// The per-file lines are the output of watch, so they show by default
+	ef.logLevel = slog.LevelInfo
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	if opts.InputFormat == "pcap" || opts.InputFormat == "parquet" {
+		return fmt.Errorf("watch cannot read -input-format %s", opts.InputFormat)
+	}
+	// Without a persistent set, files skipped as done after a restart
+	// would be missing from the total
+	if opts.StateFile == "" {
+		return errors.New("watch needs -state-file to keep the set across restarts")
+	}
+	*processed = cmp.Or(*processed, opts.StateFile+".done")
+
+	done, err := readProcessed(*processed)
+	if err != nil {
+		return err
+	}
+	list, err := os.OpenFile(*processed, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("processed list: %w", err)
+	}
+	defer list.Close()
+
+	c, err := counter.NewWithOptions("concurrent", opts)
+	if err != nil {
+		return err
+	}
+	b := c.(*concurrent.BitsetCounter)
+	defer b.Close()
+
+	// The state file and the list may live in the watched directory
+	skip := map[string]bool{}
+	for _, p := range []string{opts.StateFile, *processed} {
+		if abs, err := filepath.Abs(p); err == nil {
+			skip[abs] = true
+		}
+	}
+
+	ctx := interruptContext()
+	countOpts := []ipcount.Option{
+		ipcount.WithEngine("concurrent"), ipcount.WithCounter(c), ipcount.WithOptions(opts),
+		ipcount.WithReadLimiter(counter.NewLimiter(opts.MaxReadRate)),
+	}
+	slog.Info("watching", "dir", *dir, "pattern", *pattern, "counted", len(done))
+	seen := map[string]*pending{}
+	for {
+		ready, err := pollDir(*dir, *pattern, *settle, done, skip, seen)
+		if err != nil {
+			return err
+		}
+		for _, name := range ready {
+			path := filepath.Join(*dir, name)
+			res, err := ipcount.Count(ctx, ipcount.File(path), countOpts...)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			// Recorded only once counted and synced; a crash in between
+			// counts the file again, which adds nothing to the set
+			if _, err := fmt.Fprintln(list, name); err != nil {
+				return fmt.Errorf("processed list: %w", err)
+			}
+			if err := list.Sync(); err != nil {
+				return fmt.Errorf("processed list: %w", err)
+			}
+			done[name] = true
+			delete(seen, name)
+			slog.Info("counted", "file", name, "new", res.Unique, "total", b.Count())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// pollDir lists dir and returns the names of files matching pattern that
+// are not done and whose size and modification time have not changed for
+// settle, oldest first. seen carries the candidates between polls.
+func pollDir(dir, pattern string, settle time.Duration, done, skip map[string]bool, seen map[string]*pending) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var ready []string
+	mtimes := map[string]time.Time{}
+	listed := map[string]bool{}
+	for _, e := range entries {
+		name := e.Name()
+		listed[name] = true
+		if done[name] || !e.Type().IsRegular() {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, name); !ok {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if abs, err := filepath.Abs(path); err == nil && skip[abs] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Removed or renamed since the listing
+			continue
+		}
+		p := seen[name]
+		if p == nil || p.size != info.Size() || !p.mtime.Equal(info.ModTime()) {
+			seen[name] = &pending{size: info.Size(), mtime: info.ModTime(), stable: now}
+			continue
+		}
+		if now.Sub(p.stable) >= settle {
+			ready = append(ready, name)
+			mtimes[name] = p.mtime
+		}
+	}
+	for name := range seen {
+		if !listed[name] {
+			delete(seen, name)
+		}
+	}
+	slices.SortFunc(ready, func(a, b string) int {
+		return cmp.Or(mtimes[a].Compare(mtimes[b]), cmp.Compare(a, b))
+	})
+	return ready, nil
+}
+
+// readProcessed loads the list of counted file names, one per line; a
+// missing list means nothing has been counted yet.
+func readProcessed(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("processed list: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if name := sc.Text(); name != "" {
+			done[name] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("processed list %s: %w", path, err)
+	}
+	return done, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A file is ready once its size and modification time have held for the
+// settle time: one still growing waits, and then files come oldest first,
+// minus those not matching the pattern, those already counted, the
+// state file's list and directories.
+func TestPollDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string, mtime time.Time) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := time.Now().Add(-time.Hour)
+	write("b.log", "10.0.0.2\n", base)
+	write("a.log", "10.0.0.1\n", base.Add(time.Minute))
+	write("old.log", "10.0.0.3\n", base.Add(-time.Minute))
+	write("notes.txt", "10.0.0.4\n", base)
+	write("seen.state.done", "old.log\n", base)
+	if err := os.Mkdir(filepath.Join(dir, "sub.log"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	done, err := readProcessed(filepath.Join(dir, "seen.state.done"))
+	if err != nil || !done["old.log"] || len(done) != 1 {
+		t.Fatalf("processed list: %v, %v", done, err)
+	}
+	skipPath, _ := filepath.Abs(filepath.Join(dir, "seen.state.done"))
+	skip := map[string]bool{skipPath: true}
+	seen := map[string]*pending{}
+	const settle = 50 * time.Millisecond
+
+	// First sight of a file starts its settle time
+	if ready, err := pollDir(dir, "*", settle, done, skip, seen); err != nil || len(ready) != 0 {
+		t.Fatalf("first poll: %v, %v", ready, err)
+	}
+	time.Sleep(2 * settle)
+	// a.log grows between polls, so only b.log and notes.txt are ready
+	write("a.log", "10.0.0.1\n10.0.0.5\n", base.Add(2*time.Minute))
+	ready, err := pollDir(dir, "*", settle, done, skip, seen)
+	if err != nil || !slices.Equal(ready, []string{"b.log", "notes.txt"}) {
+		t.Errorf("after settling: %v, %v; want b.log and notes.txt", ready, err)
+	}
+	ready, err = pollDir(dir, "*.log", settle, done, skip, seen)
+	if err != nil || !slices.Equal(ready, []string{"b.log"}) {
+		t.Errorf("*.log: %v, %v; want b.log", ready, err)
+	}
+	time.Sleep(2 * settle)
+	done["b.log"] = true
+	ready, err = pollDir(dir, "*.log", settle, done, skip, seen)
+	if err != nil || !slices.Equal(ready, []string{"a.log"}) {
+		t.Errorf("once a.log settles: %v, %v", ready, err)
+	}
+
+	// A file removed before it settles is forgotten
+	os.Remove(filepath.Join(dir, "notes.txt"))
+	if _, err := pollDir(dir, "*", settle, done, skip, seen); err != nil || seen["notes.txt"] != nil {
+		t.Errorf("removed notes.txt still pending: %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package window
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/roaring"
+)
+
+// Windowed counts the distinct addresses of a sliding window, such as the
+// last 24 hours, moved forward a slice at a time by the newest timestamp
+// added. Each slice keeps the addresses seen in it as a roaring bitmap,
+// and the count is that of their union, kept up to date as addresses are
+// added and as slices expire, when the addresses of the expiring slice
+// that no other slice holds leave it. A slice's bitmap takes 2 bytes an
+// address in sparse /16s and at most 8 KB a /16, plus 576 KB of container
+// slots and locks, about 14 MB for a day of hourly slices before any
+// address. It is safe for concurrent use.
+type Windowed struct {
+	window, slice int64 // lengths in ns, window a multiple of slice
+
+	mu     sync.Mutex
+	slices map[int64]*roaring.Set // slice start, Unix ns -> the addresses seen in it
+	count  int64                  // distinct addresses of the slices
+	newest int64                  // start of the newest slice
+	begun  bool                   // whether newest is set
+	late   int64                  // adds older than the window
+}
+
+// NewWindowed creates a Windowed over the last window, moved in steps of
+// slice, both aligned to the Unix epoch in UTC. It panics unless both are
+// positive and window is a multiple of slice.
+func NewWindowed(window, slice time.Duration) *Windowed {
+	if window <= 0 || slice <= 0 || window%slice != 0 {
+		panic(fmt.Sprintf("window: window %s is not a positive multiple of slice %s", window, slice))
+	}
+	return &Windowed{window: int64(window), slice: int64(slice), slices: make(map[int64]*roaring.Set)}
+}
+
+// Add records ip as seen at t, first moving the window to t if t is past
+// it, and reports whether ip is new to the window. An add older than the
+// window's start is late: it is counted by Late and changes nothing.
+func (w *Windowed) Add(ip uint32, t time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.sliceOf(t)
+	w.advance(s)
+	if s <= w.newest-w.window {
+		w.late++
+		return false
+	}
+	set := w.slices[s]
+	if set != nil && set.Contains(ip) {
+		return false
+	}
+	seen := w.holds(ip)
+	if set == nil {
+		set = roaring.NewSet()
+		w.slices[s] = set
+	}
+	set.Add(ip)
+	if !seen {
+		w.count++
+	}
+	return !seen
+}
+
+// Advance moves the window to t, expiring the slices that fall out of it,
+// as time passes without adds. It does nothing if t is not past the
+// window's newest slice.
+func (w *Windowed) Advance(t time.Time) {
+	w.mu.Lock()
+	w.advance(w.sliceOf(t))
+	w.mu.Unlock()
+}
+
+// Count returns the distinct addresses in the window.
+func (w *Windowed) Count() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// Late returns how many adds were older than the window.
+func (w *Windowed) Late() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.late
+}
+
+// Bounds returns the span of the window, start inclusive and end
+// exclusive, the end being that of the newest slice; both are zero before
+// the first add or Advance.
+func (w *Windowed) Bounds() (start, end time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.begun {
+		return time.Time{}, time.Time{}
+	}
+	end = time.Unix(0, w.newest+w.slice).UTC()
+	return end.Add(-time.Duration(w.window)), end
+}
+
+// sliceOf returns the start of the slice holding t.
+func (w *Windowed) sliceOf(t time.Time) int64 {
+	ns := t.UnixNano()
+	return ns - mod(ns, w.slice)
+}
+
+// advance makes s the newest slice if it is past the current one and
+// releases the slices that leave the window, uncounting the addresses
+// the slices left do not hold. The caller holds mu.
+func (w *Windowed) advance(s int64) {
+	if w.begun && s <= w.newest {
+		return
+	}
+	w.newest, w.begun = s, true
+	for start, set := range w.slices {
+		if start > s-w.window {
+			continue
+		}
+		delete(w.slices, start)
+		set.Each(func(ip uint32) {
+			if !w.holds(ip) {
+				w.count--
+			}
+		})
+	}
+}
+
+// holds reports whether any slice holds ip. The caller holds mu.
+func (w *Windowed) holds(ip uint32) bool {
+	for _, set := range w.slices {
+		if set.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addSliding records ip in the sliding window, first writing the rows of
+// the slices ts is past.
+func (t *tracker) addSliding(ts int64, ip uint32) error {
+	if start, _ := t.slide.Bounds(); !start.IsZero() && ts < start.UnixNano() {
+		t.late++
+		t.worst = max(t.worst, time.Duration(t.newest-ts))
+		return nil
+	}
+	t.newest = max(t.newest, ts)
+	if err := t.roll(ts, false); err != nil {
+		return err
+	}
+	t.slide.Add(ip, time.Unix(0, ts))
+	return nil
+}
+
+// roll writes a row for the window ending with each slice the window
+// moves past on its way to ts, while it holds addresses, and with last
+// also one for the window as it stands.
+func (t *tracker) roll(ts int64, last bool) error {
+	for {
+		_, end := t.slide.Bounds()
+		n := t.slide.Count()
+		if n == 0 || (ts < end.UnixNano() && !last) {
+			return nil
+		}
+		if _, err := fmt.Fprintf(t.opts.Out, "%s,%d\n", end.Format(time.RFC3339), n); err != nil {
+			return fmt.Errorf("write window: %w", err)
+		}
+		t.written++
+		if last {
+			return nil
+		}
+		t.slide.Advance(end)
+	}
+}
@@ -0,0 +1,82 @@
+package window
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Windowed fed timestamps mostly in order, some behind and some late,
+// holds the distinct addresses of the adds inside its bounds, and a
+// sliding count writes a row per slice while the window holds any.
+func TestWindowed(t *testing.T) {
+	rng := rand.New(rand.NewPCG(21, 22))
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	w := NewWindowed(6*time.Hour, time.Hour)
+	type add struct {
+		ip uint32
+		at time.Time
+	}
+	var kept []add
+	now := base
+	for i := range 20000 {
+		now = now.Add(time.Duration(rng.IntN(5)) * time.Second)
+		at := now.Add(-time.Duration(rng.IntN(8)) * time.Hour) // some past the window
+		ip := rng.Uint32N(3000)
+		start, _ := w.Bounds()
+		late := !start.IsZero() && at.Before(start)
+		w.Add(ip, at)
+		if !late {
+			kept = append(kept, add{ip, at})
+		}
+		if i%1000 != 999 {
+			continue
+		}
+		start, end := w.Bounds()
+		want := make(map[uint32]bool)
+		for _, a := range kept {
+			if !a.at.Before(start) && a.at.Before(end) {
+				want[a.ip] = true
+			}
+		}
+		if got := w.Count(); got != int64(len(want)) {
+			t.Fatalf("after %d adds: %d in [%s, %s), want %d", i+1, got, start, end, len(want))
+		}
+	}
+	if w.Late() == 0 {
+		t.Error("no add was late")
+	}
+	w.Advance(now.Add(7 * time.Hour))
+	if n := w.Count(); n != 0 {
+		t.Errorf("%d left once every slice expired", n)
+	}
+
+	var out strings.Builder
+	c := NewWithOptions(Options{Window: 2 * time.Hour, Slide: time.Hour, Out: &out,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	n, err := c.CountReader(context.Background(), strings.NewReader(`2024-05-01T00:10:00Z 1.1.1.1
+2024-05-01T00:20:00Z 2.2.2.2
+2024-05-01T01:05:00Z 1.1.1.1
+2024-05-01T02:30:00Z 3.3.3.3
+2024-05-01T01:59:00Z 4.4.4.4
+2024-05-01T00:30:00Z 5.5.5.5
+2024-05-01T09:00:00Z 6.6.6.6
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `window_end,unique_count
+2024-05-01T01:00:00Z,2
+2024-05-01T02:00:00Z,2
+2024-05-01T03:00:00Z,3
+2024-05-01T04:00:00Z,1
+2024-05-01T10:00:00Z,1
+`
+	if n != 6 || out.String() != want {
+		t.Errorf("%d unique, rows:\n%swant 6 and:\n%s", n, out.String(), want)
+	}
+}
@@ -0,0 +1,57 @@
+package window
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// TimeFormat parses the timestamp field of a line.
+type TimeFormat struct {
+	name   string
+	layout string // time.Parse layout, "" for the epoch forms
+	unit   time.Duration
+}
+
+// Named formats accepted by ParseTimeFormat besides Go layouts.
+var namedFormats = map[string]TimeFormat{
+	"RFC3339":  {name: "RFC3339", layout: time.RFC3339}, // also accepts fractional seconds
+	"RFC1123":  {name: "RFC1123", layout: time.RFC1123},
+	"DateTime": {name: "DateTime", layout: time.DateTime},
+	"unix":     {name: "unix", unit: time.Second},
+	"unixms":   {name: "unixms", unit: time.Millisecond},
+}
+
+// ParseTimeFormat returns the format named s: RFC3339, RFC1123, DateTime
+// (2006-01-02 15:04:05), unix or unixms (epoch seconds or milliseconds), or
+// otherwise a Go reference-time layout such as "02/Jan/2006:15:04:05".
+// Timestamps without a zone are taken as UTC.
+func ParseTimeFormat(s string) (TimeFormat, error) {
+	if f, ok := namedFormats[s]; ok {
+		return f, nil
+	}
+	ref := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	if _, err := time.Parse(s, ref.Format(s)); err != nil || ref.Format(s) == s {
+		return TimeFormat{}, fmt.Errorf("unknown time format %q (want RFC3339, RFC1123, DateTime, unix, unixms or a Go layout)", s)
+	}
+	return TimeFormat{name: s, layout: s}, nil
+}
+
+func (f TimeFormat) String() string {
+	return f.name
+}
+
+// Parse returns the instant in field.
+func (f TimeFormat) Parse(field []byte) (time.Time, error) {
+	if f.layout != "" {
+		return time.Parse(f.layout, string(field))
+	}
+	n, err := strconv.ParseInt(string(field), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if f.unit == time.Millisecond {
+		return time.UnixMilli(n).UTC(), nil
+	}
+	return time.Unix(n, 0).UTC(), nil
+}
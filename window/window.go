@@ -0,0 +1,401 @@
+// Package window counts unique IPv4 addresses per time window in
+// timestamped logs such as "2024-05-01T12:00:03Z 1.2.3.4". Each line's
+// timestamp picks a window; windows are kept open until the newest
+// timestamp seen is Lag past their end, then their count is written and
+// their set released, so memory holds only the windows still in flight.
+package window
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/adaptive"
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+const (
+	ctxCheckLines = 1 << 16         // lines between cancellation checks
+	bytesPerChunk = 1 * 1024 * 1024 // read buffer size
+)
+
+// Options configures a WindowCounter.
+type Options struct {
+	Parse   utils.ParseOptions // accepted address forms
+	MaxLine int                // longest line accepted, 0 for utils.DefaultMaxLine
+
+	Window time.Duration // window length, aligned to the Unix epoch in UTC
+
+	// Lag is how far behind the newest timestamp a line may be and still
+	// land in its window. A line later than that finds its window already
+	// written: it counts toward the total only and is reported as late.
+	// 0 means one Window. It does not apply with Slide.
+	Lag time.Duration
+
+	// Slide, if set, makes the windows slide rather than tile: a row is
+	// written each time the newest timestamp passes the end of a slice of
+	// this length, with the addresses of the Window up to there, which must
+	// be a multiple of Slide. A line more than Window behind the newest
+	// timestamp is late. 0 for tiled windows.
+	Slide time.Duration
+
+	Format TimeFormat // timestamp format, the zero value for RFC3339
+
+	// TimeField is the 1-based whitespace-separated field holding the
+	// timestamp, 0 for the first. The address is field 1, or field 2 when
+	// the timestamp is field 1, or with Parse.Extract wherever that finds
+	// it in the line.
+	TimeField int
+
+	// TimeExtract, if set, finds the timestamp in a line instead of
+	// TimeField, as Parse.Extract does the address.
+	TimeExtract utils.Extractor
+
+	// Out receives a "window_start,unique_count" header and one row per
+	// window as windows close, in ascending order, or with Slide a
+	// "window_end,unique_count" header and one row per slice while the
+	// window holds addresses; nil discards them.
+	Out io.Writer
+
+	Progress *counter.Progress // receives the input read as it goes, nil for none
+	Stats    *counter.Stats    // receives late and unparsable lines, nil to discard
+	Logger   *slog.Logger      // receives warnings about skipped and late lines, nil for slog.Default()
+}
+
+// Validate reports whether o can build a WindowCounter.
+func (o Options) Validate() error {
+	if o.Window <= 0 {
+		return fmt.Errorf("window must be positive, got %s", o.Window)
+	}
+	if o.Lag < 0 {
+		return fmt.Errorf("window lag must not be negative, got %s", o.Lag)
+	}
+	switch {
+	case o.Slide < 0:
+		return fmt.Errorf("window slide must not be negative, got %s", o.Slide)
+	case o.Slide > 0 && o.Window%o.Slide != 0:
+		return fmt.Errorf("window %s is not a multiple of the slide %s", o.Window, o.Slide)
+	case o.Slide > 0 && o.Lag > 0:
+		return fmt.Errorf("a sliding window takes no lag: lines up to a window behind count")
+	}
+	if o.TimeField < 0 {
+		return fmt.Errorf("time field must be positive, got %d", o.TimeField)
+	}
+	return nil
+}
+
+func init() {
+	counter.Register("window", func(o counter.Options) (counter.Counter, error) {
+		format, _ := ParseTimeFormat(cmp.Or(o.TimeFormat, "RFC3339")) // validated by the caller
+		opts := Options{
+			Parse:       o.Parse,
+			MaxLine:     o.MaxLine,
+			Window:      cmp.Or(o.Window, time.Hour),
+			Lag:         o.WindowLag,
+			Slide:       o.WindowSlide,
+			Format:      format,
+			TimeField:   o.TimeField,
+			TimeExtract: o.TimeExtract,
+			Out:         o.Output,
+			Stats:       o.Stats,
+			Progress:    o.Progress,
+			Logger:      o.Logger,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("window: %w", err)
+		}
+		return NewWithOptions(opts), nil
+	})
+}
+
+// WindowCounter counts unique IPs per time window and overall.
+type WindowCounter struct {
+	opts Options
+}
+
+// NewWithOptions creates a WindowCounter with the given options. It panics
+// if opts fail Validate.
+func NewWithOptions(opts Options) *WindowCounter {
+	if err := opts.Validate(); err != nil {
+		panic("window: " + err.Error())
+	}
+	opts.Lag = cmp.Or(opts.Lag, opts.Window)
+	opts.TimeField = cmp.Or(opts.TimeField, 1)
+	if opts.Format == (TimeFormat{}) {
+		opts.Format = namedFormats["RFC3339"]
+	}
+	if opts.Out == nil {
+		opts.Out = io.Discard
+	}
+	return &WindowCounter{opts: opts}
+}
+
+// CountUniqueIPs writes the per-window counts of a file to Options.Out and
+// returns the number of distinct IPv4s over all windows.
+func (c *WindowCounter) CountUniqueIPs(filename string) (int64, error) {
+	return c.CountUniqueIPsContext(context.Background(), filename)
+}
+
+// CountUniqueIPsContext is CountUniqueIPs with cancellation, checked every
+// ctxCheckLines lines.
+func (c *WindowCounter) CountUniqueIPsContext(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, &counter.OpenError{Path: filename, Err: err}
+	}
+	defer file.Close()
+	return c.CountReader(ctx, file)
+}
+
+// tracker holds the open windows of one run, or with Slide its sliding
+// window.
+type tracker struct {
+	opts    *Options
+	open    map[int64]map[uint32]struct{} // window start (Unix ns) -> addresses
+	slide   *Windowed                     // the sliding window, nil for tiled ones
+	newest  int64                         // latest timestamp seen, Unix ns
+	closed  int64                         // windows starting before this are written
+	late    int64                         // lines whose window was already written
+	worst   time.Duration                 // furthest any of them was behind newest
+	written int
+}
+
+// CountReader is CountUniqueIPsContext on r.
+func (c *WindowCounter) CountReader(ctx context.Context, r io.Reader) (int64, error) {
+	t := &tracker{opts: &c.opts, open: make(map[int64]map[uint32]struct{}), closed: minStart}
+	header := "window_start,unique_count"
+	if c.opts.Slide > 0 {
+		t.slide = NewWindowed(c.opts.Window, c.opts.Slide)
+		header = "window_end,unique_count"
+	}
+	if _, err := fmt.Fprintln(c.opts.Out, header); err != nil {
+		return 0, fmt.Errorf("write window: %w", err)
+	}
+	total := &totalSet{set: make(map[uint32]struct{})}
+	cr := utils.NewDelimChunkReader(c.opts.Progress.Reader(r), bytesPerChunk, c.opts.MaxLine, c.opts.Parse.Delim())
+	maxLine := cmp.Or(c.opts.MaxLine, utils.DefaultMaxLine)
+	var lines, oversized, badTime int64
+	delim := c.opts.Parse.Delim()
+	for {
+		ch, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, counter.WrapRead("", err)
+		}
+		for data := ch.Data; len(data) > 0; {
+			var raw []byte
+			raw, data = utils.NextRecord(data, delim)
+			if lines++; lines%ctxCheckLines == 0 {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+			}
+			if len(raw) > maxLine {
+				oversized++
+				continue
+			}
+			if c.opts.Parse.CommentPrefix != "" && c.opts.Parse.IsComment(bytes.TrimSpace(raw)) {
+				continue
+			}
+			tsField, ipField := c.fields(raw)
+			if len(ipField) == 0 {
+				continue
+			}
+			first, last, form, err := c.opts.Parse.ParseForm(ipField, ipField)
+			if err != nil {
+				c.opts.Parse.Malformed.Add(ipField, err)
+				continue
+			}
+			ts, err := c.opts.Format.Parse(tsField)
+			if err != nil {
+				badTime++
+				continue
+			}
+			c.opts.Parse.Canon.Add(first, last, form)
+			for ip := first; ; ip++ {
+				total.add(ip)
+				if err := t.add(ts.UnixNano(), ip); err != nil {
+					return 0, err
+				}
+				if ip == last {
+					break
+				}
+			}
+		}
+		cr.Release(ch)
+	}
+	if err := t.finish(); err != nil {
+		return 0, err
+	}
+
+	c.opts.Stats.Set("oversized lines", "%d", oversized+cr.Oversized())
+	if c.opts.Slide > 0 {
+		c.opts.Stats.Set("windows", "%d of %s, sliding by %s", t.written, c.opts.Window, c.opts.Slide)
+	} else {
+		c.opts.Stats.Set("windows", "%d of %s, lag %s", t.written, c.opts.Window, c.opts.Lag)
+	}
+	c.opts.Stats.Set("unparsable timestamps", "%d", badTime)
+	c.opts.Stats.Set("late lines", "%d", t.late)
+	if badTime > 0 {
+		counter.Logger(c.opts.Logger).Warn("skipped lines without a timestamp", "lines", badTime,
+			"format", c.opts.Format.String(), "field", c.opts.TimeField)
+	}
+	if t.late > 0 {
+		msg := "lines arrived after their window was written; raise -window-lag or sort the input. They count toward the total only"
+		if c.opts.Slide > 0 {
+			msg = "lines arrived more than a window behind the newest; sort the input. They count toward the total only"
+		}
+		counter.Logger(c.opts.Logger).Warn(msg, "lines", t.late, "behind", t.worst)
+	}
+	return total.count(), nil
+}
+
+// totalSet holds the addresses of every window: a hash set while that is
+// small, moved into a bitset past adaptive.DefaultThreshold entries as the
+// adaptive engine does.
+type totalSet struct {
+	set  map[uint32]struct{}
+	bits *concurrent.BitsetCounter
+	n    int64 // distinct addresses once in bits
+}
+
+func (t *totalSet) add(ip uint32) {
+	if t.bits != nil {
+		if t.bits.Add(ip) {
+			t.n++
+		}
+		return
+	}
+	t.set[ip] = struct{}{}
+	if len(t.set) >= adaptive.DefaultThreshold {
+		t.bits = concurrent.New()
+		for ip := range t.set {
+			t.bits.Add(ip)
+		}
+		t.n, t.set = int64(len(t.set)), nil
+	}
+}
+
+func (t *totalSet) count() int64 {
+	if t.bits != nil {
+		return t.n
+	}
+	return int64(len(t.set))
+}
+
+// Bounds of window starts, so flush can close every window.
+const (
+	minStart = -1 << 63
+	maxStart = 1<<63 - 1
+)
+
+// add records ip in the window holding ts, first writing out the windows
+// that ended more than Lag before the newest timestamp.
+func (t *tracker) add(ts int64, ip uint32) error {
+	if t.slide != nil {
+		return t.addSliding(ts, ip)
+	}
+	start := ts - mod(ts, int64(t.opts.Window))
+	if start < t.closed {
+		t.late++
+		t.worst = max(t.worst, time.Duration(t.newest-ts))
+		return nil
+	}
+	set := t.open[start]
+	if set == nil {
+		set = make(map[uint32]struct{})
+		t.open[start] = set
+	}
+	set[ip] = struct{}{}
+
+	if ts <= t.newest {
+		return nil
+	}
+	t.newest = ts
+	// Windows whose end is at least Lag behind the newest timestamp close
+	horizon := ts - int64(t.opts.Lag)
+	return t.flush(horizon - mod(horizon, int64(t.opts.Window)) - int64(t.opts.Window) + 1)
+}
+
+// finish writes the windows still open, or the sliding window as of the
+// newest timestamp.
+func (t *tracker) finish() error {
+	if t.slide != nil {
+		return t.roll(maxStart, true)
+	}
+	return t.flush(maxStart)
+}
+
+// flush writes and releases every open window starting before limit,
+// oldest first, and marks them closed.
+func (t *tracker) flush(limit int64) error {
+	if limit <= t.closed {
+		return nil
+	}
+	var done []int64
+	for start := range t.open {
+		if start < limit {
+			done = append(done, start)
+		}
+	}
+	slices.Sort(done)
+	for _, start := range done {
+		ws := time.Unix(0, start).UTC().Format(time.RFC3339)
+		if _, err := fmt.Fprintf(t.opts.Out, "%s,%d\n", ws, len(t.open[start])); err != nil {
+			return fmt.Errorf("write window: %w", err)
+		}
+		delete(t.open, start)
+		t.written++
+	}
+	t.closed = limit
+	return nil
+}
+
+// mod is the non-negative remainder, so windows before 1970 align too.
+func mod(a, b int64) int64 {
+	if m := a % b; m < 0 {
+		return m + b
+	}
+	return a % b
+}
+
+// fields returns the timestamp and address fields of line. With
+// TimeExtract the address is field 1, and with Parse.Extract its field is
+// the whole line, which ParseForm finds it in.
+func (c *WindowCounter) fields(line []byte) (ts, ip []byte) {
+	timeField, ipField := c.opts.TimeField, 1
+	if c.opts.TimeExtract != nil {
+		ts, _ = c.opts.TimeExtract(bytes.TrimSpace(line))
+		timeField = 0
+	} else if timeField == 1 {
+		ipField = 2
+	}
+	if c.opts.Parse.Extract != nil {
+		ip, ipField = bytes.TrimSpace(line), 0
+	}
+	for i, n := 1, max(ipField, timeField); i <= n; i++ {
+		line = bytes.TrimLeft(line, " \t\r")
+		end := bytes.IndexAny(line, " \t\r")
+		if end < 0 {
+			end = len(line)
+		}
+		switch i {
+		case timeField:
+			ts = line[:end]
+		case ipField:
+			ip = line[:end]
+		}
+		line = line[end:]
+	}
+	return ts, ip
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/concurrent"
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/ipcount"
+)
+
+const (
+	dayLayout      = "2006-01-02"
+	snapshotSuffix = ".snapshot"
+)
+
+// timeWindowFlags are the engine flags of the per-time-window counter,
+// whose -window the window subcommand's own, in days, replaces.
+var timeWindowFlags = map[string]bool{"window": true, "window-lag": true, "window-slide": true, "time-format": true, "time-field": true}
+
+// windowResult is what rolling a day into the window found.
+type windowResult struct {
+	today   int64    // distinct addresses of the day, earlier runs of it included
+	new     int64    // of those, the ones no other day of the window held
+	total   int64    // distinct addresses of the whole window
+	skipped []string // days of the window left out, each with the reason
+	pruned  int      // snapshots removed for falling out of the window
+}
+
+// runWindow implements `ipcounter window`: count the inputs into the
+// day's snapshot in -state-dir, then report the union of the last -window
+// days' snapshots, merged shard by shard, and remove older ones, so a
+// rolling total costs a day of logs rather than the whole window.
+func runWindow(args []string) error {
+	fs := flag.NewFlagSet("window", flag.ExitOnError)
+	stateDir := fs.String("state-dir", "", "directory of the daily snapshots, created if missing (required)")
+	days := fs.Int("window", 7, "days in the window, the counted one included")
+	day := fs.String("date", "", "day the inputs are counted into, as YYYY-MM-DD (default today, local time)")
+	engine := flag.NewFlagSet("window", flag.ExitOnError)
+	ef := addEngineFlags(engine)
+	engine.VisitAll(func(f *flag.Flag) {
+		if !timeWindowFlags[f.Name] {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ipcounter window -state-dir DIR [-window 7] [-date YYYY-MM-DD] [flags] <filename>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *stateDir == "" || fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *days < 1 {
+		return fmt.Errorf("-window must be at least 1 day, got %d", *days)
+	}
+	date := time.Now()
+	if *day != "" {
+		var err error
+		if date, err = time.ParseInLocation(dayLayout, *day, time.Local); err != nil {
+			return fmt.Errorf("-date: %w", err)
+		}
+	}
+	opts, err := ef.options()
+	if err != nil {
+		return err
+	}
+	if opts.InputFormat == "pcap" || opts.InputFormat == "parquet" {
+		return fmt.Errorf("window cannot read -input-format %s", opts.InputFormat)
+	}
+	if opts.StateFile != "" || opts.AddressSpace.IsValid() {
+		return errors.New("window keeps its sets in -state-dir, of the full address space")
+	}
+
+	res, err := rollWindow(interruptContext(), *stateDir, date, *days, fs.Args(), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Today's IPv4 addresses: %d\n", res.today)
+	fmt.Printf("New IPv4 addresses: %d\n", res.new)
+	fmt.Printf("IPv4 addresses over %d days: %d\n", *days, res.total)
+	if len(res.skipped) > 0 {
+		fmt.Printf("Days left out: %s\n", strings.Join(res.skipped, "; "))
+	}
+	return nil
+}
+
+// rollWindow counts inputs into the snapshot of date in dir, adding to it
+// if an earlier run of the day left one, and merges the snapshots of the
+// days days up to date into the window's union. A snapshot that is
+// missing or fails to load is logged and left out, not fatal; days before
+// the oldest snapshot are not missing, just not recorded yet. Snapshots
+// of days before the window are removed once the union is known.
+func rollWindow(ctx context.Context, dir string, date time.Time, days int, inputs []string, opts counter.Options) (windowResult, error) {
+	var res windowResult
+	log := counter.Logger(opts.Logger)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return res, fmt.Errorf("-state-dir: %w", err)
+	}
+	recorded, err := daySnapshots(dir)
+	if err != nil {
+		return res, err
+	}
+	newSet := func() (*concurrent.BitsetCounter, error) {
+		c, err := counter.NewWithOptions("concurrent", opts)
+		if err != nil {
+			return nil, err
+		}
+		return c.(*concurrent.BitsetCounter), nil
+	}
+
+	todayPath := filepath.Join(dir, date.Format(dayLayout)+snapshotSuffix)
+	today, err := newSet()
+	if err != nil {
+		return res, err
+	}
+	if _, err := today.LoadSnapshotFile(todayPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// What it held is lost; today's inputs at least are not
+		log.Warn("replacing today's snapshot", "err", err)
+		if today, err = newSet(); err != nil {
+			return res, err
+		}
+	}
+	src := ipcount.File(inputs[0])
+	if len(inputs) > 1 {
+		src = ipcount.Files(inputs...)
+	}
+	if _, err := ipcount.Count(ctx, src, ipcount.WithEngine("concurrent"), ipcount.WithCounter(today), ipcount.WithOptions(opts)); err != nil {
+		return res, err
+	}
+	if err := today.WriteSnapshotFile(todayPath); err != nil {
+		return res, err
+	}
+	res.today = today.Count()
+
+	union, err := newSet()
+	if err != nil {
+		return res, err
+	}
+	first := date.AddDate(0, 0, 1-days)
+	for d := first; d.Before(date); d = d.AddDate(0, 0, 1) {
+		name := d.Format(dayLayout)
+		set, err := newSet()
+		if err != nil {
+			return res, err
+		}
+		if _, err = set.LoadSnapshotFile(filepath.Join(dir, name+snapshotSuffix)); err == nil {
+			_, err = union.Merge(set)
+		}
+		switch {
+		case errors.Is(err, os.ErrNotExist) && (len(recorded) == 0 || name < recorded[0]):
+		case errors.Is(err, os.ErrNotExist):
+			log.Warn("day missing from the window", "day", name)
+			res.skipped = append(res.skipped, name+" missing")
+		case errors.Is(err, concurrent.ErrBadSnapshot):
+			log.Warn("day left out of the window", "day", name, "err", err)
+			res.skipped = append(res.skipped, name+" unreadable")
+		case err != nil:
+			return res, err
+		}
+	}
+	if res.new, err = union.Merge(today); err != nil {
+		return res, err
+	}
+	res.total = union.Count()
+
+	for _, name := range recorded {
+		if name < first.Format(dayLayout) {
+			if err := os.Remove(filepath.Join(dir, name+snapshotSuffix)); err != nil {
+				return res, fmt.Errorf("prune: %w", err)
+			}
+			res.pruned++
+		}
+	}
+	log.Info("window rolled", "day", date.Format(dayLayout), "days", days, "total", res.total, "pruned", res.pruned)
+	return res, nil
+}
+
+// daySnapshots returns the days dir holds a snapshot of, as YYYY-MM-DD,
+// oldest first.
+func daySnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("-state-dir: %w", err)
+	}
+	var days []string
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), snapshotSuffix)
+		if _, err := time.Parse(dayLayout, name); ok && err == nil && e.Type().IsRegular() {
+			days = append(days, name)
+		}
+	}
+	return days, nil // ReadDir sorts by name, which sorts the days
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sveta-1999/IPCounter/counter"
+	"github.com/Sveta-1999/IPCounter/utils"
+)
+
+// Ten days rolled into a 7-day window give the totals of recounting the
+// window's files from scratch, day after day: a day whose snapshot was
+// corrupted or deleted is left out and reported, a second run of a day
+// adds to its snapshot, and days before the window are pruned.
+func TestRollWindow(t *testing.T) {
+	const days, window = 10, 7
+	dir, stateDir := t.TempDir(), filepath.Join(t.TempDir(), "state")
+	opts := counter.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	rng := rand.New(rand.NewPCG(16, 17))
+	start := time.Date(2026, 3, 25, 0, 0, 0, 0, time.Local) // across the DST change
+	sets := make([]map[uint32]bool, days)
+	lost := map[int]string{4: "unreadable", 6: "missing"}
+
+	for k := range days {
+		sets[k] = make(map[uint32]bool)
+		var inputs []string
+		for f := range 1 + k%2 {
+			var b strings.Builder
+			for range 800 {
+				ip := 10<<24 | rng.Uint32N(1<<12) // shared among days
+				if rng.IntN(4) == 0 {
+					ip = rng.Uint32()
+				}
+				sets[k][ip] = true
+				fmt.Fprintf(&b, "%s\n", utils.FormatIPv4(ip))
+			}
+			path := filepath.Join(dir, fmt.Sprintf("day%d-%d.log", k, f))
+			if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			inputs = append(inputs, path)
+		}
+		date := start.AddDate(0, 0, k)
+		var res windowResult
+		var err error
+		for _, in := range inputs { // a run a file
+			if res, err = rollWindow(context.Background(), stateDir, date, window, []string{in}, opts); err != nil {
+				t.Fatalf("day %d: %v", k, err)
+			}
+		}
+
+		union, others := make(map[uint32]bool), make(map[uint32]bool)
+		var skipped []string
+		for j := max(0, k-window+1); j <= k; j++ {
+			if why, ok := lost[j]; ok && j < k {
+				skipped = append(skipped, start.AddDate(0, 0, j).Format(dayLayout)+" "+why)
+				continue
+			}
+			for ip := range sets[j] {
+				union[ip] = true
+				if j < k {
+					others[ip] = true
+				}
+			}
+		}
+		var fresh int64
+		for ip := range sets[k] {
+			if !others[ip] {
+				fresh++
+			}
+		}
+		if res.today != int64(len(sets[k])) || res.new != fresh || res.total != int64(len(union)) ||
+			strings.Join(res.skipped, ";") != strings.Join(skipped, ";") {
+			t.Errorf("day %d: %d today, %d new, %d in the window, left out %q; want %d, %d, %d, %q",
+				k, res.today, res.new, res.total, res.skipped, len(sets[k]), fresh, len(union), skipped)
+		}
+
+		snapshot := filepath.Join(stateDir, date.Format(dayLayout)+snapshotSuffix)
+		switch lost[k] {
+		case "unreadable":
+			if err := os.WriteFile(snapshot, []byte("ipcset01 but not much else"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		case "missing":
+			if err := os.Remove(snapshot); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	kept, err := daySnapshots(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := start.AddDate(0, 0, days-window).Format(dayLayout); len(kept) != window-1 || kept[0] != first {
+		t.Errorf("kept %q, want the %d days from %s but the deleted one", kept, window, first)
+	}
+}